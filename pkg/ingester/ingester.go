@@ -446,7 +446,7 @@ func New(cfg Config, limits *validation.Overrides, ingestersRing ring.ReadRing,
 		// where N is the total number of ingesters. Each ingester is part of their own consumer group
 		// so that they all replay the owned partition with no gaps.
 		kafkaCfg.FallbackClientErrorSampleRate = cfg.ErrorSampleRate
-		i.ingestReader, err = ingest.NewPartitionReaderForPusher(kafkaCfg, i.ingestPartitionID, cfg.IngesterRing.InstanceID, i, log.With(logger, "component", "ingest_reader"), registerer)
+		i.ingestReader, err = ingest.NewPartitionReaderForPusher(kafkaCfg, i.ingestPartitionID, cfg.IngesterRing.InstanceID, i, i.limits, log.With(logger, "component", "ingest_reader"), registerer)
 		if err != nil {
 			return nil, errors.Wrap(err, "creating ingest storage reader")
 		}
@@ -4020,6 +4020,11 @@ func (i *Ingester) CheckReady(ctx context.Context) error {
 	if err := i.checkAvailableForRead(); err != nil {
 		return fmt.Errorf("ingester not ready for reads: %v", err)
 	}
+	if i.ingestReader != nil {
+		if err := i.ingestReader.CheckHealth(); err != nil {
+			return fmt.Errorf("ingest storage reader not healthy: %v", err)
+		}
+	}
 	return i.lifecycler.CheckReady(ctx)
 }
 
@@ -0,0 +1,183 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// batchMagic prefixes the content of the records holding a gzip-compressed batch of records. Its first byte is the
+// tag of a protobuf field with number 0, which is invalid, so it's never the prefix of an uncompressed write request,
+// and it's different from the first byte of the magic bytes of each Decompressor.
+var batchMagic = []byte{0x00, 'm', 'b', 0x01}
+
+// maxBatchEntryBytes is the maximum size of the content of a record in a batch. It protects from allocating huge
+// buffers when the length of an entry is corrupted.
+const maxBatchEntryBytes = 64 << 20
+
+// BatchEntry is a record of a batch of records.
+type BatchEntry struct {
+	// TenantID is the tenant the record belongs to. If empty, the record belongs to the tenant the batch has been written with.
+	TenantID string
+	// Content is the content of the record, which is a write request optionally compressed with one of the supported codecs.
+	Content []byte
+}
+
+// EncodeBatch encodes the entries as the content of a single record, to reduce the per-record overhead when producing
+// many small records. After the magic bytes, the content is a gzip stream of entries, each made of the uvarint-prefixed
+// tenant ID followed by the uvarint-prefixed content.
+func EncodeBatch(entries []BatchEntry) ([]byte, error) {
+	buf := bytes.NewBuffer(append([]byte(nil), batchMagic...))
+	w := gzip.NewWriter(buf)
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, e := range entries {
+		for _, field := range [][]byte{[]byte(e.TenantID), e.Content} {
+			n := binary.PutUvarint(lenBuf[:], uint64(len(field)))
+			if _, err := w.Write(lenBuf[:n]); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(field); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// isBatch returns whether the content of a record is a batch of records encoded by EncodeBatch.
+func isBatch(content []byte) bool {
+	return bytes.HasPrefix(content, batchMagic)
+}
+
+// BatchDecoder decodes the entries of a batch of records encoded by EncodeBatch. The batch is decompressed while
+// the entries are read, so only the entry being read is held in memory instead of the whole decompressed batch.
+type BatchDecoder struct {
+	gz *gzip.Reader
+	r  *bufio.Reader
+}
+
+// NewBatchDecoder returns a BatchDecoder reading the entries of the batch in content.
+func NewBatchDecoder(content []byte) (*BatchDecoder, error) {
+	if !isBatch(content) {
+		return nil, errors.New("the content isn't a batch of records")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(content[len(batchMagic):]))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing batch of records: %w", err)
+	}
+	return &BatchDecoder{gz: gz, r: bufio.NewReader(gz)}, nil
+}
+
+// Next returns the next entry of the batch, or io.EOF once all the entries have been read.
+func (d *BatchDecoder) Next() (BatchEntry, error) {
+	tenantID, err := d.readField()
+	if errors.Is(err, io.EOF) {
+		return BatchEntry{}, io.EOF
+	}
+	if err != nil {
+		return BatchEntry{}, fmt.Errorf("reading tenant of batched record: %w", err)
+	}
+
+	content, err := d.readField()
+	if err != nil {
+		// The batch can't end between the tenant and the content of an entry.
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return BatchEntry{}, fmt.Errorf("reading content of batched record: %w", err)
+	}
+
+	return BatchEntry{TenantID: string(tenantID), Content: content}, nil
+}
+
+// readField reads a uvarint-prefixed field. It returns io.EOF only if the batch ends before the field.
+func (d *BatchDecoder) readField() ([]byte, error) {
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxBatchEntryBytes {
+		return nil, fmt.Errorf("size %d exceeds the maximum of %d bytes", size, maxBatchEntryBytes)
+	}
+
+	field := make([]byte, size)
+	if _, err := io.ReadFull(d.r, field); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return field, nil
+}
+
+// Close releases the resources of the decoder.
+func (d *BatchDecoder) Close() error {
+	return d.gz.Close()
+}
+
+// splitBatch sends the records of the batch held by r to the output channel, as they're decoded, until the batch
+// has been read or the context is cancelled. The records inherit the tracing context and the offset of r. If the
+// batch is corrupted, a record holding the error is sent after the records decoded so far, so that it's skipped
+// like any other record which can't be parsed. The entries already consumed by a previous consume are skipped.
+//
+// The splitting also stops if stop, unless it's nil, returns true before an entry other than the first one sent.
+// It returns the number of entries of the batch consumed so far, including the skipped ones, and whether the batch
+// has been completely split.
+func (c pusherConsumer) splitBatch(ctx context.Context, r record, ch chan<- record, stop func() bool) (int, bool) {
+	send := func(rec record) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case ch <- rec:
+			return true
+		}
+	}
+
+	d, err := NewBatchDecoder(r.content)
+	if err != nil {
+		return r.consumedBatchEntries, send(record{ctx: r.ctx, tenantID: r.tenantID, offset: r.offset, timestamp: r.timestamp, err: err})
+	}
+	defer d.Close()
+
+	consumed := 0
+	for {
+		entry, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return consumed, true
+		}
+		if err != nil {
+			return consumed, send(record{ctx: r.ctx, tenantID: r.tenantID, offset: r.offset, timestamp: r.timestamp, err: err})
+		}
+		if consumed < r.consumedBatchEntries {
+			consumed++
+			continue
+		}
+		if consumed > r.consumedBatchEntries && stop != nil && stop() {
+			return consumed, false
+		}
+
+		tenantID := entry.TenantID
+		if tenantID == "" {
+			tenantID = r.tenantID
+		}
+
+		c.metrics.batchedRecords.Inc()
+		if !send(record{ctx: r.ctx, tenantID: tenantID, content: entry.Content, offset: r.offset, timestamp: r.timestamp}) {
+			return consumed, false
+		}
+		consumed++
+	}
+}
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestBatchDecoder(t *testing.T) {
+	entries := []BatchEntry{
+		{TenantID: "user-1", Content: []byte("record-1")},
+		{TenantID: "", Content: []byte("record-2")},
+		{TenantID: "user-2", Content: []byte{}},
+	}
+
+	t.Run("should decode the entries of a batch", func(t *testing.T) {
+		content, err := EncodeBatch(entries)
+		require.NoError(t, err)
+		require.True(t, isBatch(content))
+		require.Nil(t, detectDecompressor(defaultDecompressors, content))
+
+		d, err := NewBatchDecoder(content)
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, d.Close()) })
+
+		var actual []BatchEntry
+		for {
+			e, err := d.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			actual = append(actual, e)
+		}
+		assert.Equal(t, entries, actual)
+	})
+
+	t.Run("should fail if the content isn't a batch", func(t *testing.T) {
+		_, err := NewBatchDecoder([]byte("not a batch"))
+		require.Error(t, err)
+	})
+
+	t.Run("should fail if the batch is truncated", func(t *testing.T) {
+		content, err := EncodeBatch(entries)
+		require.NoError(t, err)
+
+		d, err := NewBatchDecoder(content[:len(content)-10])
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = d.Close() })
+
+		for {
+			_, err = d.Next()
+			if err != nil {
+				break
+			}
+		}
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestPusherConsumer_ShouldConsumeBatchesOfRecords(t *testing.T) {
+	newContent := func(metricName string) []byte {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return content
+	}
+	newBatch := func(entries ...BatchEntry) []byte {
+		content, err := EncodeBatch(entries)
+		require.NoError(t, err)
+		return content
+	}
+
+	validBatch := newBatch(
+		BatchEntry{Content: newContent("series_2")},
+		BatchEntry{TenantID: "user-2", Content: gzipCompress(t, newContent("series_3"))},
+	)
+	corruptedBatch := newBatch(BatchEntry{Content: newContent("series_5")}, BatchEntry{Content: newContent("series_6")})
+	corruptedBatch = corruptedBatch[:len(corruptedBatch)-10]
+
+	type pushed struct {
+		tenantID   string
+		metricName string
+	}
+	var (
+		pushesMx sync.Mutex
+		pushes   []pushed
+	)
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := user.ExtractOrgID(ctx)
+		require.NoError(t, err)
+
+		pushesMx.Lock()
+		defer pushesMx.Unlock()
+		pushes = append(pushes, pushed{tenantID: tenantID, metricName: request.Timeseries[0].Labels[0].Value})
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), []record{
+		{ctx: context.Background(), tenantID: "user-1", content: newContent("series_1")},
+		{ctx: context.Background(), tenantID: "user-1", content: validBatch},
+		{ctx: context.Background(), tenantID: "user-1", content: newContent("series_4")},
+		{ctx: context.Background(), tenantID: "user-1", content: corruptedBatch},
+	}))
+
+	// The records of the corrupted batch decoded before the corruption may or may not be pushed,
+	// depending on how much of the batch is lost, so only the first pushes are checked.
+	require.GreaterOrEqual(t, len(pushes), 4)
+	assert.Equal(t, []pushed{
+		{tenantID: "user-1", metricName: "series_1"},
+		{tenantID: "user-1", metricName: "series_2"},
+		{tenantID: "user-2", metricName: "series_3"},
+		{tenantID: "user-1", metricName: "series_4"},
+	}, pushes[:4])
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_parse_errors_total Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.
+		# TYPE cortex_ingest_storage_reader_parse_errors_total counter
+		cortex_ingest_storage_reader_parse_errors_total 1
+	`), "cortex_ingest_storage_reader_parse_errors_total"))
+}
@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// chunkMagic prefixes the content of the records holding a chunk of a record too large to be produced as a single
+// record. Like batchMagic, its first byte is the tag of a protobuf field with number 0, so it's never the prefix of
+// an uncompressed write request, and the magic bytes differ from the ones of the batches.
+var chunkMagic = []byte{0x00, 'm', 'c', 0x01}
+
+// maxChunkedRecordBytes is the maximum size of the content of a record reassembled from its chunks. It protects from
+// buffering huge records when the chunks are corrupted.
+const maxChunkedRecordBytes = maxBatchEntryBytes
+
+// maxChunksPerRecord is the maximum number of chunks a record can be split into.
+const maxChunksPerRecord = 1 << 16
+
+// EncodeChunks splits the content of a record into the contents of chunk records of at most maxChunkBytes of content
+// each, plus the framing. The chunks must be produced to the same partition, with the same tenant, and the recordID
+// must be unique among the records of the tenant whose chunks may be consumed together.
+//
+// After the magic bytes, the content of a chunk record is made of the uvarint-prefixed record ID, the uvarint index of
+// the chunk, the uvarint number of chunks of the record, and the chunk of the record's content until the end.
+func EncodeChunks(recordID string, content []byte, maxChunkBytes int) ([][]byte, error) {
+	if maxChunkBytes <= 0 {
+		return nil, errors.New("the maximum size of the chunks must be greater than 0")
+	}
+	if len(content) > maxChunkedRecordBytes {
+		return nil, fmt.Errorf("the record size %d exceeds the maximum of %d bytes", len(content), maxChunkedRecordBytes)
+	}
+
+	count := max(1, (len(content)+maxChunkBytes-1)/maxChunkBytes)
+	if count > maxChunksPerRecord {
+		return nil, fmt.Errorf("the record would be split into %d chunks, exceeding the maximum of %d chunks", count, maxChunksPerRecord)
+	}
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		payload := content[i*maxChunkBytes : min((i+1)*maxChunkBytes, len(content))]
+
+		chunk := append([]byte(nil), chunkMagic...)
+		chunk = binary.AppendUvarint(chunk, uint64(len(recordID)))
+		chunk = append(chunk, recordID...)
+		chunk = binary.AppendUvarint(chunk, uint64(i))
+		chunk = binary.AppendUvarint(chunk, uint64(count))
+		chunks = append(chunks, append(chunk, payload...))
+	}
+	return chunks, nil
+}
+
+// isChunk returns whether the content of a record is a chunk of a record encoded by EncodeChunks.
+func isChunk(content []byte) bool {
+	return bytes.HasPrefix(content, chunkMagic)
+}
+
+// recordChunk is a chunk of a record decoded from the content of a chunk record.
+type recordChunk struct {
+	recordID string
+	index    int
+	count    int
+	payload  []byte
+}
+
+// decodeChunk decodes the chunk of a record encoded by EncodeChunks.
+func decodeChunk(content []byte) (recordChunk, error) {
+	buf := content[len(chunkMagic):]
+
+	idLen, n := binary.Uvarint(buf)
+	if n <= 0 || idLen > uint64(len(buf)-n) {
+		return recordChunk{}, errors.New("reading record ID of chunk: corrupted chunk")
+	}
+	buf = buf[n:]
+	recordID := string(buf[:idLen])
+	buf = buf[idLen:]
+
+	index, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return recordChunk{}, errors.New("reading index of chunk: corrupted chunk")
+	}
+	buf = buf[n:]
+
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count == 0 || index >= count || count > maxChunksPerRecord {
+		return recordChunk{}, fmt.Errorf("reading number of chunks: invalid chunk %d of %d", index, count)
+	}
+
+	return recordChunk{recordID: recordID, index: int(index), count: int(count), payload: buf[n:]}, nil
+}
+
+// chunkedRecord is a record being reassembled from its chunks.
+type chunkedRecord struct {
+	// first is the first chunk record received, whose context and timestamp are inherited by the reassembled record.
+	first    record
+	offsets  []int64
+	payloads [][]byte
+	received int
+	size     int
+}
+
+// chunkAssembler reassembles the records split into chunk records by EncodeChunks. The chunks of a record may be
+// received in any order, and interleaved with other records, as long as they're consumed together. It's not safe
+// for concurrent use.
+type chunkAssembler struct {
+	records map[string]*chunkedRecord
+
+	reassembled prometheus.Counter
+	incomplete  prometheus.Counter
+	logger      log.Logger
+}
+
+func newChunkAssembler(metrics *pusherConsumerMetrics, logger log.Logger) *chunkAssembler {
+	return &chunkAssembler{
+		records:     map[string]*chunkedRecord{},
+		reassembled: metrics.reassembledRecords,
+		incomplete:  metrics.incompleteChunkedRecords,
+		logger:      logger,
+	}
+}
+
+// add adds the chunk record r. Once all the chunks of its record have been added, it returns the reassembled record,
+// true, and the offsets of the chunks other than the one of the reassembled record, which is the lowest. If the chunk
+// is corrupted or inconsistent with the previous chunks, it returns a record holding the error instead, so that it's
+// skipped like any other record which can't be parsed, and the chunks of the record added so far are discarded.
+func (a *chunkAssembler) add(r record) (_ record, _ bool, others []int64) {
+	chunk, err := decodeChunk(r.content)
+	if err != nil {
+		return record{ctx: r.ctx, tenantID: r.tenantID, offset: r.offset, timestamp: r.timestamp, err: err}, true, nil
+	}
+
+	// The record IDs are unique per tenant only.
+	key := r.tenantID + "/" + chunk.recordID
+	rec, ok := a.records[key]
+	if !ok {
+		rec = &chunkedRecord{first: r, payloads: make([][]byte, chunk.count)}
+		a.records[key] = rec
+	}
+
+	rec.size += len(chunk.payload)
+	switch {
+	case len(rec.payloads) != chunk.count:
+		err = fmt.Errorf("the chunk %d of record %s has %d chunks, while the previous ones had %d", chunk.index, chunk.recordID, chunk.count, len(rec.payloads))
+	case rec.payloads[chunk.index] != nil:
+		err = fmt.Errorf("the chunk %d of record %s has been received twice", chunk.index, chunk.recordID)
+	case rec.size > maxChunkedRecordBytes:
+		err = fmt.Errorf("the chunks of record %s exceed the maximum of %d bytes", chunk.recordID, maxChunkedRecordBytes)
+	}
+	rec.offsets = append(rec.offsets, r.offset)
+	if err != nil {
+		delete(a.records, key)
+		failed := record{ctx: rec.first.ctx, tenantID: r.tenantID, timestamp: rec.first.timestamp, err: err}
+		failed.offset, others = splitOffsets(rec.offsets)
+		return failed, true, others
+	}
+
+	// The payload of a chunk is never nil, even if it's empty, so a nil payload is a chunk not received yet.
+	rec.payloads[chunk.index] = chunk.payload
+	rec.received++
+	if rec.received < len(rec.payloads) {
+		return record{}, false, nil
+	}
+
+	delete(a.records, key)
+	a.reassembled.Inc()
+
+	reassembled := rec.first
+	reassembled.content = bytes.Join(rec.payloads, nil)
+	reassembled.offset, others = splitOffsets(rec.offsets)
+	return reassembled, true, others
+}
+
+// splitOffsets sorts the offsets of the chunks of a record, and returns the lowest one and the other ones.
+func splitOffsets(offsets []int64) (int64, []int64) {
+	slices.Sort(offsets)
+	return offsets[0], offsets[1:]
+}
+
+// discardIncomplete counts, logs and discards the records whose chunks haven't all been added.
+func (a *chunkAssembler) discardIncomplete() {
+	for key, rec := range a.records {
+		a.incomplete.Inc()
+		level.Warn(a.logger).Log("msg", "discarded record whose chunks have not all been consumed", "user", rec.first.tenantID, "first_offset", slices.Min(rec.offsets), "received_chunks", rec.received, "chunks", len(rec.payloads))
+		delete(a.records, key)
+	}
+}
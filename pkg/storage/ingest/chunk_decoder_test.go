@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestEncodeChunks(t *testing.T) {
+	t.Run("should split the content into chunks which can be decoded", func(t *testing.T) {
+		content := []byte("0123456789")
+		chunks, err := EncodeChunks("record-1", content, 4)
+		require.NoError(t, err)
+		require.Len(t, chunks, 3)
+
+		var reassembled []byte
+		for i, c := range chunks {
+			require.True(t, isChunk(c))
+			require.False(t, isBatch(c))
+			require.Nil(t, detectDecompressor(defaultDecompressors, c))
+
+			chunk, err := decodeChunk(c)
+			require.NoError(t, err)
+			assert.Equal(t, "record-1", chunk.recordID)
+			assert.Equal(t, i, chunk.index)
+			assert.Equal(t, 3, chunk.count)
+			reassembled = append(reassembled, chunk.payload...)
+		}
+		assert.Equal(t, content, reassembled)
+	})
+
+	t.Run("should encode an empty content as a single chunk", func(t *testing.T) {
+		chunks, err := EncodeChunks("record-1", nil, 4)
+		require.NoError(t, err)
+		require.Len(t, chunks, 1)
+
+		chunk, err := decodeChunk(chunks[0])
+		require.NoError(t, err)
+		assert.Equal(t, 1, chunk.count)
+		assert.Empty(t, chunk.payload)
+		assert.NotNil(t, chunk.payload)
+	})
+
+	t.Run("should fail if the maximum size of the chunks is invalid", func(t *testing.T) {
+		_, err := EncodeChunks("record-1", []byte("content"), 0)
+		require.Error(t, err)
+	})
+
+	t.Run("should fail to decode a truncated chunk", func(t *testing.T) {
+		chunks, err := EncodeChunks("record-1", []byte("content"), 4)
+		require.NoError(t, err)
+
+		_, err = decodeChunk(chunks[0][:len(chunkMagic)+3])
+		require.Error(t, err)
+	})
+}
+
+func TestPusherConsumer_ChunkedRecords(t *testing.T) {
+	newContent := func(metricName string) []byte {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return content
+	}
+	newChunks := func(recordID, metricName string) [][]byte {
+		chunks, err := EncodeChunks(recordID, newContent(metricName), 10)
+		require.NoError(t, err)
+		require.Greater(t, len(chunks), 2)
+		return chunks
+	}
+
+	var (
+		pushedMx sync.Mutex
+		pushed   []string
+	)
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushedMx.Lock()
+		defer pushedMx.Unlock()
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	t.Run("should reassemble the records from their chunks", func(t *testing.T) {
+		pushed = nil
+		first, second := newChunks("record-1", "chunked_1"), newChunks("record-1", "chunked_2")
+
+		// The chunks of the records are interleaved with each other and with other records, and out of order.
+		records := []record{
+			{ctx: context.Background(), tenantID: "user-1", offset: 1, content: first[1]},
+			{ctx: context.Background(), tenantID: "user-2", offset: 2, content: second[0]},
+			{ctx: context.Background(), tenantID: "user-1", offset: 3, content: newContent("series_1")},
+		}
+		for i, c := range first[2:] {
+			records = append(records, record{ctx: context.Background(), tenantID: "user-1", offset: int64(4 + i), content: c})
+		}
+		records = append(records, record{ctx: context.Background(), tenantID: "user-1", offset: 10, content: first[0]})
+		for i, c := range second[1:] {
+			records = append(records, record{ctx: context.Background(), tenantID: "user-2", offset: int64(11 + i), content: c})
+		}
+
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		lastProcessed, err := c.ConsumeWithLastProcessedOffset(context.Background(), records)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"series_1", "chunked_1", "chunked_2"}, pushed)
+		assert.Equal(t, records[len(records)-1].offset, lastProcessed)
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.reassembledRecords))
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.incompleteChunkedRecords))
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.parseErrors))
+	})
+
+	t.Run("should count and log the records whose chunks have not all been consumed", func(t *testing.T) {
+		pushed = nil
+		chunks := newChunks("record-1", "chunked_1")
+		records := []record{
+			{ctx: context.Background(), tenantID: "user-1", offset: 1, content: chunks[0]},
+			{ctx: context.Background(), tenantID: "user-1", offset: 2, content: newContent("series_1")},
+			{ctx: context.Background(), tenantID: "user-1", offset: 3, content: chunks[1]},
+		}
+
+		logs := &concurrency.SyncBuffer{}
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewLogfmtLogger(logs))
+		lastProcessed, err := c.ConsumeWithLastProcessedOffset(context.Background(), records)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"series_1"}, pushed)
+		assert.Equal(t, int64(-1), lastProcessed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.incompleteChunkedRecords))
+		assert.Contains(t, logs.String(), "discarded record whose chunks have not all been consumed")
+		assert.Contains(t, logs.String(), "first_offset=1 received_chunks=2")
+	})
+
+	t.Run("should skip the records with inconsistent chunks", func(t *testing.T) {
+		pushed = nil
+		chunks := newChunks("record-1", "chunked_1")
+		records := []record{
+			{ctx: context.Background(), tenantID: "user-1", offset: 1, content: chunks[0]},
+			{ctx: context.Background(), tenantID: "user-1", offset: 2, content: chunks[0]},
+			{ctx: context.Background(), tenantID: "user-1", offset: 3, content: append(append([]byte{}, chunkMagic...), 0xff)},
+			{ctx: context.Background(), tenantID: "user-1", offset: 4, content: newContent("series_1")},
+		}
+
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		lastProcessed, err := c.ConsumeWithLastProcessedOffset(context.Background(), records)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"series_1"}, pushed)
+		assert.Equal(t, int64(4), lastProcessed)
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.parseErrors))
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.incompleteChunkedRecords))
+	})
+}
+
+func TestChunkAssembler_DiscardIncomplete(t *testing.T) {
+	chunks, err := EncodeChunks("record-1", []byte(strings.Repeat("x", 10)), 4)
+	require.NoError(t, err)
+
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	a := newChunkAssembler(metrics, log.NewNopLogger())
+	_, complete, _ := a.add(record{tenantID: "user-1", offset: 1, content: chunks[0]})
+	require.False(t, complete)
+
+	// The chunks of the records of different tenants aren't reassembled together.
+	_, complete, _ = a.add(record{tenantID: "user-2", offset: 2, content: chunks[1]})
+	require.False(t, complete)
+
+	a.discardIncomplete()
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.incompleteChunkedRecords))
+	assert.Empty(t, a.records)
+}
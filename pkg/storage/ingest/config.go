@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/common/model"
 )
 
 const (
@@ -20,24 +21,92 @@ const (
 	consumeFromEnd        = "end"
 	consumeFromTimestamp  = "timestamp"
 
+	ingestionOrderingStrict  = "strict"
+	ingestionOrderingRelaxed = "relaxed"
+	ingestionOrderingSeries  = "series"
+
+	futureSamplesPush   = "push"
+	futureSamplesDrop   = "drop"
+	futureSamplesReject = "reject"
+
+	duplicateSamplesPush      = "push"
+	duplicateSamplesKeepFirst = "keep-first"
+	duplicateSamplesKeepLast  = "keep-last"
+
+	exemplarOnlyRecordsPush          = "push"
+	exemplarOnlyRecordsDropExemplars = "drop-exemplars"
+	exemplarOnlyRecordsSkip          = "skip"
+
+	slowConsumeProfileCPU   = "cpu"
+	slowConsumeProfileBlock = "block"
+
+	recordOutcomeLogDisabled = "disabled"
+	recordOutcomeLogLogfmt   = "logfmt"
+	recordOutcomeLogJSON     = "json"
+
 	kafkaConfigFlagPrefix          = "ingest-storage.kafka"
 	targetConsumerLagAtStartupFlag = kafkaConfigFlagPrefix + ".target-consumer-lag-at-startup"
 	maxConsumerLagAtStartupFlag    = kafkaConfigFlagPrefix + ".max-consumer-lag-at-startup"
 )
 
 var (
-	ErrMissingKafkaAddress               = errors.New("the Kafka address has not been configured")
-	ErrMissingKafkaTopic                 = errors.New("the Kafka topic has not been configured")
-	ErrInvalidWriteClients               = errors.New("the configured number of write clients is invalid (must be greater than 0)")
-	ErrInvalidConsumePosition            = errors.New("the configured consume position is invalid")
-	ErrInvalidProducerMaxRecordSizeBytes = fmt.Errorf("the configured producer max record size bytes must be a value between %d and %d", minProducerRecordDataBytesLimit, maxProducerRecordDataBytesLimit)
-	ErrInconsistentConsumerLagAtStartup  = fmt.Errorf("the target and max consumer lag at startup must be either both set to 0 or to a value greater than 0")
-	ErrInvalidMaxConsumerLagAtStartup    = fmt.Errorf("the configured max consumer lag at startup must greater or equal than the configured target consumer lag")
-	ErrInconsistentSASLCredentials       = fmt.Errorf("the SASL username and password must be both configured to enable SASL authentication")
-	ErrInvalidIngestionConcurrencyMax    = errors.New("ingest-storage.kafka.ingestion-concurrency-max must either be set to 0 or to a value greater than 0")
-	ErrInvalidIngestionConcurrencyParams = errors.New("ingest-storage.kafka.ingestion-concurrency-queue-capacity, ingest-storage.kafka.ingestion-concurrency-estimated-bytes-per-sample, ingest-storage.kafka.ingestion-concurrency-batch-size and ingest-storage.kafka.ingestion-concurrency-target-flushes-per-shard must be greater than 0")
+	ErrMissingKafkaAddress                    = errors.New("the Kafka address has not been configured")
+	ErrMissingKafkaTopic                      = errors.New("the Kafka topic has not been configured")
+	ErrInvalidWriteClients                    = errors.New("the configured number of write clients is invalid (must be greater than 0)")
+	ErrInvalidConsumePosition                 = errors.New("the configured consume position is invalid")
+	ErrInvalidProducerMaxRecordSizeBytes      = fmt.Errorf("the configured producer max record size bytes must be a value between %d and %d", minProducerRecordDataBytesLimit, maxProducerRecordDataBytesLimit)
+	ErrInconsistentConsumerLagAtStartup       = fmt.Errorf("the target and max consumer lag at startup must be either both set to 0 or to a value greater than 0")
+	ErrInvalidMaxConsumerLagAtStartup         = fmt.Errorf("the configured max consumer lag at startup must greater or equal than the configured target consumer lag")
+	ErrInconsistentSASLCredentials            = fmt.Errorf("the SASL username and password must be both configured to enable SASL authentication")
+	ErrInvalidIngestionConcurrencyIdleFlush   = errors.New("ingest-storage.kafka.ingestion-concurrency-idle-flush-timeout must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionConcurrencyWarmUp      = errors.New("ingest-storage.kafka.ingestion-concurrency-warm-up-duration must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionConcurrencyMax         = errors.New("ingest-storage.kafka.ingestion-concurrency-max must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionConcurrencyParams      = errors.New("ingest-storage.kafka.ingestion-concurrency-queue-capacity, ingest-storage.kafka.ingestion-concurrency-estimated-bytes-per-sample, ingest-storage.kafka.ingestion-concurrency-batch-size and ingest-storage.kafka.ingestion-concurrency-target-flushes-per-shard must be greater than 0")
+	ErrInvalidTenantCircuitBreakerThreshold   = errors.New("ingest-storage.kafka.tenant-circuit-breaker-failure-threshold must be greater than 0 when the tenant circuit breaker is enabled")
+	ErrInvalidTenantCircuitBreakerIdleTimeout = errors.New("ingest-storage.kafka.tenant-circuit-breaker-idle-timeout must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionOrdering               = errors.New("the configured ingestion ordering is invalid")
+	ErrRelaxedIngestionOrderingConcurrency    = errors.New("ingest-storage.kafka.ingestion-concurrency-max must be greater than 0 when the ingestion ordering is relaxed or series")
+	ErrInvalidConsumeMaxRetries               = errors.New("ingest-storage.kafka.consume-max-retries must either be set to 0 or to a value greater than 0")
+	ErrInvalidConsumeRetryBudget              = errors.New("ingest-storage.kafka.consume-retry-budget must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionDecodeMaxBytes         = errors.New("ingest-storage.kafka.ingestion-decode-max-bytes must either be set to 0 or to a value greater than 0")
+	ErrInvalidMaxDecompressedRecordSizeBytes  = errors.New("ingest-storage.kafka.max-decompressed-record-size-bytes must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionDecodeTimeout          = errors.New("ingest-storage.kafka.ingestion-decode-timeout must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionDecodeMaxAbandoned     = errors.New("ingest-storage.kafka.ingestion-decode-timeout-max-abandoned must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionFirstRecordTimeout     = errors.New("ingest-storage.kafka.ingestion-first-record-timeout must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionMutationTimeout        = errors.New("ingest-storage.kafka.ingestion-mutation-timeout must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionPushTimeout            = errors.New("ingest-storage.kafka.ingestion-push-timeout, ingest-storage.kafka.ingestion-push-timeout-per-kib and ingest-storage.kafka.ingestion-push-max-timeout must be greater or equal than 0, and ingest-storage.kafka.ingestion-push-max-timeout must either be set to 0 or be greater or equal than ingest-storage.kafka.ingestion-push-timeout")
+	ErrInvalidMaxRecordsPerConsume            = errors.New("ingest-storage.kafka.max-records-per-consume must either be set to 0 or to a value greater than 0")
+	ErrInvalidMaxTenantsPerConsume            = errors.New("ingest-storage.kafka.max-tenants-per-consume must either be set to 0 or to a value greater than 0")
+	ErrInvalidMaxConsumeDuration              = errors.New("ingest-storage.kafka.max-consume-duration must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionMaxSampleAge           = errors.New("ingest-storage.kafka.ingestion-max-sample-age must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionMaxProcessingLag       = errors.New("ingest-storage.kafka.ingestion-max-processing-lag must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionSplitRequestsMaxBytes  = errors.New("ingest-storage.kafka.ingestion-split-requests-max-bytes must either be set to 0 or to a value greater than 0")
+	ErrInvalidProcessingTimeSLO               = errors.New("ingest-storage.kafka.processing-time-slo must either be set to 0 or to a value greater than 0")
+	ErrInvalidFutureSamplesBehavior           = errors.New("the configured behavior for samples too far in the future is invalid")
+	ErrInvalidDuplicateSamplesBehavior        = errors.New("the configured behavior for samples with duplicate timestamps is invalid")
+	ErrInvalidExemplarOnlyRecordsBehavior     = errors.New("the configured behavior for records with exemplars but no samples is invalid")
+	ErrInvalidIngestionMaxExemplarsPerSecond  = errors.New("ingest-storage.kafka.ingestion-max-exemplars-per-second must either be set to 0 or to a value greater than 0")
+	ErrInvalidIngestionMergeWindow            = errors.New("ingest-storage.kafka.ingestion-merge-window must be greater or equal than 0, and ingest-storage.kafka.ingestion-merge-max-bytes must be greater than 0 when the merge window is enabled")
+	ErrInvalidRecordOutcomeLogFormat          = errors.New("the configured format of the record outcome logs is invalid")
+	ErrInvalidRecordSummaryLogSampleRate      = errors.New("ingest-storage.kafka.record-summary-log-sample-rate must either be set to 0 or to a value greater than 0")
+	ErrInvalidPushMetadata                    = errors.New("ingest-storage.kafka.push-metadata must be a comma-separated list of key=value pairs whose keys are valid lowercase gRPC metadata keys not starting with grpc-")
+	ErrInvalidFutureSamplesTolerance          = errors.New("ingest-storage.kafka.ingestion-future-samples-tolerance must be greater or equal than 0")
+	ErrInvalidHeartbeatMetricName             = errors.New("ingest-storage.kafka.heartbeat-metric-name must be a valid metric name when ingest-storage.kafka.heartbeat-tenant is set")
+	ErrInvalidMaxConsecutiveSkips             = errors.New("ingest-storage.kafka.max-consecutive-skips must either be set to 0 or to a value greater than 0")
+	ErrInvalidMaxSeriesIdleTimeout            = errors.New("ingest-storage.kafka.max-series-idle-timeout must be greater than 0")
+	ErrInvalidIdempotencyTokens               = errors.New("ingest-storage.kafka.idempotency-tokens-max-size and ingest-storage.kafka.idempotency-tokens-ttl must be greater or equal than 0")
+	ErrInvalidMetadataOnlyConcurrency         = errors.New("ingest-storage.kafka.metadata-only-concurrency must either be set to 0 or to a value greater than 0, and ingest-storage.kafka.ingestion-concurrency-queue-capacity must be greater than 0 when it's enabled")
+	ErrInvalidServerErrorRatioHealthCheck     = errors.New("ingest-storage.kafka.server-error-ratio-health-threshold must be between 0 and 1, and ingest-storage.kafka.server-error-ratio-health-window must be greater than 0 when the threshold is greater than 0")
+	ErrInvalidSlowConsumeProfile              = errors.New("ingest-storage.kafka.slow-consume-profile-threshold and ingest-storage.kafka.slow-consume-profile-cooldown must be greater or equal than 0, and ingest-storage.kafka.slow-consume-profile-type must be a supported profile type")
+	ErrPushLatencyInjectionNotAllowed         = errors.New("ingest-storage.kafka.injected-push-latency is only supported by binaries built with the chaos_testing build tag")
 
 	consumeFromPositionOptions = []string{consumeFromLastOffset, consumeFromStart, consumeFromEnd, consumeFromTimestamp}
+	ingestionOrderingOptions   = []string{ingestionOrderingStrict, ingestionOrderingRelaxed, ingestionOrderingSeries}
+	futureSamplesOptions       = []string{futureSamplesPush, futureSamplesDrop, futureSamplesReject}
+	duplicateSamplesOptions    = []string{duplicateSamplesPush, duplicateSamplesKeepFirst, duplicateSamplesKeepLast}
+	exemplarOnlyRecordsOptions = []string{exemplarOnlyRecordsPush, exemplarOnlyRecordsDropExemplars, exemplarOnlyRecordsSkip}
+	recordOutcomeLogOptions    = []string{recordOutcomeLogDisabled, recordOutcomeLogLogfmt, recordOutcomeLogJSON}
+	slowConsumeProfileOptions  = []string{slowConsumeProfileCPU, slowConsumeProfileBlock}
 )
 
 type Config struct {
@@ -110,6 +179,15 @@ type KafkaConfig struct {
 	IngestionConcurrencyMax       int `yaml:"ingestion_concurrency_max"`
 	IngestionConcurrencyBatchSize int `yaml:"ingestion_concurrency_batch_size"`
 
+	// IngestionConcurrencyIdleFlushTimeout is the time after which the batches of a tenant which aren't full are flushed
+	// if no record of the tenant has been pushed meanwhile. 0 means the batches are only flushed once full, or once all
+	// the records of the fetched batch have been pushed.
+	IngestionConcurrencyIdleFlushTimeout time.Duration `yaml:"ingestion_concurrency_idle_flush_timeout"`
+
+	// IngestionConcurrencyWarmUpDuration is the duration over which the ingestion concurrency is ramped from 1 to
+	// IngestionConcurrencyMax once the partition reader has started. 0 means no warm-up.
+	IngestionConcurrencyWarmUpDuration time.Duration `yaml:"ingestion_concurrency_warm_up_duration"`
+
 	// IngestionConcurrencyQueueCapacity controls how many batches can be enqueued for flushing series to the TSDB HEAD.
 	// We don't want to push any batches in parallel and instead want to prepare the next ones while the current one finishes, hence the buffer of 5.
 	// For example, if we flush 1 batch/sec, then batching 2 batches/sec doesn't make us faster.
@@ -125,6 +203,195 @@ type KafkaConfig struct {
 	// IngestionConcurrencyEstimatedBytesPerSample is the estimated number of bytes per sample.
 	// Our data indicates that the average sample size is somewhere between ~250 and ~500 bytes. We'll use 500 bytes as a conservative estimate.
 	IngestionConcurrencyEstimatedBytesPerSample int `yaml:"ingestion_concurrency_estimated_bytes_per_sample"`
+
+	// IngestionOrdering controls whether the records of a batch are pushed to the storage in the order they've been read from Kafka.
+	// With the strict ordering, the records are pushed one after the other and only the series of a record are parallelized.
+	// With the relaxed ordering, up to IngestionConcurrencyMax records are pushed in parallel regardless of their order in the batch,
+	// so samples of the same series in different records may be ingested out of order and get rejected by the storage
+	// unless out-of-order ingestion is enabled.
+	// With the series ordering, the series of the records are sharded by hash across IngestionConcurrencyMax workers,
+	// so that only the samples of the same series are pushed in order.
+	IngestionOrdering string `yaml:"ingestion_ordering"`
+
+	// ConsumeMaxRetries is the number of times a batch of records failing with a server error is retried before
+	// consulting the PoisonPolicy. 0 means retrying forever.
+	ConsumeMaxRetries int `yaml:"consume_max_retries"`
+
+	// ConsumeRetryBudget is the number of retries of the records failing with a server error allowed while consuming
+	// a batch of records, shared by all the records of the batch. 0 means the records aren't retried on their own.
+	ConsumeRetryBudget int `yaml:"consume_retry_budget"`
+
+	// DeduplicateClientErrorLogs controls whether only the first occurrence of each client error cause is logged
+	// for each tenant in a batch of records.
+	DeduplicateClientErrorLogs bool `yaml:"deduplicate_client_error_logs"`
+
+	// IngestionDecodeMaxBytes is the maximum total size of the records which are decoded and not pushed to the storage yet.
+	IngestionDecodeMaxBytes int `yaml:"ingestion_decode_max_bytes"`
+
+	// IngestionDecodeTimeout is the duration after which a record still being decoded is logged and counted.
+	// If IngestionDecodeTimeoutAbandon is enabled, the decode is abandoned and the record is skipped as a parse error,
+	// unless IngestionDecodeTimeoutMaxAbandoned abandoned decodes are still running.
+	IngestionDecodeTimeout             time.Duration `yaml:"ingestion_decode_timeout"`
+	IngestionDecodeTimeoutAbandon      bool          `yaml:"ingestion_decode_timeout_abandon"`
+	IngestionDecodeTimeoutMaxAbandoned int           `yaml:"ingestion_decode_timeout_max_abandoned"`
+
+	// MaxDecompressedRecordSizeBytes is the maximum size of the content of a compressed record once decompressed.
+	// The records exceeding it are skipped as parse errors. 0 to disable.
+	MaxDecompressedRecordSizeBytes int `yaml:"max_decompressed_record_size_bytes"`
+
+	// IngestionFirstRecordTimeout is the duration after the start of a consume after which the consume is logged and
+	// counted if no record has been handed over to be pushed yet.
+	IngestionFirstRecordTimeout time.Duration `yaml:"ingestion_first_record_timeout"`
+
+	// IngestionMutationTimeout is the duration after which the transforms applied to a decoded record before pushing it
+	// are logged and counted. They're never abandoned, because they modify the write request in place.
+	IngestionMutationTimeout time.Duration `yaml:"ingestion_mutation_timeout"`
+
+	// IngestionPushTimeout is the base timeout of the push of each record to the storage, to which IngestionPushTimeoutPerKiB
+	// is added for each KiB of the write request, up to IngestionPushMaxTimeout. 0 to disable.
+	IngestionPushTimeout       time.Duration `yaml:"ingestion_push_timeout"`
+	IngestionPushTimeoutPerKiB time.Duration `yaml:"ingestion_push_timeout_per_kib"`
+	IngestionPushMaxTimeout    time.Duration `yaml:"ingestion_push_max_timeout"`
+
+	// VerifyDecodeRoundTrip is a debug option which re-marshals each decoded write request and compares it with the
+	// decompressed content of the record. If VerifyDecodeRoundTripFail is enabled, mismatching records are skipped
+	// as parse errors.
+	VerifyDecodeRoundTrip     bool `yaml:"verify_decode_round_trip"`
+	VerifyDecodeRoundTripFail bool `yaml:"verify_decode_round_trip_fail"`
+
+	// LogServerErrorFirstSeries is a debug option which logs the label set, with redacted values, of the first series
+	// of the write requests failing to be pushed with a server error.
+	LogServerErrorFirstSeries bool `yaml:"log_server_error_first_series"`
+
+	// RecordSummaryLogSampleRate is a debug option which logs the summary of 1 out of every RecordSummaryLogSampleRate
+	// decoded records at debug level, with the values of the labels redacted. 0 to disable.
+	RecordSummaryLogSampleRate int64 `yaml:"record_summary_log_sample_rate"`
+
+	// RecordOutcomeLogFormat is the format of the log event emitted for the outcome of each consumed record.
+	RecordOutcomeLogFormat string `yaml:"record_outcome_log_format"`
+
+	// DetectOutOfOrderSamples enables counting the records with samples out of timestamp order within a series.
+	// SortOutOfOrderSamples additionally sorts them before pushing, and implies the detection.
+	DetectOutOfOrderSamples bool `yaml:"detect_out_of_order_samples"`
+	SortOutOfOrderSamples   bool `yaml:"sort_out_of_order_samples"`
+
+	// MaxRecordsPerConsume is the maximum number of records pushed to the storage by a single consumer.
+	// Larger batches are split, and each split is consumed and retried on its own. 0 means unlimited.
+	MaxRecordsPerConsume int `yaml:"max_records_per_consume"`
+
+	// MaxTenantsPerConsume is the maximum number of distinct tenants whose records are pushed to the storage by a
+	// single consumer. The records of the other tenants are left to the next consumer. 0 means unlimited.
+	MaxTenantsPerConsume int `yaml:"max_tenants_per_consume"`
+
+	// MaxConsumeDuration is the maximum time a single consumer spends pushing records to the storage. The records
+	// not attempted yet once it's exceeded are left to the next consumer. 0 means unlimited.
+	MaxConsumeDuration time.Duration `yaml:"max_consume_duration"`
+
+	// IngestionMaxSampleAge is the max age of the samples pushed to the storage. Older samples are dropped. 0 means no limit.
+	IngestionMaxSampleAge time.Duration `yaml:"ingestion_max_sample_age"`
+
+	// IngestionMaxProcessingLag is how long after their Kafka timestamp the records can still be pushed to the storage.
+	// Older records are skipped. 0 means no limit.
+	IngestionMaxProcessingLag time.Duration `yaml:"ingestion_max_processing_lag"`
+
+	// IngestionSplitRequestsMaxBytes is the max size of the write requests pushed to the storage. Larger write requests
+	// are split into partial write requests, each pushed on its own. 0 means no limit.
+	IngestionSplitRequestsMaxBytes int `yaml:"ingestion_split_requests_max_bytes"`
+
+	// IngestionGroupRecordsByTenant groups the records of each consumed batch by tenant before pushing them, preserving
+	// the order of the records of each tenant.
+	IngestionGroupRecordsByTenant bool `yaml:"ingestion_group_records_by_tenant"`
+
+	// IngestionTenantNewestFirst pushes the records of each tenant of each consumed batch in descending timestamp order,
+	// in the positions held by the records of the tenant, so that the most recent data is queryable first.
+	IngestionTenantNewestFirst bool `yaml:"ingestion_tenant_newest_first"`
+
+	// IngestionBatchMetrics accumulates the per-record metrics locally to each consumed batch, and flushes them to the
+	// shared metrics once the batch has been consumed.
+	IngestionBatchMetrics bool `yaml:"ingestion_batch_metrics"`
+
+	// IngestionFutureSamplesBehavior is what to do with the records with samples further in the future than
+	// IngestionFutureSamplesTolerance: push them as usual, drop those samples, or reject the whole record as a client error.
+	IngestionFutureSamplesBehavior  string        `yaml:"ingestion_future_samples_behavior"`
+	IngestionFutureSamplesTolerance time.Duration `yaml:"ingestion_future_samples_tolerance"`
+
+	// IngestionDuplicateSamplesBehavior is what to do with the samples of a series with the same timestamp within a
+	// write request: push them as usual, or keep only the first or the last of them.
+	IngestionDuplicateSamplesBehavior string `yaml:"ingestion_duplicate_samples_behavior"`
+
+	// IngestionExemplarOnlyRecordsBehavior is what to do with the records with exemplars but no samples nor histograms:
+	// push them as usual, drop their exemplars, or skip the whole record as a client error.
+	IngestionExemplarOnlyRecordsBehavior string `yaml:"ingestion_exemplar_only_records_behavior"`
+
+	// IngestionMaxExemplarsPerSecond is the maximum rate of the exemplars pushed by the consumers of a partition. The
+	// excess exemplars are dropped, while the samples of the same write requests are pushed. 0 for unlimited.
+	IngestionMaxExemplarsPerSecond float64 `yaml:"ingestion_max_exemplars_per_second"`
+
+	// IngestionMergeWindow is the window the write requests of each tenant are accumulated across the consumes for,
+	// to be pushed merged in a single request per tenant. 0 to disable. The accumulated write requests are pushed
+	// early once their size exceeds IngestionMergeMaxBytes.
+	IngestionMergeWindow   time.Duration `yaml:"ingestion_merge_window"`
+	IngestionMergeMaxBytes int           `yaml:"ingestion_merge_max_bytes"`
+
+	// HeartbeatTenant is the tenant the heartbeat series is pushed for after each consumed batch. Empty to disable.
+	HeartbeatTenant     string `yaml:"heartbeat_tenant"`
+	HeartbeatMetricName string `yaml:"heartbeat_metric_name"`
+
+	// SlowConsumeProfileThreshold is the duration of a consume after which a profile of the rest of the consume is
+	// captured to SlowConsumeProfileDirectory, at most once per SlowConsumeProfileCooldown. 0 to disable.
+	SlowConsumeProfileThreshold time.Duration `yaml:"slow_consume_profile_threshold"`
+	SlowConsumeProfileType      string        `yaml:"slow_consume_profile_type"`
+	SlowConsumeProfileDirectory string        `yaml:"slow_consume_profile_directory"`
+	SlowConsumeProfileCooldown  time.Duration `yaml:"slow_consume_profile_cooldown"`
+
+	// CanaryTenant is the tenant of the canary records pushed by the readiness checks. Empty to disable.
+	CanaryTenant string `yaml:"canary_tenant"`
+
+	// MaxConsecutiveSkips is the number of write requests skipped in a row after which a warning is logged. 0 to disable.
+	MaxConsecutiveSkips int `yaml:"max_consecutive_skips"`
+
+	// MaxSeriesIdleTimeout is the time after which a series not consumed anymore stops counting towards the tenant's
+	// maximum number of active series.
+	MaxSeriesIdleTimeout time.Duration `yaml:"max_series_idle_timeout"`
+
+	// IdempotencyTokensMaxSize is the number of idempotency tokens of the recently consumed records which are kept to
+	// skip the duplicate records. 0 to disable. The tokens expire after IdempotencyTokensTTL, if greater than 0.
+	IdempotencyTokensMaxSize int           `yaml:"idempotency_tokens_max_size"`
+	IdempotencyTokensTTL     time.Duration `yaml:"idempotency_tokens_ttl"`
+
+	// TenantInflightBytesTrackedTenants are the tenants whose in-flight bytes of records being ingested are exported.
+	TenantInflightBytesTrackedTenants flagext.StringSliceCSV `yaml:"tenant_inflight_bytes_tracked_tenants"`
+
+	// ProcessingTimeTrackedTenants are the tenants whose time taken to process each record is exported.
+	ProcessingTimeTrackedTenants flagext.StringSliceCSV `yaml:"processing_time_tracked_tenants"`
+
+	// ProcessingTimeSLO is the processing time of each record of the tracked tenants under which it's counted as
+	// processed within the SLO. 0 to disable.
+	ProcessingTimeSLO time.Duration `yaml:"processing_time_slo"`
+
+	// MetadataOnlyConcurrency is the number of workers pushing the write requests with only metadata, separately from the
+	// requests with samples. 0 means the metadata-only requests are pushed like any other request.
+	MetadataOnlyConcurrency int `yaml:"metadata_only_concurrency"`
+
+	// DeferMetadataPushes defers the push of the metadata of the records to the end of each batch, in a single request per tenant.
+	DeferMetadataPushes bool `yaml:"defer_metadata_pushes"`
+
+	// PushMetadata are the key=value pairs of metadata injected in the context of each push to the storage, so that the
+	// storage can tell the write requests replayed from Kafka apart.
+	PushMetadata flagext.StringSliceCSV `yaml:"push_metadata"`
+
+	TenantCircuitBreakerEnabled          bool          `yaml:"tenant_circuit_breaker_enabled"`
+	TenantCircuitBreakerFailureThreshold uint          `yaml:"tenant_circuit_breaker_failure_threshold"`
+	TenantCircuitBreakerCooldownPeriod   time.Duration `yaml:"tenant_circuit_breaker_cooldown_period"`
+	TenantCircuitBreakerIdleTimeout      time.Duration `yaml:"tenant_circuit_breaker_idle_timeout"`
+
+	ServerErrorRatioHealthThreshold float64 `yaml:"server_error_ratio_health_threshold"`
+	ServerErrorRatioHealthWindow    int     `yaml:"server_error_ratio_health_window"`
+
+	// Testing only: artificial latency added to each push to the storage, to reproduce slow storage scenarios in tests.
+	// It can only be enabled in binaries built with the chaos_testing build tag.
+	InjectedPushLatency        time.Duration          `yaml:"injected_push_latency" category:"experimental" doc:"hidden"`
+	InjectedPushLatencyTenants flagext.StringSliceCSV `yaml:"injected_push_latency_tenants" category:"experimental" doc:"hidden"`
 }
 
 func (cfg *KafkaConfig) RegisterFlags(f *flag.FlagSet) {
@@ -170,10 +437,77 @@ func (cfg *KafkaConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet)
 	f.BoolVar(&cfg.UseCompressedBytesAsFetchMaxBytes, prefix+".use-compressed-bytes-as-fetch-max-bytes", true, "When enabled, the fetch request MaxBytes field is computed using the compressed size of previous records. When disabled, MaxBytes is computed using uncompressed bytes. Different Kafka implementations interpret MaxBytes differently.")
 
 	f.IntVar(&cfg.IngestionConcurrencyMax, prefix+".ingestion-concurrency-max", 0, "The maximum number of concurrent ingestion streams to the TSDB head. Every tenant has their own set of streams. 0 to disable.")
+	f.DurationVar(&cfg.IngestionConcurrencyWarmUpDuration, prefix+".ingestion-concurrency-warm-up-duration", 0, "The duration over which the ingestion concurrency is ramped up linearly from 1 to -"+prefix+".ingestion-concurrency-max once the partition reader has started, to avoid hitting the TSDB head at full concurrency right away. The concurrency is picked for each batch of records. 0 to disable.")
 	f.IntVar(&cfg.IngestionConcurrencyBatchSize, prefix+".ingestion-concurrency-batch-size", 150, "The number of timeseries to batch together before ingesting to the TSDB head. Only use this setting when -ingest-storage.kafka.ingestion-concurrency-max is greater than 0.")
 	f.IntVar(&cfg.IngestionConcurrencyQueueCapacity, prefix+".ingestion-concurrency-queue-capacity", 5, "The number of batches to prepare and queue to ingest to the TSDB head. Only use this setting when -ingest-storage.kafka.ingestion-concurrency-max is greater than 0.")
+	f.DurationVar(&cfg.IngestionConcurrencyIdleFlushTimeout, prefix+".ingestion-concurrency-idle-flush-timeout", 0, "The time after which the batches of timeseries of a tenant which haven't reached -"+prefix+".ingestion-concurrency-batch-size are ingested to the TSDB head if no record of the tenant has been fetched from Kafka meanwhile, to bound the latency of the samples of the low-rate tenants. 0 to only ingest the batches once full, or once the whole batch of fetched records has been batched. Only used when -"+prefix+".ingestion-concurrency-max is greater than 0.")
 	f.IntVar(&cfg.IngestionConcurrencyTargetFlushesPerShard, prefix+".ingestion-concurrency-target-flushes-per-shard", 80, "The expected number of times to ingest timeseries to the TSDB head after batching. With fewer flushes, the overhead of splitting up the work is higher than the benefit of parallelization. Only use this setting when -ingest-storage.kafka.ingestion-concurrency-max is greater than 0.")
 	f.IntVar(&cfg.IngestionConcurrencyEstimatedBytesPerSample, prefix+".ingestion-concurrency-estimated-bytes-per-sample", 500, "The estimated number of bytes a sample has at time of ingestion. This value is used to estimate the timeseries without decompressing them. Only use this setting when -ingest-storage.kafka.ingestion-concurrency-max is greater than 0.")
+	f.StringVar(&cfg.IngestionOrdering, prefix+".ingestion-ordering", ingestionOrderingStrict, fmt.Sprintf("The order in which the records fetched from Kafka are pushed to the TSDB head. With %[1]q, records are pushed in the order they have been written to Kafka. With %[2]q, up to -%[3]s.ingestion-concurrency-max records are pushed in parallel regardless of their order, which increases throughput but may cause samples of the same series to be ingested out of order and get rejected unless out-of-order ingestion is enabled. With %[5]q, the series of the records are pushed by -%[3]s.ingestion-concurrency-max workers shared by all tenants, and the samples of each series are pushed in the order they have been written to Kafka while different series are pushed in parallel. Supported options: %[4]s.", ingestionOrderingStrict, ingestionOrderingRelaxed, prefix, strings.Join(ingestionOrderingOptions, ", "), ingestionOrderingSeries))
+
+	f.IntVar(&cfg.ConsumeRetryBudget, prefix+".consume-retry-budget", 0, "The maximum number of times the records of a batch of records fetched from Kafka which fail to be pushed to the TSDB head with a server error are retried on their own, before the whole batch is retried. The retries are shared by all the records of the batch, so that the retries of a bad batch are bounded. Once the budget is exhausted, the next server error fails the batch. The records are only retried on their own when -"+prefix+".ingestion-concurrency-max is 0 or the ingestion ordering is relaxed, and -"+prefix+".metadata-only-concurrency is 0. 0 to disable.")
+	f.IntVar(&cfg.ConsumeMaxRetries, prefix+".consume-max-retries", 0, "The maximum number of times a batch of records fetched from Kafka which fails to be pushed to the TSDB head with a server error is retried. Once the retries are exhausted, the reader stops with an error unless a different decision is taken by a custom poison policy. 0 to retry forever.")
+	f.BoolVar(&cfg.DeduplicateClientErrorLogs, prefix+".deduplicate-client-error-logs", false, "When enabled, only the first occurrence of each client error cause is logged for each tenant while pushing a batch of records fetched from Kafka to the TSDB head, followed by the number of suppressed occurrences once the batch has been pushed. This replaces the sampling of client errors.")
+	f.IntVar(&cfg.IngestionDecodeMaxBytes, prefix+".ingestion-decode-max-bytes", 0, "The maximum total size, in bytes, of the records fetched from Kafka which are being decoded or are waiting to be pushed to the TSDB head. When the limit is reached, decoding the next record waits until enough records have been pushed. A record larger than the limit is decoded on its own. 0 to disable.")
+	f.IntVar(&cfg.MaxDecompressedRecordSizeBytes, prefix+".max-decompressed-record-size-bytes", 128*1024*1024, "The maximum size, in bytes, of the content of a compressed record fetched from Kafka once decompressed. The decompression stops once the limit is exceeded, and the record is skipped as if it couldn't be parsed. 0 to disable.")
+	f.DurationVar(&cfg.IngestionDecodeTimeout, prefix+".ingestion-decode-timeout", 0, "The maximum time decoding a record fetched from Kafka is expected to take. Decodes taking longer are logged and counted. 0 to disable.")
+	f.DurationVar(&cfg.IngestionFirstRecordTimeout, prefix+".ingestion-first-record-timeout", 0, "The maximum time the first record of a batch of records fetched from Kafka is expected to take to be decoded and handed over to be pushed to the TSDB head, since the start of the consumption of the batch. The consumptions whose first record takes longer, for example because it's huge, are logged and counted, while the consumption goes on. 0 to disable.")
+	f.DurationVar(&cfg.IngestionMutationTimeout, prefix+".ingestion-mutation-timeout", 0, "The maximum time applying the limits and the transforms to a record fetched from Kafka, once decoded, is expected to take. Mutations taking longer are logged and counted. 0 to disable.")
+	f.DurationVar(&cfg.IngestionPushTimeout, prefix+".ingestion-push-timeout", 0, "The base timeout of the push of each record fetched from Kafka to the TSDB head. The timeout of each push is this value plus -"+prefix+".ingestion-push-timeout-per-kib for each KiB of the write request, up to -"+prefix+".ingestion-push-max-timeout. A push which times out fails with a server error. The timeout only applies when the records are pushed one by one, which is the case when -"+prefix+".ingestion-concurrency-max is 0 or with the relaxed ingestion ordering, and neither -"+prefix+".metadata-only-concurrency nor -"+prefix+".defer-metadata-pushes is enabled. The base timeout can be overridden for each tenant with -ingest-storage.push-timeout. 0 to disable.")
+	f.DurationVar(&cfg.IngestionPushTimeoutPerKiB, prefix+".ingestion-push-timeout-per-kib", 0, "The time added to the timeout of the push of a record fetched from Kafka to the TSDB head for each KiB of its write request. Only used when -"+prefix+".ingestion-push-timeout is greater than 0.")
+	f.DurationVar(&cfg.IngestionPushMaxTimeout, prefix+".ingestion-push-max-timeout", 0, "The maximum timeout of the push of a record fetched from Kafka to the TSDB head, regardless of the size of its write request. Only used when -"+prefix+".ingestion-push-timeout is greater than 0. 0 for no maximum.")
+	f.BoolVar(&cfg.IngestionDecodeTimeoutAbandon, prefix+".ingestion-decode-timeout-abandon", false, "When enabled, the decode of a record fetched from Kafka which takes longer than -"+prefix+".ingestion-decode-timeout is abandoned, and the record is skipped as if it couldn't be parsed. The bytes of the record are still accounted for in -"+prefix+".ingestion-decode-max-bytes and in the tenant's in-flight bytes until the abandoned decode returns.")
+	f.IntVar(&cfg.IngestionDecodeTimeoutMaxAbandoned, prefix+".ingestion-decode-timeout-max-abandoned", 10, "The maximum number of abandoned decodes of records fetched from Kafka which may still be running. Once the limit is reached, the decodes taking longer than -"+prefix+".ingestion-decode-timeout are waited for instead of being abandoned, until an abandoned decode returns. Only used when -"+prefix+".ingestion-decode-timeout-abandon is enabled. 0 for no limit.")
+	f.BoolVar(&cfg.VerifyDecodeRoundTrip, prefix+".verify-decode-round-trip", false, "Debug option to re-marshal each write request decoded from a record fetched from Kafka, and compare it with the decompressed content of the record. Mismatches are logged and counted by the cortex_ingest_storage_reader_decode_round_trip_mismatches_total metric. This is expensive, and should only be enabled to catch decoding bugs, for example while migrating to a new protobuf version.")
+	f.BoolVar(&cfg.VerifyDecodeRoundTripFail, prefix+".verify-decode-round-trip-fail", false, "When enabled together with -"+prefix+".verify-decode-round-trip, the records whose write request doesn't match their content once re-marshalled are skipped as if they couldn't be parsed.")
+	f.Int64Var(&cfg.RecordSummaryLogSampleRate, prefix+".record-summary-log-sample-rate", 0, "Debug option to log, at debug level, a summary of 1 out of every N records fetched from Kafka once decoded, with the tenant, the number of series, samples, histograms and exemplars, the first and last timestamps of the samples and histograms, and the label set of the first series, to spot-check the data being ingested. The values of the labels but the metric name are redacted. The records are always decoded when enabled. 0 to disable.")
+	f.BoolVar(&cfg.LogServerErrorFirstSeries, prefix+".log-server-error-first-series", false, "Debug option to log the label set of the first series of each write request which fails to be pushed to the TSDB head with a server error. The values of the labels but the metric name are redacted, but the label names and metric names may still be sensitive.")
+	f.StringVar(&cfg.RecordOutcomeLogFormat, prefix+".record-outcome-log-format", recordOutcomeLogDisabled, fmt.Sprintf("The format of the log event emitted for the outcome of each record fetched from Kafka, with the tenant, offset, outcome and processing latency of the record. With %[1]q, no event is logged. With %[2]q, the events are logged by the default logger. With %[3]q, the events are logged to the standard error as JSON objects, regardless of the log format, so that they can be indexed by log pipelines. Supported options: %[4]s.", recordOutcomeLogDisabled, recordOutcomeLogLogfmt, recordOutcomeLogJSON, strings.Join(recordOutcomeLogOptions, ", ")))
+	f.BoolVar(&cfg.DetectOutOfOrderSamples, prefix+".detect-out-of-order-samples", false, "When enabled, the records fetched from Kafka are scanned for samples which are out of timestamp order within a series, and the records with out-of-order samples are counted.")
+	f.BoolVar(&cfg.SortOutOfOrderSamples, prefix+".sort-out-of-order-samples", false, "When enabled, the samples of each series of a record fetched from Kafka are sorted by timestamp before being pushed to the TSDB head, if they're out of order. Implies -"+prefix+".detect-out-of-order-samples.")
+	f.IntVar(&cfg.MaxRecordsPerConsume, prefix+".max-records-per-consume", 0, "The maximum number of records fetched from Kafka which are pushed to the TSDB head at once. Larger batches of fetched records are split, and each split is pushed and retried on its own. 0 for unlimited.")
+	f.IntVar(&cfg.MaxTenantsPerConsume, prefix+".max-tenants-per-consume", 0, "The maximum number of distinct tenants whose records fetched from Kafka are pushed to the TSDB head at once, to bound the per-tenant state of each push. The records of the tenants beyond the first ones of a batch of fetched records are pushed and retried on their own once the records of the first tenants have been pushed, like when -"+prefix+".max-records-per-consume is exceeded. The order of the records of each tenant is preserved. 0 for unlimited.")
+	f.DurationVar(&cfg.MaxConsumeDuration, prefix+".max-consume-duration", 0, "The maximum time spent pushing a batch of records fetched from Kafka to the TSDB head at once. Once exceeded, the records being pushed are completed, while the records which haven't been attempted yet are pushed and retried on their own, like when -"+prefix+".max-records-per-consume is exceeded. 0 for unlimited.")
+	f.DurationVar(&cfg.IngestionMaxSampleAge, prefix+".ingestion-max-sample-age", 0, "The maximum age of the samples of the records fetched from Kafka which are pushed to the TSDB head. Older samples and histograms are dropped before pushing, while the other samples of the same records are pushed. 0 to disable.")
+	f.DurationVar(&cfg.IngestionMaxProcessingLag, prefix+".ingestion-max-processing-lag", 0, "The maximum time between the Kafka timestamp of a record fetched from Kafka and its push to the TSDB head. The records which haven't been pushed by then are skipped instead, because their data is considered too stale to be useful, and counted as rejected with the "+reasonStaleDeadline+" reason. 0 to disable.")
+	f.IntVar(&cfg.IngestionSplitRequestsMaxBytes, prefix+".ingestion-split-requests-max-bytes", 0, "The maximum size, in bytes, of the write requests of the records fetched from Kafka which are pushed to the TSDB head at once. Larger write requests are split into partial write requests, each pushed on its own, and a record is only failed if one of its partial write requests fails with a server error. A single series or metadata larger than the limit is never split. 0 to disable.")
+	f.BoolVar(&cfg.IngestionGroupRecordsByTenant, prefix+".ingestion-group-records-by-tenant", false, "When enabled, the records of each batch fetched from Kafka are grouped by tenant before being pushed to the TSDB head, so that the records of the same tenant are pushed one after the other and batched together by the ingestion shards. The records of each tenant are pushed in the order they've been fetched, while the records of different tenants are pushed in the order each tenant first appears in the batch.")
+	f.BoolVar(&cfg.IngestionTenantNewestFirst, prefix+".ingestion-tenant-newest-first", false, "When enabled, the records of each tenant of each batch fetched from Kafka are pushed to the TSDB head from the most recent to the oldest, according to their Kafka timestamp, so that the most recent data is queryable first while recovering. The records of each tenant are pushed in the slots of the batch held by the records of the tenant, so the records of the different tenants are still interleaved in the order they've been fetched. This breaks the offset ordering of the records of each tenant: the samples of a series spread across several records are pushed out of order, so they're rejected as out-of-order samples unless the out-of-order time window covers them, and the offset of a batch is only committed once its oldest records have been pushed, so the whole batch is consumed again on restart.")
+	f.BoolVar(&cfg.IngestionBatchMetrics, prefix+".ingestion-batch-metrics", false, "When enabled, the metrics updated for each record fetched from Kafka, such as the number of decoded records and pushed samples, are accumulated locally to each batch of records and only added to the exported metrics once the batch has been consumed. This reduces the contention on the metrics when many records are consumed concurrently, at the cost of the metrics lagging behind within a batch.")
+	f.StringVar(&cfg.IngestionFutureSamplesBehavior, prefix+".ingestion-future-samples-behavior", futureSamplesPush, fmt.Sprintf("What to do with the records fetched from Kafka with samples or histograms whose timestamp is further in the future than -%[1]s.ingestion-future-samples-tolerance. With %[2]q, the records are pushed to the TSDB head as usual. With %[3]q, those samples and histograms are dropped, while the other samples of the same records are pushed. With %[4]q, the whole records are skipped as a client error with the %[5]q reason. Supported options: %[6]s.", prefix, futureSamplesPush, futureSamplesDrop, futureSamplesReject, reasonTooFarInFuture, strings.Join(futureSamplesOptions, ", ")))
+	f.DurationVar(&cfg.IngestionFutureSamplesTolerance, prefix+".ingestion-future-samples-tolerance", 10*time.Minute, "How far in the future, compared to the wall clock, the timestamps of the samples of the records fetched from Kafka are tolerated. The default value matches the default of -validation.create-grace-period, which is enforced by the ingesters. Only used when -"+prefix+".ingestion-future-samples-behavior is not "+futureSamplesPush+".")
+	f.StringVar(&cfg.IngestionDuplicateSamplesBehavior, prefix+".ingestion-duplicate-samples-behavior", duplicateSamplesPush, fmt.Sprintf("What to do with the samples or histograms of a series with the same timestamp within a record fetched from Kafka, which the TSDB head rejects. With %[1]q, the records are pushed to the TSDB head as usual. With %[2]q or %[3]q, only the first or the last of the samples with the same timestamp is kept, in the position of the first one so that the order of the distinct timestamps is preserved. Supported options: %[4]s.", duplicateSamplesPush, duplicateSamplesKeepFirst, duplicateSamplesKeepLast, strings.Join(duplicateSamplesOptions, ", ")))
+	f.StringVar(&cfg.IngestionExemplarOnlyRecordsBehavior, prefix+".ingestion-exemplar-only-records-behavior", exemplarOnlyRecordsPush, fmt.Sprintf("What to do with the records fetched from Kafka with exemplars but no samples nor histograms, whose exemplars the TSDB head may reject. With %[1]q, the records are pushed to the TSDB head as usual. With %[2]q, their series are dropped along with their exemplars, while their metadata is pushed. With %[3]q, the whole records are skipped as a client error with the %[4]q reason. Supported options: %[5]s.", exemplarOnlyRecordsPush, exemplarOnlyRecordsDropExemplars, exemplarOnlyRecordsSkip, reasonExemplarOnly, strings.Join(exemplarOnlyRecordsOptions, ", ")))
+	f.Float64Var(&cfg.IngestionMaxExemplarsPerSecond, prefix+".ingestion-max-exemplars-per-second", 0, "The maximum rate of the exemplars of the records fetched from Kafka which are pushed to the TSDB head, to protect the exemplar storage from bursts of exemplars. The exemplars exceeding the rate are dropped, while the samples and histograms of the same records are pushed, and counted by the cortex_ingest_storage_reader_exemplars_rate_limited_total metric. 0 for unlimited.")
+	f.DurationVar(&cfg.IngestionMergeWindow, prefix+".ingestion-merge-window", 0, "The time window during which the write requests of the records fetched from Kafka are accumulated across the batches of records, to be pushed to the TSDB head merged in a single request per tenant at the end of the window, which amortizes the overhead of the pushes of high-frequency producers. The offsets of the records are only committed once their write requests have been pushed, and the merged requests failing to be pushed with a server error are pushed again with the next flush, while the ones rejected with a client error are dropped. 0 to disable.")
+	f.IntVar(&cfg.IngestionMergeMaxBytes, prefix+".ingestion-merge-max-bytes", 64*1024*1024, "The maximum size, in bytes, of the write requests accumulated during -"+prefix+".ingestion-merge-window. The accumulated write requests are pushed before the end of the window once the maximum would be exceeded.")
+	f.StringVar(&cfg.HeartbeatTenant, prefix+".heartbeat-tenant", "", "The tenant for which a heartbeat series is pushed to the TSDB head after each batch of records fetched from Kafka has been successfully consumed. The value of the series is the Unix timestamp, in seconds, the batch has been consumed at, and it has a partition label set to the consumed partition. Alerting on the staleness of the series detects a stalled consumer even when no records are written to the partition. Empty to disable.")
+	f.StringVar(&cfg.HeartbeatMetricName, prefix+".heartbeat-metric-name", "cortex_ingest_storage_reader_heartbeat_timestamp_seconds", "The metric name of the heartbeat series pushed when -"+prefix+".heartbeat-tenant is set.")
+	f.DurationVar(&cfg.SlowConsumeProfileThreshold, prefix+".slow-consume-profile-threshold", 0, "Debug option to capture a profile of the pushes of a batch of records fetched from Kafka to the TSDB head which take longer than this duration. The profile is captured from the moment the threshold is exceeded until the batch has been pushed, and written to -"+prefix+".slow-consume-profile-directory. 0 to disable.")
+	f.StringVar(&cfg.SlowConsumeProfileType, prefix+".slow-consume-profile-type", slowConsumeProfileCPU, fmt.Sprintf("The type of the profile captured when -%[1]s.slow-consume-profile-threshold is exceeded. With %[2]q, a CPU profile is captured, unless another CPU profile is already being captured by the process. With %[3]q, a goroutine blocking profile is captured, with the blocking events sampled only while capturing. Supported options: %[4]s.", prefix, slowConsumeProfileCPU, slowConsumeProfileBlock, strings.Join(slowConsumeProfileOptions, ", ")))
+	f.StringVar(&cfg.SlowConsumeProfileDirectory, prefix+".slow-consume-profile-directory", "", "The directory the profiles captured when -"+prefix+".slow-consume-profile-threshold is exceeded are written to. Empty to use the temporary directory of the operating system.")
+	f.DurationVar(&cfg.SlowConsumeProfileCooldown, prefix+".slow-consume-profile-cooldown", 10*time.Minute, "The minimum time between the starts of two profiles captured when -"+prefix+".slow-consume-profile-threshold is exceeded, to avoid capturing a profile for each slow batch during an incident.")
+	f.StringVar(&cfg.CanaryTenant, prefix+".canary-tenant", "", "The tenant of the canary records, which are write requests pushed to the TSDB head on their own with the same code path as the records fetched from Kafka, for example by readiness checks verifying that the records can be ingested end to end before accepting the traffic. The canary records aren't written to Kafka. Empty to disable.")
+	f.IntVar(&cfg.MaxConsecutiveSkips, prefix+".max-consecutive-skips", 0, "The number of write requests read from Kafka skipped in a row, because they couldn't be parsed or have been rejected with a client error, after which an error is logged and the cortex_ingest_storage_reader_consecutive_skips_threshold_exceeded_total metric is incremented. The error is logged again each time the count crosses a multiple of this value, until a request is successfully pushed. 0 to disable.")
+	f.DurationVar(&cfg.MaxSeriesIdleTimeout, prefix+".max-series-idle-timeout", 20*time.Minute, "The time after which a series of a tenant which hasn't been consumed from Kafka anymore stops counting towards the tenant's maximum number of active series set with -ingest-storage.max-series.")
+	f.IntVar(&cfg.IdempotencyTokensMaxSize, prefix+".idempotency-tokens-max-size", 0, "The number of idempotency tokens of the records fetched from Kafka which have been consumed recently that are kept, to skip the records with the same token, for example the records produced again by a producer retrying after a timeout. The token of a record is the value of its "+IdempotencyTokenHeader+" header, for example the producer ID and the sequence number of the record, and the records without it are never skipped. The skipped records are counted by the cortex_ingest_storage_reader_rejected_records_total metric with the reason "+reasonIdempotentSkip+". The oldest tokens are evicted once the maximum is reached. 0 to disable.")
+	f.DurationVar(&cfg.IdempotencyTokensTTL, prefix+".idempotency-tokens-ttl", 0, "The time after which the idempotency tokens kept when -"+prefix+".idempotency-tokens-max-size is set expire, after which the records with the same token aren't skipped anymore. 0 for no expiration.")
+	f.IntVar(&cfg.MetadataOnlyConcurrency, prefix+".metadata-only-concurrency", 0, "The number of workers pushing the records fetched from Kafka which contain only metadata to the TSDB head, separately from the records with samples, so that bursts of metadata don't delay the ingestion of samples. Up to -"+prefix+".ingestion-concurrency-queue-capacity metadata-only records are queued for each worker. 0 to push the metadata-only records like any other record.")
+	f.BoolVar(&cfg.DeferMetadataPushes, prefix+".defer-metadata-pushes", false, "When enabled, the metadata of the records fetched from Kafka is collected while consuming each batch of records, and pushed to the TSDB head at the end of the batch in a single request per tenant, while the samples and exemplars are pushed as usual.")
+	f.Var(&cfg.PushMetadata, prefix+".push-metadata", "Comma-separated list of key=value pairs of gRPC metadata injected in the context of each push of the records fetched from Kafka to the TSDB head, for example source=replay, so that the storage can treat the write requests replayed from Kafka specially. The metadata is both added to the outgoing metadata, for the storage reached via gRPC, and to the incoming metadata, for the storage running in the same process. The keys must be valid lowercase gRPC metadata keys, and must not start with grpc-. Empty to disable.")
+	f.Var(&cfg.TenantInflightBytesTrackedTenants, prefix+".tenant-inflight-bytes-tracked-tenants", "Comma-separated list of tenants for which the bytes of the records fetched from Kafka which are being decoded or waiting to be pushed to the TSDB head are exported as a metric.")
+	f.Var(&cfg.ProcessingTimeTrackedTenants, prefix+".processing-time-tracked-tenants", "Comma-separated list of tenants for which the time taken to push each record fetched from Kafka to the TSDB head is exported as a per-tenant histogram. The records of all the tenants are tracked by the aggregated processing time histogram.")
+	f.DurationVar(&cfg.ProcessingTimeSLO, prefix+".processing-time-slo", 0, "The time under which the push of a record fetched from Kafka to the TSDB head is considered within the processing time SLO. For the tenants of -"+prefix+".processing-time-tracked-tenants, the records pushed and the ones pushed within the SLO are counted, for SLO burn-rate alerting. 0 to disable.")
+
+	f.BoolVar(&cfg.TenantCircuitBreakerEnabled, prefix+".tenant-circuit-breaker-enabled", false, "Enable a circuit breaker for each tenant when pushing the records consumed from Kafka to the storage. When the circuit breaker of a tenant is open, the records of that tenant fail without being pushed, while the other tenants are unaffected.")
+	f.DurationVar(&cfg.InjectedPushLatency, prefix+".injected-push-latency", 0, "Testing only. Artificial latency added to each push of the records consumed from Kafka to the storage. Requires a binary built with the chaos_testing build tag. 0 to disable.")
+	f.Var(&cfg.InjectedPushLatencyTenants, prefix+".injected-push-latency-tenants", "Testing only. Comma-separated list of tenants to which the injected push latency applies. Empty to apply it to all tenants.")
+	f.UintVar(&cfg.TenantCircuitBreakerFailureThreshold, prefix+".tenant-circuit-breaker-failure-threshold", 5, "The number of consecutive server errors for a tenant after which its circuit breaker opens. Only used when -"+prefix+".tenant-circuit-breaker-enabled is true.")
+	f.DurationVar(&cfg.TenantCircuitBreakerCooldownPeriod, prefix+".tenant-circuit-breaker-cooldown-period", 10*time.Second, "How long the circuit breaker of a tenant stays open before allowing a push to test whether the storage has recovered. Only used when -"+prefix+".tenant-circuit-breaker-enabled is true.")
+	f.DurationVar(&cfg.TenantCircuitBreakerIdleTimeout, prefix+".tenant-circuit-breaker-idle-timeout", time.Hour, "How long the circuit breaker of a tenant is kept while it's closed and the tenant doesn't push any record. The circuit breakers which aren't closed are always kept. Only used when -"+prefix+".tenant-circuit-breaker-enabled is true. 0 to keep the circuit breakers forever.")
+
+	f.Float64Var(&cfg.ServerErrorRatioHealthThreshold, prefix+".server-error-ratio-health-threshold", 0, "The ratio of server errors among the most recent pushes of the records consumed from Kafka to the storage above which the ingester is reported as not ready. 0 to disable.")
+	f.IntVar(&cfg.ServerErrorRatioHealthWindow, prefix+".server-error-ratio-health-window", 100, "The number of most recent pushes to the storage over which the ratio of server errors is computed. Only used when -"+prefix+".server-error-ratio-health-threshold is greater than 0.")
 }
 
 func (cfg *KafkaConfig) Validate() error {
@@ -229,12 +563,170 @@ func (cfg *KafkaConfig) Validate() error {
 		return ErrInvalidIngestionConcurrencyMax
 	}
 
+	if cfg.IngestionConcurrencyWarmUpDuration < 0 {
+		return ErrInvalidIngestionConcurrencyWarmUp
+	}
+
+	if cfg.IngestionConcurrencyIdleFlushTimeout < 0 {
+		return ErrInvalidIngestionConcurrencyIdleFlush
+	}
+
 	if cfg.IngestionConcurrencyMax >= 1 {
 		if cfg.IngestionConcurrencyBatchSize <= 0 || cfg.IngestionConcurrencyQueueCapacity <= 0 || cfg.IngestionConcurrencyEstimatedBytesPerSample <= 0 || cfg.IngestionConcurrencyTargetFlushesPerShard <= 0 {
 			return ErrInvalidIngestionConcurrencyParams
 		}
 	}
 
+	if !slices.Contains(ingestionOrderingOptions, cfg.IngestionOrdering) {
+		return ErrInvalidIngestionOrdering
+	}
+
+	if (cfg.IngestionOrdering == ingestionOrderingRelaxed || cfg.IngestionOrdering == ingestionOrderingSeries) && cfg.IngestionConcurrencyMax <= 0 {
+		return ErrRelaxedIngestionOrderingConcurrency
+	}
+
+	if cfg.ConsumeMaxRetries < 0 {
+		return ErrInvalidConsumeMaxRetries
+	}
+
+	if cfg.ConsumeRetryBudget < 0 {
+		return ErrInvalidConsumeRetryBudget
+	}
+
+	if cfg.IngestionDecodeMaxBytes < 0 {
+		return ErrInvalidIngestionDecodeMaxBytes
+	}
+
+	if cfg.MaxDecompressedRecordSizeBytes < 0 {
+		return ErrInvalidMaxDecompressedRecordSizeBytes
+	}
+
+	if cfg.IngestionDecodeTimeout < 0 {
+		return ErrInvalidIngestionDecodeTimeout
+	}
+
+	if cfg.IngestionDecodeTimeoutMaxAbandoned < 0 {
+		return ErrInvalidIngestionDecodeMaxAbandoned
+	}
+
+	if cfg.IngestionFirstRecordTimeout < 0 {
+		return ErrInvalidIngestionFirstRecordTimeout
+	}
+
+	if cfg.IngestionMutationTimeout < 0 {
+		return ErrInvalidIngestionMutationTimeout
+	}
+
+	if cfg.IngestionPushTimeout < 0 || cfg.IngestionPushTimeoutPerKiB < 0 || cfg.IngestionPushMaxTimeout < 0 ||
+		(cfg.IngestionPushMaxTimeout > 0 && cfg.IngestionPushMaxTimeout < cfg.IngestionPushTimeout) {
+		return ErrInvalidIngestionPushTimeout
+	}
+
+	if cfg.MaxRecordsPerConsume < 0 {
+		return ErrInvalidMaxRecordsPerConsume
+	}
+
+	if cfg.MaxTenantsPerConsume < 0 {
+		return ErrInvalidMaxTenantsPerConsume
+	}
+
+	if cfg.MaxConsumeDuration < 0 {
+		return ErrInvalidMaxConsumeDuration
+	}
+
+	if cfg.IngestionMaxSampleAge < 0 {
+		return ErrInvalidIngestionMaxSampleAge
+	}
+
+	if cfg.IngestionMaxProcessingLag < 0 {
+		return ErrInvalidIngestionMaxProcessingLag
+	}
+
+	if cfg.IngestionSplitRequestsMaxBytes < 0 {
+		return ErrInvalidIngestionSplitRequestsMaxBytes
+	}
+
+	if cfg.ProcessingTimeSLO < 0 {
+		return ErrInvalidProcessingTimeSLO
+	}
+
+	if !slices.Contains(futureSamplesOptions, cfg.IngestionFutureSamplesBehavior) {
+		return ErrInvalidFutureSamplesBehavior
+	}
+
+	if cfg.IngestionDuplicateSamplesBehavior != "" && !slices.Contains(duplicateSamplesOptions, cfg.IngestionDuplicateSamplesBehavior) {
+		return ErrInvalidDuplicateSamplesBehavior
+	}
+
+	if cfg.IngestionExemplarOnlyRecordsBehavior != "" && !slices.Contains(exemplarOnlyRecordsOptions, cfg.IngestionExemplarOnlyRecordsBehavior) {
+		return ErrInvalidExemplarOnlyRecordsBehavior
+	}
+
+	if cfg.IngestionMaxExemplarsPerSecond < 0 {
+		return ErrInvalidIngestionMaxExemplarsPerSecond
+	}
+
+	if cfg.IngestionMergeWindow < 0 || (cfg.IngestionMergeWindow > 0 && cfg.IngestionMergeMaxBytes <= 0) {
+		return ErrInvalidIngestionMergeWindow
+	}
+
+	if cfg.RecordOutcomeLogFormat != "" && !slices.Contains(recordOutcomeLogOptions, cfg.RecordOutcomeLogFormat) {
+		return ErrInvalidRecordOutcomeLogFormat
+	}
+
+	if cfg.RecordSummaryLogSampleRate < 0 {
+		return ErrInvalidRecordSummaryLogSampleRate
+	}
+
+	if _, err := parsePushMetadata(cfg.PushMetadata); err != nil {
+		return ErrInvalidPushMetadata
+	}
+
+	if cfg.IngestionFutureSamplesTolerance < 0 {
+		return ErrInvalidFutureSamplesTolerance
+	}
+
+	if cfg.HeartbeatTenant != "" && !model.IsValidLegacyMetricName(cfg.HeartbeatMetricName) {
+		return ErrInvalidHeartbeatMetricName
+	}
+
+	if cfg.MaxConsecutiveSkips < 0 {
+		return ErrInvalidMaxConsecutiveSkips
+	}
+
+	if cfg.SlowConsumeProfileThreshold < 0 || cfg.SlowConsumeProfileCooldown < 0 ||
+		(cfg.SlowConsumeProfileThreshold > 0 && !slices.Contains(slowConsumeProfileOptions, cfg.SlowConsumeProfileType)) {
+		return ErrInvalidSlowConsumeProfile
+	}
+
+	if cfg.MaxSeriesIdleTimeout <= 0 {
+		return ErrInvalidMaxSeriesIdleTimeout
+	}
+
+	if cfg.IdempotencyTokensMaxSize < 0 || cfg.IdempotencyTokensTTL < 0 {
+		return ErrInvalidIdempotencyTokens
+	}
+
+	if cfg.MetadataOnlyConcurrency < 0 || (cfg.MetadataOnlyConcurrency > 0 && cfg.IngestionConcurrencyQueueCapacity <= 0) {
+		return ErrInvalidMetadataOnlyConcurrency
+	}
+
+	if cfg.TenantCircuitBreakerEnabled && cfg.TenantCircuitBreakerFailureThreshold == 0 {
+		return ErrInvalidTenantCircuitBreakerThreshold
+	}
+
+	if cfg.TenantCircuitBreakerIdleTimeout < 0 {
+		return ErrInvalidTenantCircuitBreakerIdleTimeout
+	}
+
+	if cfg.ServerErrorRatioHealthThreshold < 0 || cfg.ServerErrorRatioHealthThreshold > 1 || (cfg.ServerErrorRatioHealthThreshold > 0 && cfg.ServerErrorRatioHealthWindow <= 0) {
+		return ErrInvalidServerErrorRatioHealthCheck
+	}
+
+	if cfg.InjectedPushLatency > 0 && !pushLatencyInjectionAllowed {
+		return ErrPushLatencyInjectionNotAllowed
+	}
+
 	return nil
 }
 
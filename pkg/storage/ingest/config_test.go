@@ -210,6 +210,430 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			expectedErr: ErrInvalidIngestionConcurrencyParams,
 		},
+		"should fail if the tenant circuit breaker is enabled and the failure threshold is 0": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.TenantCircuitBreakerEnabled = true
+				cfg.KafkaConfig.TenantCircuitBreakerFailureThreshold = 0
+			},
+			expectedErr: ErrInvalidTenantCircuitBreakerThreshold,
+		},
+		"should fail if the ingestion ordering is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionOrdering = "random"
+			},
+			expectedErr: ErrInvalidIngestionOrdering,
+		},
+		"should fail if the ingestion ordering is relaxed and max ingestion concurrency is 0": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionOrdering = ingestionOrderingRelaxed
+				cfg.KafkaConfig.IngestionConcurrencyMax = 0
+			},
+			expectedErr: ErrRelaxedIngestionOrderingConcurrency,
+		},
+		"should pass if the ingestion ordering is relaxed and max ingestion concurrency is greater than 0": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionOrdering = ingestionOrderingRelaxed
+				cfg.KafkaConfig.IngestionConcurrencyMax = 4
+			},
+		},
+		"should fail if the push latency injection is enabled in a binary built without the chaos_testing build tag": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.InjectedPushLatency = time.Second
+			},
+			expectedErr: ErrPushLatencyInjectionNotAllowed,
+		},
+		"should fail if ingestion decode max bytes is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionDecodeMaxBytes = -1
+			},
+			expectedErr: ErrInvalidIngestionDecodeMaxBytes,
+		},
+		"should fail if the server error ratio health threshold is greater than 1": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.ServerErrorRatioHealthThreshold = 1.5
+			},
+			expectedErr: ErrInvalidServerErrorRatioHealthCheck,
+		},
+		"should fail if the server error ratio health check is enabled and the window is 0": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.ServerErrorRatioHealthThreshold = 0.5
+				cfg.KafkaConfig.ServerErrorRatioHealthWindow = 0
+			},
+			expectedErr: ErrInvalidServerErrorRatioHealthCheck,
+		},
+		"should fail if consume max retries is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.ConsumeMaxRetries = -1
+			},
+			expectedErr: ErrInvalidConsumeMaxRetries,
+		},
+		"should fail if ingestion decode timeout is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionDecodeTimeout = -time.Second
+			},
+			expectedErr: ErrInvalidIngestionDecodeTimeout,
+		},
+		"should fail if max records per consume is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.MaxRecordsPerConsume = -1
+			},
+			expectedErr: ErrInvalidMaxRecordsPerConsume,
+		},
+		"should fail if the ingestion ordering is series and max ingestion concurrency is 0": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionOrdering = ingestionOrderingSeries
+				cfg.KafkaConfig.IngestionConcurrencyMax = 0
+			},
+			expectedErr: ErrRelaxedIngestionOrderingConcurrency,
+		},
+		"should fail if metadata only concurrency is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.MetadataOnlyConcurrency = -1
+			},
+			expectedErr: ErrInvalidMetadataOnlyConcurrency,
+		},
+		"should fail if ingestion max sample age is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionMaxSampleAge = -time.Hour
+			},
+			expectedErr: ErrInvalidIngestionMaxSampleAge,
+		},
+		"should fail if max consecutive skips is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.MaxConsecutiveSkips = -1
+			},
+			expectedErr: ErrInvalidMaxConsecutiveSkips,
+		},
+		"should fail if ingestion concurrency warm-up duration is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionConcurrencyWarmUpDuration = -time.Second
+			},
+			expectedErr: ErrInvalidIngestionConcurrencyWarmUp,
+		},
+		"should fail if the behavior for samples too far in the future is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionFutureSamplesBehavior = "unknown"
+			},
+			expectedErr: ErrInvalidFutureSamplesBehavior,
+		},
+		"should fail if the tolerance of samples in the future is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionFutureSamplesBehavior = futureSamplesReject
+				cfg.KafkaConfig.IngestionFutureSamplesTolerance = -time.Second
+			},
+			expectedErr: ErrInvalidFutureSamplesTolerance,
+		},
+		"should fail if the heartbeat metric name is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.HeartbeatTenant = "heartbeat"
+				cfg.KafkaConfig.HeartbeatMetricName = "invalid-name"
+			},
+			expectedErr: ErrInvalidHeartbeatMetricName,
+		},
+		"should fail if ingestion max processing lag is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionMaxProcessingLag = -time.Hour
+			},
+			expectedErr: ErrInvalidIngestionMaxProcessingLag,
+		},
+		"should fail if consume retry budget is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.ConsumeRetryBudget = -1
+			},
+			expectedErr: ErrInvalidConsumeRetryBudget,
+		},
+		"should fail if ingestion split requests max bytes is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionSplitRequestsMaxBytes = -1
+			},
+			expectedErr: ErrInvalidIngestionSplitRequestsMaxBytes,
+		},
+		"should fail if the record outcome log format is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.RecordOutcomeLogFormat = "xml"
+			},
+			expectedErr: ErrInvalidRecordOutcomeLogFormat,
+		},
+		"should fail if the processing time SLO is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.ProcessingTimeSLO = -time.Second
+			},
+			expectedErr: ErrInvalidProcessingTimeSLO,
+		},
+		"should fail if the behavior for samples with duplicate timestamps is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionDuplicateSamplesBehavior = "unknown"
+			},
+			expectedErr: ErrInvalidDuplicateSamplesBehavior,
+		},
+		"should fail if the max consume duration is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.MaxConsumeDuration = -time.Second
+			},
+			expectedErr: ErrInvalidMaxConsumeDuration,
+		},
+		"should fail if the push metadata is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.PushMetadata = []string{"source=replay", "Source"}
+			},
+			expectedErr: ErrInvalidPushMetadata,
+		},
+		"should pass if the push metadata is valid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.PushMetadata = []string{"source=replay"}
+			},
+		},
+		"should fail if the push timeout is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionPushTimeout = -time.Second
+			},
+			expectedErr: ErrInvalidIngestionPushTimeout,
+		},
+		"should fail if the maximum push timeout is lower than the push timeout": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionPushTimeout = 10 * time.Second
+				cfg.KafkaConfig.IngestionPushMaxTimeout = time.Second
+			},
+			expectedErr: ErrInvalidIngestionPushTimeout,
+		},
+		"should pass if the push timeout scales with the size of the requests": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionPushTimeout = time.Second
+				cfg.KafkaConfig.IngestionPushTimeoutPerKiB = time.Millisecond
+				cfg.KafkaConfig.IngestionPushMaxTimeout = 10 * time.Second
+			},
+		},
+		"should fail if the number of idempotency tokens is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IdempotencyTokensMaxSize = -1
+			},
+			expectedErr: ErrInvalidIdempotencyTokens,
+		},
+		"should fail if the TTL of the idempotency tokens is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IdempotencyTokensMaxSize = 100
+				cfg.KafkaConfig.IdempotencyTokensTTL = -time.Minute
+			},
+			expectedErr: ErrInvalidIdempotencyTokens,
+		},
+		"should fail if the max series idle timeout is not greater than 0": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.MaxSeriesIdleTimeout = 0
+			},
+			expectedErr: ErrInvalidMaxSeriesIdleTimeout,
+		},
+		"should fail if ingestion mutation timeout is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionMutationTimeout = -time.Second
+			},
+			expectedErr: ErrInvalidIngestionMutationTimeout,
+		},
+		"should fail if max tenants per consume is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.MaxTenantsPerConsume = -1
+			},
+			expectedErr: ErrInvalidMaxTenantsPerConsume,
+		},
+		"should fail if the behavior for records with exemplars but no samples is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionExemplarOnlyRecordsBehavior = "unknown"
+			},
+			expectedErr: ErrInvalidExemplarOnlyRecordsBehavior,
+		},
+		"should fail if the type of the slow consume profiles is invalid": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.SlowConsumeProfileThreshold = time.Second
+				cfg.KafkaConfig.SlowConsumeProfileType = "heap"
+			},
+			expectedErr: ErrInvalidSlowConsumeProfile,
+		},
+		"should fail if the ingestion concurrency idle flush timeout is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionConcurrencyIdleFlushTimeout = -time.Second
+			},
+			expectedErr: ErrInvalidIngestionConcurrencyIdleFlush,
+		},
+		"should fail if the max exemplars per second is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionMaxExemplarsPerSecond = -1
+			},
+			expectedErr: ErrInvalidIngestionMaxExemplarsPerSecond,
+		},
+		"should fail if the merge window is enabled without a maximum size": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionMergeWindow = time.Second
+				cfg.KafkaConfig.IngestionMergeMaxBytes = 0
+			},
+			expectedErr: ErrInvalidIngestionMergeWindow,
+		},
+		"should fail if ingestion first record timeout is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionFirstRecordTimeout = -time.Second
+			},
+			expectedErr: ErrInvalidIngestionFirstRecordTimeout,
+		},
+		"should fail if the record summary log sample rate is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.RecordSummaryLogSampleRate = -1
+			},
+			expectedErr: ErrInvalidRecordSummaryLogSampleRate,
+		},
+		"should fail if the max decompressed record size is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.MaxDecompressedRecordSizeBytes = -1
+			},
+			expectedErr: ErrInvalidMaxDecompressedRecordSizeBytes,
+		},
+		"should fail if the tenant circuit breaker idle timeout is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.TenantCircuitBreakerIdleTimeout = -1
+			},
+			expectedErr: ErrInvalidTenantCircuitBreakerIdleTimeout,
+		},
+		"should fail if the max abandoned decodes is negative": {
+			setup: func(cfg *Config) {
+				cfg.Enabled = true
+				cfg.KafkaConfig.Address = "localhost"
+				cfg.KafkaConfig.Topic = "test"
+				cfg.KafkaConfig.IngestionDecodeTimeoutMaxAbandoned = -1
+			},
+			expectedErr: ErrInvalidIngestionDecodeMaxAbandoned,
+		},
 	}
 
 	for testName, testData := range tests {
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"fmt"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+const decoderProtobuf = "protobuf"
+
+// RecordDecoder decodes the decompressed content of records into write requests. Several decoders can be configured,
+// for example to consume the records written with either the old or the new schema while the producers are migrated
+// from one to the other: each decoder is tried in order until one succeeds.
+type RecordDecoder interface {
+	// Name returns the name of the decoder, used to track the decoders which decoded the consumed records.
+	Name() string
+
+	// Decode decodes the content into req, which is empty. The request may be partially decoded
+	// when an error is returned. It must be safe to call concurrently.
+	Decode(content []byte, req *mimirpb.WriteRequest) error
+}
+
+// defaultDecoders are the decoders used to decode the content of the records.
+var defaultDecoders = []RecordDecoder{protobufDecoder{}}
+
+// protobufDecoder decodes the content of the records written by the distributors.
+type protobufDecoder struct{}
+
+func (protobufDecoder) Name() string { return decoderProtobuf }
+
+func (protobufDecoder) Decode(content []byte, req *mimirpb.WriteRequest) error {
+	return req.Unmarshal(content)
+}
+
+// WithRecordDecoders configures the consumer to decode the content of the records with the given decoders, which are
+// tried in order: the first one is the primary decoder, and the next ones are the fallbacks tried when the previous
+// ones fail. A record is a parse error only if all of them fail. By default, the records are decoded as write requests
+// written by the distributors.
+func WithRecordDecoders(decoders ...RecordDecoder) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		if len(decoders) > 0 {
+			c.decoders = decoders
+		}
+	}
+}
+
+// defaultDecodersOnly returns whether the records are decoded by the default decoders only.
+func (c pusherConsumer) defaultDecodersOnly() bool {
+	return len(c.decoders) == 1 && c.decoders[0] == RecordDecoder(protobufDecoder{})
+}
+
+// unmarshal decodes the decompressed content with the first decoder which succeeds, and returns the index of the
+// decoder. The failures of each decoder are counted, to tell which format the records failing to be decoded have.
+// If all the decoders fail, the error of the primary decoder is returned, annotated with the errors of the fallbacks.
+func (c pusherConsumer) unmarshal(content []byte) (*mimirpb.WriteRequest, int, error) {
+	var (
+		req        *mimirpb.WriteRequest
+		primaryErr error
+	)
+	for i, d := range c.decoders {
+		// Each decoder starts from an empty request, because a failed decoder may have partially decoded it.
+		// We don't free the WriteRequest slices because they are being freed by a level below.
+		req = &mimirpb.WriteRequest{}
+		err := d.Decode(content, req)
+		if err == nil {
+			c.metrics.recordDecoders.WithLabelValues(d.Name()).Inc()
+			return req, i, nil
+		}
+
+		c.metrics.decodeErrors.WithLabelValues(d.Name()).Inc()
+		if i == 0 {
+			primaryErr = err
+		} else {
+			primaryErr = fmt.Errorf("%w (fallback decoder %s: %v)", primaryErr, d.Name(), err)
+		}
+	}
+	return req, -1, primaryErr
+}
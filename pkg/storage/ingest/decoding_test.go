@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// legacyPrefix prefixes the content of the records written with the legacy schema of the tests.
+var legacyPrefix = []byte("legacy:")
+
+// legacyDecoder decodes the write requests prefixed by legacyPrefix.
+type legacyDecoder struct{}
+
+func (legacyDecoder) Name() string { return "legacy" }
+
+func (legacyDecoder) Decode(content []byte, req *mimirpb.WriteRequest) error {
+	if !bytes.HasPrefix(content, legacyPrefix) {
+		return errors.New("missing legacy prefix")
+	}
+	return req.Unmarshal(content[len(legacyPrefix):])
+}
+
+func TestPusherConsumer_RecordDecoders(t *testing.T) {
+	content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+	legacyContent := append(append([]byte{}, legacyPrefix...), content...)
+
+	records := func() []record {
+		return []record{
+			{ctx: context.Background(), tenantID: "user-1", content: content},
+			{ctx: context.Background(), tenantID: "user-1", content: gzipCompress(t, legacyContent)},
+			{ctx: context.Background(), tenantID: "user-1", content: legacyContent},
+			{ctx: context.Background(), tenantID: "user-1", content: []byte("garbage")},
+		}
+	}
+
+	tests := map[string]struct {
+		decoders         []RecordDecoder
+		expectedPushes   int64
+		expectedDecoders string
+		expectedErrors   string
+		expectedParseErr int
+	}{
+		"should decode the records with the default decoder": {
+			expectedPushes: 1,
+			expectedDecoders: `
+				cortex_ingest_storage_reader_records_by_decoder_total{decoder="protobuf"} 1
+			`,
+			expectedErrors: `
+				cortex_ingest_storage_reader_decode_errors_total{codec="protobuf"} 3
+			`,
+			expectedParseErr: 3,
+		},
+		"should fall back to the fallback decoder when the primary decoder fails": {
+			decoders:       []RecordDecoder{protobufDecoder{}, legacyDecoder{}},
+			expectedPushes: 3,
+			expectedDecoders: `
+				cortex_ingest_storage_reader_records_by_decoder_total{decoder="legacy"} 2
+				cortex_ingest_storage_reader_records_by_decoder_total{decoder="protobuf"} 1
+			`,
+			expectedErrors: `
+				cortex_ingest_storage_reader_decode_errors_total{codec="legacy"} 1
+				cortex_ingest_storage_reader_decode_errors_total{codec="protobuf"} 3
+			`,
+			expectedParseErr: 1,
+		},
+		"should try the decoders in the configured order": {
+			decoders:       []RecordDecoder{legacyDecoder{}, protobufDecoder{}},
+			expectedPushes: 3,
+			expectedDecoders: `
+				cortex_ingest_storage_reader_records_by_decoder_total{decoder="legacy"} 2
+				cortex_ingest_storage_reader_records_by_decoder_total{decoder="protobuf"} 1
+			`,
+			expectedErrors: `
+				cortex_ingest_storage_reader_decode_errors_total{codec="legacy"} 2
+				cortex_ingest_storage_reader_decode_errors_total{codec="protobuf"} 1
+			`,
+			expectedParseErr: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pushes := atomic.NewInt64(0)
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				pushes.Inc()
+				require.Len(t, request.Timeseries, 1)
+				assert.Equal(t, "series_1", request.Timeseries[0].Labels[0].Value)
+				return nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			metrics := newPusherConsumerMetrics(reg)
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithRecordDecoders(testData.decoders...))
+			require.NoError(t, c.Consume(context.Background(), records()))
+
+			assert.Equal(t, testData.expectedPushes, pushes.Load())
+			assert.Equal(t, float64(testData.expectedParseErr), testutil.ToFloat64(metrics.parseErrors))
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+				# HELP cortex_ingest_storage_reader_records_by_decoder_total Number of records read from Kafka by the decoder which decoded their content.
+				# TYPE cortex_ingest_storage_reader_records_by_decoder_total counter
+			`+testData.expectedDecoders), "cortex_ingest_storage_reader_records_by_decoder_total"))
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+				# HELP cortex_ingest_storage_reader_decode_errors_total Number of records read from Kafka which each decoder failed to decode, by the name of the decoder. The records decoded by a fallback decoder are counted for the decoders tried before it.
+				# TYPE cortex_ingest_storage_reader_decode_errors_total counter
+			`+testData.expectedErrors), "cortex_ingest_storage_reader_decode_errors_total"))
+		})
+	}
+}
+
+func TestPusherConsumer_RecordDecodersError(t *testing.T) {
+	c := newPusherConsumer(nil, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithRecordDecoders(protobufDecoder{}, legacyDecoder{}))
+
+	_, err := c.decode([]byte("garbage"))
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "(fallback decoder legacy: missing legacy prefix)")
+	assert.False(t, c.defaultDecodersOnly())
+}
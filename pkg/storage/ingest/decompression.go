@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const codecNone = "none"
+
+// errDecompressedContentTooLarge is the error of the records whose decompressed content exceeds the maximum size.
+var errDecompressedContentTooLarge = errors.New("the decompressed content exceeds the maximum size")
+
+// Decompressor decompresses the content of records compressed with a specific codec.
+// Records don't carry the codec they've been compressed with, so the codec is detected from the magic bytes
+// at the beginning of the content. This allows consuming records written by producers which compress them
+// alongside producers which don't.
+type Decompressor interface {
+	// Codec returns the name of the codec, used to track the codecs of the consumed records.
+	Codec() string
+
+	// Magic returns the bytes the content compressed with this codec begins with.
+	// The magic bytes must not be a valid prefix of an uncompressed write request.
+	Magic() []byte
+
+	// Decompress returns the decompressed content. It must be safe to call concurrently.
+	// If maxSize is greater than 0 and the decompressed content exceeds it, Decompress stops decompressing
+	// and returns an error wrapping errDecompressedContentTooLarge.
+	Decompress(content []byte, maxSize int) ([]byte, error)
+}
+
+// defaultDecompressors are the decompressors used to detect and decompress the content of the records.
+var defaultDecompressors = []Decompressor{
+	gzipDecompressor{},
+	snappyDecompressor{},
+	zstdDecompressor{},
+}
+
+// detectDecompressor returns the decompressor whose magic bytes prefix the content,
+// or nil if the content isn't compressed with any of the given codecs.
+func detectDecompressor(decompressors []Decompressor, content []byte) Decompressor {
+	for _, d := range decompressors {
+		if bytes.HasPrefix(content, d.Magic()) {
+			return d
+		}
+	}
+	return nil
+}
+
+// gzipMagic is the ID1, ID2 and CM fields of the gzip header, where CM is always deflate.
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+type gzipDecompressor struct{}
+
+func (gzipDecompressor) Codec() string { return "gzip" }
+
+func (gzipDecompressor) Magic() []byte { return gzipMagic }
+
+func (gzipDecompressor) Decompress(content []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readAllLimited(r, maxSize)
+}
+
+// snappyMagic is the stream identifier chunk the snappy framing format begins with.
+// The snappy block format has no magic bytes, so only the framing format can be detected.
+var snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+type snappyDecompressor struct{}
+
+func (snappyDecompressor) Codec() string { return "snappy" }
+
+func (snappyDecompressor) Magic() []byte { return snappyMagic }
+
+func (snappyDecompressor) Decompress(content []byte, maxSize int) ([]byte, error) {
+	return readAllLimited(snappy.NewReader(bytes.NewReader(content)), maxSize)
+}
+
+// zstdMagic is the magic number of a zstd frame. Its first byte is also the tag of a varint protobuf field
+// with number 5, which isn't defined in a write request.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdDecoders pools the zstd decoders by the maximum size of the decompressed content they've been created with, so
+// that we don't allocate a decoder and its buffers for each record. The decoders are only used with DecodeAll, which
+// doesn't need any goroutine when the decoder concurrency is 1, so the pooled decoders don't need to be closed when
+// they're garbage collected.
+var zstdDecoders sync.Map // map[int]*sync.Pool
+
+// zstdDecoderPool returns the pool of the zstd decoders which don't decompress more than maxSize bytes.
+// maxSize 0 means no limit.
+func zstdDecoderPool(maxSize int) *sync.Pool {
+	if pool, ok := zstdDecoders.Load(maxSize); ok {
+		return pool.(*sync.Pool)
+	}
+
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if maxSize > 0 {
+		// The window is bounded too, so that a frame can't make the decoder allocate a window larger than the content
+		// it's allowed to decompress, regardless of the size the frame declares.
+		window := uint64(min(max(maxSize, zstd.MinWindowSize), zstd.MaxWindowSize))
+		opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)), zstd.WithDecoderMaxWindow(window))
+	}
+
+	pool, _ := zstdDecoders.LoadOrStore(maxSize, &sync.Pool{
+		New: func() any {
+			d, err := zstd.NewReader(nil, opts...)
+			if err != nil {
+				// This can only happen with invalid options.
+				panic(err)
+			}
+			return d
+		},
+	})
+	return pool.(*sync.Pool)
+}
+
+type zstdDecompressor struct{}
+
+func (zstdDecompressor) Codec() string { return "zstd" }
+
+func (zstdDecompressor) Magic() []byte { return zstdMagic }
+
+// Decompress implements Decompressor. It's safe to call concurrently, because each call borrows its own decoder from the pool.
+func (zstdDecompressor) Decompress(content []byte, maxSize int) ([]byte, error) {
+	pool := zstdDecoderPool(maxSize)
+	d := pool.Get().(*zstd.Decoder)
+	defer pool.Put(d)
+
+	decompressed, err := d.DecodeAll(content, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, fmt.Errorf("%w of %d bytes: %w", errDecompressedContentTooLarge, maxSize, err)
+	}
+	return decompressed, err
+}
+
+// readAllLimited reads r until EOF, like io.ReadAll, but stops reading once more than maxSize bytes have been read.
+// maxSize 0 means no limit.
+func readAllLimited(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+
+	// One more byte than the limit is read, to tell a content of exactly maxSize bytes from a larger one.
+	content, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxSize {
+		return nil, fmt.Errorf("%w of %d bytes", errDecompressedContentTooLarge, maxSize)
+	}
+	return content, nil
+}
@@ -0,0 +1,270 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func gzipCompress(t testing.TB, content []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func snappyCompress(t testing.TB, content []byte) []byte {
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	_, err := w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zstdCompress(t testing.TB, content []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer w.Close()
+	return w.EncodeAll(content, nil)
+}
+
+func TestDetectDecompressor(t *testing.T) {
+	content, err := (&mimirpb.WriteRequest{
+		Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")},
+		Metadata:   []*mimirpb.MetricMetadata{{MetricFamilyName: "series_1", Help: "help"}},
+		Source:     mimirpb.RULE,
+	}).Marshal()
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		content       []byte
+		expectedCodec string
+	}{
+		"uncompressed": {
+			content:       content,
+			expectedCodec: codecNone,
+		},
+		"empty": {
+			content:       []byte{},
+			expectedCodec: codecNone,
+		},
+		"gzip": {
+			content:       gzipCompress(t, content),
+			expectedCodec: "gzip",
+		},
+		"snappy": {
+			content:       snappyCompress(t, content),
+			expectedCodec: "snappy",
+		},
+		"zstd": {
+			content:       zstdCompress(t, content),
+			expectedCodec: "zstd",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			d := detectDecompressor(defaultDecompressors, tc.content)
+			if tc.expectedCodec == codecNone {
+				assert.Nil(t, d)
+				return
+			}
+
+			require.NotNil(t, d)
+			assert.Equal(t, tc.expectedCodec, d.Codec())
+
+			decompressed, err := d.Decompress(tc.content, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, decompressed)
+		})
+	}
+}
+
+func TestDecompressor_MaxSize(t *testing.T) {
+	// The content is highly compressible, so that it's much larger than its compressed content.
+	content := bytes.Repeat([]byte("a"), 1024*1024)
+
+	tests := map[string]struct {
+		decompressor Decompressor
+		compressed   []byte
+	}{
+		"gzip": {
+			decompressor: gzipDecompressor{},
+			compressed:   gzipCompress(t, content),
+		},
+		"snappy": {
+			decompressor: snappyDecompressor{},
+			compressed:   snappyCompress(t, content),
+		},
+		"zstd": {
+			decompressor: zstdDecompressor{},
+			compressed:   zstdCompress(t, content),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			decompressed, err := tc.decompressor.Decompress(tc.compressed, len(content))
+			require.NoError(t, err)
+			assert.Equal(t, content, decompressed)
+
+			decompressed, err = tc.decompressor.Decompress(tc.compressed, len(content)-1)
+			require.ErrorIs(t, err, errDecompressedContentTooLarge)
+			assert.Nil(t, decompressed)
+		})
+	}
+}
+
+func TestPusherConsumer_ShouldDecompressRecords(t *testing.T) {
+	content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+
+	// The content begins with the gzip magic bytes, but it's not valid gzip.
+	corrupted := append([]byte{}, gzipCompress(t, content)[:len(gzipMagic)]...)
+
+	pushes := atomic.NewInt64(0)
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushes.Inc()
+		require.Len(t, request.Timeseries, 1)
+		assert.Equal(t, "series_1", request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), []record{
+		{ctx: context.Background(), tenantID: "user-1", content: content},
+		{ctx: context.Background(), tenantID: "user-1", content: gzipCompress(t, content)},
+		{ctx: context.Background(), tenantID: "user-1", content: snappyCompress(t, content)},
+		{ctx: context.Background(), tenantID: "user-1", content: zstdCompress(t, content)},
+		{ctx: context.Background(), tenantID: "user-1", content: corrupted},
+	}))
+
+	assert.Equal(t, int64(4), pushes.Load())
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_parse_errors_total Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.
+		# TYPE cortex_ingest_storage_reader_parse_errors_total counter
+		cortex_ingest_storage_reader_parse_errors_total 1
+
+		# HELP cortex_ingest_storage_reader_records_by_codec_total Number of records read from Kafka by the codec detected for their content.
+		# TYPE cortex_ingest_storage_reader_records_by_codec_total counter
+		cortex_ingest_storage_reader_records_by_codec_total{codec="gzip"} 2
+		cortex_ingest_storage_reader_records_by_codec_total{codec="none"} 1
+		cortex_ingest_storage_reader_records_by_codec_total{codec="snappy"} 1
+		cortex_ingest_storage_reader_records_by_codec_total{codec="zstd"} 1
+	`), "cortex_ingest_storage_reader_parse_errors_total", "cortex_ingest_storage_reader_records_by_codec_total"))
+}
+
+func TestPusherConsumer_ShouldSkipRecordsExceedingMaxDecompressedSize(t *testing.T) {
+	content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+
+	pushes := atomic.NewInt64(0)
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		pushes.Inc()
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	cfg := KafkaConfig{MaxDecompressedRecordSizeBytes: len(content) - 1}
+	c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), []record{
+		// The limit only applies to the decompressed content, so the uncompressed record is pushed.
+		{ctx: context.Background(), tenantID: "user-1", content: content},
+		{ctx: context.Background(), tenantID: "user-1", content: gzipCompress(t, content)},
+		{ctx: context.Background(), tenantID: "user-1", content: snappyCompress(t, content)},
+		{ctx: context.Background(), tenantID: "user-1", content: zstdCompress(t, content)},
+	}))
+
+	assert.Equal(t, int64(1), pushes.Load())
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_parse_errors_total Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.
+		# TYPE cortex_ingest_storage_reader_parse_errors_total counter
+		cortex_ingest_storage_reader_parse_errors_total 3
+	`), "cortex_ingest_storage_reader_parse_errors_total"))
+}
+
+func TestZstdDecompressor_Concurrency(t *testing.T) {
+	const goroutines = 10
+
+	contents := make([][]byte, goroutines)
+	for i := range contents {
+		contents[i] = bytes.Repeat([]byte{byte(i)}, 10_000+i)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(expected []byte) {
+			defer wg.Done()
+
+			compressed := zstdCompress(t, expected)
+			for j := 0; j < 100; j++ {
+				decompressed, err := zstdDecompressor{}.Decompress(compressed, 0)
+				if !assert.NoError(t, err) || !assert.Equal(t, expected, decompressed) {
+					return
+				}
+			}
+		}(contents[i])
+	}
+	wg.Wait()
+}
+
+func BenchmarkPusherConsumer_Decompression(b *testing.B) {
+	const numSeries = 2000
+
+	req := &mimirpb.WriteRequest{Timeseries: make([]mimirpb.PreallocTimeseries, 0, numSeries)}
+	for i := 0; i < numSeries; i++ {
+		req.Timeseries = append(req.Timeseries, mockPreallocTimeseries(fmt.Sprintf("series_%d", i)))
+	}
+	content, err := req.Marshal()
+	require.NoError(b, err)
+
+	codecs := map[string][]byte{
+		codecNone: content,
+		"snappy":  snappyCompress(b, content),
+		"zstd":    zstdCompress(b, content),
+	}
+
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	for _, codec := range []string{codecNone, "snappy", "zstd"} {
+		b.Run(codec, func(b *testing.B) {
+			records := make([]record, 100)
+			for i := range records {
+				records[i] = record{ctx: context.Background(), tenantID: "user-1", content: codecs[codec]}
+			}
+
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if err := c.Consume(context.Background(), records); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
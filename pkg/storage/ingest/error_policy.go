@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// The outcomes of the records handled by the ErrorPolicy instead of being pushed.
+const (
+	outcomeDeadLettered = "dead_lettered"
+	outcomeRepublished  = "republished"
+)
+
+// ErrorAction is the action taken by the consumer on a write request which failed to be pushed to the storage.
+type ErrorAction int
+
+const (
+	// ErrorActionSkip logs and skips the write request, like a client error, so that the consumption goes on.
+	ErrorActionSkip ErrorAction = iota
+	// ErrorActionRetry retries the push of the record within the retry budget of the batch, if the records are
+	// retried, and aborts the consumption of the batch once the record has failed all its retries.
+	ErrorActionRetry
+	// ErrorActionDeadLetter skips the record after logging it, and exports it with the FailedRecordExporter of the
+	// PartitionReader once the batch has been consumed, so that it can be reprocessed offline. The consumption is
+	// aborted if there's no FailedRecordExporter, so that the record isn't lost.
+	ErrorActionDeadLetter
+	// ErrorActionAbort aborts the consumption of the batch without retrying the record, so that the batch is retried
+	// and eventually handed over to the PoisonPolicy.
+	ErrorActionAbort
+	// ErrorActionRepublish republishes the record with the RecordRepublisher of the PartitionReader, so that it's
+	// consumed again later, and skips it. The consumption is aborted if there's no RecordRepublisher or it fails.
+	ErrorActionRepublish
+)
+
+func (a ErrorAction) String() string {
+	switch a {
+	case ErrorActionSkip:
+		return "skip"
+	case ErrorActionRetry:
+		return "retry"
+	case ErrorActionDeadLetter:
+		return "dead-letter"
+	case ErrorActionAbort:
+		return "abort"
+	case ErrorActionRepublish:
+		return "republish"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrorPolicy decides what to do with a write request which failed to be pushed to the storage with err. It's
+// consulted for each failed push, by the goroutine pushing the request, so it should return quickly. The tenant of
+// the request is in the context.
+//
+// The actions applying to a record are only honored when each record is pushed on its own, which is the case when
+// the records are pushed sequentially or with the relaxed ingestion ordering. Otherwise, the requests pushed may span
+// multiple records, so the actions other than ErrorActionSkip abort the consumption of the batch.
+type ErrorPolicy interface {
+	Decide(ctx context.Context, err error) ErrorAction
+}
+
+// ErrorPolicyFunc is a function that implements ErrorPolicy.
+type ErrorPolicyFunc func(ctx context.Context, err error) ErrorAction
+
+func (f ErrorPolicyFunc) Decide(ctx context.Context, err error) ErrorAction {
+	return f(ctx, err)
+}
+
+// DefaultErrorPolicy is the default ErrorPolicy. It skips the write requests rejected with a client error, and retries
+// the ones which failed with a server error. It can be used as a fallback by custom policies.
+var DefaultErrorPolicy = ErrorPolicyFunc(func(_ context.Context, err error) ErrorAction {
+	if mimirpb.IsClientError(err) {
+		return ErrorActionSkip
+	}
+	return ErrorActionRetry
+})
+
+// WithErrorPolicy configures the ErrorPolicy consulted for each write request which failed to be pushed to the
+// storage. By default, the client errors are skipped and the server errors are retried, see DefaultErrorPolicy.
+func WithErrorPolicy(policy ErrorPolicy) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.errorPolicy = policy
+	}
+}
+
+// RecordRepublisher republishes the records whose push failed with an error the ErrorPolicy decided to republish,
+// for example to the end of their partition or to a retry topic, so that they're consumed again later.
+type RecordRepublisher interface {
+	// RepublishRecord republishes the record. It's called by the goroutine pushing the record, which waits for it to
+	// return. The record must not be retained once it has returned, because its content may be reused.
+	RepublishRecord(ctx context.Context, rec FailedRecord) error
+}
+
+// WithRecordRepublisher configures the PartitionReader to republish with the republisher the records whose push
+// failed with an error the ErrorPolicy decided to republish. The records are only republished by the PartitionReader
+// created with NewPartitionReaderForPusher.
+func WithRecordRepublisher(republisher RecordRepublisher) PartitionReaderOption {
+	return func(r *PartitionReader) {
+		r.recordRepublisher = republisher
+	}
+}
+
+// withRecordRepublisher configures the consumer to republish the records of the partition with the republisher.
+func withRecordRepublisher(republisher RecordRepublisher, partition int32) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.republisher = republisher
+		c.partition = partition
+	}
+}
+
+// pushActionError is the error of a push annotated with the action decided by the ErrorPolicy, so that the action is
+// applied to the record once the error has been returned by the storage writer.
+type pushActionError struct {
+	action ErrorAction
+	err    error
+}
+
+func (e *pushActionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pushActionError) Unwrap() error {
+	return e.err
+}
+
+// errorActionOf returns the action decided by the ErrorPolicy for err. The errors which haven't been handed over to
+// the policy, for example because they've been returned by the shards pushing in parallel, are retried like the
+// server errors.
+func errorActionOf(err error) ErrorAction {
+	var actionErr *pushActionError
+	if errors.As(err, &actionErr) {
+		return actionErr.action
+	}
+	return ErrorActionRetry
+}
+
+// applyErrorAction applies the action decided by the ErrorPolicy to the record whose push failed with err, once the
+// record has been retried if it had to be. It returns the outcome of the record and the error the consumption must
+// fail with, if any: the records dead-lettered or republished don't fail the consumption.
+func (c pusherConsumer) applyErrorAction(ctx context.Context, r parsedRecord, err error) (string, error) {
+	if err == nil {
+		return outcomePushed, nil
+	}
+
+	switch errorActionOf(err) {
+	case ErrorActionDeadLetter:
+		if c.failedRecords == nil {
+			return outcomeFailed, fmt.Errorf("%w (the record can't be dead-lettered because there's no failed record exporter)", err)
+		}
+		level.Error(spanlogger.FromContext(ctx, c.logger)).Log("msg", "dead-lettering write request which failed to be pushed, as decided by the error policy", "user", r.tenantID, "offset", r.offset, "err", err)
+		// The record is exported under the tenant it's been produced for, so that it's remapped again if it's replayed.
+		r.tenantID, r.err = r.producedTenantID, err
+		c.failedRecords.add(r)
+		return outcomeDeadLettered, nil
+	case ErrorActionRepublish:
+		if c.republisher == nil {
+			return outcomeFailed, fmt.Errorf("%w (the record can't be republished because there's no record republisher)", err)
+		}
+		rec := FailedRecord{Partition: c.partition, Offset: r.offset, TenantID: r.producedTenantID, Timestamp: r.timestamp, Content: r.content, Err: err}
+		if rerr := c.republisher.RepublishRecord(ctx, rec); rerr != nil {
+			return outcomeFailed, fmt.Errorf("republishing record which failed to be pushed with %v: %w", err, rerr)
+		}
+		level.Warn(spanlogger.FromContext(ctx, c.logger)).Log("msg", "republished write request which failed to be pushed, as decided by the error policy", "user", r.tenantID, "offset", r.offset, "err", err)
+		return outcomeRepublished, nil
+	default:
+		return outcomeFailed, err
+	}
+}
@@ -0,0 +1,221 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// recordRepublisherFunc is a RecordRepublisher which calls the function for each record.
+type recordRepublisherFunc func(context.Context, FailedRecord) error
+
+func (f recordRepublisherFunc) RepublishRecord(ctx context.Context, rec FailedRecord) error {
+	return f(ctx, rec)
+}
+
+func TestPusherConsumer_WithErrorPolicy(t *testing.T) {
+	var (
+		clientErr = ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "bad data")
+		serverErr = ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+	)
+	newRecord := func(tenantID, metricName string, offset int64) record {
+		r := makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+		r.offset = offset
+		return r
+	}
+	records := []record{newRecord("user-1", "series_1", 10), newRecord("user-2", "series_2", 11), newRecord("user-1", "series_3", 12)}
+
+	tests := map[string]struct {
+		pushErr     error
+		action      *ErrorAction
+		republisher bool
+		noExporter  bool
+		retryBudget int
+
+		expectedPushes       []string
+		expectedErr          string
+		expectedDeadLettered []int64
+		expectedRepublished  []int64
+	}{
+		"should skip the client errors by default": {
+			pushErr:        clientErr,
+			expectedPushes: []string{"series_1", "series_2", "series_3"},
+		},
+		"should abort on the server errors by default": {
+			pushErr:        serverErr,
+			expectedPushes: []string{"series_1", "series_2"},
+			expectedErr:    "consuming record at index 1 for tenant user-2: rpc error: code = Unavailable desc = ingester internal error",
+		},
+		"should skip the server errors": {
+			pushErr:        serverErr,
+			action:         actionPtr(ErrorActionSkip),
+			expectedPushes: []string{"series_1", "series_2", "series_3"},
+		},
+		"should abort on the client errors": {
+			pushErr:        clientErr,
+			action:         actionPtr(ErrorActionAbort),
+			expectedPushes: []string{"series_1", "series_2"},
+			expectedErr:    "consuming record at index 1 for tenant user-2: rpc error: code = InvalidArgument desc = bad data",
+		},
+		"should not retry the errors aborting the consumption": {
+			pushErr:        serverErr,
+			action:         actionPtr(ErrorActionAbort),
+			retryBudget:    2,
+			expectedPushes: []string{"series_1", "series_2"},
+			expectedErr:    "ingester internal error",
+		},
+		"should retry the client errors": {
+			pushErr:        clientErr,
+			action:         actionPtr(ErrorActionRetry),
+			retryBudget:    2,
+			expectedPushes: []string{"series_1", "series_2", "series_2", "series_2"},
+			expectedErr:    "bad data",
+		},
+		"should dead-letter the record": {
+			pushErr:              serverErr,
+			action:               actionPtr(ErrorActionDeadLetter),
+			expectedPushes:       []string{"series_1", "series_2", "series_3"},
+			expectedDeadLettered: []int64{11},
+		},
+		"should abort if the record can't be dead-lettered": {
+			pushErr:        serverErr,
+			action:         actionPtr(ErrorActionDeadLetter),
+			noExporter:     true,
+			expectedPushes: []string{"series_1", "series_2"},
+			expectedErr:    "the record can't be dead-lettered because there's no failed record exporter",
+		},
+		"should republish the record": {
+			pushErr:             serverErr,
+			action:              actionPtr(ErrorActionRepublish),
+			republisher:         true,
+			expectedPushes:      []string{"series_1", "series_2", "series_3"},
+			expectedRepublished: []int64{11},
+		},
+		"should abort if the record can't be republished": {
+			pushErr:        serverErr,
+			action:         actionPtr(ErrorActionRepublish),
+			expectedPushes: []string{"series_1", "series_2"},
+			expectedErr:    "the record can't be republished because there's no record republisher",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var pushes []string
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				metricName := request.Timeseries[0].Labels[0].Value
+				pushes = append(pushes, metricName)
+				if metricName == "series_2" {
+					return testData.pushErr
+				}
+				return nil
+			})
+
+			var deadLettered, republished []int64
+			exporter := failedRecordExporterFunc(func(_ context.Context, records []FailedRecord) error {
+				for _, rec := range records {
+					assert.ErrorIs(t, rec.Err, testData.pushErr)
+					deadLettered = append(deadLettered, rec.Offset)
+				}
+				return nil
+			})
+			var opts []PusherConsumerOption
+			if !testData.noExporter {
+				opts = append(opts, withFailedRecordExports(newFailedRecordExports(exporter, 1, log.NewNopLogger(), prometheus.NewPedanticRegistry())))
+			}
+			if testData.action != nil {
+				opts = append(opts, WithErrorPolicy(ErrorPolicyFunc(func(context.Context, error) ErrorAction {
+					return *testData.action
+				})))
+			}
+			if testData.republisher {
+				opts = append(opts, withRecordRepublisher(recordRepublisherFunc(func(_ context.Context, rec FailedRecord) error {
+					assert.Equal(t, int32(1), rec.Partition)
+					assert.Equal(t, "user-2", rec.TenantID)
+					republished = append(republished, rec.Offset)
+					return nil
+				}), 1))
+			}
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, KafkaConfig{ConsumeRetryBudget: testData.retryBudget}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), opts...)
+			err := c.Consume(context.Background(), records)
+			if testData.expectedErr != "" {
+				require.ErrorContains(t, err, testData.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, testData.expectedPushes, pushes)
+			assert.Equal(t, testData.expectedDeadLettered, deadLettered)
+			assert.Equal(t, testData.expectedRepublished, republished)
+
+			// The policy is consulted for each failed push.
+			action := DefaultErrorPolicy.Decide(context.Background(), testData.pushErr)
+			if testData.action != nil {
+				action = *testData.action
+			}
+			failedPushes := 0
+			for _, metricName := range testData.expectedPushes {
+				if metricName == "series_2" {
+					failedPushes++
+				}
+			}
+			assert.Equal(t, float64(failedPushes), testutil.ToFloat64(metrics.storagePusherMetrics.errorPolicyDecisions.WithLabelValues(action.String())))
+		})
+	}
+}
+
+func TestPusherConsumer_WithErrorPolicy_FailedRecords(t *testing.T) {
+	serverErr := ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+	rec := makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)
+	rec.offset = 10
+
+	for _, action := range []ErrorAction{ErrorActionDeadLetter, ErrorActionRepublish} {
+		t.Run(action.String(), func(t *testing.T) {
+			var failed []FailedRecord
+			collect := func(_ context.Context, records ...FailedRecord) error {
+				for _, r := range records {
+					// The content is copied, because it must not be retained.
+					r.Content = append([]byte(nil), r.Content...)
+					failed = append(failed, r)
+				}
+				return nil
+			}
+			pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return serverErr })
+
+			// The records aren't retried, so their content is only kept for the ErrorPolicy.
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(),
+				WithErrorPolicy(ErrorPolicyFunc(func(context.Context, error) ErrorAction { return action })),
+				WithTenantRemapper(func(tenantID string) string { return "remapped-" + tenantID }),
+				withFailedRecordExports(newFailedRecordExports(failedRecordExporterFunc(func(ctx context.Context, records []FailedRecord) error {
+					return collect(ctx, records...)
+				}), 1, log.NewNopLogger(), prometheus.NewPedanticRegistry())),
+				withRecordRepublisher(recordRepublisherFunc(func(ctx context.Context, r FailedRecord) error {
+					return collect(ctx, r)
+				}), 1),
+			)
+			require.NoError(t, c.Consume(context.Background(), []record{rec}))
+
+			require.Len(t, failed, 1)
+			assert.Equal(t, rec.content, failed[0].Content)
+			assert.Equal(t, int64(10), failed[0].Offset)
+			// The record is kept under the tenant it's been produced for, so that it's remapped again when it's replayed.
+			assert.Equal(t, "user-1", failed[0].TenantID)
+		})
+	}
+}
+
+func actionPtr(action ErrorAction) *ErrorAction {
+	return &action
+}
@@ -0,0 +1,365 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+)
+
+// FailedRecord is a record which failed to be consumed, exported to be inspected or reprocessed offline.
+type FailedRecord struct {
+	// Partition is the partition the record has been read from.
+	Partition int32
+	// Offset is the offset of the record in the partition.
+	Offset int64
+	// TenantID is the tenant the record has been produced for.
+	TenantID string
+	// Timestamp is the Kafka timestamp of the record. It may be zero if unknown.
+	Timestamp time.Time
+	// Content is the content of the record as it's been read from Kafka, which may be compressed or batched.
+	Content []byte
+	// Err is the error the record failed with.
+	Err error
+}
+
+// FailedRecordExporter exports the records which failed to be consumed, for example to a local file or to an object
+// storage, so that operators can inspect them or re-ingest them later.
+type FailedRecordExporter interface {
+	// ExportFailedRecords exports the records. It's called by the consuming goroutine, at most once per consumed batch
+	// of records, so the records should be written with buffered I/O. The records must not be retained once it has
+	// returned, because their content may be reused.
+	ExportFailedRecords(ctx context.Context, records []FailedRecord) error
+}
+
+// WithFailedRecordExporter configures the PartitionReader to export the records which failed to be consumed: the records
+// skipped by the consumers because they couldn't be parsed into a write request, and the records of the batches which
+// are dead-lettered by the PoisonPolicy because they kept failing with server errors.
+//
+// The records skipped by a consumer are exported once the whole batch they belong to has been successfully consumed,
+// so that the records of the batches which are retried or dead-lettered aren't exported twice. The records skipped by
+// consumers are only exported by the PartitionReader created with NewPartitionReaderForPusher.
+func WithFailedRecordExporter(exporter FailedRecordExporter) PartitionReaderOption {
+	return func(r *PartitionReader) {
+		r.failedRecordExporter = exporter
+	}
+}
+
+// withFailedRecordExports configures the consumer to export the records it skips because they couldn't be parsed.
+func withFailedRecordExports(e *failedRecordExports) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.failedRecordExports = e
+	}
+}
+
+// failedRecordExports exports the failed records of a partition with a FailedRecordExporter, counting and logging the
+// failures of the exporter, which never fail the consumption. It's safe for concurrent use if the exporter is.
+// A nil *failedRecordExports is a no-op.
+type failedRecordExports struct {
+	exporter  FailedRecordExporter
+	partition int32
+	logger    log.Logger
+
+	exported prometheus.Counter
+	failures prometheus.Counter
+}
+
+func newFailedRecordExports(exporter FailedRecordExporter, partition int32, logger log.Logger, reg prometheus.Registerer) *failedRecordExports {
+	return &failedRecordExports{
+		exporter:  exporter,
+		partition: partition,
+		logger:    logger,
+		exported: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_failed_records_exported_total",
+			Help: "Number of records read from Kafka which failed to be consumed and have been exported for offline reprocessing.",
+		}),
+		failures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_failed_records_export_failures_total",
+			Help: "Number of records read from Kafka which failed to be consumed and couldn't be exported for offline reprocessing.",
+		}),
+	}
+}
+
+// export exports the records, after setting their partition.
+func (e *failedRecordExports) export(ctx context.Context, records []FailedRecord) {
+	if e == nil || len(records) == 0 {
+		return
+	}
+
+	for i := range records {
+		records[i].Partition = e.partition
+	}
+	if err := e.exporter.ExportFailedRecords(ctx, records); err != nil {
+		e.failures.Add(float64(len(records)))
+		level.Error(e.logger).Log("msg", "failed to export records which failed to be consumed", "records", len(records), "record_min_offset", records[0].Offset, "err", err)
+		return
+	}
+	e.exported.Add(float64(len(records)))
+}
+
+// failedRecordBuffer accumulates the records skipped while consuming a batch. It's safe for concurrent use.
+// A nil *failedRecordBuffer is a no-op.
+type failedRecordBuffer struct {
+	mx      sync.Mutex
+	records []FailedRecord
+}
+
+func (b *failedRecordBuffer) add(r parsedRecord) {
+	if b == nil {
+		return
+	}
+
+	b.mx.Lock()
+	b.records = append(b.records, FailedRecord{Offset: r.offset, TenantID: r.tenantID, Timestamp: r.timestamp, Content: r.content, Err: r.err})
+	b.mx.Unlock()
+}
+
+// flush exports the buffered records, if any.
+func (b *failedRecordBuffer) flush(ctx context.Context, e *failedRecordExports) {
+	if b == nil {
+		return
+	}
+	e.export(ctx, b.records)
+}
+
+// FailedRecordCompression is the codec the content of the failed records is compressed with by the exporters.
+type FailedRecordCompression string
+
+// The codecs the content of the failed records can be compressed with. The records read from Kafka may already be
+// compressed, in which case their content is compressed again.
+const (
+	// FailedRecordCompressionNone doesn't compress the content of the records. It's the default.
+	FailedRecordCompressionNone   FailedRecordCompression = ""
+	FailedRecordCompressionGzip   FailedRecordCompression = "gzip"
+	FailedRecordCompressionSnappy FailedRecordCompression = "snappy"
+	FailedRecordCompressionZstd   FailedRecordCompression = "zstd"
+)
+
+// FailedRecordExporterOption customizes the FileFailedRecordExporter and the BucketFailedRecordExporter.
+type FailedRecordExporterOption func(*failedRecordEncoder)
+
+// WithFailedRecordCompression configures the exporter to compress the content of the records with the codec, to reduce
+// the storage used by the large records. The codec is written alongside each record, so that ReadFailedRecords
+// decompresses their content.
+func WithFailedRecordCompression(compression FailedRecordCompression) FailedRecordExporterOption {
+	return func(e *failedRecordEncoder) {
+		e.compression = compression
+	}
+}
+
+// failedRecordLine is the JSON encoding of a FailedRecord, one per line.
+type failedRecordLine struct {
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	TenantID  string    `json:"tenant"`
+	Timestamp time.Time `json:"timestamp"`
+	Content   []byte    `json:"content"`
+	// Codec is the codec the content has been compressed with by the exporter, if any.
+	Codec string `json:"codec,omitempty"`
+	Err   string `json:"error"`
+}
+
+// failedRecordEncoder encodes the failed records, compressing their content if configured.
+type failedRecordEncoder struct {
+	compression FailedRecordCompression
+}
+
+func newFailedRecordEncoder(opts []FailedRecordExporterOption) failedRecordEncoder {
+	var e failedRecordEncoder
+	for _, opt := range opts {
+		opt(&e)
+	}
+	return e
+}
+
+// encode writes the records to w as JSON lines, which can be read back by ReadFailedRecords.
+// The content of the records is base64 encoded once compressed.
+func (e failedRecordEncoder) encode(w io.Writer, records []FailedRecord) error {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		content, err := compressFailedRecordContent(e.compression, r.Content)
+		if err != nil {
+			return fmt.Errorf("compressing failed record at offset %d: %w", r.Offset, err)
+		}
+
+		line := failedRecordLine{Partition: r.Partition, Offset: r.Offset, TenantID: r.TenantID, Timestamp: r.Timestamp, Content: content, Codec: string(e.compression)}
+		if r.Err != nil {
+			line.Err = r.Err.Error()
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// failedRecordZstdEncoder is shared by the exporters, because EncodeAll is safe to call concurrently.
+var failedRecordZstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+// compressFailedRecordContent compresses the content of a failed record with the codec. The compressed content can be
+// decompressed by the Decompressor of the codec.
+func compressFailedRecordContent(compression FailedRecordCompression, content []byte) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+	)
+	switch compression {
+	case FailedRecordCompressionNone:
+		return content, nil
+	case FailedRecordCompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case FailedRecordCompressionSnappy:
+		// The framing format is used, because it's the one the snappy Decompressor reads.
+		w = snappy.NewBufferedWriter(&buf)
+	case FailedRecordCompressionZstd:
+		enc, err := failedRecordZstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(content, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressFailedRecordContent decompresses the content of a failed record compressed with the codec by the exporter.
+func decompressFailedRecordContent(codec string, content []byte) ([]byte, error) {
+	if codec == "" {
+		return content, nil
+	}
+	for _, d := range defaultDecompressors {
+		if d.Codec() == codec {
+			// The content has been compressed by the exporter from a record which had already been decompressed.
+			return d.Decompress(content, 0)
+		}
+	}
+	return nil, fmt.Errorf("unsupported codec %q", codec)
+}
+
+// ReadFailedRecords reads the records exported by the FileFailedRecordExporter or the BucketFailedRecordExporter,
+// for example to re-ingest them, and calls fn for each of them in the order they've been exported, with their content
+// decompressed if it's been compressed by the exporter. It stops at the first error returned by fn.
+func ReadFailedRecords(r io.Reader, fn func(FailedRecord) error) error {
+	dec := json.NewDecoder(r)
+	for {
+		var line failedRecordLine
+		if err := dec.Decode(&line); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading failed record: %w", err)
+		}
+
+		content, err := decompressFailedRecordContent(line.Codec, line.Content)
+		if err != nil {
+			return fmt.Errorf("decompressing failed record at offset %d: %w", line.Offset, err)
+		}
+
+		rec := FailedRecord{Partition: line.Partition, Offset: line.Offset, TenantID: line.TenantID, Timestamp: line.Timestamp, Content: content}
+		if line.Err != "" {
+			rec.Err = errors.New(line.Err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// FileFailedRecordExporter is a FailedRecordExporter appending the records to a local file as JSON lines, which can
+// be read back by ReadFailedRecords. The writes are buffered, and the buffer is flushed once per call to
+// ExportFailedRecords. It's safe for concurrent use.
+type FileFailedRecordExporter struct {
+	encoder failedRecordEncoder
+
+	mx   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+}
+
+// NewFileFailedRecordExporter returns a FileFailedRecordExporter appending the records to the file at path, which is
+// created if it doesn't exist.
+func NewFileFailedRecordExporter(path string, opts ...FailedRecordExporterOption) (*FileFailedRecordExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening failed records file: %w", err)
+	}
+	return &FileFailedRecordExporter{encoder: newFailedRecordEncoder(opts), file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+// ExportFailedRecords implements FailedRecordExporter.
+func (e *FileFailedRecordExporter) ExportFailedRecords(_ context.Context, records []FailedRecord) error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if err := e.encoder.encode(e.buf, records); err != nil {
+		return err
+	}
+	return e.buf.Flush()
+}
+
+// Close closes the file.
+func (e *FileFailedRecordExporter) Close() error {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	return errors.Join(e.buf.Flush(), e.file.Close())
+}
+
+// BucketFailedRecordExporter is a FailedRecordExporter uploading the records of each call to ExportFailedRecords as an
+// object of JSON lines, which can be read back by ReadFailedRecords. The objects are named after the partition and the
+// offset of the first record they contain, and the time they've been uploaded at. It's safe for concurrent use.
+type BucketFailedRecordExporter struct {
+	encoder failedRecordEncoder
+	bucket  objstore.Bucket
+	prefix  string
+}
+
+// NewBucketFailedRecordExporter returns a BucketFailedRecordExporter uploading the objects under the prefix of the bucket.
+func NewBucketFailedRecordExporter(bucket objstore.Bucket, prefix string, opts ...FailedRecordExporterOption) *BucketFailedRecordExporter {
+	return &BucketFailedRecordExporter{encoder: newFailedRecordEncoder(opts), bucket: bucket, prefix: prefix}
+}
+
+// ExportFailedRecords implements FailedRecordExporter.
+func (e *BucketFailedRecordExporter) ExportFailedRecords(ctx context.Context, records []FailedRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := e.encoder.encode(&buf, records); err != nil {
+		return err
+	}
+
+	name := path.Join(e.prefix, fmt.Sprintf("%d-%020d-%d.jsonl", records[0].Partition, records[0].Offset, time.Now().UnixNano()))
+	if err := e.bucket.Upload(ctx, name, &buf); err != nil {
+		return fmt.Errorf("uploading failed records object %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type failedRecordExporterFunc func(ctx context.Context, records []FailedRecord) error
+
+func (f failedRecordExporterFunc) ExportFailedRecords(ctx context.Context, records []FailedRecord) error {
+	return f(ctx, records)
+}
+
+func readAllFailedRecords(t *testing.T, content string) []FailedRecord {
+	var records []FailedRecord
+	require.NoError(t, ReadFailedRecords(strings.NewReader(content), func(r FailedRecord) error {
+		records = append(records, r)
+		return nil
+	}))
+	return records
+}
+
+func TestFileFailedRecordExporter(t *testing.T) {
+	timestamp := time.UnixMilli(1000).UTC()
+	records := []FailedRecord{
+		{Partition: 1, Offset: 10, TenantID: "user-1", Timestamp: timestamp, Content: []byte{0x00, 0xff}, Err: errors.New("parse error")},
+		{Partition: 1, Offset: 11, TenantID: "user-2", Content: []byte("content")},
+	}
+
+	file := filepath.Join(t.TempDir(), "failed.jsonl")
+	exporter, err := NewFileFailedRecordExporter(file)
+	require.NoError(t, err)
+	require.NoError(t, exporter.ExportFailedRecords(context.Background(), records[:1]))
+	require.NoError(t, exporter.ExportFailedRecords(context.Background(), records[1:]))
+
+	// The records are flushed to the file by each export.
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.NoError(t, exporter.Close())
+
+	exported := readAllFailedRecords(t, string(content))
+	require.Len(t, exported, 2)
+	assert.Equal(t, records[0].Offset, exported[0].Offset)
+	assert.Equal(t, records[0].TenantID, exported[0].TenantID)
+	assert.True(t, timestamp.Equal(exported[0].Timestamp))
+	assert.Equal(t, records[0].Content, exported[0].Content)
+	assert.EqualError(t, exported[0].Err, "parse error")
+	assert.Equal(t, records[1].Content, exported[1].Content)
+	assert.NoError(t, exported[1].Err)
+
+	// The records are appended to the existing file.
+	exporter, err = NewFileFailedRecordExporter(file)
+	require.NoError(t, err)
+	require.NoError(t, exporter.ExportFailedRecords(context.Background(), records[:1]))
+	require.NoError(t, exporter.Close())
+
+	content, err = os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Len(t, readAllFailedRecords(t, string(content)), 3)
+}
+
+func TestBucketFailedRecordExporter(t *testing.T) {
+	bucket := objstore.NewInMemBucket()
+	exporter := NewBucketFailedRecordExporter(bucket, "failed")
+	require.NoError(t, exporter.ExportFailedRecords(context.Background(), nil))
+	require.NoError(t, exporter.ExportFailedRecords(context.Background(), []FailedRecord{
+		{Partition: 2, Offset: 20, TenantID: "user-1", Content: []byte("1"), Err: errors.New("failed")},
+		{Partition: 2, Offset: 21, TenantID: "user-1", Content: []byte("2"), Err: errors.New("failed")},
+	}))
+
+	objects := bucket.Objects()
+	require.Len(t, objects, 1)
+	for name, content := range objects {
+		assert.True(t, strings.HasPrefix(name, "failed/2-00000000000000000020-"), name)
+
+		exported := readAllFailedRecords(t, string(content))
+		require.Len(t, exported, 2)
+		assert.Equal(t, []byte("2"), exported[1].Content)
+	}
+}
+
+func TestFailedRecordExporters_Compression(t *testing.T) {
+	content := []byte(strings.Repeat("content", 100))
+	records := []FailedRecord{{Partition: 1, Offset: 10, TenantID: "user-1", Content: content, Err: errors.New("failed")}}
+
+	for _, compression := range []FailedRecordCompression{FailedRecordCompressionNone, FailedRecordCompressionGzip, FailedRecordCompressionSnappy, FailedRecordCompressionZstd} {
+		t.Run(fmt.Sprintf("compression=%q", compression), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "failed.jsonl")
+			fileExporter, err := NewFileFailedRecordExporter(file, WithFailedRecordCompression(compression))
+			require.NoError(t, err)
+			require.NoError(t, fileExporter.ExportFailedRecords(context.Background(), records))
+			require.NoError(t, fileExporter.Close())
+			fileContent, err := os.ReadFile(file)
+			require.NoError(t, err)
+
+			bucket := objstore.NewInMemBucket()
+			bucketExporter := NewBucketFailedRecordExporter(bucket, "failed", WithFailedRecordCompression(compression))
+			require.NoError(t, bucketExporter.ExportFailedRecords(context.Background(), records))
+			require.Len(t, bucket.Objects(), 1)
+
+			exportedContents := [][]byte{fileContent}
+			for _, objectContent := range bucket.Objects() {
+				exportedContents = append(exportedContents, objectContent)
+			}
+			for _, exportedContent := range exportedContents {
+				// The codec is recorded alongside the record, so that its content is decompressed when read back.
+				var line failedRecordLine
+				require.NoError(t, json.Unmarshal(exportedContent, &line))
+				assert.Equal(t, string(compression), line.Codec)
+				if compression != FailedRecordCompressionNone {
+					assert.Less(t, len(line.Content), len(content))
+				}
+
+				exported := readAllFailedRecords(t, string(exportedContent))
+				require.Len(t, exported, 1)
+				assert.Equal(t, content, exported[0].Content)
+				assert.EqualError(t, exported[0].Err, "failed")
+			}
+		})
+	}
+
+	t.Run("unsupported compression", func(t *testing.T) {
+		exporter := NewBucketFailedRecordExporter(objstore.NewInMemBucket(), "failed", WithFailedRecordCompression("lz4"))
+		require.ErrorContains(t, exporter.ExportFailedRecords(context.Background(), records), `unsupported compression "lz4"`)
+	})
+
+	t.Run("unsupported codec", func(t *testing.T) {
+		err := ReadFailedRecords(strings.NewReader(`{"offset":10,"content":"","codec":"lz4"}`), func(FailedRecord) error { return nil })
+		require.ErrorContains(t, err, `unsupported codec "lz4"`)
+	})
+}
+
+func TestPusherConsumer_FailedRecordExports(t *testing.T) {
+	valid := makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)
+	valid.offset = 1
+	invalid := record{ctx: context.Background(), tenantID: "user-2", offset: 2, content: []byte("invalid"), timestamp: time.UnixMilli(1000)}
+
+	newExports := func(exporter FailedRecordExporter) *failedRecordExports {
+		return newFailedRecordExports(exporter, 3, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	}
+
+	t.Run("should export the records which couldn't be parsed once the batch has been consumed", func(t *testing.T) {
+		var exported []FailedRecord
+		exports := newExports(failedRecordExporterFunc(func(_ context.Context, records []FailedRecord) error {
+			exported = append(exported, slices.Clone(records)...)
+			return nil
+		}))
+
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), withFailedRecordExports(exports))
+		require.NoError(t, c.Consume(context.Background(), []record{valid, invalid}))
+
+		require.Len(t, exported, 1)
+		assert.Equal(t, int32(3), exported[0].Partition)
+		assert.Equal(t, int64(2), exported[0].Offset)
+		assert.Equal(t, "user-2", exported[0].TenantID)
+		assert.Equal(t, invalid.timestamp, exported[0].Timestamp)
+		assert.Equal(t, invalid.content, exported[0].Content)
+		assert.ErrorContains(t, exported[0].Err, "parsing ingest consumer write request")
+		assert.Equal(t, float64(1), testutil.ToFloat64(exports.exported))
+	})
+
+	t.Run("should not export the records of a batch which failed to be consumed", func(t *testing.T) {
+		exported := 0
+		exports := newExports(failedRecordExporterFunc(func(_ context.Context, records []FailedRecord) error {
+			exported += len(records)
+			return nil
+		}))
+
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return errors.New("server error") })
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), withFailedRecordExports(exports))
+		require.Error(t, c.Consume(context.Background(), []record{invalid, valid}))
+
+		assert.Equal(t, 0, exported)
+	})
+
+	t.Run("should not fail the consumption if the records can't be exported", func(t *testing.T) {
+		exports := newExports(failedRecordExporterFunc(func(context.Context, []FailedRecord) error {
+			return errors.New("export error")
+		}))
+
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), withFailedRecordExports(exports))
+		require.NoError(t, c.Consume(context.Background(), []record{valid, invalid}))
+
+		assert.Equal(t, float64(0), testutil.ToFloat64(exports.exported))
+		assert.Equal(t, float64(1), testutil.ToFloat64(exports.failures))
+	})
+}
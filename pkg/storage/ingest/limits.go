@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import "time"
+
+// TenantLimits provides the per-tenant limits applied to the records consumed from Kafka before they're pushed to the storage.
+// It's implemented by validation.Overrides.
+type TenantLimits interface {
+	// IngestStorageDropExemplars returns whether the exemplars of the tenant's write requests should be dropped.
+	IngestStorageDropExemplars(userID string) bool
+	// IngestStorageDropMetadata returns whether the metadata of the tenant's write requests should be dropped.
+	IngestStorageDropMetadata(userID string) bool
+	// IngestStorageMaxInflightBytes returns the maximum size of the tenant's records which can be in flight, or 0 if unlimited.
+	IngestStorageMaxInflightBytes(userID string) int
+	// IngestStorageMaxExemplarsPerSeries returns the maximum number of exemplars per series of the tenant's write requests, or 0 if unlimited.
+	IngestStorageMaxExemplarsPerSeries(userID string) int
+	// IngestStorageMaxExemplarAge returns the maximum age of the exemplars of the tenant's write requests, or 0 if unlimited.
+	IngestStorageMaxExemplarAge(userID string) time.Duration
+	// IngestStorageDeniedMetricNames returns the metric names whose series are dropped from the tenant's write requests.
+	IngestStorageDeniedMetricNames(userID string) []string
+	// IngestStorageDeniedMetricNamesRegex returns the regular expression matching the metric names whose series are
+	// dropped from the tenant's write requests, or an empty string if none.
+	IngestStorageDeniedMetricNamesRegex(userID string) string
+	// IngestStorageInjectedLabels returns the name=value labels injected into every series of the tenant's write requests.
+	IngestStorageInjectedLabels(userID string) []string
+	// IngestStorageInjectedLabelsOverwrite returns whether the injected labels replace the labels with the same name
+	// the series already have.
+	IngestStorageInjectedLabelsOverwrite(userID string) bool
+	// IngestStorageRequiredLabels returns the label names every series of the tenant's write requests must have.
+	IngestStorageRequiredLabels(userID string) []string
+	// IngestStorageMaxSeries returns the maximum number of active series of the tenant, beyond which the new series of
+	// the tenant's write requests are dropped, or 0 if unlimited.
+	IngestStorageMaxSeries(userID string) int
+	// IngestStorageRejectMissingRequiredLabels returns whether the tenant's write requests with series missing required
+	// labels are rejected, instead of dropping those series.
+	IngestStorageRejectMissingRequiredLabels(userID string) bool
+	// IngestStoragePushTimeout returns the base timeout of the push of each of the tenant's records, overriding the
+	// one of the KafkaConfig, or 0 if the one of the KafkaConfig applies.
+	IngestStoragePushTimeout(userID string) time.Duration
+	// IngestStorageDownsampleInterval returns the interval the samples of the tenant's write requests are down-sampled
+	// to, or 0 if they aren't down-sampled.
+	IngestStorageDownsampleInterval(userID string) time.Duration
+}
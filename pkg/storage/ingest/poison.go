@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+)
+
+// PoisonDecision is the action taken by the PartitionReader on a batch of records which keeps failing to be consumed.
+type PoisonDecision int
+
+const (
+	// PoisonDecisionAbort stops the PartitionReader with the consumption error, without committing the batch.
+	PoisonDecisionAbort PoisonDecision = iota
+	// PoisonDecisionSkip skips the batch, so that its records are never consumed.
+	PoisonDecisionSkip
+	// PoisonDecisionDeadLetter skips the batch after logging the tenant and offset of each of its records,
+	// so that they can be found and reprocessed offline.
+	PoisonDecisionDeadLetter
+)
+
+func (d PoisonDecision) String() string {
+	switch d {
+	case PoisonDecisionAbort:
+		return "abort"
+	case PoisonDecisionSkip:
+		return "skip"
+	case PoisonDecisionDeadLetter:
+		return "dead-letter"
+	default:
+		return "unknown"
+	}
+}
+
+// PoisonBatch describes a batch of records which failed to be consumed after all the retries.
+type PoisonBatch struct {
+	// Partition is the partition the records have been read from.
+	Partition int32
+	// MinOffset and MaxOffset are the offsets of the first and last records of the batch.
+	MinOffset, MaxOffset int64
+	// Attempts is the number of times the batch has been attempted to be consumed.
+	Attempts int
+	// Err is the error returned by the last attempt.
+	Err error
+}
+
+// PoisonPolicy decides what to do with a batch of records which keeps failing to be consumed with server errors.
+// It's consulted once the batch has failed -ingest-storage.kafka.consume-max-retries times after the first attempt.
+type PoisonPolicy interface {
+	Decide(ctx context.Context, batch PoisonBatch) PoisonDecision
+}
+
+// PoisonPolicyFunc is a function that implements PoisonPolicy.
+type PoisonPolicyFunc func(ctx context.Context, batch PoisonBatch) PoisonDecision
+
+func (f PoisonPolicyFunc) Decide(ctx context.Context, batch PoisonBatch) PoisonDecision {
+	return f(ctx, batch)
+}
+
+// abortPoisonPolicy is the default PoisonPolicy. It never gives up on a batch.
+var abortPoisonPolicy = PoisonPolicyFunc(func(context.Context, PoisonBatch) PoisonDecision {
+	return PoisonDecisionAbort
+})
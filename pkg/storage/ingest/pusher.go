@@ -3,26 +3,58 @@
 package ingest
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"math/rand/v2"
+	"os"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/cancellation"
+	"github.com/grafana/dskit/grpcutil"
 	"github.com/grafana/dskit/middleware"
 	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc/codes"
 
 	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/globalerror"
 	util_log "github.com/grafana/mimir/pkg/util/log"
 	"github.com/grafana/mimir/pkg/util/spanlogger"
 )
 
+// errDecodeRoundTripMismatch is the parse error of the records whose write request doesn't match their content once re-marshalled.
+var errDecodeRoundTripMismatch = errors.New("the decoded write request doesn't match the content of the record once re-marshalled")
+
+// reasonTooFarInFuture is the reason of the records rejected because they have samples too far in the future.
+const reasonTooFarInFuture = "too_far_in_future"
+
+// reasonStaleDeadline is the reason of the records skipped because they haven't been pushed within the max processing lag.
+const reasonStaleDeadline = "stale_deadline"
+
+// errStaleDeadline is the error of the records skipped because they haven't been pushed within the max processing lag.
+var errStaleDeadline = errors.New("the record has not been pushed within the maximum processing lag since its Kafka timestamp")
+
+// reasonEmptyTenant is the reason of the records rejected because they have no tenant, which is usually a misconfiguration
+// of the producer.
+const reasonEmptyTenant = "empty_tenant"
+
+// errEmptyTenant is the error of the records rejected because they have no tenant.
+var errEmptyTenant = errors.New("the record has no tenant")
+
+// errDecodeTimeout is the parse error of the records whose decoding has been abandoned because it took too long.
+var errDecodeTimeout = errors.New("decoding the record timed out")
+
 type Pusher interface {
 	PushToStorage(context.Context, *mimirpb.WriteRequest) error
 }
@@ -34,131 +66,2085 @@ type PusherCloser interface {
 	Close() []error
 }
 
-// pusherConsumer receives records from Kafka and pushes them to the storage.
-// Each time a batch of records is received from Kafka, we instantiate a new pusherConsumer, this is to ensure we can retry if necessary and know whether we have completed that batch or not.
-type pusherConsumer struct {
-	metrics *pusherConsumerMetrics
-	logger  log.Logger
+// pusherConsumer receives records from Kafka and pushes them to the storage.
+// Each time a batch of records is received from Kafka, we instantiate a new pusherConsumer, this is to ensure we can retry if necessary and know whether we have completed that batch or not.
+//
+// The state of a consume is per call: it's either created by newPusherConsumer for each batch, or set by consume on its
+// own copy of the consumer. The state shared by the consumes is referenced by pointers configured with the options:
+// the state shared by the consumers of a PartitionReader, like the skips tracker and the metric denylists, and the
+// ConsumeLimiters, which may be shared by the consumers of different PartitionReader instances.
+type pusherConsumer struct {
+	metrics *pusherConsumerMetrics
+	logger  log.Logger
+
+	kafkaConfig KafkaConfig
+	limits      TenantLimits
+
+	pusher Pusher
+
+	// rawPusher is the Pusher if it implements RawPusher, or nil otherwise.
+	rawPusher RawPusher
+
+	// decompressors are used to detect whether the content of a record is compressed and to decompress it.
+	decompressors []Decompressor
+
+	// decoders are tried in order to decode the decompressed content of a record.
+	decoders []RecordDecoder
+
+	// decodeBudget bounds the bytes of the records being decoded and not pushed yet. It's nil when unlimited.
+	decodeBudget *decodeBudget
+
+	// tenantInflight bounds the bytes of the records of each tenant being decoded and not pushed yet.
+	tenantInflight *tenantInflightBytes
+
+	// abandonedDecodes bounds the abandoned decodes which are still running.
+	abandonedDecodes *abandonedDecodes
+
+	// limiters, if not nil, are the limiters shared with other consumers. The decodeBudget and tenantInflight are the
+	// ones of the limiters then.
+	limiters *ConsumeLimiters
+
+	// outcomes, if not nil, receives the outcome of each record once it's been handed over to the storage writer.
+	outcomes chan<- RecordOutcome
+
+	// outcomeLogger, if not nil, logs the outcome of each record.
+	outcomeLogger log.Logger
+
+	// onRecordDecoded, if not nil, is called by the decoding goroutine once each record has been decoded.
+	onRecordDecoded OnRecordDecoded
+
+	// processingTimeTenants are the tenants whose processing time of each record is tracked.
+	processingTimeTenants map[string]struct{}
+
+	// tenantRemapper, if not nil, returns the tenant the records of each tenant are pushed as.
+	tenantRemapper TenantRemapper
+
+	// lagTracker, if not nil, is updated with the offset of each record once it's been handed over to the storage writer.
+	lagTracker *consumerLagTracker
+
+	// pushingTenant, if not nil, tracks the tenant of the record being pushed.
+	pushingTenant *pushingTenantTracker
+
+	// warmUp, if not nil, ramps the ingestion concurrency after the PartitionReader has started.
+	warmUp *concurrencyWarmUp
+
+	// concurrency holds the ingestion concurrency set at runtime with SetConcurrency.
+	concurrency *concurrencyControl
+
+	// skips counts the consecutive skipped requests. It's nil if disabled.
+	skips *consecutiveSkipsTracker
+
+	// denylists caches the compiled metric denylists of the tenants.
+	denylists *metricDenylists
+
+	// seriesLimiter tracks the active series of the tenants with a maximum number of active series.
+	seriesLimiter *tenantSeriesLimiter
+
+	// metricsBackend, if not nil, receives the core metrics instead of Prometheus.
+	metricsBackend ConsumerMetrics
+
+	// heartbeat, if not nil, pushes the heartbeat series once each batch has been successfully consumed.
+	heartbeat *consumerHeartbeat
+
+	// profiler, if not nil, captures a profile of the consumes taking longer than its threshold.
+	profiler *slowConsumeProfiler
+
+	// exemplarLimiter, if not nil, drops the exemplars exceeding the maximum rate of the exemplars.
+	exemplarLimiter *exemplarRateLimiter
+
+	// quotas, if not nil, rejects the records of the tenants which have exceeded their quota.
+	quotas *tenantQuotas
+
+	// resourceMonitor is consulted before pushing each record, to slow down when the pressure on the resources is high.
+	resourceMonitor ResourceMonitor
+
+	// aborter tracks the in-flight consumes, so that they can be aborted.
+	aborter *consumeAborter
+
+	// skipPolicy decides what to do with the records which couldn't be parsed.
+	skipPolicy SkipPolicy
+
+	// errorPolicy, if not nil, overrides DefaultErrorPolicy to decide what to do with the failed pushes.
+	errorPolicy ErrorPolicy
+
+	// republisher, if not nil, republishes the records of the partition whose push failed with an error the
+	// errorPolicy decided to republish.
+	republisher RecordRepublisher
+	partition   int32
+
+	// priorityResolver, if not nil, returns the priority of each record pushed with the relaxed ordering.
+	priorityResolver RecordPriorityResolver
+
+	// recordOrdering, if not nil, returns the order the records of each batch are pushed in.
+	recordOrdering RecordOrdering
+
+	// consumeReports, if not nil, is called with the report of each consumed batch.
+	consumeReports func(ConsumeReport)
+
+	// auditSink, if not nil, receives the records successfully pushed once each batch has been consumed.
+	auditSink RecordAuditSink
+
+	// readBackVerifier, if not nil, reads a sample of readBackFraction of the pushed records back once each batch has
+	// been consumed.
+	readBackVerifier ReadBackVerifier
+	readBackFraction float64
+
+	// clientErrLogLimiter, if not nil, limits the rate of the logged client errors, across the consumers sharing it.
+	clientErrLogLimiter *ClientErrorLogLimiter
+
+	// serverErrClassifier, if not nil, overrides DefaultServerErrorClassifier to classify the server errors.
+	serverErrClassifier ServerErrorClassifier
+
+	// downsampler, if not nil, overrides KeepFirstPerInterval to down-sample the write requests.
+	downsampler Downsampler
+
+	// stagesFn, if not nil, returns the stages run on the records given the default stages.
+	stagesFn func(defaults []Stage) []Stage
+
+	// ingestionEvents, if not nil, publishes the ingestion events of the records pushed once each batch has been
+	// consumed.
+	ingestionEvents *ingestionEvents
+
+	// failedRecordExports, if not nil, exports the records skipped because they couldn't be parsed once each batch
+	// has been consumed.
+	failedRecordExports *failedRecordExports
+
+	// clientErrors aggregates the client errors returned while consuming a batch. It's set by consume, on its own copy
+	// of the consumer.
+	clientErrors *clientErrorAggregator
+
+	// tenantRecords counts the records of each tenant of a batch. It's set by consume, on its own copy of the
+	// consumer.
+	tenantRecords *tenantRecordCounter
+
+	// offsets tracks the offsets of the processed records. It's set by ConsumeWithLastProcessedOffset, on its own copy
+	// of the consumer.
+	offsets *processedOffsets
+
+	// retryBudget is the budget of the retries of the records failing with a server error while consuming a batch.
+	// It's set by consume, on its own copy of the consumer, when the retries are enabled.
+	retryBudget *retryBudget
+
+	// audit buffers the records pushed while consuming a batch. It's set by consume, on its own copy of the
+	// consumer, when an audit sink is configured.
+	audit *auditBuffer
+	// readBack buffers the samples to read back while consuming a batch. It's set by consume, on its own copy of the
+	// consumer, when the read-back verification is enabled.
+	readBack *readBackBuffer
+	// pipeline runs the stages of the records. It's set by consume, on its own copy of the consumer, so that the
+	// stages are bound to the copy.
+	pipeline pipeline
+
+	// failedRecords buffers the records skipped while consuming a batch. It's set by consume, on its own copy of the
+	// consumer, when the failed records are exported.
+	failedRecords *failedRecordBuffer
+	// events buffers the ingestion events of the records pushed while consuming a batch. It's set by consume, on its
+	// own copy of the consumer, when the ingestion events are published.
+	events *ingestionEventBuffer
+
+	// results collects the result of each record. It's only set on the copy of the consumer of ConsumeWithResults.
+	results *recordResults
+	// pacer spreads the pushes of the records over the window allotted to the consumption. It's only set on the copy
+	// of the consumer of ConsumeWithPacing.
+	pacer *pushPacer
+	// deltas accumulates the increments of the core metrics. It's only set on the copy of the consumer of
+	// ConsumeWithMetricsDeltas.
+	deltas *consumeDeltas
+
+	// idempotencyTokens, if not nil, holds the tokens of the records consumed recently, to skip the duplicate records.
+	idempotencyTokens *idempotencyTokens
+}
+
+// PusherConsumerOption customizes the consumer pushing the records read from Kafka to the storage.
+type PusherConsumerOption func(*pusherConsumer)
+
+// RecordOutcome is the outcome of pushing a single record to the storage.
+type RecordOutcome struct {
+	// Index is the position of the record in the consumed batch.
+	Index int
+	// TenantID is the tenant the record belongs to.
+	TenantID string
+	// Err is the error which caused the record to be skipped or the consumption to be aborted.
+	// It's nil if the record has been pushed or skipped because of a client error.
+	Err error
+}
+
+// WithRecordOutcomes configures the consumer to send the outcome of each record to the given channel,
+// as soon as the record has been handed over to the storage writer instead of at the end of the batch.
+//
+// Sending outcomes never applies backpressure to the consumption: if the channel is full, the outcome is
+// dropped and counted by the cortex_ingest_storage_reader_record_outcomes_dropped_total metric. This means
+// that a caller which stops reading from the channel can't block the consumption, but it also means that
+// the channel should be buffered to hold the outcomes of at least a batch of records if missing outcomes
+// isn't acceptable.
+//
+// When the writes are parallelized with -ingest-storage.kafka.ingestion-concurrency-max, the series of a
+// record may still be in flight when its outcome is sent, and the errors of the in-flight series are only
+// returned once the batch has been consumed. The channel is never closed by the consumer.
+func WithRecordOutcomes(outcomes chan<- RecordOutcome) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.outcomes = outcomes
+	}
+}
+
+// TenantRemapper returns the tenant the records of the given tenant should be pushed as.
+type TenantRemapper func(tenantID string) string
+
+// WithTenantRemapper configures the consumer to push the records under the tenant returned by the remapper,
+// for example to re-ingest the records of a tenant under a new tenant ID while migrating it. The tenant's limits
+// are the ones of the remapped tenant. By default, the records are pushed under the tenant they've been written with.
+func WithTenantRemapper(remapper TenantRemapper) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.tenantRemapper = remapper
+	}
+}
+
+// OnRecordDecoded is called with the position of the record among the decoded records of the consumed batch, its
+// tenant, the size of its content in bytes, and the error it failed to be decoded with, if any.
+type OnRecordDecoded func(index int, tenantID string, size int, err error)
+
+// WithOnRecordDecoded configures the consumer to call fn once each record has been decoded, whether it's been decoded
+// successfully or not, before it's handed over to the pushing goroutine. It can be used to sample the decoded records,
+// or to track the decode stage when the ingestion is bound by the decoding.
+//
+// fn is called by the goroutine decoding the records, so it must be fast and must not block, because the next record
+// isn't decoded until it has returned. The records rejected before being decoded, for example because they have no
+// tenant, are reported with the error they're rejected with.
+func WithOnRecordDecoded(fn OnRecordDecoded) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.onRecordDecoded = fn
+	}
+}
+
+// WithConsumerMetrics configures the consumer to report the total and failed write requests, and the time taken to
+// process each batch of records, to the given ConsumerMetrics instead of the default Prometheus metrics. The other
+// metrics of the consumer are still exported as Prometheus metrics.
+func WithConsumerMetrics(metrics ConsumerMetrics) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.metricsBackend = metrics
+	}
+}
+
+// withConsumerLagTracker configures the consumer to update the lag tracker once each record has been pushed.
+func withConsumerLagTracker(t *consumerLagTracker) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.lagTracker = t
+	}
+}
+
+// withConcurrencyWarmUp configures the consumer to honor the ingestion concurrency allowed by the warm-up.
+func withConcurrencyWarmUp(w *concurrencyWarmUp) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.warmUp = w
+	}
+}
+
+// withMetricDenylists configures the consumer to use the given metric denylists, which are shared by the consumers
+// of a PartitionReader, instead of denylists of its own.
+func withMetricDenylists(d *metricDenylists) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.denylists = d
+	}
+}
+
+// withAbandonedDecodes configures the consumer to bound the abandoned decodes with the given tracker, which is shared
+// by the consumers of a PartitionReader, since the abandoned decodes keep running after the consume has returned.
+func withAbandonedDecodes(a *abandonedDecodes) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.abandonedDecodes = a
+	}
+}
+
+// withConsecutiveSkipsTracker configures the consumer to count the consecutive skips with the given tracker,
+// which is shared by the consumers of a PartitionReader, instead of a tracker of its own.
+func withConsecutiveSkipsTracker(t *consecutiveSkipsTracker) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.skips = t
+	}
+}
+
+// newPusherConsumer creates a new pusherConsumer instance.
+func newPusherConsumer(pusher Pusher, kafkaCfg KafkaConfig, limits TenantLimits, metrics *pusherConsumerMetrics, logger log.Logger, opts ...PusherConsumerOption) *pusherConsumer {
+	// The layer below (parallelStoragePusher, parallelStorageShards, sequentialStoragePusher) will return all errors they see
+	// and potentially ingesting a batch if they encounter any error.
+	// We can safely ignore client errors and continue ingesting. We abort ingesting if we get any other error.
+	metrics.decodeBytesBudget.Set(float64(kafkaCfg.IngestionDecodeMaxBytes))
+
+	c := &pusherConsumer{
+		kafkaConfig:     kafkaCfg,
+		limits:          limits,
+		metrics:         metrics,
+		logger:          logger,
+		decompressors:   defaultDecompressors,
+		decoders:        defaultDecoders,
+		aborter:         newConsumeAborter(),
+		resourceMonitor: NoopResourceMonitor{},
+		decodeBudget:    newDecodeBudget(int64(kafkaCfg.IngestionDecodeMaxBytes), metrics.decodeBytesInUse),
+	}
+	c.tenantInflight = newTenantInflightBytes(limits, kafkaCfg.TenantInflightBytesTrackedTenants, metrics.tenantInflightBytes)
+	c.abandonedDecodes = newAbandonedDecodes(kafkaCfg.IngestionDecodeTimeoutMaxAbandoned, metrics.abandonedDecodes)
+	c.skips = newConsecutiveSkipsTracker(kafkaCfg.MaxConsecutiveSkips, metrics, logger)
+	c.denylists = newMetricDenylists(limits)
+	c.seriesLimiter = newTenantSeriesLimiter(limits, kafkaCfg.MaxSeriesIdleTimeout)
+	c.exemplarLimiter = newExemplarRateLimiter(kafkaCfg, metrics)
+	c.concurrency = newConcurrencyControl()
+	c.idempotencyTokens = newIdempotencyTokens(kafkaCfg.IdempotencyTokensMaxSize, kafkaCfg.IdempotencyTokensTTL)
+	c.outcomeLogger = newRecordOutcomeLogger(kafkaCfg.RecordOutcomeLogFormat, logger, os.Stderr)
+	if len(kafkaCfg.ProcessingTimeTrackedTenants) > 0 {
+		c.processingTimeTenants = make(map[string]struct{}, len(kafkaCfg.ProcessingTimeTrackedTenants))
+		for _, userID := range kafkaCfg.ProcessingTimeTrackedTenants {
+			c.processingTimeTenants[userID] = struct{}{}
+		}
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.metricsBackend != nil {
+		c.metrics = c.metrics.withBackend(c.metricsBackend)
+	}
+
+	// The metadata has been validated with the config.
+	pushMetadata, _ := parsePushMetadata(kafkaCfg.PushMetadata)
+
+	// The middlewares forward the raw pushes if the Pusher is a RawPusher, so that the records pushed without being
+	// decoded are pushed through them too.
+	if pushMetadata != nil {
+		pusher = withRawForwarding(pushMetadataInjectingPusher{upstream: pusher, md: pushMetadata}, pusher)
+	}
+
+	// The series are counted, and the pushes tracked while in flight, right before the upstream Pusher, once the
+	// requests have been split or batched.
+	pusher = withRawForwarding(inflightTrackingPusher{upstream: pusher, inflight: metrics.inflightPushes}, pusher)
+	pusher = withRawForwarding(seriesPerPushObservingPusher{upstream: pusher, seriesPerPush: metrics.seriesPerPush}, pusher)
+
+	if kafkaCfg.LogServerErrorFirstSeries {
+		pusher = withRawForwarding(failedSeriesLoggingPusher{upstream: pusher, logger: logger}, pusher)
+	}
+
+	// The consecutive skips of the raw pushes are tracked by the rawStorageWriter.
+	if _, ok := pusher.(RawPusher); ok {
+		c.rawPusher = panicRecoveringPusher{upstream: pusher, logger: logger, panics: metrics.panics}
+	}
+
+	// The pusher is wrapped once the options have been applied, because they may replace the skips tracker.
+	if c.skips != nil {
+		pusher = consecutiveSkipsTrackingPusher{upstream: pusher, skips: c.skips}
+	}
+	c.pusher = panicRecoveringPusher{upstream: pusher, logger: logger, panics: metrics.panics}
+	return c
+}
+
+type parsedRecord struct {
+	*mimirpb.WriteRequest
+	// ctx holds the tracing baggage for this record/request.
+	ctx      context.Context
+	tenantID string
+	// producedTenantID is the tenant the record has been produced for, before tenantID is remapped by the
+	// TenantRemapper, if any.
+	producedTenantID string
+	err              error
+	index            int
+	offset           int64
+	// timestamp is the Kafka timestamp of the record. It may be zero if unknown.
+	timestamp time.Time
+	// size is the size of the record's content in bytes, before unmarshalling.
+	size int
+	// decodeBytes is the number of bytes acquired from the decode budget, to release once the record has been pushed.
+	decodeBytes int64
+	// inflightBytes is the number of in-flight bytes acquired for the tenant, to release once the record has been pushed.
+	inflightBytes int64
+	// content is the content of the record. It's only kept if the record couldn't be parsed, for the SkipPolicy,
+	// if the records failing to be pushed are retried, to decode them again, or if a custom ErrorPolicy may
+	// dead-letter or republish them.
+	content []byte
+	// raw is the uncompressed content of the record if it's pushed without being decoded, in which case WriteRequest is nil.
+	raw []byte
+	// pushStart is when pushRecord started processing the record.
+	pushStart time.Time
+}
+
+// Consume implements the recordConsumer interface.
+// It'll use a separate goroutine to unmarshal the next record while we push the current record to storage.
+// If more than -ingest-storage.kafka.max-records-per-consume records are given, or -ingest-storage.kafka.max-consume-duration
+// is exceeded, only the first ones are consumed and an *unprocessedRecordsError is returned once they've been successfully
+// consumed. Likewise, if the records of more than -ingest-storage.kafka.max-tenants-per-consume tenants are given, only
+// the records of the first tenants are consumed. If the context is cancelled or the consume is aborted, a
+// *ConsumeCancelledError is returned with the progress made until then.
+func (c pusherConsumer) Consume(ctx context.Context, records []record) error {
+	if maxRecords := c.kafkaConfig.MaxRecordsPerConsume; maxRecords > 0 && len(records) > maxRecords {
+		err := c.Consume(ctx, records[:maxRecords])
+
+		// The records not attempted because the consume duration has been exceeded come before the remaining ones.
+		var unprocessed *unprocessedRecordsError
+		if errors.As(err, &unprocessed) {
+			return &unprocessedRecordsError{records: slices.Concat(unprocessed.records, records[maxRecords:]), reason: unprocessed.reason}
+		}
+		if err != nil {
+			return err
+		}
+		return &unprocessedRecordsError{records: records[maxRecords:], reason: unprocessedMaxRecords}
+	}
+
+	// The gaps are detected in the order the records have been read from Kafka, before they're reordered or skipped.
+	c.detectOffsetGaps(records)
+
+	if records, deferred := c.deferExcessTenants(records); len(deferred) > 0 {
+		err := c.consumeTenants(ctx, records)
+
+		var unprocessed *unprocessedRecordsError
+		if errors.As(err, &unprocessed) {
+			return &unprocessedRecordsError{records: slices.Concat(unprocessed.records, deferred), reason: unprocessed.reason}
+		}
+		if err != nil {
+			return err
+		}
+		return &unprocessedRecordsError{records: deferred, reason: unprocessedMaxTenants}
+	}
+	return c.consumeTenants(ctx, records)
+}
+
+// consumeTenants consumes the records, once the records of the excess tenants have been deferred.
+func (c pusherConsumer) consumeTenants(ctx context.Context, records []record) error {
+	if c.idempotencyTokens != nil {
+		return c.consumeIdempotently(ctx, records)
+	}
+	return c.consumeRecords(ctx, records)
+}
+
+// deferExcessTenants splits the records into the records of the first -ingest-storage.kafka.max-tenants-per-consume
+// distinct tenants, and the deferred records of the other tenants, preserving the order of the records in each.
+func (c pusherConsumer) deferExcessTenants(records []record) (kept, deferred []record) {
+	maxTenants := c.kafkaConfig.MaxTenantsPerConsume
+	if maxTenants <= 0 {
+		return records, nil
+	}
+
+	tenants := make(map[string]struct{}, maxTenants)
+	for i, r := range records {
+		if _, ok := tenants[r.tenantID]; ok {
+			continue
+		}
+		if len(tenants) < maxTenants {
+			tenants[r.tenantID] = struct{}{}
+			continue
+		}
+
+		// The records are only copied once there's a record to defer.
+		kept = slices.Clone(records[:i])
+		for _, r := range records[i:] {
+			if _, ok := tenants[r.tenantID]; ok {
+				kept = append(kept, r)
+			} else {
+				r.deferred = true
+				deferred = append(deferred, r)
+			}
+		}
+		return kept, deferred
+	}
+	return records, nil
+}
+
+// consumeRecords pushes the records, once ordered, to the storage.
+func (c pusherConsumer) consumeRecords(ctx context.Context, records []record) error {
+	records, err := c.orderRecords(records)
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(records, func(r record) bool { return isBatch(r.content) }) {
+		return c.consumeBatches(ctx, records, nil)
+	}
+
+	// We accumulate the total bytes across all records per tenant to determine the number of timeseries we expected to receive.
+	// Then, we'll use that to determine the number of shards we need to parallelize the writes.
+	var bytesPerTenant = make(map[string]int)
+	for _, r := range records {
+		bytesPerTenant[r.tenantID] += len(r.content)
+	}
+
+	// The records must be fed one at a time to stop feeding them once the consume duration has been exceeded.
+	if c.kafkaConfig.MaxConsumeDuration > 0 {
+		return c.consumeBatches(ctx, records, bytesPerTenant)
+	}
+
+	// The records are all known upfront, so we don't need a producer goroutine to feed the pipeline.
+	recordsChannel := make(chan record, len(records))
+	for _, r := range records {
+		recordsChannel <- r
+	}
+	close(recordsChannel)
+
+	return c.consume(ctx, recordsChannel, bytesPerTenant)
+}
+
+// detectOffsetGaps counts and logs the gaps between the offsets of consecutive records, which should never happen
+// because the reader reads the records of the partition one after the other. The records split from the same batch
+// share the offset of the batch. Nothing is detected if the records have no offsets, nor before the deferred records.
+func (c pusherConsumer) detectOffsetGaps(records []record) {
+	if !slices.ContainsFunc(records, func(r record) bool { return r.offset != 0 }) {
+		return
+	}
+
+	for i := 1; i < len(records); i++ {
+		c.detectOffsetGap(records[i-1], records[i])
+	}
+}
+
+// detectOffsetGap counts and logs the gap between the offsets of the consecutive records prev and next, if any.
+func (c pusherConsumer) detectOffsetGap(prev, next record) {
+	if next.offset > prev.offset+1 && !next.deferred {
+		c.metrics.offsetGaps.Inc()
+		level.Warn(c.logger).Log("msg", "detected a gap between the offsets of the consumed records, records have been skipped", "first_missing_offset", prev.offset+1, "last_missing_offset", next.offset-1, "missing", next.offset-prev.offset-1)
+	}
+}
+
+// The reasons of an unprocessedRecordsError.
+const (
+	unprocessedMaxRecords         = "the maximum number of records per consume has been exceeded"
+	unprocessedMaxConsumeDuration = "the maximum consume duration has been exceeded"
+	unprocessedMaxTenants         = "the maximum number of tenants per consume has been exceeded"
+)
+
+// unprocessedRecordsError is returned by Consume when it's given more records than it's allowed to consume at once,
+// or when it's been consuming them for longer than allowed. All the records but the unprocessed ones have been
+// successfully consumed, so the caller should neither back off nor retry them, and should consume the unprocessed
+// records with a new consumer instead.
+type unprocessedRecordsError struct {
+	// records are the records which haven't been attempted, in the order they would have been pushed in.
+	records []record
+	reason  string
+}
+
+func (e *unprocessedRecordsError) Error() string {
+	return fmt.Sprintf("%d records have not been processed because %s", len(e.records), e.reason)
+}
+
+// consumeBatches is like Consume, but it splits the batches of records into their records while they're being consumed,
+// so that the records of a batch are decoded only when the pipeline is ready to receive them. When bytesPerTenant is nil,
+// because the number of records isn't known upfront, the number of shards is estimated like consumeStream does.
+//
+// The records are fed to the pipeline one at a time, and the feeding stops once the consume duration has been exceeded:
+// the records fed until then are consumed, and an *unprocessedRecordsError is returned with the other ones. The feeding
+// may stop while a batch is being split, in which case the batch is returned with the number of its consumed entries.
+func (c pusherConsumer) consumeBatches(ctx context.Context, records []record, bytesPerTenant map[string]int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var deadline time.Time
+	if maxDuration := c.kafkaConfig.MaxConsumeDuration; maxDuration > 0 {
+		deadline = time.Now().Add(maxDuration)
+	}
+
+	exceeded := func() bool {
+		return !deadline.IsZero() && time.Now().After(deadline)
+	}
+
+	recordsChannel := make(chan record)
+	done := make(chan struct{})
+	var unprocessed []record
+	go func() {
+		defer close(done)
+		defer close(recordsChannel)
+
+		for i, r := range records {
+			// At least a record is attempted, so that each consume makes progress.
+			if i > 0 && exceeded() {
+				unprocessed = records[i:]
+				return
+			}
+
+			if consumed, complete := c.feedRecord(ctx, r, recordsChannel, exceeded); !complete {
+				if isBatch(r.content) && ctx.Err() == nil {
+					// The consume duration has been exceeded while splitting the batch, whose other entries
+					// are left to the next consume.
+					r.consumedBatchEntries = consumed
+					unprocessed = slices.Concat([]record{r}, records[i+1:])
+				}
+				return
+			}
+		}
+	}()
+
+	err := c.consume(ctx, recordsChannel, bytesPerTenant)
+
+	// Stop splitting the batches if the consumption has been aborted.
+	cancel()
+	<-done
+	if err == nil && len(unprocessed) > 0 {
+		c.metrics.consumeDurationExceeded.Inc()
+		return &unprocessedRecordsError{records: unprocessed, reason: unprocessedMaxConsumeDuration}
+	}
+	return err
+}
+
+// feedRecord sends the record to the pipeline, split into its records if it's a batch, until stop returns true. It
+// returns the number of entries of the batch consumed, and whether the whole record has been sent.
+func (c pusherConsumer) feedRecord(ctx context.Context, r record, ch chan<- record, stop func() bool) (int, bool) {
+	if isBatch(r.content) {
+		consumed, complete := c.splitBatch(ctx, r, ch, stop)
+		if complete {
+			c.offsets.split(r.offset)
+		}
+		return consumed, complete
+	}
+
+	select {
+	case <-ctx.Done():
+		return 0, false
+	case ch <- r:
+		return 0, true
+	}
+}
+
+// consumeStream is like Consume, but it reads the records from the input channel until it's closed instead of
+// requiring the whole batch to be materialized upfront. This allows the caller to feed records lazily as they're fetched.
+// The batches of records are split and the gaps between the offsets are detected as the records are received.
+//
+// The features which need the whole batch of records can't be applied to the records as they're received, so if the
+// maximum number of records or tenants per consume, the maximum consume duration, the idempotency tokens or an ordering
+// of the records are configured, the records are all received before being consumed like Consume does, and an
+// *unprocessedRecordsError may be returned likewise.
+//
+// Because the whole batch isn't known upfront, the number of shards used to parallelize the writes of a tenant
+// is estimated from the records of that tenant received before its first push, which is usually lower than
+// what Consume would estimate for the same batch.
+//
+// consumeStream stops reading from records as soon as it returns, so the caller should stop sending records
+// once consumeStream has returned.
+func (c pusherConsumer) consumeStream(ctx context.Context, records <-chan record) error {
+	if c.needsWholeBatch() {
+		var batch []record
+		for r := range records {
+			batch = append(batch, r)
+		}
+		return c.Consume(ctx, batch)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	recordsChannel := make(chan record)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(recordsChannel)
+
+		var prev record
+		for i := 0; ; i++ {
+			var r record
+			select {
+			case <-ctx.Done():
+				return
+			case rec, ok := <-records:
+				if !ok {
+					return
+				}
+				r = rec
+			}
+
+			if i > 0 {
+				c.detectOffsetGap(prev, r)
+			}
+			prev = r
+			if _, complete := c.feedRecord(ctx, r, recordsChannel, nil); !complete {
+				return
+			}
+		}
+	}()
+
+	err := c.consume(ctx, recordsChannel, nil)
+
+	// Stop reading the records if the consumption has been aborted.
+	cancel()
+	<-done
+	return err
+}
+
+// needsWholeBatch returns whether the consumer is configured with features which need the whole batch of records
+// to be known before the records are consumed.
+func (c pusherConsumer) needsWholeBatch() bool {
+	cfg := c.kafkaConfig
+	return cfg.MaxRecordsPerConsume > 0 || cfg.MaxTenantsPerConsume > 0 || cfg.MaxConsumeDuration > 0 ||
+		c.idempotencyTokens != nil || c.recordOrdering != nil || cfg.IngestionTenantNewestFirst || cfg.IngestionGroupRecordsByTenant
+}
+
+// consume unmarshals and pushes the records read from the input channel until it's closed.
+// When bytesPerTenant is nil, its estimation is accumulated as the records are received.
+func (c pusherConsumer) consume(ctx context.Context, records <-chan record, bytesPerTenant map[string]int) error {
+	if c.kafkaConfig.IngestionBatchMetrics {
+		// The metrics are batched on this copy of the consumer only, so that they're flushed once this batch is consumed.
+		var batch *metricsBatch
+		c.metrics, batch = c.metrics.batched()
+		defer batch.flush()
+	}
+	if c.deltas != nil {
+		// The deltas are recorded once the metrics are batched, so that the batched metrics are still batched.
+		c.metrics = c.metrics.withBackend(deltaRecordingMetrics{ConsumerMetrics: c.metrics.storagePusherMetrics.backend, deltas: c.deltas})
+	}
+
+	batchStart := time.Now()
+	defer func() {
+		c.metrics.storagePusherMetrics.backend.ObserveProcessing(time.Since(batchStart))
+	}()
+	defer c.profiler.track()()
+
+	if c.auditSink != nil {
+		c.audit = &auditBuffer{}
+	}
+	if c.readBackEnabled() {
+		c.readBack = &readBackBuffer{fraction: c.readBackFraction}
+	}
+	c.pipeline = c.newPipeline()
+	if c.failedRecordExports != nil {
+		c.failedRecords = &failedRecordBuffer{}
+	}
+	if c.ingestionEvents != nil {
+		c.events = &ingestionEventBuffer{}
+	}
+
+	if c.recordRetriesEnabled() {
+		c.retryBudget = newRetryBudget(c.kafkaConfig.ConsumeRetryBudget, c.metrics.retryBudgetRemaining)
+	}
+
+	// The pusher is wrapped on this copy of the consumer only, so that the report covers this batch only. The report
+	// is also returned with the error of a cancelled consume, so it's built even if the consume reports are disabled.
+	c.clientErrors = newClientErrorAggregator()
+	c.tenantRecords = newTenantRecordCounter()
+	c.pusher = clientErrorAggregatingPusher{upstream: c.pusher, aggregator: c.clientErrors}
+	if c.consumeReports != nil {
+		defer func(c pusherConsumer) {
+			c.consumeReports(c.report())
+		}(c)
+	}
+
+	recordsChannel := make(chan parsedRecord)
+
+	// Create a cancellable context to let the unmarshalling goroutine know when to stop.
+	// The context is also cancelled if the consume is aborted.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer c.aborter.track(cancel)()
+
+	// Now, unmarshal the records into the channel.
+	go c.unmarshalRequests(ctx, batchStart, records, recordsChannel)
+
+	err := c.pushRequests(ctx, recordsChannel, bytesPerTenant)
+	if cause := context.Cause(ctx); cause != nil {
+		// The records left once cancelled or aborted haven't been pushed, regardless of the error returned by pushRequests.
+		if abortErr := abortCause(ctx); abortErr != nil {
+			cause = abortErr
+		}
+		return &ConsumeCancelledError{Err: cause, Report: c.report(), LastProcessedOffset: c.safeLastProcessedOffset()}
+	}
+	if err != nil {
+		cancel(cancellation.NewErrorf("error while pushing to storage")) // Stop the unmarshalling goroutine.
+		return err
+	}
+
+	c.audit.flush(ctx, c.auditSink)
+	c.readBack.verify(ctx, c.readBackVerifier, c.metrics.readBackVerifications, c.logger)
+	c.failedRecords.flush(ctx, c.failedRecordExports)
+	c.events.flush(c.ingestionEvents)
+	c.heartbeat.push(ctx)
+	cancel(cancellation.NewErrorf("done unmarshalling records"))
+	return nil
+}
+
+// unmarshalRequests unmarshals the records read from the input channel and sends them to the output channel.
+// It closes the output channel once the input channel is closed or the context is cancelled. The time each record has
+// waited since batchStart, when the consumption of the batch started, before being unmarshalled is observed.
+func (c pusherConsumer) unmarshalRequests(ctx context.Context, batchStart time.Time, records <-chan record, ch chan<- parsedRecord) {
+	defer close(ch)
+
+	rawPush := c.rawPushEnabled()
+	// The content of the records failing to be pushed is needed to retry them, and to dead-letter or republish them.
+	keepContent := c.recordRetriesEnabled() || c.errorPolicy != nil
+
+	// The records whose chunks haven't all been received once the consumption ends are never pushed.
+	chunks := newChunkAssembler(c.metrics, c.logger)
+	defer chunks.discardIncomplete()
+
+	// The records without tenant are only logged once per batch, because they're usually all the records of a producer.
+	loggedEmptyTenant := false
+
+	stopWatchdog := c.watchFirstRecord(batchStart)
+	defer stopWatchdog()
+
+	index := 0
+
+	// decode decodes the record, for which the tenant's inflightBytes have been acquired, and sends it to the output
+	// channel. It returns false if the context is done.
+	decode := func(r record, inflightBytes int64) bool {
+		// Wait for enough decode budget before unmarshalling, because the decoded request is kept in memory until it's pushed.
+		decodeBytes, err := c.decodeBudget.acquire(ctx, int64(len(r.content)))
+		if err != nil {
+			c.tenantInflight.release(r.tenantID, inflightBytes)
+			return false
+		}
+
+		parsed := parsedRecord{
+			ctx:              r.ctx,
+			tenantID:         r.tenantID,
+			producedTenantID: r.tenantID,
+			index:            index,
+			offset:           r.offset,
+			timestamp:        r.timestamp,
+			size:             len(r.content),
+			decodeBytes:      decodeBytes,
+			inflightBytes:    inflightBytes,
+		}
+		index++
+
+		// The record couldn't be split from its batch, so there's nothing to decode.
+		if r.err != nil {
+			parsed.WriteRequest = &mimirpb.WriteRequest{}
+			parsed.err = fmt.Errorf("parsing ingest consumer write request: %w", r.err)
+		} else if r.tenantID == "" {
+			// The record isn't decoded, because it's rejected regardless of its content.
+			c.metrics.rejectedRecords.WithLabelValues(reasonEmptyTenant).Inc()
+			if !loggedEmptyTenant {
+				loggedEmptyTenant = true
+				level.Warn(spanlogger.FromContext(r.ctx, c.logger)).Log("msg", "rejected record without tenant; skipping it and the other records without tenant of the batch", "offset", r.offset, "size", len(r.content))
+			}
+			parsed.WriteRequest = &mimirpb.WriteRequest{}
+			parsed.err = errEmptyTenant
+		} else {
+			if rawPush && !c.decodeRaw(r.tenantID) {
+				parsed.raw, err = c.decompress(r.content)
+				if err != nil {
+					parsed.WriteRequest = &mimirpb.WriteRequest{}
+				}
+			} else {
+				var abandoned bool
+				parsed.WriteRequest, abandoned, err = c.decodeWithTimeout(ctx, r, func() {
+					c.decodeBudget.release(decodeBytes)
+					c.tenantInflight.release(r.tenantID, inflightBytes)
+				})
+				if abandoned {
+					// The bytes are released by the abandoned decode once it returns, because it keeps them in memory until then.
+					parsed.decodeBytes, parsed.inflightBytes = 0, 0
+				}
+			}
+
+			var panicErr *RecordPanicError
+			if errors.As(err, &panicErr) {
+				panicErr.Index, panicErr.TenantID = parsed.index, parsed.tenantID
+				reportPanic(r.ctx, c.logger, c.metrics.panics, panicErr)
+				parsed.err = panicErr
+			} else if err != nil {
+				parsed.err = fmt.Errorf("parsing ingest consumer write request: %w", err)
+			} else if parsed.raw == nil {
+				c.metrics.recordsDecoded.Inc()
+			}
+		}
+		if c.onRecordDecoded != nil {
+			c.onRecordDecoded(parsed.index, parsed.tenantID, parsed.size, parsed.err)
+		}
+		if parsed.err != nil || keepContent {
+			parsed.content = r.content
+		}
+
+		// Now that we're done, check again before we send it to the channel.
+		if !c.sendParsedRecord(ctx, ch, parsed) {
+			c.decodeBudget.release(parsed.decodeBytes)
+			c.tenantInflight.release(parsed.tenantID, parsed.inflightBytes)
+			return false
+		}
+		stopWatchdog()
+		return true
+	}
+
+	// The records of the tenants exceeding their in-flight bytes are parked until the tenant's other records have been
+	// pushed, while the records of the other tenants are decoded meanwhile. The parked records of each tenant are
+	// decoded in the order they've been received, and before the records of the tenant received after them.
+	parked := &parkedRecords{}
+	for {
+		var released <-chan struct{}
+		if parked.len() > 0 {
+			// The channel is taken before trying to decode the parked records, so that no release is missed.
+			released = c.tenantInflight.releases()
+			if !parked.decodeReady(c.tenantInflight, decode) {
+				return
+			}
+		}
+		if records == nil && parked.len() == 0 {
+			return
+		}
+
+		var r record
+		// Before we being unmarshalling the write request check if the context was cancelled.
+		select {
+		case <-ctx.Done():
+			// No more processing is needed, so we need to abort.
+			return
+		case <-released:
+			continue
+		case rec, ok := <-records:
+			if !ok {
+				// The parked records are still decoded once all the records have been received.
+				records = nil
+				continue
+			}
+			r = rec
+		}
+
+		// The late records of large batches wait for the records before them to be decoded and handed over.
+		c.metrics.decodeQueueSeconds.Observe(time.Since(batchStart).Seconds())
+
+		// The chunks of a record are buffered until they've all been received, and the record is reassembled. The
+		// offsets of the other chunks are processed as soon as the record is reassembled, because the last processed
+		// offset can't go past the lowest one, which is the offset of the record, until the record is processed.
+		if isChunk(r.content) {
+			var (
+				complete bool
+				others   []int64
+			)
+			if r, complete, others = chunks.add(r); !complete {
+				continue
+			}
+			for _, offset := range others {
+				c.offsets.processed(offset)
+			}
+			c.results.reassembled(r.offset, others)
+		}
+
+		// The records which can't be parsed, or have no tenant, aren't decoded, so they don't count as in-flight bytes.
+		if r.err != nil || r.tenantID == "" {
+			if !decode(r, 0) {
+				return
+			}
+			continue
+		}
+		if parked.has(r.tenantID) || !c.tenantInflight.tryAcquire(r.tenantID, int64(len(r.content))) {
+			c.metrics.tenantInflightBytesWaits.Inc()
+			parked.add(r)
+			continue
+		}
+		if !decode(r, int64(len(r.content))) {
+			return
+		}
+	}
+}
+
+// parkedRecords are the records waiting for the in-flight bytes of their tenant to be released, in the order they've
+// been received.
+type parkedRecords struct {
+	records []record
+	tenants map[string]int
+}
+
+func (p *parkedRecords) len() int {
+	return len(p.records)
+}
+
+// has returns whether records of the tenant are parked.
+func (p *parkedRecords) has(tenantID string) bool {
+	return p.tenants[tenantID] > 0
+}
+
+func (p *parkedRecords) add(r record) {
+	if p.tenants == nil {
+		p.tenants = map[string]int{}
+	}
+	p.records = append(p.records, r)
+	p.tenants[r.tenantID]++
+}
+
+// decodeReady decodes, in order, the parked records whose tenant's in-flight bytes allow it, stopping at the first
+// record of each tenant which still exceeds them. It returns false if decode does.
+func (p *parkedRecords) decodeReady(inflight *tenantInflightBytes, decode func(record, int64) bool) bool {
+	var blocked map[string]struct{}
+	kept := p.records[:0]
+	for i, r := range p.records {
+		if _, ok := blocked[r.tenantID]; ok || !inflight.tryAcquire(r.tenantID, int64(len(r.content))) {
+			if blocked == nil {
+				blocked = map[string]struct{}{}
+			}
+			blocked[r.tenantID] = struct{}{}
+			kept = append(kept, r)
+			continue
+		}
+
+		p.tenants[r.tenantID]--
+		if !decode(r, int64(len(r.content))) {
+			p.records = append(kept, p.records[i+1:]...)
+			return false
+		}
+	}
+	clear(p.records[len(kept):])
+	p.records = kept
+	return true
+}
+
+// sendParsedRecord sends the parsed record to the channel, and returns false if the context is done before. The time
+// waited for the pushing goroutine to receive the record is observed, and the sends which block are counted, to tell
+// whether the decoding is waiting for the pushes.
+func (c pusherConsumer) sendParsedRecord(ctx context.Context, ch chan<- parsedRecord, parsed parsedRecord) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case ch <- parsed:
+		c.metrics.unmarshalSendWaitSeconds.Observe(0)
+		return true
+	default:
+	}
+
+	c.metrics.unmarshalSendBlocked.Inc()
+	start := time.Now()
+	defer func() {
+		c.metrics.unmarshalSendWaitSeconds.Observe(time.Since(start).Seconds())
+	}()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case ch <- parsed:
+		return true
+	}
+}
+
+// decodeWithTimeout decodes the record like decode, but it logs and counts the decodes taking longer than the configured
+// timeout. If abandoning timed out decodes is enabled, it returns errDecodeTimeout as soon as the timeout expires and the
+// result of the decode, which keeps running in the background, is discarded. The decodes are also abandoned if the
+// context is done. It returns whether the decode has been abandoned, in which case release is called once the abandoned
+// decode returns, so that the memory it keeps until then is still accounted for.
+func (c pusherConsumer) decodeWithTimeout(ctx context.Context, r record, release func()) (*mimirpb.WriteRequest, bool, error) {
+	timeout := c.kafkaConfig.IngestionDecodeTimeout
+	if timeout <= 0 {
+		req, err := c.decode(r.content)
+		return req, false, err
+	}
+
+	type result struct {
+		req *mimirpb.WriteRequest
+		err error
+	}
+
+	// The channel is buffered so that an abandoned decode can always complete and doesn't leak the goroutine.
+	done := make(chan result, 1)
+	go func() {
+		req, err := c.decode(r.content)
+		done <- result{req: req, err: err}
+	}()
+
+	// abandon releases the bytes and the abandoned decode once the decode returns.
+	abandon := func() {
+		go func() {
+			<-done
+			release()
+			c.abandonedDecodes.done()
+		}()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.req, false, res.err
+	case <-ctx.Done():
+		c.abandonedDecodes.add()
+		abandon()
+		return &mimirpb.WriteRequest{}, true, context.Cause(ctx)
+	case <-timer.C:
+	}
+
+	c.metrics.decodeTimeouts.Inc()
+	c.metrics.timeouts.WithLabelValues(timeoutStageDecode).Inc()
+	if c.kafkaConfig.IngestionDecodeTimeoutAbandon {
+		if c.abandonedDecodes.tryAdd() {
+			abandon()
+			level.Warn(c.logger).Log("msg", "abandoned decoding a record because it took longer than the timeout", "user", r.tenantID, "size", len(r.content), "timeout", timeout)
+			return &mimirpb.WriteRequest{}, true, errDecodeTimeout
+		}
+		level.Warn(c.logger).Log("msg", "decoding a record is taking longer than the timeout, but it can't be abandoned because too many abandoned decodes are still running", "user", r.tenantID, "size", len(r.content), "timeout", timeout)
+	} else {
+		level.Warn(c.logger).Log("msg", "decoding a record is taking longer than the timeout", "user", r.tenantID, "size", len(r.content), "timeout", timeout)
+	}
+
+	select {
+	case res := <-done:
+		return res.req, false, res.err
+	case <-ctx.Done():
+		c.abandonedDecodes.add()
+		abandon()
+		return &mimirpb.WriteRequest{}, true, context.Cause(ctx)
+	}
+}
+
+// abandonedDecodes counts the abandoned decodes which are still running, so that the decodes which never return can't
+// pile up their goroutines and the memory they keep. It's safe for concurrent use.
+type abandonedDecodes struct {
+	// max is the maximum number of abandoned decodes still running, or 0 for no limit.
+	max int
+
+	mx      sync.Mutex
+	running int
+	gauge   prometheus.Gauge
+}
+
+func newAbandonedDecodes(maxAbandoned int, gauge prometheus.Gauge) *abandonedDecodes {
+	return &abandonedDecodes{max: maxAbandoned, gauge: gauge}
+}
+
+// tryAdd adds an abandoned decode, unless the maximum number of abandoned decodes are still running.
+func (a *abandonedDecodes) tryAdd() bool {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if a.max > 0 && a.running >= a.max {
+		return false
+	}
+	a.running++
+	a.gauge.Set(float64(a.running))
+	return true
+}
+
+// add adds an abandoned decode regardless of the maximum, for the decodes which can't be waited for.
+func (a *abandonedDecodes) add() {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	a.running++
+	a.gauge.Set(float64(a.running))
+}
+
+// done removes an abandoned decode once it has returned.
+func (a *abandonedDecodes) done() {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	a.running--
+	a.gauge.Set(float64(a.running))
+}
+
+// decode decompresses and unmarshals the content of a record into a write request.
+// A panic while decoding is recovered and returned as a *RecordPanicError, whose record context is filled by the caller.
+func (c pusherConsumer) decode(content []byte) (req *mimirpb.WriteRequest, err error) {
+	req = &mimirpb.WriteRequest{}
+	defer func() {
+		if p := recover(); p != nil {
+			err = newRecordPanicError(p, -1, "")
+		}
+	}()
+
+	content, err = c.decompress(content)
+	if err != nil {
+		return req, err
+	}
+
+	var decoder int
+	if req, decoder, err = c.unmarshal(content); err != nil {
+		return req, err
+	}
+
+	// The round-trip is only verified for the primary decoder, because the fallbacks may decode other schemas.
+	if c.kafkaConfig.VerifyDecodeRoundTrip && decoder == 0 {
+		if err := c.verifyRoundTrip(req, content); err != nil {
+			return req, err
+		}
+	}
+
+	// The content may be valid protobuf while still decoding to a request we can't safely push.
+	return req, validateWriteRequest(req)
+}
+
+// verifyRoundTrip re-marshals the request decoded from content, and compares the result with content. A mismatch is
+// logged and counted, and it's returned as an error only if the records should fail on mismatches.
+func (c pusherConsumer) verifyRoundTrip(req *mimirpb.WriteRequest, content []byte) error {
+	// The write request can't match the content if their sizes differ, in which case it's not re-marshalled.
+	var err error
+	remarshalledSize := writeRequestSize(req)
+	if remarshalledSize == len(content) {
+		var remarshalled []byte
+		remarshalled, err = req.Marshal()
+		if err == nil && bytes.Equal(remarshalled, content) {
+			return nil
+		}
+		remarshalledSize = len(remarshalled)
+	}
+
+	c.metrics.decodeRoundTripMismatches.Inc()
+	level.Warn(c.logger).Log("msg", "decoded write request doesn't match the content of the record once re-marshalled", "size", len(content), "remarshalled_size", remarshalledSize, "err", err)
+	if !c.kafkaConfig.VerifyDecodeRoundTripFail {
+		return nil
+	}
+	return fmt.Errorf("%w: content is %d bytes, re-marshalled write request is %d bytes", errDecodeRoundTripMismatch, len(content), remarshalledSize)
+}
+
+// decompress returns the decompressed content if it's been compressed with one of the supported codecs,
+// or the content itself otherwise.
+func (c pusherConsumer) decompress(content []byte) ([]byte, error) {
+	d := detectDecompressor(c.decompressors, content)
+	if d == nil {
+		c.metrics.recordCodecs.WithLabelValues(codecNone).Inc()
+		return content, nil
+	}
+
+	c.metrics.recordCodecs.WithLabelValues(d.Codec()).Inc()
+	decompressed, err := d.Decompress(content, c.kafkaConfig.MaxDecompressedRecordSizeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %s content: %w", d.Codec(), err)
+	}
+	return decompressed, nil
+}
+
+// pushRequests pushes the parsed records read from the input channel to the storage until the channel is closed.
+// It returns the first non-client error encountered, which aborts the processing of the remaining records.
+func (c pusherConsumer) pushRequests(ctx context.Context, records <-chan parsedRecord, bytesPerTenant map[string]int) error {
+	if c.kafkaConfig.IngestionOrdering == ingestionOrderingRelaxed {
+		return c.pushRequestsRelaxed(ctx, records)
+	}
+
+	streaming := bytesPerTenant == nil
+	if streaming {
+		bytesPerTenant = make(map[string]int)
+	}
+
+	clientErrDedup := c.newClientErrorDeduplicator()
+	defer clientErrDedup.logSuppressed(c.logger)
+
+	writer := c.withMetadataRouting(c.newStorageWriter(bytesPerTenant, clientErrDedup), clientErrDedup)
+	if c.rawPushEnabled() {
+		writer = rawStorageWriter{
+			PusherCloser: writer,
+			pusher:       c.rawPusher,
+			errorHandler: c.newErrorHandler(clientErrDedup),
+			skips:        c.skips,
+			clientErrors: c.clientErrors,
+		}
+	}
+	for r := range records {
+		if streaming {
+			bytesPerTenant[r.tenantID] += r.size
+		}
+
+		// If we get an error at any point, we need to stop processing the records. They will be retried at some point.
+		c.pushingTenant.start(r.tenantID)
+		err := c.pushRecord(ctx, r, writer)
+		c.pushingTenant.done()
+		if err != nil {
+			return err
+		}
+	}
+
+	// We need to tell the storage writer that we're done and no more records are coming.
+	return multierror.New(writer.Close()...).Err()
+}
+
+// pushRequestsRelaxed pushes up to IngestionConcurrencyMax parsed records in parallel, each as soon as a worker is free,
+// without preserving the order of the records. Each record is pushed as a whole by a sequentialStoragePusher.
+// It returns the first non-client error encountered, after waiting for the in-flight pushes to complete.
+func (c pusherConsumer) pushRequestsRelaxed(ctx context.Context, records <-chan parsedRecord) error {
+	clientErrDedup := c.newClientErrorDeduplicator()
+	defer clientErrDedup.logSuppressed(c.logger)
+
+	writer := c.withMetadataRouting(newSequentialStoragePusherWithErrorHandler(c.metrics.storagePusherMetrics, c.pusher, c.newErrorHandler(clientErrDedup)), clientErrDedup)
+
+	g, gCtx := errgroup.WithContext(ctx)
+	if c.priorityResolver != nil {
+		// The workers read the records by priority from a queue fed by the decoded records.
+		prioritized := make(chan parsedRecord)
+		capacity := c.ingestionConcurrency() * max(c.kafkaConfig.IngestionConcurrencyQueueCapacity, 1)
+		input := records
+		g.Go(func() error { return c.prioritizeRecords(gCtx, input, prioritized, capacity) })
+		records = prioritized
+	}
+	workers := newResizableWorkers(g, c.ingestionConcurrency, func(exit func() bool) error {
+		worker := newPushWorkerTracker(c.metrics.storagePusherMetrics)
+		defer worker.stop()
+
+		for {
+			// The excess workers exit once the concurrency has been lowered, after their in-flight push.
+			if exit() {
+				return nil
+			}
+			select {
+			case <-gCtx.Done():
+				// Another worker failed, so there's no point in pushing more records.
+				return nil
+			case <-c.concurrency.watch():
+				// The concurrency has changed while waiting for a record.
+				continue
+			case r, ok := <-records:
+				if !ok {
+					return nil
+				}
+				worker.acquire()
+				c.pushingTenant.start(r.tenantID)
+				err := c.pushRecord(ctx, r, writer)
+				c.pushingTenant.done()
+				worker.release()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	})
+
+	// The workers are resized with the concurrency set at runtime until they've all returned.
+	changed := c.concurrency.watch()
+	workers.resize()
+	stopResizing := make(chan struct{})
+	resizingDone := make(chan struct{})
+	go func() {
+		defer close(resizingDone)
+		for {
+			select {
+			case <-stopResizing:
+				return
+			case <-changed:
+				changed = c.concurrency.watch()
+				workers.resize()
+			}
+		}
+	}()
+
+	err := g.Wait()
+	close(stopResizing)
+	<-resizingDone
+	closeErrs := multierror.New(writer.Close()...).Err()
+	if err != nil {
+		return err
+	}
+	return closeErrs
+}
+
+// pushRecord pushes a single parsed record to the storage using the writer. Records that failed to be parsed are logged and skipped.
+// A panic while pushing the record is recovered and returned as a *RecordPanicError.
+func (c pusherConsumer) pushRecord(ctx context.Context, r parsedRecord, writer PusherCloser) (err error) {
+	r.pushStart = time.Now()
+	c.tenantRecords.add(r.tenantID)
+	c.deltas.record(r.size)
+	defer func() {
+		// The error is set once a panic has been recovered too, because the deferred functions run in reverse order.
+		if err != nil {
+			c.offsets.fail(r.offset)
+		}
+	}()
+
+	if _, ok := c.processingTimeTenants[r.tenantID]; ok {
+		// The tenant is the one the record has been written with, even if it's pushed under a remapped tenant.
+		defer func(userID string, start time.Time) {
+			elapsed := time.Since(start)
+			c.metrics.tenantProcessingTimeSeconds.WithLabelValues(userID).Observe(elapsed.Seconds())
+
+			if slo := c.kafkaConfig.ProcessingTimeSLO; slo > 0 {
+				c.metrics.tenantSLORecords.WithLabelValues(userID).Inc()
+				if elapsed <= slo {
+					c.metrics.tenantSLORecordsWithin.WithLabelValues(userID).Inc()
+				}
+			}
+		}(r.tenantID, time.Now())
+	}
+	defer c.decodeBudget.release(r.decodeBytes)
+	defer c.tenantInflight.release(r.tenantID, r.inflightBytes)
+	defer func() {
+		if p := recover(); p != nil {
+			panicErr := newRecordPanicError(p, r.index, r.tenantID)
+			reportPanic(ctx, c.logger, c.metrics.panics, panicErr)
+			err = panicErr
+		}
+	}()
+
+	// A panic while decoding the record isn't a parse error, so the record isn't skipped.
+	var panicErr *RecordPanicError
+	if errors.As(r.err, &panicErr) {
+		c.sendOutcome(r, outcomePanic, r.err)
+		return r.err
+	}
+
+	if errors.Is(r.err, errEmptyTenant) {
+		// The record has been counted and logged when it's been received.
+		c.sendOutcome(r, reasonEmptyTenant, r.err)
+		c.markProcessed(r.offset)
+		return nil
+	}
+
+	if r.err != nil {
+		c.metrics.parseErrors.Inc()
+		if errors.Is(r.err, errDecompressedContentTooLarge) {
+			RecordFailure(c.metrics.storagePusherMetrics.backend, FailureCauseTooLarge)
+		} else {
+			RecordFailure(c.metrics.storagePusherMetrics.backend, FailureCauseUnmarshal)
+		}
+
+		policy := c.skipPolicy
+		if policy == nil {
+			policy = skipRecordPolicy
+		}
+		decision := policy.Decide(ctx, SkippedRecord{Index: r.index, Offset: r.offset, TenantID: r.tenantID, Content: r.content, Err: r.err})
+		c.metrics.skipDecisions.WithLabelValues(decision.Action.String()).Inc()
+
+		switch {
+		case decision.Action == SkipActionAbort:
+			err = fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, r.err)
+			c.sendOutcome(r, outcomeParseErrorAborted, err)
+			return err
+		case decision.Action == SkipActionFallback && decision.Fallback != nil:
+			level.Warn(spanlogger.FromContext(ctx, c.logger)).Log("msg", "failed to parse write request; pushing the fallback request", "user", r.tenantID, "err", r.err)
+			r.WriteRequest, r.err = decision.Fallback, nil
+		default:
+			level.Error(spanlogger.FromContext(ctx, c.logger)).Log("msg", "failed to parse write request; skipping", "err", r.err)
+			c.skips.skipped(r.tenantID, r.err)
+			c.failedRecords.add(r)
+			c.sendOutcome(r, outcomeParseError, r.err)
+			c.markProcessed(r.offset)
+			return nil
+		}
+	}
+
+	// The pushes are paced before acquiring the shared limits, so that the waiting records don't hold them.
+	if err := c.pacer.wait(ctx); err != nil {
+		err = fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, err)
+		c.sendOutcome(r, outcomeFailed, err)
+		return err
+	}
+
+	// The shared limits and the backpressure are honored before checking the deadline, because waiting for them may take a while.
+	release, err := c.limiters.acquirePush(ctx)
+	if err != nil {
+		err = fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, err)
+		c.sendOutcome(r, outcomeFailed, err)
+		return err
+	}
+	defer release()
+
+	if err := c.waitBackpressure(ctx, r.tenantID); err != nil {
+		err = fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, err)
+		c.sendOutcome(r, outcomeFailed, err)
+		return err
+	}
+
+	if c.pastDeadline(r) {
+		c.metrics.rejectedRecords.WithLabelValues(reasonStaleDeadline).Inc()
+		level.Warn(spanlogger.FromContext(ctx, c.logger)).Log("msg", "skipped write request which has not been pushed within the max processing lag", "user", r.tenantID, "record_timestamp", r.timestamp, "max_lag", c.kafkaConfig.IngestionMaxProcessingLag)
+		c.sendOutcome(r, reasonStaleDeadline, errStaleDeadline)
+		c.markProcessed(r.offset)
+		return nil
+	}
+
+	if r.raw != nil {
+		// The record hasn't been decoded, so it's pushed as it is. The transforms are disabled when pushing raw records.
+		c.metrics.rawRecords.Inc()
+		err = c.pushWithTimeout(r.ctx, r.tenantID, len(r.raw), func(ctx context.Context) error {
+			return writer.(rawStorageWriter).PushRawToStorage(ctx, r.tenantID, r.raw)
+		})
+		var outcome string
+		outcome, err = c.applyErrorAction(ctx, r, c.retryPush(ctx, r, writer, err))
+		switch {
+		case err != nil:
+			err = fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, err)
+		case outcome == outcomePushed:
+			c.markProcessed(r.offset)
+			c.audit.add(r)
+			c.events.add(r)
+		default:
+			// The record has been dead-lettered or republished, so it's processed even though it's not been ingested.
+			c.markProcessed(r.offset)
+		}
+		c.sendOutcome(r, outcome, err)
+		return err
+	}
+
+	r.tenantID = c.remapTenant(ctx, r.tenantID)
+	if err := c.prepareRequestWithTimeout(ctx, r.tenantID, r.WriteRequest); err != nil {
+		var rejection *stageRejection
+		if !errors.As(err, &rejection) {
+			err = fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, err)
+			c.sendOutcome(r, outcomeFailed, err)
+			return err
+		}
+
+		reason := rejection.reason
+		c.metrics.rejectedRecords.WithLabelValues(reason).Inc()
+		level.Warn(spanlogger.FromContext(ctx, c.logger)).Log("msg", "rejected write request before pushing it; skipping", "user", r.tenantID, "reason", reason, "err", err)
+		c.skips.skipped(r.tenantID, err)
+		c.sendOutcome(r, reason, err)
+		c.markProcessed(r.offset)
+		return nil
+	}
+
+	// The exemplars are rate limited once the stages have dropped theirs, so that the dropped ones don't consume the rate.
+	c.exemplarLimiter.limit(r.WriteRequest)
+
+	// Count and sample the samples before pushing, because the request may be freed once it's been pushed.
+	c.readBack.sample(r.offset, r.tenantID, r.WriteRequest)
+	floatSamples, histograms := countSamples(r.WriteRequest)
+	c.logRecordSummary(ctx, r, floatSamples, histograms)
+	c.metrics.floatSamples.Add(float64(floatSamples))
+	c.metrics.nativeHistograms.Add(float64(histograms))
+	if samples := floatSamples + histograms; samples > 0 {
+		// Outliers reveal producers encoding the samples wastefully, or writing mostly metadata.
+		c.metrics.recordBytesPerSample.Observe(float64(r.size) / float64(samples))
+	}
+
+	err = c.pushWithTimeout(r.ctx, r.tenantID, writeRequestSize(r.WriteRequest), func(ctx context.Context) error {
+		return c.pushSplitting(ctx, r.tenantID, r.WriteRequest, writer)
+	})
+	var outcome string
+	outcome, err = c.applyErrorAction(ctx, r, c.retryPush(ctx, r, writer, err))
+	switch {
+	case err != nil:
+		err = fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, err)
+	case outcome == outcomePushed:
+		c.markProcessed(r.offset)
+		c.audit.add(r)
+		c.events.add(r)
+	default:
+		// The record has been dead-lettered or republished, so it's processed even though it's not been ingested.
+		c.markProcessed(r.offset)
+	}
+	c.sendOutcome(r, outcome, err)
+	return err
+}
+
+// prepareRequest runs the stages, which apply the tenant's limits and the configured transforms by default, on the
+// decoded request of the record before it's pushed. It returns a *stageRejection if the record must be rejected, for
+// example because it has samples too far in the future or series missing required labels, and the error of the
+// stage which failed otherwise.
+func (c pusherConsumer) prepareRequest(ctx context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+	p := c.pipeline
+	if p == nil {
+		p = c.newPipeline()
+	}
+	return p.run(ctx, tenantID, req)
+}
+
+// pastDeadline returns whether the push deadline of the record, its Kafka timestamp plus the max processing lag,
+// has passed. The records without a timestamp have no deadline.
+func (c pusherConsumer) pastDeadline(r parsedRecord) bool {
+	maxLag := c.kafkaConfig.IngestionMaxProcessingLag
+	if maxLag <= 0 || r.timestamp.IsZero() {
+		return false
+	}
+	return time.Now().After(r.timestamp.Add(maxLag))
+}
+
+// sendOutcome sends the outcome of the record to the outcomes channel, if configured, without blocking, and records it
+// in the results. The outcome is one of the outcome* constants, or the reason the record has been rejected with, and
+// it's only logged and recorded in the results.
+func (c pusherConsumer) sendOutcome(r parsedRecord, outcome string, err error) {
+	c.logOutcome(r, outcome, err)
+	c.results.record(r.offset, outcome, err)
+	if c.outcomes == nil {
+		return
+	}
+
+	select {
+	case c.outcomes <- RecordOutcome{Index: r.index, TenantID: r.tenantID, Err: err}:
+	default:
+		c.metrics.droppedOutcomes.Inc()
+	}
+}
+
+// remapTenant returns the tenant the record of tenantID should be pushed as.
+func (c pusherConsumer) remapTenant(ctx context.Context, tenantID string) string {
+	if c.tenantRemapper == nil {
+		return tenantID
+	}
+
+	remapped := c.tenantRemapper(tenantID)
+	if remapped != tenantID {
+		c.metrics.remappedRecords.Inc()
+		level.Debug(spanlogger.FromContext(ctx, c.logger)).Log("msg", "remapped the tenant of a write request", "user", tenantID, "remapped_user", remapped)
+	}
+	return remapped
+}
+
+// dropOptionalData removes the exemplars and metadata from the write request if the tenant's limits require so,
+// while keeping the samples.
+func (c pusherConsumer) dropOptionalData(tenantID string, req *mimirpb.WriteRequest) {
+	if c.limits.IngestStorageDropExemplars(tenantID) {
+		dropped := 0
+		for i := range req.Timeseries {
+			if n := len(req.Timeseries[i].Exemplars); n > 0 {
+				dropped += n
+				req.Timeseries[i].ClearExemplars()
+			}
+		}
+		c.metrics.exemplarsDropped.Add(float64(dropped))
+	} else {
+		c.dropStaleExemplars(tenantID, req)
 
-	kafkaConfig KafkaConfig
+		if maxExemplars := c.limits.IngestStorageMaxExemplarsPerSeries(tenantID); maxExemplars > 0 {
+			dropped := 0
+			for i := range req.Timeseries {
+				dropped += trimExemplars(&req.Timeseries[i], maxExemplars)
+			}
+			c.metrics.exemplarsDropped.Add(float64(dropped))
+		}
+	}
 
-	pusher Pusher
+	if c.limits.IngestStorageDropMetadata(tenantID) && len(req.Metadata) > 0 {
+		c.metrics.metadataDropped.Add(float64(len(req.Metadata)))
+		req.Metadata = nil
+	}
 }
 
-// newPusherConsumer creates a new pusherConsumer instance.
-func newPusherConsumer(pusher Pusher, kafkaCfg KafkaConfig, metrics *pusherConsumerMetrics, logger log.Logger) *pusherConsumer {
-	// The layer below (parallelStoragePusher, parallelStorageShards, sequentialStoragePusher) will return all errors they see
-	// and potentially ingesting a batch if they encounter any error.
-	// We can safely ignore client errors and continue ingesting. We abort ingesting if we get any other error.
-	return &pusherConsumer{
-		pusher:      pusher,
-		kafkaConfig: kafkaCfg,
-		metrics:     metrics,
-		logger:      logger,
+// dropStaleExemplars drops the exemplars older than the tenant's max exemplar age, if any. The series are kept with
+// all their samples, even if all their exemplars are dropped.
+func (c pusherConsumer) dropStaleExemplars(tenantID string, req *mimirpb.WriteRequest) {
+	maxAge := c.limits.IngestStorageMaxExemplarAge(tenantID)
+	if maxAge <= 0 {
+		return
+	}
+	minTimestamp := time.Now().Add(-maxAge).UnixMilli()
+
+	dropped := 0
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+
+		// Move the fresh exemplars to the front by swapping them with the stale ones, preserving their order,
+		// so that no two exemplars share their labels once the stale ones are cleared by ResizeExemplars.
+		kept := 0
+		for j := range ts.Exemplars {
+			if ts.Exemplars[j].TimestampMs >= minTimestamp {
+				ts.Exemplars[kept], ts.Exemplars[j] = ts.Exemplars[j], ts.Exemplars[kept]
+				kept++
+			}
+		}
+		if kept < len(ts.Exemplars) {
+			dropped += len(ts.Exemplars) - kept
+			ts.ResizeExemplars(kept)
+		}
 	}
+	c.metrics.exemplarsDropped.Add(float64(dropped))
 }
 
-// Consume implements the recordConsumer interface.
-// It'll use a separate goroutine to unmarshal the next record while we push the current record to storage.
-func (c pusherConsumer) Consume(ctx context.Context, records []record) error {
-	defer func(processingStart time.Time) {
-		c.metrics.processingTimeSeconds.Observe(time.Since(processingStart).Seconds())
-	}(time.Now())
+// trimExemplars drops the oldest exemplars of the series exceeding maxExemplars, and returns the number of dropped exemplars.
+// The kept exemplars are sorted by timestamp.
+func trimExemplars(ts *mimirpb.PreallocTimeseries, maxExemplars int) int {
+	n := len(ts.Exemplars)
+	if n <= maxExemplars {
+		return 0
+	}
 
-	type parsedRecord struct {
-		*mimirpb.WriteRequest
-		// ctx holds the tracing baggage for this record/request.
-		ctx      context.Context
-		tenantID string
-		err      error
-		index    int
+	if !sort.SliceIsSorted(ts.Exemplars, func(i, j int) bool { return ts.Exemplars[i].TimestampMs < ts.Exemplars[j].TimestampMs }) {
+		sort.SliceStable(ts.Exemplars, func(i, j int) bool { return ts.Exemplars[i].TimestampMs < ts.Exemplars[j].TimestampMs })
 	}
 
-	recordsChannel := make(chan parsedRecord)
+	// Move the most recent exemplars to the front by swapping them with the oldest ones, instead of copying them,
+	// so that no two exemplars share their labels once the oldest ones are cleared by ResizeExemplars.
+	for i, offset := 0, n-maxExemplars; i < maxExemplars; i++ {
+		ts.Exemplars[i], ts.Exemplars[i+offset] = ts.Exemplars[i+offset], ts.Exemplars[i]
+	}
+	ts.ResizeExemplars(maxExemplars)
+	return n - maxExemplars
+}
 
-	// Create a cancellable context to let the unmarshalling goroutine know when to stop.
-	ctx, cancel := context.WithCancelCause(ctx)
+// dropStaleSamples removes the samples and histograms older than the configured max age from the request, if enabled.
+// The series left without samples and histograms are removed too, while the series which still have fresh samples
+// are preserved with all their labels and exemplars.
+func (c pusherConsumer) dropStaleSamples(req *mimirpb.WriteRequest) {
+	maxAge := c.kafkaConfig.IngestionMaxSampleAge
+	if maxAge <= 0 {
+		return
+	}
+	minTimestamp := time.Now().Add(-maxAge).UnixMilli()
 
-	// Now, unmarshal the records into the channel.
-	go func(unmarshalCtx context.Context, records []record, ch chan<- parsedRecord) {
-		defer close(ch)
+	dropped := filterSamples(req, func(ts int64) bool { return ts >= minTimestamp })
+	c.metrics.staleSamplesDropped.Add(float64(dropped))
+}
 
-		for index, r := range records {
-			// Before we being unmarshalling the write request check if the context was cancelled.
-			select {
-			case <-unmarshalCtx.Done():
-				// No more processing is needed, so we need to abort.
-				return
-			default:
-			}
+// checkFutureSamples looks for the samples and histograms further in the future than the configured tolerance, if
+// enabled. Depending on the configured behavior, they're dropped from the request like the stale samples, or a
+// client error is returned so that the whole record is rejected.
+func (c pusherConsumer) checkFutureSamples(req *mimirpb.WriteRequest) error {
+	behavior := c.kafkaConfig.IngestionFutureSamplesBehavior
+	if behavior == "" || behavior == futureSamplesPush {
+		return nil
+	}
+	maxTimestamp := time.Now().Add(c.kafkaConfig.IngestionFutureSamplesTolerance).UnixMilli()
+
+	if behavior == futureSamplesDrop {
+		dropped := filterSamples(req, func(ts int64) bool { return ts <= maxTimestamp })
+		c.metrics.futureSamples.Add(float64(dropped))
+		return nil
+	}
 
-			parsed := parsedRecord{
-				ctx:          r.ctx,
-				tenantID:     r.tenantID,
-				WriteRequest: &mimirpb.WriteRequest{},
-				index:        index,
+	future := 0
+	for _, ts := range req.Timeseries {
+		for _, s := range ts.Samples {
+			if s.TimestampMs > maxTimestamp {
+				future++
 			}
+		}
+		for _, h := range ts.Histograms {
+			if h.Timestamp > maxTimestamp {
+				future++
+			}
+		}
+	}
+	if future == 0 {
+		return nil
+	}
 
-			// We don't free the WriteRequest slices because they are being freed by a level below.
-			err := parsed.WriteRequest.Unmarshal(r.content)
-			if err != nil {
-				parsed.err = fmt.Errorf("parsing ingest consumer write request: %w", err)
+	c.metrics.futureSamples.Add(float64(future))
+	err := fmt.Errorf("%d samples have a timestamp too far in the future, more than %s after the wall clock", future, c.kafkaConfig.IngestionFutureSamplesTolerance)
+	return globalerror.WrapErrorWithGRPCStatus(err, codes.InvalidArgument, &mimirpb.ErrorDetails{Cause: mimirpb.BAD_DATA})
+}
+
+// filterSamples removes the samples and histograms whose timestamp isn't kept from the request, and returns how many
+// have been removed. The series left without samples and histograms are removed too, while the other series are
+// preserved with all their labels and exemplars.
+func filterSamples(req *mimirpb.WriteRequest, keep func(ts int64) bool) int {
+	dropped := 0
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		hadSamples := len(ts.Samples) > 0 || len(ts.Histograms) > 0
+
+		samples := ts.Samples[:0]
+		for _, s := range ts.Samples {
+			if keep(s.TimestampMs) {
+				samples = append(samples, s)
 			}
+		}
+		removed := len(ts.Samples) - len(samples)
+		ts.Samples = samples
 
-			// Now that we're done, check again before we send it to the channel.
-			select {
-			case <-unmarshalCtx.Done():
-				return
-			case ch <- parsed:
+		histograms := ts.Histograms[:0]
+		for _, h := range ts.Histograms {
+			if keep(h.Timestamp) {
+				histograms = append(histograms, h)
 			}
 		}
-	}(ctx, records, recordsChannel)
+		removed += len(ts.Histograms) - len(histograms)
+		ts.Histograms = histograms
+		dropped += removed
 
-	// We accumulate the total bytes across all records per tenant to determine the number of timeseries we expected to receive.
-	// Then, we'll use that to determine the number of shards we need to parallelize the writes.
-	var bytesPerTenant = make(map[string]int)
-	for _, r := range records {
-		bytesPerTenant[r.tenantID] += len(r.content)
+		if removed > 0 {
+			// The cached size of the series isn't valid anymore.
+			ts.HistogramsUpdated()
+		}
+
+		if hadSamples && len(ts.Samples) == 0 && len(ts.Histograms) == 0 {
+			mimirpb.ReusePreallocTimeseries(&ts)
+			continue
+		}
+		kept = append(kept, ts)
 	}
 
-	writer := c.newStorageWriter(bytesPerTenant)
-	for r := range recordsChannel {
-		if r.err != nil {
-			level.Error(spanlogger.FromContext(ctx, c.logger)).Log("msg", "failed to parse write request; skipping", "err", r.err)
+	// Don't keep references to the removed series, which have been returned to the pool.
+	clear(req.Timeseries[len(kept):])
+	req.Timeseries = kept
+
+	return dropped
+}
+
+// checkSamplesOrder counts the requests with samples out of timestamp order within a series, if enabled, and
+// sorts them if configured to. Requests whose samples are already in order are only scanned once.
+func (c pusherConsumer) checkSamplesOrder(req *mimirpb.WriteRequest) {
+	if !c.kafkaConfig.DetectOutOfOrderSamples && !c.kafkaConfig.SortOutOfOrderSamples {
+		return
+	}
+
+	outOfOrder := false
+	for i := range req.Timeseries {
+		ts := req.Timeseries[i].TimeSeries
+
+		samplesOutOfOrder := !sort.SliceIsSorted(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].TimestampMs < ts.Samples[j].TimestampMs
+		})
+		histogramsOutOfOrder := !sort.SliceIsSorted(ts.Histograms, func(i, j int) bool {
+			return ts.Histograms[i].Timestamp < ts.Histograms[j].Timestamp
+		})
+		if !samplesOutOfOrder && !histogramsOutOfOrder {
 			continue
 		}
 
-		// If we get an error at any point, we need to stop processing the records. They will be retried at some point.
-		err := c.pushToStorage(r.ctx, r.tenantID, r.WriteRequest, writer)
-		if err != nil {
-			cancel(cancellation.NewErrorf("error while pushing to storage")) // Stop the unmarshalling goroutine.
-			return fmt.Errorf("consuming record at index %d for tenant %s: %w", r.index, r.tenantID, err)
+		outOfOrder = true
+		if !c.kafkaConfig.SortOutOfOrderSamples {
+			// We only need to know whether the request has any series out of order.
+			break
+		}
+
+		// Sort stably, so that the order of samples with the same timestamp is preserved. The sorting changes the
+		// marshalled series, so their cached size isn't valid anymore.
+		req.Timeseries[i].HistogramsUpdated()
+		if samplesOutOfOrder {
+			sort.SliceStable(ts.Samples, func(i, j int) bool {
+				return ts.Samples[i].TimestampMs < ts.Samples[j].TimestampMs
+			})
+		}
+		if histogramsOutOfOrder {
+			sort.SliceStable(ts.Histograms, func(i, j int) bool {
+				return ts.Histograms[i].Timestamp < ts.Histograms[j].Timestamp
+			})
 		}
 	}
 
-	cancel(cancellation.NewErrorf("done unmarshalling records"))
+	if outOfOrder {
+		c.metrics.outOfOrderRecords.Inc()
+	}
+}
 
-	// We need to tell the storage writer that we're done and no more records are coming.
-	return multierror.New(writer.Close()...).Err()
+// dedupSamples removes the samples and histograms of each series with the same timestamp as another one of the series,
+// if configured to. The sample kept is the first or the last one, in the position of the first one, so that the order
+// of the distinct timestamps is preserved.
+func (c pusherConsumer) dedupSamples(req *mimirpb.WriteRequest) {
+	behavior := c.kafkaConfig.IngestionDuplicateSamplesBehavior
+	if behavior == "" || behavior == duplicateSamplesPush {
+		return
+	}
+	keepLast := behavior == duplicateSamplesKeepLast
+
+	removed := 0
+	for i := range req.Timeseries {
+		ts := req.Timeseries[i].TimeSeries
+
+		var samplesRemoved, histogramsRemoved int
+		ts.Samples, samplesRemoved = dedupTimestamps(ts.Samples, func(s mimirpb.Sample) int64 { return s.TimestampMs }, keepLast)
+		ts.Histograms, histogramsRemoved = dedupTimestamps(ts.Histograms, func(h mimirpb.Histogram) int64 { return h.Timestamp }, keepLast)
+		if samplesRemoved+histogramsRemoved > 0 {
+			// The cached size of the series isn't valid anymore.
+			req.Timeseries[i].HistogramsUpdated()
+			removed += samplesRemoved + histogramsRemoved
+		}
+	}
+
+	if removed > 0 {
+		c.metrics.duplicateSamples.Add(float64(removed))
+	}
+}
+
+// dedupTimestamps removes in place the items with the same timestamp as a previous item, and returns the kept items
+// and how many have been removed. If keepLast, the kept item is replaced by the last item with its timestamp.
+func dedupTimestamps[T any](items []T, timestamp func(T) int64, keepLast bool) ([]T, int) {
+	sorted, duplicates := true, false
+	for i := 1; i < len(items); i++ {
+		prev, curr := timestamp(items[i-1]), timestamp(items[i])
+		if curr < prev {
+			sorted = false
+		} else if curr == prev {
+			duplicates = true
+		}
+	}
+	if sorted && !duplicates {
+		return items, 0
+	}
+
+	kept := items[:0]
+	if sorted {
+		// The items with the same timestamp are adjacent.
+		for _, item := range items {
+			if len(kept) > 0 && timestamp(kept[len(kept)-1]) == timestamp(item) {
+				if keepLast {
+					kept[len(kept)-1] = item
+				}
+				continue
+			}
+			kept = append(kept, item)
+		}
+	} else {
+		positions := make(map[int64]int, len(items))
+		for _, item := range items {
+			if pos, ok := positions[timestamp(item)]; ok {
+				if keepLast {
+					kept[pos] = item
+				}
+				continue
+			}
+			positions[timestamp(item)] = len(kept)
+			kept = append(kept, item)
+		}
+	}
+
+	removed := len(items) - len(kept)
+	clear(items[len(kept):])
+	return kept, removed
+}
+
+// tenantInflightBytes tracks the bytes of each tenant's records which are being decoded or waiting to be pushed, so that
+// the records of a tenant exceeding its limit are parked until the tenant's other records have been pushed, while the
+// other tenants are unaffected. The in-flight bytes are exported only for the tracked tenants, to keep the cardinality of the metric bounded.
+type tenantInflightBytes struct {
+	limits  TenantLimits
+	tracked map[string]struct{}
+	gauge   *prometheus.GaugeVec
+
+	mx       sync.Mutex
+	inflight map[string]int64
+	// released is closed, and replaced, whenever in-flight bytes are released, to wake up the parked records.
+	released chan struct{}
+}
+
+func newTenantInflightBytes(limits TenantLimits, trackedTenants []string, gauge *prometheus.GaugeVec) *tenantInflightBytes {
+	t := &tenantInflightBytes{
+		limits:   limits,
+		tracked:  make(map[string]struct{}, len(trackedTenants)),
+		gauge:    gauge,
+		inflight: map[string]int64{},
+		released: make(chan struct{}),
+	}
+	for _, userID := range trackedTenants {
+		t.tracked[userID] = struct{}{}
+	}
+	return t
+}
+
+// tryAcquire adds size bytes to the tenant's in-flight bytes and returns true, unless they would exceed the tenant's limit.
+// A record is always accepted when no other record of the tenant is in flight, so that a record larger than the limit
+// isn't parked forever.
+func (t *tenantInflightBytes) tryAcquire(userID string, size int64) bool {
+	limit := int64(t.limits.IngestStorageMaxInflightBytes(userID))
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	current := t.inflight[userID]
+	if limit > 0 && current > 0 && current+size > limit {
+		return false
+	}
+	t.set(userID, current+size)
+	return true
+}
+
+// releases returns a channel which is closed once in-flight bytes are released.
+func (t *tenantInflightBytes) releases() <-chan struct{} {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.released
+}
+
+// release removes size bytes from the tenant's in-flight bytes.
+func (t *tenantInflightBytes) release(userID string, size int64) {
+	if size == 0 {
+		return
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.set(userID, t.inflight[userID]-size)
+	close(t.released)
+	t.released = make(chan struct{})
+}
+
+func (t *tenantInflightBytes) set(userID string, size int64) {
+	if size <= 0 {
+		delete(t.inflight, userID)
+	} else {
+		t.inflight[userID] = size
+	}
+
+	if _, ok := t.tracked[userID]; ok {
+		t.gauge.WithLabelValues(userID).Set(float64(size))
+	}
+}
+
+// decodeBudget limits the total bytes of the records which are concurrently decoded or waiting to be pushed,
+// so that a burst of large records doesn't cause a spike of memory before they're pushed to the storage.
+// A nil *decodeBudget is unlimited.
+type decodeBudget struct {
+	limit int64
+	sem   *semaphore.Weighted
+	inUse prometheus.Gauge
+}
+
+func newDecodeBudget(limit int64, inUse prometheus.Gauge) *decodeBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &decodeBudget{
+		limit: limit,
+		sem:   semaphore.NewWeighted(limit),
+		inUse: inUse,
+	}
+}
+
+// acquire blocks until size bytes of budget are available or the context is cancelled, and returns the number of
+// bytes acquired, which must be passed to release. A record larger than the whole budget acquires all of it,
+// so that it's decoded on its own instead of blocking forever.
+func (b *decodeBudget) acquire(ctx context.Context, size int64) (int64, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	size = min(size, b.limit)
+	if err := b.sem.Acquire(ctx, size); err != nil {
+		return 0, err
+	}
+	b.inUse.Add(float64(size))
+	return size, nil
+}
+
+func (b *decodeBudget) release(size int64) {
+	if b == nil || size == 0 {
+		return
+	}
+	b.inUse.Sub(float64(size))
+	b.sem.Release(size)
+}
+
+// newClientErrorDeduplicator returns the deduplicator of the client errors logged while pushing a batch of records,
+// or nil if the deduplication is disabled.
+func (c pusherConsumer) newClientErrorDeduplicator() *clientErrorDeduplicator {
+	if !c.kafkaConfig.DeduplicateClientErrorLogs {
+		return nil
+	}
+	return newClientErrorDeduplicator()
 }
 
-func (c pusherConsumer) newStorageWriter(bytesPerTenant map[string]int) PusherCloser {
+// ingestionConcurrency returns the maximum ingestion concurrency, honoring the concurrency set at runtime and the
+// warm-up if any.
+func (c pusherConsumer) ingestionConcurrency() int {
+	return c.warmUp.concurrency(c.concurrency.get(c.kafkaConfig.IngestionConcurrencyMax))
+}
+
+func (c pusherConsumer) newStorageWriter(bytesPerTenant map[string]int, clientErrDedup *clientErrorDeduplicator) PusherCloser {
 	if c.kafkaConfig.IngestionConcurrencyMax == 0 {
-		return newSequentialStoragePusher(c.metrics.storagePusherMetrics, c.pusher, c.kafkaConfig.FallbackClientErrorSampleRate, c.logger)
+		return newSequentialStoragePusherWithErrorHandler(c.metrics.storagePusherMetrics, c.pusher, c.newErrorHandler(clientErrDedup))
+	}
+
+	if c.kafkaConfig.IngestionOrdering == ingestionOrderingSeries {
+		return newSeriesShardedPusher(c.metrics.storagePusherMetrics, c.newErrorHandler(clientErrDedup), c.pusher, c.ingestionConcurrency(), c.kafkaConfig.IngestionConcurrencyQueueCapacity)
 	}
 
-	return newParallelStoragePusher(
+	p := newParallelStoragePusher(
 		c.metrics.storagePusherMetrics,
 		c.pusher,
 		bytesPerTenant,
 		c.kafkaConfig.FallbackClientErrorSampleRate,
-		c.kafkaConfig.IngestionConcurrencyMax,
+		clientErrDedup,
+		c.clientErrLogLimiter,
+		c.serverErrClassifier,
+		c.ingestionConcurrency(),
 		c.kafkaConfig.IngestionConcurrencyBatchSize,
 		c.kafkaConfig.IngestionConcurrencyQueueCapacity,
 		c.kafkaConfig.IngestionConcurrencyEstimatedBytesPerSample,
 		c.kafkaConfig.IngestionConcurrencyTargetFlushesPerShard,
+		c.kafkaConfig.IngestionConcurrencyIdleFlushTimeout,
 		c.logger,
 	)
+	p.errorHandler.policy = c.errorPolicy
+	return p
+}
+
+// newErrorHandler returns a pushErrorHandler of the consumer, which consults its ErrorPolicy.
+func (c pusherConsumer) newErrorHandler(clientErrDedup *clientErrorDeduplicator) *pushErrorHandler {
+	h := newPushErrorHandler(c.metrics.storagePusherMetrics, util_log.NewSampler(c.kafkaConfig.FallbackClientErrorSampleRate), clientErrDedup, c.clientErrLogLimiter, c.serverErrClassifier, c.logger)
+	h.policy = c.errorPolicy
+	return h
+}
+
+// withMetadataRouting wraps the writer to push the metadata-only requests with a dedicated pool of workers, and
+// to defer the metadata pushes to the end of the batch, if enabled. The deferred metadata is pushed in metadata-only
+// requests, so it's pushed by the dedicated workers when both are enabled.
+func (c pusherConsumer) withMetadataRouting(writer PusherCloser, clientErrDedup *clientErrorDeduplicator) PusherCloser {
+	if c.kafkaConfig.MetadataOnlyConcurrency > 0 {
+		writer = &metadataRoutingPusher{
+			samples:              writer,
+			metadata:             newSeriesShardedPusher(c.metrics.storagePusherMetrics, c.newErrorHandler(clientErrDedup), c.pusher, c.kafkaConfig.MetadataOnlyConcurrency, c.kafkaConfig.IngestionConcurrencyQueueCapacity),
+			metadataOnlyRequests: c.metrics.metadataOnlyRequests,
+		}
+	}
+
+	if c.kafkaConfig.DeferMetadataPushes {
+		writer = newDeferredMetadataPusher(writer, c.metrics.deferredMetadata)
+	}
+	return writer
 }
 
 func (c pusherConsumer) pushToStorage(ctx context.Context, tenantID string, req *mimirpb.WriteRequest, writer PusherCloser) error {
@@ -173,6 +2159,34 @@ func (c pusherConsumer) pushToStorage(ctx context.Context, tenantID string, req
 	return err
 }
 
+// validateWriteRequest checks that a successfully unmarshalled request has the structure that the pushers
+// expect, so that a corrupted record is skipped as unparseable instead of causing a panic further down.
+func validateWriteRequest(req *mimirpb.WriteRequest) error {
+	for i, ts := range req.Timeseries {
+		if ts.TimeSeries == nil {
+			return fmt.Errorf("timeseries at index %d is nil", i)
+		}
+		if len(ts.Labels) == 0 {
+			return fmt.Errorf("timeseries at index %d has no labels", i)
+		}
+	}
+	for i, md := range req.Metadata {
+		if md == nil {
+			return fmt.Errorf("metadata at index %d is nil", i)
+		}
+	}
+	return nil
+}
+
+// countSamples returns the number of float samples and native histogram samples in the request.
+func countSamples(req *mimirpb.WriteRequest) (floatSamples, histograms int) {
+	for _, ts := range req.Timeseries {
+		floatSamples += len(ts.Samples)
+		histograms += len(ts.Histograms)
+	}
+	return floatSamples, histograms
+}
+
 // sequentialStoragePusher receives mimirpb.WriteRequest which are then pushed to the storage one by one.
 type sequentialStoragePusher struct {
 	metrics      *storagePusherMetrics
@@ -181,15 +2195,8 @@ type sequentialStoragePusher struct {
 	pusher Pusher
 }
 
-// newSequentialStoragePusher creates a new sequentialStoragePusher instance.
-func newSequentialStoragePusher(metrics *storagePusherMetrics, pusher Pusher, sampleRate int64, logger log.Logger) sequentialStoragePusher {
-	return sequentialStoragePusher{
-		metrics:      metrics,
-		pusher:       pusher,
-		errorHandler: newPushErrorHandler(metrics, util_log.NewSampler(sampleRate), logger),
-	}
-}
-
+// newSequentialStoragePusherWithErrorHandler creates a new sequentialStoragePusher instance handling the push errors
+// with the errorHandler.
 func newSequentialStoragePusherWithErrorHandler(metrics *storagePusherMetrics, pusher Pusher, errorHandler *pushErrorHandler) sequentialStoragePusher {
 	return sequentialStoragePusher{
 		metrics:      metrics,
@@ -205,11 +2212,8 @@ func (ssp sequentialStoragePusher) PushToStorage(ctx context.Context, wr *mimirp
 		ssp.metrics.processingTime.WithLabelValues(requestContents(wr)).Observe(time.Since(now).Seconds())
 	}(time.Now())
 
-	if err := ssp.pusher.PushToStorage(ctx, wr); ssp.errorHandler.IsServerError(ctx, err) {
-		return err
-	}
-
-	return nil
+	// Each request is pushed on its own, so the error is returned annotated with the action decided by the ErrorPolicy.
+	return ssp.errorHandler.handle(ctx, ssp.pusher.PushToStorage(ctx, wr))
 }
 
 // Close implements the PusherCloser interface.
@@ -232,26 +2236,29 @@ type parallelStoragePusher struct {
 	batchSize      int
 	bytesPerTenant map[string]int
 
-	queueCapacity   int
-	bytesPerSample  int
-	targetFlushes   int
-	numActiveShards int
+	queueCapacity    int
+	bytesPerSample   int
+	targetFlushes    int
+	idleFlushTimeout time.Duration
+	numActiveShards  int
 }
 
 // newParallelStoragePusher creates a new parallelStoragePusher instance.
-func newParallelStoragePusher(metrics *storagePusherMetrics, pusher Pusher, bytesPerTenant map[string]int, sampleRate int64, maxShards int, batchSize int, queueCapacity int, bytesPerSample int, targetFlushes int, logger log.Logger) *parallelStoragePusher {
+func newParallelStoragePusher(metrics *storagePusherMetrics, pusher Pusher, bytesPerTenant map[string]int, sampleRate int64, clientErrDedup *clientErrorDeduplicator, logLimiter *ClientErrorLogLimiter, classifier ServerErrorClassifier, maxShards int, batchSize int, queueCapacity int, bytesPerSample int, targetFlushes int, idleFlushTimeout time.Duration, logger log.Logger) *parallelStoragePusher {
 	return &parallelStoragePusher{
 		logger:         log.With(logger, "component", "parallel-storage-pusher"),
 		pushers:        make(map[string]PusherCloser),
 		upstreamPusher: pusher,
 		maxShards:      maxShards,
 		bytesPerTenant: bytesPerTenant,
-		errorHandler:   newPushErrorHandler(metrics, util_log.NewSampler(sampleRate), logger),
+		errorHandler:   newPushErrorHandler(metrics, util_log.NewSampler(sampleRate), clientErrDedup, logLimiter, classifier, logger),
 		batchSize:      batchSize,
 		queueCapacity:  queueCapacity,
 		bytesPerSample: bytesPerSample,
 		targetFlushes:  targetFlushes,
 		metrics:        metrics,
+
+		idleFlushTimeout: idleFlushTimeout,
 	}
 }
 
@@ -299,7 +2306,7 @@ func (c *parallelStoragePusher) shardsFor(userID string, requestSource mimirpb.W
 		// So we choose the lower overhead and simpler sequential pusher.
 		p = newSequentialStoragePusherWithErrorHandler(c.metrics, c.upstreamPusher, c.errorHandler)
 	} else {
-		p = newParallelStorageShards(c.metrics, c.errorHandler, idealShards, c.batchSize, c.queueCapacity, c.upstreamPusher, hashLabels)
+		p = newParallelStorageShards(c.metrics, c.errorHandler, idealShards, c.batchSize, c.queueCapacity, c.idleFlushTimeout, c.upstreamPusher, hashLabels)
 	}
 	c.pushers[userID+"|"+requestSource.String()] = p
 	return p
@@ -340,6 +2347,19 @@ type parallelStorageShards struct {
 
 	wg     *sync.WaitGroup
 	shards []*batchingQueue
+
+	// idleFlushTimeout, if greater than 0, is the time after which the batches are flushed if no write request has
+	// been pushed meanwhile, even if they're not full. The batches are then accessed by the timer too, so they're
+	// owned either by the write request being pushed or by the idle flush in progress, which send the batches without
+	// holding the lock. This also keeps the batches of each shard sent in order.
+	idleFlushTimeout time.Duration
+	mx               sync.Mutex
+	idleTimer        *time.Timer
+	lastPush         time.Time
+	closed           bool
+	pushing          bool
+	// idleFlushing is closed once the idle flush in progress, if any, has sent its batches.
+	idleFlushing chan struct{}
 }
 
 type flushableWriteRequest struct {
@@ -350,16 +2370,17 @@ type flushableWriteRequest struct {
 }
 
 // newParallelStorageShards creates a new parallelStorageShards instance.
-func newParallelStorageShards(metrics *storagePusherMetrics, errorHandler *pushErrorHandler, numShards int, batchSize int, capacity int, pusher Pusher, hashLabels labelsHashFunc) *parallelStorageShards {
+func newParallelStorageShards(metrics *storagePusherMetrics, errorHandler *pushErrorHandler, numShards int, batchSize int, capacity int, idleFlushTimeout time.Duration, pusher Pusher, hashLabels labelsHashFunc) *parallelStorageShards {
 	p := &parallelStorageShards{
-		numShards:    numShards,
-		pusher:       pusher,
-		errorHandler: errorHandler,
-		hashLabels:   hashLabels,
-		capacity:     capacity,
-		metrics:      metrics,
-		batchSize:    batchSize,
-		wg:           &sync.WaitGroup{},
+		numShards:        numShards,
+		pusher:           pusher,
+		errorHandler:     errorHandler,
+		hashLabels:       hashLabels,
+		capacity:         capacity,
+		metrics:          metrics,
+		batchSize:        batchSize,
+		wg:               &sync.WaitGroup{},
+		idleFlushTimeout: idleFlushTimeout,
 	}
 
 	p.start()
@@ -371,6 +2392,11 @@ func newParallelStorageShards(metrics *storagePusherMetrics, errorHandler *pushE
 // PushToStorage ignores SkipLabelNameValidation because that field is only used in the distributor and not in the ingester.
 // PushToStorage aborts the request if it encounters an error.
 func (p *parallelStorageShards) PushToStorage(ctx context.Context, request *mimirpb.WriteRequest) error {
+	if p.idleFlushTimeout > 0 {
+		p.startPush()
+		defer p.endPush()
+	}
+
 	var (
 		builder         labels.ScratchBuilder
 		nonCopiedLabels labels.Labels
@@ -402,8 +2428,90 @@ func (p *parallelStorageShards) PushToStorage(ctx context.Context, request *mimi
 	return nil
 }
 
+// startPush takes the ownership of the batches for the write request being pushed, once the idle flush in progress,
+// if any, has sent its batches.
+func (p *parallelStorageShards) startPush() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.waitIdleFlush()
+	p.pushing = true
+}
+
+// endPush gives up the ownership of the batches once the write request has been pushed, and restarts the wait for the
+// idle flush timeout.
+func (p *parallelStorageShards) endPush() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.pushing = false
+	p.resetIdleTimer()
+}
+
+// waitIdleFlush waits for the idle flush in progress, if any, to send its batches. It must be called with the lock
+// held, which is released while waiting.
+func (p *parallelStorageShards) waitIdleFlush() {
+	for p.idleFlushing != nil {
+		flushing := p.idleFlushing
+		p.mx.Unlock()
+		<-flushing
+		p.mx.Lock()
+	}
+}
+
+// resetIdleTimer restarts the wait for the idle flush timeout, once a write request is pushed. It must be called with
+// the lock held.
+func (p *parallelStorageShards) resetIdleTimer() {
+	p.lastPush = time.Now()
+	if p.idleTimer == nil {
+		p.idleTimer = time.AfterFunc(p.idleFlushTimeout, p.flushIdle)
+		return
+	}
+	p.idleTimer.Reset(p.idleFlushTimeout)
+}
+
+// flushIdle flushes the batches which aren't empty once no write request has been pushed for the idle flush timeout.
+// The batches are taken from the shards with the lock held, and sent once it's been released, because sending them
+// blocks while the queues of the shards are full.
+func (p *parallelStorageShards) flushIdle() {
+	p.mx.Lock()
+	// A write request may be being pushed, or have been pushed while the timer was firing, in which case the timer is
+	// reset once it's been pushed.
+	if p.closed || p.pushing || time.Since(p.lastPush) < p.idleFlushTimeout {
+		p.mx.Unlock()
+		return
+	}
+	batches := make([]*flushableWriteRequest, len(p.shards))
+	for i, shard := range p.shards {
+		batches[i] = shard.takeIdleBatch()
+	}
+	flushing := make(chan struct{})
+	p.idleFlushing = flushing
+	p.mx.Unlock()
+
+	for i, batch := range batches {
+		if batch != nil {
+			p.shards[i].ch <- *batch
+		}
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.idleFlushing = nil
+	close(flushing)
+}
+
 // Close stops all the shards and waits for them to finish.
 func (p *parallelStorageShards) Close() []error {
+	if p.idleFlushTimeout > 0 {
+		// The timer is stopped before closing the shards, so that the batches aren't flushed once the channels are closed.
+		p.mx.Lock()
+		p.waitIdleFlush()
+		p.closed = true
+		if p.idleTimer != nil {
+			p.idleTimer.Stop()
+		}
+		p.mx.Unlock()
+	}
+
 	var errs multierror.MultiError
 
 	for _, shard := range p.shards {
@@ -433,12 +2541,17 @@ func (p *parallelStorageShards) run(queue *batchingQueue) {
 	defer p.wg.Done()
 	defer queue.Done()
 
+	worker := newPushWorkerTracker(p.metrics)
+	defer worker.stop()
+
 	for wr := range queue.Channel() {
 		p.metrics.batchAge.Observe(time.Since(wr.startedAt).Seconds())
 		p.metrics.timeSeriesPerFlush.Observe(float64(len(wr.WriteRequest.Timeseries)))
 		processingStart := time.Now()
 
+		worker.acquire()
 		err := p.pusher.PushToStorage(wr.Context, wr.WriteRequest)
+		worker.release()
 
 		// The error handler needs to determine if this is a server error or not.
 		// If it is, we need to stop processing as the batch will be retried. When is not (client error), it'll log it, and we can continue processing.
@@ -469,42 +2582,81 @@ type pushErrorHandler struct {
 	metrics          *storagePusherMetrics
 	clientErrSampler *util_log.Sampler
 	fallbackLogger   log.Logger
+
+	// clientErrDedup, if not nil, takes precedence over clientErrSampler to decide which client errors are logged.
+	clientErrDedup *clientErrorDeduplicator
+
+	// logLimiter, if not nil, limits the rate of the client errors logged once sampled or deduplicated.
+	logLimiter *ClientErrorLogLimiter
+
+	// classifier classifies the server errors into their subcauses.
+	classifier ServerErrorClassifier
+
+	// policy, if not nil, overrides DefaultErrorPolicy to decide what to do with the failed pushes.
+	policy ErrorPolicy
 }
 
 // newPushErrorHandler creates a new pushErrorHandler instance.
-func newPushErrorHandler(metrics *storagePusherMetrics, clientErrSampler *util_log.Sampler, fallbackLogger log.Logger) *pushErrorHandler {
+func newPushErrorHandler(metrics *storagePusherMetrics, clientErrSampler *util_log.Sampler, clientErrDedup *clientErrorDeduplicator, logLimiter *ClientErrorLogLimiter, classifier ServerErrorClassifier, fallbackLogger log.Logger) *pushErrorHandler {
 	return &pushErrorHandler{
 		metrics:          metrics,
 		clientErrSampler: clientErrSampler,
+		clientErrDedup:   clientErrDedup,
+		logLimiter:       logLimiter,
+		classifier:       classifier,
 		fallbackLogger:   fallbackLogger,
 	}
 }
 
-// IsServerError returns whether the error is a server error or not, the context is used to extract the span from the trace.
-// When the error is a server error, we'll add it to the span passed down in the context and return true to indicate that the we should stop processing.
-// When it is a client error, we'll add it to the span and log it to stdout/stderr.
+// IsServerError returns whether the error must stop the processing, the context is used to extract the span from the trace.
+// It's the case of the server errors by default, while the client errors are logged, unless the ErrorPolicy decides
+// otherwise: the errors the policy decides to skip are logged, while the other ones are added to the span passed down
+// in the context.
 func (p *pushErrorHandler) IsServerError(ctx context.Context, err error) bool {
+	return p.handle(ctx, err) != nil
+}
+
+// handle handles the error of a push like IsServerError. It returns nil if the processing can go on, and the error
+// annotated with the action decided by the ErrorPolicy otherwise.
+func (p *pushErrorHandler) handle(ctx context.Context, err error) error {
 	// For every request, we have to determine if it's a server error.
 	// For the sake of simplicity, let's increment the total requests counter here.
-	p.metrics.totalRequests.Inc()
+	p.metrics.backend.IncTotal()
 
 	if err == nil {
-		return false
+		return nil
 	}
+	p.metrics.errRequestsByCode.WithLabelValues(grpcErrorCode(err)).Inc()
 	spanLog := spanlogger.FromContext(ctx, p.fallbackLogger)
 
-	// Only return non-client errors; these will stop the processing of the current Kafka fetches and retry (possibly).
+	policy := p.policy
+	if policy == nil {
+		policy = DefaultErrorPolicy
+	}
+	action := policy.Decide(ctx, err)
+	p.metrics.errorPolicyDecisions.WithLabelValues(action.String()).Inc()
+
+	// Only return the errors which aren't skipped; these will stop the processing of the current Kafka fetches and retry (possibly).
 	if !mimirpb.IsClientError(err) {
-		p.metrics.serverErrRequests.Inc()
+		RecordFailure(p.metrics.backend, FailureCauseServer)
+		p.metrics.serverErrRequestsBySubcause.WithLabelValues(p.classifier.classify(err)).Inc()
 		_ = spanLog.Error(err)
-		return true
+		if action != ErrorActionSkip {
+			return &pushActionError{action: action, err: err}
+		}
+		level.Warn(spanLog).Log("msg", "skipping write request which failed with a server error, as decided by the error policy", "err", err)
+		return nil
 	}
 
-	p.metrics.clientErrRequests.Inc()
+	RecordFailure(p.metrics.backend, clientErrorFailureCause(err))
+	if action != ErrorActionSkip {
+		_ = spanLog.Error(err)
+		return &pushActionError{action: action, err: err}
+	}
 
 	// The error could be sampled or marked to be skipped in logs, so we check whether it should be
-	// logged before doing it.
-	if keep, reason := p.shouldLogClientError(ctx, err); keep {
+	// logged before doing it. The errors which should be logged are still throttled by the log limiter.
+	if keep, reason := p.shouldLogClientError(ctx, err); keep && p.logLimiter.allow() {
 		if reason != "" {
 			err = fmt.Errorf("%w (%s)", err, reason)
 		}
@@ -512,12 +2664,30 @@ func (p *pushErrorHandler) IsServerError(ctx context.Context, err error) bool {
 		// This error message is consistent with error message in Prometheus remote-write and OTLP handlers in distributors.
 		level.Warn(spanLog).Log("msg", "detected a client error while ingesting write request (the request may have been partially ingested)", "insight", true, "err", err)
 	}
-	return false
+	return nil
+}
+
+// grpcErrorCode returns the name of the gRPC status code of err, or "unknown" if err has no gRPC status.
+func grpcErrorCode(err error) string {
+	if stat, ok := grpcutil.ErrorToStatus(err); ok {
+		return stat.Code().String()
+	}
+	return "unknown"
 }
 
 // shouldLogClientError returns whether err should be logged.
 func (p *pushErrorHandler) shouldLogClientError(ctx context.Context, err error) (bool, string) {
 	var optional middleware.OptionalLogging
+	if p.clientErrDedup != nil {
+		// Errors which shouldn't be logged are never logged, even if they're the first occurrence of their cause.
+		if errors.As(err, &optional) {
+			if keep, _ := optional.ShouldLog(ctx); !keep {
+				return false, ""
+			}
+		}
+		return p.clientErrDedup.isFirstOccurrence(ctx, err), ""
+	}
+
 	if !errors.As(err, &optional) {
 		// If error isn't sampled yet, we wrap it into our sampler and try again.
 		err = p.clientErrSampler.WrapError(err)
@@ -530,6 +2700,66 @@ func (p *pushErrorHandler) shouldLogClientError(ctx context.Context, err error)
 	return optional.ShouldLog(ctx)
 }
 
+// clientErrorDeduplicator tracks the client errors encountered while pushing a batch of records, so that only the
+// first occurrence of each cause is logged for each tenant. The suppressed occurrences are counted and logged
+// once the batch has been pushed.
+type clientErrorDeduplicator struct {
+	mx         sync.Mutex
+	suppressed map[clientErrorKey]int
+}
+
+type clientErrorKey struct {
+	tenantID string
+	cause    string
+}
+
+func newClientErrorDeduplicator() *clientErrorDeduplicator {
+	return &clientErrorDeduplicator{suppressed: map[clientErrorKey]int{}}
+}
+
+// isFirstOccurrence returns whether it's the first time a client error with the same cause is encountered for the tenant.
+func (d *clientErrorDeduplicator) isFirstOccurrence(ctx context.Context, err error) bool {
+	// The tenant is injected in the context before pushing, so it's only missing in tests.
+	tenantID, _ := user.ExtractOrgID(ctx)
+	key := clientErrorKey{tenantID: tenantID, cause: clientErrorCause(err)}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if count, ok := d.suppressed[key]; ok {
+		d.suppressed[key] = count + 1
+		return false
+	}
+	d.suppressed[key] = 0
+	return true
+}
+
+// logSuppressed logs the number of client errors that haven't been logged for each tenant and cause.
+// It's a no-op if d is nil.
+func (d *clientErrorDeduplicator) logSuppressed(logger log.Logger) {
+	if d == nil {
+		return
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	for key, count := range d.suppressed {
+		if count > 0 {
+			level.Warn(logger).Log("msg", "suppressed repeated client errors while ingesting write requests", "user", key.tenantID, "cause", key.cause, "suppressed", count)
+		}
+	}
+	clear(d.suppressed)
+}
+
+// clientErrorCause returns the cause in the details of err if any, or the type of err otherwise.
+func clientErrorCause(err error) string {
+	if cause, ok := errorDetailsCause(err); ok {
+		return cause.String()
+	}
+	return fmt.Sprintf("%T", err)
+}
+
 // batchingQueue is a queue that batches the incoming time series according to the batch size.
 // Once the batch size is reached, the batch is pushed to a channel which can be accessed through the Channel() method.
 type batchingQueue struct {
@@ -541,6 +2771,9 @@ type batchingQueue struct {
 
 	currentBatch flushableWriteRequest
 	batchSize    int
+
+	// pendingErrs are the errors collected by the idle flushes, to be returned with the errors of the next push.
+	pendingErrs multierror.MultiError
 }
 
 // newBatchingQueue creates a new batchingQueue instance.
@@ -635,6 +2868,22 @@ func (q *batchingQueue) push() error {
 	return errs.Err()
 }
 
+// takeIdleBatch returns the current batch to push to the channel if it's not empty, because no time series has been
+// added for a while, and resets it. It returns nil if the current batch is empty. The errors collected meanwhile are kept
+// to be returned by the next push or by Close, because there's no caller to return them to.
+func (q *batchingQueue) takeIdleBatch() *flushableWriteRequest {
+	if len(q.currentBatch.Timeseries)+len(q.currentBatch.Metadata) == 0 {
+		return nil
+	}
+	q.pendingErrs = q.collectErrors()
+	q.metrics.idleFlushTotal.Inc()
+	q.metrics.flushTotal.Inc()
+
+	batch := q.currentBatch
+	q.resetCurrentBatch()
+	return &batch
+}
+
 // resetCurrentBatch resets the current batch to an empty state.
 func (q *batchingQueue) resetCurrentBatch() {
 	q.currentBatch = flushableWriteRequest{
@@ -643,7 +2892,8 @@ func (q *batchingQueue) resetCurrentBatch() {
 }
 
 func (q *batchingQueue) collectErrors() multierror.MultiError {
-	var errs multierror.MultiError
+	errs := q.pendingErrs
+	q.pendingErrs = nil
 
 	for {
 		select {
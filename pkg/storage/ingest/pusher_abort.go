@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errConsumeAborted is the error returned by the consumes aborted without a cause.
+var errConsumeAborted = errors.New("the consumption has been aborted")
+
+// abortError is the cause of the context of a consume which has been aborted.
+type abortError struct {
+	cause error
+}
+
+func (e *abortError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *abortError) Unwrap() error {
+	return e.cause
+}
+
+// consumeAborter tracks the in-flight consumes of a pusherConsumer, so that they can be aborted.
+// It's shared by the copies of the pusherConsumer, and it's safe for concurrent use.
+type consumeAborter struct {
+	mx       sync.Mutex
+	nextID   int
+	inflight map[int]context.CancelCauseFunc
+}
+
+func newConsumeAborter() *consumeAborter {
+	return &consumeAborter{inflight: map[int]context.CancelCauseFunc{}}
+}
+
+// track registers the cancel function of an in-flight consume, and returns the function to call once it's done.
+func (a *consumeAborter) track(cancel context.CancelCauseFunc) func() {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	id := a.nextID
+	a.nextID++
+	a.inflight[id] = cancel
+
+	return func() {
+		a.mx.Lock()
+		defer a.mx.Unlock()
+		delete(a.inflight, id)
+	}
+}
+
+// abort cancels the in-flight consumes with the cause.
+func (a *consumeAborter) abort(cause error) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	for _, cancel := range a.inflight {
+		cancel(&abortError{cause: cause})
+	}
+}
+
+// abortCause returns the cause the consume running with ctx has been aborted with, or nil if it hasn't been aborted.
+func abortCause(ctx context.Context) error {
+	var abortErr *abortError
+	if errors.As(context.Cause(ctx), &abortErr) {
+		return abortErr.cause
+	}
+	return nil
+}
+
+// Abort cancels the context of the in-flight consumes of the consumer with the cause, so that they stop unmarshalling
+// and pushing more records and promptly return the cause, or errConsumeAborted if the cause is nil. The records already
+// handed over to the storage aren't interrupted. The consumes started after Abort has returned aren't affected.
+//
+// Abort is safe for concurrent use. It's idempotent, because once a consume has been aborted it keeps returning the
+// cause of the first Abort.
+func (c pusherConsumer) Abort(cause error) {
+	if cause == nil {
+		cause = errConsumeAborted
+	}
+	c.aborter.abort(cause)
+}
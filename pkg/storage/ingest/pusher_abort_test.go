@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_Abort(t *testing.T) {
+	var records []record
+	for i := 0; i < 5; i++ {
+		r := makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)
+		r.offset = int64(i)
+		records = append(records, r)
+	}
+
+	for ordering, cfg := range map[string]KafkaConfig{
+		ingestionOrderingStrict:  {IngestionOrdering: ingestionOrderingStrict},
+		ingestionOrderingRelaxed: {IngestionOrdering: ingestionOrderingRelaxed, IngestionConcurrencyMax: 1},
+	} {
+		t.Run(ordering, func(t *testing.T) {
+			t.Run("should return the cause of the first abort", func(t *testing.T) {
+				var c *pusherConsumer
+				pushes := atomic.NewInt64(0)
+				pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+					if pushes.Inc() == 2 {
+						c.Abort(errors.New("emergency stop"))
+						c.Abort(errors.New("another emergency stop"))
+					}
+					return nil
+				})
+				c = newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+				require.EqualError(t, c.Consume(context.Background(), records), "emergency stop")
+				assert.Less(t, pushes.Load(), int64(len(records)))
+
+				// The next consumes aren't affected.
+				pushes.Store(100)
+				require.NoError(t, c.Consume(context.Background(), records))
+			})
+
+			t.Run("should return a default error if aborted without a cause", func(t *testing.T) {
+				var c *pusherConsumer
+				pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+					c.Abort(nil)
+					return nil
+				})
+				c = newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+				require.ErrorIs(t, c.Consume(context.Background(), records), errConsumeAborted)
+			})
+
+			t.Run("should be a no-op if there's no in-flight consume", func(t *testing.T) {
+				c := newPusherConsumer(pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil }), cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+				c.Abort(errors.New("emergency stop"))
+
+				require.NoError(t, c.Consume(context.Background(), records))
+			})
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AuditedRecord describes a record which has been successfully pushed to the storage.
+type AuditedRecord struct {
+	// Offset is the offset of the record in the partition.
+	Offset int64
+	// TenantID is the tenant the record has been pushed as, which is the remapped tenant if a TenantRemapper is configured.
+	TenantID string
+	// CompletedAt is the time the record has been handed over to the storage writer.
+	CompletedAt time.Time
+}
+
+// RecordAuditSink receives the records which have been successfully pushed to the storage, for example to keep a
+// compliance log of when the data has been ingested.
+type RecordAuditSink interface {
+	// RecordsPushed is called once per consumed batch of records, after all of them have been successfully consumed,
+	// with the records pushed to the storage in the order they've been pushed. It's called by the consuming goroutine,
+	// so it should hand the records over to a background writer instead of blocking on slow I/O.
+	RecordsPushed(ctx context.Context, records []AuditedRecord)
+}
+
+// WithRecordAuditSink configures the consumer to report the records successfully pushed to the storage to the sink.
+//
+// The records are buffered in memory while a batch is being consumed, and reported only once the whole batch has
+// been successfully consumed, because the non-client errors of the records pushed in parallel are only known at
+// the end of the batch. If the consumption of a batch fails none of its records are reported, and they're reported
+// once the batch has been retried successfully. The records skipped because they couldn't be parsed aren't reported,
+// while the records partially rejected by the storage with client errors are.
+func WithRecordAuditSink(sink RecordAuditSink) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.auditSink = sink
+	}
+}
+
+// auditBuffer accumulates the records pushed while consuming a batch. It's safe for concurrent use.
+// A nil *auditBuffer is a no-op.
+type auditBuffer struct {
+	mx      sync.Mutex
+	records []AuditedRecord
+}
+
+func (b *auditBuffer) add(r parsedRecord) {
+	if b == nil {
+		return
+	}
+
+	now := time.Now()
+	b.mx.Lock()
+	b.records = append(b.records, AuditedRecord{Offset: r.offset, TenantID: r.tenantID, CompletedAt: now})
+	b.mx.Unlock()
+}
+
+// flush reports the buffered records to the sink, if any.
+func (b *auditBuffer) flush(ctx context.Context, sink RecordAuditSink) {
+	if b == nil || len(b.records) == 0 {
+		return
+	}
+	sink.RecordsPushed(ctx, b.records)
+}
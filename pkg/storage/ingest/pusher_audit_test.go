@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// recordAuditSinkFunc is a RecordAuditSink which calls the function for each batch of records.
+type recordAuditSinkFunc func(context.Context, []AuditedRecord)
+
+func (f recordAuditSinkFunc) RecordsPushed(ctx context.Context, records []AuditedRecord) {
+	f(ctx, records)
+}
+
+func TestPusherConsumer_WithRecordAuditSink(t *testing.T) {
+	newRecord := func(metricName string, offset int64) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content, offset: offset}
+	}
+	unparseable := record{ctx: context.Background(), tenantID: "user-1", content: []byte{0x0a, 0xff}, offset: 12}
+
+	tests := map[string]struct {
+		pushErr         error
+		records         []record
+		expectedOffsets []int64
+		expectedErr     bool
+	}{
+		"should report the pushed records": {
+			records:         []record{newRecord("series_1", 10), newRecord("series_2", 11)},
+			expectedOffsets: []int64{10, 11},
+		},
+		"should not report the records which couldn't be parsed": {
+			records:         []record{newRecord("series_1", 10), newRecord("series_2", 11), unparseable},
+			expectedOffsets: []int64{10, 11},
+		},
+		"should report the records rejected with a client error": {
+			pushErr:         ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "bad data"),
+			records:         []record{newRecord("series_1", 10)},
+			expectedOffsets: []int64{10},
+		},
+		"should not report any record if the batch fails": {
+			pushErr:     ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error"),
+			records:     []record{newRecord("series_1", 10)},
+			expectedErr: true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+				return testData.pushErr
+			})
+
+			var (
+				calls   int
+				offsets []int64
+			)
+			sink := recordAuditSinkFunc(func(_ context.Context, records []AuditedRecord) {
+				calls++
+				for _, r := range records {
+					assert.Equal(t, "user-1", r.TenantID)
+					assert.WithinDuration(t, time.Now(), r.CompletedAt, time.Minute)
+					offsets = append(offsets, r.Offset)
+				}
+			})
+
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithRecordAuditSink(sink))
+			err := c.Consume(context.Background(), testData.records)
+			if testData.expectedErr {
+				require.Error(t, err)
+				assert.Zero(t, calls)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, 1, calls)
+			assert.Equal(t, testData.expectedOffsets, offsets)
+		})
+	}
+}
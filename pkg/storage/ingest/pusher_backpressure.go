@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"time"
+)
+
+// backpressureRecheckInterval is how long a record waits before the ResourceMonitor is consulted again, when the
+// monitor holds the push of the record without returning a delay.
+const backpressureRecheckInterval = 100 * time.Millisecond
+
+// ResourceMonitor reports the pressure on the resources shared by the consumers, for example the depth of the queues
+// of the storage or the memory in use by the process, so that the consumers slow down when it's high. It decouples the
+// backpressure policy from the consumer. It must be safe for concurrent use.
+type ResourceMonitor interface {
+	// Backpressure is called before the record of tenantID is pushed. It returns whether the record can be pushed, and
+	// how long to wait before pushing it or, if it can't be pushed yet, before calling Backpressure again.
+	Backpressure(ctx context.Context, tenantID string) (delay time.Duration, proceed bool)
+}
+
+// NoopResourceMonitor is the ResourceMonitor which never slows down the consumer. It's the default one.
+type NoopResourceMonitor struct{}
+
+// Backpressure implements ResourceMonitor.
+func (NoopResourceMonitor) Backpressure(context.Context, string) (time.Duration, bool) {
+	return 0, true
+}
+
+// WithResourceMonitor configures the consumer to consult the monitor before pushing each record, and to wait as long as
+// the monitor asks to. The monitor can be shared by the consumers of different partitions, to adapt the ingestion of
+// the whole process to the pressure on its resources.
+func WithResourceMonitor(monitor ResourceMonitor) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		if monitor == nil {
+			monitor = NoopResourceMonitor{}
+		}
+		c.resourceMonitor = monitor
+	}
+}
+
+// waitBackpressure waits until the ResourceMonitor lets the record of tenantID be pushed. It returns the cause of the
+// context if it's done while waiting.
+func (c pusherConsumer) waitBackpressure(ctx context.Context, tenantID string) error {
+	delayed := false
+	for {
+		delay, proceed := c.resourceMonitor.Backpressure(ctx, tenantID)
+		if proceed && delay <= 0 {
+			return nil
+		}
+		if !proceed && delay <= 0 {
+			delay = backpressureRecheckInterval
+		}
+
+		if !delayed {
+			delayed = true
+			c.metrics.backpressureDelayedRecords.Inc()
+		}
+
+		start := time.Now()
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.metrics.backpressureDelaySeconds.Add(time.Since(start).Seconds())
+			return context.Cause(ctx)
+		case <-timer.C:
+		}
+		c.metrics.backpressureDelaySeconds.Add(time.Since(start).Seconds())
+
+		if proceed {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type resourceMonitorFunc func(ctx context.Context, tenantID string) (time.Duration, bool)
+
+func (f resourceMonitorFunc) Backpressure(ctx context.Context, tenantID string) (time.Duration, bool) {
+	return f(ctx, tenantID)
+}
+
+func TestPusherConsumer_ResourceMonitor(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-2", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+	}
+
+	var (
+		pushedMx sync.Mutex
+		pushed   []string
+	)
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushedMx.Lock()
+		defer pushedMx.Unlock()
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	t.Run("should not slow down with the default monitor", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithResourceMonitor(nil))
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		assert.Equal(t, []string{"series_1", "series_2"}, pushed)
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.backpressureDelayedRecords))
+	})
+
+	t.Run("should wait the delay returned by the monitor before pushing", func(t *testing.T) {
+		pushed = nil
+		monitor := resourceMonitorFunc(func(_ context.Context, tenantID string) (time.Duration, bool) {
+			if tenantID == "user-2" {
+				return 50 * time.Millisecond, true
+			}
+			return 0, true
+		})
+
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithResourceMonitor(monitor))
+		start := time.Now()
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+		assert.Equal(t, []string{"series_1", "series_2"}, pushed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.backpressureDelayedRecords))
+		assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.backpressureDelaySeconds), 0.05)
+	})
+
+	t.Run("should hold the push until the monitor lets it proceed", func(t *testing.T) {
+		pushed = nil
+		calls := 0
+		monitor := resourceMonitorFunc(func(context.Context, string) (time.Duration, bool) {
+			calls++
+			// The first record is held twice, once with a delay and once without.
+			switch calls {
+			case 1:
+				return time.Millisecond, false
+			case 2:
+				return 0, false
+			}
+			return 0, true
+		})
+
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithResourceMonitor(monitor))
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		assert.Equal(t, 4, calls)
+		assert.Equal(t, []string{"series_1", "series_2"}, pushed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.backpressureDelayedRecords))
+		assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.backpressureDelaySeconds), backpressureRecheckInterval.Seconds())
+	})
+
+	t.Run("should stop waiting when the context is canceled", func(t *testing.T) {
+		pushed = nil
+		cause := errors.New("stopping")
+		ctx, cancel := context.WithCancelCause(context.Background())
+		monitor := resourceMonitorFunc(func(context.Context, string) (time.Duration, bool) {
+			cancel(cause)
+			return time.Hour, false
+		})
+
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithResourceMonitor(monitor))
+		require.ErrorIs(t, c.Consume(ctx, records), cause)
+		assert.Empty(t, pushed)
+	})
+}
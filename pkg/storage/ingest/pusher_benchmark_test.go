@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// noopMetric is a prometheus.Counter, prometheus.Gauge and prometheus.Histogram which discards the observations.
+type noopMetric struct{}
+
+var noopMetricDesc = prometheus.NewDesc("noop", "Discarded metric.", nil, nil)
+
+func (noopMetric) Desc() *prometheus.Desc           { return noopMetricDesc }
+func (noopMetric) Write(*dto.Metric) error          { return nil }
+func (noopMetric) Describe(chan<- *prometheus.Desc) {}
+func (noopMetric) Collect(chan<- prometheus.Metric) {}
+func (noopMetric) Inc()                             {}
+func (noopMetric) Dec()                             {}
+func (noopMetric) Add(float64)                      {}
+func (noopMetric) Sub(float64)                      {}
+func (noopMetric) Set(float64)                      {}
+func (noopMetric) SetToCurrentTime()                {}
+func (noopMetric) Observe(float64)                  {}
+
+// newNoopPusherConsumerMetrics returns the metrics of a pusherConsumer which discard all the observations of the
+// counters, gauges and histograms, and report the core metrics to NoopConsumerMetrics, so that the benchmarks measure
+// the cost of the consumption without the cost of the instrumentation. The vectors of metrics are kept, but they aren't
+// registered. The fields are replaced by reflection, so that the metrics added later are discarded too.
+func newNoopPusherConsumerMetrics() *pusherConsumerMetrics {
+	m := newPusherConsumerMetrics(nil)
+	discardMetrics(reflect.ValueOf(m).Elem())
+	m.storagePusherMetrics.backend = NoopConsumerMetrics{}
+	return m
+}
+
+// discardMetrics replaces the metrics of the struct, and of the structs of metrics of this package it points to, with noopMetric.
+func discardMetrics(v reflect.Value) {
+	noop := reflect.ValueOf(noopMetric{})
+	pkgPath := reflect.TypeOf(pusherConsumerMetrics{}).PkgPath()
+
+	for i := 0; i < v.NumField(); i++ {
+		// The fields are unexported, so they can only be set through their address.
+		field := v.Field(i)
+		field = reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+
+		switch t := field.Type(); {
+		case t.Kind() == reflect.Interface && noop.Type().Implements(t) && !field.IsNil():
+			field.Set(noop)
+		case t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct && t.Elem().PkgPath() == pkgPath && !field.IsNil():
+			discardMetrics(field.Elem())
+		}
+	}
+}
+
+func TestNewNoopPusherConsumerMetrics(t *testing.T) {
+	t.Run("should discard all the counters, gauges and histograms", func(t *testing.T) {
+		m := newNoopPusherConsumerMetrics()
+		for _, v := range []reflect.Value{reflect.ValueOf(m).Elem(), reflect.ValueOf(m.storagePusherMetrics).Elem(), reflect.ValueOf(m.storagePusherMetrics.batchingQueueMetrics).Elem()} {
+			for i := 0; i < v.NumField(); i++ {
+				if field := v.Field(i); field.Kind() == reflect.Interface && !field.IsNil() && field.Type() != reflect.TypeOf((*ConsumerMetrics)(nil)).Elem() {
+					assert.Equal(t, reflect.TypeOf(noopMetric{}), field.Elem().Type(), v.Type().Field(i).Name)
+				}
+			}
+		}
+		assert.Equal(t, NoopConsumerMetrics{}, m.storagePusherMetrics.backend)
+	})
+
+	t.Run("should consume the records like with the Prometheus metrics", func(t *testing.T) {
+		var records []record
+		for i := 0; i < 10; i++ {
+			records = append(records, makeRecord(t, fmt.Sprintf("user-%d", i%3), &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}, nil))
+		}
+
+		consume := func(metrics *pusherConsumerMetrics) []string {
+			var (
+				mx     sync.Mutex
+				pushed []string
+			)
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				mx.Lock()
+				defer mx.Unlock()
+				pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+				return nil
+			})
+			c := newPusherConsumer(pusher, KafkaConfig{IngestionConcurrencyMax: 2, IngestionConcurrencyBatchSize: 1, IngestionConcurrencyQueueCapacity: 1, IngestionConcurrencyEstimatedBytesPerSample: 1, IngestionConcurrencyTargetFlushesPerShard: 1}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+			require.NoError(t, c.Consume(context.Background(), records))
+			return pushed
+		}
+
+		assert.ElementsMatch(t, consume(newPusherConsumerMetrics(prometheus.NewPedanticRegistry())), consume(newNoopPusherConsumerMetrics()))
+	})
+}
+
+func BenchmarkPusherConsumer_Metrics(b *testing.B) {
+	const numSeries = 100
+
+	records := make([]record, 100)
+	for i := range records {
+		req := &mimirpb.WriteRequest{Timeseries: make([]mimirpb.PreallocTimeseries, 0, numSeries)}
+		for s := 0; s < numSeries; s++ {
+			req.Timeseries = append(req.Timeseries, mockPreallocTimeseries(fmt.Sprintf("series_%d", s)))
+		}
+		records[i] = makeRecord(b, "user-1", req, nil)
+	}
+
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	for name, newMetrics := range map[string]func() *pusherConsumerMetrics{
+		"prometheus": func() *pusherConsumerMetrics { return newPusherConsumerMetrics(prometheus.NewPedanticRegistry()) },
+		"noop":       newNoopPusherConsumerMetrics,
+	} {
+		b.Run(name, func(b *testing.B) {
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newMetrics(), log.NewNopLogger())
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if err := c.Consume(context.Background(), records); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
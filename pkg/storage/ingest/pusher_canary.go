@@ -0,0 +1,41 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"slices"
+)
+
+var (
+	errCanaryDisabled = errors.New("the canary tenant isn't configured")
+	errNoCanaryRecord = errors.New("no record of the canary tenant to consume")
+
+	// errCanaryNotPushed is returned when probing the canary of a PartitionReader whose records aren't pushed to the storage.
+	errCanaryNotPushed = errors.New("the records of the partition reader aren't pushed to the storage")
+)
+
+// ConsumeCanary pushes the first record of the canary tenant among the records with the same code path as Consume, and
+// returns its result as soon as it's been pushed. The other records aren't consumed. It's meant to verify that the
+// records can be pushed to the storage end to end, for example before accepting the traffic once deployed, so it's not
+// affected by the consumption of the other batches.
+//
+// Like ConsumeWithResults, the error returned is the one the consumption of the canary record has failed with, while
+// the canary record rejected with a client error has a nil error and the outcome it's been rejected with.
+func (c pusherConsumer) ConsumeCanary(ctx context.Context, records []record) (RecordResult, error) {
+	tenantID := c.kafkaConfig.CanaryTenant
+	if tenantID == "" {
+		return RecordResult{}, errCanaryDisabled
+	}
+
+	i := slices.IndexFunc(records, func(r record) bool { return r.tenantID == tenantID })
+	if i < 0 {
+		return RecordResult{}, errNoCanaryRecord
+	}
+
+	// The heartbeat is only pushed once the batches read from Kafka have been consumed.
+	c.heartbeat = nil
+	results, err := c.ConsumeWithResults(ctx, records[i:i+1])
+	return results[0], err
+}
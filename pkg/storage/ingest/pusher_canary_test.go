@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_ConsumeCanary(t *testing.T) {
+	newRecord := func(tenantID, metricName string) record {
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+	}
+	records := []record{newRecord("user-1", "series_1"), newRecord("canary", "series_2"), newRecord("canary", "series_3")}
+
+	var (
+		pushed  []string
+		pushErr error
+	)
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := tenant.TenantID(ctx)
+		require.NoError(t, err)
+		pushed = append(pushed, tenantID+"/"+request.Timeseries[0].Labels[0].Value)
+		return pushErr
+	})
+	newConsumer := func(cfg KafkaConfig) *pusherConsumer {
+		return newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+	}
+
+	t.Run("should only push the first record of the canary tenant", func(t *testing.T) {
+		pushed = nil
+		result, err := newConsumer(KafkaConfig{CanaryTenant: "canary"}).ConsumeCanary(context.Background(), records)
+		require.NoError(t, err)
+		assert.Equal(t, RecordResult{Outcome: outcomePushed}, result)
+		assert.Equal(t, []string{"canary/series_2"}, pushed)
+	})
+
+	t.Run("should return the error the canary record failed to be pushed with", func(t *testing.T) {
+		pushed, pushErr = nil, errors.New("server error")
+		t.Cleanup(func() { pushErr = nil })
+
+		result, err := newConsumer(KafkaConfig{CanaryTenant: "canary"}).ConsumeCanary(context.Background(), records)
+		require.ErrorIs(t, err, pushErr)
+		assert.Equal(t, outcomeFailed, result.Outcome)
+		assert.ErrorIs(t, result.Err, pushErr)
+	})
+
+	t.Run("should fail without record of the canary tenant", func(t *testing.T) {
+		pushed = nil
+		_, err := newConsumer(KafkaConfig{CanaryTenant: "canary"}).ConsumeCanary(context.Background(), records[:1])
+		require.ErrorIs(t, err, errNoCanaryRecord)
+		assert.Empty(t, pushed)
+	})
+
+	t.Run("should fail without canary tenant", func(t *testing.T) {
+		_, err := newConsumer(KafkaConfig{}).ConsumeCanary(context.Background(), records)
+		require.ErrorIs(t, err, errCanaryDisabled)
+	})
+
+	t.Run("should probe the canary of the partition reader", func(t *testing.T) {
+		pushed = nil
+		cfg := KafkaConfig{CanaryTenant: "canary"}
+		r := &PartitionReader{kafkaCfg: cfg, newConsumer: consumerFactoryFunc(func() recordConsumer { return newConsumer(cfg) })}
+
+		result, err := r.ProbeCanary(context.Background(), records[2].content)
+		require.NoError(t, err)
+		assert.Equal(t, RecordResult{Outcome: outcomePushed}, result)
+		assert.Equal(t, []string{"canary/series_3"}, pushed)
+	})
+}
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/grafana/dskit/grpcutil"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// The causes of the write requests which failed to be consumed, used as the values of the cause label of
+// cortex_ingest_storage_reader_requests_failed_total and passed to ConsumerMetrics.IncFailed.
+const (
+	// FailureCauseClient is the cause of the requests rejected by the storage with a client error, which are skipped.
+	FailureCauseClient = "client"
+	// FailureCauseServer is the cause of the requests which failed with a server error, which aborts the consumption.
+	FailureCauseServer = "server"
+	// FailureCauseUnmarshal is the cause of the records which couldn't be unmarshalled into a write request.
+	FailureCauseUnmarshal = "unmarshal"
+	// FailureCauseTooLarge is the cause of the records or requests rejected because of their size.
+	FailureCauseTooLarge = "too_large"
+	// FailureCauseDuplicate is the cause of the records or requests rejected because they've already been consumed.
+	FailureCauseDuplicate = "duplicate"
+	// FailureCauseRateLimited is the cause of the records or requests rejected because of a rate limit.
+	FailureCauseRateLimited = "rate_limited"
+	// FailureCauseOther is recorded in place of the causes which haven't been registered.
+	FailureCauseOther = "other"
+)
+
+// maxFailureCauses is the maximum number of failure causes, including the built-in ones, which bounds the cardinality
+// of the cause label.
+const maxFailureCauses = 32
+
+// validFailureCause is the format of the failure causes.
+var validFailureCause = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// failureCauses are the registered failure causes.
+var failureCauses = newFailureCauseRegistry(FailureCauseClient, FailureCauseServer, FailureCauseUnmarshal, FailureCauseTooLarge, FailureCauseDuplicate, FailureCauseRateLimited, FailureCauseOther)
+
+// failureCauseRegistry is a set of failure causes. It's safe for concurrent use.
+type failureCauseRegistry struct {
+	mx     sync.RWMutex
+	causes map[string]struct{}
+}
+
+func newFailureCauseRegistry(causes ...string) *failureCauseRegistry {
+	r := &failureCauseRegistry{causes: make(map[string]struct{}, len(causes))}
+	for _, cause := range causes {
+		r.causes[cause] = struct{}{}
+	}
+	return r
+}
+
+func (r *failureCauseRegistry) register(cause string) error {
+	if !validFailureCause.MatchString(cause) {
+		return fmt.Errorf("invalid failure cause %q: it must be made of lowercase letters, digits and underscores, and start with a letter", cause)
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if _, ok := r.causes[cause]; ok {
+		return nil
+	}
+	if len(r.causes) >= maxFailureCauses {
+		return fmt.Errorf("can't register failure cause %q: the maximum of %d failure causes has been reached", cause, maxFailureCauses)
+	}
+	r.causes[cause] = struct{}{}
+	return nil
+}
+
+func (r *failureCauseRegistry) normalize(cause string) string {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if _, ok := r.causes[cause]; ok {
+		return cause
+	}
+	return FailureCauseOther
+}
+
+// RegisterFailureCause registers a custom failure cause, for example the cause of the records rejected by a pluggable
+// validator, so that it can be recorded with RecordFailure. Registering a cause which is already registered is a no-op.
+// It returns an error if the cause isn't made of lowercase letters, digits and underscores, or if too many causes have
+// been registered.
+func RegisterFailureCause(cause string) error {
+	return failureCauses.register(cause)
+}
+
+// RecordFailure records a failed write request with the cause to the metrics. The causes which haven't been registered
+// are recorded as FailureCauseOther, so that a misbehaving component can't cause a cardinality explosion.
+func RecordFailure(metrics ConsumerMetrics, cause string) {
+	metrics.IncFailed(failureCauses.normalize(cause))
+}
+
+// clientErrorFailureCause returns the failure cause of a request rejected by the storage with the client error err.
+// The requests rejected because of a rate limit, either with the 429 status code or with a rate limiting cause, are
+// told apart from the other client errors.
+func clientErrorFailureCause(err error) string {
+	if grpcutil.ErrorToStatusCode(err) == http.StatusTooManyRequests {
+		return FailureCauseRateLimited
+	}
+	if cause, ok := errorDetailsCause(err); ok && (cause == mimirpb.INGESTION_RATE_LIMITED || cause == mimirpb.REQUEST_RATE_LIMITED) {
+		return FailureCauseRateLimited
+	}
+	return FailureCauseClient
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/httpgrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestFailureCauseRegistry(t *testing.T) {
+	r := newFailureCauseRegistry(FailureCauseClient, FailureCauseOther)
+
+	assert.Equal(t, FailureCauseClient, r.normalize(FailureCauseClient))
+	assert.Equal(t, FailureCauseOther, r.normalize("custom_validator"))
+
+	require.NoError(t, r.register("custom_validator"))
+	require.NoError(t, r.register("custom_validator"))
+	assert.Equal(t, "custom_validator", r.normalize("custom_validator"))
+
+	for _, invalid := range []string{"", "Custom", "custom-validator", "1custom", "custom validator"} {
+		assert.Error(t, r.register(invalid), invalid)
+	}
+
+	for i := len(r.causes); i < maxFailureCauses; i++ {
+		require.NoError(t, r.register(fmt.Sprintf("cause_%d", i)))
+	}
+	require.ErrorContains(t, r.register("one_too_many"), "the maximum of 32 failure causes has been reached")
+	assert.Equal(t, FailureCauseOther, r.normalize("one_too_many"))
+}
+
+func TestRecordFailure(t *testing.T) {
+	require.NoError(t, RegisterFailureCause("test_record_failure"))
+
+	metrics := &recordingConsumerMetrics{failed: map[string]int{}}
+	RecordFailure(metrics, FailureCauseServer)
+	RecordFailure(metrics, "test_record_failure")
+	RecordFailure(metrics, "not_registered")
+	RecordFailure(metrics, "not_registered_either")
+
+	assert.Equal(t, map[string]int{FailureCauseServer: 1, "test_record_failure": 1, FailureCauseOther: 2}, metrics.failed)
+}
+
+func TestPusherConsumer_ShouldRecordFailureCauses(t *testing.T) {
+	newContent := func(metricName string) []byte {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return content
+	}
+
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		switch request.Timeseries[0].Labels[0].Value {
+		case "client_error":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		case "rate_limited":
+			return httpgrpc.Errorf(http.StatusTooManyRequests, "ingestion rate limit exceeded")
+		}
+		return nil
+	})
+
+	// The decompressed content of the large record exceeds the maximum, while the compressed one doesn't.
+	large := newContent("series_" + strings.Repeat("a", 1024))
+	cfg := KafkaConfig{MaxDecompressedRecordSizeBytes: len(large) - 1, IdempotencyTokensMaxSize: 10}
+	backend := &recordingConsumerMetrics{failed: map[string]int{}}
+	c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithConsumerMetrics(backend))
+
+	require.NoError(t, c.Consume(context.Background(), []record{
+		{ctx: context.Background(), tenantID: "user-1", content: newContent("series_1"), idempotencyToken: "token-1"},
+		{ctx: context.Background(), tenantID: "user-1", content: newContent("series_1"), idempotencyToken: "token-1"},
+		{ctx: context.Background(), tenantID: "user-1", content: []byte("invalid")},
+		{ctx: context.Background(), tenantID: "user-1", content: gzipCompress(t, large)},
+		{ctx: context.Background(), tenantID: "user-1", content: newContent("client_error")},
+		{ctx: context.Background(), tenantID: "user-1", content: newContent("rate_limited")},
+	}))
+
+	assert.Equal(t, map[string]int{
+		FailureCauseDuplicate:   1,
+		FailureCauseUnmarshal:   1,
+		FailureCauseTooLarge:    1,
+		FailureCauseClient:      1,
+		FailureCauseRateLimited: 1,
+	}, backend.failed)
+}
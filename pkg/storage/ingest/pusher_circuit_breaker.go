@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/failsafe-go/failsafe-go/circuitbreaker"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+var errTenantCircuitBreakerOpen = errors.New("the tenant circuit breaker is open")
+
+// tenantCircuitBreakerPusher is a Pusher middleware that keeps a circuit breaker for each tenant.
+// Server errors returned by the upstream Pusher are recorded as failures of the tenant's circuit breaker,
+// while successful pushes and client errors are recorded as successes. When the circuit breaker of a tenant
+// is open, its requests fail with a server error without being pushed, so that an unhealthy storage
+// for one tenant doesn't get hammered while the other tenants' breakers are unaffected.
+//
+// A server error aborts the consumption of the whole batch of records, which is retried by the PartitionReader.
+// Retries for a tenant with an open circuit breaker fail fast until the cooldown period has elapsed.
+//
+// The tenantCircuitBreakerPusher is shared by all the pusherConsumer instances of a PartitionReader,
+// so that the state of the circuit breakers is preserved across the consumed batches. The circuit breakers which
+// have stayed closed without being used for the idle timeout are evicted, so that the circuit breakers of the
+// tenants which don't write to the partition anymore don't accumulate.
+type tenantCircuitBreakerPusher struct {
+	upstream Pusher
+	logger   log.Logger
+
+	failureThreshold uint
+	cooldownPeriod   time.Duration
+	idleTimeout      time.Duration
+
+	breakersMx sync.Mutex
+	breakers   map[string]*tenantCircuitBreaker
+	// lastEviction is the last time the idle circuit breakers have been evicted.
+	lastEviction time.Time
+
+	transitions *prometheus.CounterVec
+
+	// now is the function returning the current time, replaceable in tests.
+	now func() time.Time
+}
+
+// tenantCircuitBreaker is the circuit breaker of a tenant, with the last time it's been used.
+type tenantCircuitBreaker struct {
+	circuitbreaker.CircuitBreaker[any]
+	lastUsed time.Time
+}
+
+func newTenantCircuitBreakerPusher(upstream Pusher, cfg KafkaConfig, reg prometheus.Registerer, logger log.Logger) *tenantCircuitBreakerPusher {
+	p := &tenantCircuitBreakerPusher{
+		upstream:         upstream,
+		logger:           logger,
+		failureThreshold: cfg.TenantCircuitBreakerFailureThreshold,
+		cooldownPeriod:   cfg.TenantCircuitBreakerCooldownPeriod,
+		idleTimeout:      cfg.TenantCircuitBreakerIdleTimeout,
+		breakers:         map[string]*tenantCircuitBreaker{},
+		now:              time.Now,
+		transitions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_tenant_circuit_breaker_transitions_total",
+			Help: "Number of times the circuit breaker of a tenant has entered a state.",
+		}, []string{"state"}),
+	}
+
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_ingest_storage_reader_tenant_circuit_breakers_open",
+		Help: "Number of tenants whose circuit breaker is currently open.",
+	}, func() float64 {
+		return float64(p.openBreakers())
+	})
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_ingest_storage_reader_tenant_circuit_breakers",
+		Help: "Number of tenants which have a circuit breaker.",
+	}, func() float64 {
+		p.breakersMx.Lock()
+		defer p.breakersMx.Unlock()
+		return float64(len(p.breakers))
+	})
+
+	for _, s := range []circuitbreaker.State{circuitbreaker.OpenState, circuitbreaker.HalfOpenState, circuitbreaker.ClosedState} {
+		p.transitions.WithLabelValues(s.String())
+	}
+
+	return p
+}
+
+// PushToStorage implements the Pusher interface.
+func (p *tenantCircuitBreakerPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	userID, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		// Without a tenant we can't pick a circuit breaker, so let the upstream Pusher deal with the request.
+		return p.upstream.PushToStorage(ctx, req)
+	}
+
+	return p.push(userID, func() error {
+		return p.upstream.PushToStorage(ctx, req)
+	})
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+func (p *tenantCircuitBreakerPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	return p.push(tenantID, func() error {
+		return p.upstream.(RawPusher).PushRawToStorage(ctx, tenantID, content)
+	})
+}
+
+// push pushes with the circuit breaker of the tenant, failing fast if it's open.
+func (p *tenantCircuitBreakerPusher) push(userID string, push func() error) error {
+	cb := p.breakerFor(userID)
+	if !cb.TryAcquirePermit() {
+		return fmt.Errorf("%w for tenant %s", errTenantCircuitBreakerOpen, userID)
+	}
+
+	err := push()
+	if err != nil && !mimirpb.IsClientError(err) {
+		cb.RecordFailure()
+	} else {
+		cb.RecordSuccess()
+	}
+	return err
+}
+
+// breakerFor returns the circuit breaker of the tenant, creating it if it doesn't exist yet.
+func (p *tenantCircuitBreakerPusher) breakerFor(userID string) circuitbreaker.CircuitBreaker[any] {
+	p.breakersMx.Lock()
+	defer p.breakersMx.Unlock()
+
+	now := p.now()
+	p.evictIdleBreakers(now)
+
+	if cb, ok := p.breakers[userID]; ok {
+		cb.lastUsed = now
+		return cb.CircuitBreaker
+	}
+
+	logger := log.With(p.logger, "user", userID)
+	cb := circuitbreaker.Builder[any]().
+		WithFailureThreshold(p.failureThreshold).
+		WithDelay(p.cooldownPeriod).
+		OnClose(func(event circuitbreaker.StateChangedEvent) {
+			p.transitions.WithLabelValues(circuitbreaker.ClosedState.String()).Inc()
+			level.Info(logger).Log("msg", "tenant circuit breaker is closed", "previous", event.OldState, "current", event.NewState)
+		}).
+		OnOpen(func(event circuitbreaker.StateChangedEvent) {
+			p.transitions.WithLabelValues(circuitbreaker.OpenState.String()).Inc()
+			level.Warn(logger).Log("msg", "tenant circuit breaker is open", "previous", event.OldState, "current", event.NewState)
+		}).
+		OnHalfOpen(func(event circuitbreaker.StateChangedEvent) {
+			p.transitions.WithLabelValues(circuitbreaker.HalfOpenState.String()).Inc()
+			level.Info(logger).Log("msg", "tenant circuit breaker is half-open", "previous", event.OldState, "current", event.NewState)
+		}).
+		Build()
+
+	p.breakers[userID] = &tenantCircuitBreaker{CircuitBreaker: cb, lastUsed: now}
+	return cb
+}
+
+// evictIdleBreakers evicts the circuit breakers which are closed and haven't been used for the idle timeout.
+// The circuit breakers which aren't closed are kept, so that a tenant doesn't get a fresh circuit breaker by not
+// pushing until the open one is evicted. The circuit breakers are evicted at most once per idle timeout, so that
+// they aren't all scanned on each push. It must be called with breakersMx held.
+func (p *tenantCircuitBreakerPusher) evictIdleBreakers(now time.Time) {
+	if p.idleTimeout <= 0 || now.Sub(p.lastEviction) < p.idleTimeout {
+		return
+	}
+	p.lastEviction = now
+
+	for userID, cb := range p.breakers {
+		if cb.IsClosed() && now.Sub(cb.lastUsed) >= p.idleTimeout {
+			delete(p.breakers, userID)
+		}
+	}
+}
+
+// openBreakers returns the number of tenants whose circuit breaker is open.
+func (p *tenantCircuitBreakerPusher) openBreakers() int {
+	p.breakersMx.Lock()
+	defer p.breakersMx.Unlock()
+
+	open := 0
+	for _, cb := range p.breakers {
+		if cb.IsOpen() {
+			open++
+		}
+	}
+	return open
+}
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+func TestTenantCircuitBreakerPusher(t *testing.T) {
+	cfg := KafkaConfig{
+		TenantCircuitBreakerEnabled:          true,
+		TenantCircuitBreakerFailureThreshold: 2,
+		TenantCircuitBreakerCooldownPeriod:   time.Hour,
+	}
+
+	// user-1 always fails with a server error, user-2 always fails with a client error, every other tenant succeeds.
+	pushesPerTenant := map[string]int{}
+	upstream := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+		userID, err := user.ExtractOrgID(ctx)
+		require.NoError(t, err)
+		pushesPerTenant[userID]++
+
+		switch userID {
+		case "user-1":
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		case "user-2":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		default:
+			return nil
+		}
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	p := newTenantCircuitBreakerPusher(upstream, cfg, reg, log.NewNopLogger())
+
+	push := func(userID string) error {
+		return p.PushToStorage(user.InjectOrgID(context.Background(), userID), &mimirpb.WriteRequest{})
+	}
+
+	for i := 0; i < 5; i++ {
+		err := push("user-1")
+		require.Error(t, err)
+		assert.False(t, mimirpb.IsClientError(err))
+		if i >= 2 {
+			assert.ErrorIs(t, err, errTenantCircuitBreakerOpen)
+		}
+
+		assert.True(t, mimirpb.IsClientError(push("user-2")))
+		assert.NoError(t, push("user-3"))
+	}
+
+	// Once the breaker of user-1 is open, its requests don't reach the upstream anymore.
+	assert.Equal(t, map[string]int{"user-1": 2, "user-2": 5, "user-3": 5}, pushesPerTenant)
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_tenant_circuit_breakers_open Number of tenants whose circuit breaker is currently open.
+		# TYPE cortex_ingest_storage_reader_tenant_circuit_breakers_open gauge
+		cortex_ingest_storage_reader_tenant_circuit_breakers_open 1
+
+		# HELP cortex_ingest_storage_reader_tenant_circuit_breaker_transitions_total Number of times the circuit breaker of a tenant has entered a state.
+		# TYPE cortex_ingest_storage_reader_tenant_circuit_breaker_transitions_total counter
+		cortex_ingest_storage_reader_tenant_circuit_breaker_transitions_total{state="closed"} 0
+		cortex_ingest_storage_reader_tenant_circuit_breaker_transitions_total{state="half-open"} 0
+		cortex_ingest_storage_reader_tenant_circuit_breaker_transitions_total{state="open"} 1
+	`), "cortex_ingest_storage_reader_tenant_circuit_breakers_open", "cortex_ingest_storage_reader_tenant_circuit_breaker_transitions_total"))
+}
+
+func TestTenantCircuitBreakerPusher_ShouldCloseAfterCooldown(t *testing.T) {
+	cfg := KafkaConfig{
+		TenantCircuitBreakerEnabled:          true,
+		TenantCircuitBreakerFailureThreshold: 1,
+		TenantCircuitBreakerCooldownPeriod:   100 * time.Millisecond,
+	}
+
+	upstreamErr := ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+	upstream := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		return upstreamErr
+	})
+
+	p := newTenantCircuitBreakerPusher(upstream, cfg, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+	ctx := user.InjectOrgID(context.Background(), "user-1")
+
+	require.Error(t, p.PushToStorage(ctx, &mimirpb.WriteRequest{}))
+	require.ErrorIs(t, p.PushToStorage(ctx, &mimirpb.WriteRequest{}), errTenantCircuitBreakerOpen)
+
+	// The storage recovers, so once the cooldown has elapsed the breaker lets requests through again.
+	upstreamErr = nil
+	require.Eventually(t, func() bool {
+		return p.PushToStorage(ctx, &mimirpb.WriteRequest{}) == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, p.openBreakers())
+}
+
+func TestTenantCircuitBreakerPusher_ShouldEvictIdleClosedBreakers(t *testing.T) {
+	cfg := KafkaConfig{
+		TenantCircuitBreakerEnabled:          true,
+		TenantCircuitBreakerFailureThreshold: 1,
+		TenantCircuitBreakerCooldownPeriod:   time.Hour,
+		TenantCircuitBreakerIdleTimeout:      time.Minute,
+	}
+
+	// user-1 always fails with a server error, every other tenant succeeds.
+	upstream := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+		userID, err := user.ExtractOrgID(ctx)
+		require.NoError(t, err)
+		if userID == "user-1" {
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		}
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	p := newTenantCircuitBreakerPusher(upstream, cfg, reg, log.NewNopLogger())
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	push := func(userID string) error {
+		return p.PushToStorage(user.InjectOrgID(context.Background(), userID), &mimirpb.WriteRequest{})
+	}
+
+	require.Error(t, push("user-1"))
+	require.NoError(t, push("user-2"))
+	require.NoError(t, push("user-3"))
+
+	// user-3 keeps pushing, while user-1, whose breaker is open, and user-2 stay idle.
+	now = now.Add(30 * time.Second)
+	require.NoError(t, push("user-3"))
+	now = now.Add(time.Minute)
+	require.NoError(t, push("user-3"))
+
+	p.breakersMx.Lock()
+	var tenants []string
+	for userID := range p.breakers {
+		tenants = append(tenants, userID)
+	}
+	p.breakersMx.Unlock()
+	assert.ElementsMatch(t, []string{"user-1", "user-3"}, tenants)
+
+	// The open breaker of user-1 isn't evicted, so its requests still fail fast.
+	assert.ErrorIs(t, push("user-1"), errTenantCircuitBreakerOpen)
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_tenant_circuit_breakers Number of tenants which have a circuit breaker.
+		# TYPE cortex_ingest_storage_reader_tenant_circuit_breakers gauge
+		cortex_ingest_storage_reader_tenant_circuit_breakers 2
+	`), "cortex_ingest_storage_reader_tenant_circuit_breakers"))
+}
@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"errors"
+	"sync"
+
+	"go.uber.org/atomic"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+)
+
+var (
+	errInvalidConcurrency       = errors.New("the ingestion concurrency must be greater than 0")
+	errConcurrencyDisabled      = errors.New("the ingestion concurrency can't be changed because the records are pushed sequentially, with -ingest-storage.kafka.ingestion-concurrency-max set to 0")
+	errInvalidExemplarRateLimit = errors.New("the maximum rate of the exemplars must be greater than 0")
+	errExemplarRateLimitOff     = errors.New("the maximum rate of the exemplars can't be changed because it's unlimited, with -ingest-storage.kafka.ingestion-max-exemplars-per-second set to 0")
+	errIngestionNotTunable      = errors.New("the ingestion of the partition reader can't be tuned because its records aren't pushed to the storage")
+)
+
+// SetConcurrency changes the maximum ingestion concurrency at runtime, overriding IngestionConcurrencyMax, for example
+// to tune the consumption during an incident without restarting. With the relaxed ingestion ordering, the workers of
+// the batch being pushed are resized right away: the new workers start pushing records as soon as they've been added,
+// while the excess workers exit once their in-flight push has completed. With the other orderings, the new concurrency
+// applies from the next batch. The warm-up, if any, still ramps the concurrency up to the new maximum.
+//
+// The concurrency is shared by all the consumers of the PartitionReader. It can't be changed if the records are
+// pushed sequentially, because the pushes of the records would then be reordered.
+func (c pusherConsumer) SetConcurrency(n int) error {
+	return c.concurrency.setChecked(c.kafkaConfig, n)
+}
+
+// SetMaxExemplarsPerSecond changes the maximum rate of the exemplars pushed, overriding IngestionMaxExemplarsPerSecond,
+// starting with the next exemplars pushed. The rate is shared by all the consumers of the PartitionReader. It can't be
+// changed if the rate of the exemplars is unlimited, because the exemplars aren't tracked then.
+func (c pusherConsumer) SetMaxExemplarsPerSecond(limit float64) error {
+	return c.exemplarLimiter.setLimit(limit)
+}
+
+// setLimit changes the maximum rate of the exemplars, and the burst along with it. It returns an error if the limit
+// is invalid, or if the rate of the exemplars is unlimited and l is nil.
+func (l *exemplarRateLimiter) setLimit(limit float64) error {
+	if l == nil {
+		return errExemplarRateLimitOff
+	}
+	if limit <= 0 {
+		return errInvalidExemplarRateLimit
+	}
+	l.limiter.SetLimit(rate.Limit(limit))
+	l.limiter.SetBurst(max(1, int(limit)))
+	return nil
+}
+
+// concurrencyControl holds the ingestion concurrency set at runtime, and notifies its changes. It's shared by all the
+// pusherConsumer instances of a PartitionReader, and safe for concurrent use. A nil *concurrencyControl never
+// overrides the configured concurrency.
+type concurrencyControl struct {
+	// concurrency is the concurrency set at runtime, or 0 if it hasn't been set.
+	concurrency atomic.Int64
+
+	mx sync.Mutex
+	// changed is closed, and replaced, each time the concurrency is set.
+	changed chan struct{}
+}
+
+func newConcurrencyControl() *concurrencyControl {
+	return &concurrencyControl{changed: make(chan struct{})}
+}
+
+// withConcurrencyControl configures the consumer to use the given concurrency control, which is shared by the
+// consumers of a PartitionReader, instead of a concurrency control of its own.
+func withConcurrencyControl(cc *concurrencyControl) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.concurrency = cc
+	}
+}
+
+// setChecked sets the concurrency, or returns an error if it is invalid or can't be changed with cfg.
+func (cc *concurrencyControl) setChecked(cfg KafkaConfig, n int) error {
+	if cfg.IngestionConcurrencyMax == 0 {
+		return errConcurrencyDisabled
+	}
+	if n <= 0 {
+		return errInvalidConcurrency
+	}
+	cc.set(n)
+	return nil
+}
+
+func (cc *concurrencyControl) set(n int) {
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+
+	cc.concurrency.Store(int64(n))
+	close(cc.changed)
+	cc.changed = make(chan struct{})
+}
+
+// get returns the concurrency set at runtime, or the configured one if it hasn't been set.
+func (cc *concurrencyControl) get(configured int) int {
+	if cc == nil {
+		return configured
+	}
+	if n := cc.concurrency.Load(); n > 0 {
+		return int(n)
+	}
+	return configured
+}
+
+// watch returns a channel closed once the concurrency is set next. The channel of a nil *concurrencyControl is never
+// closed.
+func (cc *concurrencyControl) watch() <-chan struct{} {
+	if cc == nil {
+		return nil
+	}
+
+	cc.mx.Lock()
+	defer cc.mx.Unlock()
+	return cc.changed
+}
+
+// resizableWorkers runs the workers of a pool in an errgroup, and resizes the pool while it's running. The worker
+// with the ID i keeps running while i is lower than the current size of the pool, which must be at least 1: the pool
+// grows by starting the workers with the missing IDs once resized, and shrinks by letting the workers with the excess
+// IDs exit as soon as they check it. Once a worker
+// has returned for another reason, because there's no more work or the pool is failing, the pool isn't resized
+// anymore, so that no worker is started once the errgroup may have been waited for.
+type resizableWorkers struct {
+	g      *errgroup.Group
+	size   func() int
+	worker func(exit func() bool) error
+
+	mx       sync.Mutex
+	running  []bool
+	finished bool
+}
+
+// newResizableWorkers returns a pool of workers running worker, whose size is returned by size. Each worker must
+// return once exit returns true, which it should check before picking up new work.
+func newResizableWorkers(g *errgroup.Group, size func() int, worker func(exit func() bool) error) *resizableWorkers {
+	return &resizableWorkers{g: g, size: size, worker: worker}
+}
+
+// resize starts the workers missing from the current size of the pool.
+func (p *resizableWorkers) resize() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.finished {
+		return
+	}
+	size := p.size()
+	for id := 0; id < size; id++ {
+		if id == len(p.running) {
+			p.running = append(p.running, false)
+		}
+		if !p.running[id] {
+			p.running[id] = true
+			p.g.Go(func() error { return p.run(id) })
+		}
+	}
+}
+
+func (p *resizableWorkers) run(id int) error {
+	exited := false
+	err := p.worker(func() bool {
+		p.mx.Lock()
+		defer p.mx.Unlock()
+
+		// The worker exits atomically with the check, so that it's started again if the pool grows back.
+		if id >= p.size() {
+			p.running[id] = false
+			exited = true
+		}
+		return exited
+	})
+
+	if !exited {
+		p.mx.Lock()
+		p.running[id] = false
+		p.finished = true
+		p.mx.Unlock()
+	}
+	return err
+}
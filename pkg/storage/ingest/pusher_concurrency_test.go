@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"golang.org/x/time/rate"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_SetConcurrency(t *testing.T) {
+	var records []record
+	for i := 0; i < 6; i++ {
+		records = append(records, makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}, nil))
+	}
+	newConsumer := func(cfg KafkaConfig, pusher Pusher) *pusherConsumer {
+		return newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+	}
+	nopPusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	t.Run("should reject the invalid concurrencies", func(t *testing.T) {
+		c := newConsumer(KafkaConfig{IngestionConcurrencyMax: 2}, nopPusher)
+		require.ErrorIs(t, c.SetConcurrency(0), errInvalidConcurrency)
+		require.ErrorIs(t, c.SetConcurrency(-1), errInvalidConcurrency)
+		assert.Equal(t, 2, c.ingestionConcurrency())
+
+		require.NoError(t, c.SetConcurrency(5))
+		assert.Equal(t, 5, c.ingestionConcurrency())
+	})
+
+	t.Run("should not change the concurrency if the records are pushed sequentially", func(t *testing.T) {
+		c := newConsumer(KafkaConfig{}, nopPusher)
+		require.ErrorIs(t, c.SetConcurrency(2), errConcurrencyDisabled)
+	})
+
+	t.Run("should add the workers while the batch is being pushed", func(t *testing.T) {
+		var (
+			inflight = atomic.NewInt64(0)
+			release  = make(chan struct{})
+		)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			inflight.Inc()
+			defer inflight.Dec()
+			<-release
+			return nil
+		})
+		c := newConsumer(KafkaConfig{IngestionOrdering: ingestionOrderingRelaxed, IngestionConcurrencyMax: 1}, pusher)
+
+		done := make(chan error)
+		go func() { done <- c.Consume(context.Background(), records) }()
+
+		require.Eventually(t, func() bool { return inflight.Load() == 1 }, time.Second, 5*time.Millisecond)
+		require.NoError(t, c.SetConcurrency(3))
+		require.Eventually(t, func() bool { return inflight.Load() == 3 }, time.Second, 5*time.Millisecond)
+
+		close(release)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("should let the excess workers complete their push and exit", func(t *testing.T) {
+		var (
+			calls         = atomic.NewInt64(0)
+			inflight      = atomic.NewInt64(0)
+			inflightAfter = atomic.NewInt64(0)
+			overlapped    = atomic.NewBool(false)
+			release       = make(chan struct{})
+		)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			if calls.Inc() <= 3 {
+				inflight.Inc()
+				defer inflight.Dec()
+				<-release
+				return nil
+			}
+
+			// The next records are pushed by the remaining worker only.
+			if inflightAfter.Inc() > 1 {
+				overlapped.Store(true)
+			}
+			defer inflightAfter.Dec()
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+		c := newConsumer(KafkaConfig{IngestionOrdering: ingestionOrderingRelaxed, IngestionConcurrencyMax: 3}, pusher)
+
+		done := make(chan error)
+		go func() { done <- c.Consume(context.Background(), records) }()
+
+		require.Eventually(t, func() bool { return inflight.Load() == 3 }, time.Second, 5*time.Millisecond)
+		require.NoError(t, c.SetConcurrency(1))
+
+		// The in-flight pushes aren't dropped.
+		close(release)
+		require.NoError(t, <-done)
+		assert.Equal(t, int64(len(records)), calls.Load())
+		assert.False(t, overlapped.Load())
+	})
+}
+
+func TestPusherConsumer_SetMaxExemplarsPerSecond(t *testing.T) {
+	newConsumer := func(cfg KafkaConfig) *pusherConsumer {
+		return newPusherConsumer(nil, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+	}
+
+	c := newConsumer(KafkaConfig{})
+	require.ErrorIs(t, c.SetMaxExemplarsPerSecond(10), errExemplarRateLimitOff)
+
+	c = newConsumer(KafkaConfig{IngestionMaxExemplarsPerSecond: 10})
+	require.ErrorIs(t, c.SetMaxExemplarsPerSecond(0), errInvalidExemplarRateLimit)
+	assert.Equal(t, rate.Limit(10), c.exemplarLimiter.limiter.Limit())
+
+	require.NoError(t, c.SetMaxExemplarsPerSecond(100))
+	assert.Equal(t, rate.Limit(100), c.exemplarLimiter.limiter.Limit())
+	assert.Equal(t, 100, c.exemplarLimiter.limiter.Burst())
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// redactedLabelValue replaces the values of the labels logged by the failedSeriesLoggingPusher.
+const redactedLabelValue = "<redacted>"
+
+// failedSeriesLoggingPusher is a Pusher middleware which logs the label set of the first series of the write requests
+// the upstream Pusher fails to push with a server error, to give some context about the data which failed. The values
+// of the labels but the metric name are redacted, because they may be sensitive.
+type failedSeriesLoggingPusher struct {
+	upstream Pusher
+	logger   log.Logger
+}
+
+// PushToStorage implements the Pusher interface.
+func (p failedSeriesLoggingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	// The label set is formatted before pushing, because the request may be freed once it's been pushed.
+	var firstSeries string
+	numSeries := len(req.Timeseries)
+	if numSeries > 0 {
+		firstSeries = redactedLabelsString(req.Timeseries[0].Labels)
+	}
+
+	err := p.upstream.PushToStorage(ctx, req)
+	if err != nil && !mimirpb.IsClientError(err) {
+		userID, _ := user.ExtractOrgID(ctx)
+		level.Error(spanlogger.FromContext(ctx, p.logger)).Log("msg", "failed to push write request with a server error", "user", userID, "series", numSeries, "first_series", firstSeries, "err", err)
+	}
+	return err
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+// The series of the raw pushes aren't decoded, so only the size of the write request is logged.
+func (p failedSeriesLoggingPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	err := p.upstream.(RawPusher).PushRawToStorage(ctx, tenantID, content)
+	if err != nil && !mimirpb.IsClientError(err) {
+		level.Error(spanlogger.FromContext(ctx, p.logger)).Log("msg", "failed to push raw write request with a server error", "user", tenantID, "size", len(content), "err", err)
+	}
+	return err
+}
+
+// redactedLabelsString formats the label set like labels.Labels.String, with the values of the labels but the
+// metric name redacted.
+func redactedLabelsString(lbls []mimirpb.LabelAdapter) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range lbls {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		if l.Name == labels.MetricName {
+			b.WriteString(l.Value)
+		} else {
+			b.WriteString(redactedLabelValue)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// logRecordSummary logs the summary of the decoded write request of the record at debug level, once every
+// RecordSummaryLogSampleRate records on average. The values of the labels but the metric name are redacted.
+func (c pusherConsumer) logRecordSummary(ctx context.Context, r parsedRecord, floatSamples, histograms int) {
+	rate := c.kafkaConfig.RecordSummaryLogSampleRate
+	if rate <= 0 || rand.Int64N(rate) != 0 {
+		return
+	}
+
+	// The first and last timestamps are the earliest and latest ones, because the samples may be out of order.
+	exemplars := 0
+	minTs, maxTs := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, ts := range r.Timeseries {
+		exemplars += len(ts.Exemplars)
+		for _, s := range ts.Samples {
+			minTs, maxTs = min(minTs, s.TimestampMs), max(maxTs, s.TimestampMs)
+		}
+		for _, h := range ts.Histograms {
+			minTs, maxTs = min(minTs, h.Timestamp), max(maxTs, h.Timestamp)
+		}
+	}
+	var firstSeries string
+	if len(r.Timeseries) > 0 {
+		firstSeries = redactedLabelsString(r.Timeseries[0].Labels)
+	}
+
+	keyvals := []any{"msg", "sampled record summary", "user", r.tenantID, "offset", r.offset, "size", r.size, "series", len(r.Timeseries), "samples", floatSamples, "histograms", histograms, "exemplars", exemplars, "metadata", len(r.Metadata), "first_series", firstSeries}
+	if floatSamples+histograms > 0 {
+		keyvals = append(keyvals, "first_timestamp", minTs, "last_timestamp", maxTs)
+	}
+	level.Debug(spanlogger.FromContext(ctx, c.logger)).Log(keyvals...)
+}
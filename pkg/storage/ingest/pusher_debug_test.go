@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_LogServerErrorFirstSeries(t *testing.T) {
+	series := mockPreallocTimeseries("http_requests_total")
+	series.Labels = append(series.Labels, mimirpb.LabelAdapter{Name: "user_email", Value: "someone@example.com"})
+	records := []record{makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{series}}, nil)}
+
+	const expectedSeries = `first_series="{__name__=\"http_requests_total\", user_email=\"<redacted>\"}"`
+
+	tests := map[string]struct {
+		enabled     bool
+		pushErr     error
+		expectedLog bool
+	}{
+		"should log the first series of the requests failing with a server error": {
+			enabled:     true,
+			pushErr:     ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error"),
+			expectedLog: true,
+		},
+		"should not log the first series of the requests failing with a client error": {
+			enabled: true,
+			pushErr: ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "sample out of bounds"),
+		},
+		"should not log the first series if disabled": {
+			pushErr: ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error"),
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pusher := pusherFunc(func(_ context.Context, req *mimirpb.WriteRequest) error {
+				// Like the ingester, the request is freed once it's been pushed.
+				mimirpb.ReuseSlice(req.Timeseries)
+				return testData.pushErr
+			})
+
+			logs := &concurrency.SyncBuffer{}
+			cfg := KafkaConfig{LogServerErrorFirstSeries: testData.enabled}
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewLogfmtLogger(logs))
+			_ = c.Consume(context.Background(), records)
+
+			if testData.expectedLog {
+				require.Contains(t, logs.String(), expectedSeries)
+				assert.NotContains(t, logs.String(), "someone@example.com")
+			} else {
+				assert.NotContains(t, logs.String(), "first_series")
+			}
+		})
+	}
+}
+
+func TestPusherConsumer_RecordSummaryLogSampleRate(t *testing.T) {
+	series := mockPreallocTimeseries("http_requests_total")
+	series.Labels = append(series.Labels, mimirpb.LabelAdapter{Name: "user_email", Value: "someone@example.com"})
+	series.Samples = []mimirpb.Sample{{TimestampMs: 20, Value: 1}, {TimestampMs: 10, Value: 2}}
+	series.Histograms = []mimirpb.Histogram{{Timestamp: 30}}
+	records := []record{makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{series, mockPreallocTimeseries("up")}}, nil)}
+
+	for _, rate := range []int64{0, 1} {
+		logs := &concurrency.SyncBuffer{}
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+		c := newPusherConsumer(pusher, KafkaConfig{RecordSummaryLogSampleRate: rate}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewLogfmtLogger(logs))
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		if rate == 0 {
+			assert.NotContains(t, logs.String(), "sampled record summary")
+			continue
+		}
+		assert.Contains(t, logs.String(), `msg="sampled record summary" user=user-1`)
+		assert.Contains(t, logs.String(), `series=2 samples=3 histograms=1 exemplars=0 metadata=0 first_series="{__name__=\"http_requests_total\", user_email=\"<redacted>\"}" first_timestamp=1 last_timestamp=30`)
+		assert.NotContains(t, logs.String(), "someone@example.com")
+	}
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+)
+
+// ConsumeMetricsDeltas are the increments of the core metrics of the consumer produced by a single consume, for the
+// callers aggregating the metrics outside Prometheus. Unlike a ConsumerMetrics, which receives the metrics as they're
+// produced by all the consumes, they're only returned once the consume has returned.
+type ConsumeMetricsDeltas struct {
+	// Records is the number of records whose push has been attempted, including the records split from batches.
+	Records int64
+	// Bytes is the total size of the content of these records, as read from Kafka.
+	Bytes int64
+	// Requests is the number of write requests attempted to be pushed to the storage.
+	Requests int64
+	// FailedRequests is the number of write requests which failed to be pushed to the storage, keyed by the cause of
+	// their failure, which is either one of the FailureCause constants or a cause registered with RegisterFailureCause.
+	// It's nil if no request failed.
+	FailedRequests map[string]int64
+	// ProcessingTime is the time taken to process the records.
+	ProcessingTime time.Duration
+}
+
+// ConsumeWithMetricsDeltas is like Consume, but it also returns the increments of the core metrics produced by the
+// consume, whether it's succeeded or not. The metrics are still reported to the Prometheus metrics, or to the
+// ConsumerMetrics configured with WithConsumerMetrics. The increments are only tracked by this method, so that the
+// other consumes don't pay for them.
+func (c pusherConsumer) ConsumeWithMetricsDeltas(ctx context.Context, records []record) (ConsumeMetricsDeltas, error) {
+	c.deltas = &consumeDeltas{}
+	err := c.Consume(ctx, records)
+	return c.deltas.snapshot(), err
+}
+
+// consumeDeltas accumulates the increments of the core metrics produced by a consume. It's safe for concurrent use.
+// A nil *consumeDeltas accumulates nothing.
+type consumeDeltas struct {
+	mx     sync.Mutex
+	deltas ConsumeMetricsDeltas
+}
+
+// record adds a record of the given size whose push is attempted.
+func (d *consumeDeltas) record(size int) {
+	if d == nil {
+		return
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.deltas.Records++
+	d.deltas.Bytes += int64(size)
+}
+
+func (d *consumeDeltas) snapshot() ConsumeMetricsDeltas {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	deltas := d.deltas
+	deltas.FailedRequests = maps.Clone(d.deltas.FailedRequests)
+	return deltas
+}
+
+// deltaRecordingMetrics is a ConsumerMetrics middleware which also adds the metrics to the deltas of a consume.
+type deltaRecordingMetrics struct {
+	ConsumerMetrics
+	deltas *consumeDeltas
+}
+
+func (m deltaRecordingMetrics) IncTotal() {
+	m.ConsumerMetrics.IncTotal()
+
+	m.deltas.mx.Lock()
+	defer m.deltas.mx.Unlock()
+	m.deltas.deltas.Requests++
+}
+
+func (m deltaRecordingMetrics) IncFailed(cause string) {
+	m.ConsumerMetrics.IncFailed(cause)
+
+	m.deltas.mx.Lock()
+	defer m.deltas.mx.Unlock()
+	if m.deltas.deltas.FailedRequests == nil {
+		m.deltas.deltas.FailedRequests = map[string]int64{}
+	}
+	m.deltas.deltas.FailedRequests[failureCauses.normalize(cause)]++
+}
+
+func (m deltaRecordingMetrics) ObserveProcessing(d time.Duration) {
+	m.ConsumerMetrics.ObserveProcessing(d)
+
+	m.deltas.mx.Lock()
+	defer m.deltas.mx.Unlock()
+	// A consume may be split into several consumes, each observing its processing time.
+	m.deltas.deltas.ProcessingTime += d
+}
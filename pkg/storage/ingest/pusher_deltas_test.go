@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_ConsumeWithMetricsDeltas(t *testing.T) {
+	newRecord := func(metricName string) record {
+		return makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+	}
+	records := []record{newRecord("series_1"), newRecord("bad_series"), newRecord("series_2")}
+	expectedBytes := int64(0)
+	for _, r := range records {
+		expectedBytes += int64(len(r.content))
+	}
+
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		if request.Timeseries[0].Labels[0].Value == "bad_series" {
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "bad data")
+		}
+		return nil
+	})
+
+	for _, batchMetrics := range []bool{false, true} {
+		c := newPusherConsumer(pusher, KafkaConfig{IngestionBatchMetrics: batchMetrics}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+		deltas, err := c.ConsumeWithMetricsDeltas(context.Background(), records)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), deltas.Records)
+		assert.Equal(t, expectedBytes, deltas.Bytes)
+		assert.Equal(t, int64(3), deltas.Requests)
+		assert.Equal(t, map[string]int64{FailureCauseClient: 1}, deltas.FailedRequests)
+		assert.Positive(t, deltas.ProcessingTime)
+
+		// The deltas only cover a single consume.
+		deltas, err = c.ConsumeWithMetricsDeltas(context.Background(), records[:1])
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), deltas.Records)
+		assert.Equal(t, int64(1), deltas.Requests)
+		assert.Nil(t, deltas.FailedRequests)
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// reasonDeniedMetric is the reason of the series dropped because their metric name is denied by the tenant's limits.
+const reasonDeniedMetric = "denied_metric"
+
+// metricDenylist is the compiled metric denylist of a tenant.
+type metricDenylist struct {
+	// names and pattern are the limits the denylist has been compiled from.
+	names   []string
+	pattern string
+
+	denied map[string]struct{}
+	regex  *labels.FastRegexMatcher
+}
+
+func newMetricDenylist(names []string, pattern string) *metricDenylist {
+	d := &metricDenylist{
+		names:   slices.Clone(names),
+		pattern: pattern,
+		denied:  make(map[string]struct{}, len(names)),
+	}
+	for _, name := range names {
+		d.denied[name] = struct{}{}
+	}
+	if pattern != "" {
+		// The regex is validated when the limits are loaded, so it can't fail to compile here.
+		d.regex, _ = labels.NewFastRegexMatcher(pattern)
+	}
+	return d
+}
+
+// isDenied returns whether the series of the metric name should be dropped.
+func (d *metricDenylist) isDenied(name string) bool {
+	if _, ok := d.denied[name]; ok {
+		return true
+	}
+	return d.regex != nil && d.regex.MatchString(name)
+}
+
+// metricDenylists caches the compiled metric denylists of the tenants, which are recompiled whenever the tenant's
+// limits change, so that the changes of the runtime config are applied without restarting. It's safe for concurrent use.
+//
+// The metricDenylists is shared by all the pusherConsumer instances of a PartitionReader, so that the denylists
+// aren't recompiled for each batch.
+type metricDenylists struct {
+	limits TenantLimits
+
+	mx      sync.Mutex
+	tenants map[string]*metricDenylist
+}
+
+func newMetricDenylists(limits TenantLimits) *metricDenylists {
+	return &metricDenylists{limits: limits, tenants: map[string]*metricDenylist{}}
+}
+
+// enabled returns whether the tenant has a metric denylist.
+func (d *metricDenylists) enabled(tenantID string) bool {
+	return len(d.limits.IngestStorageDeniedMetricNames(tenantID)) > 0 || d.limits.IngestStorageDeniedMetricNamesRegex(tenantID) != ""
+}
+
+// get returns the compiled metric denylist of the tenant, or nil if the tenant has none.
+func (d *metricDenylists) get(tenantID string) *metricDenylist {
+	names, pattern := d.limits.IngestStorageDeniedMetricNames(tenantID), d.limits.IngestStorageDeniedMetricNamesRegex(tenantID)
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if len(names) == 0 && pattern == "" {
+		delete(d.tenants, tenantID)
+		return nil
+	}
+
+	denylist, ok := d.tenants[tenantID]
+	if !ok || denylist.pattern != pattern || !slices.Equal(denylist.names, names) {
+		denylist = newMetricDenylist(names, pattern)
+		d.tenants[tenantID] = denylist
+	}
+	return denylist
+}
+
+// dropDeniedSeries removes the series whose metric name is denied by the tenant's metric denylist from the request,
+// and returns how many have been removed. The metadata of the denied metrics is kept.
+func (d *metricDenylists) dropDeniedSeries(tenantID string, req *mimirpb.WriteRequest) int {
+	denylist := d.get(tenantID)
+	if denylist == nil {
+		return 0
+	}
+
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		if denylist.isDenied(metricName(ts.Labels)) {
+			mimirpb.ReusePreallocTimeseries(&ts)
+			continue
+		}
+		kept = append(kept, ts)
+	}
+	dropped := len(req.Timeseries) - len(kept)
+
+	// Don't keep references to the removed series, which have been returned to the pool.
+	clear(req.Timeseries[len(kept):])
+	req.Timeseries = kept
+
+	return dropped
+}
+
+// metricName returns the value of the metric name label, or an empty string if there's none.
+func metricName(lbls []mimirpb.LabelAdapter) string {
+	for _, l := range lbls {
+		if l.Name == labels.MetricName {
+			return l.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_MetricDenylist(t *testing.T) {
+	newRecord := func(tenantID string) record {
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{
+			Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("up"), mockPreallocTimeseries("debug_requests"), mockPreallocTimeseries("debug_errors"), mockPreallocTimeseries("http_requests")},
+			Metadata:   []*mimirpb.MetricMetadata{{MetricFamilyName: "debug_requests", Help: "help"}},
+		}, nil)
+	}
+
+	var tenantLimits map[string]*validation.Limits
+	limits := validation.MockOverrides(func(_ *validation.Limits, l map[string]*validation.Limits) {
+		tenantLimits = l
+		tenantLimits["names"] = validation.MockDefaultLimits()
+		tenantLimits["names"].IngestStorageDeniedMetricNames = []string{"debug_requests", "http_requests"}
+		tenantLimits["regex"] = validation.MockDefaultLimits()
+		tenantLimits["regex"].IngestStorageDeniedMetricNamesRegex = "debug_.*"
+		tenantLimits["both"] = validation.MockDefaultLimits()
+		tenantLimits["both"].IngestStorageDeniedMetricNames = []string{"up"}
+		tenantLimits["both"].IngestStorageDeniedMetricNamesRegex = "debug_.*"
+	})
+
+	var (
+		pushedMx sync.Mutex
+		pushed   map[string][]string
+	)
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := tenant.TenantID(ctx)
+		require.NoError(t, err)
+
+		// The metadata of the denied metrics is kept.
+		require.Len(t, request.Metadata, 1)
+
+		pushedMx.Lock()
+		defer pushedMx.Unlock()
+		for _, ts := range request.Timeseries {
+			pushed[tenantID] = append(pushed[tenantID], metricName(ts.Labels))
+		}
+		return nil
+	})
+
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	denylists := newMetricDenylists(limits)
+	consume := func() {
+		pushed = map[string][]string{}
+		c := newPusherConsumer(pusher, KafkaConfig{}, limits, metrics, log.NewNopLogger(), withMetricDenylists(denylists))
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("names"), newRecord("regex"), newRecord("both"), newRecord("none")}))
+	}
+
+	consume()
+	assert.Equal(t, map[string][]string{
+		"names": {"up", "debug_errors"},
+		"regex": {"up", "http_requests"},
+		"both":  {"http_requests"},
+		"none":  {"up", "debug_requests", "debug_errors", "http_requests"},
+	}, pushed)
+	assert.Equal(t, float64(7), testutil.ToFloat64(metrics.droppedSeries.WithLabelValues(reasonDeniedMetric)))
+
+	// The changes of the limits are applied to the next records.
+	tenantLimits["names"].IngestStorageDeniedMetricNames = []string{"up"}
+	tenantLimits["regex"].IngestStorageDeniedMetricNamesRegex = "(up|debug_errors)"
+	delete(tenantLimits, "both")
+
+	consume()
+	assert.Equal(t, map[string][]string{
+		"names": {"debug_requests", "debug_errors", "http_requests"},
+		"regex": {"debug_requests", "http_requests"},
+		"both":  {"up", "debug_requests", "debug_errors", "http_requests"},
+		"none":  {"up", "debug_requests", "debug_errors", "http_requests"},
+	}, pushed)
+	assert.Equal(t, float64(10), testutil.ToFloat64(metrics.droppedSeries.WithLabelValues(reasonDeniedMetric)))
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"time"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// Downsampler down-samples in place the samples and histograms of each series of the write request to the interval,
+// and returns how many samples and histograms have been removed. It must keep every series of the write request,
+// with its labels unchanged, and at least one of its samples or histograms if it has any, so that each series is
+// still ingested. It's only called for the tenants down-sampled with -ingest-storage.downsample-interval.
+type Downsampler func(req *mimirpb.WriteRequest, interval time.Duration) int
+
+// WithDownsampler configures the consumer to down-sample the write requests of the tenants with a down-sample
+// interval with the downsampler, instead of KeepFirstPerInterval.
+func WithDownsampler(downsampler Downsampler) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.downsampler = downsampler
+	}
+}
+
+// KeepFirstPerInterval is the default Downsampler. It keeps the first sample and the first histogram of each series in
+// each interval, aligned to the Unix epoch, and removes the others. The float samples and the histograms are
+// down-sampled separately. The counter reset hint of each histogram kept after removed ones is reset to unknown,
+// unless the histogram is a gauge histogram, because the counter resets of the removed histograms would be missed.
+func KeepFirstPerInterval(req *mimirpb.WriteRequest, interval time.Duration) int {
+	intervalMs := interval.Milliseconds()
+	if intervalMs <= 0 {
+		return 0
+	}
+
+	removed := 0
+	for i := range req.Timeseries {
+		ts := req.Timeseries[i].TimeSeries
+
+		var samplesRemoved, histogramsRemoved int
+		ts.Samples, samplesRemoved = keepFirstPerInterval(ts.Samples, func(s mimirpb.Sample) int64 { return s.TimestampMs }, intervalMs, nil)
+		ts.Histograms, histogramsRemoved = keepFirstPerInterval(ts.Histograms, func(h mimirpb.Histogram) int64 { return h.Timestamp }, intervalMs, func(h *mimirpb.Histogram) {
+			if h.ResetHint != mimirpb.Histogram_GAUGE {
+				h.ResetHint = mimirpb.Histogram_UNKNOWN
+			}
+		})
+		if samplesRemoved+histogramsRemoved > 0 {
+			// The cached size of the series isn't valid anymore.
+			req.Timeseries[i].HistogramsUpdated()
+			removed += samplesRemoved + histogramsRemoved
+		}
+	}
+	return removed
+}
+
+// keepFirstPerInterval removes in place the items in the same interval as a previous item, and returns the kept items
+// and how many have been removed. If not nil, afterRemoved is called with each item kept after removed items.
+func keepFirstPerInterval[T any](items []T, timestamp func(T) int64, intervalMs int64, afterRemoved func(*T)) ([]T, int) {
+	bucket := func(item T) int64 {
+		// The intervals of the timestamps before the Unix epoch are floored too.
+		b := timestamp(item) / intervalMs
+		if timestamp(item)%intervalMs < 0 {
+			b--
+		}
+		return b
+	}
+
+	kept := items[:0]
+	seen := make(map[int64]struct{}, len(items))
+	removedSinceKept := false
+	for _, item := range items {
+		b := bucket(item)
+		if _, ok := seen[b]; ok {
+			removedSinceKept = true
+			continue
+		}
+		seen[b] = struct{}{}
+		kept = append(kept, item)
+		if removedSinceKept && afterRemoved != nil {
+			afterRemoved(&kept[len(kept)-1])
+		}
+		removedSinceKept = false
+	}
+	return kept, len(items) - len(kept)
+}
+
+// downsample down-samples the write request of tenantID to the tenant's down-sample interval, if any.
+func (c pusherConsumer) downsample(tenantID string, req *mimirpb.WriteRequest) {
+	interval := c.limits.IngestStorageDownsampleInterval(tenantID)
+	if interval <= 0 {
+		return
+	}
+
+	downsampler := c.downsampler
+	if downsampler == nil {
+		downsampler = KeepFirstPerInterval
+	}
+	if removed := downsampler(req, interval); removed > 0 {
+		c.metrics.downsampledSamples.Add(float64(removed))
+	}
+}
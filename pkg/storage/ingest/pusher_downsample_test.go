@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestKeepFirstPerInterval(t *testing.T) {
+	req := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{
+		{TimeSeries: &mimirpb.TimeSeries{
+			Labels:  []mimirpb.LabelAdapter{{Name: "__name__", Value: "floats"}},
+			Samples: []mimirpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 5000, Value: 2}, {TimestampMs: 12000, Value: 3}, {TimestampMs: 9999, Value: 4}, {TimestampMs: -1, Value: 5}},
+		}},
+		{TimeSeries: &mimirpb.TimeSeries{
+			Labels: []mimirpb.LabelAdapter{{Name: "__name__", Value: "histograms"}},
+			Histograms: []mimirpb.Histogram{
+				{Timestamp: 1000, ResetHint: mimirpb.Histogram_NO},
+				{Timestamp: 2000, ResetHint: mimirpb.Histogram_YES},
+				{Timestamp: 11000, ResetHint: mimirpb.Histogram_NO},
+				{Timestamp: 21000, ResetHint: mimirpb.Histogram_NO},
+			},
+		}},
+		{TimeSeries: &mimirpb.TimeSeries{
+			Labels:     []mimirpb.LabelAdapter{{Name: "__name__", Value: "gauge_histograms"}},
+			Histograms: []mimirpb.Histogram{{Timestamp: 1000, ResetHint: mimirpb.Histogram_GAUGE}, {Timestamp: 2000, ResetHint: mimirpb.Histogram_GAUGE}, {Timestamp: 11000, ResetHint: mimirpb.Histogram_GAUGE}},
+		}},
+		{TimeSeries: &mimirpb.TimeSeries{
+			Labels:  []mimirpb.LabelAdapter{{Name: "__name__", Value: "single"}},
+			Samples: []mimirpb.Sample{{TimestampMs: 1000, Value: 1}},
+		}},
+	}}
+
+	assert.Equal(t, 4, KeepFirstPerInterval(req, 10*time.Second))
+
+	require.Len(t, req.Timeseries, 4)
+	assert.Equal(t, []mimirpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 12000, Value: 3}, {TimestampMs: -1, Value: 5}}, req.Timeseries[0].Samples)
+	// The counter reset hint of the histograms kept after removed ones is reset, because the removed ones could have
+	// been counter resets.
+	assert.Equal(t, []mimirpb.Histogram{
+		{Timestamp: 1000, ResetHint: mimirpb.Histogram_NO},
+		{Timestamp: 11000, ResetHint: mimirpb.Histogram_UNKNOWN},
+		{Timestamp: 21000, ResetHint: mimirpb.Histogram_NO},
+	}, req.Timeseries[1].Histograms)
+	assert.Equal(t, []mimirpb.Histogram{{Timestamp: 1000, ResetHint: mimirpb.Histogram_GAUGE}, {Timestamp: 11000, ResetHint: mimirpb.Histogram_GAUGE}}, req.Timeseries[2].Histograms)
+	assert.Equal(t, []mimirpb.Sample{{TimestampMs: 1000, Value: 1}}, req.Timeseries[3].Samples)
+}
+
+func TestPusherConsumer_Downsample(t *testing.T) {
+	newRecord := func(tenantID string) record {
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{{TimeSeries: &mimirpb.TimeSeries{
+			Labels:    []mimirpb.LabelAdapter{{Name: "__name__", Value: "series_1"}},
+			Samples:   []mimirpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}, {TimestampMs: 61000, Value: 3}},
+			Exemplars: []mimirpb.Exemplar{},
+		}}}}, nil)
+	}
+
+	limits := validation.MockOverrides(func(_ *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		tenantLimits["backfill"] = validation.MockDefaultLimits()
+		tenantLimits["backfill"].IngestStorageDownsampleInterval = model.Duration(time.Minute)
+	})
+
+	var pushed map[string][]mimirpb.Sample
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := tenant.TenantID(ctx)
+		require.NoError(t, err)
+		pushed[tenantID] = append(pushed[tenantID], request.Timeseries[0].Samples...)
+		return nil
+	})
+
+	t.Run("should down-sample the samples of the tenants with a down-sample interval", func(t *testing.T) {
+		pushed = map[string][]mimirpb.Sample{}
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, limits, metrics, log.NewNopLogger())
+
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("backfill"), newRecord("user-1")}))
+		assert.Equal(t, []mimirpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 61000, Value: 3}}, pushed["backfill"])
+		assert.Len(t, pushed["user-1"], 3)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.downsampledSamples))
+	})
+
+	t.Run("should down-sample with the custom downsampler", func(t *testing.T) {
+		pushed = map[string][]mimirpb.Sample{}
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		var intervals []time.Duration
+		keepLast := func(req *mimirpb.WriteRequest, interval time.Duration) int {
+			intervals = append(intervals, interval)
+			ts := req.Timeseries[0].TimeSeries
+			removed := len(ts.Samples) - 1
+			ts.Samples = ts.Samples[len(ts.Samples)-1:]
+			return removed
+		}
+		c := newPusherConsumer(pusher, KafkaConfig{}, limits, metrics, log.NewNopLogger(), WithDownsampler(keepLast))
+
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("backfill"), newRecord("user-1")}))
+		assert.Equal(t, []mimirpb.Sample{{TimestampMs: 61000, Value: 3}}, pushed["backfill"])
+		assert.Len(t, pushed["user-1"], 3)
+		assert.Equal(t, []time.Duration{time.Minute}, intervals)
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.downsampledSamples))
+	})
+}
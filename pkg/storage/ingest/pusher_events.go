@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// IngestionEvent reports that records of a tenant have been ingested, for the downstream pipelines reacting to the
+// ingestion instead of polling the storage.
+type IngestionEvent struct {
+	// Partition is the partition the records have been read from.
+	Partition int32
+	// TenantID is the tenant the records have been pushed as, which is the remapped tenant if a TenantRemapper is
+	// configured.
+	TenantID string
+	// Records is the number of records of the tenant which have been ingested, including the records split from
+	// batches.
+	Records int
+	// MinOffset and MaxOffset are the lowest and the highest offsets of these records in the partition.
+	MinOffset int64
+	MaxOffset int64
+	// Timestamp is the time the consume having ingested the records has completed.
+	Timestamp time.Time
+}
+
+// EventPublisher publishes the ingestion events to a message bus.
+type EventPublisher interface {
+	// PublishIngestionEvents publishes the events of a consumed batch of records, one per tenant. It's called by a
+	// background goroutine, one call at a time, so it can block on I/O. Its errors are logged and counted, and the
+	// events are dropped.
+	PublishIngestionEvents(ctx context.Context, events []IngestionEvent) error
+}
+
+// WithEventPublisher configures the PartitionReader to publish an IngestionEvent per tenant with the publisher once
+// each batch of records has been successfully consumed. The events are published in the background, buffering the
+// events of up to bufferSize batches, so that a slow publisher doesn't slow down the consumption: the events of the
+// batches consumed while the buffer is full are dropped and counted. The events of a batch whose consumption fails
+// aren't published, and they're published once the batch has been retried successfully.
+//
+// The events are only published by the PartitionReader created with NewPartitionReaderForPusher.
+func WithEventPublisher(publisher EventPublisher, bufferSize int) PartitionReaderOption {
+	return func(r *PartitionReader) {
+		r.eventPublisher = publisher
+		r.eventBufferSize = bufferSize
+	}
+}
+
+// withIngestionEvents configures the consumer to publish the ingestion events of its batches.
+func withIngestionEvents(e *ingestionEvents) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.ingestionEvents = e
+	}
+}
+
+// ingestionEvents publishes the ingestion events of a partition with an EventPublisher, from a background goroutine
+// reading the events from a buffered channel. The events left in the channel are published when it's stopped.
+// It's shared by all the pusherConsumer instances of a PartitionReader, which starts and stops it.
+type ingestionEvents struct {
+	services.Service
+
+	publisher EventPublisher
+	partition int32
+	logger    log.Logger
+	events    chan []IngestionEvent
+
+	published prometheus.Counter
+	failed    prometheus.Counter
+	dropped   prometheus.Counter
+}
+
+func newIngestionEvents(publisher EventPublisher, bufferSize int, partition int32, logger log.Logger, reg prometheus.Registerer) *ingestionEvents {
+	e := &ingestionEvents{
+		publisher: publisher,
+		partition: partition,
+		logger:    logger,
+		events:    make(chan []IngestionEvent, max(bufferSize, 0)),
+		published: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_ingestion_events_published_total",
+			Help: "Number of ingestion events of the records read from Kafka which have been published.",
+		}),
+		failed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_ingestion_events_failed_total",
+			Help: "Number of ingestion events of the records read from Kafka which failed to be published.",
+		}),
+		dropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_ingestion_events_dropped_total",
+			Help: "Number of ingestion events of the records read from Kafka which have been dropped because the buffer of the events to publish was full.",
+		}),
+	}
+	e.Service = services.NewBasicService(nil, e.running, e.stopping)
+	return e
+}
+
+// enqueue buffers the events to be published, without blocking. The events are dropped if the buffer is full.
+func (e *ingestionEvents) enqueue(events []IngestionEvent) {
+	if e == nil || len(events) == 0 {
+		return
+	}
+
+	for i := range events {
+		events[i].Partition = e.partition
+	}
+	select {
+	case e.events <- events:
+	default:
+		e.dropped.Add(float64(len(events)))
+	}
+}
+
+func (e *ingestionEvents) running(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case events := <-e.events:
+			e.publish(ctx, events)
+		}
+	}
+}
+
+func (e *ingestionEvents) stopping(_ error) error {
+	// The events buffered are published once the consumption has stopped, without the cancellation of running.
+	for {
+		select {
+		case events := <-e.events:
+			e.publish(context.Background(), events)
+		default:
+			return nil
+		}
+	}
+}
+
+func (e *ingestionEvents) publish(ctx context.Context, events []IngestionEvent) {
+	if err := e.publisher.PublishIngestionEvents(ctx, events); err != nil {
+		e.failed.Add(float64(len(events)))
+		level.Warn(e.logger).Log("msg", "failed to publish ingestion events", "events", len(events), "err", err)
+		return
+	}
+	e.published.Add(float64(len(events)))
+}
+
+// ingestionEventBuffer accumulates the records pushed by each tenant while consuming a batch. It's safe for concurrent
+// use. A nil *ingestionEventBuffer is a no-op.
+type ingestionEventBuffer struct {
+	mx      sync.Mutex
+	events  []IngestionEvent
+	tenants map[string]int
+}
+
+func (b *ingestionEventBuffer) add(r parsedRecord) {
+	if b == nil {
+		return
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	i, ok := b.tenants[r.tenantID]
+	if !ok {
+		if b.tenants == nil {
+			b.tenants = map[string]int{}
+		}
+		i = len(b.events)
+		b.tenants[r.tenantID] = i
+		b.events = append(b.events, IngestionEvent{TenantID: r.tenantID, MinOffset: r.offset, MaxOffset: r.offset})
+	}
+
+	ev := &b.events[i]
+	ev.Records++
+	ev.MinOffset = min(ev.MinOffset, r.offset)
+	ev.MaxOffset = max(ev.MaxOffset, r.offset)
+}
+
+// flush enqueues an event per tenant, in the order the tenants have first been pushed, if any.
+func (b *ingestionEventBuffer) flush(e *ingestionEvents) {
+	if b == nil {
+		return
+	}
+
+	now := time.Now()
+	for i := range b.events {
+		b.events[i].Timestamp = now
+	}
+	e.enqueue(b.events)
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// eventPublisherFunc is an EventPublisher which calls the function for each batch of events.
+type eventPublisherFunc func(context.Context, []IngestionEvent) error
+
+func (f eventPublisherFunc) PublishIngestionEvents(ctx context.Context, events []IngestionEvent) error {
+	return f(ctx, events)
+}
+
+func TestPusherConsumer_WithIngestionEvents(t *testing.T) {
+	newRecord := func(tenantID, metricName string, offset int64) record {
+		r := makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+		r.offset = offset
+		return r
+	}
+	records := []record{newRecord("user-1", "series_1", 10), newRecord("user-2", "series_2", 11), newRecord("user-1", "series_3", 12)}
+
+	var pushErr error
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		return pushErr
+	})
+	events := newIngestionEvents(eventPublisherFunc(func(context.Context, []IngestionEvent) error { return nil }), 1, 3, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), withIngestionEvents(events))
+
+	t.Run("should enqueue an event per tenant once the batch has been consumed", func(t *testing.T) {
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		require.Len(t, events.events, 1)
+		enqueued := <-events.events
+		require.Len(t, enqueued, 2)
+		for _, ev := range enqueued {
+			assert.Equal(t, int32(3), ev.Partition)
+			assert.WithinDuration(t, time.Now(), ev.Timestamp, time.Minute)
+		}
+		assert.Equal(t, IngestionEvent{Partition: 3, TenantID: "user-1", Records: 2, MinOffset: 10, MaxOffset: 12, Timestamp: enqueued[0].Timestamp}, enqueued[0])
+		assert.Equal(t, IngestionEvent{Partition: 3, TenantID: "user-2", Records: 1, MinOffset: 11, MaxOffset: 11, Timestamp: enqueued[1].Timestamp}, enqueued[1])
+	})
+
+	t.Run("should drop the events once the buffer is full", func(t *testing.T) {
+		require.NoError(t, c.Consume(context.Background(), records))
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		assert.Len(t, events.events, 1)
+		assert.Equal(t, float64(2), testutil.ToFloat64(events.dropped))
+		<-events.events
+	})
+
+	t.Run("should not enqueue any event if the batch fails", func(t *testing.T) {
+		pushErr = ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		t.Cleanup(func() { pushErr = nil })
+
+		require.Error(t, c.Consume(context.Background(), records))
+		assert.Empty(t, events.events)
+	})
+}
+
+func TestIngestionEvents_Publish(t *testing.T) {
+	var (
+		mx        sync.Mutex
+		published []IngestionEvent
+	)
+	publisher := eventPublisherFunc(func(_ context.Context, events []IngestionEvent) error {
+		if events[0].TenantID == "failing" {
+			return fmt.Errorf("bus unavailable")
+		}
+		mx.Lock()
+		defer mx.Unlock()
+		published = append(published, events...)
+		return nil
+	})
+
+	events := newIngestionEvents(publisher, 10, 1, log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), events))
+
+	events.enqueue([]IngestionEvent{{TenantID: "user-1", Records: 1}})
+	events.enqueue([]IngestionEvent{{TenantID: "failing", Records: 1}, {TenantID: "user-3", Records: 1}})
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(events.published) == 1 && testutil.ToFloat64(events.failed) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// The events buffered when stopping are published.
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), events))
+	events.enqueue([]IngestionEvent{{TenantID: "user-2", Records: 1}})
+	require.NoError(t, events.stopping(nil))
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, []IngestionEvent{{Partition: 1, TenantID: "user-1", Records: 1}, {Partition: 1, TenantID: "user-2", Records: 1}}, published)
+}
@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// exemplarRateLimiter limits the rate of the exemplars pushed to the storage, to protect the exemplar storage from
+// bursts of exemplars independently of the samples. The exemplars exceeding the rate are dropped, while the samples
+// of the same write requests are pushed. It's shared by the consumers of a PartitionReader, and safe for concurrent use.
+// A nil *exemplarRateLimiter limits nothing.
+type exemplarRateLimiter struct {
+	limiter *rate.Limiter
+	limited prometheus.Counter
+
+	// The rate of the exemplars is measured over windows of at least a second, and exported once each window ends.
+	rate        prometheus.Gauge
+	mx          sync.Mutex
+	windowStart time.Time
+	windowCount int
+}
+
+// newExemplarRateLimiter returns the exemplarRateLimiter configured by cfg, or nil if the rate is unlimited.
+func newExemplarRateLimiter(cfg KafkaConfig, metrics *pusherConsumerMetrics) *exemplarRateLimiter {
+	if cfg.IngestionMaxExemplarsPerSecond <= 0 {
+		return nil
+	}
+	limit := cfg.IngestionMaxExemplarsPerSecond
+	return &exemplarRateLimiter{
+		limiter:     rate.NewLimiter(rate.Limit(limit), max(1, int(limit))),
+		limited:     metrics.exemplarsRateLimited,
+		rate:        metrics.exemplarsPerSecond,
+		windowStart: time.Now(),
+	}
+}
+
+// withExemplarRateLimiter configures the consumer to use the given limiter, which is shared by the consumers of a
+// PartitionReader, instead of a limiter of its own.
+func withExemplarRateLimiter(l *exemplarRateLimiter) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.exemplarLimiter = l
+	}
+}
+
+// limit drops the exemplars of the write request exceeding the rate. The first exemplars of each series are kept.
+func (l *exemplarRateLimiter) limit(req *mimirpb.WriteRequest) {
+	if l == nil {
+		return
+	}
+
+	now := time.Now()
+	total, limited := 0, 0
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		n := len(ts.Exemplars)
+		if n == 0 {
+			continue
+		}
+		total += n
+
+		kept := 0
+		for kept < n && l.limiter.AllowN(now, 1) {
+			kept++
+		}
+		if kept < n {
+			limited += n - kept
+			ts.ResizeExemplars(kept)
+		}
+	}
+	l.limited.Add(float64(limited))
+	l.observe(now, total)
+}
+
+// observe adds the exemplars to the current window, and exports the rate of the window once it's ended.
+func (l *exemplarRateLimiter) observe(now time.Time, exemplars int) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.windowCount += exemplars
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		l.rate.Set(float64(l.windowCount) / elapsed.Seconds())
+		l.windowStart = now
+		l.windowCount = 0
+	}
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_MaxExemplarsPerSecond(t *testing.T) {
+	newRecord := func(metricName string) record {
+		return makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseriesWithExemplar(metricName)}}, nil)
+	}
+	records := []record{newRecord("series_1"), newRecord("series_2"), newRecord("series_3")}
+
+	var samples, exemplars []int
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		samples = append(samples, len(request.Timeseries[0].Samples))
+		exemplars = append(exemplars, len(request.Timeseries[0].Exemplars))
+		return nil
+	})
+
+	t.Run("should drop the exemplars exceeding the rate while pushing the samples", func(t *testing.T) {
+		samples, exemplars = nil, nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+
+		// The burst allows a single exemplar, and the next one is only allowed after a long time.
+		c := newPusherConsumer(pusher, KafkaConfig{IngestionMaxExemplarsPerSecond: 0.001}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		assert.Equal(t, []int{1, 1, 1}, samples)
+		assert.Equal(t, []int{1, 0, 0}, exemplars)
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.exemplarsRateLimited))
+	})
+
+	t.Run("should push all the exemplars if the rate is unlimited", func(t *testing.T) {
+		samples, exemplars = nil, nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		assert.Equal(t, []int{1, 1, 1}, exemplars)
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.exemplarsRateLimited))
+	})
+}
+
+func TestExemplarRateLimiter_Rate(t *testing.T) {
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	l := newExemplarRateLimiter(KafkaConfig{IngestionMaxExemplarsPerSecond: 10}, metrics)
+	start := l.windowStart
+
+	// The rate is only exported once the window has ended.
+	l.observe(start.Add(500*time.Millisecond), 30)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.exemplarsPerSecond))
+
+	l.observe(start.Add(2*time.Second), 10)
+	assert.Equal(t, float64(20), testutil.ToFloat64(metrics.exemplarsPerSecond))
+
+	// The next window starts when the previous one has ended.
+	l.observe(start.Add(6*time.Second), 8)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.exemplarsPerSecond))
+}
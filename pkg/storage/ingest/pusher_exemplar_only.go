@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/globalerror"
+)
+
+// reasonExemplarOnly is the reason of the records skipped because they have exemplars but no samples nor histograms.
+const reasonExemplarOnly = "exemplar_only"
+
+// isExemplarOnly returns whether the request has exemplars, but no samples nor histograms.
+func isExemplarOnly(req *mimirpb.WriteRequest) bool {
+	if floatSamples, histograms := countSamples(req); floatSamples > 0 || histograms > 0 {
+		return false
+	}
+	for _, ts := range req.Timeseries {
+		if len(ts.Exemplars) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExemplarOnlyRecord handles the request of a record with exemplars but no samples nor histograms, which the
+// storage may reject, according to the configured behavior: it's pushed as usual, its series are dropped along with
+// their exemplars, or a client error is returned so that the whole record is skipped. Its metadata is kept when its
+// series are dropped.
+func (c pusherConsumer) checkExemplarOnlyRecord(req *mimirpb.WriteRequest) error {
+	if !isExemplarOnly(req) {
+		return nil
+	}
+	behavior := c.kafkaConfig.IngestionExemplarOnlyRecordsBehavior
+	if behavior == "" {
+		behavior = exemplarOnlyRecordsPush
+	}
+	c.metrics.exemplarOnlyRecords.WithLabelValues(behavior).Inc()
+
+	switch behavior {
+	case exemplarOnlyRecordsDropExemplars:
+		// The series have no samples, so they're left empty once their exemplars are dropped.
+		for i := range req.Timeseries {
+			mimirpb.ReusePreallocTimeseries(&req.Timeseries[i])
+		}
+		clear(req.Timeseries)
+		req.Timeseries = req.Timeseries[:0]
+	case exemplarOnlyRecordsSkip:
+		err := errors.New("the record has exemplars but no samples nor histograms")
+		return globalerror.WrapErrorWithGRPCStatus(err, codes.InvalidArgument, &mimirpb.ErrorDetails{Cause: mimirpb.BAD_DATA})
+	}
+	return nil
+}
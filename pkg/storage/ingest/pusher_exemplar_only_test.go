@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_ExemplarOnlyRecords(t *testing.T) {
+	newExemplarOnlyRecord := func() record {
+		ts := mockPreallocTimeseriesWithExemplar("exemplar_only")
+		ts.Samples = nil
+		return makeRecord(t, "user-1", &mimirpb.WriteRequest{
+			Timeseries: []mimirpb.PreallocTimeseries{ts},
+			Metadata:   []*mimirpb.MetricMetadata{{MetricFamilyName: "exemplar_only", Type: mimirpb.COUNTER}},
+		}, nil)
+	}
+	newRecord := func() record {
+		return makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseriesWithExemplar("series_1")}}, nil)
+	}
+
+	tests := map[string]struct {
+		behavior         string
+		expectedSeries   []string
+		expectedMetadata int
+		expectedRejected float64
+	}{
+		"should push the records as-is by default": {
+			behavior:         "",
+			expectedSeries:   []string{"exemplar_only", "series_1"},
+			expectedMetadata: 1,
+		},
+		"should drop the exemplars of the records": {
+			behavior:         exemplarOnlyRecordsDropExemplars,
+			expectedSeries:   []string{"series_1"},
+			expectedMetadata: 1,
+		},
+		"should skip the records": {
+			behavior:         exemplarOnlyRecordsSkip,
+			expectedSeries:   []string{"series_1"},
+			expectedRejected: 1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var (
+				pushedSeries   []string
+				pushedMetadata int
+			)
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				for _, ts := range request.Timeseries {
+					pushedSeries = append(pushedSeries, metricName(ts.Labels))
+					// The exemplars of the records with samples are left untouched.
+					assert.NotEmpty(t, ts.Exemplars)
+				}
+				pushedMetadata += len(request.Metadata)
+				return nil
+			})
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			cfg := KafkaConfig{IngestionExemplarOnlyRecordsBehavior: tc.behavior}
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+			require.NoError(t, c.Consume(context.Background(), []record{newExemplarOnlyRecord(), newRecord()}))
+			assert.Equal(t, tc.expectedSeries, pushedSeries)
+			assert.Equal(t, tc.expectedMetadata, pushedMetadata)
+			assert.Equal(t, tc.expectedRejected, testutil.ToFloat64(metrics.rejectedRecords.WithLabelValues(reasonExemplarOnly)))
+
+			expectedAction := tc.behavior
+			if expectedAction == "" {
+				expectedAction = exemplarOnlyRecordsPush
+			}
+			assert.Equal(t, 1, testutil.CollectAndCount(metrics.exemplarOnlyRecords))
+			assert.Equal(t, float64(1), testutil.ToFloat64(metrics.exemplarOnlyRecords.WithLabelValues(expectedAction)))
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// healthTrackingPusher is a Pusher middleware that tracks the outcome of the most recent pushes, to report the
+// consumer as unhealthy when the ratio of server errors among them exceeds the configured threshold.
+//
+// The window is count based: it holds the outcomes of the last windowSize pushes, regardless of when they happened.
+// The ratio isn't evaluated until the window has been filled, to avoid reporting the consumer as unhealthy
+// because of a few errors right after startup.
+type healthTrackingPusher struct {
+	upstream  Pusher
+	threshold float64
+
+	mx           sync.Mutex
+	outcomes     []bool // true for server errors.
+	next         int
+	filled       bool
+	serverErrors int
+}
+
+func newHealthTrackingPusher(upstream Pusher, threshold float64, windowSize int, reg prometheus.Registerer) *healthTrackingPusher {
+	p := &healthTrackingPusher{
+		upstream:  upstream,
+		threshold: threshold,
+		outcomes:  make([]bool, windowSize),
+	}
+
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_ingest_storage_reader_recent_server_error_ratio",
+		Help: "Ratio of server errors among the most recent pushes of the records read from Kafka to the storage.",
+	}, func() float64 {
+		ratio, _ := p.serverErrorRatio()
+		return ratio
+	})
+
+	return p
+}
+
+// PushToStorage implements the Pusher interface.
+func (p *healthTrackingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	return p.track(p.upstream.PushToStorage(ctx, req))
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+func (p *healthTrackingPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	return p.track(p.upstream.(RawPusher).PushRawToStorage(ctx, tenantID, content))
+}
+
+// track records the outcome of a push, and returns its error.
+func (p *healthTrackingPusher) track(err error) error {
+	// A canceled push says nothing about the health of the storage, so we don't track it.
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	p.record(err != nil && !mimirpb.IsClientError(err))
+	return err
+}
+
+func (p *healthTrackingPusher) record(serverError bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.outcomes[p.next] {
+		p.serverErrors--
+	}
+	p.outcomes[p.next] = serverError
+	if serverError {
+		p.serverErrors++
+	}
+
+	p.next++
+	if p.next == len(p.outcomes) {
+		p.next = 0
+		p.filled = true
+	}
+}
+
+// serverErrorRatio returns the ratio of server errors among the tracked pushes, and whether the window is full.
+func (p *healthTrackingPusher) serverErrorRatio() (float64, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	total := p.next
+	if p.filled {
+		total = len(p.outcomes)
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(p.serverErrors) / float64(total), p.filled
+}
+
+// checkHealth returns an error if the ratio of server errors among the most recent pushes exceeds the threshold.
+func (p *healthTrackingPusher) checkHealth() error {
+	ratio, filled := p.serverErrorRatio()
+	if filled && ratio > p.threshold {
+		return fmt.Errorf("the ratio of server errors among the last %d pushes to the storage is %.2f, above the threshold of %.2f", len(p.outcomes), ratio, p.threshold)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+func TestHealthTrackingPusher(t *testing.T) {
+	var nextErr error
+	upstream := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		return nextErr
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	p := newHealthTrackingPusher(upstream, 0.5, 4, reg)
+
+	push := func(err error) {
+		nextErr = err
+		assert.Equal(t, err, p.PushToStorage(context.Background(), &mimirpb.WriteRequest{}))
+	}
+
+	serverErr := ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+	clientErr := ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+
+	// The consumer is healthy until the window has been filled, even if all the pushes failed.
+	push(serverErr)
+	push(serverErr)
+	push(serverErr)
+	require.NoError(t, p.checkHealth())
+
+	push(serverErr)
+	require.EqualError(t, p.checkHealth(), "the ratio of server errors among the last 4 pushes to the storage is 1.00, above the threshold of 0.50")
+
+	// Client errors and canceled pushes don't count as server errors.
+	push(nil)
+	push(clientErr)
+	push(context.Canceled)
+	require.NoError(t, p.checkHealth())
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_recent_server_error_ratio Ratio of server errors among the most recent pushes of the records read from Kafka to the storage.
+		# TYPE cortex_ingest_storage_reader_recent_server_error_ratio gauge
+		cortex_ingest_storage_reader_recent_server_error_ratio 0.5
+	`)))
+
+	// The oldest outcomes slide out of the window.
+	push(nil)
+	push(nil)
+	require.NoError(t, p.checkHealth())
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_recent_server_error_ratio Ratio of server errors among the most recent pushes of the records read from Kafka to the storage.
+		# TYPE cortex_ingest_storage_reader_recent_server_error_ratio gauge
+		cortex_ingest_storage_reader_recent_server_error_ratio 0
+	`)))
+}
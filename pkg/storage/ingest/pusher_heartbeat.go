@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// consumerHeartbeat pushes a synthetic series for a designated tenant after each successfully consumed batch of
+// records, whose value is the time the batch has been consumed at. Alerting on the staleness of the series detects
+// a stalled consumer even when no records are written to the partition. A nil *consumerHeartbeat is a no-op.
+type consumerHeartbeat struct {
+	pusher     Pusher
+	tenantID   string
+	metricName string
+	partition  string
+	logger     log.Logger
+	failures   prometheus.Counter
+
+	// now is the function returning the current time, replaceable in tests.
+	now func() time.Time
+}
+
+// newConsumerHeartbeat returns a consumerHeartbeat pushing to pusher, or nil if no heartbeat tenant is configured.
+func newConsumerHeartbeat(cfg KafkaConfig, partitionID int32, pusher Pusher, metrics *pusherConsumerMetrics, logger log.Logger) *consumerHeartbeat {
+	if cfg.HeartbeatTenant == "" {
+		return nil
+	}
+	return &consumerHeartbeat{
+		pusher:     pusher,
+		tenantID:   cfg.HeartbeatTenant,
+		metricName: cfg.HeartbeatMetricName,
+		partition:  strconv.Itoa(int(partitionID)),
+		logger:     logger,
+		failures:   metrics.heartbeatFailures,
+		now:        time.Now,
+	}
+}
+
+// push pushes the heartbeat sample. A failure is logged and counted, but it doesn't fail the consumption,
+// because the records of the batch have been consumed anyway.
+func (h *consumerHeartbeat) push(ctx context.Context) {
+	if h == nil {
+		return
+	}
+
+	// The request is built from scratch each time, because the storage may return its slices to the pools once pushed.
+	now := h.now()
+	req := &mimirpb.WriteRequest{
+		Timeseries: []mimirpb.PreallocTimeseries{{TimeSeries: &mimirpb.TimeSeries{
+			Labels:  []mimirpb.LabelAdapter{{Name: labels.MetricName, Value: h.metricName}, {Name: "partition", Value: h.partition}},
+			Samples: []mimirpb.Sample{{TimestampMs: now.UnixMilli(), Value: float64(now.UnixMilli()) / 1000}},
+		}}},
+		Source: mimirpb.API,
+	}
+
+	if err := h.pusher.PushToStorage(user.InjectOrgID(ctx, h.tenantID), req); err != nil {
+		h.failures.Inc()
+		level.Warn(spanlogger.FromContext(ctx, h.logger)).Log("msg", "failed to push the consumer heartbeat", "user", h.tenantID, "err", err)
+	}
+}
+
+// withConsumerHeartbeat configures the consumer to push the heartbeat after each successfully consumed batch.
+func withConsumerHeartbeat(h *consumerHeartbeat) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.heartbeat = h
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_Heartbeat(t *testing.T) {
+	records := []record{makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)}
+
+	cfg := KafkaConfig{HeartbeatTenant: "heartbeat", HeartbeatMetricName: "consumer_heartbeat"}
+	now := time.UnixMilli(1_700_000_000_500)
+
+	type push struct {
+		tenantID string
+		series   mimirpb.TimeSeries
+	}
+
+	tests := map[string]struct {
+		recordsErr        error
+		heartbeatErr      error
+		expectedErr       string
+		expectedHeartbeat bool
+		expectedFailures  int
+	}{
+		"should push the heartbeat once the batch has been consumed": {
+			expectedHeartbeat: true,
+		},
+		"should not push the heartbeat if the batch failed to be consumed": {
+			recordsErr:  errors.New("storage unavailable"),
+			expectedErr: "storage unavailable",
+		},
+		"should not fail the consumption if the heartbeat failed to be pushed": {
+			heartbeatErr:      errors.New("storage unavailable"),
+			expectedHeartbeat: true,
+			expectedFailures:  1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var (
+				mx         sync.Mutex
+				heartbeats []push
+			)
+			pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+				tenantID, err := user.ExtractOrgID(ctx)
+				require.NoError(t, err)
+				if tenantID != cfg.HeartbeatTenant {
+					return testData.recordsErr
+				}
+
+				mx.Lock()
+				defer mx.Unlock()
+				heartbeats = append(heartbeats, push{tenantID: tenantID, series: *request.Timeseries[0].TimeSeries})
+				return testData.heartbeatErr
+			})
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			heartbeat := newConsumerHeartbeat(cfg, 3, pusher, metrics, log.NewNopLogger())
+			heartbeat.now = func() time.Time { return now }
+
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), withConsumerHeartbeat(heartbeat))
+			err := c.Consume(context.Background(), records)
+			if testData.expectedErr != "" {
+				require.ErrorContains(t, err, testData.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			if !testData.expectedHeartbeat {
+				assert.Empty(t, heartbeats)
+				return
+			}
+			require.Len(t, heartbeats, 1)
+			assert.Equal(t, []mimirpb.LabelAdapter{{Name: "__name__", Value: "consumer_heartbeat"}, {Name: "partition", Value: "3"}}, heartbeats[0].series.Labels)
+			assert.Equal(t, []mimirpb.Sample{{TimestampMs: now.UnixMilli(), Value: 1_700_000_000.5}}, heartbeats[0].series.Samples)
+			assert.Equal(t, float64(testData.expectedFailures), testutil.ToFloat64(metrics.heartbeatFailures))
+		})
+	}
+}
+
+func TestNewConsumerHeartbeat(t *testing.T) {
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	assert.Nil(t, newConsumerHeartbeat(KafkaConfig{}, 1, nil, metrics, log.NewNopLogger()))
+
+	// A nil heartbeat is a no-op.
+	var heartbeat *consumerHeartbeat
+	heartbeat.push(context.Background())
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// IdempotencyTokenHeader is the header of the records holding their idempotency token, for example the producer ID and
+// the sequence number of the record. The records with the same token as a record consumed recently are skipped when
+// -ingest-storage.kafka.idempotency-tokens-max-size is set.
+const IdempotencyTokenHeader = "idempotency-token"
+
+// reasonIdempotentSkip is the reason of the records skipped because a record with the same idempotency token has
+// already been consumed.
+const reasonIdempotentSkip = "idempotent_skip"
+
+// idempotencyToken returns the idempotency token of the record, or an empty string if it has none.
+func idempotencyToken(rec *kgo.Record) string {
+	for _, h := range rec.Headers {
+		if h.Key == IdempotencyTokenHeader {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// withIdempotencyTokens configures the consumer to skip the records whose token is in the tokens, shared by the
+// consumers of a partition so that the duplicates are skipped across batches.
+func withIdempotencyTokens(tokens *idempotencyTokens) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.idempotencyTokens = tokens
+	}
+}
+
+// consumeIdempotently consumes the records, skipping the ones whose idempotency token is the token of a record already
+// consumed, either in a previous batch or earlier in this one. The tokens of the records are only kept once they've
+// been consumed, so that the records are consumed again if the consumption fails.
+func (c pusherConsumer) consumeIdempotently(ctx context.Context, records []record) error {
+	var (
+		now     = time.Now()
+		pending = map[string]struct{}{}
+		kept    = make([]record, 0, len(records))
+	)
+	for i, r := range records {
+		if r.idempotencyToken == "" {
+			kept = append(kept, r)
+			continue
+		}
+
+		_, duplicate := pending[r.idempotencyToken]
+		if duplicate || c.idempotencyTokens.contains(r.idempotencyToken, now) {
+			c.metrics.rejectedRecords.WithLabelValues(reasonIdempotentSkip).Inc()
+			RecordFailure(c.metrics.storagePusherMetrics.backend, FailureCauseDuplicate)
+			c.sendOutcome(parsedRecord{ctx: r.ctx, tenantID: r.tenantID, index: i, offset: r.offset, timestamp: r.timestamp}, reasonIdempotentSkip, nil)
+			c.markProcessed(r.offset)
+			continue
+		}
+		pending[r.idempotencyToken] = struct{}{}
+		kept = append(kept, r)
+	}
+
+	err := c.consumeRecords(ctx, kept)
+
+	// The records not attempted because the consume duration has been exceeded are consumed again later.
+	var unprocessed *unprocessedRecordsError
+	if errors.As(err, &unprocessed) {
+		for _, r := range unprocessed.records {
+			delete(pending, r.idempotencyToken)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	c.idempotencyTokens.add(pending, time.Now())
+	return err
+}
+
+// idempotencyTokens is a bounded set of the idempotency tokens of the records consumed recently. The oldest tokens
+// are evicted once the maximum number of tokens is reached, and the tokens expire after the TTL, if greater than 0.
+// It's safe for concurrent use.
+type idempotencyTokens struct {
+	maxSize int
+	ttl     time.Duration
+
+	mx sync.Mutex
+	// order holds the tokens from the oldest to the newest, and entries their element in order.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type idempotencyTokenEntry struct {
+	token string
+	added time.Time
+}
+
+// newIdempotencyTokens returns the idempotency tokens, or nil if maxSize is 0.
+func newIdempotencyTokens(maxSize int, ttl time.Duration) *idempotencyTokens {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &idempotencyTokens{
+		maxSize: maxSize,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, maxSize),
+	}
+}
+
+// contains returns whether the token has been added and hasn't expired at now.
+func (t *idempotencyTokens) contains(token string, now time.Time) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	e, ok := t.entries[token]
+	if !ok {
+		return false
+	}
+	if t.expired(e.Value.(idempotencyTokenEntry), now) {
+		t.order.Remove(e)
+		delete(t.entries, token)
+		return false
+	}
+	return true
+}
+
+// add adds the tokens at now, evicting the expired tokens and then the oldest ones beyond the maximum number of tokens.
+func (t *idempotencyTokens) add(tokens map[string]struct{}, now time.Time) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	for token := range tokens {
+		if e, ok := t.entries[token]; ok {
+			e.Value = idempotencyTokenEntry{token: token, added: now}
+			t.order.MoveToBack(e)
+			continue
+		}
+		t.entries[token] = t.order.PushBack(idempotencyTokenEntry{token: token, added: now})
+	}
+
+	for e := t.order.Front(); e != nil && (t.order.Len() > t.maxSize || t.expired(e.Value.(idempotencyTokenEntry), now)); e = t.order.Front() {
+		t.order.Remove(e)
+		delete(t.entries, e.Value.(idempotencyTokenEntry).token)
+	}
+}
+
+func (t *idempotencyTokens) expired(e idempotencyTokenEntry, now time.Time) bool {
+	return t.ttl > 0 && now.Sub(e.added) >= t.ttl
+}
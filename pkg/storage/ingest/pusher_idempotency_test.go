@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestIdempotencyToken(t *testing.T) {
+	assert.Equal(t, "", idempotencyToken(&kgo.Record{}))
+	assert.Equal(t, "producer-1/2", idempotencyToken(&kgo.Record{Headers: []kgo.RecordHeader{
+		{Key: "other", Value: []byte("value")},
+		{Key: IdempotencyTokenHeader, Value: []byte("producer-1/2")},
+	}}))
+}
+
+func TestIdempotencyTokens(t *testing.T) {
+	now := time.Now()
+
+	t.Run("should evict the oldest tokens beyond the maximum number of tokens", func(t *testing.T) {
+		tokens := newIdempotencyTokens(2, 0)
+		tokens.add(map[string]struct{}{"a": {}}, now)
+		tokens.add(map[string]struct{}{"b": {}}, now.Add(time.Second))
+		tokens.add(map[string]struct{}{"c": {}}, now.Add(2*time.Second))
+
+		assert.False(t, tokens.contains("a", now.Add(3*time.Second)))
+		assert.True(t, tokens.contains("b", now.Add(3*time.Second)))
+		assert.True(t, tokens.contains("c", now.Add(3*time.Second)))
+	})
+
+	t.Run("should refresh the tokens added again", func(t *testing.T) {
+		tokens := newIdempotencyTokens(2, 0)
+		tokens.add(map[string]struct{}{"a": {}}, now)
+		tokens.add(map[string]struct{}{"b": {}}, now.Add(time.Second))
+		tokens.add(map[string]struct{}{"a": {}}, now.Add(2*time.Second))
+		tokens.add(map[string]struct{}{"c": {}}, now.Add(3*time.Second))
+
+		assert.True(t, tokens.contains("a", now.Add(4*time.Second)))
+		assert.False(t, tokens.contains("b", now.Add(4*time.Second)))
+		assert.True(t, tokens.contains("c", now.Add(4*time.Second)))
+	})
+
+	t.Run("should expire the tokens after the TTL", func(t *testing.T) {
+		tokens := newIdempotencyTokens(10, time.Minute)
+		tokens.add(map[string]struct{}{"a": {}}, now)
+
+		assert.True(t, tokens.contains("a", now.Add(59*time.Second)))
+		assert.False(t, tokens.contains("a", now.Add(time.Minute)))
+		assert.Empty(t, tokens.entries)
+	})
+
+	t.Run("should be disabled with a maximum of 0 tokens", func(t *testing.T) {
+		assert.Nil(t, newIdempotencyTokens(0, time.Minute))
+	})
+}
+
+func TestPusherConsumer_IdempotencyTokens(t *testing.T) {
+	newRecord := func(metricName string, offset int64, token string) record {
+		r := makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+		r.offset = offset
+		r.idempotencyToken = token
+		return r
+	}
+
+	var (
+		pushed  []string
+		pushErr error
+	)
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		if pushErr != nil {
+			return pushErr
+		}
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{IdempotencyTokensMaxSize: 10}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+	// The duplicates are skipped within a batch, and the records without token are never skipped.
+	lastProcessed, err := c.ConsumeWithLastProcessedOffset(context.Background(), []record{
+		newRecord("series_1", 1, "token-1"),
+		newRecord("series_2", 2, "token-1"),
+		newRecord("series_3", 3, ""),
+		newRecord("series_4", 4, ""),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"series_1", "series_3", "series_4"}, pushed)
+	assert.Equal(t, int64(4), lastProcessed)
+
+	// The tokens of a batch which failed to be consumed aren't kept, so its records are consumed again.
+	pushed = nil
+	pushErr = errors.New("server error")
+	require.Error(t, c.Consume(context.Background(), []record{newRecord("series_5", 5, "token-2")}))
+	pushErr = nil
+
+	// The duplicates are skipped across batches.
+	require.NoError(t, c.Consume(context.Background(), []record{
+		newRecord("series_6", 6, "token-1"),
+		newRecord("series_5", 5, "token-2"),
+	}))
+	assert.Equal(t, []string{"series_5"}, pushed)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.rejectedRecords.WithLabelValues(reasonIdempotentSkip)))
+}
@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// inflightPushes tracks when the pushes to the storage which haven't completed yet have started, to report the age of
+// the oldest one. A steadily rising age reveals a push which hangs. It's safe for concurrent use.
+type inflightPushes struct {
+	mx sync.Mutex
+	// starts holds the start of each in-flight push, from the oldest to the newest. The pushes start in order, because
+	// their start is taken while holding the lock, so the oldest push is always the front one.
+	starts *list.List
+}
+
+func newInflightPushes() *inflightPushes {
+	return &inflightPushes{starts: list.New()}
+}
+
+// start records that a push has started, and returns the function to call once it has completed.
+func (p *inflightPushes) start() (done func()) {
+	p.mx.Lock()
+	e := p.starts.PushBack(time.Now())
+	p.mx.Unlock()
+
+	return func() {
+		p.mx.Lock()
+		p.starts.Remove(e)
+		p.mx.Unlock()
+	}
+}
+
+// oldestAge returns how long ago the oldest in-flight push has started, or 0 if there's no push in flight.
+func (p *inflightPushes) oldestAge() time.Duration {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	oldest := p.starts.Front()
+	if oldest == nil {
+		return 0
+	}
+	return time.Since(oldest.Value.(time.Time))
+}
+
+// inflightTrackingPusher is a Pusher middleware which tracks the pushes to the upstream Pusher while they're in flight.
+type inflightTrackingPusher struct {
+	upstream Pusher
+	inflight *inflightPushes
+}
+
+// PushToStorage implements the Pusher interface.
+func (p inflightTrackingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	defer p.inflight.start()()
+	return p.upstream.PushToStorage(ctx, req)
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+func (p inflightTrackingPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	defer p.inflight.start()()
+	return p.upstream.(RawPusher).PushRawToStorage(ctx, tenantID, content)
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestInflightPushes(t *testing.T) {
+	p := newInflightPushes()
+	assert.Equal(t, time.Duration(0), p.oldestAge())
+
+	doneFirst := p.start()
+	time.Sleep(20 * time.Millisecond)
+	doneSecond := p.start()
+	assert.GreaterOrEqual(t, p.oldestAge(), 20*time.Millisecond)
+
+	// Once the oldest push has completed, the next one becomes the oldest.
+	doneFirst()
+	assert.Less(t, p.oldestAge(), 20*time.Millisecond)
+
+	doneSecond()
+	assert.Equal(t, time.Duration(0), p.oldestAge())
+}
+
+func TestPusherConsumer_OldestInflightPushAge(t *testing.T) {
+	const metricName = "cortex_ingest_storage_reader_oldest_inflight_push_age_seconds"
+	gatherAge := func(t *testing.T, reg *prometheus.Registry) float64 {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == metricName {
+				return family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		require.Fail(t, "metric not found", metricName)
+		return 0
+	}
+
+	started, unblock := make(chan struct{}), make(chan struct{})
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		close(started)
+		<-unblock
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+
+	done := make(chan error)
+	go func() {
+		done <- c.Consume(context.Background(), []record{makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)})
+	}()
+
+	// The age rises while the push hangs.
+	<-started
+	time.Sleep(20 * time.Millisecond)
+	assert.GreaterOrEqual(t, gatherAge(t, reg), (20 * time.Millisecond).Seconds())
+
+	close(unblock)
+	require.NoError(t, <-done)
+	assert.Equal(t, float64(0), gatherAge(t, reg))
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/globalerror"
+)
+
+// reasonMissingRequiredLabel is the reason of the series dropped, or the records rejected, because they're missing
+// labels required by the tenant's limits.
+const reasonMissingRequiredLabel = "missing_required_label"
+
+// injectLabels injects the tenant's injected labels into every series of the request, and returns the number of series
+// whose labels have changed. The labels a series already has are only replaced if the tenant's limits require so.
+func (c pusherConsumer) injectLabels(tenantID string, req *mimirpb.WriteRequest) int {
+	injected := c.limits.IngestStorageInjectedLabels(tenantID)
+	if len(injected) == 0 {
+		return 0
+	}
+	overwrite := c.limits.IngestStorageInjectedLabelsOverwrite(tenantID)
+
+	changed := 0
+	for i := range req.Timeseries {
+		// The labels are searched by name, so they must be sorted. They usually are, in which case they're left as is.
+		req.Timeseries[i].SortLabelsIfNeeded()
+
+		lbls := req.Timeseries[i].Labels
+		seriesChanged := false
+		for _, l := range injected {
+			// The injected labels are validated when the limits are loaded, so they're always name=value pairs.
+			name, value, _ := strings.Cut(l, "=")
+			if injectLabel(&lbls, name, value, overwrite) {
+				seriesChanged = true
+			}
+		}
+
+		if seriesChanged {
+			req.Timeseries[i].SetLabels(lbls)
+			changed++
+		}
+	}
+	return changed
+}
+
+// injectLabel adds the label to the labels, which must be sorted by name, and keeps them sorted. If there's already a
+// label with the same name, its value is only replaced if overwrite. It returns whether the labels have changed.
+func injectLabel(lbls *[]mimirpb.LabelAdapter, name, value string, overwrite bool) bool {
+	i, found := findLabel(*lbls, name)
+	if found {
+		if !overwrite || (*lbls)[i].Value == value {
+			return false
+		}
+		(*lbls)[i].Value = value
+		return true
+	}
+
+	*lbls = slices.Insert(*lbls, i, mimirpb.LabelAdapter{Name: name, Value: value})
+	return true
+}
+
+// checkRequiredLabels looks for the series missing any of the tenant's required labels. Depending on the tenant's
+// limits, those series are dropped, or an error is returned if the record must be rejected because of them.
+func (c pusherConsumer) checkRequiredLabels(tenantID string, req *mimirpb.WriteRequest) error {
+	required := c.limits.IngestStorageRequiredLabels(tenantID)
+	if len(required) == 0 {
+		return nil
+	}
+
+	if !c.limits.IngestStorageRejectMissingRequiredLabels(tenantID) {
+		kept := req.Timeseries[:0]
+		for _, ts := range req.Timeseries {
+			if !hasLabels(ts.Labels, required) {
+				mimirpb.ReusePreallocTimeseries(&ts)
+				continue
+			}
+			kept = append(kept, ts)
+		}
+		if dropped := len(req.Timeseries) - len(kept); dropped > 0 {
+			c.metrics.droppedSeries.WithLabelValues(reasonMissingRequiredLabel).Add(float64(dropped))
+		}
+
+		// Don't keep references to the removed series, which have been returned to the pool.
+		clear(req.Timeseries[len(kept):])
+		req.Timeseries = kept
+		return nil
+	}
+
+	missing := 0
+	for _, ts := range req.Timeseries {
+		if !hasLabels(ts.Labels, required) {
+			missing++
+		}
+	}
+	if missing == 0 {
+		return nil
+	}
+
+	err := fmt.Errorf("%d series are missing any of the required labels %s", missing, strings.Join(required, ", "))
+	return globalerror.WrapErrorWithGRPCStatus(err, codes.InvalidArgument, &mimirpb.ErrorDetails{Cause: mimirpb.BAD_DATA})
+}
+
+// hasLabels returns whether the labels have all the names. The labels are scanned in place, because they may not be
+// sorted by name, so that no label set nor map has to be built for each series.
+func hasLabels(lbls []mimirpb.LabelAdapter, names []string) bool {
+	for _, name := range names {
+		if !slices.ContainsFunc(lbls, func(l mimirpb.LabelAdapter) bool { return l.Name == name }) {
+			return false
+		}
+	}
+	return true
+}
+
+// findLabel returns the position of the label with the name in the labels, which must be sorted by name, or the
+// position it should be inserted at, and whether it's been found.
+func findLabel(lbls []mimirpb.LabelAdapter, name string) (int, bool) {
+	return slices.BinarySearchFunc(lbls, name, func(l mimirpb.LabelAdapter, name string) int {
+		return strings.Compare(l.Name, name)
+	})
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_InjectedLabels(t *testing.T) {
+	newRecord := func(tenantID string, unsorted bool) record {
+		withSource := mockPreallocTimeseries("up")
+		withSource.Labels = append(withSource.Labels, mimirpb.LabelAdapter{Name: "source", Value: "original"})
+		if unsorted {
+			slices.Reverse(withSource.Labels)
+		}
+
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{
+			Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("http_requests"), withSource},
+		}, nil)
+	}
+
+	limits := validation.MockOverrides(func(_ *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		tenantLimits["skip"] = validation.MockDefaultLimits()
+		tenantLimits["skip"].IngestStorageInjectedLabels = []string{"__ingest_source__=kafka", "source=injected"}
+		tenantLimits["overwrite"] = validation.MockDefaultLimits()
+		tenantLimits["overwrite"].IngestStorageInjectedLabels = []string{"__ingest_source__=kafka", "source=injected"}
+		tenantLimits["overwrite"].IngestStorageInjectedLabelsConflict = "overwrite"
+		tenantLimits["overwrite-same"] = validation.MockDefaultLimits()
+		tenantLimits["overwrite-same"].IngestStorageInjectedLabels = []string{"source=original"}
+		tenantLimits["overwrite-same"].IngestStorageInjectedLabelsConflict = "overwrite"
+	})
+
+	var (
+		pushedMx sync.Mutex
+		pushed   map[string][]string
+	)
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := tenant.TenantID(ctx)
+		require.NoError(t, err)
+
+		// The size of the request must account for the injected labels.
+		marshalled, err := request.Marshal()
+		require.NoError(t, err)
+		require.Equal(t, len(marshalled), request.Size())
+
+		pushedMx.Lock()
+		defer pushedMx.Unlock()
+		for _, ts := range request.Timeseries {
+			pushed[tenantID] = append(pushed[tenantID], mimirpb.FromLabelAdaptersToLabels(ts.Labels).String())
+		}
+		return nil
+	})
+
+	tests := map[string]struct {
+		tenantID         string
+		unsorted         bool
+		expectedSeries   []string
+		expectedInjected int
+	}{
+		"should not change the series if no labels are injected": {
+			tenantID:       "user-1",
+			expectedSeries: []string{`{__name__="http_requests"}`, `{__name__="up", source="original"}`},
+		},
+		"should keep the labels the series already have": {
+			tenantID: "skip",
+			expectedSeries: []string{
+				`{__ingest_source__="kafka", __name__="http_requests", source="injected"}`,
+				`{__ingest_source__="kafka", __name__="up", source="original"}`,
+			},
+			expectedInjected: 2,
+		},
+		"should overwrite the labels the series already have": {
+			tenantID: "overwrite",
+			expectedSeries: []string{
+				`{__ingest_source__="kafka", __name__="http_requests", source="injected"}`,
+				`{__ingest_source__="kafka", __name__="up", source="injected"}`,
+			},
+			expectedInjected: 2,
+		},
+		"should not count the series whose labels haven't changed": {
+			tenantID: "overwrite-same",
+			expectedSeries: []string{
+				`{__name__="http_requests", source="original"}`,
+				`{__name__="up", source="original"}`,
+			},
+			expectedInjected: 1,
+		},
+		"should keep the labels the series already have if they're not sorted": {
+			tenantID: "skip",
+			unsorted: true,
+			expectedSeries: []string{
+				`{__ingest_source__="kafka", __name__="http_requests", source="injected"}`,
+				`{__ingest_source__="kafka", __name__="up", source="original"}`,
+			},
+			expectedInjected: 2,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pushed = map[string][]string{}
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, KafkaConfig{}, limits, metrics, log.NewNopLogger())
+
+			require.NoError(t, c.Consume(context.Background(), []record{newRecord(testData.tenantID, testData.unsorted)}))
+			assert.Equal(t, testData.expectedSeries, pushed[testData.tenantID])
+			assert.Equal(t, float64(testData.expectedInjected), testutil.ToFloat64(metrics.injectedLabelsSeries))
+		})
+	}
+}
+
+func TestPusherConsumer_RequiredLabels(t *testing.T) {
+	newSeries := func(metricName string, extraLabels ...string) mimirpb.PreallocTimeseries {
+		series := mockPreallocTimeseries(metricName)
+		for i := 0; i < len(extraLabels); i += 2 {
+			series.Labels = append(series.Labels, mimirpb.LabelAdapter{Name: extraLabels[i], Value: extraLabels[i+1]})
+		}
+		return series
+	}
+	newRecord := func(tenantID string) record {
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{
+			Timeseries: []mimirpb.PreallocTimeseries{
+				newSeries("compliant", "cluster", "eu", "namespace", "default"),
+				newSeries("no_namespace", "cluster", "eu"),
+				newSeries("no_labels"),
+				// The labels of the series aren't necessarily sorted.
+				newSeries("unsorted", "namespace", "default", "cluster", "eu"),
+			},
+		}, nil)
+	}
+
+	limits := validation.MockOverrides(func(_ *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		tenantLimits["drop"] = validation.MockDefaultLimits()
+		tenantLimits["drop"].IngestStorageRequiredLabels = []string{"cluster", "namespace"}
+		tenantLimits["reject"] = validation.MockDefaultLimits()
+		tenantLimits["reject"].IngestStorageRequiredLabels = []string{"cluster", "namespace"}
+		tenantLimits["reject"].IngestStorageMissingRequiredLabels = "reject"
+		tenantLimits["injected"] = validation.MockDefaultLimits()
+		tenantLimits["injected"].IngestStorageRequiredLabels = []string{"cluster"}
+		tenantLimits["injected"].IngestStorageInjectedLabels = []string{"cluster=us"}
+	})
+
+	var (
+		pushedMx sync.Mutex
+		pushed   map[string][]string
+	)
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := tenant.TenantID(ctx)
+		require.NoError(t, err)
+
+		pushedMx.Lock()
+		defer pushedMx.Unlock()
+		for _, ts := range request.Timeseries {
+			pushed[tenantID] = append(pushed[tenantID], metricName(ts.Labels))
+		}
+		return nil
+	})
+
+	tests := map[string]struct {
+		tenantID         string
+		expectedSeries   []string
+		expectedDropped  int
+		expectedRejected int
+	}{
+		"should push all the series if no labels are required": {
+			tenantID:       "user-1",
+			expectedSeries: []string{"compliant", "no_namespace", "no_labels", "unsorted"},
+		},
+		"should drop the series missing required labels": {
+			tenantID:        "drop",
+			expectedSeries:  []string{"compliant", "unsorted"},
+			expectedDropped: 2,
+		},
+		"should reject the records with series missing required labels": {
+			tenantID:         "reject",
+			expectedRejected: 1,
+		},
+		"should check the required labels once the labels have been injected": {
+			tenantID:       "injected",
+			expectedSeries: []string{"compliant", "no_namespace", "no_labels", "unsorted"},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pushed = map[string][]string{}
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, KafkaConfig{}, limits, metrics, log.NewNopLogger())
+
+			require.NoError(t, c.Consume(context.Background(), []record{newRecord(testData.tenantID)}))
+			assert.Equal(t, testData.expectedSeries, pushed[testData.tenantID])
+			assert.Equal(t, float64(testData.expectedDropped), testutil.ToFloat64(metrics.droppedSeries.WithLabelValues(reasonMissingRequiredLabel)))
+			assert.Equal(t, float64(testData.expectedRejected), testutil.ToFloat64(metrics.rejectedRecords.WithLabelValues(reasonMissingRequiredLabel)))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/atomic"
+)
+
+// consumerLagTracker tracks how many records the consumer of a partition is behind the latest record produced to it.
+// The high watermark is updated by the PartitionReader each time it fetches records, while the highest processed
+// offset is updated by the pusherConsumer each time a record has been successfully pushed to the storage.
+//
+// The consumerLagTracker is shared by all the pusherConsumer instances of a PartitionReader.
+type consumerLagTracker struct {
+	// highWatermark is the offset of the next record which will be produced to the partition.
+	highWatermark atomic.Int64
+	// highestProcessed is the highest offset of the records pushed to the storage, -1 if none.
+	highestProcessed atomic.Int64
+
+	lag prometheus.Gauge
+}
+
+func newConsumerLagTracker(partitionID int32, reg prometheus.Registerer) *consumerLagTracker {
+	t := &consumerLagTracker{
+		lag: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name:        "cortex_ingest_storage_reader_consumer_lag_records",
+			Help:        "The number of records produced to the partition which haven't been pushed to the storage yet, as seen by the consumer.",
+			ConstLabels: prometheus.Labels{"partition": strconv.Itoa(int(partitionID))},
+		}),
+	}
+	t.highestProcessed.Store(-1)
+	return t
+}
+
+// setHighWatermark records the high watermark of the partition returned by a fetch. An older high watermark is ignored.
+// A nil *consumerLagTracker is a no-op.
+func (t *consumerLagTracker) setHighWatermark(hwm int64) {
+	if t == nil || hwm < 0 {
+		return
+	}
+	casHWM(&t.highWatermark, hwm)
+}
+
+// processed records that the record at the offset has been successfully pushed to the storage, and updates the lag.
+// Records may be processed out of order, so an offset lower than the highest processed one is ignored.
+// A nil *consumerLagTracker is a no-op.
+func (t *consumerLagTracker) processed(offset int64) {
+	if t == nil {
+		return
+	}
+	casHWM(&t.highestProcessed, offset)
+
+	// The latest record produced to the partition has offset highWatermark-1.
+	t.lag.Set(float64(max(0, t.highWatermark.Load()-1-t.highestProcessed.Load())))
+}
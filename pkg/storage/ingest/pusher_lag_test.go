@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestConsumerLagTracker(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	tracker := newConsumerLagTracker(1, reg)
+
+	tracker.setHighWatermark(10)
+	tracker.processed(3)
+	assert.Equal(t, float64(6), testutil.ToFloat64(tracker.lag))
+
+	// An older high watermark and a lower offset processed out of order are ignored.
+	tracker.setHighWatermark(5)
+	tracker.processed(1)
+	assert.Equal(t, float64(6), testutil.ToFloat64(tracker.lag))
+
+	tracker.processed(9)
+	assert.Equal(t, float64(0), testutil.ToFloat64(tracker.lag))
+
+	tracker.setHighWatermark(20)
+	tracker.processed(9)
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_consumer_lag_records The number of records produced to the partition which haven't been pushed to the storage yet, as seen by the consumer.
+		# TYPE cortex_ingest_storage_reader_consumer_lag_records gauge
+		cortex_ingest_storage_reader_consumer_lag_records{partition="1"} 10
+	`)))
+
+	// A nil tracker is a no-op.
+	var nilTracker *consumerLagTracker
+	nilTracker.setHighWatermark(10)
+	nilTracker.processed(1)
+}
+
+func TestPusherConsumer_ShouldUpdateTheConsumerLag(t *testing.T) {
+	newRecord := func(metricName string, offset int64) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content, offset: offset}
+	}
+
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		if request.Timeseries[0].Labels[0].Value == "server_error" {
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		}
+		return nil
+	})
+
+	tracker := newConsumerLagTracker(1, prometheus.NewPedanticRegistry())
+	tracker.setHighWatermark(10)
+
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), withConsumerLagTracker(tracker))
+	require.Error(t, c.Consume(context.Background(), []record{newRecord("series_1", 5), newRecord("series_2", 6), newRecord("server_error", 7)}))
+
+	// The record failing with a server error hasn't been processed.
+	assert.Equal(t, float64(3), testutil.ToFloat64(tracker.lag))
+}
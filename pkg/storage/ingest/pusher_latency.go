@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/grafana/dskit/user"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// latencyInjectingPusher is a Pusher middleware which delays each push to the upstream Pusher.
+// It's used by tests to deterministically reproduce a slow storage, and must never be enabled in production.
+type latencyInjectingPusher struct {
+	upstream Pusher
+	latency  time.Duration
+
+	// tenants the latency applies to. When empty, the latency applies to all tenants.
+	tenants []string
+}
+
+func newLatencyInjectingPusher(upstream Pusher, latency time.Duration, tenants []string) *latencyInjectingPusher {
+	return &latencyInjectingPusher{
+		upstream: upstream,
+		latency:  latency,
+		tenants:  tenants,
+	}
+}
+
+// PushToStorage implements the Pusher interface.
+func (p *latencyInjectingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	if err := p.wait(ctx); err != nil {
+		return err
+	}
+	return p.upstream.PushToStorage(ctx, req)
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+func (p *latencyInjectingPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	if err := p.wait(ctx); err != nil {
+		return err
+	}
+	return p.upstream.(RawPusher).PushRawToStorage(ctx, tenantID, content)
+}
+
+// wait delays the push, if the latency applies to its tenant.
+func (p *latencyInjectingPusher) wait(ctx context.Context) error {
+	if !p.appliesTo(ctx) {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-time.After(p.latency):
+		return nil
+	}
+}
+
+func (p *latencyInjectingPusher) appliesTo(ctx context.Context) bool {
+	if len(p.tenants) == 0 {
+		return true
+	}
+
+	userID, err := user.ExtractOrgID(ctx)
+	return err == nil && slices.Contains(p.tenants, userID)
+}
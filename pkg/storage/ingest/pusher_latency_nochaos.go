@@ -0,0 +1,8 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+//go:build !chaos_testing
+
+package ingest
+
+// pushLatencyInjectionAllowed is true only in binaries built with the chaos_testing build tag.
+const pushLatencyInjectionAllowed = false
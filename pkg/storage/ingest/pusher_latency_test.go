@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestLatencyInjectingPusher(t *testing.T) {
+	const latency = 200 * time.Millisecond
+
+	upstream := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	// measure returns how long it took to push a request for the tenant.
+	measure := func(p Pusher, userID string) time.Duration {
+		start := time.Now()
+		require.NoError(t, p.PushToStorage(user.InjectOrgID(context.Background(), userID), &mimirpb.WriteRequest{}))
+		return time.Since(start)
+	}
+
+	t.Run("should delay the pushes of all tenants", func(t *testing.T) {
+		p := newLatencyInjectingPusher(upstream, latency, nil)
+		assert.GreaterOrEqual(t, measure(p, "user-1"), latency)
+		assert.GreaterOrEqual(t, measure(p, "user-2"), latency)
+	})
+
+	t.Run("should delay the pushes of the configured tenants only", func(t *testing.T) {
+		p := newLatencyInjectingPusher(upstream, latency, []string{"user-1"})
+		assert.GreaterOrEqual(t, measure(p, "user-1"), latency)
+		assert.Less(t, measure(p, "user-2"), latency)
+	})
+
+	t.Run("should honor the context cancellation", func(t *testing.T) {
+		p := newLatencyInjectingPusher(upstream, time.Hour, nil)
+
+		ctx, cancel := context.WithTimeout(user.InjectOrgID(context.Background(), "user-1"), latency)
+		defer cancel()
+		assert.ErrorIs(t, p.PushToStorage(ctx, &mimirpb.WriteRequest{}), context.DeadlineExceeded)
+	})
+}
+
+func TestNewPartitionReaderForPusher_InjectedPushLatency(t *testing.T) {
+	cfg := createTestKafkaConfig("localhost:0", "test")
+	cfg.InjectedPushLatency = time.Millisecond
+	upstream := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	// The latency is only injected by the binaries built with the chaos_testing build tag, even if the config
+	// hasn't been validated.
+	_, err := NewPartitionReaderForPusher(cfg, 1, "test", upstream, validation.MockDefaultOverrides(), log.NewNopLogger(), prometheus.NewPedanticRegistry())
+	if pushLatencyInjectionAllowed {
+		require.NoError(t, err)
+	} else {
+		require.ErrorIs(t, err, ErrPushLatencyInjectionNotAllowed)
+	}
+}
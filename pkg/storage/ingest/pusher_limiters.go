@@ -0,0 +1,109 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// ConsumeLimitsConfig configures the ConsumeLimiters. The zero value of each limit means unlimited.
+type ConsumeLimitsConfig struct {
+	// MaxDecodeBytes is the maximum total size of the records which are being decoded or are waiting to be pushed.
+	MaxDecodeBytes int64
+
+	// MaxConcurrentPushes is the maximum number of records which are being handed over to the storage writers at once.
+	MaxConcurrentPushes int
+
+	// MaxRecordsPerSecond is the maximum rate of the records handed over to the storage writers.
+	MaxRecordsPerSecond float64
+
+	// TenantInflightBytesTrackedTenants are the tenants whose in-flight bytes are exported as a metric. The in-flight
+	// bytes of each tenant are limited by the tenant's limits.
+	TenantInflightBytesTrackedTenants []string
+}
+
+// ConsumeLimiters are the limiters of the resources used to consume records, shared by the consumers they're configured
+// for with WithConsumeLimiters, for example by the PartitionReader instances of different partitions running in the same
+// process, so that the concurrent consumes respect global caps. It's safe for concurrent use.
+//
+// By default, each consume has a decode budget and in-flight bytes of its own, configured by the KafkaConfig, and
+// neither the concurrency nor the rate of the pushes are limited.
+type ConsumeLimiters struct {
+	decodeBudget   *decodeBudget
+	tenantInflight *tenantInflightBytes
+
+	// pushes and pushRate are nil when unlimited.
+	pushes         *semaphore.Weighted
+	pushesInFlight prometheus.Gauge
+	pushRate       *rate.Limiter
+}
+
+// NewConsumeLimiters returns the ConsumeLimiters configured by cfg. The in-flight bytes of each tenant are limited by
+// the limits of the tenant.
+func NewConsumeLimiters(cfg ConsumeLimitsConfig, limits TenantLimits, reg prometheus.Registerer) *ConsumeLimiters {
+	l := &ConsumeLimiters{
+		decodeBudget: newDecodeBudget(cfg.MaxDecodeBytes, promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_shared_decode_bytes_in_use",
+			Help: "Bytes of the shared decode budget in use by the records read from Kafka which are being decoded or waiting to be pushed.",
+		})),
+		tenantInflight: newTenantInflightBytes(limits, cfg.TenantInflightBytesTrackedTenants, promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_shared_tenant_inflight_bytes",
+			Help: "Bytes of the records read from Kafka which are being decoded or waiting to be pushed, for the tracked tenants, across the consumers sharing the limiters.",
+		}, []string{"user"})),
+		pushesInFlight: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_shared_pushes_in_flight",
+			Help: "Number of records read from Kafka which are being handed over to the storage writers, across the consumers sharing the limiters.",
+		}),
+	}
+	if cfg.MaxConcurrentPushes > 0 {
+		l.pushes = semaphore.NewWeighted(int64(cfg.MaxConcurrentPushes))
+	}
+	if cfg.MaxRecordsPerSecond > 0 {
+		l.pushRate = rate.NewLimiter(rate.Limit(cfg.MaxRecordsPerSecond), max(1, int(cfg.MaxRecordsPerSecond)))
+	}
+	return l
+}
+
+// WithConsumeLimiters configures the consumer to use the given limiters, shared with other consumers, instead of a
+// decode budget and in-flight bytes of its own. The decode budget and tenant in-flight bytes configured by the
+// KafkaConfig are ignored.
+func WithConsumeLimiters(l *ConsumeLimiters) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.limiters = l
+		c.decodeBudget = l.decodeBudget
+		c.tenantInflight = l.tenantInflight
+	}
+}
+
+// acquirePush waits until the record can be handed over to the storage writer, honoring the concurrency and rate of
+// the pushes. The returned function must be called once the record has been handed over. A nil *ConsumeLimiters
+// never waits.
+func (l *ConsumeLimiters) acquirePush(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	if l.pushRate != nil {
+		if err := l.pushRate.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if l.pushes != nil {
+		if err := l.pushes.Acquire(ctx, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	l.pushesInFlight.Inc()
+	return func() {
+		l.pushesInFlight.Dec()
+		if l.pushes != nil {
+			l.pushes.Release(1)
+		}
+	}, nil
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_SharedConsumeLimiters(t *testing.T) {
+	const (
+		consumers          = 4
+		recordsPerConsumer = 10
+	)
+
+	newRecords := func(tenantID string) []record {
+		records := make([]record, 0, recordsPerConsumer)
+		for i := 0; i < recordsPerConsumer; i++ {
+			wr := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}
+			records = append(records, makeRecord(t, tenantID, wr, nil))
+		}
+		return records
+	}
+
+	tests := map[string]struct {
+		cfg            ConsumeLimitsConfig
+		maxConcurrency int64
+	}{
+		"should honor the concurrency of the pushes across the consumers": {
+			cfg:            ConsumeLimitsConfig{MaxConcurrentPushes: 2},
+			maxConcurrency: 2,
+		},
+		"should honor the decode budget across the consumers": {
+			cfg:            ConsumeLimitsConfig{MaxDecodeBytes: 1, MaxConcurrentPushes: consumers},
+			maxConcurrency: consumers,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var (
+				inflight       = atomic.NewInt64(0)
+				maxInflight    = atomic.NewInt64(0)
+				pushes         = atomic.NewInt64(0)
+				pushesByTenant sync.Map
+			)
+			pusher := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+				current := inflight.Inc()
+				defer inflight.Dec()
+				for {
+					observed := maxInflight.Load()
+					if current <= observed || maxInflight.CompareAndSwap(observed, current) {
+						break
+					}
+				}
+
+				tenantID, _ := user.ExtractOrgID(ctx)
+				count, _ := pushesByTenant.LoadOrStore(tenantID, atomic.NewInt64(0))
+				count.(*atomic.Int64).Inc()
+				pushes.Inc()
+				time.Sleep(time.Millisecond)
+				return nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			limiters := NewConsumeLimiters(testData.cfg, validation.MockDefaultOverrides(), reg)
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < consumers; i++ {
+				tenantID := fmt.Sprintf("user-%d", i)
+				c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithConsumeLimiters(limiters))
+				require.Same(t, limiters.decodeBudget, c.decodeBudget)
+				require.Same(t, limiters.tenantInflight, c.tenantInflight)
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, c.Consume(context.Background(), newRecords(tenantID)))
+				}()
+			}
+			wg.Wait()
+
+			assert.Equal(t, int64(consumers*recordsPerConsumer), pushes.Load())
+			for i := 0; i < consumers; i++ {
+				count, ok := pushesByTenant.Load(fmt.Sprintf("user-%d", i))
+				require.True(t, ok)
+				assert.Equal(t, int64(recordsPerConsumer), count.(*atomic.Int64).Load())
+			}
+			assert.LessOrEqual(t, maxInflight.Load(), testData.maxConcurrency)
+
+			// All the limits have been released.
+			assert.Equal(t, float64(0), testutil.ToFloat64(limiters.pushesInFlight))
+			if limiters.decodeBudget != nil {
+				assert.Equal(t, float64(0), testutil.ToFloat64(limiters.decodeBudget.inUse))
+			}
+			assert.Empty(t, limiters.tenantInflight.inflight)
+		})
+	}
+}
+
+func TestConsumeLimiters_PushRate(t *testing.T) {
+	limiters := NewConsumeLimiters(ConsumeLimitsConfig{MaxRecordsPerSecond: 10}, validation.MockDefaultOverrides(), prometheus.NewPedanticRegistry())
+
+	// The burst is a second worth of records, so the records after the first 10 wait for the rate.
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		release, err := limiters.acquirePush(context.Background())
+		require.NoError(t, err)
+		release()
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	t.Run("should stop waiting once the context is canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := limiters.acquirePush(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("should never wait if the limiters are nil", func(t *testing.T) {
+		release, err := (*ConsumeLimiters)(nil).acquirePush(context.Background())
+		require.NoError(t, err)
+		release()
+	})
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+// ClientErrorLogLimiter limits the rate of the client errors logged by the consumers it's configured for with
+// WithClientErrorLogLimiter, for example by the PartitionReader instances of different partitions running in the same
+// process, so that the consumers respect a global log budget when many records fail with a client error at once. The
+// client errors are throttled once they've been sampled or deduplicated by each consumer. It's safe for concurrent use.
+//
+// By default, each consumer only samples or deduplicates the client errors it logs.
+type ClientErrorLogLimiter struct {
+	limiter   *rate.Limiter
+	throttled prometheus.Counter
+}
+
+// NewClientErrorLogLimiter returns a ClientErrorLogLimiter which allows up to logsPerSecond client errors to be logged
+// per second, with bursts of up to burst client errors.
+func NewClientErrorLogLimiter(logsPerSecond float64, burst int, reg prometheus.Registerer) *ClientErrorLogLimiter {
+	return &ClientErrorLogLimiter{
+		limiter: rate.NewLimiter(rate.Limit(logsPerSecond), max(1, burst)),
+		throttled: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_shared_client_error_logs_throttled_total",
+			Help: "Number of client errors which haven't been logged because the log budget shared by the consumers has been exhausted.",
+		}),
+	}
+}
+
+// WithClientErrorLogLimiter configures the consumer to only log the client errors allowed by the given limiter, shared
+// with other consumers.
+func WithClientErrorLogLimiter(l *ClientErrorLogLimiter) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.clientErrLogLimiter = l
+	}
+}
+
+// allow returns whether a client error can be logged now. A nil *ClientErrorLogLimiter allows all of them.
+func (l *ClientErrorLogLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	if l.limiter.Allow() {
+		return true
+	}
+	l.throttled.Inc()
+	return false
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_WithClientErrorLogLimiter(t *testing.T) {
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "sample out of bounds")
+	})
+	newRecords := func() []record {
+		var records []record
+		for i := 0; i < 3; i++ {
+			records = append(records, makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil))
+		}
+		return records
+	}
+	countLogged := func(buf *bytes.Buffer) int {
+		return strings.Count(buf.String(), "detected a client error while ingesting write request")
+	}
+
+	t.Run("should log all the client errors by default", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewLogfmtLogger(buf))
+
+		require.NoError(t, c.Consume(context.Background(), newRecords()))
+		assert.Equal(t, 3, countLogged(buf))
+	})
+
+	t.Run("should share the log budget across the consumers", func(t *testing.T) {
+		limiter := NewClientErrorLogLimiter(0.001, 2, prometheus.NewPedanticRegistry())
+
+		var bufs [2]*bytes.Buffer
+		for i := range bufs {
+			bufs[i] = &bytes.Buffer{}
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewLogfmtLogger(bufs[i]), WithClientErrorLogLimiter(limiter))
+			require.NoError(t, c.Consume(context.Background(), newRecords()))
+		}
+
+		assert.Equal(t, 2, countLogged(bufs[0]))
+		assert.Equal(t, 0, countLogged(bufs[1]))
+		assert.Equal(t, float64(4), testutil.ToFloat64(limiter.throttled))
+	})
+}
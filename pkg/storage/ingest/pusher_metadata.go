@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// metadataRoutingPusher is a PusherCloser which pushes the metadata-only write requests with a dedicated PusherCloser,
+// so that bursts of metadata updates don't delay the ingestion of the samples. The metadata-only requests are pushed in
+// the background, so their non-client errors are only returned by a later push or by Close.
+//
+// It's safe to call PushToStorage concurrently if both the samples and metadata PusherCloser are.
+type metadataRoutingPusher struct {
+	samples  PusherCloser
+	metadata PusherCloser
+
+	metadataOnlyRequests prometheus.Counter
+}
+
+// PushToStorage implements the PusherCloser interface.
+func (p *metadataRoutingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	if isMetadataOnly(req) {
+		p.metadataOnlyRequests.Inc()
+		return p.metadata.PushToStorage(ctx, req)
+	}
+
+	if err := p.samples.PushToStorage(ctx, req); err != nil {
+		// The consumption is aborted, so we stop pushing the metadata because Close may not be called.
+		p.metadata.Close()
+		return err
+	}
+	return nil
+}
+
+// Close implements the PusherCloser interface.
+func (p *metadataRoutingPusher) Close() []error {
+	return append(p.samples.Close(), p.metadata.Close()...)
+}
+
+// isMetadataOnly returns whether the request has metadata and neither samples, histograms nor exemplars.
+func isMetadataOnly(req *mimirpb.WriteRequest) bool {
+	if len(req.Metadata) == 0 {
+		return false
+	}
+
+	for _, ts := range req.Timeseries {
+		if len(ts.Samples) > 0 || len(ts.Histograms) > 0 || len(ts.Exemplars) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// deferredMetadataPusher is a PusherCloser which strips the metadata from the write requests, pushing the rest of
+// each request immediately, and pushes the collected metadata of each tenant at once in a single request on Close.
+// This reduces the overhead of writing the metadata when a batch has many records, while the samples and exemplars
+// are still pushed as soon as possible.
+//
+// The combined requests are pushed by the upstream PusherCloser, so their errors are classified and counted like
+// the errors of any other request. It's safe to call PushToStorage concurrently if the upstream PusherCloser is.
+type deferredMetadataPusher struct {
+	upstream PusherCloser
+
+	mx       sync.Mutex
+	pending  map[deferredMetadataKey]*deferredMetadata
+	order    []deferredMetadataKey
+	deferred prometheus.Counter
+}
+
+// deferredMetadataKey groups the metadata which can be pushed in the same request.
+type deferredMetadataKey struct {
+	tenantID string
+	source   mimirpb.WriteRequest_SourceEnum
+}
+
+type deferredMetadata struct {
+	// ctx is the context of the first request the metadata has been collected from, without its cancellation.
+	ctx                 context.Context
+	skipLabelValidation bool
+	metadata            []*mimirpb.MetricMetadata
+}
+
+func newDeferredMetadataPusher(upstream PusherCloser, deferred prometheus.Counter) *deferredMetadataPusher {
+	return &deferredMetadataPusher{
+		upstream: upstream,
+		pending:  map[deferredMetadataKey]*deferredMetadata{},
+		deferred: deferred,
+	}
+}
+
+// PushToStorage implements the PusherCloser interface.
+func (p *deferredMetadataPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	if len(req.Metadata) > 0 {
+		p.collect(ctx, req)
+		req.Metadata = nil
+
+		if len(req.Timeseries) == 0 {
+			return nil
+		}
+	}
+	return p.upstream.PushToStorage(ctx, req)
+}
+
+func (p *deferredMetadataPusher) collect(ctx context.Context, req *mimirpb.WriteRequest) {
+	// The tenant is injected in the context before pushing, so it's only missing in tests.
+	tenantID, _ := user.ExtractOrgID(ctx)
+	key := deferredMetadataKey{tenantID: tenantID, source: req.Source}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.deferred.Add(float64(len(req.Metadata)))
+	pending, ok := p.pending[key]
+	if !ok {
+		pending = &deferredMetadata{ctx: context.WithoutCancel(ctx), skipLabelValidation: req.SkipLabelValidation}
+		p.pending[key] = pending
+		p.order = append(p.order, key)
+	}
+	pending.metadata = append(pending.metadata, req.Metadata...)
+}
+
+// Close implements the PusherCloser interface. It pushes the collected metadata before closing the upstream PusherCloser.
+func (p *deferredMetadataPusher) Close() []error {
+	p.mx.Lock()
+	pending, order := p.pending, p.order
+	p.pending, p.order = map[deferredMetadataKey]*deferredMetadata{}, nil
+	p.mx.Unlock()
+
+	var errs []error
+	for _, key := range order {
+		m := pending[key]
+		req := &mimirpb.WriteRequest{Metadata: m.metadata, Source: key.source, SkipLabelValidation: m.skipLabelValidation}
+		if err := p.upstream.PushToStorage(m.ctx, req); err != nil {
+			// A non-client error aborts the consumption, so there's no point in pushing the metadata of the other tenants.
+			errs = append(errs, err)
+			break
+		}
+	}
+	return append(errs, p.upstream.Close()...)
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestIsMetadataOnly(t *testing.T) {
+	metadata := []*mimirpb.MetricMetadata{{MetricFamilyName: "series_1", Type: mimirpb.COUNTER}}
+
+	withoutSamples := mockPreallocTimeseries("series_1")
+	withoutSamples.Samples = nil
+
+	assert.False(t, isMetadataOnly(&mimirpb.WriteRequest{}))
+	assert.False(t, isMetadataOnly(&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}))
+	assert.False(t, isMetadataOnly(&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}, Metadata: metadata}))
+	assert.True(t, isMetadataOnly(&mimirpb.WriteRequest{Metadata: metadata}))
+	assert.True(t, isMetadataOnly(&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{withoutSamples}, Metadata: metadata}))
+}
+
+func TestPusherConsumer_MetadataOnlyConcurrency(t *testing.T) {
+	newRecord := func(req *mimirpb.WriteRequest) record {
+		content, err := req.Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
+	}
+	metadataRecord := newRecord(&mimirpb.WriteRequest{Metadata: []*mimirpb.MetricMetadata{{MetricFamilyName: "series_1", Type: mimirpb.COUNTER}}})
+	samplesRecord := func(metricName string) record {
+		return newRecord(&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}})
+	}
+
+	cfg := KafkaConfig{
+		MetadataOnlyConcurrency:           1,
+		IngestionConcurrencyQueueCapacity: 1,
+	}
+
+	t.Run("should not delay the samples while pushing the metadata", func(t *testing.T) {
+		samplesPushed := make(chan struct{})
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			if len(request.Metadata) > 0 {
+				// The metadata completes only once the samples of the following record have been pushed,
+				// which would never happen if the records were pushed in order by the same writer.
+				select {
+				case <-samplesPushed:
+				case <-time.After(5 * time.Second):
+					return assert.AnError
+				}
+				return nil
+			}
+
+			if request.Timeseries[0].Labels[0].Value == "series_2" {
+				close(samplesPushed)
+			}
+			return nil
+		})
+
+		reg := prometheus.NewPedanticRegistry()
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), []record{samplesRecord("series_1"), metadataRecord, samplesRecord("series_2")}))
+
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_ingest_storage_reader_metadata_only_requests_total Number of write requests read from Kafka with only metadata which have been pushed to the storage by the dedicated metadata workers.
+			# TYPE cortex_ingest_storage_reader_metadata_only_requests_total counter
+			cortex_ingest_storage_reader_metadata_only_requests_total 1
+		`), "cortex_ingest_storage_reader_metadata_only_requests_total"))
+	})
+
+	t.Run("should return the server error encountered while pushing the metadata", func(t *testing.T) {
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			if len(request.Metadata) > 0 {
+				return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+			}
+			return nil
+		})
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.ErrorContains(t, c.Consume(context.Background(), []record{samplesRecord("series_1"), metadataRecord, samplesRecord("series_2")}), "ingester internal error")
+	})
+
+	t.Run("should stop pushing the metadata when pushing the samples fails", func(t *testing.T) {
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			if len(request.Timeseries) > 0 {
+				return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+			}
+			return nil
+		})
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.ErrorContains(t, c.Consume(context.Background(), []record{metadataRecord, samplesRecord("series_1"), metadataRecord}), "ingester internal error")
+	})
+}
+
+func TestPusherConsumer_DeferMetadataPushes(t *testing.T) {
+	newRecord := func(tenantID, metricName string, withSamples bool) record {
+		req := &mimirpb.WriteRequest{Metadata: []*mimirpb.MetricMetadata{{MetricFamilyName: metricName, Type: mimirpb.COUNTER}}}
+		if withSamples {
+			req.Timeseries = []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}
+		}
+		content, err := req.Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: tenantID, content: content}
+	}
+	records := []record{
+		newRecord("user-1", "series_1", true),
+		newRecord("user-2", "series_2", true),
+		newRecord("user-1", "series_3", false),
+	}
+
+	type push struct {
+		tenantID string
+		series   []string
+		metadata []string
+	}
+
+	tests := map[string]struct {
+		metadataErr      error
+		expectedErr      string
+		expectedFailures string
+	}{
+		"should push the metadata of each tenant at the end of the batch": {},
+		"should skip the combined metadata push failing with a client error": {
+			metadataErr: ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "invalid metadata"),
+			expectedFailures: `
+				# HELP cortex_ingest_storage_reader_requests_failed_total Number of write requests which caused errors while processing. Client errors are errors such as tenant limits and samples out of bounds. Server errors indicate internal recoverable errors.
+				# TYPE cortex_ingest_storage_reader_requests_failed_total counter
+				cortex_ingest_storage_reader_requests_failed_total{cause="client"} 2
+				cortex_ingest_storage_reader_requests_failed_total{cause="server"} 0
+			`,
+		},
+		"should return the server error of the combined metadata push": {
+			metadataErr: ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error"),
+			expectedErr: "ingester internal error",
+			expectedFailures: `
+				# HELP cortex_ingest_storage_reader_requests_failed_total Number of write requests which caused errors while processing. Client errors are errors such as tenant limits and samples out of bounds. Server errors indicate internal recoverable errors.
+				# TYPE cortex_ingest_storage_reader_requests_failed_total counter
+				cortex_ingest_storage_reader_requests_failed_total{cause="client"} 0
+				cortex_ingest_storage_reader_requests_failed_total{cause="server"} 1
+			`,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var pushes []push
+			pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+				tenantID, err := user.ExtractOrgID(ctx)
+				require.NoError(t, err)
+
+				p := push{tenantID: tenantID}
+				for _, ts := range request.Timeseries {
+					p.series = append(p.series, ts.Labels[0].Value)
+				}
+				for _, m := range request.Metadata {
+					p.metadata = append(p.metadata, m.MetricFamilyName)
+				}
+				pushes = append(pushes, p)
+
+				if len(request.Metadata) > 0 {
+					return testData.metadataErr
+				}
+				return nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			metrics := newPusherConsumerMetrics(reg)
+			c := newPusherConsumer(pusher, KafkaConfig{DeferMetadataPushes: true}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+			err := c.Consume(context.Background(), records)
+			if testData.expectedErr != "" {
+				require.ErrorContains(t, err, testData.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			expectedPushes := []push{
+				{tenantID: "user-1", series: []string{"series_1"}},
+				{tenantID: "user-2", series: []string{"series_2"}},
+				{tenantID: "user-1", metadata: []string{"series_1", "series_3"}},
+			}
+			if testData.expectedErr == "" {
+				expectedPushes = append(expectedPushes, push{tenantID: "user-2", metadata: []string{"series_2"}})
+			}
+			assert.Equal(t, expectedPushes, pushes)
+			assert.Equal(t, float64(3), testutil.ToFloat64(metrics.deferredMetadata))
+
+			if testData.expectedFailures != "" {
+				assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(testData.expectedFailures), "cortex_ingest_storage_reader_requests_failed_total"))
+			}
+		})
+	}
+}
@@ -3,47 +3,601 @@
 package ingest
 
 import (
+	"context"
+	"math"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
 )
 
 // pusherConsumerMetrics holds the metrics for the pusherConsumer.
 type pusherConsumerMetrics struct {
-	processingTimeSeconds prometheus.Observer
+	processingTimeSeconds    prometheus.Histogram
+	floatSamples             prometheus.Counter
+	nativeHistograms         prometheus.Counter
+	recordBytesPerSample     prometheus.Histogram
+	seriesPerPush            prometheus.Histogram
+	recordsDecoded           prometheus.Counter
+	unmarshalSendBlocked     prometheus.Counter
+	unmarshalSendWaitSeconds prometheus.Histogram
+	decodeQueueSeconds       prometheus.Histogram
+	rawRecords               prometheus.Counter
+	parseErrors              prometheus.Counter
+	skipDecisions            *prometheus.CounterVec
+	decodeTimeouts           prometheus.Counter
+	abandonedDecodes         prometheus.Gauge
+	panics                   prometheus.Counter
+	recordCodecs             *prometheus.CounterVec
+	recordDecoders           *prometheus.CounterVec
+	decodeErrors             *prometheus.CounterVec
+	batchedRecords           prometheus.Counter
+	reassembledRecords       prometheus.Counter
+	incompleteChunkedRecords prometheus.Counter
+	droppedOutcomes          prometheus.Counter
+	remappedRecords          prometheus.Counter
+	exemplarsDropped         prometheus.Counter
+	metadataDropped          prometheus.Counter
+	staleSamplesDropped      prometheus.Counter
+	metadataOnlyRequests     prometheus.Counter
+	deferredMetadata         prometheus.Counter
+	outOfOrderRecords        prometheus.Counter
+	offsetGaps               prometheus.Counter
+	consumeDurationExceeded  prometheus.Counter
+	pushTimeouts             prometheus.Counter
+	timeouts                 *prometheus.CounterVec
+	readBackVerifications    *prometheus.CounterVec
+	stageDurationSeconds     *prometheus.HistogramVec
+	stageErrors              *prometheus.CounterVec
+
+	// inflightPushes tracks the pushes to the storage in flight, to report the age of the oldest one.
+	inflightPushes             *inflightPushes
+	backpressureDelayedRecords prometheus.Counter
+	backpressureDelaySeconds   prometheus.Counter
+	decodeBytesBudget          prometheus.Gauge
+	decodeBytesInUse           prometheus.Gauge
+
+	// decodeRoundTripMismatches is only tracked when the round-trip verification is enabled.
+	decodeRoundTripMismatches prometheus.Counter
+
+	// tenantProcessingTimeSeconds tracks the processing time of the records of the tracked tenants only, to bound its cardinality.
+	tenantProcessingTimeSeconds *prometheus.HistogramVec
+
+	// tenantSLORecords and tenantSLORecordsWithin are only tracked for the tracked tenants, when a processing time SLO is configured.
+	tenantSLORecords       *prometheus.CounterVec
+	tenantSLORecordsWithin *prometheus.CounterVec
+
+	consecutiveSkips                  prometheus.Gauge
+	consecutiveSkipsThresholdExceeded prometheus.Counter
+
+	tenantInflightBytes      *prometheus.GaugeVec
+	tenantInflightBytesWaits prometheus.Counter
+
+	futureSamples        prometheus.Counter
+	exemplarOnlyRecords  *prometheus.CounterVec
+	exemplarsPerSecond   prometheus.Gauge
+	exemplarsRateLimited prometheus.Counter
+	quotaCheckDuration   prometheus.Histogram
+	quotaCheckFailures   prometheus.Counter
+	duplicateSamples     prometheus.Counter
+	downsampledSamples   prometheus.Counter
+	rejectedRecords      *prometheus.CounterVec
+
+	heartbeatFailures   prometheus.Counter
+	slowConsumeProfiles prometheus.Counter
+
+	droppedSeries        *prometheus.CounterVec
+	injectedLabelsSeries prometheus.Counter
+
+	pushRetries          prometheus.Counter
+	retriesPerRecord     prometheus.Histogram
+	retryBudgetRemaining prometheus.Gauge
+
+	splitRequests        prometheus.Counter
+	splitPartialRequests prometheus.Counter
+
+	// priorityWaitSeconds is only tracked when a RecordPriorityResolver is configured.
+	priorityWaitSeconds *prometheus.HistogramVec
 
 	storagePusherMetrics *storagePusherMetrics
 }
 
-// newPusherConsumerMetrics creates a new pusherConsumerMetrics instance.
+// ConsumerMetrics receives the core metrics of the records consumed from Kafka, so that they can be exported
+// with a metrics library other than Prometheus. The default implementation exports them as Prometheus metrics.
+// The implementations must be safe for concurrent use.
+type ConsumerMetrics interface {
+	// IncTotal is called for each write request attempted to be pushed to the storage.
+	IncTotal()
+	// IncFailed is called for each write request which failed to be pushed to the storage, with the cause of the
+	// failure, which is either one of the FailureCause constants or a cause registered with RegisterFailureCause.
+	IncFailed(cause string)
+	// ObserveProcessing is called with the time taken to process each batch of fetched records.
+	ObserveProcessing(d time.Duration)
+}
+
+// NoopConsumerMetrics is a ConsumerMetrics which discards the metrics, for example to benchmark the consumption of the
+// records without the cost of the instrumentation.
+type NoopConsumerMetrics struct{}
+
+func (NoopConsumerMetrics) IncTotal()                       {}
+func (NoopConsumerMetrics) IncFailed(string)                {}
+func (NoopConsumerMetrics) ObserveProcessing(time.Duration) {}
+
+// prometheusConsumerMetrics is the default ConsumerMetrics, which exports the metrics as Prometheus metrics.
+type prometheusConsumerMetrics struct {
+	total  prometheus.Counter
+	failed *prometheus.CounterVec
+	// processing is nil if the metrics are only used by the storage pushers, which don't observe the processing time.
+	processing prometheus.Observer
+}
+
+func (m *prometheusConsumerMetrics) IncTotal() {
+	m.total.Inc()
+}
+
+func (m *prometheusConsumerMetrics) IncFailed(cause string) {
+	m.failed.WithLabelValues(failureCauses.normalize(cause)).Inc()
+}
+
+func (m *prometheusConsumerMetrics) ObserveProcessing(d time.Duration) {
+	if m.processing != nil {
+		m.processing.Observe(d.Seconds())
+	}
+}
+
+// withBackend returns a copy of the metrics which reports the core metrics to backend instead of Prometheus.
+// The other metrics are still exported as Prometheus metrics, and are shared with m.
+func (m *pusherConsumerMetrics) withBackend(backend ConsumerMetrics) *pusherConsumerMetrics {
+	storagePusherMetrics := *m.storagePusherMetrics
+	storagePusherMetrics.backend = backend
+
+	metrics := *m
+	metrics.storagePusherMetrics = &storagePusherMetrics
+	return &metrics
+}
+
+// ProcessingTimeHistogramConfig configures the native histogram tracking the time taken to process a batch of records.
+// The zero value of each field means the default value is used.
+type ProcessingTimeHistogramConfig struct {
+	// BucketFactor is the growth factor between the bounds of two consecutive buckets. Defaults to 1.1.
+	BucketFactor float64
+	// MaxBucketNumber is the maximum number of buckets. Defaults to 100.
+	MaxBucketNumber uint32
+	// MinResetDuration is the minimum time between two resets of the histogram when it exceeds the maximum number of buckets. Defaults to 1h.
+	MinResetDuration time.Duration
+}
+
+// withDefaults returns the config with the unset fields set to their default value.
+func (cfg ProcessingTimeHistogramConfig) withDefaults() ProcessingTimeHistogramConfig {
+	if cfg.BucketFactor == 0 {
+		cfg.BucketFactor = 1.1
+	}
+	if cfg.MaxBucketNumber == 0 {
+		cfg.MaxBucketNumber = 100
+	}
+	if cfg.MinResetDuration == 0 {
+		cfg.MinResetDuration = time.Hour
+	}
+	return cfg
+}
+
+// newPusherConsumerMetrics creates a new pusherConsumerMetrics instance with the default processing time histogram.
 func newPusherConsumerMetrics(reg prometheus.Registerer) *pusherConsumerMetrics {
-	return &pusherConsumerMetrics{
+	return newPusherConsumerMetricsWithHistogramConfig(reg, ProcessingTimeHistogramConfig{})
+}
+
+// newPusherConsumerMetricsWithHistogramConfig creates a new pusherConsumerMetrics instance.
+func newPusherConsumerMetricsWithHistogramConfig(reg prometheus.Registerer, histogramCfg ProcessingTimeHistogramConfig) *pusherConsumerMetrics {
+	histogramCfg = histogramCfg.withDefaults()
+
+	m := &pusherConsumerMetrics{
 		storagePusherMetrics: newStoragePusherMetrics(reg),
 		processingTimeSeconds: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
 			Name:                            "cortex_ingest_storage_reader_records_processing_time_seconds",
 			Help:                            "Time taken to process a batch of fetched records. Fetched records are effectively a set of WriteRequests read from Kafka.",
-			NativeHistogramBucketFactor:     1.1,
-			NativeHistogramMaxBucketNumber:  100,
-			NativeHistogramMinResetDuration: 1 * time.Hour,
+			NativeHistogramBucketFactor:     histogramCfg.BucketFactor,
+			NativeHistogramMaxBucketNumber:  histogramCfg.MaxBucketNumber,
+			NativeHistogramMinResetDuration: histogramCfg.MinResetDuration,
 			Buckets:                         prometheus.DefBuckets,
 		}),
+		tenantProcessingTimeSeconds: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:                            "cortex_ingest_storage_reader_tenant_record_processing_time_seconds",
+			Help:                            "Time taken to push a record read from Kafka to the storage, for the tracked tenants only.",
+			NativeHistogramBucketFactor:     histogramCfg.BucketFactor,
+			NativeHistogramMaxBucketNumber:  histogramCfg.MaxBucketNumber,
+			NativeHistogramMinResetDuration: histogramCfg.MinResetDuration,
+			Buckets:                         prometheus.DefBuckets,
+		}, []string{"user"}),
+		tenantSLORecords: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_tenant_processing_slo_records_total",
+			Help: "Number of records read from Kafka pushed to the storage, for the tracked tenants only, when a processing time SLO is configured.",
+		}, []string{"user"}),
+		tenantSLORecordsWithin: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_tenant_processing_slo_records_within_total",
+			Help: "Number of records read from Kafka pushed to the storage within the processing time SLO, for the tracked tenants only.",
+		}, []string{"user"}),
+		priorityWaitSeconds: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:                            "cortex_ingest_storage_reader_record_priority_queue_wait_seconds",
+			Help:                            "Time a decoded record read from Kafka has waited in the priority queue for a push worker, by priority.",
+			NativeHistogramBucketFactor:     histogramCfg.BucketFactor,
+			NativeHistogramMaxBucketNumber:  histogramCfg.MaxBucketNumber,
+			NativeHistogramMinResetDuration: histogramCfg.MinResetDuration,
+			Buckets:                         prometheus.DefBuckets,
+		}, []string{"priority"}),
+		floatSamples: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_float_samples_total",
+			Help: "Number of float samples in the write requests read from Kafka that have been attempted to be pushed to the storage.",
+		}),
+		nativeHistograms: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_native_histograms_total",
+			Help: "Number of native histogram samples in the write requests read from Kafka that have been attempted to be pushed to the storage.",
+		}),
+		recordBytesPerSample: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:                        "cortex_ingest_storage_reader_record_bytes_per_sample",
+			Help:                        "Size of the content of each record read from Kafka divided by the number of float and histogram samples of its write request. Only the records with samples are observed.",
+			NativeHistogramBucketFactor: 1.1,
+			Buckets:                     prometheus.ExponentialBuckets(4, 2, 14),
+		}),
+		seriesPerPush: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:                        "cortex_ingest_storage_reader_series_per_push",
+			Help:                        "Number of series of each write request pushed to the storage, once the records read from Kafka have been split or batched. The records pushed without being decoded aren't observed.",
+			NativeHistogramBucketFactor: 1.1,
+			Buckets:                     prometheus.ExponentialBuckets(1, 4, 10),
+		}),
+		recordsDecoded: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_records_decoded_total",
+			Help: "Number of records read from Kafka which have been successfully decoded. Compared with cortex_ingest_storage_reader_requests_total, it shows whether the ingestion is bound by decoding or by pushing to the storage.",
+		}),
+		unmarshalSendBlocked: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_unmarshal_send_blocked_total",
+			Help: "Number of records read from Kafka whose hand-off from the decoding goroutine to the pushing goroutine has blocked because the pushing goroutine was busy.",
+		}),
+		unmarshalSendWaitSeconds: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:                        "cortex_ingest_storage_reader_unmarshal_send_wait_seconds",
+			Help:                        "Time the decoding goroutine has waited for the pushing goroutine to receive each decoded record read from Kafka.",
+			NativeHistogramBucketFactor: 1.1,
+		}),
+		decodeQueueSeconds: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:                        "cortex_ingest_storage_reader_decode_queue_seconds",
+			Help:                        "Time each record read from Kafka has waited, since the consumption of its batch started, before the decoding goroutine started decoding it.",
+			NativeHistogramBucketFactor: 1.1,
+		}),
+		rawRecords: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_raw_records_total",
+			Help: "Number of records read from Kafka which have been pushed to the storage in their serialized form, without being decoded.",
+		}),
+		parseErrors: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_parse_errors_total",
+			Help: "Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.",
+		}),
+		skipDecisions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_skip_policy_decisions_total",
+			Help: "Number of records read from Kafka which couldn't be parsed into a write request, by the action decided by the skip policy.",
+		}, []string{"action"}),
+		decodeTimeouts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_decode_timeouts_total",
+			Help: "Number of records read from Kafka whose decoding took longer than the configured timeout.",
+		}),
+		abandonedDecodes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_abandoned_decodes",
+			Help: "Number of abandoned decodes of records read from Kafka which are still running.",
+		}),
+		decodeRoundTripMismatches: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_decode_round_trip_mismatches_total",
+			Help: "Number of records read from Kafka whose decoded write request doesn't match their content once re-marshalled. Only tracked when the round-trip verification is enabled.",
+		}),
+		panics: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_panics_total",
+			Help: "Number of panics recovered while consuming the records read from Kafka.",
+		}),
+		recordCodecs: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_records_by_codec_total",
+			Help: "Number of records read from Kafka by the codec detected for their content.",
+		}, []string{"codec"}),
+		recordDecoders: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_records_by_decoder_total",
+			Help: "Number of records read from Kafka by the decoder which decoded their content.",
+		}, []string{"decoder"}),
+		decodeErrors: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_decode_errors_total",
+			Help: "Number of records read from Kafka which each decoder failed to decode, by the name of the decoder. The records decoded by a fallback decoder are counted for the decoders tried before it.",
+		}, []string{"codec"}),
+		batchedRecords: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_batched_records_total",
+			Help: "Number of records split from the batches of records read from Kafka.",
+		}),
+		reassembledRecords: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_reassembled_records_total",
+			Help: "Number of records reassembled from the chunk records read from Kafka.",
+		}),
+		incompleteChunkedRecords: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_incomplete_chunked_records_total",
+			Help: "Number of records split into chunk records read from Kafka which have been discarded because their chunks have not all been consumed together.",
+		}),
+		droppedOutcomes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_record_outcomes_dropped_total",
+			Help: "Number of outcomes of the records read from Kafka which have been dropped because the outcomes channel was full.",
+		}),
+		remappedRecords: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_remapped_records_total",
+			Help: "Number of records read from Kafka which have been pushed to the storage under a remapped tenant.",
+		}),
+		exemplarsDropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_exemplars_dropped_total",
+			Help: "Number of exemplars dropped from the write requests read from Kafka because of the tenant's limits.",
+		}),
+		metadataDropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_metadata_dropped_total",
+			Help: "Number of metadata dropped from the write requests read from Kafka because of the tenant's limits.",
+		}),
+		staleSamplesDropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_stale_samples_dropped_total",
+			Help: "Number of samples and histograms dropped from the write requests read from Kafka because they were older than the max sample age.",
+		}),
+		consecutiveSkips: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_consecutive_skipped_requests",
+			Help: "Number of write requests read from Kafka skipped in a row, because they couldn't be parsed or have been rejected with a client error.",
+		}),
+		consecutiveSkipsThresholdExceeded: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_consecutive_skips_threshold_exceeded_total",
+			Help: "Number of times the number of write requests read from Kafka skipped in a row has crossed a multiple of the configured threshold.",
+		}),
+		metadataOnlyRequests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_metadata_only_requests_total",
+			Help: "Number of write requests read from Kafka with only metadata which have been pushed to the storage by the dedicated metadata workers.",
+		}),
+		deferredMetadata: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_deferred_metadata_total",
+			Help: "Number of metadata of the write requests read from Kafka whose push has been deferred to the end of the batch.",
+		}),
+		outOfOrderRecords: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_out_of_order_records_total",
+			Help: "Number of write requests read from Kafka with samples out of timestamp order within a series.",
+		}),
+		offsetGaps: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_offset_gaps_total",
+			Help: "Number of gaps between the offsets of consecutive records of the batches of records read from Kafka, which means that records have been skipped by the reader.",
+		}),
+		consumeDurationExceeded: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_consume_duration_exceeded_total",
+			Help: "Number of consumes of records read from Kafka which stopped before attempting all the records because the maximum consume duration has been exceeded.",
+		}),
+		pushTimeouts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_push_timeouts_total",
+			Help: "Number of pushes of the records read from Kafka to the storage which failed because they took longer than their timeout.",
+		}),
+		timeouts: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_timeouts_total",
+			Help: "Number of records read from Kafka whose processing took longer than the configured timeout, by the stage which timed out.",
+		}, []string{"stage"}),
+		readBackVerifications: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_read_back_verifications_total",
+			Help: "Number of samples of the records read from Kafka which have been read back from the storage once pushed, by whether the storage agreed with the pushed sample. Only tracked when the read-back verification is enabled.",
+		}, []string{"result"}),
+		stageDurationSeconds: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:                        "cortex_ingest_storage_reader_stage_duration_seconds",
+			Help:                        "Time each stage of the processing of the records read from Kafka has taken to process the write request of each record.",
+			NativeHistogramBucketFactor: 1.1,
+		}, []string{"stage"}),
+		stageErrors: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_stage_errors_total",
+			Help: "Number of records read from Kafka whose processing has been stopped by a stage, by the stage and the cause of the error, either a client error rejecting the record or a server error failing the consumption.",
+		}, []string{"stage", "cause"}),
+		backpressureDelayedRecords: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_backpressure_delayed_records_total",
+			Help: "Number of records read from Kafka whose push has been delayed because of the backpressure reported by the resource monitor.",
+		}),
+		backpressureDelaySeconds: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_backpressure_delay_seconds_total",
+			Help: "Total time spent waiting before pushing the records read from Kafka because of the backpressure reported by the resource monitor.",
+		}),
+		decodeBytesBudget: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_decode_bytes_budget",
+			Help: "Maximum number of bytes of records read from Kafka which can be decoded and waiting to be pushed to the storage at the same time. 0 if unlimited.",
+		}),
+		decodeBytesInUse: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_decode_bytes_in_use",
+			Help: "Number of bytes of records read from Kafka which are currently being decoded or waiting to be pushed to the storage.",
+		}),
+		tenantInflightBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_tenant_inflight_bytes",
+			Help: "Number of bytes of the tenant's records read from Kafka which are currently being decoded or waiting to be pushed to the storage. Only exported for the tracked tenants.",
+		}, []string{"user"}),
+		tenantInflightBytesWaits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_tenant_inflight_bytes_waits_total",
+			Help: "Number of records read from Kafka whose decoding has waited for the other records of their tenant to be pushed, because the tenant exceeded the maximum in-flight bytes.",
+		}),
+		exemplarOnlyRecords: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_exemplar_only_records_total",
+			Help: "Number of records read from Kafka with exemplars but no samples nor histograms, by the action taken on them: pushed as-is, exemplars dropped, or the record skipped.",
+		}, []string{"action"}),
+		exemplarsPerSecond: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_exemplars_per_second",
+			Help: "Rate of the exemplars of the write requests read from Kafka, before the exemplars exceeding the maximum rate are dropped. Only updated when the rate of the exemplars is limited.",
+		}),
+		exemplarsRateLimited: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_exemplars_rate_limited_total",
+			Help: "Number of exemplars dropped from the write requests read from Kafka because they exceeded the maximum rate of the exemplars.",
+		}),
+		quotaCheckDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:                        "cortex_ingest_storage_reader_quota_check_duration_seconds",
+			Help:                        "Time taken to check the quota of a tenant with the quota checker, when the result of the previous check has expired. The records rejected because their tenant has exceeded its quota are counted by cortex_ingest_storage_reader_rejected_records_total with the quota_exceeded reason.",
+			NativeHistogramBucketFactor: 1.1,
+		}),
+		quotaCheckFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_quota_check_failures_total",
+			Help: "Number of quota checks which failed, in which case the records of the tenant are pushed.",
+		}),
+		futureSamples: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_too_far_in_future_samples_total",
+			Help: "Number of samples and histograms of the write requests read from Kafka whose timestamp is further in the future than the configured tolerance.",
+		}),
+		duplicateSamples: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_duplicate_timestamp_samples_removed_total",
+			Help: "Number of samples and histograms of the write requests read from Kafka which have been removed because another sample of the same series had the same timestamp.",
+		}),
+		downsampledSamples: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_downsampled_samples_removed_total",
+			Help: "Number of samples and histograms of the write requests read from Kafka which have been removed by down-sampling their series.",
+		}),
+		rejectedRecords: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_rejected_records_total",
+			Help: "Number of records read from Kafka which have been rejected as a client error before being pushed to the storage.",
+		}, []string{"reason"}),
+		droppedSeries: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_dropped_series_total",
+			Help: "Number of series dropped from the write requests read from Kafka because of the tenant's limits.",
+		}, []string{"reason"}),
+		injectedLabelsSeries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_injected_labels_series_total",
+			Help: "Number of series of the write requests read from Kafka whose labels have changed because of the labels injected by the tenant's limits.",
+		}),
+		pushRetries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_push_retries_total",
+			Help: "Number of retries of the records read from Kafka which failed to be pushed to the storage with a server error.",
+		}),
+		retriesPerRecord: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_ingest_storage_reader_retries_per_record",
+			Help:    "Number of retries of each record read from Kafka pushed to the storage, observed once the record has finally been pushed or has failed. Only observed when the retries of the records are enabled.",
+			Buckets: []float64{0, 1, 2, 3, 5, 8, 13, 21},
+		}),
+		retryBudgetRemaining: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_retry_budget_remaining",
+			Help: "Number of retries left in the retry budget of the batch of records read from Kafka being consumed.",
+		}),
+		splitRequests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_split_requests_total",
+			Help: "Number of write requests read from Kafka which have been split into partial write requests before being pushed to the storage, because they were too large.",
+		}),
+		splitPartialRequests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_split_partial_requests_total",
+			Help: "Number of partial write requests pushed to the storage after splitting the too large write requests read from Kafka.",
+		}),
+		heartbeatFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_heartbeat_push_failures_total",
+			Help: "Number of heartbeat series which failed to be pushed to the storage after consuming a batch of records read from Kafka.",
+		}),
+		slowConsumeProfiles: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_slow_consume_profiles_total",
+			Help: "Number of profiles captured because pushing a batch of records read from Kafka to the storage has taken longer than the threshold.",
+		}),
 	}
+
+	// The default backend of the storage pushers doesn't observe the processing time, which is tracked by the consumer.
+	m.storagePusherMetrics.backend = &prometheusConsumerMetrics{
+		total:      m.storagePusherMetrics.totalRequests,
+		failed:     m.storagePusherMetrics.errRequests,
+		processing: m.processingTimeSeconds,
+	}
+
+	m.inflightPushes = newInflightPushes()
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_ingest_storage_reader_oldest_inflight_push_age_seconds",
+		Help: "Time since the oldest push of the records read from Kafka to the storage which hasn't completed yet has started, or 0 if there's no push in flight. A steadily rising value reveals a push which hangs.",
+	}, func() float64 {
+		return m.inflightPushes.oldestAge().Seconds()
+	})
+	return m
+}
+
+// ConsumerMetricsSnapshot is a point-in-time view of the metrics of the records consumed from Kafka.
+// The values are cumulative since the PartitionReader has been created.
+type ConsumerMetricsSnapshot struct {
+	// TotalRequests is the number of write requests attempted to be pushed to the storage.
+	TotalRequests uint64
+	// ClientErrorRequests is the number of write requests which failed with a client error.
+	ClientErrorRequests uint64
+	// ServerErrorRequests is the number of write requests which failed with a server error.
+	ServerErrorRequests uint64
+
+	// ProcessingTimeP50 and ProcessingTimeP99 are the estimated quantiles of the time taken to process a batch of fetched records.
+	ProcessingTimeP50 time.Duration
+	ProcessingTimeP99 time.Duration
+}
+
+// snapshot returns the current values of the metrics. Counters are read without locking.
+// It only reflects the Prometheus metrics, so its values are zero when an alternate ConsumerMetrics is used.
+func (m *pusherConsumerMetrics) snapshot() ConsumerMetricsSnapshot {
+	processingTime := &dto.Metric{}
+	if err := m.processingTimeSeconds.Write(processingTime); err != nil {
+		processingTime = nil
+	}
+
+	return ConsumerMetricsSnapshot{
+		TotalRequests:       counterValue(m.storagePusherMetrics.totalRequests),
+		ClientErrorRequests: counterValue(m.storagePusherMetrics.clientErrRequests),
+		ServerErrorRequests: counterValue(m.storagePusherMetrics.serverErrRequests),
+		ProcessingTimeP50:   histogramQuantile(0.5, processingTime),
+		ProcessingTimeP99:   histogramQuantile(0.99, processingTime),
+	}
+}
+
+func counterValue(c prometheus.Counter) uint64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		return 0
+	}
+	return uint64(m.GetCounter().GetValue())
+}
+
+// histogramQuantile estimates the quantile q of the observations in seconds of a classic histogram,
+// interpolating linearly within the bucket the quantile falls into like PromQL's histogram_quantile() does.
+func histogramQuantile(q float64, m *dto.Metric) time.Duration {
+	h := m.GetHistogram()
+	count := float64(h.GetSampleCount())
+	if count == 0 {
+		return 0
+	}
+
+	rank := q * count
+	lowerBound, lowerCount := 0.0, 0.0
+	for _, b := range h.GetBucket() {
+		upperBound, upperCount := b.GetUpperBound(), float64(b.GetCumulativeCount())
+		if upperCount >= rank {
+			if math.IsInf(upperBound, 1) {
+				// We can't interpolate in the +Inf bucket, so return its lower bound.
+				return time.Duration(lowerBound * float64(time.Second))
+			}
+			if upperCount == lowerCount {
+				return time.Duration(upperBound * float64(time.Second))
+			}
+			value := lowerBound + (upperBound-lowerBound)*(rank-lowerCount)/(upperCount-lowerCount)
+			return time.Duration(value * float64(time.Second))
+		}
+		lowerBound, lowerCount = upperBound, upperCount
+	}
+
+	// All the observations are above the highest bucket.
+	return time.Duration(lowerBound * float64(time.Second))
 }
 
 // storagePusherMetrics holds the metrics for both the sequentialStoragePusher and the parallelStoragePusher.
 type storagePusherMetrics struct {
 	// batchAge is not really important unless we're pushing many things at once, so it's only used as part of parallelStoragePusher.
-	batchAge             prometheus.Histogram
-	processingTime       *prometheus.HistogramVec
-	timeSeriesPerFlush   prometheus.Histogram
-	shardsPerPush        prometheus.Histogram
-	pushersPerPush       prometheus.Histogram
-	estimatedTimeseries  prometheus.Counter
-	batchingQueueMetrics *batchingQueueMetrics
-	clientErrRequests    prometheus.Counter
-	serverErrRequests    prometheus.Counter
-	totalRequests        prometheus.Counter
+	batchAge                    prometheus.Histogram
+	processingTime              *prometheus.HistogramVec
+	timeSeriesPerFlush          prometheus.Histogram
+	shardsPerPush               prometheus.Histogram
+	pushersPerPush              prometheus.Histogram
+	estimatedTimeseries         prometheus.Counter
+	batchingQueueMetrics        *batchingQueueMetrics
+	errRequests                 *prometheus.CounterVec
+	errRequestsByCode           *prometheus.CounterVec
+	serverErrRequestsBySubcause *prometheus.CounterVec
+	errorPolicyDecisions        *prometheus.CounterVec
+	clientErrRequests           prometheus.Counter
+	serverErrRequests           prometheus.Counter
+	totalRequests               prometheus.Counter
+
+	// pushWorkersBusy and pushWorkerBusyTime track the utilization of the workers pushing in parallel.
+	pushWorkersBusy    prometheus.Gauge
+	pushWorkerBusyTime prometheus.Histogram
+
+	// backend receives the total and failed requests, which by default are the Prometheus metrics above.
+	backend ConsumerMetrics
 }
 
 // newStoragePusherMetrics creates a new storagePusherMetrics instance.
@@ -53,8 +607,20 @@ func newStoragePusherMetrics(reg prometheus.Registerer) *storagePusherMetrics {
 		Help: "Number of write requests which caused errors while processing. Client errors are errors such as tenant limits and samples out of bounds. Server errors indicate internal recoverable errors.",
 	}, []string{"cause"})
 
-	return &storagePusherMetrics{
+	m := &storagePusherMetrics{
 		batchingQueueMetrics: newBatchingQueueMetrics(reg),
+		errRequestsByCode: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_requests_failed_by_code_total",
+			Help: "Number of write requests which caused errors while processing, by the gRPC status code of the error, or unknown if the error has no gRPC status.",
+		}, []string{"code"}),
+		serverErrRequestsBySubcause: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_requests_failed_server_errors_total",
+			Help: "Number of write requests which failed with a server error, by the subcause of the error: network if the storage couldn't be reached, application if the storage failed to process the request.",
+		}, []string{"subcause"}),
+		errorPolicyDecisions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_error_policy_decisions_total",
+			Help: "Number of write requests which failed to be pushed to the storage, by the action decided by the error policy.",
+		}, []string{"action"}),
 		batchAge: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
 			Name:                        "cortex_ingest_storage_reader_pusher_batch_age_seconds",
 			Help:                        "Age of the batch of samples that are being ingested by an ingestion shard. This is the time since adding the first sample to the batch. Higher values indicates that the batching queue is not processing fast enough or that the batches are not filling up fast enough.",
@@ -80,8 +646,9 @@ func newStoragePusherMetrics(reg prometheus.Registerer) *storagePusherMetrics {
 			Help:                        "Number of pushers that are pushed to in each batch. There is one pusher for each unique tenant and Source tuple.",
 			NativeHistogramBucketFactor: 1.1,
 		}),
-		clientErrRequests: errRequestsCounter.WithLabelValues("client"),
-		serverErrRequests: errRequestsCounter.WithLabelValues("server"),
+		errRequests:       errRequestsCounter,
+		clientErrRequests: errRequestsCounter.WithLabelValues(FailureCauseClient),
+		serverErrRequests: errRequestsCounter.WithLabelValues(FailureCauseServer),
 		totalRequests: promauto.With(reg).NewCounter(prometheus.CounterOpts{
 			Name: "cortex_ingest_storage_reader_requests_total",
 			Help: "Number of attempted write requests after batching records from Kafka.",
@@ -90,13 +657,73 @@ func newStoragePusherMetrics(reg prometheus.Registerer) *storagePusherMetrics {
 			Name: "cortex_ingest_storage_reader_pusher_estimated_timeseries_total",
 			Help: "The estimated number of time series expected to be pushed to each shard. This is based on the decompressed size of records and is used to determine how many shards to use for each tenant for each batch. If the estimation is good, then it should match histogram_sum(cortex_ingest_storage_reader_pusher_timeseries_per_flush).",
 		}),
+		pushWorkersBusy: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_push_workers_busy",
+			Help: "Number of workers pushing in parallel, either ingestion shards or relaxed ordering workers, which are currently pushing to the storage.",
+		}),
+		pushWorkerBusyTime: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:                        "cortex_ingest_storage_reader_push_worker_busy_seconds",
+			Help:                        "Total time each worker pushing in parallel has spent pushing to the storage, observed once the worker has stopped at the end of the consumed batch. Values much lower than the time to consume the batch indicate that there are more workers than needed.",
+			NativeHistogramBucketFactor: 1.1,
+		}),
 	}
+	m.backend = &prometheusConsumerMetrics{total: m.totalRequests, failed: m.errRequests}
+	return m
+}
+
+// pushWorkerTracker tracks the time a worker pushing in parallel is busy pushing to the storage. It's not safe for
+// concurrent use, so each worker has its own.
+type pushWorkerTracker struct {
+	metrics *storagePusherMetrics
+	busy    time.Duration
+	since   time.Time
+}
+
+func newPushWorkerTracker(metrics *storagePusherMetrics) *pushWorkerTracker {
+	return &pushWorkerTracker{metrics: metrics}
+}
+
+// acquire marks the worker as busy.
+func (t *pushWorkerTracker) acquire() {
+	t.metrics.pushWorkersBusy.Inc()
+	t.since = time.Now()
+}
+
+// release marks the worker as idle.
+func (t *pushWorkerTracker) release() {
+	t.busy += time.Since(t.since)
+	t.metrics.pushWorkersBusy.Dec()
+}
+
+// stop observes the total time the worker has been busy. It must be called once the worker has stopped.
+func (t *pushWorkerTracker) stop() {
+	t.metrics.pushWorkerBusyTime.Observe(t.busy.Seconds())
 }
 
 // batchingQueueMetrics holds the metrics for the batchingQueue.
+// seriesPerPushObservingPusher is a Pusher middleware which observes the number of series of each write request
+// pushed to the upstream Pusher. The number is taken before pushing, because the request may be freed by the push.
+type seriesPerPushObservingPusher struct {
+	upstream      Pusher
+	seriesPerPush prometheus.Histogram
+}
+
+// PushToStorage implements the Pusher interface.
+func (p seriesPerPushObservingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	p.seriesPerPush.Observe(float64(len(req.Timeseries)))
+	return p.upstream.PushToStorage(ctx, req)
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+// The series of the raw pushes aren't observed, because they aren't decoded.
+func (p seriesPerPushObservingPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	return p.upstream.(RawPusher).PushRawToStorage(ctx, tenantID, content)
+}
+
 type batchingQueueMetrics struct {
 	flushTotal       prometheus.Counter
 	flushErrorsTotal prometheus.Counter
+	idleFlushTotal   prometheus.Counter
 }
 
 // newBatchingQueueMetrics creates a new batchingQueueMetrics instance.
@@ -110,5 +737,9 @@ func newBatchingQueueMetrics(reg prometheus.Registerer) *batchingQueueMetrics {
 			Name: "cortex_ingest_storage_reader_batching_queue_flush_errors_total",
 			Help: "Number of errors encountered while flushing a batch of samples to the storage.",
 		}),
+		idleFlushTotal: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_batching_queue_idle_flush_total",
+			Help: "Number of times a batch of samples is flushed to the storage before being full, because no samples of the same tenant have been read from Kafka for the idle flush timeout.",
+		}),
 	}
 }
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+)
+
+// metricsBatch holds the metrics accumulated locally to a consumed batch of records, until they're flushed to the
+// shared metrics. A nil *metricsBatch is a no-op.
+type metricsBatch struct {
+	counters   []*batchedCounter
+	histograms []*batchedHistogram
+}
+
+// batched returns a copy of the metrics whose per-record metrics are accumulated locally to the returned batch
+// instead of updating the shared metrics, which are only updated when the batch is flushed. The other metrics are
+// shared with m.
+func (m *pusherConsumerMetrics) batched() (*pusherConsumerMetrics, *metricsBatch) {
+	b := &metricsBatch{}
+
+	metrics := *m
+	metrics.recordsDecoded = b.counter(m.recordsDecoded)
+	metrics.rawRecords = b.counter(m.rawRecords)
+	metrics.floatSamples = b.counter(m.floatSamples)
+	metrics.nativeHistograms = b.counter(m.nativeHistograms)
+	metrics.unmarshalSendBlocked = b.counter(m.unmarshalSendBlocked)
+	metrics.recordBytesPerSample = b.histogram(m.recordBytesPerSample)
+	metrics.unmarshalSendWaitSeconds = b.histogram(m.unmarshalSendWaitSeconds)
+	metrics.decodeQueueSeconds = b.histogram(m.decodeQueueSeconds)
+	metrics.retriesPerRecord = b.histogram(m.retriesPerRecord)
+
+	storagePusherMetrics := *m.storagePusherMetrics
+	storagePusherMetrics.totalRequests = b.counter(m.storagePusherMetrics.totalRequests)
+	storagePusherMetrics.timeSeriesPerFlush = b.histogram(m.storagePusherMetrics.timeSeriesPerFlush)
+	// An alternate ConsumerMetrics receives the total requests as they're pushed.
+	if backend, ok := m.storagePusherMetrics.backend.(*prometheusConsumerMetrics); ok {
+		batchedBackend := *backend
+		batchedBackend.total = storagePusherMetrics.totalRequests
+		storagePusherMetrics.backend = &batchedBackend
+	}
+	metrics.storagePusherMetrics = &storagePusherMetrics
+
+	return &metrics, b
+}
+
+func (b *metricsBatch) counter(c prometheus.Counter) *batchedCounter {
+	batched := &batchedCounter{Counter: c}
+	b.counters = append(b.counters, batched)
+	return batched
+}
+
+func (b *metricsBatch) histogram(h prometheus.Histogram) *batchedHistogram {
+	batched := &batchedHistogram{Histogram: h}
+	b.histograms = append(b.histograms, batched)
+	return batched
+}
+
+// flush adds the accumulated metrics to the shared metrics. The metrics updated after the flush, for example by the
+// goroutines still running once the consumption has failed, directly update the shared metrics.
+func (b *metricsBatch) flush() {
+	if b == nil {
+		return
+	}
+
+	for _, c := range b.counters {
+		c.flush()
+	}
+	for _, h := range b.histograms {
+		h.flush()
+	}
+}
+
+// batchedCounter is a prometheus.Counter accumulating its increments locally until it's flushed to the wrapped counter.
+// It's safe for concurrent use.
+type batchedCounter struct {
+	prometheus.Counter
+
+	pending atomic.Float64
+	flushed atomic.Bool
+}
+
+func (c *batchedCounter) Inc() {
+	c.Add(1)
+}
+
+func (c *batchedCounter) Add(v float64) {
+	if c.flushed.Load() {
+		c.Counter.Add(v)
+		return
+	}
+	c.pending.Add(v)
+}
+
+func (c *batchedCounter) flush() {
+	c.flushed.Store(true)
+	if v := c.pending.Load(); v != 0 {
+		c.pending.Sub(v)
+		c.Counter.Add(v)
+	}
+}
+
+// batchedHistogram is a prometheus.Histogram accumulating its observations locally until they're observed by the
+// wrapped histogram when it's flushed. It's safe for concurrent use.
+type batchedHistogram struct {
+	prometheus.Histogram
+
+	mx      sync.Mutex
+	pending []float64
+	flushed bool
+}
+
+func (h *batchedHistogram) Observe(v float64) {
+	h.mx.Lock()
+	if !h.flushed {
+		h.pending = append(h.pending, v)
+		h.mx.Unlock()
+		return
+	}
+	h.mx.Unlock()
+
+	h.Histogram.Observe(v)
+}
+
+func (h *batchedHistogram) flush() {
+	h.mx.Lock()
+	pending := h.pending
+	h.pending, h.flushed = nil, true
+	h.mx.Unlock()
+
+	for _, v := range pending {
+		h.Histogram.Observe(v)
+	}
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_BatchMetrics(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+		makeRecord(t, "user-2", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}}, nil),
+	}
+
+	for _, batchMetrics := range []bool{false, true} {
+		t.Run(fmt.Sprintf("batch metrics: %t", batchMetrics), func(t *testing.T) {
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+
+			var decodedWhilePushing []float64
+			pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+				decodedWhilePushing = append(decodedWhilePushing, testutil.ToFloat64(metrics.recordsDecoded))
+				return nil
+			})
+
+			c := newPusherConsumer(pusher, KafkaConfig{IngestionBatchMetrics: batchMetrics}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+			require.NoError(t, c.Consume(context.Background(), records))
+
+			// The metrics are only updated once the batch has been consumed when they're batched.
+			require.Len(t, decodedWhilePushing, len(records))
+			if batchMetrics {
+				assert.Equal(t, []float64{0, 0, 0}, decodedWhilePushing)
+			} else {
+				assert.NotEqual(t, []float64{0, 0, 0}, decodedWhilePushing)
+			}
+
+			assert.Equal(t, float64(len(records)), testutil.ToFloat64(metrics.recordsDecoded))
+			assert.Equal(t, float64(len(records)), testutil.ToFloat64(metrics.floatSamples))
+			assert.Equal(t, float64(len(records)), testutil.ToFloat64(metrics.storagePusherMetrics.totalRequests))
+
+			metric := &dto.Metric{}
+			require.NoError(t, metrics.recordBytesPerSample.Write(metric))
+			assert.Equal(t, uint64(len(records)), metric.GetHistogram().GetSampleCount())
+		})
+	}
+}
+
+func TestMetricsBatch_FlushedMetrics(t *testing.T) {
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	batched, batch := metrics.batched()
+
+	batched.recordsDecoded.Add(2)
+	batched.recordBytesPerSample.Observe(10)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.recordsDecoded))
+
+	batch.flush()
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.recordsDecoded))
+
+	// The metrics updated once the batch has been flushed directly update the shared metrics.
+	batched.recordsDecoded.Inc()
+	batched.recordBytesPerSample.Observe(20)
+	assert.Equal(t, float64(3), testutil.ToFloat64(metrics.recordsDecoded))
+
+	metric := &dto.Metric{}
+	require.NoError(t, metrics.recordBytesPerSample.Write(metric))
+	assert.Equal(t, uint64(2), metric.GetHistogram().GetSampleCount())
+	assert.Equal(t, float64(30), metric.GetHistogram().GetSampleSum())
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// ConsumeWithLastProcessedOffset is like Consume, but it also returns the highest offset of the records such that the
+// records at that offset and all the lower offsets have been processed: they've either been pushed to the storage or
+// definitively skipped, for example because of a client error. It's -1 if no record has been processed. Committing the
+// returned offset guarantees that the records are consumed at least once, even if the consumption fails.
+//
+// When the consumption fails, the records whose push error can't be attributed to them, because they're pushed by the
+// ingestion shards or their metadata is pushed separately, aren't considered processed.
+func (c pusherConsumer) ConsumeWithLastProcessedOffset(ctx context.Context, records []record) (int64, error) {
+	c.offsets = newProcessedOffsets(records)
+	err := c.Consume(ctx, records)
+
+	// The records consumed before the maximum number of records or the maximum duration of a consume has been reached
+	// have been processed.
+	var unprocessed *unprocessedRecordsError
+	if err != nil && !errors.As(err, &unprocessed) && !c.pushErrorsAttributable() {
+		return -1, err
+	}
+	return c.offsets.lastProcessed(), err
+}
+
+// safeLastProcessedOffset returns the last processed offset of the records tracked by ConsumeWithLastProcessedOffset,
+// or -1 if the offsets aren't tracked or the records for which no error has been returned may not have been pushed.
+func (c pusherConsumer) safeLastProcessedOffset() int64 {
+	if c.offsets == nil || !c.pushErrorsAttributable() {
+		return -1
+	}
+	return c.offsets.lastProcessed()
+}
+
+// pushErrorsAttributable returns whether the error of each push is returned by the storage writer for the record being
+// pushed, so that the records for which no error has been returned have been successfully pushed.
+func (c pusherConsumer) pushErrorsAttributable() bool {
+	cfg := c.kafkaConfig
+	sequential := cfg.IngestionOrdering == ingestionOrderingRelaxed || cfg.IngestionConcurrencyMax == 0
+	return sequential && cfg.MetadataOnlyConcurrency == 0 && !cfg.DeferMetadataPushes
+}
+
+// markProcessed records that the record at the offset has been processed.
+func (c pusherConsumer) markProcessed(offset int64) {
+	c.lagTracker.processed(offset)
+	c.offsets.processed(offset)
+}
+
+// processedOffsets tracks the offsets of the records of a consume which have been processed. The records split from a
+// batch share the offset of the batch, which is only processed once all its records have been split and processed.
+// It's safe for concurrent use. A nil *processedOffsets tracks nothing.
+type processedOffsets struct {
+	// offsets are the distinct offsets of the consumed records, in ascending order.
+	offsets []int64
+
+	mx sync.Mutex
+	// unsplit are the offsets of the batches which haven't been completely split yet.
+	unsplit map[int64]struct{}
+	// done are the offsets with at least a processed record, and failed the ones with at least a failed record.
+	done   map[int64]struct{}
+	failed map[int64]struct{}
+}
+
+func newProcessedOffsets(records []record) *processedOffsets {
+	p := &processedOffsets{
+		offsets: make([]int64, 0, len(records)),
+		unsplit: map[int64]struct{}{},
+		done:    make(map[int64]struct{}, len(records)),
+		failed:  map[int64]struct{}{},
+	}
+	for _, r := range records {
+		p.offsets = append(p.offsets, r.offset)
+		if isBatch(r.content) {
+			p.unsplit[r.offset] = struct{}{}
+		}
+	}
+	slices.Sort(p.offsets)
+	p.offsets = slices.Compact(p.offsets)
+	return p
+}
+
+func (p *processedOffsets) processed(offset int64) {
+	p.mark(offset, func() { p.done[offset] = struct{}{} })
+}
+
+func (p *processedOffsets) fail(offset int64) {
+	p.mark(offset, func() { p.failed[offset] = struct{}{} })
+}
+
+// split records that all the records of the batch at the offset have been split.
+func (p *processedOffsets) split(offset int64) {
+	p.mark(offset, func() { delete(p.unsplit, offset) })
+}
+
+func (p *processedOffsets) mark(offset int64, fn func()) {
+	if p == nil {
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	fn()
+}
+
+// lastProcessed returns the highest offset such that it and all the lower offsets have been processed, or -1 if none.
+func (p *processedOffsets) lastProcessed() int64 {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	last := int64(-1)
+	for _, offset := range p.offsets {
+		_, done := p.done[offset]
+		_, failed := p.failed[offset]
+		_, unsplit := p.unsplit[offset]
+		if !done || failed || unsplit {
+			break
+		}
+		last = offset
+	}
+	return last
+}
@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_ConsumeWithLastProcessedOffset(t *testing.T) {
+	newRecord := func(offset int64, metricName string) record {
+		r := makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+		r.offset = offset
+		return r
+	}
+	newBatchRecord := func(offset int64, metricNames ...string) record {
+		var wrs []*mimirpb.WriteRequest
+		for _, metricName := range metricNames {
+			wrs = append(wrs, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}})
+		}
+		r := makeBatchRecord(t, "user-1", nil, wrs...)
+		r.offset = offset
+		return r
+	}
+
+	serverErr := errors.New("storage unavailable")
+	clientErr := ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "out of order sample")
+
+	tests := map[string]struct {
+		cfg                   KafkaConfig
+		records               []record
+		failures              map[string]error
+		expectedLastProcessed int64
+		expectedErr           bool
+	}{
+		"should return the last offset if all the records have been pushed": {
+			records:               []record{newRecord(10, "series_1"), newRecord(11, "series_2"), newRecord(12, "series_3")},
+			expectedLastProcessed: 12,
+		},
+		"should return -1 if there's no record": {
+			expectedLastProcessed: -1,
+		},
+		"should return the offset before the record failing with a server error": {
+			records:               []record{newRecord(10, "series_1"), newRecord(11, "series_2"), newRecord(12, "series_3")},
+			failures:              map[string]error{"series_2": serverErr},
+			expectedLastProcessed: 10,
+			expectedErr:           true,
+		},
+		"should return -1 if the first record fails with a server error": {
+			records:               []record{newRecord(10, "series_1"), newRecord(11, "series_2")},
+			failures:              map[string]error{"series_1": serverErr},
+			expectedLastProcessed: -1,
+			expectedErr:           true,
+		},
+		"should consider the records skipped because of a client error processed": {
+			records:               []record{newRecord(10, "series_1"), newRecord(11, "series_2"), newRecord(12, "series_3")},
+			failures:              map[string]error{"series_2": clientErr},
+			expectedLastProcessed: 12,
+		},
+		"should consider the records which can't be parsed processed": {
+			records:               []record{newRecord(10, "series_1"), {ctx: context.Background(), tenantID: "user-1", content: []byte("invalid"), offset: 11}, newRecord(12, "series_3"), newRecord(13, "series_4")},
+			failures:              map[string]error{"series_4": serverErr},
+			expectedLastProcessed: 12,
+			expectedErr:           true,
+		},
+		"should not consider a batch processed if one of its records fails": {
+			records:               []record{newRecord(10, "series_1"), newBatchRecord(11, "series_2", "series_3"), newRecord(12, "series_4")},
+			failures:              map[string]error{"series_3": serverErr},
+			expectedLastProcessed: 10,
+			expectedErr:           true,
+		},
+		"should consider a batch processed once all its records have been pushed": {
+			records:               []record{newRecord(10, "series_1"), newBatchRecord(11, "series_2", "series_3"), newRecord(12, "series_4")},
+			failures:              map[string]error{"series_4": serverErr},
+			expectedLastProcessed: 11,
+			expectedErr:           true,
+		},
+		"should return the last offset of the records consumed before the max number of records per consume": {
+			cfg:                   KafkaConfig{MaxRecordsPerConsume: 2},
+			records:               []record{newRecord(10, "series_1"), newRecord(11, "series_2"), newRecord(12, "series_3")},
+			expectedLastProcessed: 11,
+			expectedErr:           true,
+		},
+		"should return -1 if the push errors can't be attributed to the records": {
+			cfg:                   KafkaConfig{IngestionConcurrencyMax: 2, IngestionConcurrencyBatchSize: 10, IngestionConcurrencyQueueCapacity: 1, IngestionConcurrencyEstimatedBytesPerSample: 100, IngestionConcurrencyTargetFlushesPerShard: 1},
+			records:               []record{newRecord(10, "series_1"), newRecord(11, "series_2"), newRecord(12, "series_3")},
+			failures:              map[string]error{"series_3": serverErr},
+			expectedLastProcessed: -1,
+			expectedErr:           true,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pusher := pusherFunc(func(_ context.Context, req *mimirpb.WriteRequest) error {
+				for _, ts := range req.Timeseries {
+					if err := testData.failures[ts.Labels[0].Value]; err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+			c := newPusherConsumer(pusher, testData.cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+			lastProcessed, err := c.ConsumeWithLastProcessedOffset(context.Background(), testData.records)
+			if testData.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, testData.expectedLastProcessed, lastProcessed)
+		})
+	}
+}
@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// RecordOrdering returns the order the records of a batch should be pushed in, given their offsets in the order
+// they have been fetched. The returned slice holds the position in offsets of each record to push, and must
+// reference each record exactly once.
+type RecordOrdering func(offsets []int64) []int
+
+// NewestOffsetFirst is a RecordOrdering which pushes the records with the highest offsets first.
+func NewestOffsetFirst(offsets []int64) []int {
+	order := make([]int, len(offsets))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(offsets[b], offsets[a])
+	})
+	return order
+}
+
+// WithRecordOrdering configures the consumer to push the records of each batch in the order returned by the
+// given RecordOrdering, for example to make the most recent data queryable first while replaying a large backlog.
+// By default, the records are pushed in the order they have been fetched, which is the offset order.
+//
+// The ordering only applies within the batch of records given to each Consume call, and when
+// -ingest-storage.kafka.max-records-per-consume is set it applies to each chunk of records consumed at once.
+// A non-sequential ordering has the following implications:
+//
+//   - The offset of a batch is committed only once all its records have been consumed, so on restart the whole
+//     batch is consumed again, regardless of the order its records have been pushed in.
+//   - The samples of a series spread across several records are pushed out of order, so they're rejected by the
+//     storage as out-of-order samples unless the out-of-order time window covers them.
+//   - The consumer lag tracks the highest offset pushed, so it may be reported lower than it actually is while
+//     a batch is being consumed.
+//   - The Index of each RecordOutcome is the position of the record in the order it's been pushed in.
+func WithRecordOrdering(ordering RecordOrdering) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.recordOrdering = ordering
+	}
+}
+
+// orderRecords returns the records in the order they should be pushed in. The records given are never reordered in
+// place, because they're consumed again in the fetched order if the consumption fails.
+func (c pusherConsumer) orderRecords(records []record) ([]record, error) {
+	records, err := c.orderRecordsByOffset(records)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.kafkaConfig.IngestionTenantNewestFirst {
+		records = orderTenantRecordsNewestFirst(records)
+	}
+	if c.kafkaConfig.IngestionGroupRecordsByTenant {
+		records = groupRecordsByTenant(records)
+	}
+	return records, nil
+}
+
+// orderRecordsByOffset returns the records in the order returned by the RecordOrdering, if any.
+func (c pusherConsumer) orderRecordsByOffset(records []record) ([]record, error) {
+	if c.recordOrdering == nil {
+		return records, nil
+	}
+
+	offsets := make([]int64, len(records))
+	for i, r := range records {
+		offsets[i] = r.offset
+	}
+
+	order := c.recordOrdering(offsets)
+	if len(order) != len(records) {
+		return nil, fmt.Errorf("invalid record ordering: got %d positions for %d records", len(order), len(records))
+	}
+
+	seen := make([]bool, len(records))
+	ordered := make([]record, 0, len(records))
+	for _, pos := range order {
+		if pos < 0 || pos >= len(records) || seen[pos] {
+			return nil, fmt.Errorf("invalid record ordering: position %d is out of range or repeated", pos)
+		}
+		seen[pos] = true
+		ordered = append(ordered, records[pos])
+	}
+	return ordered, nil
+}
+
+// groupRecordsByTenant returns the records grouped by tenant, with the tenants in the order they first appear in the
+// records. The sort is stable, so the records of each tenant keep their order. The records of a batch record aren't
+// split from it, so they're grouped with the records of the tenant of the batch record.
+func groupRecordsByTenant(records []record) []record {
+	positions := map[string]int{}
+	for _, r := range records {
+		if _, ok := positions[r.tenantID]; !ok {
+			positions[r.tenantID] = len(positions)
+		}
+	}
+	if len(positions) <= 1 {
+		return records
+	}
+
+	grouped := slices.Clone(records)
+	slices.SortStableFunc(grouped, func(a, b record) int {
+		return cmp.Compare(positions[a.tenantID], positions[b.tenantID])
+	})
+	return grouped
+}
+
+// orderTenantRecordsNewestFirst returns the records with the records of each tenant in descending order of their Kafka
+// timestamp, and of their offset for the records with the same timestamp. The records of each tenant take the
+// positions held by the records of the tenant, so the records of the different tenants are still interleaved as they
+// were. The records without a timestamp are pushed after the records of the same tenant with one.
+func orderTenantRecordsNewestFirst(records []record) []record {
+	positions := map[string][]int{}
+	for i, r := range records {
+		positions[r.tenantID] = append(positions[r.tenantID], i)
+	}
+
+	ordered := make([]record, len(records))
+	tenantRecords := make([]record, 0, len(records))
+	for _, pos := range positions {
+		tenantRecords = tenantRecords[:0]
+		for _, i := range pos {
+			tenantRecords = append(tenantRecords, records[i])
+		}
+		slices.SortStableFunc(tenantRecords, func(a, b record) int {
+			return cmp.Or(b.timestamp.Compare(a.timestamp), cmp.Compare(b.offset, a.offset))
+		})
+		for j, i := range pos {
+			ordered[i] = tenantRecords[j]
+		}
+	}
+	return ordered
+}
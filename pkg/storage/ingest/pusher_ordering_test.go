@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestNewestOffsetFirst(t *testing.T) {
+	assert.Equal(t, []int{}, NewestOffsetFirst(nil))
+	assert.Equal(t, []int{2, 1, 0}, NewestOffsetFirst([]int64{10, 11, 12}))
+	assert.Equal(t, []int{1, 2, 0}, NewestOffsetFirst([]int64{10, 12, 11}))
+}
+
+func TestPusherConsumer_WithRecordOrdering(t *testing.T) {
+	var records []record
+	for i, metricName := range []string{"series_0", "series_1", "series_2"} {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		records = append(records, record{ctx: context.Background(), tenantID: "user-1", content: content, offset: int64(100 + i)})
+	}
+
+	tests := map[string]struct {
+		ordering       RecordOrdering
+		expectedPushed []string
+		expectedErr    string
+	}{
+		"should push the records in the fetched order by default": {
+			expectedPushed: []string{"series_0", "series_1", "series_2"},
+		},
+		"should push the records with the newest offset first": {
+			ordering:       NewestOffsetFirst,
+			expectedPushed: []string{"series_2", "series_1", "series_0"},
+		},
+		"should push the records in a custom order": {
+			ordering:       func([]int64) []int { return []int{1, 0, 2} },
+			expectedPushed: []string{"series_1", "series_0", "series_2"},
+		},
+		"should fail if the ordering misses some records": {
+			ordering:    func([]int64) []int { return []int{1, 0} },
+			expectedErr: "invalid record ordering: got 2 positions for 3 records",
+		},
+		"should fail if the ordering repeats a record": {
+			ordering:    func([]int64) []int { return []int{1, 1, 2} },
+			expectedErr: "invalid record ordering: position 1 is out of range or repeated",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var pushed []string
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+				return nil
+			})
+
+			var opts []PusherConsumerOption
+			if testData.ordering != nil {
+				opts = append(opts, WithRecordOrdering(testData.ordering))
+			}
+
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), opts...)
+			err := c.Consume(context.Background(), records)
+			if testData.expectedErr != "" {
+				require.EqualError(t, err, testData.expectedErr)
+				assert.Empty(t, pushed)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testData.expectedPushed, pushed)
+		})
+	}
+}
+
+func TestPusherConsumer_GroupRecordsByTenant(t *testing.T) {
+	var records []record
+	for i, tenantID := range []string{"user-2", "user-1", "user-2", "user-3", "user-1"} {
+		records = append(records, makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}, nil))
+		records[i].offset = int64(100 + i)
+	}
+	fetched := slices.Clone(records)
+
+	tests := map[string]struct {
+		ordering       RecordOrdering
+		expectedPushed []string
+	}{
+		"should push the records grouped by tenant in the order each tenant first appears": {
+			expectedPushed: []string{"series_0", "series_2", "series_1", "series_4", "series_3"},
+		},
+		"should group the records by tenant once they've been ordered": {
+			ordering:       NewestOffsetFirst,
+			expectedPushed: []string{"series_4", "series_1", "series_3", "series_2", "series_0"},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var pushed []string
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+				return nil
+			})
+
+			var opts []PusherConsumerOption
+			if testData.ordering != nil {
+				opts = append(opts, WithRecordOrdering(testData.ordering))
+			}
+			c := newPusherConsumer(pusher, KafkaConfig{IngestionGroupRecordsByTenant: true}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), opts...)
+			require.NoError(t, c.Consume(context.Background(), records))
+
+			assert.Equal(t, testData.expectedPushed, pushed)
+			// The records are consumed again in the fetched order if the consumption fails.
+			assert.Equal(t, fetched, records)
+		})
+	}
+}
+
+func TestPusherConsumer_TenantNewestFirst(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	var records []record
+	for i, r := range []struct {
+		tenantID  string
+		timestamp time.Time
+	}{
+		{tenantID: "user-2", timestamp: base},
+		{tenantID: "user-1", timestamp: base.Add(time.Second)},
+		{tenantID: "user-2", timestamp: base.Add(2 * time.Second)},
+		{tenantID: "user-3", timestamp: base},
+		{tenantID: "user-1", timestamp: base.Add(time.Second)},
+		{tenantID: "user-2", timestamp: base.Add(time.Second)},
+	} {
+		records = append(records, makeRecord(t, r.tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}, nil))
+		records[i].offset = int64(100 + i)
+		records[i].timestamp = r.timestamp
+	}
+	fetched := slices.Clone(records)
+
+	var pushed []string
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	c := newPusherConsumer(pusher, KafkaConfig{IngestionTenantNewestFirst: true}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	// The records of each tenant are pushed newest first, and by descending offset for the same timestamp, in the
+	// positions held by the records of the tenant.
+	assert.Equal(t, []string{"series_2", "series_4", "series_5", "series_3", "series_1", "series_0"}, pushed)
+	// The records are consumed again in the fetched order if the consumption fails.
+	assert.Equal(t, fetched, records)
+}
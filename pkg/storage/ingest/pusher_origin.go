@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// parsePushMetadata parses the key=value pairs of -ingest-storage.kafka.push-metadata. It returns nil if there are none.
+func parsePushMetadata(pairs []string) (metadata.MD, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	md := make(metadata.MD, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || !isValidPushMetadataKey(key) {
+			return nil, fmt.Errorf("invalid push metadata %q", pair)
+		}
+		md.Append(key, value)
+	}
+	return md, nil
+}
+
+// isValidPushMetadataKey returns whether the key is a valid gRPC metadata key. The keys are required to be lowercase,
+// because gRPC lowercases them, and the binary keys aren't supported because their values would have to be encoded.
+func isValidPushMetadataKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "grpc-") || strings.HasSuffix(key, "-bin") {
+		return false
+	}
+	for _, r := range key {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// withPushMetadata returns the context with the metadata added to both its outgoing and incoming metadata, so that it's
+// received by the storage whether it's reached via gRPC or running in the same process.
+func withPushMetadata(ctx context.Context, md metadata.MD) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+
+	outgoing, _ := metadata.FromOutgoingContext(ctx)
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Join(outgoing, md))
+	return metadata.NewIncomingContext(ctx, metadata.Join(incoming, md))
+}
+
+// pushMetadataInjectingPusher is a Pusher middleware which injects the configured metadata in the context of each push
+// to the upstream Pusher.
+type pushMetadataInjectingPusher struct {
+	upstream Pusher
+	md       metadata.MD
+}
+
+// PushToStorage implements the Pusher interface.
+func (p pushMetadataInjectingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	return p.upstream.PushToStorage(withPushMetadata(ctx, p.md), req)
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+func (p pushMetadataInjectingPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	return p.upstream.(RawPusher).PushRawToStorage(withPushMetadata(ctx, p.md), tenantID, content)
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestParsePushMetadata(t *testing.T) {
+	md, err := parsePushMetadata(nil)
+	require.NoError(t, err)
+	assert.Nil(t, md)
+
+	md, err = parsePushMetadata([]string{"source=replay", "x-origin.id=ingest_storage", "source=kafka", "empty="})
+	require.NoError(t, err)
+	assert.Equal(t, metadata.MD{"source": {"replay", "kafka"}, "x-origin.id": {"ingest_storage"}, "empty": {""}}, md)
+
+	for _, pair := range []string{"source", "=replay", "Source=replay", "grpc-source=replay", "source-bin=replay", "so urce=replay"} {
+		_, err := parsePushMetadata([]string{pair})
+		assert.Error(t, err, pair)
+	}
+}
+
+// metadataRecordingPusher records the incoming and outgoing metadata of the context of each push, either decoded or raw.
+type metadataRecordingPusher struct {
+	mx       sync.Mutex
+	incoming []metadata.MD
+	outgoing []metadata.MD
+}
+
+func (p *metadataRecordingPusher) record(ctx context.Context) {
+	incoming, _ := metadata.FromIncomingContext(ctx)
+	outgoing, _ := metadata.FromOutgoingContext(ctx)
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.incoming = append(p.incoming, incoming)
+	p.outgoing = append(p.outgoing, outgoing)
+}
+
+func (p *metadataRecordingPusher) PushToStorage(ctx context.Context, _ *mimirpb.WriteRequest) error {
+	p.record(ctx)
+	return nil
+}
+
+type metadataRecordingRawPusher struct {
+	*metadataRecordingPusher
+}
+
+func (p metadataRecordingRawPusher) PushRawToStorage(ctx context.Context, _ string, _ []byte) error {
+	p.record(ctx)
+	return nil
+}
+
+func TestPusherConsumer_PushMetadata(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+	}
+	incomingCtx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("existing", "incoming"))
+	for i := range records {
+		records[i].ctx = metadata.AppendToOutgoingContext(incomingCtx, "existing", "outgoing")
+	}
+
+	cfg := KafkaConfig{PushMetadata: []string{"source=replay"}}
+
+	t.Run("should inject the metadata in the context of the pushes", func(t *testing.T) {
+		pusher := &metadataRecordingPusher{}
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		require.Len(t, pusher.incoming, 1)
+		assert.Equal(t, metadata.MD{"existing": {"incoming"}, "source": {"replay"}}, pusher.incoming[0])
+		assert.Equal(t, metadata.MD{"existing": {"outgoing"}, "source": {"replay"}}, pusher.outgoing[0])
+	})
+
+	t.Run("should inject the metadata in the context of the raw pushes", func(t *testing.T) {
+		pusher := metadataRecordingRawPusher{&metadataRecordingPusher{}}
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.True(t, c.rawPushEnabled())
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		require.Len(t, pusher.incoming, 1)
+		assert.Equal(t, metadata.MD{"existing": {"incoming"}, "source": {"replay"}}, pusher.incoming[0])
+		assert.Equal(t, metadata.MD{"existing": {"outgoing"}, "source": {"replay"}}, pusher.outgoing[0])
+	})
+
+	t.Run("should not inject any metadata by default", func(t *testing.T) {
+		pusher := &metadataRecordingPusher{}
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		require.Len(t, pusher.incoming, 1)
+		assert.Equal(t, metadata.MD{"existing": {"incoming"}}, pusher.incoming[0])
+	})
+}
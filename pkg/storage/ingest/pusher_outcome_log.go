@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"io"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// The outcomes of the records logged by the record outcome logger, besides the reasons the records are rejected with.
+const (
+	outcomePushed            = "pushed"
+	outcomeFailed            = "failed"
+	outcomePanic             = "panic"
+	outcomeParseError        = "parse_error"
+	outcomeParseErrorAborted = "parse_error_aborted"
+)
+
+// newRecordOutcomeLogger returns the logger of the record outcomes for the configured format, or nil if they're not
+// logged. The JSON events are written to w, with their own timestamp, because the format of the default logger
+// can't be changed.
+func newRecordOutcomeLogger(format string, logger log.Logger, w io.Writer) log.Logger {
+	switch format {
+	case recordOutcomeLogLogfmt:
+		return logger
+	case recordOutcomeLogJSON:
+		return log.With(log.NewJSONLogger(log.NewSyncWriter(w)), "ts", log.DefaultTimestampUTC)
+	default:
+		return nil
+	}
+}
+
+// logOutcome logs the outcome of the record as a single event, if enabled. The fields are the same for every
+// outcome, so that the events can be indexed: the error is empty if there's none.
+func (c pusherConsumer) logOutcome(r parsedRecord, outcome string, err error) {
+	if c.outcomeLogger == nil {
+		return
+	}
+
+	var cause string
+	if err != nil {
+		cause = err.Error()
+	}
+	level.Info(c.outcomeLogger).Log(
+		"msg", "record outcome",
+		"user", r.tenantID,
+		"offset", r.offset,
+		"index", r.index,
+		"outcome", outcome,
+		"latency", time.Since(r.pushStart),
+		"err", cause,
+	)
+}
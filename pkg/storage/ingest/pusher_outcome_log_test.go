@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_RecordOutcomeLogs(t *testing.T) {
+	wr := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}
+	records := []record{
+		makeRecord(t, "user-1", wr, nil),
+		{ctx: context.Background(), tenantID: "user-2", content: []byte("invalid"), offset: 2},
+		makeRecord(t, "user-3", wr, nil),
+	}
+	records[0].offset = 1
+	records[2].offset = 3
+
+	pusher := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+		if userID, _ := user.ExtractOrgID(ctx); userID == "user-3" {
+			return errors.New("storage unavailable")
+		}
+		return nil
+	})
+
+	t.Run("json", func(t *testing.T) {
+		buf := &concurrency.SyncBuffer{}
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		c.outcomeLogger = newRecordOutcomeLogger(recordOutcomeLogJSON, nil, buf)
+
+		require.Error(t, c.Consume(context.Background(), records))
+
+		var events []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			event := map[string]any{}
+			require.NoError(t, json.Unmarshal([]byte(line), &event))
+			events = append(events, event)
+		}
+		require.Len(t, events, 3)
+
+		for i, expected := range []struct {
+			user, outcome string
+			offset        float64
+			withErr       bool
+		}{
+			{user: "user-1", outcome: outcomePushed, offset: 1},
+			{user: "user-2", outcome: outcomeParseError, offset: 2, withErr: true},
+			{user: "user-3", outcome: outcomeFailed, offset: 3, withErr: true},
+		} {
+			event := events[i]
+			assert.Equal(t, "record outcome", event["msg"])
+			assert.Equal(t, "info", event["level"])
+			assert.Equal(t, expected.user, event["user"])
+			assert.Equal(t, expected.outcome, event["outcome"])
+			assert.Equal(t, expected.offset, event["offset"])
+			assert.Equal(t, float64(i), event["index"])
+			assert.Equal(t, expected.withErr, event["err"] != "")
+			assert.NotEmpty(t, event["latency"])
+			assert.NotEmpty(t, event["ts"])
+		}
+	})
+
+	t.Run("logfmt", func(t *testing.T) {
+		buf := &concurrency.SyncBuffer{}
+		cfg := KafkaConfig{RecordOutcomeLogFormat: recordOutcomeLogLogfmt}
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewLogfmtLogger(buf))
+
+		require.NoError(t, c.Consume(context.Background(), records[:1]))
+		assert.Contains(t, buf.String(), `level=info msg="record outcome" user=user-1 offset=1 index=0 outcome=pushed latency=`)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		buf := &concurrency.SyncBuffer{}
+		cfg := KafkaConfig{RecordOutcomeLogFormat: recordOutcomeLogDisabled}
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewLogfmtLogger(buf))
+
+		require.NoError(t, c.Consume(context.Background(), records[:1]))
+		assert.NotContains(t, buf.String(), "record outcome")
+	})
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// ConsumeWithPacing is like Consume, but it spreads the pushes of the records evenly over the window, the time the
+// caller expects to allot to the consumption, instead of pushing them as fast as possible, to smooth the load on the
+// storage. It's meant for the callers consuming the records in fixed-interval polling loops, which would otherwise
+// push each batch in a burst at the start of each interval. The records are pushed as fast as possible if the window
+// is 0.
+//
+// The pushes are scheduled when the consumption starts, based on the number of given records, so the records split
+// from batches or reassembled from chunks, and the pushes slowed down by the storage or the backpressure, don't shift
+// the schedule: the late pushes are made right away, and the pushes beyond the number of given records at the end of
+// the window. The window isn't a deadline, and the consumption may take longer.
+func (c pusherConsumer) ConsumeWithPacing(ctx context.Context, records []record, window time.Duration) error {
+	c.pacer = newPushPacer(window, len(records), time.Now())
+	return c.Consume(ctx, records)
+}
+
+// pushPacer schedules the pushes of the records evenly over a window. It's safe for concurrent use.
+// A nil *pushPacer never delays the pushes.
+type pushPacer struct {
+	start    time.Time
+	window   time.Duration
+	interval time.Duration
+	// pushes is the number of pushes scheduled so far.
+	pushes atomic.Int64
+}
+
+// newPushPacer returns the pacer spreading the pushes of the records over the window from start, or nil if the window
+// or the number of records is 0.
+func newPushPacer(window time.Duration, records int, start time.Time) *pushPacer {
+	if window <= 0 || records <= 0 {
+		return nil
+	}
+	return &pushPacer{start: start, window: window, interval: window / time.Duration(records)}
+}
+
+// next returns when the next push is scheduled.
+func (p *pushPacer) next() time.Time {
+	scheduled := time.Duration(p.pushes.Inc()-1) * p.interval
+	return p.start.Add(min(scheduled, p.window))
+}
+
+// wait waits until the next push is scheduled. It returns the cause of the context if it's done while waiting.
+func (p *pushPacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	delay := time.Until(p.next())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
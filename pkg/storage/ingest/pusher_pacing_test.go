@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPushPacer(t *testing.T) {
+	start := time.Now()
+
+	p := newPushPacer(time.Second, 4, start)
+	for _, expected := range []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond, time.Second, time.Second} {
+		assert.Equal(t, start.Add(expected), p.next())
+	}
+
+	assert.Nil(t, newPushPacer(0, 4, start))
+	assert.Nil(t, newPushPacer(time.Second, 0, start))
+	assert.NoError(t, (*pushPacer)(nil).wait(context.Background()))
+}
+
+func TestPusherConsumer_ConsumeWithPacing(t *testing.T) {
+	var records []record
+	for range 4 {
+		records = append(records, makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil))
+	}
+
+	var pushed []time.Time
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		pushed = append(pushed, time.Now())
+		return nil
+	})
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+	t.Run("should spread the pushes over the window", func(t *testing.T) {
+		pushed = nil
+		const window = 400 * time.Millisecond
+		start := time.Now()
+		require.NoError(t, c.ConsumeWithPacing(context.Background(), records, window))
+
+		require.Len(t, pushed, len(records))
+		for i, at := range pushed {
+			assert.GreaterOrEqual(t, at.Sub(start), time.Duration(i)*window/time.Duration(len(records)))
+		}
+	})
+
+	t.Run("should push as fast as possible without window", func(t *testing.T) {
+		pushed = nil
+		start := time.Now()
+		require.NoError(t, c.ConsumeWithPacing(context.Background(), records, 0))
+
+		require.Len(t, pushed, len(records))
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("should stop waiting once the context is canceled", func(t *testing.T) {
+		pushed = nil
+		ctx, cancel := context.WithCancelCause(context.Background())
+		time.AfterFunc(50*time.Millisecond, func() { cancel(context.Canceled) })
+
+		err := c.ConsumeWithPacing(ctx, records, time.Minute)
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Len(t, pushed, 1)
+	})
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// RecordPanicError is returned when a panic has been recovered while consuming a record, for example in a
+// decompressor or in a Pusher middleware. It's a server error, so the batch of records is retried.
+type RecordPanicError struct {
+	// Index is the position of the record in the consumed batch, or -1 if it's unknown.
+	Index int
+	// TenantID is the tenant the record belongs to, if known.
+	TenantID string
+	// Value is the value the panic has been called with.
+	Value any
+	// Stack is the stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func newRecordPanicError(value any, index int, tenantID string) *RecordPanicError {
+	return &RecordPanicError{Index: index, TenantID: tenantID, Value: value, Stack: debug.Stack()}
+}
+
+func (e *RecordPanicError) Error() string {
+	return fmt.Sprintf("panic while consuming record at index %d for tenant %s: %v", e.Index, e.TenantID, e.Value)
+}
+
+// reportPanic logs and counts a recovered panic.
+func reportPanic(ctx context.Context, logger log.Logger, panics prometheus.Counter, err *RecordPanicError) {
+	panics.Inc()
+	level.Error(spanlogger.FromContext(ctx, logger)).Log("msg", "recovered from panic while consuming record", "record_index", err.Index, "user", err.TenantID, "panic", err.Value, "stack", string(err.Stack))
+}
+
+// panicRecoveringPusher is a Pusher middleware which turns the panics of the upstream Pusher into a *RecordPanicError.
+// It's needed because the records may be pushed by background goroutines, which would crash the process if they panicked.
+type panicRecoveringPusher struct {
+	upstream Pusher
+	logger   log.Logger
+	panics   prometheus.Counter
+}
+
+// PushToStorage implements the Pusher interface.
+func (p panicRecoveringPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			// The index of the record isn't known at this level, but it's added by the error returned by pushRecord.
+			userID, _ := user.ExtractOrgID(ctx)
+			panicErr := newRecordPanicError(r, -1, userID)
+			reportPanic(ctx, p.logger, p.panics, panicErr)
+			err = panicErr
+		}
+	}()
+
+	return p.upstream.PushToStorage(ctx, req)
+}
+
+// PushRawToStorage implements the RawPusher interface. It must only be called if the upstream Pusher is a RawPusher.
+func (p panicRecoveringPusher) PushRawToStorage(ctx context.Context, tenantID string, content []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := newRecordPanicError(r, -1, tenantID)
+			reportPanic(ctx, p.logger, p.panics, panicErr)
+			err = panicErr
+		}
+	}()
+
+	return p.upstream.(RawPusher).PushRawToStorage(ctx, tenantID, content)
+}
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// panickingDecompressor is a Decompressor whose content is prefixed by its magic bytes, and which always panics.
+type panickingDecompressor struct{}
+
+func (panickingDecompressor) Codec() string { return "panicking" }
+func (panickingDecompressor) Magic() []byte { return []byte{0xff, 0xfd} }
+
+func (panickingDecompressor) Decompress([]byte, int) ([]byte, error) {
+	panic("decompressor bug")
+}
+
+// panickingLimits is a TenantLimits which panics when the limits of a tenant are looked up before pushing.
+type panickingLimits struct {
+	TenantLimits
+}
+
+func (panickingLimits) IngestStorageDropExemplars(string) bool {
+	panic("limits bug")
+}
+
+func TestPusherConsumer_ShouldRecoverFromPanics(t *testing.T) {
+	newRecord := func(metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
+	}
+
+	panickingPusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		if request.Timeseries[0].Labels[0].Value == "series_2" {
+			panic("middleware bug")
+		}
+		return nil
+	})
+	noopPusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	tests := map[string]struct {
+		pusher          Pusher
+		cfg             KafkaConfig
+		limits          TenantLimits
+		decompressors   []Decompressor
+		records         []record
+		expectedIndex   int
+		expectedErr     string
+		expectedMessage string
+	}{
+		"should recover from a panic of the Pusher": {
+			pusher:          panickingPusher,
+			records:         []record{newRecord("series_1"), newRecord("series_2"), newRecord("series_3")},
+			expectedIndex:   -1,
+			expectedErr:     "consuming record at index 1 for tenant user-1: panic while consuming record at index -1 for tenant user-1: middleware bug",
+			expectedMessage: "middleware bug",
+		},
+		"should recover from a panic of the Pusher called by a background goroutine": {
+			pusher: panickingPusher,
+			cfg: KafkaConfig{
+				IngestionConcurrencyMax:                     2,
+				IngestionConcurrencyBatchSize:               1,
+				IngestionConcurrencyQueueCapacity:           1,
+				IngestionConcurrencyEstimatedBytesPerSample: 1,
+				IngestionConcurrencyTargetFlushesPerShard:   1,
+			},
+			records:         []record{newRecord("series_1"), newRecord("series_2"), newRecord("series_3")},
+			expectedIndex:   -1,
+			expectedErr:     "panic while consuming record at index -1 for tenant user-1: middleware bug",
+			expectedMessage: "middleware bug",
+		},
+		"should recover from a panic while decoding a record": {
+			pusher:          noopPusher,
+			decompressors:   []Decompressor{panickingDecompressor{}},
+			records:         []record{{ctx: context.Background(), tenantID: "user-1", content: append(panickingDecompressor{}.Magic(), 0)}},
+			expectedIndex:   0,
+			expectedErr:     "panic while consuming record at index 0 for tenant user-1: decompressor bug",
+			expectedMessage: "decompressor bug",
+		},
+		"should recover from a panic while preparing a record to be pushed": {
+			pusher:          noopPusher,
+			limits:          panickingLimits{TenantLimits: validation.MockDefaultOverrides()},
+			records:         []record{newRecord("series_1")},
+			expectedIndex:   0,
+			expectedErr:     "panic while consuming record at index 0 for tenant user-1: limits bug",
+			expectedMessage: "limits bug",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			limits := testData.limits
+			if limits == nil {
+				limits = validation.MockDefaultOverrides()
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			logs := &concurrency.SyncBuffer{}
+			c := newPusherConsumer(testData.pusher, testData.cfg, limits, newPusherConsumerMetrics(reg), log.NewLogfmtLogger(logs))
+			if testData.decompressors != nil {
+				c.decompressors = testData.decompressors
+			}
+
+			err := c.Consume(context.Background(), testData.records)
+			require.ErrorContains(t, err, testData.expectedErr)
+			assert.False(t, mimirpb.IsClientError(err))
+
+			var panicErr *RecordPanicError
+			require.ErrorAs(t, err, &panicErr)
+			assert.Equal(t, testData.expectedIndex, panicErr.Index)
+			assert.Equal(t, "user-1", panicErr.TenantID)
+			assert.Equal(t, testData.expectedMessage, panicErr.Value)
+			assert.NotEmpty(t, panicErr.Stack)
+
+			assert.Contains(t, logs.String(), "recovered from panic while consuming record")
+			assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+				# HELP cortex_ingest_storage_reader_panics_total Number of panics recovered while consuming the records read from Kafka.
+				# TYPE cortex_ingest_storage_reader_panics_total counter
+				cortex_ingest_storage_reader_panics_total 1
+			`), "cortex_ingest_storage_reader_panics_total"))
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"container/heap"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// RecordPriorityResolver returns the priority class of a decoded record, for example based on its tenant or on the
+// metrics it contains. The records with a higher priority are pushed first when the push workers are contended.
+// The priority is used as the value of a metric label, so the resolver should only return a few distinct values.
+type RecordPriorityResolver func(tenantID string, req *mimirpb.WriteRequest) int
+
+// WithRecordPriority configures the consumer to push the decoded records with a higher priority first, for example
+// so that the critical data is ingested first while recovering from a backlog. The records waiting for a push worker
+// are queued by priority, and the records with the same priority are pushed in the order they've been decoded. The
+// records which couldn't be parsed have priority 0.
+//
+// The priority is only honored with the relaxed ingestion ordering, because the other orderings preserve the order of
+// the records or of the samples of each series. Up to -ingest-storage.kafka.ingestion-concurrency-queue-capacity
+// records per push worker are decoded ahead and queued, so that there's a choice of records to push next.
+func WithRecordPriority(resolver RecordPriorityResolver) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.priorityResolver = resolver
+	}
+}
+
+// prioritizedRecord is a parsed record waiting in a recordPriorityQueue.
+type prioritizedRecord struct {
+	parsedRecord
+	priority   int
+	enqueuedAt time.Time
+}
+
+// recordPriorityQueue is a heap of records with the highest priority first, and the lowest index first among
+// the records with the same priority. It's not safe for concurrent use.
+type recordPriorityQueue []prioritizedRecord
+
+func (q recordPriorityQueue) Len() int { return len(q) }
+
+func (q recordPriorityQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].index < q[j].index
+}
+
+func (q recordPriorityQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *recordPriorityQueue) Push(x any) { *q = append(*q, x.(prioritizedRecord)) }
+
+func (q *recordPriorityQueue) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = prioritizedRecord{}
+	*q = old[:len(old)-1]
+	return r
+}
+
+// prioritizeRecords queues up to capacity records read from the input channel, and sends them to the output channel
+// by priority as soon as a push worker reads from it. The output channel is closed once all the records have been sent.
+// If the context is cancelled, the queued records are released without being pushed and nil is returned.
+func (c pusherConsumer) prioritizeRecords(ctx context.Context, records <-chan parsedRecord, out chan<- parsedRecord, capacity int) error {
+	defer close(out)
+
+	queue := &recordPriorityQueue{}
+	defer func() {
+		for _, r := range *queue {
+			c.decodeBudget.release(r.decodeBytes)
+			c.tenantInflight.release(r.tenantID, r.inflightBytes)
+		}
+	}()
+
+	in := records
+	for in != nil || queue.Len() > 0 {
+		// Only read more records while there's room in the queue, and only send when there's a record to send.
+		var (
+			maybeIn  <-chan parsedRecord
+			maybeOut chan<- parsedRecord
+			next     parsedRecord
+		)
+		if in != nil && queue.Len() < capacity {
+			maybeIn = in
+		}
+		if queue.Len() > 0 {
+			maybeOut = out
+			next = (*queue)[0].parsedRecord
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case r, ok := <-maybeIn:
+			if !ok {
+				in = nil
+				continue
+			}
+			priority := 0
+			if r.err == nil {
+				priority = c.priorityResolver(r.tenantID, r.WriteRequest)
+			}
+			heap.Push(queue, prioritizedRecord{parsedRecord: r, priority: priority, enqueuedAt: time.Now()})
+		case maybeOut <- next:
+			sent := heap.Pop(queue).(prioritizedRecord)
+			c.metrics.priorityWaitSeconds.WithLabelValues(strconv.Itoa(sent.priority)).Observe(time.Since(sent.enqueuedAt).Seconds())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"container/heap"
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestRecordPriorityQueue(t *testing.T) {
+	queue := &recordPriorityQueue{}
+	for i, priority := range []int{0, 2, 1, 2, 0} {
+		heap.Push(queue, prioritizedRecord{parsedRecord: parsedRecord{index: i}, priority: priority})
+	}
+
+	var popped []int
+	for queue.Len() > 0 {
+		popped = append(popped, heap.Pop(queue).(prioritizedRecord).index)
+	}
+	assert.Equal(t, []int{1, 3, 2, 0, 4}, popped)
+}
+
+func TestPusherConsumer_WithRecordPriority(t *testing.T) {
+	priorities := map[string]int{"user-low": 0, "user-high": 1, "user-critical": 2}
+	tenants := []string{"user-low", "user-low", "user-critical", "user-high", "user-low", "user-critical"}
+
+	var records []record
+	for i, tenantID := range tenants {
+		r := makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(tenantID)}}, nil)
+		r.offset = int64(i)
+		records = append(records, r)
+	}
+
+	// The first push is blocked until all the records have been queued, so that the next ones are pushed by priority.
+	// The records are queued by the goroutine calling the resolver, before it sends the next record to the workers.
+	resolved := atomic.NewInt64(0)
+	allQueued := make(chan struct{})
+	resolver := func(tenantID string, _ *mimirpb.WriteRequest) int {
+		if resolved.Inc() == int64(len(records)) {
+			close(allQueued)
+		}
+		return priorities[tenantID]
+	}
+
+	var (
+		mx     sync.Mutex
+		pushed []string
+	)
+	pusher := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+		tenantID, err := user.ExtractOrgID(ctx)
+		require.NoError(t, err)
+
+		mx.Lock()
+		pushed = append(pushed, tenantID)
+		first := len(pushed) == 1
+		mx.Unlock()
+
+		if first {
+			<-allQueued
+		}
+		return nil
+	})
+
+	cfg := KafkaConfig{IngestionOrdering: ingestionOrderingRelaxed, IngestionConcurrencyMax: 1, IngestionConcurrencyQueueCapacity: len(records)}
+	c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithRecordPriority(resolver))
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	// The record pushed first is the one picked before the others have been queued, while the other ones are
+	// pushed by priority.
+	require.Len(t, pushed, len(records))
+	remaining := slices.Clone(tenants)
+	remaining = slices.Delete(remaining, slices.Index(remaining, pushed[0]), slices.Index(remaining, pushed[0])+1)
+	slices.SortStableFunc(remaining, func(a, b string) int { return priorities[b] - priorities[a] })
+	assert.Equal(t, remaining, pushed[1:])
+}
@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slowConsumeProfiler captures a profile of the consumes which take longer than a threshold, from the moment the
+// threshold is exceeded until the consume returns, so that a pathologically slow batch can be investigated without
+// profiling all the time. At most a profile is captured at once, and at most once per cooldown. It's shared by the
+// consumers of a PartitionReader. A nil *slowConsumeProfiler captures nothing.
+type slowConsumeProfiler struct {
+	threshold time.Duration
+	kind      string
+	dir       string
+	cooldown  time.Duration
+	partition int32
+	logger    log.Logger
+	captures  prometheus.Counter
+
+	mx        sync.Mutex
+	capturing bool
+	lastStart time.Time
+}
+
+// newSlowConsumeProfiler returns the slowConsumeProfiler configured by cfg, or nil if it's disabled.
+func newSlowConsumeProfiler(cfg KafkaConfig, partitionID int32, metrics *pusherConsumerMetrics, logger log.Logger) *slowConsumeProfiler {
+	if cfg.SlowConsumeProfileThreshold <= 0 {
+		return nil
+	}
+	dir := cfg.SlowConsumeProfileDirectory
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &slowConsumeProfiler{
+		threshold: cfg.SlowConsumeProfileThreshold,
+		kind:      cfg.SlowConsumeProfileType,
+		dir:       dir,
+		cooldown:  cfg.SlowConsumeProfileCooldown,
+		partition: partitionID,
+		logger:    logger,
+		captures:  metrics.slowConsumeProfiles,
+	}
+}
+
+// withSlowConsumeProfiler configures the consumer to profile its slow consumes with the profiler.
+func withSlowConsumeProfiler(p *slowConsumeProfiler) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.profiler = p
+	}
+}
+
+// track starts tracking a consume, and returns the function to call once the consume returns. A profile is captured
+// if the consume is still running once the threshold has elapsed.
+func (p *slowConsumeProfiler) track() (done func()) {
+	if p == nil {
+		return func() {}
+	}
+
+	var (
+		mx       sync.Mutex
+		returned bool
+		capture  *profileCapture
+	)
+	timer := time.AfterFunc(p.threshold, func() {
+		mx.Lock()
+		defer mx.Unlock()
+		if !returned {
+			capture = p.start()
+		}
+	})
+
+	return func() {
+		timer.Stop()
+		mx.Lock()
+		returned = true
+		c := capture
+		mx.Unlock()
+		p.stop(c)
+	}
+}
+
+// profileCapture is a profile being captured.
+type profileCapture struct {
+	file  *os.File
+	start time.Time
+}
+
+// start starts capturing a profile, unless a profile is already being captured or the cooldown hasn't elapsed. It
+// returns nil if no profile is captured.
+func (p *slowConsumeProfiler) start() *profileCapture {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	now := time.Now()
+	if p.capturing || (!p.lastStart.IsZero() && now.Sub(p.lastStart) < p.cooldown) {
+		return nil
+	}
+
+	path := filepath.Join(p.dir, fmt.Sprintf("slow-consume-partition-%d-%s-%s.pprof", p.partition, p.kind, now.UTC().Format("20060102T150405.000Z")))
+	f, err := os.Create(path)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to create the profile of a slow consume", "path", path, "err", err)
+		return nil
+	}
+
+	switch p.kind {
+	case slowConsumeProfileBlock:
+		runtime.SetBlockProfileRate(1)
+	default:
+		if err := pprof.StartCPUProfile(f); err != nil {
+			level.Warn(p.logger).Log("msg", "failed to start the profile of a slow consume", "path", path, "err", err)
+			_ = f.Close()
+			_ = os.Remove(path)
+			return nil
+		}
+	}
+
+	p.capturing = true
+	p.lastStart = now
+	level.Info(p.logger).Log("msg", "consume is slow, capturing a profile", "type", p.kind, "threshold", p.threshold, "path", path)
+	return &profileCapture{file: f, start: now}
+}
+
+// stop stops capturing the profile, and writes it. It's a no-op if c is nil.
+func (p *slowConsumeProfiler) stop(c *profileCapture) {
+	if c == nil {
+		return
+	}
+
+	var err error
+	switch p.kind {
+	case slowConsumeProfileBlock:
+		err = pprof.Lookup("block").WriteTo(c.file, 0)
+		runtime.SetBlockProfileRate(0)
+	default:
+		pprof.StopCPUProfile()
+	}
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	p.mx.Lock()
+	p.capturing = false
+	p.mx.Unlock()
+
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "failed to write the profile of a slow consume", "path", c.file.Name(), "err", err)
+		return
+	}
+	p.captures.Inc()
+	level.Info(p.logger).Log("msg", "captured the profile of a slow consume", "type", p.kind, "path", c.file.Name(), "duration", time.Since(c.start))
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_SlowConsumeProfile(t *testing.T) {
+	records := []record{makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)}
+
+	for _, kind := range slowConsumeProfileOptions {
+		t.Run(kind, func(t *testing.T) {
+			var pushDelay time.Duration
+			pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+				time.Sleep(pushDelay)
+				return nil
+			})
+
+			dir := t.TempDir()
+			cfg := KafkaConfig{SlowConsumeProfileThreshold: 50 * time.Millisecond, SlowConsumeProfileType: kind, SlowConsumeProfileDirectory: dir, SlowConsumeProfileCooldown: time.Hour}
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			profiler := newSlowConsumeProfiler(cfg, 1, metrics, log.NewNopLogger())
+			newConsumer := func() *pusherConsumer {
+				return newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), withSlowConsumeProfiler(profiler))
+			}
+			profiles := func() []os.DirEntry {
+				entries, err := os.ReadDir(dir)
+				require.NoError(t, err)
+				return entries
+			}
+
+			// The fast consumes aren't profiled.
+			require.NoError(t, newConsumer().Consume(context.Background(), records))
+			assert.Empty(t, profiles())
+
+			pushDelay = 200 * time.Millisecond
+			require.NoError(t, newConsumer().Consume(context.Background(), records))
+			require.Len(t, profiles(), 1)
+			assert.Contains(t, profiles()[0].Name(), "slow-consume-partition-1-"+kind)
+			info, err := profiles()[0].Info()
+			require.NoError(t, err)
+			assert.Greater(t, info.Size(), int64(0))
+			assert.Equal(t, float64(1), testutil.ToFloat64(metrics.slowConsumeProfiles))
+
+			// The next slow consumes aren't profiled until the cooldown has elapsed.
+			require.NoError(t, newConsumer().Consume(context.Background(), records))
+			assert.Len(t, profiles(), 1)
+			assert.Equal(t, float64(1), testutil.ToFloat64(metrics.slowConsumeProfiles))
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/grafana/dskit/multierror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+const (
+	quorumPushStatusSuccess     = "success"
+	quorumPushStatusClientError = "client_error"
+	quorumPushStatusServerError = "server_error"
+)
+
+// QuorumPusher is a Pusher which pushes each write request to multiple backends and considers the push
+// successful once a quorum of backends has succeeded.
+//
+// The errors returned by each backend are classified with mimirpb.IsClientError, like the pusherConsumer does:
+//   - If at least quorum backends succeed, the push succeeds.
+//   - Otherwise, if at least quorum backends either succeed or reject the request with a client error, the first
+//     client error is returned, so that the record is skipped like it would be with a single backend.
+//   - Otherwise, the quorum can't be reached because of server errors, and a server error wrapping all the
+//     backends' errors is returned, so that the batch of records is retried.
+//
+// The request is pushed to all the backends concurrently, and PushToStorage waits for all of them to return,
+// because the caller may free the request once it's been pushed. The backends must not modify the request.
+type QuorumPusher struct {
+	backends []quorumBackend
+	quorum   int
+
+	requests       *prometheus.CounterVec
+	quorumFailures prometheus.Counter
+}
+
+type quorumBackend struct {
+	name   string
+	pusher Pusher
+}
+
+// NewQuorumPusher creates a QuorumPusher pushing to the backends, by name, which requires quorum backends to succeed.
+func NewQuorumPusher(backends map[string]Pusher, quorum int, reg prometheus.Registerer) (*QuorumPusher, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("at least one backend is required")
+	}
+	if quorum < 1 || quorum > len(backends) {
+		return nil, fmt.Errorf("the quorum must be between 1 and the number of backends (%d), got %d", len(backends), quorum)
+	}
+
+	p := &QuorumPusher{
+		quorum: quorum,
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_quorum_pusher_requests_total",
+			Help: "Number of write requests pushed to each backend of the quorum pusher, by status.",
+		}, []string{"backend", "status"}),
+		quorumFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_quorum_pusher_quorum_failures_total",
+			Help: "Number of write requests which failed because the quorum of backends couldn't be reached because of server errors.",
+		}),
+	}
+
+	for name, pusher := range backends {
+		p.backends = append(p.backends, quorumBackend{name: name, pusher: pusher})
+		for _, status := range []string{quorumPushStatusSuccess, quorumPushStatusClientError, quorumPushStatusServerError} {
+			p.requests.WithLabelValues(name, status)
+		}
+	}
+
+	// Sort the backends to get deterministic errors.
+	sort.Slice(p.backends, func(i, j int) bool {
+		return p.backends[i].name < p.backends[j].name
+	})
+
+	return p, nil
+}
+
+// PushToStorage implements the Pusher interface.
+func (p *QuorumPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	errs := make([]error, len(p.backends))
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(p.backends))
+	for i, b := range p.backends {
+		go func() {
+			defer wg.Done()
+			errs[i] = b.pusher.PushToStorage(ctx, req)
+		}()
+	}
+	wg.Wait()
+
+	var (
+		successes    int
+		clientErrors int
+		firstClient  error
+		serverErrors multierror.MultiError
+	)
+	for i, err := range errs {
+		name := p.backends[i].name
+
+		switch {
+		case err == nil:
+			successes++
+			p.requests.WithLabelValues(name, quorumPushStatusSuccess).Inc()
+		case mimirpb.IsClientError(err):
+			clientErrors++
+			if firstClient == nil {
+				firstClient = err
+			}
+			p.requests.WithLabelValues(name, quorumPushStatusClientError).Inc()
+		default:
+			serverErrors.Add(fmt.Errorf("backend %s: %w", name, err))
+			p.requests.WithLabelValues(name, quorumPushStatusServerError).Inc()
+		}
+	}
+
+	if successes >= p.quorum {
+		return nil
+	}
+	if successes+clientErrors >= p.quorum {
+		return firstClient
+	}
+
+	p.quorumFailures.Inc()
+	return fmt.Errorf("quorum of %d backends not reached, %d succeeded: %w", p.quorum, successes, serverErrors.Err())
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+func TestQuorumPusher(t *testing.T) {
+	var (
+		success     = pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+		clientErr   = ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		clientError = pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return clientErr })
+		serverErr   = ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		serverError = pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return serverErr })
+	)
+
+	tests := map[string]struct {
+		backends          map[string]Pusher
+		quorum            int
+		expectedErr       error
+		expectClientError bool
+	}{
+		"should succeed if all the backends succeed": {
+			backends: map[string]Pusher{"a": success, "b": success, "c": success},
+			quorum:   3,
+		},
+		"should succeed if the quorum of backends succeeds": {
+			backends: map[string]Pusher{"a": success, "b": success, "c": serverError},
+			quorum:   2,
+		},
+		"should return a client error if the quorum is reached only counting the client errors": {
+			backends:          map[string]Pusher{"a": success, "b": clientError, "c": serverError},
+			quorum:            2,
+			expectedErr:       clientErr,
+			expectClientError: true,
+		},
+		"should return a server error if the quorum isn't reached because of server errors": {
+			backends:    map[string]Pusher{"a": success, "b": serverError, "c": serverError},
+			quorum:      2,
+			expectedErr: serverErr,
+		},
+		"should return a server error if the server errors prevent reaching the quorum even with client errors": {
+			backends:    map[string]Pusher{"a": clientError, "b": serverError, "c": success},
+			quorum:      3,
+			expectedErr: serverErr,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			p, err := NewQuorumPusher(testData.backends, testData.quorum, prometheus.NewPedanticRegistry())
+			require.NoError(t, err)
+
+			err = p.PushToStorage(context.Background(), &mimirpb.WriteRequest{})
+			if testData.expectedErr == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			require.ErrorIs(t, err, testData.expectedErr)
+			assert.Equal(t, testData.expectClientError, mimirpb.IsClientError(err))
+		})
+	}
+}
+
+func TestQuorumPusher_Metrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	p, err := NewQuorumPusher(map[string]Pusher{
+		"a": pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil }),
+		"b": pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		}),
+	}, 2, reg)
+	require.NoError(t, err)
+
+	require.Error(t, p.PushToStorage(context.Background(), &mimirpb.WriteRequest{}))
+	require.Error(t, p.PushToStorage(context.Background(), &mimirpb.WriteRequest{}))
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_quorum_pusher_requests_total Number of write requests pushed to each backend of the quorum pusher, by status.
+		# TYPE cortex_ingest_storage_reader_quorum_pusher_requests_total counter
+		cortex_ingest_storage_reader_quorum_pusher_requests_total{backend="a",status="client_error"} 0
+		cortex_ingest_storage_reader_quorum_pusher_requests_total{backend="a",status="server_error"} 0
+		cortex_ingest_storage_reader_quorum_pusher_requests_total{backend="a",status="success"} 2
+		cortex_ingest_storage_reader_quorum_pusher_requests_total{backend="b",status="client_error"} 0
+		cortex_ingest_storage_reader_quorum_pusher_requests_total{backend="b",status="server_error"} 2
+		cortex_ingest_storage_reader_quorum_pusher_requests_total{backend="b",status="success"} 0
+
+		# HELP cortex_ingest_storage_reader_quorum_pusher_quorum_failures_total Number of write requests which failed because the quorum of backends couldn't be reached because of server errors.
+		# TYPE cortex_ingest_storage_reader_quorum_pusher_quorum_failures_total counter
+		cortex_ingest_storage_reader_quorum_pusher_quorum_failures_total 2
+	`)))
+}
+
+func TestNewQuorumPusher_ShouldValidateTheQuorum(t *testing.T) {
+	backends := map[string]Pusher{"a": pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })}
+
+	_, err := NewQuorumPusher(nil, 1, prometheus.NewPedanticRegistry())
+	assert.Error(t, err)
+	_, err = NewQuorumPusher(backends, 0, prometheus.NewPedanticRegistry())
+	assert.Error(t, err)
+	_, err = NewQuorumPusher(backends, 2, prometheus.NewPedanticRegistry())
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// reasonQuotaExceeded is the reason of the records rejected because their tenant has exceeded its quota.
+const reasonQuotaExceeded = "quota_exceeded"
+
+// QuotaChecker checks the quotas of the tenants against an external service enforcing hard quotas.
+type QuotaChecker interface {
+	// WithinQuota returns whether the tenant is within its quota, in which case its records can be pushed.
+	// It returns an error if the quota couldn't be checked, in which case the records of the tenant are pushed.
+	WithinQuota(ctx context.Context, tenantID string) (bool, error)
+}
+
+// QuotaCheckerFunc is a function implementing QuotaChecker.
+type QuotaCheckerFunc func(ctx context.Context, tenantID string) (bool, error)
+
+// WithinQuota implements QuotaChecker.
+func (f QuotaCheckerFunc) WithinQuota(ctx context.Context, tenantID string) (bool, error) {
+	return f(ctx, tenantID)
+}
+
+// WithQuotaChecker configures the consumer to check the quota of the tenant of each record with the checker before
+// pushing it, rejecting the records of the tenants which have exceeded their quota as client errors with the
+// quota_exceeded reason. The result of each check is cached for the TTL, shared by all the consumers configured with
+// the returned option, so that the checker is called at most once per tenant per TTL. The failed checks aren't cached.
+func WithQuotaChecker(checker QuotaChecker, ttl time.Duration) PusherConsumerOption {
+	quotas := &tenantQuotas{checker: checker, ttl: ttl, tenants: map[string]*tenantQuota{}}
+	return func(c *pusherConsumer) {
+		c.quotas = quotas
+	}
+}
+
+// tenantQuotas caches the results of the quota checks of the tenants. It's safe for concurrent use. A nil *tenantQuotas
+// considers all the tenants within their quota.
+type tenantQuotas struct {
+	checker QuotaChecker
+	ttl     time.Duration
+
+	mx      sync.Mutex
+	tenants map[string]*tenantQuota
+}
+
+// tenantQuota is the cached result of the quota check of a tenant. Its mutex is held while the quota is checked, so
+// that the concurrent pushes of the tenant wait for a single check.
+type tenantQuota struct {
+	mx          sync.Mutex
+	withinQuota bool
+	checkedAt   time.Time
+}
+
+// checkQuota returns an error if the tenant has exceeded its quota.
+func (c pusherConsumer) checkQuota(ctx context.Context, tenantID string) error {
+	q := c.quotas
+	if q == nil {
+		return nil
+	}
+
+	q.mx.Lock()
+	tq, ok := q.tenants[tenantID]
+	if !ok {
+		tq = &tenantQuota{}
+		q.tenants[tenantID] = tq
+	}
+	q.mx.Unlock()
+
+	tq.mx.Lock()
+	defer tq.mx.Unlock()
+
+	if tq.checkedAt.IsZero() || time.Since(tq.checkedAt) >= q.ttl {
+		start := time.Now()
+		withinQuota, err := q.checker.WithinQuota(ctx, tenantID)
+		c.metrics.quotaCheckDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			c.metrics.quotaCheckFailures.Inc()
+			level.Warn(spanlogger.FromContext(ctx, c.logger)).Log("msg", "failed to check the quota of the tenant; pushing the write request", "user", tenantID, "err", err)
+			return nil
+		}
+		tq.withinQuota, tq.checkedAt = withinQuota, time.Now()
+	}
+
+	if !tq.withinQuota {
+		return fmt.Errorf("the tenant %s has exceeded its quota", tenantID)
+	}
+	return nil
+}
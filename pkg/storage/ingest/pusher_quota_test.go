@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_WithQuotaChecker(t *testing.T) {
+	newRecord := func(tenantID, metricName string) record {
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+	}
+	records := []record{
+		newRecord("user-1", "series_1"),
+		newRecord("over-quota", "series_2"),
+		newRecord("failing", "series_3"),
+		newRecord("user-1", "series_4"),
+		newRecord("over-quota", "series_5"),
+	}
+
+	var pushed []string
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	checks := atomic.NewInt64(0)
+	checker := QuotaCheckerFunc(func(_ context.Context, tenantID string) (bool, error) {
+		checks.Inc()
+		switch tenantID {
+		case "over-quota":
+			return false, nil
+		case "failing":
+			return false, fmt.Errorf("quota service unavailable")
+		}
+		return true, nil
+	})
+
+	t.Run("should reject the records of the tenants over quota and cache the checks", func(t *testing.T) {
+		pushed = nil
+		checks.Store(0)
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithQuotaChecker(checker, time.Hour))
+
+		require.NoError(t, c.Consume(context.Background(), records))
+		assert.Equal(t, []string{"series_1", "series_3", "series_4"}, pushed)
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.rejectedRecords.WithLabelValues(reasonQuotaExceeded)))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.quotaCheckFailures))
+		// The checks of the tenants with two records are cached.
+		assert.Equal(t, int64(3), checks.Load())
+	})
+
+	t.Run("should share the cached checks between the consumers configured with the same option", func(t *testing.T) {
+		pushed = nil
+		checks.Store(0)
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		opt := WithQuotaChecker(checker, time.Hour)
+
+		for i := 0; i < 2; i++ {
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), opt)
+			require.NoError(t, c.Consume(context.Background(), records[:2]))
+		}
+		assert.Equal(t, []string{"series_1", "series_1"}, pushed)
+		assert.Equal(t, int64(2), checks.Load())
+	})
+
+	t.Run("should check the quota again once the cached check has expired", func(t *testing.T) {
+		pushed = nil
+		checks.Store(0)
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithQuotaChecker(checker, 0))
+
+		require.NoError(t, c.Consume(context.Background(), records[:1]))
+		require.NoError(t, c.Consume(context.Background(), records[:1]))
+		assert.Equal(t, int64(2), checks.Load())
+	})
+}
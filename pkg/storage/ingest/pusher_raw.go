@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/grafana/dskit/user"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// RawPusher is implemented by the Pusher which can push the serialized write requests of the records as they are,
+// without the consumer decoding them first. For example, a Pusher forwarding the write requests to a remote storage
+// would otherwise have to re-marshal the write requests the consumer has decoded.
+type RawPusher interface {
+	// PushRawToStorage pushes the serialized write request of tenantID to the storage. The content is the
+	// uncompressed write request, and it must not be retained once PushRawToStorage has returned. The errors
+	// are classified like the errors returned by Pusher.PushToStorage.
+	PushRawToStorage(ctx context.Context, tenantID string, content []byte) error
+}
+
+// rawForwardingPusher is a Pusher middleware which forwards the raw pushes to its upstream Pusher, if it's a RawPusher.
+type rawForwardingPusher interface {
+	Pusher
+	RawPusher
+}
+
+// decodedOnlyPusher hides the RawPusher implementation of a Pusher middleware whose upstream Pusher isn't a RawPusher.
+type decodedOnlyPusher struct {
+	Pusher
+}
+
+// withRawForwarding returns the middleware wrapping upstream as a RawPusher if upstream is one, so that wrapping the
+// Pusher with the middleware doesn't disable pushing the records without decoding them.
+func withRawForwarding(middleware rawForwardingPusher, upstream Pusher) Pusher {
+	if _, ok := upstream.(RawPusher); ok {
+		return middleware
+	}
+	return decodedOnlyPusher{Pusher: middleware}
+}
+
+// rawPushEnabled returns whether the records may be pushed without decoding them. This is the case when the Pusher
+// implements RawPusher, the records are pushed sequentially and decoded by the default decoders, and no transform nor
+// check of the decoded write requests is enabled. The records of the tenants whose limits require transforming their
+// write requests are still decoded, see decodeRaw.
+//
+// Because the records aren't decoded, the records which can't be parsed are only detected by the storage, and their
+// samples aren't counted.
+func (c pusherConsumer) rawPushEnabled() bool {
+	cfg := c.kafkaConfig
+	return c.rawPusher != nil &&
+		cfg.IngestionConcurrencyMax == 0 &&
+		cfg.MetadataOnlyConcurrency == 0 &&
+		!cfg.DeferMetadataPushes &&
+		cfg.IngestionMaxSampleAge == 0 &&
+		cfg.IngestionSplitRequestsMaxBytes == 0 &&
+		(cfg.IngestionFutureSamplesBehavior == "" || cfg.IngestionFutureSamplesBehavior == futureSamplesPush) &&
+		(cfg.IngestionDuplicateSamplesBehavior == "" || cfg.IngestionDuplicateSamplesBehavior == duplicateSamplesPush) &&
+		(cfg.IngestionExemplarOnlyRecordsBehavior == "" || cfg.IngestionExemplarOnlyRecordsBehavior == exemplarOnlyRecordsPush) &&
+		cfg.IngestionMaxExemplarsPerSecond == 0 &&
+		!cfg.DetectOutOfOrderSamples &&
+		!cfg.SortOutOfOrderSamples &&
+		!cfg.VerifyDecodeRoundTrip &&
+		cfg.RecordSummaryLogSampleRate == 0 &&
+		c.defaultDecodersOnly() &&
+		c.tenantRemapper == nil &&
+		c.skipPolicy == nil &&
+		c.priorityResolver == nil &&
+		c.quotas == nil &&
+		c.stagesFn == nil
+}
+
+// decodeRaw returns whether the record of tenantID must be decoded even if rawPushEnabled, because the tenant's limits
+// require transforming its write requests.
+func (c pusherConsumer) decodeRaw(tenantID string) bool {
+	return c.limits.IngestStorageDropExemplars(tenantID) ||
+		c.limits.IngestStorageDropMetadata(tenantID) ||
+		c.limits.IngestStorageMaxExemplarsPerSeries(tenantID) > 0 ||
+		c.limits.IngestStorageMaxExemplarAge(tenantID) > 0 ||
+		c.limits.IngestStorageDownsampleInterval(tenantID) > 0 ||
+		c.denylists.enabled(tenantID) ||
+		len(c.limits.IngestStorageInjectedLabels(tenantID)) > 0 ||
+		len(c.limits.IngestStorageRequiredLabels(tenantID)) > 0
+}
+
+// rawStorageWriter is the storage writer used when rawPushEnabled. It pushes the records which haven't been decoded
+// with the RawPusher, and the decoded ones with the upstream writer.
+type rawStorageWriter struct {
+	PusherCloser
+
+	pusher       RawPusher
+	errorHandler *pushErrorHandler
+	skips        *consecutiveSkipsTracker
+	clientErrors *clientErrorAggregator
+}
+
+// PushRawToStorage pushes the serialized write request with the RawPusher. Like the other storage writers,
+// it only returns the server errors, while the client errors are logged.
+func (w rawStorageWriter) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	spanLog, ctx := spanlogger.NewWithLogger(ctx, w.errorHandler.fallbackLogger, "pusherConsumer.pushRawToStorage")
+	defer spanLog.Finish()
+
+	// Like with the Pusher, the tenantID is injected in the context too.
+	ctx = user.InjectOrgID(ctx, tenantID)
+
+	err := w.pusher.PushRawToStorage(ctx, tenantID, content)
+	switch {
+	case err == nil:
+		w.skips.pushed()
+	case mimirpb.IsClientError(err):
+		w.skips.skipped(tenantID, err)
+		w.clientErrors.add(tenantID, err)
+	}
+
+	// Each record is pushed on its own, so the error is returned annotated with the action decided by the ErrorPolicy.
+	return w.errorHandler.handle(ctx, err)
+}
@@ -0,0 +1,251 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+// rawPusherMock is a Pusher which implements RawPusher, recording the tenants of the requests pushed each way.
+type rawPusherMock struct {
+	mx      sync.Mutex
+	decoded []string
+	raw     []string
+	rawErr  error
+	// onRaw, if not nil, is called for each raw push.
+	onRaw func()
+}
+
+func (p *rawPusherMock) PushToStorage(ctx context.Context, _ *mimirpb.WriteRequest) error {
+	tenantID, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.decoded = append(p.decoded, tenantID)
+	return nil
+}
+
+func (p *rawPusherMock) PushRawToStorage(ctx context.Context, tenantID string, content []byte) error {
+	if ctxTenantID, err := user.ExtractOrgID(ctx); err != nil || ctxTenantID != tenantID {
+		return errors.New("the tenant isn't in the context")
+	}
+	if err := (&mimirpb.WriteRequest{}).Unmarshal(content); err != nil {
+		return err
+	}
+	if p.onRaw != nil {
+		p.onRaw()
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.raw = append(p.raw, tenantID)
+	return p.rawErr
+}
+
+func TestPusherConsumer_RawPusher(t *testing.T) {
+	wr := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}
+	content, err := wr.Marshal()
+	require.NoError(t, err)
+	compressed := gzipCompress(t, content)
+	corrupted := append(append([]byte(nil), compressed[:10]...), 0xff, 0xff, 0xff)
+
+	limits := validation.MockOverrides(func(_ *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		tenantLimits["drop-exemplars"] = validation.MockDefaultLimits()
+		tenantLimits["drop-exemplars"].IngestStorageDropExemplars = true
+	})
+
+	tests := map[string]struct {
+		cfg             KafkaConfig
+		opts            []PusherConsumerOption
+		records         []record
+		rawErr          error
+		expectedRaw     []string
+		expectedDecoded []string
+		expectedErr     string
+	}{
+		"should push the records without decoding them": {
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: content},
+				{ctx: context.Background(), tenantID: "user-2", content: compressed},
+			},
+			expectedRaw: []string{"user-1", "user-2"},
+		},
+		"should push the records of the batches without decoding them": {
+			records: []record{
+				makeBatchRecord(t, "user-1", gzipCompress, wr, wr),
+				makeRecord(t, "user-2", wr, nil),
+			},
+			expectedRaw: []string{"user-1", "user-1", "user-2"},
+		},
+		"should decode the records of the tenants whose limits transform the requests": {
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: content},
+				{ctx: context.Background(), tenantID: "drop-exemplars", content: content},
+			},
+			expectedRaw:     []string{"user-1"},
+			expectedDecoded: []string{"drop-exemplars"},
+		},
+		"should decode the records if a transform is enabled": {
+			cfg: KafkaConfig{IngestionMaxSampleAge: time.Hour},
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: content},
+			},
+			expectedDecoded: []string{"user-1"},
+		},
+		"should decode the records if custom stages are configured": {
+			opts: []PusherConsumerOption{WithStages(func(defaults []Stage) []Stage { return defaults })},
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: content},
+			},
+			expectedDecoded: []string{"user-1"},
+		},
+		"should decode the records if the writes are parallelized": {
+			cfg: KafkaConfig{IngestionConcurrencyMax: 2, IngestionConcurrencyBatchSize: 10, IngestionConcurrencyQueueCapacity: 1, IngestionConcurrencyEstimatedBytesPerSample: 100, IngestionConcurrencyTargetFlushesPerShard: 1},
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: content},
+			},
+			expectedDecoded: []string{"user-1"},
+		},
+		"should skip the records rejected with a client error": {
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: content},
+				{ctx: context.Background(), tenantID: "user-2", content: content},
+			},
+			rawErr:      ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "sample out of bounds"),
+			expectedRaw: []string{"user-1", "user-2"},
+		},
+		"should abort on server errors": {
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: content},
+				{ctx: context.Background(), tenantID: "user-2", content: content},
+			},
+			rawErr:      errors.New("storage unavailable"),
+			expectedRaw: []string{"user-1"},
+			expectedErr: "consuming record at index 0 for tenant user-1: storage unavailable",
+		},
+		"should skip the records which can't be decompressed": {
+			records: []record{
+				{ctx: context.Background(), tenantID: "user-1", content: corrupted},
+				{ctx: context.Background(), tenantID: "user-2", content: content},
+			},
+			expectedRaw: []string{"user-2"},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pusher := &rawPusherMock{rawErr: testData.rawErr}
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, testData.cfg, limits, metrics, log.NewNopLogger(), testData.opts...)
+
+			err := c.Consume(context.Background(), testData.records)
+			if testData.expectedErr != "" {
+				require.EqualError(t, err, testData.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, testData.expectedRaw, pusher.raw)
+			assert.Equal(t, testData.expectedDecoded, pusher.decoded)
+			assert.Equal(t, float64(len(testData.expectedRaw)), testutil.ToFloat64(metrics.rawRecords))
+		})
+	}
+}
+
+func TestPusherConsumer_RawPusher_Middlewares(t *testing.T) {
+	wr := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}
+
+	t.Run("should track the raw pushes in flight", func(t *testing.T) {
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		var inflightAge time.Duration
+		pusher := &rawPusherMock{onRaw: func() {
+			time.Sleep(time.Millisecond)
+			inflightAge = metrics.inflightPushes.oldestAge()
+		}}
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		require.NoError(t, c.Consume(context.Background(), []record{makeRecord(t, "user-1", wr, nil)}))
+		assert.Equal(t, []string{"user-1"}, pusher.raw)
+		assert.Greater(t, inflightAge, time.Duration(0))
+		assert.Equal(t, time.Duration(0), metrics.inflightPushes.oldestAge())
+	})
+
+	t.Run("should recover from the panics of the raw pushes", func(t *testing.T) {
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		pusher := &rawPusherMock{onRaw: func() { panic("raw push panicked") }}
+		c := newPusherConsumer(pusher, KafkaConfig{LogServerErrorFirstSeries: true}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		err := c.Consume(context.Background(), []record{makeRecord(t, "user-1", wr, nil)})
+		var panicErr *RecordPanicError
+		require.ErrorAs(t, err, &panicErr)
+		assert.Equal(t, "user-1", panicErr.TenantID)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.panics))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.rawRecords))
+	})
+}
+
+func TestNewPartitionReaderForPusher_RawPusher(t *testing.T) {
+	wr := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}
+	cfg := createTestKafkaConfig("localhost:0", "test")
+	// The middlewares wrapping the Pusher forward the raw pushes.
+	if pushLatencyInjectionAllowed {
+		cfg.InjectedPushLatency = time.Millisecond
+	}
+	cfg.TenantCircuitBreakerEnabled = true
+	cfg.TenantCircuitBreakerFailureThreshold = 10
+	cfg.TenantCircuitBreakerCooldownPeriod = time.Minute
+	cfg.ServerErrorRatioHealthThreshold = 0.5
+	cfg.ServerErrorRatioHealthWindow = 10
+
+	t.Run("should push the records without decoding them through the middlewares", func(t *testing.T) {
+		pusher := &rawPusherMock{}
+		r, err := NewPartitionReaderForPusher(cfg, 1, "test", pusher, validation.MockDefaultOverrides(), log.NewNopLogger(), prometheus.NewPedanticRegistry())
+		require.NoError(t, err)
+
+		require.NoError(t, r.newConsumer.consumer().Consume(context.Background(), []record{makeRecord(t, "user-1", wr, nil), makeRecord(t, "user-2", wr, nil)}))
+		assert.Equal(t, []string{"user-1", "user-2"}, pusher.raw)
+		assert.Empty(t, pusher.decoded)
+		assert.Equal(t, float64(2), testutil.ToFloat64(r.consumerMetrics.rawRecords))
+	})
+
+	t.Run("should decode the records if the Pusher isn't a RawPusher", func(t *testing.T) {
+		var pushed []string
+		pusher := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+			tenantID, err := user.ExtractOrgID(ctx)
+			require.NoError(t, err)
+			pushed = append(pushed, tenantID)
+			return nil
+		})
+		r, err := NewPartitionReaderForPusher(cfg, 1, "test", pusher, validation.MockDefaultOverrides(), log.NewNopLogger(), prometheus.NewPedanticRegistry())
+		require.NoError(t, err)
+
+		require.NoError(t, r.newConsumer.consumer().Consume(context.Background(), []record{makeRecord(t, "user-1", wr, nil)}))
+		assert.Equal(t, []string{"user-1"}, pushed)
+		assert.Equal(t, float64(0), testutil.ToFloat64(r.consumerMetrics.rawRecords))
+	})
+
+	t.Run("should fail if the merge window is enabled", func(t *testing.T) {
+		mergeCfg := cfg
+		mergeCfg.IngestionMergeWindow = time.Second
+		mergeCfg.IngestionMergeMaxBytes = 1024
+		_, err := NewPartitionReaderForPusher(mergeCfg, 1, "test", &rawPusherMock{}, validation.MockDefaultOverrides(), log.NewNopLogger(), prometheus.NewPedanticRegistry())
+		require.ErrorIs(t, err, errMergeWindowWithRawPusher)
+	})
+}
@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// The results of the read-back verifications.
+const (
+	readBackAgreed    = "agreed"
+	readBackDisagreed = "disagreed"
+	readBackFailed    = "failed"
+)
+
+// ReadBackSample is a float sample of a record which has been pushed to the storage, to read back from the storage.
+type ReadBackSample struct {
+	// Offset is the offset of the record the sample has been pushed with.
+	Offset int64
+	// TenantID is the tenant the sample has been pushed as, which is the remapped tenant if a TenantRemapper is configured.
+	TenantID string
+	// Labels are the labels of the series of the sample, once the configured transforms have been applied.
+	Labels    labels.Labels
+	Timestamp int64
+	Value     float64
+}
+
+// ReadBackVerifier reads the samples pushed to the storage back from it, for example by querying the storage through
+// its Reader, to validate the write path end to end, for example while migrating it.
+type ReadBackVerifier interface {
+	// VerifyReadBack returns whether the sample has been read back from the storage with the same value. It returns an
+	// error if the storage couldn't be read.
+	VerifyReadBack(ctx context.Context, sample ReadBackSample) (bool, error)
+}
+
+// WithReadBackVerification configures the consumer to read a sample of a fraction, between 0 and 1, of the records
+// pushed to the storage back with the verifier, and to count whether the storage agrees with the pushed sample. The
+// first float sample of each sampled record is verified, and the records without float samples, or pushed without
+// being decoded, aren't verified.
+//
+// Reading back the storage is expensive, so the fraction should be small. The samples are verified once the batch of
+// records they've been pushed with has been successfully consumed, because the records pushed in parallel may still be
+// in flight until then. They're verified by the consuming goroutine, so the verification slows the consumption down.
+// If the consumption of a batch fails, none of its samples is verified.
+func WithReadBackVerification(verifier ReadBackVerifier, fraction float64) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.readBackVerifier = verifier
+		c.readBackFraction = fraction
+	}
+}
+
+// readBackEnabled returns whether the samples of the records are read back from the storage once pushed.
+func (c pusherConsumer) readBackEnabled() bool {
+	return c.readBackVerifier != nil && c.readBackFraction > 0
+}
+
+// readBackBuffer accumulates the samples to read back while consuming a batch. It's safe for concurrent use.
+// A nil *readBackBuffer is a no-op.
+type readBackBuffer struct {
+	fraction float64
+
+	mx      sync.Mutex
+	samples []ReadBackSample
+}
+
+// sample picks the first float sample of the request to read back, if the request has been sampled. It must be called
+// before the request is pushed, because the request may be returned to the pool once pushed.
+func (b *readBackBuffer) sample(offset int64, tenantID string, req *mimirpb.WriteRequest) {
+	if b == nil || rand.Float64() >= b.fraction {
+		return
+	}
+
+	for _, ts := range req.Timeseries {
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		s := ReadBackSample{
+			Offset:    offset,
+			TenantID:  tenantID,
+			Labels:    mimirpb.FromLabelAdaptersToLabelsWithCopy(ts.Labels),
+			Timestamp: ts.Samples[0].TimestampMs,
+			Value:     ts.Samples[0].Value,
+		}
+		b.mx.Lock()
+		b.samples = append(b.samples, s)
+		b.mx.Unlock()
+		return
+	}
+}
+
+// verify reads the buffered samples back with the verifier, and counts the results.
+func (b *readBackBuffer) verify(ctx context.Context, verifier ReadBackVerifier, results *prometheus.CounterVec, logger log.Logger) {
+	if b == nil {
+		return
+	}
+
+	for _, s := range b.samples {
+		agreed, err := verifier.VerifyReadBack(ctx, s)
+		switch {
+		case err != nil:
+			results.WithLabelValues(readBackFailed).Inc()
+			level.Warn(spanlogger.FromContext(ctx, logger)).Log("msg", "failed to read back a sample pushed to the storage", "user", s.TenantID, "offset", s.Offset, "err", err)
+		case !agreed:
+			results.WithLabelValues(readBackDisagreed).Inc()
+			level.Warn(spanlogger.FromContext(ctx, logger)).Log("msg", "the sample read back from the storage doesn't match the pushed sample", "user", s.TenantID, "offset", s.Offset, "metric", s.Labels.Get(labels.MetricName), "timestamp", s.Timestamp)
+		default:
+			results.WithLabelValues(readBackAgreed).Inc()
+		}
+	}
+}
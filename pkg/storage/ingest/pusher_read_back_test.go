@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+type readBackVerifierFunc func(ctx context.Context, sample ReadBackSample) (bool, error)
+
+func (f readBackVerifierFunc) VerifyReadBack(ctx context.Context, sample ReadBackSample) (bool, error) {
+	return f(ctx, sample)
+}
+
+func TestPusherConsumer_ReadBackVerification(t *testing.T) {
+	newRecord := func(offset int64, timeseries ...mimirpb.PreallocTimeseries) record {
+		r := makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: timeseries}, nil)
+		r.offset = offset
+		return r
+	}
+	histogramSeries := mockPreallocTimeseries("histogram")
+	histogramSeries.Samples = nil
+	histogramSeries.Histograms = []mimirpb.Histogram{{Timestamp: 1}}
+
+	records := []record{
+		newRecord(1, mockPreallocTimeseries("series_1")),
+		newRecord(2, histogramSeries, mockPreallocTimeseries("series_2")),
+		newRecord(3, histogramSeries),
+		newRecord(4, mockPreallocTimeseries("series_4")),
+	}
+
+	// The storage has the samples of the first record only, and fails to be read for the last record.
+	var verified []ReadBackSample
+	verifier := readBackVerifierFunc(func(_ context.Context, sample ReadBackSample) (bool, error) {
+		verified = append(verified, sample)
+		switch sample.Offset {
+		case 1:
+			return true, nil
+		case 4:
+			return false, errors.New("storage unavailable")
+		}
+		return false, nil
+	})
+
+	var pushErr error
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return pushErr })
+
+	t.Run("should verify the first float sample of the sampled records once the batch has been consumed", func(t *testing.T) {
+		verified = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithReadBackVerification(verifier, 1))
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		expected := map[int64]string{1: "series_1", 2: "series_2", 4: "series_4"}
+		require.Len(t, verified, len(expected))
+		for _, sample := range verified {
+			assert.Equal(t, "user-1", sample.TenantID)
+			assert.Equal(t, labels.FromStrings(labels.MetricName, expected[sample.Offset]).String(), sample.Labels.String())
+			assert.Equal(t, int64(1), sample.Timestamp)
+			assert.Equal(t, float64(2), sample.Value)
+		}
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.readBackVerifications.WithLabelValues(readBackAgreed)))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.readBackVerifications.WithLabelValues(readBackDisagreed)))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.readBackVerifications.WithLabelValues(readBackFailed)))
+	})
+
+	t.Run("should not verify the samples of a batch which failed to be consumed", func(t *testing.T) {
+		verified, pushErr = nil, errors.New("server error")
+		t.Cleanup(func() { pushErr = nil })
+
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithReadBackVerification(verifier, 1))
+		require.Error(t, c.Consume(context.Background(), records))
+		assert.Empty(t, verified)
+	})
+
+	t.Run("should not verify any sample without fraction", func(t *testing.T) {
+		verified = nil
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithReadBackVerification(verifier, 0))
+		require.NoError(t, c.Consume(context.Background(), records))
+		assert.Empty(t, verified)
+	})
+}
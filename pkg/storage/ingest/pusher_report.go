@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/grafana/dskit/grpcutil"
+	"github.com/grafana/dskit/user"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// ConsumeReport summarizes the consumption of a batch of records.
+type ConsumeReport struct {
+	// ClientErrors are the client errors returned by the storage while pushing the batch, aggregated by tenant and
+	// cause and sorted by tenant and cause. The client errors don't abort the consumption, so they're otherwise only logged.
+	ClientErrors []ClientErrorSummary
+
+	// Tenants are the number of records of each tenant encountered while consuming the batch, whether they've been
+	// pushed or skipped, keyed by the tenant the records have been written with. The records left unconsumed once
+	// the consumption has failed aren't counted.
+	Tenants map[string]int
+}
+
+// ConsumeCancelledError is returned by Consume when its context has been cancelled or it's been aborted before all
+// the records have been consumed. It carries the progress made until then, so that the caller can commit the offset
+// of the records which have been processed instead of consuming them again.
+type ConsumeCancelledError struct {
+	// Err is the cause of the cancellation, or the cause of the abort.
+	Err error
+	// Report summarizes the consumption of the records until the cancellation.
+	Report ConsumeReport
+	// LastProcessedOffset is the highest offset such that the records at that offset and all the lower offsets have
+	// been processed, like the one returned by ConsumeWithLastProcessedOffset. It's -1 if no record has been processed,
+	// if the offsets aren't tracked because the records are consumed with Consume, or if the records for which no error
+	// has been returned may not have been pushed.
+	LastProcessedOffset int64
+}
+
+func (e *ConsumeCancelledError) Error() string { return e.Err.Error() }
+func (e *ConsumeCancelledError) Unwrap() error { return e.Err }
+
+// ClientErrorSummary aggregates the client errors with the same cause returned for the write requests of a tenant.
+type ClientErrorSummary struct {
+	TenantID string
+	// Cause is the cause in the mimirpb.ErrorDetails of the errors, or mimirpb.UNKNOWN_CAUSE if they have no details.
+	Cause mimirpb.ErrorCause
+	// Count is the number of write requests which failed with a client error with this cause.
+	Count int
+	// FirstError is the message of the first of these errors, for example the limit which has been hit.
+	FirstError string
+}
+
+// WithConsumeReports configures the consumer to call the function with the report of each consumed batch of records,
+// once the batch has been consumed, whether its consumption has succeeded or not. The function is called by the
+// consuming goroutine, so it should return quickly. The client errors are still logged as usual.
+func WithConsumeReports(fn func(ConsumeReport)) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.consumeReports = fn
+	}
+}
+
+// report returns the report of the batch consumed by this copy of the consumer so far.
+func (c pusherConsumer) report() ConsumeReport {
+	report := c.clientErrors.report()
+	report.Tenants = c.tenantRecords.report()
+	return report
+}
+
+// errorDetailsCause returns the cause in the mimirpb.ErrorDetails of the gRPC status of err, if any.
+func errorDetailsCause(err error) (mimirpb.ErrorCause, bool) {
+	stat, ok := grpcutil.ErrorToStatus(err)
+	if !ok {
+		return mimirpb.UNKNOWN_CAUSE, false
+	}
+	for _, details := range stat.Details() {
+		if errDetails, ok := details.(*mimirpb.ErrorDetails); ok {
+			return errDetails.GetCause(), true
+		}
+	}
+	return mimirpb.UNKNOWN_CAUSE, false
+}
+
+// clientErrorAggregator aggregates the client errors returned while consuming a batch of records. It's safe for concurrent use.
+// A nil *clientErrorAggregator is a no-op.
+type clientErrorAggregator struct {
+	mx        sync.Mutex
+	summaries map[clientErrorSummaryKey]*ClientErrorSummary
+}
+
+type clientErrorSummaryKey struct {
+	tenantID string
+	cause    mimirpb.ErrorCause
+}
+
+func newClientErrorAggregator() *clientErrorAggregator {
+	return &clientErrorAggregator{summaries: map[clientErrorSummaryKey]*ClientErrorSummary{}}
+}
+
+func (a *clientErrorAggregator) add(tenantID string, err error) {
+	if a == nil {
+		return
+	}
+
+	cause, _ := errorDetailsCause(err)
+	key := clientErrorSummaryKey{tenantID: tenantID, cause: cause}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	summary, ok := a.summaries[key]
+	if !ok {
+		summary = &ClientErrorSummary{TenantID: tenantID, Cause: cause, FirstError: err.Error()}
+		a.summaries[key] = summary
+	}
+	summary.Count++
+}
+
+// report returns the report of the aggregated client errors.
+func (a *clientErrorAggregator) report() ConsumeReport {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	var report ConsumeReport
+	for _, summary := range a.summaries {
+		report.ClientErrors = append(report.ClientErrors, *summary)
+	}
+	slices.SortFunc(report.ClientErrors, func(a, b ClientErrorSummary) int {
+		return cmp.Or(cmp.Compare(a.TenantID, b.TenantID), cmp.Compare(a.Cause, b.Cause))
+	})
+	return report
+}
+
+// tenantRecordCounter counts the records of each tenant encountered while consuming a batch of records.
+// It's safe for concurrent use. A nil *tenantRecordCounter is a no-op.
+type tenantRecordCounter struct {
+	mx     sync.Mutex
+	counts map[string]int
+}
+
+func newTenantRecordCounter() *tenantRecordCounter {
+	return &tenantRecordCounter{counts: map[string]int{}}
+}
+
+func (t *tenantRecordCounter) add(tenantID string) {
+	if t == nil {
+		return
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.counts[tenantID]++
+}
+
+// report returns a copy of the counts, or nil if no record has been counted.
+func (t *tenantRecordCounter) report() map[string]int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if len(t.counts) == 0 {
+		return nil
+	}
+	return maps.Clone(t.counts)
+}
+
+// clientErrorAggregatingPusher is a Pusher middleware which adds the client errors of the upstream Pusher to an aggregator.
+type clientErrorAggregatingPusher struct {
+	upstream   Pusher
+	aggregator *clientErrorAggregator
+}
+
+// PushToStorage implements the Pusher interface.
+func (p clientErrorAggregatingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	err := p.upstream.PushToStorage(ctx, req)
+	if err != nil && mimirpb.IsClientError(err) {
+		tenantID, _ := user.ExtractOrgID(ctx)
+		p.aggregator.add(tenantID, err)
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_WithConsumeReports(t *testing.T) {
+	newRecord := func(tenantID, metricName string) record {
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+	}
+
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		switch request.Timeseries[0].Labels[0].Value {
+		case "too_many_series":
+			return ingesterError(mimirpb.TENANT_LIMIT, codes.FailedPrecondition, "per-user series limit of 10 exceeded")
+		case "bad_data":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "sample out of bounds")
+		case "server_error":
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		}
+		return nil
+	})
+
+	tests := map[string]struct {
+		records        []record
+		expectedErr    bool
+		expectedReport ConsumeReport
+	}{
+		"should report no client error": {
+			records:        []record{newRecord("user-1", "series_1")},
+			expectedReport: ConsumeReport{Tenants: map[string]int{"user-1": 1}},
+		},
+		"should aggregate the client errors by tenant and cause": {
+			records: []record{
+				newRecord("user-2", "bad_data"),
+				newRecord("user-1", "too_many_series"),
+				newRecord("user-1", "series_1"),
+				newRecord("user-1", "too_many_series"),
+				newRecord("user-1", "bad_data"),
+			},
+			expectedReport: ConsumeReport{ClientErrors: []ClientErrorSummary{
+				{TenantID: "user-1", Cause: mimirpb.BAD_DATA, Count: 1, FirstError: "rpc error: code = InvalidArgument desc = sample out of bounds"},
+				{TenantID: "user-1", Cause: mimirpb.TENANT_LIMIT, Count: 2, FirstError: "rpc error: code = FailedPrecondition desc = per-user series limit of 10 exceeded"},
+				{TenantID: "user-2", Cause: mimirpb.BAD_DATA, Count: 1, FirstError: "rpc error: code = InvalidArgument desc = sample out of bounds"},
+			}, Tenants: map[string]int{"user-1": 4, "user-2": 1}},
+		},
+		"should report the client errors encountered before a server error": {
+			records:     []record{newRecord("user-1", "bad_data"), newRecord("user-2", "server_error"), newRecord("user-3", "series_1")},
+			expectedErr: true,
+			expectedReport: ConsumeReport{ClientErrors: []ClientErrorSummary{
+				{TenantID: "user-1", Cause: mimirpb.BAD_DATA, Count: 1, FirstError: "rpc error: code = InvalidArgument desc = sample out of bounds"},
+			}, Tenants: map[string]int{"user-1": 1, "user-2": 1}},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var reports []ConsumeReport
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithConsumeReports(func(r ConsumeReport) {
+				reports = append(reports, r)
+			}))
+
+			err := c.Consume(context.Background(), testData.records)
+			if testData.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Len(t, reports, 1)
+			assert.Equal(t, testData.expectedReport, reports[0])
+
+			// Each batch gets its own report.
+			require.NoError(t, c.Consume(context.Background(), []record{newRecord("user-1", "series_1")}))
+			require.Len(t, reports, 2)
+			assert.Equal(t, ConsumeReport{Tenants: map[string]int{"user-1": 1}}, reports[1])
+		})
+	}
+}
+
+func TestPusherConsumer_ConsumeCancelled(t *testing.T) {
+	var records []record
+	for i := 0; i < 5; i++ {
+		r := makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)
+		r.offset = int64(i)
+		records = append(records, r)
+	}
+
+	t.Run("should return the progress made before the context has been cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		pushes := 0
+		pusher := pusherFunc(func(pushCtx context.Context, _ *mimirpb.WriteRequest) error {
+			if err := pushCtx.Err(); err != nil {
+				return err
+			}
+			if pushes++; pushes == 2 {
+				cancel()
+			}
+			return nil
+		})
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+		lastProcessed, err := c.ConsumeWithLastProcessedOffset(ctx, records)
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, int64(1), lastProcessed)
+
+		var cancelled *ConsumeCancelledError
+		require.ErrorAs(t, err, &cancelled)
+		assert.Equal(t, int64(1), cancelled.LastProcessedOffset)
+		assert.GreaterOrEqual(t, cancelled.Report.Tenants["user-1"], 2)
+	})
+
+	t.Run("should return the progress made before the consume has been aborted", func(t *testing.T) {
+		var c *pusherConsumer
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			c.Abort(errors.New("emergency stop"))
+			return nil
+		})
+		c = newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+		err := c.Consume(context.Background(), records)
+		require.EqualError(t, err, "emergency stop")
+
+		var cancelled *ConsumeCancelledError
+		require.ErrorAs(t, err, &cancelled)
+		assert.Equal(t, int64(-1), cancelled.LastProcessedOffset, "the offsets aren't tracked by Consume")
+		assert.GreaterOrEqual(t, cancelled.Report.Tenants["user-1"], 1)
+	})
+}
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"sync"
+)
+
+// RecordResult is the result of consuming a single record.
+type RecordResult struct {
+	// Outcome is what happened to the record, as logged by the record outcome logger: "pushed", "failed", "panic",
+	// "parse_error", "parse_error_aborted", "tenant_max_inflight_bytes", or the reason the record has been rejected
+	// with, like "empty_tenant" or "stale_deadline". It's empty if the record hasn't been processed, for example
+	// because the consumption has stopped before it, or because some of its chunks haven't been consumed.
+	Outcome string
+	// Err is the error which caused the record to be skipped or the consumption to be aborted.
+	// It's nil if the record has been pushed or skipped because of a client error.
+	Err error
+}
+
+// ConsumeWithResults is like Consume, but it also returns the result of each of the given records, at the same
+// position as the record. The results are collected whether the consumption succeeds or fails, so they tell which
+// records have been processed before the consumption failed and how.
+//
+// The records are matched with their results by offset, so the records must have distinct offsets, like the records
+// read from a partition have. The records split from a batch share the offset of the batch, whose result is the one of
+// its first record which hasn't been successfully pushed, if any. The chunks of a record share the result of the
+// record. When the writes are parallelized, the errors of the series still in flight once a record has been handed
+// over to the storage writer are only returned by the consumption, like with WithRecordOutcomes.
+//
+// The results are held in memory until the consumption ends, which costs a few tens of bytes per record, plus the
+// errors. For large batches, prefer WithRecordOutcomes or WithConsumeReports, which don't retain the results.
+func (c pusherConsumer) ConsumeWithResults(ctx context.Context, records []record) ([]RecordResult, error) {
+	c.results = newRecordResults(records)
+	err := c.Consume(ctx, records)
+	return c.results.report(), err
+}
+
+// recordResults collects the results of the records of a consume. It's safe for concurrent use.
+// A nil *recordResults collects nothing.
+type recordResults struct {
+	mx sync.Mutex
+	// positions are the positions of the records with each offset, since the records are tracked by offset once split
+	// from their batch or reassembled from their chunks.
+	positions map[int64][]int
+	// chunks are the offsets of the chunks of each reassembled record, other than the one of the record.
+	chunks  map[int64][]int64
+	results []RecordResult
+}
+
+func newRecordResults(records []record) *recordResults {
+	r := &recordResults{
+		positions: make(map[int64][]int, len(records)),
+		chunks:    map[int64][]int64{},
+		results:   make([]RecordResult, len(records)),
+	}
+	for i, rec := range records {
+		r.positions[rec.offset] = append(r.positions[rec.offset], i)
+	}
+	return r
+}
+
+// record records the outcome of the record at the offset. A result replaces the previous one of the same offset,
+// recorded for another record split from the same batch, only if the previous record has been pushed or if it
+// replaces a client error with an error.
+func (r *recordResults) record(offset int64, outcome string, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for _, i := range r.positions[offset] {
+		prev := r.results[i]
+		if prev.Outcome == "" || prev.Outcome == outcomePushed || (prev.Err == nil && err != nil) {
+			r.results[i] = RecordResult{Outcome: outcome, Err: err}
+		}
+	}
+}
+
+// reassembled records that the chunks at the others offsets have been reassembled into the record at the offset.
+func (r *recordResults) reassembled(offset int64, others []int64) {
+	if r == nil || len(others) == 0 {
+		return
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.chunks[offset] = append(r.chunks[offset], others...)
+}
+
+// report returns the results of the records, at the position of each record.
+func (r *recordResults) report() []RecordResult {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for offset, others := range r.chunks {
+		var result RecordResult
+		if positions := r.positions[offset]; len(positions) > 0 {
+			result = r.results[positions[0]]
+		}
+		for _, other := range others {
+			for _, i := range r.positions[other] {
+				r.results[i] = result
+			}
+		}
+	}
+	return r.results
+}
@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_ConsumeWithResults(t *testing.T) {
+	newRecord := func(tenantID, metricName string, offset int64) record {
+		r := makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+		r.offset = offset
+		return r
+	}
+
+	chunked := newRecord("user-1", "series_2", 0).content
+	chunks, err := EncodeChunks("record-1", chunked, len(chunked)/2+1)
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	batch, err := EncodeBatch([]BatchEntry{{Content: newRecord("user-1", "series_3", 0).content}, {Content: []byte{0}}})
+	require.NoError(t, err)
+
+	records := []record{
+		newRecord("user-1", "series_1", 1),
+		newRecord("", "series_1", 2),
+		{ctx: context.Background(), tenantID: "user-1", offset: 3, content: chunks[0]},
+		{ctx: context.Background(), tenantID: "user-1", offset: 4, content: chunks[1]},
+		{ctx: context.Background(), tenantID: "user-1", offset: 5, content: batch},
+		newRecord("user-1", "series_4", 6),
+		newRecord("user-1", "series_5", 7),
+	}
+
+	serverErr := errors.New("server error")
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		if request.Timeseries[0].Labels[0].Value == "series_4" {
+			return serverErr
+		}
+		return nil
+	})
+
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+	results, err := c.ConsumeWithResults(context.Background(), records)
+	require.ErrorIs(t, err, serverErr)
+	require.Len(t, results, len(records))
+
+	assert.Equal(t, RecordResult{Outcome: outcomePushed}, results[0])
+	assert.Equal(t, RecordResult{Outcome: reasonEmptyTenant, Err: errEmptyTenant}, results[1])
+
+	// The chunks of the record share its result.
+	assert.Equal(t, RecordResult{Outcome: outcomePushed}, results[2])
+	assert.Equal(t, RecordResult{Outcome: outcomePushed}, results[3])
+
+	// The result of the batch is the one of its record which couldn't be parsed.
+	assert.Equal(t, outcomeParseError, results[4].Outcome)
+	assert.Error(t, results[4].Err)
+
+	assert.Equal(t, outcomeFailed, results[5].Outcome)
+	assert.ErrorIs(t, results[5].Err, serverErr)
+
+	// The consumption has been aborted before the last record.
+	assert.Equal(t, RecordResult{}, results[6])
+}
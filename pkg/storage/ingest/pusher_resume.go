@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+// ResumptionToken captures where a consume has stopped because of the maximum number of records, the maximum consume
+// duration or the maximum number of tenants per consume, so that the next consume of the records resumes exactly where
+// it stopped, including within a batch of records which has only been partially split. It's serializable, so that it
+// can be stored alongside the records it refers to.
+type ResumptionToken struct {
+	// Reason is why the consume has stopped.
+	Reason string `json:"reason"`
+	// Records are the records left to consume, in the order they're to be consumed in.
+	Records []ResumptionRecord `json:"records"`
+}
+
+// ResumptionRecord is a record left to consume by a ResumptionToken.
+type ResumptionRecord struct {
+	// Offset is the offset of the record.
+	Offset int64 `json:"offset"`
+	// ConsumedBatchEntries is the number of entries of the batch held by the record which have already been consumed,
+	// if the consume has stopped while splitting it.
+	ConsumedBatchEntries int `json:"consumed_batch_entries,omitempty"`
+	// Deferred is set if the record has been left because of the maximum number of tenants per consume.
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+// ResumptionToken returns the token to resume the consume from.
+func (e *unprocessedRecordsError) ResumptionToken() ResumptionToken {
+	token := ResumptionToken{Reason: e.reason, Records: make([]ResumptionRecord, 0, len(e.records))}
+	for _, r := range e.records {
+		token.Records = append(token.Records, ResumptionRecord{
+			Offset:               r.offset,
+			ConsumedBatchEntries: r.consumedBatchEntries,
+			Deferred:             r.deferred,
+		})
+	}
+	return token
+}
+
+// resume returns the records to consume to resume a consume of the records from where the token has been returned.
+// The records are looked up by their offset, so the records the token refers to which aren't given are ignored.
+func (t ResumptionToken) resume(records []record) []record {
+	byOffset := make(map[int64]record, len(records))
+	for _, r := range records {
+		if _, ok := byOffset[r.offset]; !ok {
+			byOffset[r.offset] = r
+		}
+	}
+
+	resumed := make([]record, 0, len(t.Records))
+	for _, tr := range t.Records {
+		r, ok := byOffset[tr.Offset]
+		if !ok {
+			continue
+		}
+		r.consumedBatchEntries = tr.ConsumedBatchEntries
+		r.deferred = tr.Deferred
+		resumed = append(resumed, r)
+	}
+	return resumed
+}
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_ResumptionToken(t *testing.T) {
+	wrs := make([]*mimirpb.WriteRequest, 0, 6)
+	for i := 0; i < 6; i++ {
+		wrs = append(wrs, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}})
+	}
+
+	// The records are a batch of 4 requests followed by 2 single requests.
+	records := []record{makeBatchRecord(t, "user-1", nil, wrs[:4]...)}
+	records[0].offset = 10
+	for i, wr := range wrs[4:] {
+		r := makeRecord(t, "user-1", wr, nil)
+		r.offset = int64(11 + i)
+		records = append(records, r)
+	}
+
+	var (
+		pushedMx sync.Mutex
+		pushed   []string
+	)
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushedMx.Lock()
+		defer pushedMx.Unlock()
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	t.Run("should resume a partially split batch from the serialized token", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+
+		// The consume duration is exceeded as soon as the first entry of the batch has been sent.
+		c := newPusherConsumer(pusher, KafkaConfig{MaxConsumeDuration: time.Nanosecond}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, c.Consume(context.Background(), records), &unprocessed)
+		assert.Equal(t, []string{"series_0"}, pushed)
+
+		token := unprocessed.ResumptionToken()
+		assert.Equal(t, ResumptionToken{
+			Reason: unprocessedMaxConsumeDuration,
+			Records: []ResumptionRecord{
+				{Offset: 10, ConsumedBatchEntries: 1},
+				{Offset: 11},
+				{Offset: 12},
+			},
+		}, token)
+
+		encoded, err := json.Marshal(token)
+		require.NoError(t, err)
+		var decoded ResumptionToken
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		require.Equal(t, token, decoded)
+
+		c = newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), decoded.resume(records)))
+		assert.Equal(t, []string{"series_0", "series_1", "series_2", "series_3", "series_4", "series_5"}, pushed)
+	})
+
+	t.Run("should resume after the records exceeding the maximum number of records", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+
+		c := newPusherConsumer(pusher, KafkaConfig{MaxRecordsPerConsume: 2}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, c.Consume(context.Background(), records), &unprocessed)
+		assert.Equal(t, []string{"series_0", "series_1", "series_2", "series_3", "series_4"}, pushed)
+
+		resumed := unprocessed.ResumptionToken().resume(records)
+		assert.Equal(t, records[2:], resumed)
+		require.NoError(t, c.Consume(context.Background(), resumed))
+		assert.Equal(t, []string{"series_0", "series_1", "series_2", "series_3", "series_4", "series_5"}, pushed)
+	})
+
+	t.Run("should ignore the records of the token which aren't given", func(t *testing.T) {
+		token := ResumptionToken{Records: []ResumptionRecord{{Offset: 12}, {Offset: 13}}}
+		assert.Equal(t, records[2:], token.resume(records))
+	})
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/dskit/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// retryBudget is the number of retries of the records failing to be pushed with a server error which are allowed while
+// consuming a batch of records. It's shared by all the records of the batch, so that a bad batch can't retry each of its
+// records many times: once the budget is exhausted, the server errors abort the consumption of the batch as usual.
+// It's safe for concurrent use. A nil *retryBudget never allows a retry.
+type retryBudget struct {
+	remaining *atomic.Int64
+	gauge     prometheus.Gauge
+}
+
+func newRetryBudget(retries int, gauge prometheus.Gauge) *retryBudget {
+	gauge.Set(float64(retries))
+	return &retryBudget{remaining: atomic.NewInt64(int64(retries)), gauge: gauge}
+}
+
+// tryAcquire takes a retry from the budget, and returns whether there was one left.
+func (b *retryBudget) tryAcquire() bool {
+	if b == nil {
+		return false
+	}
+
+	for {
+		remaining := b.remaining.Load()
+		if remaining <= 0 {
+			return false
+		}
+		if b.remaining.CompareAndSwap(remaining, remaining-1) {
+			b.gauge.Set(float64(remaining - 1))
+			return true
+		}
+	}
+}
+
+// recordRetriesEnabled returns whether the records failing to be pushed with a server error are retried. They're only
+// retried when each push error is returned for the record being pushed, which isn't the case when the series of the
+// records are pushed in parallel by the ingestion shards, or when the metadata-only records are pushed by their own workers.
+func (c pusherConsumer) recordRetriesEnabled() bool {
+	cfg := c.kafkaConfig
+	sequential := cfg.IngestionOrdering == ingestionOrderingRelaxed || cfg.IngestionConcurrencyMax == 0
+	return cfg.ConsumeRetryBudget > 0 && sequential && cfg.MetadataOnlyConcurrency == 0
+}
+
+// retryPush retries the push of the record which failed with err, as long as it fails with an error the ErrorPolicy
+// decides to retry, which are the server errors by default, and there are retries left in the batch's retry budget.
+// It returns the error of the last push.
+//
+// The request of the record may have been freed by the failed push, so it's decoded again from the content of the
+// record for each retry, and prepared like the first time.
+func (c pusherConsumer) retryPush(ctx context.Context, r parsedRecord, writer PusherCloser, err error) error {
+	if c.retryBudget == nil {
+		return err
+	}
+
+	// The retries are observed once the record has finally been pushed or has failed, including the records pushed
+	// without being retried, so that a shift of the distribution towards more retries is visible.
+	retries := 0
+	defer func() {
+		c.metrics.retriesPerRecord.Observe(float64(retries))
+	}()
+	if err == nil {
+		return nil
+	}
+
+	boff := backoff.New(ctx, backoff.Config{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second,
+	})
+
+	for err != nil && errorActionOf(err) == ErrorActionRetry && ctx.Err() == nil && c.retryBudget.tryAcquire() {
+		c.metrics.pushRetries.Inc()
+		retries++
+		boff.Wait()
+		if ctx.Err() != nil {
+			return err
+		}
+
+		if r.raw != nil {
+			// The raw content isn't retained by the RawPusher, so it can be pushed again as it is.
+			err = c.pushWithTimeout(r.ctx, r.tenantID, len(r.raw), func(ctx context.Context) error {
+				return writer.(rawStorageWriter).PushRawToStorage(ctx, r.tenantID, r.raw)
+			})
+			continue
+		}
+
+		var req *mimirpb.WriteRequest
+		if req, err = c.decode(r.content); err != nil {
+			return err
+		}
+		if err = c.prepareRequest(r.ctx, r.tenantID, req); err != nil {
+			return err
+		}
+		err = c.pushWithTimeout(r.ctx, r.tenantID, writeRequestSize(req), func(ctx context.Context) error {
+			return c.pushSplitting(ctx, r.tenantID, req, writer)
+		})
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/tenant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_RetryBudget(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-2", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+	}
+
+	tests := map[string]struct {
+		cfg               KafkaConfig
+		failures          map[string]int
+		expectedErr       bool
+		expectedRetries   int
+		expectedRemaining int
+		expectedObserved  uint64
+		expectedPushed    map[string]string
+	}{
+		"should retry the records within the budget": {
+			cfg:               KafkaConfig{ConsumeRetryBudget: 4},
+			failures:          map[string]int{"user-1": 2, "user-2": 1},
+			expectedRetries:   3,
+			expectedRemaining: 1,
+			expectedObserved:  2,
+			expectedPushed:    map[string]string{"user-1": "series_1", "user-2": "series_2"},
+		},
+		"should retry the records within the budget with the relaxed ordering": {
+			cfg:               KafkaConfig{ConsumeRetryBudget: 3, IngestionOrdering: ingestionOrderingRelaxed, IngestionConcurrencyMax: 2},
+			failures:          map[string]int{"user-1": 2, "user-2": 1},
+			expectedRetries:   3,
+			expectedRemaining: 0,
+			expectedObserved:  2,
+			expectedPushed:    map[string]string{"user-1": "series_1", "user-2": "series_2"},
+		},
+		"should fail fast once the budget is exhausted": {
+			cfg:               KafkaConfig{ConsumeRetryBudget: 2},
+			failures:          map[string]int{"user-1": 2, "user-2": 1},
+			expectedErr:       true,
+			expectedRetries:   2,
+			expectedRemaining: 0,
+			expectedObserved:  2,
+			expectedPushed:    map[string]string{"user-1": "series_1"},
+		},
+		"should not retry the records if disabled": {
+			failures:       map[string]int{"user-1": 1},
+			expectedErr:    true,
+			expectedPushed: map[string]string{},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var (
+				mx       sync.Mutex
+				failures = make(map[string]int, len(testData.failures))
+				pushed   = map[string]string{}
+			)
+			for tenantID, n := range testData.failures {
+				failures[tenantID] = n
+			}
+			pusher := pusherFunc(func(ctx context.Context, req *mimirpb.WriteRequest) error {
+				tenantID, err := tenant.TenantID(ctx)
+				require.NoError(t, err)
+
+				// Like the ingester, the request is freed once it's been pushed, even if the push failed.
+				require.Len(t, req.Timeseries, 1)
+				name := metricName(req.Timeseries[0].Labels)
+				defer mimirpb.ReuseSlice(req.Timeseries)
+
+				mx.Lock()
+				defer mx.Unlock()
+				if failures[tenantID] > 0 {
+					failures[tenantID]--
+					return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+				}
+				pushed[tenantID] = name
+				return nil
+			})
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, testData.cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+			err := c.Consume(context.Background(), records)
+			if testData.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, testData.expectedPushed, pushed)
+			assert.Equal(t, float64(testData.expectedRetries), testutil.ToFloat64(metrics.pushRetries))
+			assert.Equal(t, float64(testData.expectedRemaining), testutil.ToFloat64(metrics.retryBudgetRemaining))
+
+			// The retries of each record are observed once it's been pushed or has failed.
+			var retriesPerRecord dto.Metric
+			require.NoError(t, metrics.retriesPerRecord.Write(&retriesPerRecord))
+			assert.Equal(t, testData.expectedObserved, retriesPerRecord.GetHistogram().GetSampleCount())
+			assert.Equal(t, float64(testData.expectedRetries), retriesPerRecord.GetHistogram().GetSampleSum())
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// seriesShardedPusher is a PusherCloser which splits each write request by series and pushes the series to a fixed
+// number of workers, shared by all the tenants, in the background. A series always goes to the same worker, and each
+// worker pushes its requests one after the other, so that the samples of a series are pushed in the order they have
+// been received while different series are pushed in parallel.
+//
+// The worker of a series is picked by hashing its labels with labels.Labels.Hash, the same hashing function used for
+// the stripes in the TSDB, combined with a hash of the tenant ID. Different series whose hashes collide on the same
+// worker are simply pushed one after the other by that worker, so collisions only reduce the parallelism and never
+// affect the ordering. The metadata of a request, which isn't subject to ordering, all go to the worker of the tenant.
+//
+// Like parallelStorageShards, PushToStorage only returns a non-client error returned by a previous push, and Close
+// returns the non-client errors of the pushes still in flight.
+type seriesShardedPusher struct {
+	metrics      *storagePusherMetrics
+	errorHandler *pushErrorHandler
+	pusher       Pusher
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	stopMx   sync.RWMutex
+	stopped  bool
+	queues   []chan seriesShardedRequest
+
+	errMx sync.Mutex
+	err   error
+}
+
+var errSeriesShardedPusherStopped = errors.New("the pusher has been stopped")
+
+type seriesShardedRequest struct {
+	ctx context.Context
+	*mimirpb.WriteRequest
+}
+
+// newSeriesShardedPusher creates a seriesShardedPusher with numWorkers workers, each queueing up to queueCapacity requests.
+func newSeriesShardedPusher(metrics *storagePusherMetrics, errorHandler *pushErrorHandler, pusher Pusher, numWorkers int, queueCapacity int) *seriesShardedPusher {
+	p := &seriesShardedPusher{
+		metrics:      metrics,
+		errorHandler: errorHandler,
+		pusher:       pusher,
+		queues:       make([]chan seriesShardedRequest, numWorkers),
+	}
+
+	p.wg.Add(numWorkers)
+	for i := range p.queues {
+		p.queues[i] = make(chan seriesShardedRequest, queueCapacity)
+		go p.run(p.queues[i])
+	}
+
+	return p
+}
+
+// PushToStorage implements the PusherCloser interface. It's safe to call it concurrently.
+func (p *seriesShardedPusher) PushToStorage(ctx context.Context, request *mimirpb.WriteRequest) error {
+	if err := p.enqueue(ctx, request); err != nil {
+		// The consumption is aborted, so we stop the workers because Close may not be called.
+		p.stop()
+		return fmt.Errorf("encountered a non-client error when ingesting; this error was for a previous write request: %w", err)
+	}
+	return nil
+}
+
+// enqueue splits the request by series and sends the series to their workers, unless a previous push has failed.
+func (p *seriesShardedPusher) enqueue(ctx context.Context, request *mimirpb.WriteRequest) error {
+	p.stopMx.RLock()
+	defer p.stopMx.RUnlock()
+
+	if err := p.firstError(); err != nil {
+		return err
+	}
+	if p.stopped {
+		return errSeriesShardedPusherStopped
+	}
+
+	// The tenant is in the context, and an empty one is hashed like any other tenant.
+	userID, _ := user.ExtractOrgID(ctx)
+	tenantHash := fnv.New64a()
+	_, _ = tenantHash.Write([]byte(userID))
+	tenantShard := tenantHash.Sum64()
+
+	var (
+		builder         labels.ScratchBuilder
+		nonCopiedLabels labels.Labels
+		requests        = make([]*mimirpb.WriteRequest, len(p.queues))
+	)
+	requestFor := func(worker uint64) *mimirpb.WriteRequest {
+		if requests[worker] == nil {
+			requests[worker] = &mimirpb.WriteRequest{Source: request.Source, SkipLabelValidation: request.SkipLabelValidation}
+		}
+		return requests[worker]
+	}
+
+	for _, ts := range request.Timeseries {
+		mimirpb.FromLabelAdaptersOverwriteLabels(&builder, ts.Labels, &nonCopiedLabels)
+		worker := (nonCopiedLabels.Hash() + tenantShard) % uint64(len(p.queues))
+
+		req := requestFor(worker)
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+
+	if len(request.Metadata) > 0 {
+		req := requestFor(tenantShard % uint64(len(p.queues)))
+		req.Metadata = request.Metadata
+	}
+
+	for worker, req := range requests {
+		if req != nil {
+			p.queues[worker] <- seriesShardedRequest{ctx: ctx, WriteRequest: req}
+		}
+	}
+	return nil
+}
+
+// Close implements the PusherCloser interface. It waits for the in-flight requests to be pushed.
+func (p *seriesShardedPusher) Close() []error {
+	p.stop()
+
+	if err := p.firstError(); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// stop closes the queues and waits for the workers to push the queued requests. It's safe to call it multiple times.
+func (p *seriesShardedPusher) stop() {
+	p.stopOnce.Do(func() {
+		// The queues are closed while holding the lock, so that no request is concurrently sent to them.
+		p.stopMx.Lock()
+		p.stopped = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+		p.stopMx.Unlock()
+
+		p.wg.Wait()
+	})
+}
+
+// run pushes the requests of a worker one after the other, until the queue is closed.
+func (p *seriesShardedPusher) run(queue chan seriesShardedRequest) {
+	defer p.wg.Done()
+
+	for req := range queue {
+		// Once a non-client error has been encountered the batch of records will be retried,
+		// so there's no point in pushing the remaining requests.
+		if p.firstError() != nil {
+			continue
+		}
+
+		p.metrics.timeSeriesPerFlush.Observe(float64(len(req.Timeseries)))
+		err := p.pusher.PushToStorage(req.ctx, req.WriteRequest)
+		if p.errorHandler.IsServerError(req.ctx, err) {
+			p.setError(err)
+		}
+	}
+}
+
+func (p *seriesShardedPusher) firstError() error {
+	p.errMx.Lock()
+	defer p.errMx.Unlock()
+	return p.err
+}
+
+func (p *seriesShardedPusher) setError(err error) {
+	p.errMx.Lock()
+	defer p.errMx.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// reasonMaxSeries is the reason of the series dropped because they would exceed the tenant's maximum number of active series.
+const reasonMaxSeries = "max_series"
+
+// withTenantSeriesLimiter configures the consumer to use the given limiter, which is shared by the consumers of a
+// PartitionReader, so that the active series are tracked across batches.
+func withTenantSeriesLimiter(l *tenantSeriesLimiter) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.seriesLimiter = l
+	}
+}
+
+// tenantSeriesLimiter tracks the active series of the tenants with a maximum number of active series, and drops the
+// new series of their write requests once the maximum is reached. A series is active until it hasn't been pushed for
+// the idle timeout, or forever if the idle timeout is 0. It's safe for concurrent use.
+//
+// The series are tracked by the hash of their labels, so the new series whose hash collides with an active series are
+// considered active too.
+type tenantSeriesLimiter struct {
+	limits      TenantLimits
+	idleTimeout time.Duration
+
+	mx      sync.Mutex
+	tenants map[string]*tenantActiveSeries
+}
+
+// tenantActiveSeries are the active series of a tenant, with the last time each of them has been pushed.
+type tenantActiveSeries struct {
+	mx        sync.Mutex
+	series    map[uint64]time.Time
+	lastPurge time.Time
+}
+
+func newTenantSeriesLimiter(limits TenantLimits, idleTimeout time.Duration) *tenantSeriesLimiter {
+	return &tenantSeriesLimiter{limits: limits, idleTimeout: idleTimeout, tenants: map[string]*tenantActiveSeries{}}
+}
+
+// get returns the active series of the tenant, or nil if the tenant has no maximum number of active series, in which
+// case its series aren't tracked anymore.
+func (l *tenantSeriesLimiter) get(tenantID string, maxSeries int) *tenantActiveSeries {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if maxSeries <= 0 {
+		delete(l.tenants, tenantID)
+		return nil
+	}
+
+	active, ok := l.tenants[tenantID]
+	if !ok {
+		active = &tenantActiveSeries{series: map[uint64]time.Time{}, lastPurge: time.Now()}
+		l.tenants[tenantID] = active
+	}
+	return active
+}
+
+// dropNewSeries removes the series of the request which aren't active and would exceed the tenant's maximum number of
+// active series, and returns how many have been removed. The other series become active, or are kept active.
+func (l *tenantSeriesLimiter) dropNewSeries(tenantID string, req *mimirpb.WriteRequest) int {
+	maxSeries := l.limits.IngestStorageMaxSeries(tenantID)
+	active := l.get(tenantID, maxSeries)
+	if active == nil {
+		return 0
+	}
+
+	var (
+		builder         labels.ScratchBuilder
+		nonCopiedLabels labels.Labels
+		now             = time.Now()
+	)
+
+	active.mx.Lock()
+	defer active.mx.Unlock()
+
+	kept := req.Timeseries[:0]
+	for _, ts := range req.Timeseries {
+		mimirpb.FromLabelAdaptersOverwriteLabels(&builder, ts.Labels, &nonCopiedLabels)
+		hash := nonCopiedLabels.Hash()
+
+		if _, ok := active.series[hash]; !ok && len(active.series) >= maxSeries {
+			// The idle series are only purged once the maximum is reached, and at most once per tenth of the idle
+			// timeout, so that the purges don't cost a scan of the active series for each record.
+			active.purgeIdle(now, l.idleTimeout)
+			if len(active.series) >= maxSeries {
+				mimirpb.ReusePreallocTimeseries(&ts)
+				continue
+			}
+		}
+		active.series[hash] = now
+		kept = append(kept, ts)
+	}
+	dropped := len(req.Timeseries) - len(kept)
+
+	// Don't keep references to the removed series, which have been returned to the pool.
+	clear(req.Timeseries[len(kept):])
+	req.Timeseries = kept
+
+	return dropped
+}
+
+// purgeIdle removes the series which haven't been pushed for the idle timeout, unless they've been purged less than a
+// tenth of the idle timeout ago.
+func (a *tenantActiveSeries) purgeIdle(now time.Time, idleTimeout time.Duration) {
+	if idleTimeout <= 0 || now.Sub(a.lastPurge) < idleTimeout/10 {
+		return
+	}
+
+	a.lastPurge = now
+	for hash, lastPushed := range a.series {
+		if now.Sub(lastPushed) >= idleTimeout {
+			delete(a.series, hash)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_MaxSeries(t *testing.T) {
+	newRecord := func(tenantID string, metricNames ...string) record {
+		var timeseries []mimirpb.PreallocTimeseries
+		for _, name := range metricNames {
+			timeseries = append(timeseries, mockPreallocTimeseries(name))
+		}
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: timeseries}, nil)
+	}
+
+	limits := validation.MockOverrides(func(_ *validation.Limits, l map[string]*validation.Limits) {
+		l["limited"] = validation.MockDefaultLimits()
+		l["limited"].IngestStorageMaxSeries = 2
+	})
+
+	var pushed []string
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		for _, ts := range request.Timeseries {
+			pushed = append(pushed, metricName(ts.Labels))
+		}
+		return nil
+	})
+
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{}, limits, metrics, log.NewNopLogger())
+
+	// The new series beyond the limit are dropped, while the samples of the active series are still pushed, across batches.
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("limited", "series_1", "series_2", "series_3")}))
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("limited", "series_4", "series_2", "series_1")}))
+	assert.Equal(t, []string{"series_1", "series_2", "series_2", "series_1"}, pushed)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.droppedSeries.WithLabelValues(reasonMaxSeries)))
+
+	// The series of the tenants without limit are never dropped.
+	pushed = nil
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("unlimited", "series_1", "series_2", "series_3")}))
+	assert.Equal(t, []string{"series_1", "series_2", "series_3"}, pushed)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.droppedSeries.WithLabelValues(reasonMaxSeries)))
+}
+
+func TestTenantSeriesLimiter_IdleSeries(t *testing.T) {
+	limits := validation.MockOverrides(func(defaults *validation.Limits, _ map[string]*validation.Limits) {
+		defaults.IngestStorageMaxSeries = 1
+	})
+	newRequest := func(metricName string) *mimirpb.WriteRequest {
+		return &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}
+	}
+
+	l := newTenantSeriesLimiter(limits, time.Minute)
+	require.Equal(t, 0, l.dropNewSeries("user-1", newRequest("series_1")))
+	require.Equal(t, 1, l.dropNewSeries("user-1", newRequest("series_2")))
+
+	// Once the active series has been idle for the idle timeout, a new series can replace it.
+	active := l.get("user-1", 1)
+	for hash := range active.series {
+		active.series[hash] = time.Now().Add(-time.Minute)
+	}
+	active.lastPurge = time.Now().Add(-time.Minute)
+	require.Equal(t, 0, l.dropNewSeries("user-1", newRequest("series_2")))
+	require.Equal(t, 1, l.dropNewSeries("user-1", newRequest("series_1")))
+
+	// The series aren't tracked anymore once the tenant has no limit.
+	assert.Nil(t, l.get("user-1", 0))
+	assert.Empty(t, l.tenants)
+}
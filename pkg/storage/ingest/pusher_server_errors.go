@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/grafana/dskit/grpcutil"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// ServerErrorNetwork is the subcause of the server errors caused by the storage being unreachable, for example
+	// because the connection has been refused or reset, which usually reveals an infrastructure outage.
+	ServerErrorNetwork = "network"
+	// ServerErrorApplication is the subcause of the server errors returned by the storage failing to process the
+	// request, which usually reveals a bug or an overloaded storage.
+	ServerErrorApplication = "application"
+)
+
+// ServerErrorClassifier classifies a server error returned by the storage into its subcause, either ServerErrorNetwork
+// or ServerErrorApplication. Any other subcause is counted as ServerErrorApplication.
+type ServerErrorClassifier func(err error) string
+
+// WithServerErrorClassifier configures the consumer to classify the server errors with the classifier instead of
+// DefaultServerErrorClassifier, for example to recognize the errors of a custom transport to the storage.
+func WithServerErrorClassifier(classifier ServerErrorClassifier) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.serverErrClassifier = classifier
+	}
+}
+
+// DefaultServerErrorClassifier classifies as ServerErrorNetwork the errors of the network operations, the refused,
+// reset or broken connections, and the errors with the gRPC Unavailable status code, which gRPC returns when it can't
+// reach the server. The other errors are classified as ServerErrorApplication.
+func DefaultServerErrorClassifier(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return ServerErrorNetwork
+	}
+	if stat, ok := grpcutil.ErrorToStatus(err); ok && stat.Code() == codes.Unavailable {
+		return ServerErrorNetwork
+	}
+	return ServerErrorApplication
+}
+
+// classify returns the subcause of the server error. A nil ServerErrorClassifier is DefaultServerErrorClassifier.
+func (c ServerErrorClassifier) classify(err error) string {
+	if c == nil {
+		c = DefaultServerErrorClassifier
+	}
+	if subcause := c(err); subcause == ServerErrorNetwork {
+		return ServerErrorNetwork
+	}
+	return ServerErrorApplication
+}
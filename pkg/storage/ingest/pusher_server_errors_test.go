@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestDefaultServerErrorClassifier(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		expected string
+	}{
+		"connection refused": {
+			err:      fmt.Errorf("pushing: %w", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}),
+			expected: ServerErrorNetwork,
+		},
+		"connection reset": {
+			err:      fmt.Errorf("pushing: %w", syscall.ECONNRESET),
+			expected: ServerErrorNetwork,
+		},
+		"gRPC unavailable": {
+			err:      status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing\""),
+			expected: ServerErrorNetwork,
+		},
+		"gRPC internal": {
+			err:      status.Error(codes.Internal, "internal error"),
+			expected: ServerErrorApplication,
+		},
+		"plain error": {
+			err:      fmt.Errorf("the TSDB head failed"),
+			expected: ServerErrorApplication,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, DefaultServerErrorClassifier(tc.err))
+		})
+	}
+}
+
+func TestPushErrorHandler_ShouldCountServerErrorsBySubcause(t *testing.T) {
+	t.Run("should classify the server errors with the default classifier", func(t *testing.T) {
+		metrics := newStoragePusherMetrics(prometheus.NewPedanticRegistry())
+		h := newPushErrorHandler(metrics, nil, nil, nil, nil, log.NewNopLogger())
+
+		h.IsServerError(context.Background(), status.Error(codes.Unavailable, "unavailable"))
+		h.IsServerError(context.Background(), status.Error(codes.Internal, "internal"))
+		h.IsServerError(context.Background(), fmt.Errorf("plain"))
+		h.IsServerError(context.Background(), ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "bad data"))
+
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.serverErrRequestsBySubcause.WithLabelValues(ServerErrorNetwork)))
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.serverErrRequestsBySubcause.WithLabelValues(ServerErrorApplication)))
+	})
+
+	t.Run("should count the unknown subcauses of a custom classifier as application errors", func(t *testing.T) {
+		metrics := newStoragePusherMetrics(prometheus.NewPedanticRegistry())
+		h := newPushErrorHandler(metrics, nil, nil, nil, func(error) string { return "custom" }, log.NewNopLogger())
+
+		h.IsServerError(context.Background(), status.Error(codes.Unavailable, "unavailable"))
+
+		assert.Equal(t, 1, testutil.CollectAndCount(metrics.serverErrRequestsBySubcause))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.serverErrRequestsBySubcause.WithLabelValues(ServerErrorApplication)))
+	})
+}
+
+func TestPusherConsumer_WithServerErrorClassifier(t *testing.T) {
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		return fmt.Errorf("custom transport: connection lost")
+	})
+	classifier := func(error) string { return ServerErrorNetwork }
+
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithServerErrorClassifier(classifier))
+
+	records := []record{makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil)}
+	require.Error(t, c.Consume(context.Background(), records))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.storagePusherMetrics.serverErrRequestsBySubcause.WithLabelValues(ServerErrorNetwork)))
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// consecutiveSkipsTracker counts the records skipped in a row, because they couldn't be parsed or because they've
+// been rejected by the storage with a client error, and warns each time the count crosses a multiple of the threshold.
+// Many consecutive skips usually mean that a producer is writing corrupted or invalid records.
+//
+// The consecutiveSkipsTracker is shared by all the pusherConsumer instances of a PartitionReader, so that the skips
+// are counted across batches. A nil *consecutiveSkipsTracker is a no-op.
+type consecutiveSkipsTracker struct {
+	threshold int64
+	count     atomic.Int64
+	logger    log.Logger
+
+	consecutiveSkips  prometheus.Gauge
+	thresholdExceeded prometheus.Counter
+}
+
+// newConsecutiveSkipsTracker returns a consecutiveSkipsTracker, or nil if the threshold is 0 and tracking is disabled.
+func newConsecutiveSkipsTracker(threshold int, metrics *pusherConsumerMetrics, logger log.Logger) *consecutiveSkipsTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &consecutiveSkipsTracker{
+		threshold:         int64(threshold),
+		logger:            logger,
+		consecutiveSkips:  metrics.consecutiveSkips,
+		thresholdExceeded: metrics.consecutiveSkipsThresholdExceeded,
+	}
+}
+
+// skipped records that a request has been skipped because of err.
+func (t *consecutiveSkipsTracker) skipped(tenantID string, err error) {
+	if t == nil {
+		return
+	}
+
+	count := t.count.Inc()
+	t.consecutiveSkips.Set(float64(count))
+	if count%t.threshold != 0 {
+		return
+	}
+
+	// This log is never sampled, because it's meant to surface a systemic issue quickly.
+	t.thresholdExceeded.Inc()
+	level.Error(t.logger).Log("msg", "skipped many consecutive write requests read from Kafka; a producer may be writing corrupted or invalid records", "consecutive_skips", count, "threshold", t.threshold, "last_user", tenantID, "last_err", err)
+}
+
+// pushed records that a request has been successfully pushed, and resets the count of consecutive skips.
+func (t *consecutiveSkipsTracker) pushed() {
+	if t == nil {
+		return
+	}
+
+	if t.count.Swap(0) != 0 {
+		t.consecutiveSkips.Set(0)
+	}
+}
+
+// consecutiveSkipsTrackingPusher is a Pusher middleware which reports the outcome of each push to a consecutiveSkipsTracker.
+// Only the client errors are skips: the server errors abort the consumption, so they're neither skips nor successes.
+//
+// When the writes are parallelized, the requests pushed are batches of series which may span multiple records,
+// so the skips are counted per batch instead of per record.
+type consecutiveSkipsTrackingPusher struct {
+	upstream Pusher
+	skips    *consecutiveSkipsTracker
+}
+
+// PushToStorage implements the Pusher interface.
+func (p consecutiveSkipsTrackingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	err := p.upstream.PushToStorage(ctx, req)
+	switch {
+	case err == nil:
+		p.skips.pushed()
+	case mimirpb.IsClientError(err):
+		tenantID, _ := user.ExtractOrgID(ctx)
+		p.skips.skipped(tenantID, err)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_MaxConsecutiveSkips(t *testing.T) {
+	newRecord := func(metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
+	}
+	unparseable := record{ctx: context.Background(), tenantID: "user-1", content: []byte{0x0a, 0xff}}
+
+	// The requests for the series whose name starts with "bad" are rejected with a client error.
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		if strings.HasPrefix(request.Timeseries[0].Labels[0].Value, "bad") {
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "bad data")
+		}
+		return nil
+	})
+
+	tests := map[string]struct {
+		threshold         int
+		batches           [][]record
+		expectedExceeded  int
+		expectedSkips     int
+		expectedLogsCount int
+	}{
+		"should not track the skips if disabled": {
+			batches: [][]record{{unparseable, newRecord("bad_1"), newRecord("bad_2")}},
+		},
+		"should warn once the consecutive skips reach the threshold": {
+			threshold:         3,
+			batches:           [][]record{{unparseable, newRecord("bad_1"), newRecord("bad_2"), newRecord("bad_3")}},
+			expectedExceeded:  1,
+			expectedSkips:     4,
+			expectedLogsCount: 1,
+		},
+		"should count the consecutive skips across batches": {
+			threshold:         2,
+			batches:           [][]record{{newRecord("bad_1")}, {unparseable}, {newRecord("bad_2"), newRecord("bad_3")}},
+			expectedExceeded:  2,
+			expectedSkips:     4,
+			expectedLogsCount: 2,
+		},
+		"should reset the count on the first successful push": {
+			threshold:     2,
+			batches:       [][]record{{newRecord("bad_1"), newRecord("good_1"), unparseable, newRecord("good_2"), newRecord("bad_2")}},
+			expectedSkips: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			logs := &concurrency.SyncBuffer{}
+			logger := log.NewLogfmtLogger(logs)
+			cfg := KafkaConfig{MaxConsecutiveSkips: testData.threshold}
+			metrics := newPusherConsumerMetrics(reg)
+
+			// The tracker is shared by the consumers of the batches, like in the PartitionReader.
+			skips := newConsecutiveSkipsTracker(cfg.MaxConsecutiveSkips, metrics, logger)
+			for _, batch := range testData.batches {
+				c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, logger, withConsecutiveSkipsTracker(skips))
+				require.NoError(t, c.Consume(context.Background(), batch))
+			}
+
+			assert.Equal(t, testData.expectedLogsCount, strings.Count(logs.String(), "skipped many consecutive write requests read from Kafka"))
+			assert.Equal(t, float64(testData.expectedExceeded), testutil.ToFloat64(metrics.consecutiveSkipsThresholdExceeded))
+			assert.Equal(t, float64(testData.expectedSkips), testutil.ToFloat64(metrics.consecutiveSkips))
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// pushSplitting pushes the request to the storage like pushToStorage, after splitting it into partial requests if it's
+// larger than the configured max size. The partial requests are pushed one after the other, and the first server error
+// is returned, because the record must then be retried as a whole, while the partial requests failing with a client
+// error are handled by the writer like any other request.
+func (c pusherConsumer) pushSplitting(ctx context.Context, tenantID string, req *mimirpb.WriteRequest, writer PusherCloser) error {
+	maxSize := c.kafkaConfig.IngestionSplitRequestsMaxBytes
+	if maxSize <= 0 {
+		return c.pushToStorage(ctx, tenantID, req, writer)
+	}
+
+	size := writeRequestSize(req)
+	if size <= maxSize {
+		return c.pushToStorage(ctx, tenantID, req, writer)
+	}
+
+	partials := splitWriteRequest(req, size, maxSize)
+	c.metrics.splitRequests.Inc()
+	c.metrics.splitPartialRequests.Add(float64(len(partials)))
+
+	for i, partial := range partials {
+		if err := c.pushToStorage(ctx, tenantID, partial, writer); err != nil {
+			// The partial requests which haven't been pushed won't be, so their series are returned to the pool.
+			for _, notPushed := range partials[i+1:] {
+				mimirpb.ReuseSlice(notPushed.Timeseries)
+			}
+			return fmt.Errorf("pushing partial write request %d of %d: %w", i+1, len(partials), err)
+		}
+	}
+	return nil
+}
+
+// splitWriteRequest splits the request into partial requests of at most maxSize bytes, see
+// mimirpb.SplitWriteRequestByMaxMarshalSize.
+//
+// The partial requests returned by mimirpb.SplitWriteRequestByMaxMarshalSize share the backing array of the series
+// of the request, which must not be returned to the pool by the storage once each partial request has been pushed:
+// the pooled slice could be reused while the series of the next partial requests are still being pushed. So each
+// partial request gets its own slice of series.
+func splitWriteRequest(req *mimirpb.WriteRequest, size, maxSize int) []*mimirpb.WriteRequest {
+	partials := mimirpb.SplitWriteRequestByMaxMarshalSize(req, size, maxSize)
+	for _, partial := range partials {
+		if len(partial.Timeseries) > 0 {
+			partial.Timeseries = append(mimirpb.PreallocTimeseriesSliceFromPool(), partial.Timeseries...)
+		}
+	}
+	return partials
+}
@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_SplitRequests(t *testing.T) {
+	newRequest := func() *mimirpb.WriteRequest {
+		return &mimirpb.WriteRequest{
+			Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1"), mockPreallocTimeseries("series_2"), mockPreallocTimeseries("series_3")},
+			Metadata:   []*mimirpb.MetricMetadata{{MetricFamilyName: "series_1", Help: "help"}},
+		}
+	}
+
+	// Each partial write request fits a single series.
+	maxSize := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Size()
+
+	tests := map[string]struct {
+		maxSize          int
+		failures         map[string]error
+		expectedPushes   [][]string
+		expectedMetadata int
+		expectedSplits   int
+		expectedPartials int
+		expectedErr      string
+	}{
+		"should push the requests as they are if disabled": {
+			expectedPushes:   [][]string{{"series_1", "series_2", "series_3"}},
+			expectedMetadata: 1,
+		},
+		"should push the requests as they are if not larger than the max size": {
+			maxSize:          newRequest().Size(),
+			expectedPushes:   [][]string{{"series_1", "series_2", "series_3"}},
+			expectedMetadata: 1,
+		},
+		"should split the requests larger than the max size": {
+			maxSize:          maxSize,
+			expectedPushes:   [][]string{{"series_1"}, {"series_2"}, {"series_3"}, nil},
+			expectedMetadata: 1,
+			expectedSplits:   1,
+			expectedPartials: 4,
+		},
+		"should push the other partial requests if one fails with a client error": {
+			maxSize:          maxSize,
+			failures:         map[string]error{"series_2": ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "out of order sample")},
+			expectedPushes:   [][]string{{"series_1"}, {"series_2"}, {"series_3"}, nil},
+			expectedMetadata: 1,
+			expectedSplits:   1,
+			expectedPartials: 4,
+		},
+		"should fail the record if a partial request fails with a server error": {
+			maxSize:          maxSize,
+			failures:         map[string]error{"series_2": errors.New("storage unavailable")},
+			expectedPushes:   [][]string{{"series_1"}, {"series_2"}},
+			expectedSplits:   1,
+			expectedPartials: 4,
+			expectedErr:      "consuming record at index 0 for tenant user-1: pushing partial write request 2 of 4: storage unavailable",
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var (
+				pushes   [][]string
+				metadata int
+			)
+			pusher := pusherFunc(func(_ context.Context, req *mimirpb.WriteRequest) error {
+				var series []string
+				for _, ts := range req.Timeseries {
+					series = append(series, ts.Labels[0].Value)
+				}
+				pushes = append(pushes, series)
+				metadata += len(req.Metadata)
+
+				if len(series) > 0 {
+					return testData.failures[series[0]]
+				}
+				return nil
+			})
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			cfg := KafkaConfig{IngestionSplitRequestsMaxBytes: testData.maxSize}
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+			err := c.Consume(context.Background(), []record{makeRecord(t, "user-1", newRequest(), nil)})
+			if testData.expectedErr != "" {
+				require.EqualError(t, err, testData.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, testData.expectedPushes, pushes)
+			assert.Equal(t, testData.expectedMetadata, metadata)
+			assert.Equal(t, float64(testData.expectedSplits), testutil.ToFloat64(metrics.splitRequests))
+			assert.Equal(t, float64(testData.expectedPartials), testutil.ToFloat64(metrics.splitPartialRequests))
+		})
+	}
+}
+
+func TestSplitWriteRequest(t *testing.T) {
+	req := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1"), mockPreallocTimeseries("series_2")}}
+	maxSize := (&mimirpb.WriteRequest{Timeseries: req.Timeseries[:1]}).Size()
+
+	partials := splitWriteRequest(req, writeRequestSize(req), maxSize)
+	require.Len(t, partials, 2)
+
+	// Appending to the series of a partial request must not overwrite the series of the next one.
+	_ = append(partials[0].Timeseries[:0], mockPreallocTimeseries("other"), mockPreallocTimeseries("other"))
+	assert.Equal(t, "series_2", partials[1].Timeseries[0].Labels[0].Value)
+}
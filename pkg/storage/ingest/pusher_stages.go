@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// The names of the default stages, in the order they run.
+const (
+	StageQuota            = "quota"
+	StageExemplarOnly     = "exemplar_only"
+	StageDenylist         = "denylist"
+	StageInjectLabels     = "inject_labels"
+	StageRequiredLabels   = "required_labels"
+	StageSeriesLimit      = "series_limit"
+	StageDropOptionalData = "drop_optional_data"
+	StageDropStaleSamples = "drop_stale_samples"
+	StageFutureSamples    = "future_samples"
+	StageSamplesOrder     = "samples_order"
+	StageDedupSamples     = "dedup_samples"
+	StageDownsample       = "downsample"
+)
+
+// Stage is a step of the processing of each record, which validates or mutates the write request of the record once
+// it's been decompressed and decoded, and before it's pushed to the storage. The stages of a record run one after the
+// other, in order, by the goroutine pushing the records, so they must not block.
+type Stage struct {
+	// Name identifies the stage in the metrics. It must be made of lowercase letters, digits and underscores.
+	Name string
+	// Process validates or mutates the write request of the record of tenantID in place. If it returns an error, the
+	// next stages don't run and the record isn't pushed. The record is skipped if the error is returned by RejectRecord
+	// or is a client error, like the records rejected by the storage with a client error, and the consumption fails and
+	// is retried otherwise, like when the storage fails with a server error.
+	Process func(ctx context.Context, tenantID string, req *mimirpb.WriteRequest) error
+}
+
+// WithStages configures the consumer to run the stages returned by fn, called with the default stages, instead of the
+// default stages, so that the stages can be added, removed or reordered. The default stages are named with the Stage*
+// constants. The records are pushed without any validation or mutation but the ones of the stages returned by fn, and
+// they're always decoded, even if the Pusher implements RawPusher, so that the stages can process them.
+func WithStages(fn func(defaults []Stage) []Stage) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.stagesFn = fn
+	}
+}
+
+// RejectRecord returns the error a Stage rejects the record with, because of the record itself. The rejected record
+// is skipped, and counted as rejected with the reason.
+func RejectRecord(reason string, err error) error {
+	return &stageRejection{reason: reason, err: err}
+}
+
+// stageRejection is the error of a stage rejecting a record.
+type stageRejection struct {
+	reason string
+	err    error
+}
+
+func (e *stageRejection) Error() string { return e.err.Error() }
+func (e *stageRejection) Unwrap() error { return e.err }
+
+// defaultStages returns the limits and the transforms applied to the write requests of the records by default.
+func (c pusherConsumer) defaultStages() []Stage {
+	return []Stage{
+		// The quota is checked first, so that the records of the tenants over quota aren't processed any further.
+		{Name: StageQuota, Process: func(ctx context.Context, tenantID string, _ *mimirpb.WriteRequest) error {
+			if err := c.checkQuota(ctx, tenantID); err != nil {
+				return RejectRecord(reasonQuotaExceeded, err)
+			}
+			return nil
+		}},
+		// The records are checked as they've been decoded, before their series are transformed.
+		{Name: StageExemplarOnly, Process: func(_ context.Context, _ string, req *mimirpb.WriteRequest) error {
+			if err := c.checkExemplarOnlyRecord(req); err != nil {
+				return RejectRecord(reasonExemplarOnly, err)
+			}
+			return nil
+		}},
+		{Name: StageDenylist, Process: func(_ context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+			if dropped := c.denylists.dropDeniedSeries(tenantID, req); dropped > 0 {
+				c.metrics.droppedSeries.WithLabelValues(reasonDeniedMetric).Add(float64(dropped))
+			}
+			return nil
+		}},
+		{Name: StageInjectLabels, Process: func(_ context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+			if injected := c.injectLabels(tenantID, req); injected > 0 {
+				c.metrics.injectedLabelsSeries.Add(float64(injected))
+			}
+			return nil
+		}},
+		{Name: StageRequiredLabels, Process: func(_ context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+			if err := c.checkRequiredLabels(tenantID, req); err != nil {
+				return RejectRecord(reasonMissingRequiredLabel, err)
+			}
+			return nil
+		}},
+		// The series are limited once their labels are final, so that they're tracked like they're pushed.
+		{Name: StageSeriesLimit, Process: func(_ context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+			if dropped := c.seriesLimiter.dropNewSeries(tenantID, req); dropped > 0 {
+				c.metrics.droppedSeries.WithLabelValues(reasonMaxSeries).Add(float64(dropped))
+			}
+			return nil
+		}},
+		{Name: StageDropOptionalData, Process: func(_ context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+			c.dropOptionalData(tenantID, req)
+			return nil
+		}},
+		{Name: StageDropStaleSamples, Process: func(_ context.Context, _ string, req *mimirpb.WriteRequest) error {
+			c.dropStaleSamples(req)
+			return nil
+		}},
+		{Name: StageFutureSamples, Process: func(_ context.Context, _ string, req *mimirpb.WriteRequest) error {
+			if err := c.checkFutureSamples(req); err != nil {
+				return RejectRecord(reasonTooFarInFuture, err)
+			}
+			return nil
+		}},
+		{Name: StageSamplesOrder, Process: func(_ context.Context, _ string, req *mimirpb.WriteRequest) error {
+			c.checkSamplesOrder(req)
+			return nil
+		}},
+		{Name: StageDedupSamples, Process: func(_ context.Context, _ string, req *mimirpb.WriteRequest) error {
+			c.dedupSamples(req)
+			return nil
+		}},
+		// The samples are down-sampled once they're deduplicated and validated, so that only the ingested ones are kept.
+		{Name: StageDownsample, Process: func(_ context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+			c.downsample(tenantID, req)
+			return nil
+		}},
+	}
+}
+
+// pipeline runs the stages of the records, and tracks the metrics of each stage.
+type pipeline []pipelineStage
+
+type pipelineStage struct {
+	Stage
+	duration     prometheus.Observer
+	clientErrors prometheus.Counter
+	serverErrors prometheus.Counter
+}
+
+// newPipeline returns the pipeline of the stages of the consumer. Its stages are bound to this copy of the consumer.
+func (c pusherConsumer) newPipeline() pipeline {
+	stages := c.defaultStages()
+	if c.stagesFn != nil {
+		stages = c.stagesFn(stages)
+	}
+
+	p := make(pipeline, 0, len(stages))
+	for _, s := range stages {
+		p = append(p, pipelineStage{
+			Stage:        s,
+			duration:     c.metrics.stageDurationSeconds.WithLabelValues(s.Name),
+			clientErrors: c.metrics.stageErrors.WithLabelValues(s.Name, FailureCauseClient),
+			serverErrors: c.metrics.stageErrors.WithLabelValues(s.Name, FailureCauseServer),
+		})
+	}
+	return p
+}
+
+// run runs the stages on the write request of the record of tenantID. It returns a *stageRejection if a stage has
+// rejected the record, and the error of the stage otherwise.
+func (p pipeline) run(ctx context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+	for _, s := range p {
+		start := time.Now()
+		err := s.Process(ctx, tenantID, req)
+		s.duration.Observe(time.Since(start).Seconds())
+		if err == nil {
+			continue
+		}
+
+		var rejection *stageRejection
+		switch {
+		case errors.As(err, &rejection):
+			s.clientErrors.Inc()
+		case mimirpb.IsClientError(err):
+			s.clientErrors.Inc()
+			err = RejectRecord(s.Name, err)
+		default:
+			s.serverErrors.Inc()
+			err = fmt.Errorf("stage %s: %w", s.Name, err)
+		}
+		return err
+	}
+	return nil
+}
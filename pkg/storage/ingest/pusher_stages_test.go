@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_DefaultStages(t *testing.T) {
+	c := newPusherConsumer(nil, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+	var names []string
+	for _, s := range c.defaultStages() {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{
+		StageQuota, StageExemplarOnly, StageDenylist, StageInjectLabels, StageRequiredLabels, StageSeriesLimit, StageDropOptionalData,
+		StageDropStaleSamples, StageFutureSamples, StageSamplesOrder, StageDedupSamples, StageDownsample,
+	}, names)
+}
+
+func TestPusherConsumer_WithStages(t *testing.T) {
+	newRecord := func(metricName string) record {
+		return makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
+	}
+
+	var pushed []string
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		for _, ts := range request.Timeseries {
+			pushed = append(pushed, metricName(ts.Labels))
+		}
+		return nil
+	})
+
+	// The stage renames the series, rejects the reject_* series and fails on the fail series.
+	serverErr := errors.New("server error")
+	custom := Stage{Name: "custom", Process: func(_ context.Context, _ string, req *mimirpb.WriteRequest) error {
+		switch name := metricName(req.Timeseries[0].Labels); name {
+		case "reject_rejection":
+			return RejectRecord("custom_reason", errors.New("rejected"))
+		case "reject_client_error":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "invalid")
+		case "fail":
+			return serverErr
+		default:
+			req.Timeseries[0].Labels[0].Value = name + "_renamed"
+			return nil
+		}
+	}}
+
+	t.Run("should run the custom stages and skip the records they reject", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithStages(func(defaults []Stage) []Stage {
+			return append(defaults, custom)
+		}))
+
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("reject_rejection"), newRecord("reject_client_error")}))
+		assert.Equal(t, []string{"series_1_renamed"}, pushed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.rejectedRecords.WithLabelValues("custom_reason")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.rejectedRecords.WithLabelValues("custom")))
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.stageErrors.WithLabelValues("custom", FailureCauseClient)))
+		assert.Equal(t, 12+1, testutil.CollectAndCount(metrics.stageDurationSeconds))
+	})
+
+	t.Run("should fail the consumption on the server errors of the stages", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithStages(func([]Stage) []Stage {
+			return []Stage{custom}
+		}))
+
+		err := c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("fail"), newRecord("series_3")})
+		require.ErrorIs(t, err, serverErr)
+		assert.ErrorContains(t, err, "stage custom: server error")
+		assert.Equal(t, []string{"series_1_renamed"}, pushed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.stageErrors.WithLabelValues("custom", FailureCauseServer)))
+	})
+
+	t.Run("should not run the removed default stages", func(t *testing.T) {
+		pushed = nil
+		limits := validation.MockOverrides(func(defaults *validation.Limits, _ map[string]*validation.Limits) {
+			defaults.IngestStorageMaxSeries = 1
+		})
+		c := newPusherConsumer(pusher, KafkaConfig{}, limits, newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithStages(func(defaults []Stage) []Stage {
+			var stages []Stage
+			for _, s := range defaults {
+				if s.Name != StageSeriesLimit {
+					stages = append(stages, s)
+				}
+			}
+			return stages
+		}))
+
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("series_2")}))
+		assert.Equal(t, []string{"series_1", "series_2"}, pushed)
+	})
+}
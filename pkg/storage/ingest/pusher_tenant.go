@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"go.uber.org/atomic"
+)
+
+// idleTenant is reported as the tenant being pushed when no record is being pushed.
+const idleTenant = "idle"
+
+// pushingTenantTracker tracks the tenant of the record being pushed to the storage, to spot a tenant whose pushes are
+// stuck. When several records are pushed at once, the tenant is the one of the last record whose push has started. It's
+// cheap, so it's always tracked, but it's best effort: it may report idle for a moment while a push starts concurrently
+// with the end of the last other push. It's safe for concurrent use.
+//
+// The pushingTenantTracker is shared by all the pusherConsumer instances of a PartitionReader. A nil
+// *pushingTenantTracker is a no-op.
+type pushingTenantTracker struct {
+	tenant   atomic.String
+	inflight atomic.Int64
+}
+
+func newPushingTenantTracker() *pushingTenantTracker {
+	t := &pushingTenantTracker{}
+	t.tenant.Store(idleTenant)
+	return t
+}
+
+// start records that a record of the tenant is being pushed.
+func (t *pushingTenantTracker) start(tenantID string) {
+	if t == nil {
+		return
+	}
+	t.inflight.Inc()
+	t.tenant.Store(tenantID)
+}
+
+// done records that the push of a record has ended.
+func (t *pushingTenantTracker) done() {
+	if t == nil {
+		return
+	}
+	if t.inflight.Dec() == 0 {
+		t.tenant.Store(idleTenant)
+	}
+}
+
+// get returns the tenant of the record being pushed, or idleTenant if none.
+func (t *pushingTenantTracker) get() string {
+	if t == nil {
+		return idleTenant
+	}
+	return t.tenant.Load()
+}
+
+// withPushingTenantTracker configures the consumer to track the tenant of the record being pushed.
+func withPushingTenantTracker(t *pushingTenantTracker) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.pushingTenant = t
+	}
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_PushingTenant(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-2", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+	}
+
+	for name, cfg := range map[string]KafkaConfig{
+		"sequential": {},
+		"relaxed":    {IngestionOrdering: ingestionOrderingRelaxed, IngestionConcurrencyMax: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tracker := newPushingTenantTracker()
+			assert.Equal(t, idleTenant, tracker.get())
+
+			var pushingTenants []string
+			pusher := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+				tenantID, err := user.ExtractOrgID(ctx)
+				require.NoError(t, err)
+				require.Equal(t, tenantID, tracker.get())
+				pushingTenants = append(pushingTenants, tracker.get())
+				return nil
+			})
+
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), withPushingTenantTracker(tracker))
+			require.NoError(t, c.Consume(context.Background(), records))
+
+			assert.Equal(t, []string{"user-1", "user-2"}, pushingTenants)
+			assert.Equal(t, idleTenant, tracker.get())
+		})
+	}
+
+	t.Run("should report idle without tracker", func(t *testing.T) {
+		assert.Equal(t, idleTenant, (&PartitionReader{}).PushingTenant())
+	})
+}
+
+func TestPushingTenantTracker(t *testing.T) {
+	tracker := newPushingTenantTracker()
+	tracker.start("user-1")
+	tracker.start("user-2")
+	assert.Equal(t, "user-2", tracker.get())
+
+	// The tracker isn't idle until all the pushes have ended.
+	tracker.done()
+	assert.Equal(t, "user-2", tracker.get())
+	tracker.done()
+	assert.Equal(t, idleTenant, tracker.get())
+}
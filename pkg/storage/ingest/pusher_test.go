@@ -5,6 +5,7 @@ package ingest
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -19,6 +20,8 @@ import (
 	"github.com/grafana/regexp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -28,6 +31,8 @@ import (
 
 	"github.com/grafana/mimir/pkg/mimirpb"
 	util_log "github.com/grafana/mimir/pkg/util/log"
+	util_test "github.com/grafana/mimir/pkg/util/test"
+	"github.com/grafana/mimir/pkg/util/validation"
 )
 
 type pusherFunc func(context.Context, *mimirpb.WriteRequest) error
@@ -40,6 +45,29 @@ func (p pusherFunc) PushToStorage(ctx context.Context, request *mimirpb.WriteReq
 	return p(ctx, request)
 }
 
+// makeRecord returns a record of tenantID whose content is the marshalled write request, compressed with compress
+// unless it's nil.
+func makeRecord(t testing.TB, tenantID string, wr *mimirpb.WriteRequest, compress func(testing.TB, []byte) []byte) record {
+	content, err := wr.Marshal()
+	require.NoError(t, err)
+	if compress != nil {
+		content = compress(t, content)
+	}
+	return record{ctx: context.Background(), tenantID: tenantID, content: content}
+}
+
+// makeBatchRecord returns a record of tenantID whose content is a batch, encoded by EncodeBatch, of the marshalled write
+// requests of the same tenant, each compressed with compress unless it's nil.
+func makeBatchRecord(t testing.TB, tenantID string, compress func(testing.TB, []byte) []byte, wrs ...*mimirpb.WriteRequest) record {
+	entries := make([]BatchEntry, 0, len(wrs))
+	for _, wr := range wrs {
+		entries = append(entries, BatchEntry{Content: makeRecord(t, tenantID, wr, compress).content})
+	}
+	content, err := EncodeBatch(entries)
+	require.NoError(t, err)
+	return record{ctx: context.Background(), tenantID: tenantID, content: content}
+}
+
 func TestPusherConsumer(t *testing.T) {
 	const tenantID = "t1"
 	writeReqs := []*mimirpb.WriteRequest{
@@ -50,193 +78,2244 @@ func TestPusherConsumer(t *testing.T) {
 		{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_6")}},
 	}
 
-	wrBytes := make([][]byte, len(writeReqs))
-	for i, wr := range writeReqs {
-		var err error
-		wrBytes[i], err = wr.Marshal()
-		require.NoError(t, err)
+	wrBytes := make([][]byte, len(writeReqs))
+	for i, wr := range writeReqs {
+		var err error
+		wrBytes[i], err = wr.Marshal()
+		require.NoError(t, err)
+	}
+
+	ctx := context.Background()
+
+	type response struct {
+		err error
+	}
+
+	okResponse := response{nil}
+
+	testCases := map[string]struct {
+		records     []record
+		responses   []response
+		expectedWRs []*mimirpb.WriteRequest
+		expErr      string
+
+		expectedLogLines []string
+	}{
+		"single record": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+			},
+			responses: []response{
+				okResponse,
+			},
+			expectedWRs: writeReqs[0:1],
+		},
+		"multiple records": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
+			},
+			responses: []response{
+				okResponse,
+				okResponse,
+				okResponse,
+			},
+			expectedWRs: writeReqs[0:3],
+		},
+		"unparsable record": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+				{ctx: ctx, content: []byte{0}, tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
+			},
+			responses: []response{
+				okResponse,
+				okResponse,
+			},
+			expectedWRs: writeReqs[0:2],
+			expErr:      "",
+			expectedLogLines: []string{
+				"level=error msg=\"failed to parse write request; skipping\" err=\"parsing ingest consumer write request: proto: WriteRequest: illegal tag 0 (wire type 0)\"",
+			},
+		},
+		"failed processing of record": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
+			},
+			responses: []response{
+				okResponse,
+				{err: assert.AnError},
+			},
+			expectedWRs: writeReqs[0:2],
+			expErr:      assert.AnError.Error(),
+		},
+		"failed processing of last record": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
+			},
+			responses: []response{
+				okResponse,
+				{err: assert.AnError},
+			},
+			expectedWRs: writeReqs[0:2],
+			expErr:      assert.AnError.Error(),
+		},
+		"failed processing & failed unmarshalling": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
+				{ctx: ctx, content: []byte{0}, tenantID: tenantID},
+			},
+			responses: []response{
+				okResponse,
+				{err: assert.AnError},
+			},
+			expectedWRs: writeReqs[0:2],
+			expErr:      assert.AnError.Error(),
+		},
+		"no records": {},
+		"ingester client error": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
+			},
+			responses: []response{
+				{err: ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")},
+				{err: ingesterError(mimirpb.BAD_DATA, codes.Unknown, "ingester test error")}, // status code doesn't matter
+				okResponse,
+			},
+			expectedWRs: writeReqs[0:3],
+			expErr:      "", // since all fof those were client errors, we don't return an error
+			expectedLogLines: []string{
+				"user=t1 level=warn msg=\"detected a client error while ingesting write request (the request may have been partially ingested)\" insight=true err=\"rpc error: code = InvalidArgument desc = ingester test error\"",
+				"user=t1 level=warn msg=\"detected a client error while ingesting write request (the request may have been partially ingested)\" insight=true err=\"rpc error: code = Unknown desc = ingester test error\"",
+			},
+		},
+		"ingester server error": {
+			records: []record{
+				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[3], tenantID: tenantID},
+				{ctx: ctx, content: wrBytes[4], tenantID: tenantID},
+			},
+			responses: []response{
+				{err: ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")},
+				{err: ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")},
+			},
+			expectedWRs: writeReqs[0:2], // the rest of the requests are not attempted
+			expErr:      "ingester internal error",
+			expectedLogLines: []string{
+				"user=t1 level=warn msg=\"detected a client error while ingesting write request (the request may have been partially ingested)\" insight=true err=\"rpc error: code = InvalidArgument desc = ingester test error\"",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			receivedReqs := atomic.NewInt64(0)
+			pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+				reqIdx := int(receivedReqs.Inc() - 1)
+				require.GreaterOrEqualf(t, len(tc.expectedWRs), reqIdx+1, "received more requests (%d) than expected (%d)", reqIdx+1, len(tc.expectedWRs))
+
+				expectedWR := tc.expectedWRs[reqIdx]
+				for i, ts := range request.Timeseries {
+					assert.Truef(t, ts.Equal(expectedWR.Timeseries[i].TimeSeries), "timeseries %d not equal; got %v, expected %v", i, ts, expectedWR.Timeseries[i].TimeSeries)
+				}
+
+				actualTenantID, err := tenant.TenantID(ctx)
+				assert.NoError(t, err)
+				assert.Equal(t, tenantID, actualTenantID)
+
+				return tc.responses[reqIdx].err
+			})
+
+			logs := &concurrency.SyncBuffer{}
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewLogfmtLogger(logs))
+			err := c.Consume(context.Background(), tc.records)
+			if tc.expErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.expErr)
+			}
+
+			var logLines []string
+			if logsStr := logs.String(); logsStr != "" {
+				logLines = strings.Split(strings.TrimSpace(logsStr), "\n")
+				logLines = removeUnimportantLogFields(logLines)
+			}
+			assert.Equal(t, tc.expectedLogLines, logLines)
+		})
+	}
+}
+
+func TestPusherConsumer_consumeStream(t *testing.T) {
+	const tenantID = "t1"
+
+	writeReqs := []*mimirpb.WriteRequest{
+		{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}},
+		{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}},
+		{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}},
+	}
+
+	records := make([]record, 0, len(writeReqs))
+	for _, wr := range writeReqs {
+		content, err := wr.Marshal()
+		require.NoError(t, err)
+		records = append(records, record{ctx: context.Background(), tenantID: tenantID, content: content})
+	}
+
+	// feed sends the records to the channel one by one, like a reader would do while fetching them.
+	feed := func(records []record) <-chan record {
+		ch := make(chan record)
+		go func() {
+			defer close(ch)
+			for _, r := range records {
+				ch <- r
+			}
+		}()
+		return ch
+	}
+
+	for _, concurrency := range []int{0, 2} {
+		t.Run(fmt.Sprintf("ingestion concurrency: %d", concurrency), func(t *testing.T) {
+			t.Run("should push all records", func(t *testing.T) {
+				var (
+					receivedMx sync.Mutex
+					received   []string
+				)
+				pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+					receivedMx.Lock()
+					defer receivedMx.Unlock()
+					for _, ts := range request.Timeseries {
+						received = append(received, ts.Labels[0].Value)
+					}
+					return nil
+				})
+
+				cfg := KafkaConfig{
+					IngestionConcurrencyMax:                     concurrency,
+					IngestionConcurrencyBatchSize:               1,
+					IngestionConcurrencyQueueCapacity:           1,
+					IngestionConcurrencyEstimatedBytesPerSample: 1,
+					IngestionConcurrencyTargetFlushesPerShard:   1,
+				}
+				c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+				require.NoError(t, c.consumeStream(context.Background(), feed(records)))
+				// Different series may be pushed by different shards, so the order isn't guaranteed across series.
+				assert.ElementsMatch(t, []string{"series_1", "series_2", "series_3"}, received)
+			})
+		})
+	}
+
+	t.Run("should stop at the first server error", func(t *testing.T) {
+		pushes := atomic.NewInt64(0)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			if pushes.Inc() == 2 {
+				return assert.AnError
+			}
+			return nil
+		})
+
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+		ch := make(chan record, len(records))
+		for _, r := range records {
+			ch <- r
+		}
+		close(ch)
+
+		err := c.consumeStream(context.Background(), ch)
+		require.ErrorIs(t, err, assert.AnError)
+		assert.ErrorContains(t, err, "consuming record at index 1")
+		assert.Equal(t, int64(2), pushes.Load())
+	})
+
+	t.Run("should split the batches of records and detect the gaps between the offsets", func(t *testing.T) {
+		var pushed []string
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+			return nil
+		})
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		batch := makeBatchRecord(t, tenantID, gzipCompress, writeReqs[0], writeReqs[1])
+		batch.offset = 1
+		last := records[2]
+		last.offset = 5
+
+		require.NoError(t, c.consumeStream(context.Background(), feed([]record{batch, last})))
+		assert.Equal(t, []string{"series_1", "series_2", "series_3"}, pushed)
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.batchedRecords))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.offsetGaps))
+	})
+
+	t.Run("should consume the records like Consume if the features need the whole batch", func(t *testing.T) {
+		var pushed []string
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+			return nil
+		})
+		c := newPusherConsumer(pusher, KafkaConfig{MaxRecordsPerConsume: 2}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(),
+			withIdempotencyTokens(newIdempotencyTokens(10, 0)))
+
+		duplicate := records[0]
+		duplicate.idempotencyToken = "token-1"
+		err := c.consumeStream(context.Background(), feed([]record{duplicate, duplicate, records[1], records[2]}))
+
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, err, &unprocessed)
+		assert.Equal(t, []record{records[1], records[2]}, unprocessed.records)
+		assert.Equal(t, []string{"series_1"}, pushed)
+	})
+}
+
+func TestPusherConsumer_ShouldCountFloatSamplesAndNativeHistogramsSeparately(t *testing.T) {
+	req := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{
+		mockPreallocTimeseries("series_1"),
+		{TimeSeries: &mimirpb.TimeSeries{
+			Labels: []mimirpb.LabelAdapter{{Name: "__name__", Value: "series_2"}},
+			Histograms: []mimirpb.Histogram{
+				mimirpb.FromHistogramToHistogramProto(1, util_test.GenerateTestHistogram(1)),
+				mimirpb.FromFloatHistogramToHistogramProto(2, util_test.GenerateTestFloatHistogram(2)),
+			},
+		}},
+	}}
+	content, err := req.Marshal()
+	require.NoError(t, err)
+
+	reg := prometheus.NewPedanticRegistry()
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+
+	records := []record{
+		{ctx: context.Background(), tenantID: "user-1", content: content},
+		{ctx: context.Background(), tenantID: "user-2", content: content},
+	}
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_float_samples_total Number of float samples in the write requests read from Kafka that have been attempted to be pushed to the storage.
+		# TYPE cortex_ingest_storage_reader_float_samples_total counter
+		cortex_ingest_storage_reader_float_samples_total 2
+
+		# HELP cortex_ingest_storage_reader_native_histograms_total Number of native histogram samples in the write requests read from Kafka that have been attempted to be pushed to the storage.
+		# TYPE cortex_ingest_storage_reader_native_histograms_total counter
+		cortex_ingest_storage_reader_native_histograms_total 4
+	`), "cortex_ingest_storage_reader_float_samples_total", "cortex_ingest_storage_reader_native_histograms_total"))
+}
+
+func TestValidateWriteRequest(t *testing.T) {
+	testCases := map[string]struct {
+		req         *mimirpb.WriteRequest
+		expectedErr string
+	}{
+		"empty request": {
+			req: &mimirpb.WriteRequest{},
+		},
+		"valid request": {
+			req: &mimirpb.WriteRequest{
+				Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")},
+				Metadata:   []*mimirpb.MetricMetadata{{MetricFamilyName: "series_1", Type: mimirpb.COUNTER}},
+			},
+		},
+		"nil timeseries": {
+			req:         &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1"), {}}},
+			expectedErr: "timeseries at index 1 is nil",
+		},
+		"timeseries without labels": {
+			req:         &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{{TimeSeries: &mimirpb.TimeSeries{Samples: []mimirpb.Sample{{TimestampMs: 1, Value: 2}}}}}},
+			expectedErr: "timeseries at index 0 has no labels",
+		},
+		"nil metadata": {
+			req:         &mimirpb.WriteRequest{Metadata: []*mimirpb.MetricMetadata{nil}},
+			expectedErr: "metadata at index 0 is nil",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := validateWriteRequest(tc.req)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestPusherConsumer_ShouldSkipAndCountUnparseableRecords(t *testing.T) {
+	valid, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+
+	// This is valid protobuf, but the series has no labels.
+	degenerate, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{{TimeSeries: &mimirpb.TimeSeries{Samples: []mimirpb.Sample{{TimestampMs: 1, Value: 2}}}}}}).Marshal()
+	require.NoError(t, err)
+
+	pushes := atomic.NewInt64(0)
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		pushes.Inc()
+		return nil
+	})
+
+	logs := &concurrency.SyncBuffer{}
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewLogfmtLogger(logs))
+
+	require.NoError(t, c.Consume(context.Background(), []record{
+		{ctx: context.Background(), tenantID: "user-1", content: degenerate},
+		{ctx: context.Background(), tenantID: "user-1", content: valid},
+		{ctx: context.Background(), tenantID: "user-1", content: []byte{0}},
+	}))
+
+	assert.Equal(t, int64(1), pushes.Load())
+	assert.Contains(t, logs.String(), "parsing ingest consumer write request: timeseries at index 0 has no labels")
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_parse_errors_total Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.
+		# TYPE cortex_ingest_storage_reader_parse_errors_total counter
+		cortex_ingest_storage_reader_parse_errors_total 2
+
+		# HELP cortex_ingest_storage_reader_records_decoded_total Number of records read from Kafka which have been successfully decoded. Compared with cortex_ingest_storage_reader_requests_total, it shows whether the ingestion is bound by decoding or by pushing to the storage.
+		# TYPE cortex_ingest_storage_reader_records_decoded_total counter
+		cortex_ingest_storage_reader_records_decoded_total 1
+	`), "cortex_ingest_storage_reader_parse_errors_total", "cortex_ingest_storage_reader_records_decoded_total"))
+}
+
+func TestPusherConsumer_RelaxedIngestionOrdering(t *testing.T) {
+	newRecord := func(metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
+	}
+
+	cfg := KafkaConfig{
+		IngestionOrdering:       ingestionOrderingRelaxed,
+		IngestionConcurrencyMax: 2,
+	}
+
+	t.Run("should push records without waiting for the previous ones to complete", func(t *testing.T) {
+		secondPushed := make(chan struct{})
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			switch request.Timeseries[0].Labels[0].Value {
+			case "series_1":
+				// The first record completes only once the second one has been pushed,
+				// which would never happen if records were pushed in order.
+				select {
+				case <-secondPushed:
+				case <-time.After(5 * time.Second):
+					return assert.AnError
+				}
+			case "series_2":
+				close(secondPushed)
+			}
+			return nil
+		})
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("series_2"), newRecord("series_3")}))
+	})
+
+	t.Run("should return the server error and stop pushing", func(t *testing.T) {
+		pushes := atomic.NewInt64(0)
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			pushes.Inc()
+			if request.Timeseries[0].Labels[0].Value == "series_1" {
+				return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+			}
+			return nil
+		})
+
+		records := make([]record, 0, 100)
+		for i := 0; i < 100; i++ {
+			records = append(records, newRecord(fmt.Sprintf("series_%d", i+1)))
+		}
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		err := c.Consume(context.Background(), records)
+		require.ErrorContains(t, err, "consuming record at index 0 for tenant user-1: rpc error: code = Unavailable desc = ingester internal error")
+		assert.Less(t, pushes.Load(), int64(len(records)))
+	})
+
+	t.Run("should skip client errors and continue", func(t *testing.T) {
+		pushes := atomic.NewInt64(0)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			pushes.Inc()
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		})
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("series_2"), newRecord("series_3")}))
+		assert.Equal(t, int64(3), pushes.Load())
+	})
+}
+
+func TestPusherConsumer_SeriesIngestionOrdering(t *testing.T) {
+	cfg := KafkaConfig{
+		IngestionOrdering:                 ingestionOrderingSeries,
+		IngestionConcurrencyMax:           4,
+		IngestionConcurrencyQueueCapacity: 2,
+	}
+
+	newRecord := func(tenantID string, timestamp int64, metricNames ...string) record {
+		req := &mimirpb.WriteRequest{}
+		for _, name := range metricNames {
+			series := mockPreallocTimeseries(name)
+			series.Samples = []mimirpb.Sample{{TimestampMs: timestamp, Value: 1}}
+			req.Timeseries = append(req.Timeseries, series)
+		}
+		content, err := req.Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: tenantID, content: content}
+	}
+
+	t.Run("should push the samples of each series in order", func(t *testing.T) {
+		var (
+			pushedMx sync.Mutex
+			pushed   = map[string][]int64{}
+		)
+		pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+			userID, err := user.ExtractOrgID(ctx)
+			require.NoError(t, err)
+
+			pushedMx.Lock()
+			defer pushedMx.Unlock()
+			for _, ts := range request.Timeseries {
+				key := userID + "/" + ts.Labels[0].Value
+				pushed[key] = append(pushed[key], ts.Samples[0].TimestampMs)
+			}
+			return nil
+		})
+
+		var records []record
+		for i := int64(0); i < 50; i++ {
+			records = append(records, newRecord("user-1", i, "series_1", "series_2", "series_3"), newRecord("user-2", i, "series_1", "series_4"))
+		}
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), records))
+
+		require.Len(t, pushed, 5)
+		for key, timestamps := range pushed {
+			require.Len(t, timestamps, 50, key)
+			assert.True(t, slices.IsSorted(timestamps), key)
+		}
+	})
+
+	t.Run("should return the server error and stop pushing", func(t *testing.T) {
+		pushes := atomic.NewInt64(0)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			pushes.Inc()
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		})
+
+		var records []record
+		for i := int64(0); i < 100; i++ {
+			records = append(records, newRecord("user-1", i, "series_1"))
+		}
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.ErrorContains(t, c.Consume(context.Background(), records), "ingester internal error")
+		assert.Less(t, pushes.Load(), int64(len(records)))
+	})
+
+	t.Run("should skip client errors and continue", func(t *testing.T) {
+		pushes := atomic.NewInt64(0)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			pushes.Inc()
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		})
+
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("user-1", 1, "series_1"), newRecord("user-1", 2, "series_1"), newRecord("user-1", 3, "series_1")}))
+		assert.Equal(t, int64(3), pushes.Load())
+	})
+}
+
+var unimportantLogFieldsPattern = regexp.MustCompile(`(\s?)caller=\S+\.go:\d+\s`)
+
+func removeUnimportantLogFields(lines []string) []string {
+	// The 'caller' field is not important to these tests (we just care about the message and other information),
+	// and can change as we refactor code, making these tests brittle. So we remove it before making assertions about the log lines.
+	for i, line := range lines {
+		lines[i] = unimportantLogFieldsPattern.ReplaceAllString(line, "$1")
+	}
+
+	return lines
+}
+
+func TestPusherConsumer_DecodeBytesBudget(t *testing.T) {
+	newRecord := func(metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
+	}
+
+	records := []record{newRecord("series_1"), newRecord("series_2"), newRecord("series_3")}
+	recordSize := len(records[0].content)
+
+	t.Run("should not decode the next record until enough budget has been released", func(t *testing.T) {
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		unblock := make(chan struct{})
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			if request.Timeseries[0].Labels[0].Value == "series_1" {
+				<-unblock
+			}
+			return nil
+		})
+
+		// The budget fits a single record, so the second one can't be decoded while the first one is being pushed.
+		c := newPusherConsumer(pusher, KafkaConfig{IngestionDecodeMaxBytes: recordSize + 1}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		assert.Equal(t, float64(recordSize+1), testutil.ToFloat64(metrics.decodeBytesBudget))
+
+		done := make(chan error)
+		go func() {
+			done <- c.Consume(context.Background(), records)
+		}()
+
+		// Give the unmarshalling goroutine time to decode more records if it wasn't blocked.
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, float64(recordSize), testutil.ToFloat64(metrics.decodeBytesInUse))
+
+		close(unblock)
+		require.NoError(t, <-done)
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.decodeBytesInUse))
+	})
+
+	t.Run("should decode a record larger than the budget on its own", func(t *testing.T) {
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		pushes := atomic.NewInt64(0)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			pushes.Inc()
+			return nil
+		})
+
+		c := newPusherConsumer(pusher, KafkaConfig{IngestionDecodeMaxBytes: 1}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), records))
+		assert.Equal(t, int64(len(records)), pushes.Load())
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.decodeBytesInUse))
+	})
+
+	t.Run("should release the budget of the records not pushed because of an error", func(t *testing.T) {
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		})
+
+		c := newPusherConsumer(pusher, KafkaConfig{IngestionDecodeMaxBytes: 10 * recordSize}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		require.Error(t, c.Consume(context.Background(), records))
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(metrics.decodeBytesInUse) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestPusherConsumer_ShouldDropExemplarsAndMetadataHonoringTenantLimits(t *testing.T) {
+	newRecord := func(tenantID string) record {
+		content, err := (&mimirpb.WriteRequest{
+			Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseriesWithExemplar("series_1"), mockPreallocTimeseriesWithExemplar("series_2")},
+			Metadata:   []*mimirpb.MetricMetadata{{MetricFamilyName: "series_1", Help: "help", Unit: "unit"}},
+		}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: tenantID, content: content}
+	}
+
+	limits := validation.MockOverrides(func(_ *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		tenantLimits["drop-exemplars"] = validation.MockDefaultLimits()
+		tenantLimits["drop-exemplars"].IngestStorageDropExemplars = true
+		tenantLimits["drop-metadata"] = validation.MockDefaultLimits()
+		tenantLimits["drop-metadata"].IngestStorageDropMetadata = true
+		tenantLimits["max-exemplars"] = validation.MockDefaultLimits()
+		tenantLimits["max-exemplars"].IngestStorageMaxExemplarsPerSeries = 1
+		tenantLimits["max-exemplar-age"] = validation.MockDefaultLimits()
+		tenantLimits["max-exemplar-age"].IngestStorageMaxExemplarAge = model.Duration(time.Hour)
+	})
+
+	type pushed struct {
+		samples, exemplars, metadata int
+	}
+	var (
+		pushedMx sync.Mutex
+		received = map[string]pushed{}
+	)
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := tenant.TenantID(ctx)
+		require.NoError(t, err)
+
+		p := pushed{metadata: len(request.Metadata)}
+		for _, ts := range request.Timeseries {
+			p.samples += len(ts.Samples)
+			p.exemplars += len(ts.Exemplars)
+		}
+
+		pushedMx.Lock()
+		received[tenantID] = p
+		pushedMx.Unlock()
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, KafkaConfig{}, limits, newPusherConsumerMetrics(reg), log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("drop-exemplars"), newRecord("drop-metadata"), newRecord("max-exemplars"), newRecord("max-exemplar-age"), newRecord("keep-all")}))
+
+	assert.Equal(t, map[string]pushed{
+		"drop-exemplars":   {samples: 2, exemplars: 0, metadata: 1},
+		"drop-metadata":    {samples: 2, exemplars: 2, metadata: 0},
+		"max-exemplars":    {samples: 2, exemplars: 2, metadata: 1},
+		"max-exemplar-age": {samples: 2, exemplars: 0, metadata: 1},
+		"keep-all":         {samples: 2, exemplars: 2, metadata: 1},
+	}, received)
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_exemplars_dropped_total Number of exemplars dropped from the write requests read from Kafka because of the tenant's limits.
+		# TYPE cortex_ingest_storage_reader_exemplars_dropped_total counter
+		cortex_ingest_storage_reader_exemplars_dropped_total 4
+
+		# HELP cortex_ingest_storage_reader_metadata_dropped_total Number of metadata dropped from the write requests read from Kafka because of the tenant's limits.
+		# TYPE cortex_ingest_storage_reader_metadata_dropped_total counter
+		cortex_ingest_storage_reader_metadata_dropped_total 1
+	`), "cortex_ingest_storage_reader_exemplars_dropped_total", "cortex_ingest_storage_reader_metadata_dropped_total"))
+}
+
+func TestTrimExemplars(t *testing.T) {
+	newSeries := func(timestamps ...int64) mimirpb.PreallocTimeseries {
+		series := mockPreallocTimeseries("series_1")
+		for _, ts := range timestamps {
+			series.Exemplars = append(series.Exemplars, mimirpb.Exemplar{
+				Labels:      []mimirpb.LabelAdapter{{Name: "trace_id", Value: fmt.Sprint(ts)}},
+				TimestampMs: ts,
+			})
+		}
+		return series
+	}
+
+	tests := map[string]struct {
+		timestamps         []int64
+		maxExemplars       int
+		expectedTimestamps []int64
+	}{
+		"should not trim the exemplars within the limit": {
+			timestamps:         []int64{2, 1},
+			maxExemplars:       2,
+			expectedTimestamps: []int64{2, 1},
+		},
+		"should keep the most recent exemplars": {
+			timestamps:         []int64{1, 2, 3, 4, 5},
+			maxExemplars:       3,
+			expectedTimestamps: []int64{3, 4, 5},
+		},
+		"should keep the most recent exemplars when they're not sorted": {
+			timestamps:         []int64{5, 1, 4, 2},
+			maxExemplars:       3,
+			expectedTimestamps: []int64{2, 4, 5},
+		},
+		"should keep the most recent exemplar": {
+			timestamps:         []int64{1, 2, 3},
+			maxExemplars:       1,
+			expectedTimestamps: []int64{3},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			series := newSeries(testData.timestamps...)
+			dropped := trimExemplars(&series, testData.maxExemplars)
+			assert.Equal(t, len(testData.timestamps)-len(testData.expectedTimestamps), dropped)
+
+			var timestamps []int64
+			for _, e := range series.Exemplars {
+				// The labels of the kept exemplars must not have been cleared with the dropped ones.
+				assert.Equal(t, fmt.Sprint(e.TimestampMs), e.Labels[0].Value)
+				timestamps = append(timestamps, e.TimestampMs)
+			}
+			assert.Equal(t, testData.expectedTimestamps, timestamps)
+		})
+	}
+}
+
+func TestPusherConsumer_DropStaleExemplars(t *testing.T) {
+	now := time.Now()
+	fresh1, fresh2 := now.Add(-time.Minute).UnixMilli(), now.Add(-2*time.Minute).UnixMilli()
+	stale1, stale2 := now.Add(-2*time.Hour).UnixMilli(), now.Add(-3*time.Hour).UnixMilli()
+
+	series := mockPreallocTimeseries("series_1")
+	for _, ts := range []int64{stale1, fresh1, stale2, fresh2} {
+		series.Exemplars = append(series.Exemplars, mimirpb.Exemplar{
+			Labels:      []mimirpb.LabelAdapter{{Name: "trace_id", Value: fmt.Sprint(ts)}},
+			TimestampMs: ts,
+		})
+	}
+	allStale := mockPreallocTimeseriesWithExemplar("series_2")
+	req := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{series, allStale}}
+
+	limits := validation.MockOverrides(func(_ *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		tenantLimits["user-1"] = validation.MockDefaultLimits()
+		tenantLimits["user-1"].IngestStorageMaxExemplarAge = model.Duration(time.Hour)
+	})
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(nil, KafkaConfig{}, limits, metrics, log.NewNopLogger())
+	c.dropStaleExemplars("user-1", req)
+
+	// The fresh exemplars are kept in their order, with their labels.
+	var timestamps []int64
+	for _, e := range req.Timeseries[0].Exemplars {
+		assert.Equal(t, fmt.Sprint(e.TimestampMs), e.Labels[0].Value)
+		timestamps = append(timestamps, e.TimestampMs)
+	}
+	assert.Equal(t, []int64{fresh1, fresh2}, timestamps)
+	assert.Empty(t, req.Timeseries[1].Exemplars)
+
+	// The series and their samples are never dropped.
+	require.Len(t, req.Timeseries, 2)
+	assert.Len(t, req.Timeseries[0].Samples, 1)
+	assert.Len(t, req.Timeseries[1].Samples, 1)
+	assert.Equal(t, float64(3), testutil.ToFloat64(metrics.exemplarsDropped))
+
+	// Nothing is dropped for the tenants without a limit.
+	req = &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseriesWithExemplar("series_1")}}
+	c.dropStaleExemplars("user-2", req)
+	assert.Len(t, req.Timeseries[0].Exemplars, 1)
+}
+
+// blockingDecompressor is a Decompressor whose content is prefixed by its magic bytes, and which doesn't
+// return until unblock is closed.
+type blockingDecompressor struct {
+	unblock chan struct{}
+}
+
+func (d blockingDecompressor) Codec() string { return "blocking" }
+func (d blockingDecompressor) Magic() []byte { return []byte{0xff, 0xfe} }
+
+func (d blockingDecompressor) Decompress(content []byte, _ int) ([]byte, error) {
+	<-d.unblock
+	return content[len(d.Magic()):], nil
+}
+
+func TestPusherConsumer_DecodeTimeout(t *testing.T) {
+	newRecords := func(t *testing.T, d blockingDecompressor) []record {
+		slow, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+		require.NoError(t, err)
+		fast, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}).Marshal()
+		require.NoError(t, err)
+
+		return []record{
+			{ctx: context.Background(), tenantID: "user-1", content: append(d.Magic(), slow...)},
+			{ctx: context.Background(), tenantID: "user-1", content: fast},
+		}
+	}
+
+	run := func(t *testing.T, abandon bool, d blockingDecompressor) ([]string, *prometheus.Registry) {
+		var (
+			pushedMx sync.Mutex
+			pushed   []string
+		)
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			pushedMx.Lock()
+			defer pushedMx.Unlock()
+			pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+			return nil
+		})
+
+		cfg := KafkaConfig{IngestionDecodeTimeout: 10 * time.Millisecond, IngestionDecodeTimeoutAbandon: abandon}
+		reg := prometheus.NewPedanticRegistry()
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+		c.decompressors = []Decompressor{d}
+
+		require.NoError(t, c.Consume(context.Background(), newRecords(t, d)))
+		return pushed, reg
+	}
+
+	t.Run("should wait for the decode to complete if abandoning is disabled", func(t *testing.T) {
+		d := blockingDecompressor{unblock: make(chan struct{})}
+		time.AfterFunc(100*time.Millisecond, func() { close(d.unblock) })
+
+		pushed, reg := run(t, false, d)
+		assert.Equal(t, []string{"series_1", "series_2"}, pushed)
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_ingest_storage_reader_decode_timeouts_total Number of records read from Kafka whose decoding took longer than the configured timeout.
+			# TYPE cortex_ingest_storage_reader_decode_timeouts_total counter
+			cortex_ingest_storage_reader_decode_timeouts_total 1
+
+			# HELP cortex_ingest_storage_reader_parse_errors_total Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.
+			# TYPE cortex_ingest_storage_reader_parse_errors_total counter
+			cortex_ingest_storage_reader_parse_errors_total 0
+
+			# HELP cortex_ingest_storage_reader_timeouts_total Number of records read from Kafka whose processing took longer than the configured timeout, by the stage which timed out.
+			# TYPE cortex_ingest_storage_reader_timeouts_total counter
+			cortex_ingest_storage_reader_timeouts_total{stage="decode"} 1
+		`), "cortex_ingest_storage_reader_decode_timeouts_total", "cortex_ingest_storage_reader_parse_errors_total", "cortex_ingest_storage_reader_timeouts_total"))
+	})
+
+	t.Run("should skip the record as a parse error if abandoning is enabled", func(t *testing.T) {
+		d := blockingDecompressor{unblock: make(chan struct{})}
+		t.Cleanup(func() { close(d.unblock) })
+
+		pushed, reg := run(t, true, d)
+		assert.Equal(t, []string{"series_2"}, pushed)
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_ingest_storage_reader_decode_timeouts_total Number of records read from Kafka whose decoding took longer than the configured timeout.
+			# TYPE cortex_ingest_storage_reader_decode_timeouts_total counter
+			cortex_ingest_storage_reader_decode_timeouts_total 1
+
+			# HELP cortex_ingest_storage_reader_parse_errors_total Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.
+			# TYPE cortex_ingest_storage_reader_parse_errors_total counter
+			cortex_ingest_storage_reader_parse_errors_total 1
+		`), "cortex_ingest_storage_reader_decode_timeouts_total", "cortex_ingest_storage_reader_parse_errors_total"))
+	})
+}
+
+func TestPusherConsumer_DecodeTimeoutAbandoned(t *testing.T) {
+	marshal := func(t *testing.T, series string) []byte {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(series)}}).Marshal()
+		require.NoError(t, err)
+		return content
+	}
+
+	newConsumer := func(cfg KafkaConfig, d blockingDecompressor) (*pusherConsumer, *pusherConsumerMetrics, func() []string) {
+		var (
+			pushedMx sync.Mutex
+			pushed   []string
+		)
+		pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+			pushedMx.Lock()
+			defer pushedMx.Unlock()
+			pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+			return nil
+		})
+
+		cfg.IngestionDecodeTimeout = 10 * time.Millisecond
+		cfg.IngestionDecodeTimeoutAbandon = true
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		c.decompressors = []Decompressor{d}
+		return c, metrics, func() []string {
+			pushedMx.Lock()
+			defer pushedMx.Unlock()
+			return slices.Clone(pushed)
+		}
+	}
+
+	t.Run("should keep the bytes of the abandoned decode in use until it returns", func(t *testing.T) {
+		d := blockingDecompressor{unblock: make(chan struct{})}
+		c, metrics, pushed := newConsumer(KafkaConfig{IngestionDecodeMaxBytes: 1024 * 1024}, d)
+
+		slow := append(d.Magic(), marshal(t, "series_1")...)
+		require.NoError(t, c.Consume(context.Background(), []record{
+			{ctx: context.Background(), tenantID: "user-1", content: slow},
+			{ctx: context.Background(), tenantID: "user-1", content: marshal(t, "series_2")},
+		}))
+		assert.Equal(t, []string{"series_2"}, pushed())
+
+		// The abandoned decode is still running, so its bytes are still in use.
+		assert.Equal(t, float64(len(slow)), testutil.ToFloat64(metrics.decodeBytesInUse))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.abandonedDecodes))
+
+		close(d.unblock)
+		require.Eventually(t, func() bool {
+			return testutil.ToFloat64(metrics.decodeBytesInUse) == 0 && testutil.ToFloat64(metrics.abandonedDecodes) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("should wait for the decode once the maximum abandoned decodes are running", func(t *testing.T) {
+		d := blockingDecompressor{unblock: make(chan struct{})}
+		time.AfterFunc(100*time.Millisecond, func() { close(d.unblock) })
+		c, metrics, pushed := newConsumer(KafkaConfig{IngestionDecodeTimeoutMaxAbandoned: 1}, d)
+
+		require.NoError(t, c.Consume(context.Background(), []record{
+			{ctx: context.Background(), tenantID: "user-1", content: append(d.Magic(), marshal(t, "series_1")...)},
+			{ctx: context.Background(), tenantID: "user-1", content: append(d.Magic(), marshal(t, "series_2")...)},
+			{ctx: context.Background(), tenantID: "user-1", content: marshal(t, "series_3")},
+		}))
+
+		// The first decode is abandoned, while the second one is waited for.
+		assert.Equal(t, []string{"series_2", "series_3"}, pushed())
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.decodeTimeouts))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.parseErrors))
+	})
+}
+
+func TestPusherConsumer_checkSamplesOrder(t *testing.T) {
+	newRequest := func(timestamps ...int64) *mimirpb.WriteRequest {
+		series := mockPreallocTimeseries("series_1")
+		series.Samples = nil
+		for _, ts := range timestamps {
+			series.Samples = append(series.Samples, mimirpb.Sample{TimestampMs: ts, Value: float64(ts)})
+		}
+		return &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_0"), series}}
+	}
+
+	tests := map[string]struct {
+		detect, sort       bool
+		timestamps         []int64
+		expectedTimestamps []int64
+		expectedOutOfOrder int
+	}{
+		"should not scan the samples if disabled": {
+			timestamps:         []int64{3, 1, 2},
+			expectedTimestamps: []int64{3, 1, 2},
+		},
+		"should not count samples in order": {
+			detect:             true,
+			timestamps:         []int64{1, 2, 2, 3},
+			expectedTimestamps: []int64{1, 2, 2, 3},
+		},
+		"should count samples out of order without sorting them": {
+			detect:             true,
+			timestamps:         []int64{3, 1, 2},
+			expectedTimestamps: []int64{3, 1, 2},
+			expectedOutOfOrder: 1,
+		},
+		"should count and sort samples out of order": {
+			sort:               true,
+			timestamps:         []int64{3, 1, 2},
+			expectedTimestamps: []int64{1, 2, 3},
+			expectedOutOfOrder: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			cfg := KafkaConfig{DetectOutOfOrderSamples: testData.detect, SortOutOfOrderSamples: testData.sort}
+			c := newPusherConsumer(nil, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+
+			req := newRequest(testData.timestamps...)
+			c.checkSamplesOrder(req)
+
+			var timestamps []int64
+			for _, s := range req.Timeseries[1].Samples {
+				timestamps = append(timestamps, s.TimestampMs)
+			}
+			assert.Equal(t, testData.expectedTimestamps, timestamps)
+			assert.Equal(t, float64(testData.expectedOutOfOrder), testutil.ToFloat64(c.metrics.outOfOrderRecords))
+		})
+	}
+}
+
+func TestPusherConsumer_dedupSamples(t *testing.T) {
+	newRequest := func(samples ...mimirpb.Sample) *mimirpb.WriteRequest {
+		series := mockPreallocTimeseries("series_1")
+		series.Samples = samples
+		series.Histograms = []mimirpb.Histogram{{Timestamp: 1}, {Timestamp: 1}, {Timestamp: 2}}
+		return &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_0"), series}}
+	}
+
+	tests := map[string]struct {
+		behavior           string
+		samples            []mimirpb.Sample
+		expectedSamples    []mimirpb.Sample
+		expectedHistograms int
+		expectedRemoved    int
+	}{
+		"should not remove the duplicate samples if disabled": {
+			behavior:           duplicateSamplesPush,
+			samples:            []mimirpb.Sample{{TimestampMs: 1, Value: 1}, {TimestampMs: 1, Value: 2}},
+			expectedSamples:    []mimirpb.Sample{{TimestampMs: 1, Value: 1}, {TimestampMs: 1, Value: 2}},
+			expectedHistograms: 3,
+		},
+		"should keep the first of the samples with the same timestamp": {
+			behavior:           duplicateSamplesKeepFirst,
+			samples:            []mimirpb.Sample{{TimestampMs: 1, Value: 1}, {TimestampMs: 1, Value: 2}, {TimestampMs: 2, Value: 3}, {TimestampMs: 2, Value: 4}, {TimestampMs: 2, Value: 5}},
+			expectedSamples:    []mimirpb.Sample{{TimestampMs: 1, Value: 1}, {TimestampMs: 2, Value: 3}},
+			expectedHistograms: 2,
+			expectedRemoved:    4,
+		},
+		"should keep the last of the samples with the same timestamp": {
+			behavior:           duplicateSamplesKeepLast,
+			samples:            []mimirpb.Sample{{TimestampMs: 1, Value: 1}, {TimestampMs: 1, Value: 2}, {TimestampMs: 2, Value: 3}, {TimestampMs: 2, Value: 4}, {TimestampMs: 2, Value: 5}},
+			expectedSamples:    []mimirpb.Sample{{TimestampMs: 1, Value: 2}, {TimestampMs: 2, Value: 5}},
+			expectedHistograms: 2,
+			expectedRemoved:    4,
+		},
+		"should preserve the order of the distinct timestamps of samples out of order": {
+			behavior:           duplicateSamplesKeepLast,
+			samples:            []mimirpb.Sample{{TimestampMs: 3, Value: 1}, {TimestampMs: 1, Value: 2}, {TimestampMs: 3, Value: 3}, {TimestampMs: 2, Value: 4}},
+			expectedSamples:    []mimirpb.Sample{{TimestampMs: 3, Value: 3}, {TimestampMs: 1, Value: 2}, {TimestampMs: 2, Value: 4}},
+			expectedHistograms: 2,
+			expectedRemoved:    2,
+		},
+		"should not change the samples without duplicates": {
+			behavior:           duplicateSamplesKeepFirst,
+			samples:            []mimirpb.Sample{{TimestampMs: 2, Value: 1}, {TimestampMs: 1, Value: 2}},
+			expectedSamples:    []mimirpb.Sample{{TimestampMs: 2, Value: 1}, {TimestampMs: 1, Value: 2}},
+			expectedHistograms: 2,
+			expectedRemoved:    1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			cfg := KafkaConfig{IngestionDuplicateSamplesBehavior: testData.behavior}
+			c := newPusherConsumer(nil, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+			req := newRequest(testData.samples...)
+			size := req.Size()
+			c.dedupSamples(req)
+
+			assert.Equal(t, testData.expectedSamples, req.Timeseries[1].Samples)
+			assert.Len(t, req.Timeseries[1].Histograms, testData.expectedHistograms)
+			assert.Len(t, req.Timeseries[0].Samples, 1)
+			assert.Equal(t, float64(testData.expectedRemoved), testutil.ToFloat64(c.metrics.duplicateSamples))
+
+			// The cached size of the series must have been invalidated.
+			if testData.expectedRemoved > 0 {
+				expected, err := req.Marshal()
+				require.NoError(t, err)
+				assert.Less(t, len(expected), size)
+				assert.Equal(t, len(expected), req.Size())
+			}
+		})
+	}
+}
+
+func TestPusherConsumer_dropStaleSamples(t *testing.T) {
+	now := time.Now()
+	fresh := now.Add(-time.Minute).UnixMilli()
+	stale := now.Add(-2 * time.Hour).UnixMilli()
+
+	newSeries := func(metricName string, sampleTimestamps []int64, histogramTimestamps []int64) mimirpb.PreallocTimeseries {
+		series := mockPreallocTimeseries(metricName)
+		series.Samples = nil
+		for _, ts := range sampleTimestamps {
+			series.Samples = append(series.Samples, mimirpb.Sample{TimestampMs: ts, Value: 1})
+		}
+		for _, ts := range histogramTimestamps {
+			series.Histograms = append(series.Histograms, mimirpb.Histogram{Timestamp: ts})
+		}
+		return series
+	}
+
+	tests := map[string]struct {
+		maxAge          time.Duration
+		series          []mimirpb.PreallocTimeseries
+		expectedSeries  map[string]int
+		expectedDropped int
+	}{
+		"should not drop samples if disabled": {
+			series:         []mimirpb.PreallocTimeseries{newSeries("series_1", []int64{stale, fresh}, nil)},
+			expectedSeries: map[string]int{"series_1": 2},
+		},
+		"should drop the stale samples and keep the series with fresh samples": {
+			maxAge: time.Hour,
+			series: []mimirpb.PreallocTimeseries{
+				newSeries("series_1", []int64{stale, fresh}, nil),
+				newSeries("series_2", []int64{fresh}, []int64{stale}),
+			},
+			expectedSeries:  map[string]int{"series_1": 1, "series_2": 1},
+			expectedDropped: 2,
+		},
+		"should remove the series left without samples": {
+			maxAge: time.Hour,
+			series: []mimirpb.PreallocTimeseries{
+				newSeries("series_1", []int64{stale}, []int64{stale}),
+				newSeries("series_2", []int64{fresh}, nil),
+				newSeries("series_3", []int64{stale, stale}, nil),
+			},
+			expectedSeries:  map[string]int{"series_2": 1},
+			expectedDropped: 4,
+		},
+		"should keep the series which had no samples to begin with": {
+			maxAge:         time.Hour,
+			series:         []mimirpb.PreallocTimeseries{newSeries("series_1", nil, nil)},
+			expectedSeries: map[string]int{"series_1": 0},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			cfg := KafkaConfig{IngestionMaxSampleAge: testData.maxAge}
+			c := newPusherConsumer(nil, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+
+			req := &mimirpb.WriteRequest{Timeseries: testData.series}
+			c.dropStaleSamples(req)
+
+			actualSeries := map[string]int{}
+			for _, ts := range req.Timeseries {
+				actualSeries[ts.Labels[0].Value] = len(ts.Samples) + len(ts.Histograms)
+			}
+			assert.Equal(t, testData.expectedSeries, actualSeries)
+			assert.Equal(t, float64(testData.expectedDropped), testutil.ToFloat64(c.metrics.staleSamplesDropped))
+		})
+	}
+}
+
+func TestPusherConsumer_FutureSamples(t *testing.T) {
+	now := time.Now()
+	present := now.UnixMilli()
+	future := now.Add(time.Hour).UnixMilli()
+
+	newRecord := func(t *testing.T, sampleTimestamps ...int64) record {
+		series := mockPreallocTimeseries("series_1")
+		series.Samples = nil
+		for _, ts := range sampleTimestamps {
+			series.Samples = append(series.Samples, mimirpb.Sample{TimestampMs: ts, Value: 1})
+		}
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{series}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
+	}
+
+	tests := map[string]struct {
+		behavior         string
+		expectedPushed   []int
+		expectedFuture   int
+		expectedRejected int
+	}{
+		"should push the samples in the future by default": {
+			expectedPushed: []int{2, 1},
+		},
+		"should push the samples in the future if configured to": {
+			behavior:       futureSamplesPush,
+			expectedPushed: []int{2, 1},
+		},
+		"should drop the samples in the future": {
+			behavior:       futureSamplesDrop,
+			expectedPushed: []int{1, 1},
+			expectedFuture: 1,
+		},
+		"should reject the records with samples in the future": {
+			behavior:         futureSamplesReject,
+			expectedPushed:   []int{1},
+			expectedFuture:   1,
+			expectedRejected: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var pushed []int
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				pushed = append(pushed, len(request.Timeseries[0].Samples))
+				return nil
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			outcomes := make(chan RecordOutcome, 2)
+			cfg := KafkaConfig{IngestionFutureSamplesBehavior: testData.behavior, IngestionFutureSamplesTolerance: 10 * time.Minute}
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger(), WithRecordOutcomes(outcomes))
+
+			require.NoError(t, c.Consume(context.Background(), []record{newRecord(t, present, future), newRecord(t, present)}))
+			assert.Equal(t, testData.expectedPushed, pushed)
+			assert.Equal(t, float64(testData.expectedFuture), testutil.ToFloat64(c.metrics.futureSamples))
+			assert.Equal(t, float64(testData.expectedRejected), testutil.ToFloat64(c.metrics.rejectedRecords.WithLabelValues(reasonTooFarInFuture)))
+
+			outcome := <-outcomes
+			if testData.expectedRejected > 0 {
+				require.Error(t, outcome.Err)
+				assert.True(t, mimirpb.IsClientError(outcome.Err))
+			} else {
+				assert.NoError(t, outcome.Err)
+			}
+		})
+	}
+}
+
+func TestPusherConsumer_PushWorkersUtilization(t *testing.T) {
+	var records []record
+	for i := 0; i < 4; i++ {
+		records = append(records, makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}, nil))
+	}
+
+	for ordering, cfg := range map[string]KafkaConfig{
+		ingestionOrderingStrict:  {IngestionConcurrencyMax: 2, IngestionConcurrencyBatchSize: 1, IngestionConcurrencyQueueCapacity: 1, IngestionConcurrencyEstimatedBytesPerSample: 1, IngestionConcurrencyTargetFlushesPerShard: 1},
+		ingestionOrderingRelaxed: {IngestionOrdering: ingestionOrderingRelaxed, IngestionConcurrencyMax: 2},
+	} {
+		t.Run(ordering, func(t *testing.T) {
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			busy := atomic.NewFloat64(0)
+			pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+				busy.Store(max(busy.Load(), testutil.ToFloat64(metrics.storagePusherMetrics.pushWorkersBusy)))
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+			require.NoError(t, c.Consume(context.Background(), records))
+
+			assert.GreaterOrEqual(t, busy.Load(), float64(1))
+			assert.Equal(t, float64(0), testutil.ToFloat64(metrics.storagePusherMetrics.pushWorkersBusy))
+
+			// Each worker observes the time it's been busy once it has stopped.
+			var busyTime dto.Metric
+			require.NoError(t, metrics.storagePusherMetrics.pushWorkerBusyTime.Write(&busyTime))
+			assert.Equal(t, uint64(2), busyTime.GetHistogram().GetSampleCount())
+			assert.GreaterOrEqual(t, busyTime.GetHistogram().GetSampleSum(), (time.Duration(len(records)) * 10 * time.Millisecond).Seconds())
+		})
+	}
+}
+
+func TestPusherConsumer_MaxProcessingLag(t *testing.T) {
+	content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+
+	now := time.Now()
+	records := []record{
+		{ctx: context.Background(), tenantID: "stale", content: content, timestamp: now.Add(-2 * time.Hour)},
+		{ctx: context.Background(), tenantID: "fresh", content: content, timestamp: now.Add(-time.Minute)},
+		{ctx: context.Background(), tenantID: "no-timestamp", content: content},
+	}
+
+	tests := map[string]struct {
+		maxLag           time.Duration
+		expectedPushed   []string
+		expectedRejected int
+	}{
+		"should push all the records if disabled": {
+			expectedPushed: []string{"stale", "fresh", "no-timestamp"},
+		},
+		"should skip the records past their deadline": {
+			maxLag:           time.Hour,
+			expectedPushed:   []string{"fresh", "no-timestamp"},
+			expectedRejected: 1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var pushed []string
+			pusher := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+				tenantID, err := tenant.TenantID(ctx)
+				require.NoError(t, err)
+				pushed = append(pushed, tenantID)
+				return nil
+			})
+
+			outcomes := make(chan RecordOutcome, len(records))
+			c := newPusherConsumer(pusher, KafkaConfig{IngestionMaxProcessingLag: testData.maxLag}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithRecordOutcomes(outcomes))
+
+			require.NoError(t, c.Consume(context.Background(), records))
+			assert.Equal(t, testData.expectedPushed, pushed)
+			assert.Equal(t, float64(testData.expectedRejected), testutil.ToFloat64(c.metrics.rejectedRecords.WithLabelValues(reasonStaleDeadline)))
+
+			outcome := <-outcomes
+			if testData.expectedRejected > 0 {
+				assert.ErrorIs(t, outcome.Err, errStaleDeadline)
+			} else {
+				assert.NoError(t, outcome.Err)
+			}
+		})
+	}
+}
+
+func TestPusherConsumer_WriteRequestSizeAfterTransforms(t *testing.T) {
+	now := time.Now()
+	fresh := now.Add(-time.Minute).UnixMilli()
+	stale := now.Add(-2 * time.Hour).UnixMilli()
+
+	series := mockPreallocTimeseries("series_1")
+	series.Samples = []mimirpb.Sample{{TimestampMs: fresh + 1, Value: 2}, {TimestampMs: stale, Value: 0}, {TimestampMs: fresh, Value: 1}}
+	content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{series, mockPreallocTimeseries("series_2")}}).Marshal()
+	require.NoError(t, err)
+
+	cfg := KafkaConfig{IngestionMaxSampleAge: time.Hour, SortOutOfOrderSamples: true}
+	c := newPusherConsumer(nil, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+	// The size of the decoded series is cached, and must be invalidated by the transforms changing them.
+	req, err := c.decode(content)
+	require.NoError(t, err)
+	require.Equal(t, len(content), writeRequestSize(req))
+
+	c.dropStaleSamples(req)
+	c.checkSamplesOrder(req)
+
+	remarshalled, err := req.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, len(remarshalled), writeRequestSize(req))
+
+	decoded := &mimirpb.WriteRequest{}
+	require.NoError(t, decoded.Unmarshal(remarshalled))
+	assert.Equal(t, []mimirpb.Sample{{TimestampMs: fresh, Value: 1}, {TimestampMs: fresh + 1, Value: 2}}, decoded.Timeseries[0].Samples)
+	assert.Equal(t, series.Labels, decoded.Timeseries[0].Labels)
+}
+
+func TestPusherConsumer_VerifyDecodeRoundTrip(t *testing.T) {
+	samples, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+	source, err := (&mimirpb.WriteRequest{Source: mimirpb.RULE}).Marshal()
+	require.NoError(t, err)
+
+	// The fields of a message can be in any order, but they're re-marshalled in the order of their field numbers,
+	// so a request whose source precedes the series is valid but doesn't round-trip.
+	mismatching := append(append([]byte{}, source...), samples...)
+
+	tests := map[string]struct {
+		verify, fail       bool
+		content            []byte
+		expectedPushes     int
+		expectedMismatches int
+		expectedParseErrs  int
+	}{
+		"should not verify the round-trip if disabled": {
+			content:        mismatching,
+			expectedPushes: 1,
+		},
+		"should push the records which round-trip": {
+			verify:         true,
+			fail:           true,
+			content:        samples,
+			expectedPushes: 1,
+		},
+		"should count the records which don't round-trip and push them": {
+			verify:             true,
+			content:            mismatching,
+			expectedPushes:     1,
+			expectedMismatches: 1,
+		},
+		"should count the records which don't round-trip and skip them if enabled": {
+			verify:             true,
+			fail:               true,
+			content:            mismatching,
+			expectedMismatches: 1,
+			expectedParseErrs:  1,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			pushes := 0
+			pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+				pushes++
+				return nil
+			})
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			cfg := KafkaConfig{VerifyDecodeRoundTrip: testData.verify, VerifyDecodeRoundTripFail: testData.fail}
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+			require.NoError(t, c.Consume(context.Background(), []record{{ctx: context.Background(), tenantID: "user-1", content: testData.content}}))
+
+			assert.Equal(t, testData.expectedPushes, pushes)
+			assert.Equal(t, float64(testData.expectedMismatches), testutil.ToFloat64(metrics.decodeRoundTripMismatches))
+			assert.Equal(t, float64(testData.expectedParseErrs), testutil.ToFloat64(metrics.parseErrors))
+		})
+	}
+}
+
+func TestPusherConsumer_DetectOffsetGaps(t *testing.T) {
+	content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		offsets      []int64
+		expectedGaps int
+		expectedLogs []string
+	}{
+		"should not detect gaps between contiguous offsets": {
+			offsets: []int64{0, 1, 2, 3},
+		},
+		"should not detect gaps between the records of the same batch": {
+			offsets: []int64{5, 5, 5, 6},
+		},
+		"should not detect gaps if the records have no offsets": {
+			offsets: []int64{0, 0, 0},
+		},
+		"should detect the gaps between the offsets": {
+			offsets:      []int64{0, 1, 4, 5, 7},
+			expectedGaps: 2,
+			expectedLogs: []string{
+				"first_missing_offset=2 last_missing_offset=3 missing=2",
+				"first_missing_offset=6 last_missing_offset=6 missing=1",
+			},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var records []record
+			for _, offset := range testData.offsets {
+				records = append(records, record{ctx: context.Background(), tenantID: "user-1", content: content, offset: offset})
+			}
+
+			logs := &concurrency.SyncBuffer{}
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewLogfmtLogger(logs))
+			require.NoError(t, c.Consume(context.Background(), records))
+
+			assert.Equal(t, float64(testData.expectedGaps), testutil.ToFloat64(metrics.offsetGaps))
+			for _, expected := range testData.expectedLogs {
+				assert.Contains(t, logs.String(), expected)
+			}
+			if testData.expectedGaps == 0 {
+				assert.NotContains(t, logs.String(), "detected a gap")
+			}
+		})
+	}
+}
+
+func TestPusherConsumer_RecordBytesPerSample(t *testing.T) {
+	series := mockPreallocTimeseries("series_1")
+	series.Samples = []mimirpb.Sample{{TimestampMs: 1, Value: 1}, {TimestampMs: 2, Value: 2}, {TimestampMs: 3, Value: 3}}
+	series.Histograms = []mimirpb.Histogram{{Timestamp: 4}}
+
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_0")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{series}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Metadata: []*mimirpb.MetricMetadata{{MetricFamilyName: "series_0", Help: "help"}}}, nil),
+	}
+	// The first record has a float sample, and the second one has 3 float samples and a histogram sample.
+	expectedSum := float64(len(records[0].content)) + float64(len(records[1].content))/4
+
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	// The metadata-only record has no samples, so it's not observed.
+	metric := &dto.Metric{}
+	require.NoError(t, metrics.recordBytesPerSample.Write(metric))
+	assert.Equal(t, uint64(2), metric.GetHistogram().GetSampleCount())
+	assert.InDelta(t, expectedSum, metric.GetHistogram().GetSampleSum(), 1e-9)
+}
+
+func TestPusherConsumer_SeriesPerPush(t *testing.T) {
+	var timeseries []mimirpb.PreallocTimeseries
+	for i := 0; i < 10; i++ {
+		timeseries = append(timeseries, mockPreallocTimeseries(fmt.Sprintf("series_%d", i)))
+	}
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: timeseries}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_10")}}, nil),
+	}
+
+	var pushedSeries []float64
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushedSeries = append(pushedSeries, float64(len(request.Timeseries)))
+		return nil
+	})
+
+	// The first record is split into partial requests, which are observed one by one.
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{IngestionSplitRequestsMaxBytes: 100}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), records))
+	require.Greater(t, len(pushedSeries), len(records))
+
+	metric := &dto.Metric{}
+	require.NoError(t, metrics.seriesPerPush.Write(metric))
+	assert.Equal(t, uint64(len(pushedSeries)), metric.GetHistogram().GetSampleCount())
+	assert.Equal(t, float64(11), metric.GetHistogram().GetSampleSum())
+}
+
+func TestPusherConsumer_UnmarshalSendBlocked(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}}, nil),
+	}
+
+	// The pushes are slower than the decoding, so the decoding goroutine waits to hand off the records after the first.
+	const pushDuration = 50 * time.Millisecond
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		time.Sleep(pushDuration)
+		return nil
+	})
+
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	blocked := testutil.ToFloat64(metrics.unmarshalSendBlocked)
+	assert.GreaterOrEqual(t, blocked, float64(len(records)-1))
+
+	metric := &dto.Metric{}
+	require.NoError(t, metrics.unmarshalSendWaitSeconds.Write(metric))
+	assert.Equal(t, uint64(len(records)), metric.GetHistogram().GetSampleCount())
+	assert.GreaterOrEqual(t, metric.GetHistogram().GetSampleSum(), (pushDuration * time.Duration(len(records)-2)).Seconds())
+}
+
+func TestPusherConsumer_DecodeQueueTime(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}}, nil),
+	}
+
+	// The decoding of the last record only starts once the first record has been pushed, because the second one waits
+	// to be handed off in the meantime.
+	const pushDuration = 50 * time.Millisecond
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+		time.Sleep(pushDuration)
+		return nil
+	})
+
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	metric := &dto.Metric{}
+	require.NoError(t, metrics.decodeQueueSeconds.Write(metric))
+	assert.Equal(t, uint64(len(records)), metric.GetHistogram().GetSampleCount())
+	assert.GreaterOrEqual(t, metric.GetHistogram().GetSampleSum(), pushDuration.Seconds())
+}
+
+func TestPusherConsumer_OnRecordDecoded(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		{ctx: context.Background(), tenantID: "user-2", content: []byte{0}},
+		makeRecord(t, "", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}}, nil),
+	}
+
+	type decoded struct {
+		index    int
+		tenantID string
+		size     int
+		failed   bool
+	}
+	var calls []decoded
+	onDecoded := func(index int, tenantID string, size int, err error) {
+		calls = append(calls, decoded{index: index, tenantID: tenantID, size: size, failed: err != nil})
+	}
+
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithOnRecordDecoded(onDecoded))
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	assert.Equal(t, []decoded{
+		{index: 0, tenantID: "user-1", size: len(records[0].content)},
+		{index: 1, tenantID: "user-2", size: 1, failed: true},
+		{index: 2, tenantID: "", size: len(records[2].content), failed: true},
+	}, calls)
+}
+
+func TestPusherConsumer_EmptyTenant(t *testing.T) {
+	records := []record{
+		makeRecord(t, "", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+		makeRecord(t, "", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}}, nil),
+	}
+	for i := range records {
+		records[i].offset = int64(i)
+	}
+
+	var pushed []string
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	logs := &concurrency.SyncBuffer{}
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewLogfmtLogger(logs))
+	lastProcessed, err := c.ConsumeWithLastProcessedOffset(context.Background(), records)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"series_2"}, pushed)
+	assert.Equal(t, int64(2), lastProcessed)
+	assert.Equal(t, 1, strings.Count(logs.String(), "rejected record without tenant"))
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_rejected_records_total Number of records read from Kafka which have been rejected as a client error before being pushed to the storage.
+		# TYPE cortex_ingest_storage_reader_rejected_records_total counter
+		cortex_ingest_storage_reader_rejected_records_total{reason="empty_tenant"} 2
+		# HELP cortex_ingest_storage_reader_parse_errors_total Number of records read from Kafka which have been skipped because they couldn't be parsed into a write request.
+		# TYPE cortex_ingest_storage_reader_parse_errors_total counter
+		cortex_ingest_storage_reader_parse_errors_total 0
+	`), "cortex_ingest_storage_reader_rejected_records_total", "cortex_ingest_storage_reader_parse_errors_total"))
+}
+
+func TestPusherConsumer_MaxRecordsPerConsume(t *testing.T) {
+	var records []record
+	for i := 0; i < 5; i++ {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}).Marshal()
+		require.NoError(t, err)
+		records = append(records, record{ctx: context.Background(), tenantID: "user-1", content: content})
+	}
+
+	var pushed []string
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	t.Run("should consume only the first records and report the remaining ones", func(t *testing.T) {
+		pushed = nil
+		c := newPusherConsumer(pusher, KafkaConfig{MaxRecordsPerConsume: 2}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, c.Consume(context.Background(), records), &unprocessed)
+		assert.Equal(t, records[2:], unprocessed.records)
+		assert.Equal(t, []string{"series_0", "series_1"}, pushed)
+	})
+
+	t.Run("should consume all the records if they don't exceed the limit", func(t *testing.T) {
+		pushed = nil
+		c := newPusherConsumer(pusher, KafkaConfig{MaxRecordsPerConsume: 5}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+		require.NoError(t, c.Consume(context.Background(), records))
+		assert.Len(t, pushed, 5)
+	})
+}
+
+func TestPusherConsumer_MaxTenantsPerConsume(t *testing.T) {
+	var records []record
+	for i, tenantID := range []string{"user-1", "user-2", "user-3", "user-1", "user-3", "user-2"} {
+		r := makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}}, nil)
+		r.offset = int64(i)
+		records = append(records, r)
+	}
+
+	var pushed []string
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		tenantID, err := tenant.TenantID(ctx)
+		require.NoError(t, err)
+		pushed = append(pushed, tenantID+"/"+request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	t.Run("should consume only the records of the first tenants and report the other ones", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{MaxTenantsPerConsume: 2}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, c.Consume(context.Background(), records), &unprocessed)
+		assert.Equal(t, []string{"user-1/series_0", "user-2/series_1", "user-1/series_3", "user-2/series_5"}, pushed)
+		require.Len(t, unprocessed.records, 2)
+		assert.Equal(t, []int64{2, 4}, []int64{unprocessed.records[0].offset, unprocessed.records[1].offset})
+
+		// The deferred records are consumed by the next consume, without reporting the records between them as missing.
+		pushed = nil
+		require.NoError(t, c.Consume(context.Background(), unprocessed.records))
+		assert.Equal(t, []string{"user-3/series_2", "user-3/series_4"}, pushed)
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.offsetGaps))
+	})
+
+	t.Run("should consume all the records if they don't exceed the limit", func(t *testing.T) {
+		pushed = nil
+		c := newPusherConsumer(pusher, KafkaConfig{MaxTenantsPerConsume: 3}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+
+		require.NoError(t, c.Consume(context.Background(), records))
+		assert.Len(t, pushed, len(records))
+	})
+}
+
+func TestPusherConsumer_MaxConsumeDuration(t *testing.T) {
+	wrs := make([]*mimirpb.WriteRequest, 0, 10)
+	for i := 0; i < 10; i++ {
+		wrs = append(wrs, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(fmt.Sprintf("series_%d", i))}})
+	}
+	var records []record
+	for i, wr := range wrs {
+		r := makeRecord(t, "user-1", wr, nil)
+		r.offset = int64(i)
+		records = append(records, r)
+	}
+
+	var (
+		pushedMx sync.Mutex
+		pushed   []string
+	)
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		pushedMx.Lock()
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		pushedMx.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+
+	// assertUnprocessed asserts that the unprocessed records are exactly the records which haven't been pushed, in order.
+	assertUnprocessed := func(t *testing.T, err error, metrics *pusherConsumerMetrics) {
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, err, &unprocessed)
+		assert.Equal(t, unprocessedMaxConsumeDuration, unprocessed.reason)
+		require.NotEmpty(t, pushed)
+		require.NotEmpty(t, unprocessed.records)
+
+		var expected []string
+		for i := 0; i < len(pushed); i++ {
+			expected = append(expected, fmt.Sprintf("series_%d", i))
+		}
+		assert.Equal(t, expected, pushed)
+		assert.Equal(t, records[len(pushed):], unprocessed.records)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.consumeDurationExceeded))
+	}
+
+	t.Run("should stop consuming once the duration has been exceeded and return the records not attempted", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{MaxConsumeDuration: 50 * time.Millisecond}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		assertUnprocessed(t, c.Consume(context.Background(), records), metrics)
+	})
+
+	t.Run("should return the records not attempted before the ones exceeding the maximum number of records", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{MaxConsumeDuration: 50 * time.Millisecond, MaxRecordsPerConsume: 8}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		assertUnprocessed(t, c.Consume(context.Background(), records), metrics)
+	})
+
+	t.Run("should return the batch which has been partially split with the number of its consumed entries", func(t *testing.T) {
+		pushed = nil
+		batched := []record{makeBatchRecord(t, "user-1", nil, wrs[:5]...)}
+		batched[0].offset = 0
+		for i, wr := range wrs[5:] {
+			r := makeRecord(t, "user-1", wr, nil)
+			r.offset = int64(i + 1)
+			batched = append(batched, r)
+		}
+
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{MaxConsumeDuration: time.Nanosecond}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, c.Consume(context.Background(), batched), &unprocessed)
+		assert.Equal(t, []string{"series_0"}, pushed)
+
+		partial := batched[0]
+		partial.consumedBatchEntries = 1
+		assert.Equal(t, slices.Concat([]record{partial}, batched[1:]), unprocessed.records)
+	})
+
+	t.Run("should attempt at least a record", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{MaxConsumeDuration: time.Nanosecond}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		var unprocessed *unprocessedRecordsError
+		require.ErrorAs(t, c.Consume(context.Background(), records), &unprocessed)
+		assert.Equal(t, []string{"series_0"}, pushed)
+		assert.Equal(t, records[1:], unprocessed.records)
+	})
+
+	t.Run("should consume all the records if the duration isn't exceeded", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{MaxConsumeDuration: time.Minute}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		require.NoError(t, c.Consume(context.Background(), records))
+		assert.Len(t, pushed, len(records))
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.consumeDurationExceeded))
+	})
+}
+
+func TestPusherConsumer_TenantMaxInflightBytes(t *testing.T) {
+	newRecord := func(tenantID, metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: tenantID, content: content}
+	}
+
+	records := []record{
+		newRecord("user-1", "series_1"),
+		newRecord("user-1", "series_2"),
+		newRecord("user-2", "series_3"),
+	}
+	recordSize := len(records[0].content)
+
+	// Only user-1 is limited, to less than the size of two records.
+	limits := validation.MockOverrides(func(_ *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		tenantLimits["user-1"] = validation.MockDefaultLimits()
+		tenantLimits["user-1"].IngestStorageMaxInflightBytes = recordSize + 1
+	})
+
+	// The first record of user-1 is pushed only once the record of user-2 has been pushed, so that it's still in
+	// flight when the second record of user-1 is received.
+	var (
+		pushedMx    sync.Mutex
+		pushed      []string
+		user2Pushed = make(chan struct{})
+		user2Late   = atomic.NewBool(false)
+	)
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		switch name := request.Timeseries[0].Labels[0].Value; name {
+		case "series_1":
+			// The test fails below, rather than hanging, if the record of user-2 is held back by user-1.
+			select {
+			case <-user2Pushed:
+			case <-time.After(5 * time.Second):
+				user2Late.Store(true)
+			}
+		case "series_3":
+			close(user2Pushed)
+		}
+
+		pushedMx.Lock()
+		defer pushedMx.Unlock()
+		pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+		return nil
+	})
+
+	cfg := KafkaConfig{
+		IngestionOrdering:                 ingestionOrderingRelaxed,
+		IngestionConcurrencyMax:           2,
+		TenantInflightBytesTrackedTenants: []string{"user-1"},
+	}
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, cfg, limits, newPusherConsumerMetrics(reg), log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), records))
+
+	// The record of user-2 is pushed while the second record of user-1 waits for the first one to be pushed, and
+	// the second record of user-1 is pushed once it has been, rather than being rejected.
+	require.ElementsMatch(t, []string{"series_1", "series_2", "series_3"}, pushed)
+	assert.False(t, user2Late.Load())
+	assert.Less(t, slices.Index(pushed, "series_3"), slices.Index(pushed, "series_2"))
+	assert.Less(t, slices.Index(pushed, "series_1"), slices.Index(pushed, "series_2"))
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_tenant_inflight_bytes Number of bytes of the tenant's records read from Kafka which are currently being decoded or waiting to be pushed to the storage. Only exported for the tracked tenants.
+		# TYPE cortex_ingest_storage_reader_tenant_inflight_bytes gauge
+		cortex_ingest_storage_reader_tenant_inflight_bytes{user="user-1"} 0
+
+		# HELP cortex_ingest_storage_reader_tenant_inflight_bytes_waits_total Number of records read from Kafka whose decoding has waited for the other records of their tenant to be pushed, because the tenant exceeded the maximum in-flight bytes.
+		# TYPE cortex_ingest_storage_reader_tenant_inflight_bytes_waits_total counter
+		cortex_ingest_storage_reader_tenant_inflight_bytes_waits_total 1
+	`), "cortex_ingest_storage_reader_tenant_inflight_bytes", "cortex_ingest_storage_reader_tenant_inflight_bytes_waits_total"))
+}
+
+func TestPusherConsumer_WithTenantRemapper(t *testing.T) {
+	newRecord := func(tenantID, metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: tenantID, content: content}
+	}
+
+	var pushedTenants []string
+	pusher := pusherFunc(func(ctx context.Context, _ *mimirpb.WriteRequest) error {
+		userID, err := user.ExtractOrgID(ctx)
+		require.NoError(t, err)
+		pushedTenants = append(pushedTenants, userID)
+		return nil
+	})
+
+	remapper := TenantRemapper(func(tenantID string) string {
+		if tenantID == "old-tenant" {
+			return "new-tenant"
+		}
+		return tenantID
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger(), WithTenantRemapper(remapper))
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("old-tenant", "series_1"), newRecord("other-tenant", "series_2"), newRecord("old-tenant", "series_3")}))
+
+	assert.Equal(t, []string{"new-tenant", "other-tenant", "new-tenant"}, pushedTenants)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_ingest_storage_reader_remapped_records_total Number of records read from Kafka which have been pushed to the storage under a remapped tenant.
+		# TYPE cortex_ingest_storage_reader_remapped_records_total counter
+		cortex_ingest_storage_reader_remapped_records_total 2
+	`), "cortex_ingest_storage_reader_remapped_records_total"))
+}
+
+func TestPusherConsumer_WithRecordOutcomes(t *testing.T) {
+	newRecord := func(metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
+	}
+
+	serverErr := ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		switch request.Timeseries[0].Labels[0].Value {
+		case "client_error":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		case "server_error":
+			return serverErr
+		}
+		return nil
+	})
+
+	records := []record{
+		newRecord("series_1"),
+		{ctx: context.Background(), tenantID: "user-2", content: []byte{0}},
+		newRecord("client_error"),
+		newRecord("server_error"),
+		newRecord("series_2"),
+	}
+
+	t.Run("should send the outcome of each record until the consumption is aborted", func(t *testing.T) {
+		outcomes := make(chan RecordOutcome, len(records))
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), WithRecordOutcomes(outcomes))
+		require.ErrorIs(t, c.Consume(context.Background(), records), serverErr)
+		close(outcomes)
+
+		var received []RecordOutcome
+		for o := range outcomes {
+			received = append(received, o)
+		}
+
+		require.Len(t, received, 4)
+		assert.Equal(t, RecordOutcome{Index: 0, TenantID: "user-1"}, received[0])
+		assert.Equal(t, 1, received[1].Index)
+		assert.Equal(t, "user-2", received[1].TenantID)
+		assert.ErrorContains(t, received[1].Err, "parsing ingest consumer write request")
+		assert.Equal(t, RecordOutcome{Index: 2, TenantID: "user-1"}, received[2])
+		assert.Equal(t, 3, received[3].Index)
+		assert.ErrorIs(t, received[3].Err, serverErr)
+	})
+
+	t.Run("should not block if the outcomes aren't read", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		outcomes := make(chan RecordOutcome)
+		c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger(), WithRecordOutcomes(outcomes))
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("series_2")}))
+
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_ingest_storage_reader_record_outcomes_dropped_total Number of outcomes of the records read from Kafka which have been dropped because the outcomes channel was full.
+			# TYPE cortex_ingest_storage_reader_record_outcomes_dropped_total counter
+			cortex_ingest_storage_reader_record_outcomes_dropped_total 2
+		`), "cortex_ingest_storage_reader_record_outcomes_dropped_total"))
+	})
+}
+
+func TestProcessingTimeHistogramConfig(t *testing.T) {
+	assert.Equal(t, ProcessingTimeHistogramConfig{BucketFactor: 1.1, MaxBucketNumber: 100, MinResetDuration: time.Hour}, ProcessingTimeHistogramConfig{}.withDefaults())
+	assert.Equal(t, ProcessingTimeHistogramConfig{BucketFactor: 2, MaxBucketNumber: 100, MinResetDuration: time.Minute}, ProcessingTimeHistogramConfig{BucketFactor: 2, MinResetDuration: time.Minute}.withDefaults())
+
+	schemaFor := func(t *testing.T, cfg ProcessingTimeHistogramConfig) int32 {
+		reg := prometheus.NewPedanticRegistry()
+		metrics := newPusherConsumerMetricsWithHistogramConfig(reg, cfg)
+		metrics.processingTimeSeconds.Observe(1)
+
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "cortex_ingest_storage_reader_records_processing_time_seconds" {
+				return family.GetMetric()[0].GetHistogram().GetSchema()
+			}
+		}
+		require.Fail(t, "processing time histogram not found")
+		return 0
+	}
+
+	// The schema of a native histogram is derived from its bucket factor.
+	assert.Equal(t, int32(3), schemaFor(t, ProcessingTimeHistogramConfig{}))
+	assert.Equal(t, int32(0), schemaFor(t, ProcessingTimeHistogramConfig{BucketFactor: 2}))
+}
+
+func TestPusherConsumer_ProcessingTimeTrackedTenants(t *testing.T) {
+	newRecord := func(tenantID string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: tenantID, content: content}
+	}
+
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	reg := prometheus.NewPedanticRegistry()
+	metrics := newPusherConsumerMetrics(reg)
+	cfg := KafkaConfig{ProcessingTimeTrackedTenants: []string{"user-1", "user-3"}}
+	c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("user-1"), newRecord("user-2"), newRecord("user-1")}))
+
+	// Only the tracked tenants whose records have been consumed get their own series.
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.tenantProcessingTimeSeconds))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		switch family.GetName() {
+		case "cortex_ingest_storage_reader_tenant_record_processing_time_seconds":
+			require.Len(t, family.GetMetric(), 1)
+			assert.Equal(t, "user-1", family.GetMetric()[0].GetLabel()[0].GetValue())
+			assert.Equal(t, uint64(2), family.GetMetric()[0].GetHistogram().GetSampleCount())
+		case "cortex_ingest_storage_reader_records_processing_time_seconds":
+			// The whole batch, including the records of the untracked tenants, is tracked by the aggregated histogram.
+			assert.Equal(t, uint64(1), family.GetMetric()[0].GetHistogram().GetSampleCount())
+		}
+	}
+}
+
+func TestPusherConsumer_ProcessingTimeSLO(t *testing.T) {
+	newRecord := func(tenantID, metricName string) record {
+		return makeRecord(t, tenantID, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}, nil)
 	}
 
-	ctx := context.Background()
+	const slo = 50 * time.Millisecond
+	pusher := pusherFunc(func(_ context.Context, req *mimirpb.WriteRequest) error {
+		if req.Timeseries[0].Labels[0].Value == "slow" {
+			time.Sleep(2 * slo)
+		}
+		return nil
+	})
 
-	type response struct {
-		err error
-	}
+	t.Run("should count the records of the tracked tenants pushed within the SLO", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		cfg := KafkaConfig{ProcessingTimeTrackedTenants: []string{"user-1", "user-2"}, ProcessingTimeSLO: slo}
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), []record{
+			newRecord("user-1", "fast"), newRecord("user-1", "slow"), newRecord("user-1", "fast"),
+			newRecord("user-2", "slow"),
+			newRecord("user-3", "fast"),
+		}))
 
-	okResponse := response{nil}
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_ingest_storage_reader_tenant_processing_slo_records_total Number of records read from Kafka pushed to the storage, for the tracked tenants only, when a processing time SLO is configured.
+			# TYPE cortex_ingest_storage_reader_tenant_processing_slo_records_total counter
+			cortex_ingest_storage_reader_tenant_processing_slo_records_total{user="user-1"} 3
+			cortex_ingest_storage_reader_tenant_processing_slo_records_total{user="user-2"} 1
+
+			# HELP cortex_ingest_storage_reader_tenant_processing_slo_records_within_total Number of records read from Kafka pushed to the storage within the processing time SLO, for the tracked tenants only.
+			# TYPE cortex_ingest_storage_reader_tenant_processing_slo_records_within_total counter
+			cortex_ingest_storage_reader_tenant_processing_slo_records_within_total{user="user-1"} 2
+		`), "cortex_ingest_storage_reader_tenant_processing_slo_records_total", "cortex_ingest_storage_reader_tenant_processing_slo_records_within_total"))
+	})
 
-	testCases := map[string]struct {
-		records     []record
-		responses   []response
-		expectedWRs []*mimirpb.WriteRequest
-		expErr      string
+	t.Run("should not count the records if the SLO is disabled", func(t *testing.T) {
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		cfg := KafkaConfig{ProcessingTimeTrackedTenants: []string{"user-1"}}
+		c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+		require.NoError(t, c.Consume(context.Background(), []record{newRecord("user-1", "fast")}))
 
-		expectedLogLines []string
-	}{
-		"single record": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-			},
-			responses: []response{
-				okResponse,
-			},
-			expectedWRs: writeReqs[0:1],
-		},
-		"multiple records": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
-			},
-			responses: []response{
-				okResponse,
-				okResponse,
-				okResponse,
-			},
-			expectedWRs: writeReqs[0:3],
-		},
-		"unparsable record": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-				{ctx: ctx, content: []byte{0}, tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
-			},
-			responses: []response{
-				okResponse,
-				okResponse,
-			},
-			expectedWRs: writeReqs[0:2],
-			expErr:      "",
-			expectedLogLines: []string{
-				"level=error msg=\"failed to parse write request; skipping\" err=\"parsing ingest consumer write request: proto: WriteRequest: illegal tag 0 (wire type 0)\"",
-			},
-		},
-		"failed processing of record": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
-			},
-			responses: []response{
-				okResponse,
-				{err: assert.AnError},
-			},
-			expectedWRs: writeReqs[0:2],
-			expErr:      assert.AnError.Error(),
-		},
-		"failed processing of last record": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
-			},
-			responses: []response{
-				okResponse,
-				{err: assert.AnError},
-			},
-			expectedWRs: writeReqs[0:2],
-			expErr:      assert.AnError.Error(),
-		},
-		"failed processing & failed unmarshalling": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
-				{ctx: ctx, content: []byte{0}, tenantID: tenantID},
-			},
-			responses: []response{
-				okResponse,
-				{err: assert.AnError},
-			},
-			expectedWRs: writeReqs[0:2],
-			expErr:      assert.AnError.Error(),
-		},
-		"no records": {},
-		"ingester client error": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
-			},
-			responses: []response{
-				{err: ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")},
-				{err: ingesterError(mimirpb.BAD_DATA, codes.Unknown, "ingester test error")}, // status code doesn't matter
-				okResponse,
-			},
-			expectedWRs: writeReqs[0:3],
-			expErr:      "", // since all fof those were client errors, we don't return an error
-			expectedLogLines: []string{
-				"user=t1 level=warn msg=\"detected a client error while ingesting write request (the request may have been partially ingested)\" insight=true err=\"rpc error: code = InvalidArgument desc = ingester test error\"",
-				"user=t1 level=warn msg=\"detected a client error while ingesting write request (the request may have been partially ingested)\" insight=true err=\"rpc error: code = Unknown desc = ingester test error\"",
-			},
-		},
-		"ingester server error": {
-			records: []record{
-				{ctx: ctx, content: wrBytes[0], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[1], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[2], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[3], tenantID: tenantID},
-				{ctx: ctx, content: wrBytes[4], tenantID: tenantID},
-			},
-			responses: []response{
-				{err: ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")},
-				{err: ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")},
-			},
-			expectedWRs: writeReqs[0:2], // the rest of the requests are not attempted
-			expErr:      "ingester internal error",
-			expectedLogLines: []string{
-				"user=t1 level=warn msg=\"detected a client error while ingesting write request (the request may have been partially ingested)\" insight=true err=\"rpc error: code = InvalidArgument desc = ingester test error\"",
-			},
-		},
+		assert.Equal(t, 0, testutil.CollectAndCount(metrics.tenantSLORecords))
+		assert.Equal(t, 0, testutil.CollectAndCount(metrics.tenantSLORecordsWithin))
+	})
+}
+
+func TestPusherConsumerMetrics_snapshot(t *testing.T) {
+	newRecord := func(metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
 	}
 
-	for name, tc := range testCases {
-		t.Run(name, func(t *testing.T) {
-			receivedReqs := atomic.NewInt64(0)
-			pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
-				reqIdx := int(receivedReqs.Inc() - 1)
-				require.GreaterOrEqualf(t, len(tc.expectedWRs), reqIdx+1, "received more requests (%d) than expected (%d)", reqIdx+1, len(tc.expectedWRs))
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		switch request.Timeseries[0].Labels[0].Value {
+		case "client_error":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		case "server_error":
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		}
+		return nil
+	})
 
-				expectedWR := tc.expectedWRs[reqIdx]
-				for i, ts := range request.Timeseries {
-					assert.Truef(t, ts.Equal(expectedWR.Timeseries[i].TimeSeries), "timeseries %d not equal; got %v, expected %v", i, ts, expectedWR.Timeseries[i].TimeSeries)
-				}
+	metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+	assert.Equal(t, ConsumerMetricsSnapshot{}, metrics.snapshot())
 
-				actualTenantID, err := tenant.TenantID(ctx)
-				assert.NoError(t, err)
-				assert.Equal(t, tenantID, actualTenantID)
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("client_error"), newRecord("series_2")}))
+	require.Error(t, c.Consume(context.Background(), []record{newRecord("server_error")}))
 
-				return tc.responses[reqIdx].err
-			})
+	snapshot := metrics.snapshot()
+	assert.Equal(t, uint64(4), snapshot.TotalRequests)
+	assert.Equal(t, uint64(1), snapshot.ClientErrorRequests)
+	assert.Equal(t, uint64(1), snapshot.ServerErrorRequests)
+	assert.Greater(t, snapshot.ProcessingTimeP50, time.Duration(0))
+	assert.GreaterOrEqual(t, snapshot.ProcessingTimeP99, snapshot.ProcessingTimeP50)
+}
 
-			logs := &concurrency.SyncBuffer{}
-			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
-			c := newPusherConsumer(pusher, KafkaConfig{}, metrics, log.NewLogfmtLogger(logs))
-			err := c.Consume(context.Background(), tc.records)
-			if tc.expErr == "" {
-				assert.NoError(t, err)
-			} else {
-				assert.ErrorContains(t, err, tc.expErr)
-			}
+// recordingConsumerMetrics is a ConsumerMetrics which records the metrics it receives.
+type recordingConsumerMetrics struct {
+	mx          sync.Mutex
+	total       int
+	failed      map[string]int
+	processings int
+}
 
-			var logLines []string
-			if logsStr := logs.String(); logsStr != "" {
-				logLines = strings.Split(strings.TrimSpace(logsStr), "\n")
-				logLines = removeUnimportantLogFields(logLines)
-			}
-			assert.Equal(t, tc.expectedLogLines, logLines)
-		})
+func (m *recordingConsumerMetrics) IncTotal() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.total++
+}
+
+func (m *recordingConsumerMetrics) IncFailed(cause string) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.failed[cause]++
+}
+
+func (m *recordingConsumerMetrics) ObserveProcessing(time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.processings++
+}
+
+func TestPusherConsumer_WithConsumerMetrics(t *testing.T) {
+	newRecord := func(metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: "user-1", content: content}
 	}
+
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		switch request.Timeseries[0].Labels[0].Value {
+		case "client_error":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "ingester test error")
+		case "server_error":
+			return ingesterError(mimirpb.TSDB_UNAVAILABLE, codes.Unavailable, "ingester internal error")
+		}
+		return nil
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	metrics := newPusherConsumerMetrics(reg)
+	backend := &recordingConsumerMetrics{failed: map[string]int{}}
+
+	c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger(), WithConsumerMetrics(backend))
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1"), newRecord("client_error"), newRecord("series_2")}))
+	require.Error(t, c.Consume(context.Background(), []record{newRecord("server_error")}))
+
+	assert.Equal(t, 4, backend.total)
+	assert.Equal(t, map[string]int{"client": 1, "server": 1}, backend.failed)
+	assert.Equal(t, 2, backend.processings)
+
+	// The core metrics aren't exported as Prometheus metrics anymore, while the other metrics still are.
+	assert.Equal(t, ConsumerMetricsSnapshot{}, metrics.snapshot())
+	assert.Equal(t, float64(4), testutil.ToFloat64(metrics.floatSamples))
+
+	// The consumers which don't use the alternate backend still export the core metrics as Prometheus metrics.
+	c = newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+	require.NoError(t, c.Consume(context.Background(), []record{newRecord("series_1")}))
+	assert.Equal(t, uint64(1), metrics.snapshot().TotalRequests)
 }
 
-var unimportantLogFieldsPattern = regexp.MustCompile(`(\s?)caller=\S+\.go:\d+\s`)
+func TestHistogramQuantile(t *testing.T) {
+	newHistogram := func(observations ...float64) *dto.Metric {
+		h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test", Buckets: []float64{1, 2, 4}})
+		for _, o := range observations {
+			h.Observe(o)
+		}
+		m := &dto.Metric{}
+		require.NoError(t, h.Write(m))
+		return m
+	}
 
-func removeUnimportantLogFields(lines []string) []string {
-	// The 'caller' field is not important to these tests (we just care about the message and other information),
-	// and can change as we refactor code, making these tests brittle. So we remove it before making assertions about the log lines.
-	for i, line := range lines {
-		lines[i] = unimportantLogFieldsPattern.ReplaceAllString(line, "$1")
+	tests := map[string]struct {
+		histogram *dto.Metric
+		quantile  float64
+		expected  time.Duration
+	}{
+		"no observations": {
+			histogram: newHistogram(),
+			quantile:  0.5,
+			expected:  0,
+		},
+		"nil metric": {
+			histogram: nil,
+			quantile:  0.5,
+			expected:  0,
+		},
+		"interpolates within the first bucket": {
+			histogram: newHistogram(0.5, 0.5),
+			quantile:  0.5,
+			expected:  500 * time.Millisecond,
+		},
+		"interpolates within a higher bucket": {
+			histogram: newHistogram(0.5, 3, 3, 3),
+			quantile:  0.5,
+			expected:  2*time.Second + 666666666*time.Nanosecond,
+		},
+		"returns the highest finite bound when the quantile falls in the +Inf bucket": {
+			histogram: newHistogram(0.5, 10),
+			quantile:  0.99,
+			expected:  4 * time.Second,
+		},
 	}
 
-	return lines
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.InDelta(t, tc.expected, histogramQuantile(tc.quantile, tc.histogram), float64(time.Microsecond))
+		})
+	}
 }
 
 func TestPushErrorHandler_IsServerError(t *testing.T) {
@@ -279,7 +2358,7 @@ func TestPushErrorHandler_IsServerError(t *testing.T) {
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
-			c := newPushErrorHandler(newStoragePusherMetrics(prometheus.NewPedanticRegistry()), tc.sampler, log.NewNopLogger())
+			c := newPushErrorHandler(newStoragePusherMetrics(prometheus.NewPedanticRegistry()), tc.sampler, nil, nil, nil, log.NewNopLogger())
 
 			sampled, reason := c.shouldLogClientError(context.Background(), tc.err)
 			assert.Equal(t, tc.expectedSampled, sampled)
@@ -288,6 +2367,92 @@ func TestPushErrorHandler_IsServerError(t *testing.T) {
 	}
 }
 
+func TestPushErrorHandler_ShouldCountErrorsByCode(t *testing.T) {
+	metrics := newStoragePusherMetrics(prometheus.NewPedanticRegistry())
+	h := newPushErrorHandler(metrics, nil, nil, nil, nil, log.NewNopLogger())
+
+	h.IsServerError(context.Background(), nil)
+	h.IsServerError(context.Background(), ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "bad data"))
+	h.IsServerError(context.Background(), ingesterError(mimirpb.TENANT_LIMIT, codes.FailedPrecondition, "tenant limit"))
+	h.IsServerError(context.Background(), fmt.Errorf("wrapped: %w", status.Error(codes.ResourceExhausted, "too many requests")))
+	h.IsServerError(context.Background(), status.Error(codes.Unavailable, "unavailable"))
+	h.IsServerError(context.Background(), fmt.Errorf("plain"))
+
+	assert.Equal(t, 5, testutil.CollectAndCount(metrics.errRequestsByCode))
+	for _, code := range []string{"InvalidArgument", "FailedPrecondition", "ResourceExhausted", "Unavailable", "unknown"} {
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.errRequestsByCode.WithLabelValues(code)), code)
+	}
+}
+
+func TestPusherConsumer_ShouldDeduplicateClientErrorLogs(t *testing.T) {
+	newRecord := func(tenantID, metricName string) record {
+		content, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}).Marshal()
+		require.NoError(t, err)
+		return record{ctx: context.Background(), tenantID: tenantID, content: content}
+	}
+
+	pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+		switch request.Timeseries[0].Labels[0].Value {
+		case "bad_data":
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "bad data")
+		case "tenant_limit":
+			return ingesterError(mimirpb.TENANT_LIMIT, codes.FailedPrecondition, "tenant limit")
+		}
+		return nil
+	})
+
+	records := []record{
+		newRecord("user-1", "bad_data"),
+		newRecord("user-1", "bad_data"),
+		newRecord("user-1", "tenant_limit"),
+		newRecord("user-1", "bad_data"),
+		newRecord("user-2", "bad_data"),
+		newRecord("user-2", "series_1"),
+	}
+
+	for _, ingestionConcurrency := range []int{0, 2} {
+		t.Run(fmt.Sprintf("ingestion concurrency %d", ingestionConcurrency), func(t *testing.T) {
+			logs := &concurrency.SyncBuffer{}
+			cfg := KafkaConfig{
+				DeduplicateClientErrorLogs:                  true,
+				IngestionConcurrencyMax:                     ingestionConcurrency,
+				IngestionConcurrencyBatchSize:               1,
+				IngestionConcurrencyQueueCapacity:           1,
+				IngestionConcurrencyEstimatedBytesPerSample: 500,
+				IngestionConcurrencyTargetFlushesPerShard:   1,
+			}
+			c := newPusherConsumer(pusher, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewLogfmtLogger(logs))
+
+			// The deduplication is reset for each batch.
+			for i := 0; i < 2; i++ {
+				require.NoError(t, c.Consume(context.Background(), records))
+
+				lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+				assert.Equal(t, 1, countLinesContaining(lines, "user=user-1", "bad data", "detected a client error"))
+				assert.Equal(t, 1, countLinesContaining(lines, "user=user-1", "tenant limit", "detected a client error"))
+				assert.Equal(t, 1, countLinesContaining(lines, "user=user-2", "bad data", "detected a client error"))
+				assert.Equal(t, 1, countLinesContaining(lines, "suppressed repeated client errors", "user=user-1", "cause=BAD_DATA", "suppressed=2"))
+				assert.Equal(t, 1, countLinesContaining(lines, "suppressed repeated client errors"))
+				logs.Reset()
+			}
+		})
+	}
+}
+
+func countLinesContaining(lines []string, substrs ...string) int {
+	count := 0
+	for _, line := range lines {
+		matches := true
+		for _, s := range substrs {
+			matches = matches && strings.Contains(line, s)
+		}
+		if matches {
+			count++
+		}
+	}
+	return count
+}
+
 func TestPusherConsumer_consume_ShouldLogErrorsHonoringOptionalLogging(t *testing.T) {
 	// Create a request that will be used in this test. The content doesn't matter,
 	// since we only test errors.
@@ -308,7 +2473,7 @@ func TestPusherConsumer_consume_ShouldLogErrorsHonoringOptionalLogging(t *testin
 
 		reg := prometheus.NewPedanticRegistry()
 		logs := &concurrency.SyncBuffer{}
-		consumer := newPusherConsumer(pusher, KafkaConfig{}, newPusherConsumerMetrics(reg), log.NewLogfmtLogger(logs))
+		consumer := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewLogfmtLogger(logs))
 
 		return consumer, logs, reg
 	}
@@ -668,8 +2833,8 @@ func TestParallelStorageShards_ShardWriteRequest(t *testing.T) {
 			const buffer = 1
 			reg := prometheus.NewPedanticRegistry()
 			metrics := newStoragePusherMetrics(reg)
-			errorHandler := newPushErrorHandler(metrics, nil, log.NewNopLogger())
-			shardingP := newParallelStorageShards(metrics, errorHandler, tc.shardCount, tc.batchSize, buffer, pusher, labels.StableHash)
+			errorHandler := newPushErrorHandler(metrics, nil, nil, nil, nil, log.NewNopLogger())
+			shardingP := newParallelStorageShards(metrics, errorHandler, tc.shardCount, tc.batchSize, buffer, 0, pusher, labels.StableHash)
 
 			upstreamPushErrsCount := 0
 			for i, req := range tc.expectedUpstreamPushes {
@@ -724,6 +2889,80 @@ func TestParallelStorageShards_ShardWriteRequest(t *testing.T) {
 	}
 }
 
+func TestParallelStorageShards_IdleFlush(t *testing.T) {
+	newRequest := func(metricName string) *mimirpb.WriteRequest {
+		return &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(metricName)}}
+	}
+
+	t.Run("should flush the batches once no write request has been pushed for the idle flush timeout", func(t *testing.T) {
+		pushes := atomic.NewInt64(0)
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			pushes.Inc()
+			return nil
+		})
+		metrics := newStoragePusherMetrics(prometheus.NewPedanticRegistry())
+		shards := newParallelStorageShards(metrics, newPushErrorHandler(metrics, nil, nil, nil, nil, log.NewNopLogger()), 1, 100, 1, 50*time.Millisecond, pusher, labels.StableHash)
+
+		require.NoError(t, shards.PushToStorage(context.Background(), newRequest("series_1")))
+		require.NoError(t, shards.PushToStorage(context.Background(), newRequest("series_2")))
+		require.Eventually(t, func() bool { return pushes.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+		// The batches which are empty aren't flushed again.
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, int64(1), pushes.Load())
+
+		require.NoError(t, shards.PushToStorage(context.Background(), newRequest("series_3")))
+		require.Empty(t, shards.Close())
+		assert.Equal(t, int64(2), pushes.Load())
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.batchingQueueMetrics.idleFlushTotal))
+	})
+
+	t.Run("should return the errors of the idle flushes once closed", func(t *testing.T) {
+		serverErr := fmt.Errorf("server error")
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			return serverErr
+		})
+		metrics := newStoragePusherMetrics(prometheus.NewPedanticRegistry())
+		shards := newParallelStorageShards(metrics, newPushErrorHandler(metrics, nil, nil, nil, nil, log.NewNopLogger()), 1, 100, 1, 10*time.Millisecond, pusher, labels.StableHash)
+
+		require.NoError(t, shards.PushToStorage(context.Background(), newRequest("series_1")))
+		require.Eventually(t, func() bool { return testutil.ToFloat64(metrics.batchingQueueMetrics.idleFlushTotal) == 1 }, time.Second, 5*time.Millisecond)
+
+		errs := shards.Close()
+		require.Len(t, errs, 1)
+		require.ErrorIs(t, errs[0], serverErr)
+	})
+
+	t.Run("should not hold the lock while the batches of a write request are sent", func(t *testing.T) {
+		release := make(chan struct{})
+		pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			<-release
+			return nil
+		})
+		metrics := newStoragePusherMetrics(prometheus.NewPedanticRegistry())
+		shards := newParallelStorageShards(metrics, newPushErrorHandler(metrics, nil, nil, nil, nil, log.NewNopLogger()), 1, 1, 1, time.Hour, pusher, labels.StableHash)
+
+		// The first batch is being pushed and the second one is queued, so sending the third one blocks.
+		request := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1"), mockPreallocTimeseries("series_2"), mockPreallocTimeseries("series_3")}}
+		done := make(chan error)
+		go func() {
+			done <- shards.PushToStorage(context.Background(), request)
+		}()
+		require.Eventually(t, func() bool { return len(shards.shards[0].ch) == 1 }, time.Second, 5*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+
+		require.True(t, shards.mx.TryLock())
+		shards.mx.Unlock()
+		// The idle flush is skipped while the write request is being pushed, rather than waiting for it.
+		shards.flushIdle()
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.batchingQueueMetrics.idleFlushTotal))
+
+		close(release)
+		require.NoError(t, <-done)
+		require.Empty(t, shards.Close())
+	})
+}
+
 func TestParallelStoragePusher(t *testing.T) {
 	type tenantWriteRequest struct {
 		tenantID string
@@ -861,7 +3100,7 @@ func TestParallelStoragePusher(t *testing.T) {
 			}
 
 			metrics := newStoragePusherMetrics(prometheus.NewPedanticRegistry())
-			psp := newParallelStoragePusher(metrics, pusher, samplesPerTenant, 0, 1, 1, 5, 500, 80, logger)
+			psp := newParallelStoragePusher(metrics, pusher, samplesPerTenant, 0, nil, nil, nil, 1, 1, 5, 500, 80, 0, logger)
 
 			// Process requests
 			for _, req := range tc.requests {
@@ -1002,7 +3241,7 @@ cortex_ingest_storage_reader_batching_queue_flush_errors_total 0
 # HELP cortex_ingest_storage_reader_batching_queue_flush_total Number of times a batch of samples is flushed to the storage.
 # TYPE cortex_ingest_storage_reader_batching_queue_flush_total counter
 cortex_ingest_storage_reader_batching_queue_flush_total 3
-`)))
+`), "cortex_ingest_storage_reader_batching_queue_flush_errors_total", "cortex_ingest_storage_reader_batching_queue_flush_total"))
 }
 
 func TestBatchingQueue(t *testing.T) {
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/spanlogger"
+)
+
+// The stages of the processing of the records whose timeouts are counted.
+const (
+	timeoutStageFirstRecord = "first_record"
+	timeoutStageDecode      = "decode"
+	timeoutStageMutation    = "mutation"
+	timeoutStagePush        = "push"
+)
+
+// errPushTimeout is the cause of the pushes of the records to the storage which took longer than their timeout.
+var errPushTimeout = errors.New("the push of the record to the storage timed out")
+
+// pushTimeoutSupported returns whether the pushes of the records can time out. The timeout only applies when each record
+// is pushed by the time pushRecord returns, which isn't the case when the series of the records are pushed in parallel
+// by the ingestion shards, or when the metadata is pushed by its own workers or at the end of the batch: their pushes
+// would be canceled once the timeout of the record they've been collected from is released.
+func (c pusherConsumer) pushTimeoutSupported() bool {
+	cfg := c.kafkaConfig
+	sequential := cfg.IngestionOrdering == ingestionOrderingRelaxed || cfg.IngestionConcurrencyMax == 0
+	return sequential && cfg.MetadataOnlyConcurrency == 0 && !cfg.DeferMetadataPushes
+}
+
+// pushTimeout returns the timeout of the push of a write request of tenantID of size bytes, which scales with the size
+// of the request so that the large requests are given more time while the hangs of the small ones are still caught.
+// The base timeout of the tenant's limits, if any, overrides the configured one, and the timeout is never capped below
+// it. It returns 0 if the pushes don't time out.
+func (c pusherConsumer) pushTimeout(tenantID string, size int) time.Duration {
+	if !c.pushTimeoutSupported() {
+		return 0
+	}
+
+	cfg := c.kafkaConfig
+	base := cfg.IngestionPushTimeout
+	if tenantTimeout := c.limits.IngestStoragePushTimeout(tenantID); tenantTimeout > 0 {
+		base = tenantTimeout
+	}
+	if base <= 0 {
+		return 0
+	}
+
+	timeout := base + time.Duration(float64(cfg.IngestionPushTimeoutPerKiB)*float64(size)/1024)
+	if cfg.IngestionPushMaxTimeout > 0 {
+		timeout = min(timeout, max(cfg.IngestionPushMaxTimeout, base))
+	}
+	return timeout
+}
+
+// pushWithTimeout calls push with a context which times out after the push timeout of a write request of size bytes.
+// If the push fails because it's timed out, the error is counted, and wrapped with errPushTimeout.
+func (c pusherConsumer) pushWithTimeout(ctx context.Context, tenantID string, size int, push func(context.Context) error) error {
+	timeout := c.pushTimeout(tenantID, size)
+	if timeout <= 0 {
+		return push(ctx)
+	}
+
+	pushCtx, cancel := context.WithTimeoutCause(ctx, timeout, errPushTimeout)
+	defer cancel()
+
+	err := push(pushCtx)
+	if err != nil && errors.Is(context.Cause(pushCtx), errPushTimeout) {
+		c.metrics.pushTimeouts.Inc()
+		c.metrics.timeouts.WithLabelValues(timeoutStagePush).Inc()
+		level.Warn(spanlogger.FromContext(ctx, c.logger)).Log("msg", "push of write request to the storage timed out", "user", tenantID, "size", size, "timeout", timeout)
+		err = fmt.Errorf("%w after %s: %w", errPushTimeout, timeout, err)
+	}
+	return err
+}
+
+// prepareRequestWithTimeout calls prepareRequest, and logs and counts the mutations of write requests taking longer than
+// the configured timeout. The mutation isn't abandoned once timed out, because it modifies the write request in place.
+func (c pusherConsumer) prepareRequestWithTimeout(ctx context.Context, tenantID string, req *mimirpb.WriteRequest) error {
+	timeout := c.kafkaConfig.IngestionMutationTimeout
+	if timeout <= 0 {
+		return c.prepareRequest(ctx, tenantID, req)
+	}
+
+	start := time.Now()
+	err := c.prepareRequest(ctx, tenantID, req)
+	if elapsed := time.Since(start); elapsed > timeout {
+		c.metrics.timeouts.WithLabelValues(timeoutStageMutation).Inc()
+		level.Warn(spanlogger.FromContext(ctx, c.logger)).Log("msg", "mutation of write request took longer than the timeout", "user", tenantID, "elapsed", elapsed, "timeout", timeout)
+	}
+	return err
+}
+
+// watchFirstRecord logs and counts the consume started at batchStart if its first record hasn't been handed over to be
+// pushed within the configured timeout, because the push loop waits silently for it meanwhile. It returns the function
+// stopping the watchdog, to call once the first record has been handed over or the consume has completed, which can
+// be called more than once.
+func (c pusherConsumer) watchFirstRecord(batchStart time.Time) (stop func()) {
+	timeout := c.kafkaConfig.IngestionFirstRecordTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	watchdog := time.AfterFunc(timeout-time.Since(batchStart), func() {
+		c.metrics.timeouts.WithLabelValues(timeoutStageFirstRecord).Inc()
+		level.Warn(c.logger).Log("msg", "the first record of the consume has not been handed over to be pushed within the timeout", "elapsed", time.Since(batchStart), "timeout", timeout)
+	})
+	return func() { watchdog.Stop() }
+}
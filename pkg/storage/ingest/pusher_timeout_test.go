@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_pushTimeout(t *testing.T) {
+	tests := map[string]struct {
+		cfg           KafkaConfig
+		tenantTimeout time.Duration
+		size          int
+		expected      time.Duration
+	}{
+		"should not time out by default": {
+			size:     1024,
+			expected: 0,
+		},
+		"should scale the timeout with the size of the request": {
+			cfg:      KafkaConfig{IngestionPushTimeout: time.Second, IngestionPushTimeoutPerKiB: 10 * time.Millisecond},
+			size:     2560,
+			expected: time.Second + 25*time.Millisecond,
+		},
+		"should cap the timeout": {
+			cfg:      KafkaConfig{IngestionPushTimeout: time.Second, IngestionPushTimeoutPerKiB: time.Second, IngestionPushMaxTimeout: 5 * time.Second},
+			size:     10 * 1024,
+			expected: 5 * time.Second,
+		},
+		"should use the base timeout if the timeout doesn't scale": {
+			cfg:      KafkaConfig{IngestionPushTimeout: time.Second, IngestionPushMaxTimeout: 5 * time.Second},
+			size:     10 * 1024,
+			expected: time.Second,
+		},
+		"should use the base timeout of the tenant": {
+			cfg:           KafkaConfig{IngestionPushTimeout: time.Second, IngestionPushTimeoutPerKiB: 10 * time.Millisecond},
+			tenantTimeout: 3 * time.Second,
+			size:          2560,
+			expected:      3*time.Second + 25*time.Millisecond,
+		},
+		"should time out the pushes of the tenant if the timeout is only set for the tenant": {
+			tenantTimeout: 3 * time.Second,
+			size:          1024,
+			expected:      3 * time.Second,
+		},
+		"should not cap the timeout below the base timeout of the tenant": {
+			cfg:           KafkaConfig{IngestionPushTimeout: time.Second, IngestionPushTimeoutPerKiB: time.Second, IngestionPushMaxTimeout: 5 * time.Second},
+			tenantTimeout: 10 * time.Second,
+			size:          10 * 1024,
+			expected:      10 * time.Second,
+		},
+		"should not time out if the records are pushed by the ingestion shards": {
+			cfg:      KafkaConfig{IngestionPushTimeout: time.Second, IngestionConcurrencyMax: 2},
+			size:     1024,
+			expected: 0,
+		},
+		"should time out with the relaxed ordering": {
+			cfg:      KafkaConfig{IngestionPushTimeout: time.Second, IngestionConcurrencyMax: 2, IngestionOrdering: ingestionOrderingRelaxed},
+			size:     1024,
+			expected: time.Second,
+		},
+		"should not time out if the metadata is pushed at the end of the batch": {
+			cfg:      KafkaConfig{IngestionPushTimeout: time.Second, DeferMetadataPushes: true},
+			size:     1024,
+			expected: 0,
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			limits := validation.MockOverrides(func(defaults *validation.Limits, _ map[string]*validation.Limits) {
+				defaults.IngestStoragePushTimeout = model.Duration(testData.tenantTimeout)
+			})
+			c := newPusherConsumer(nil, testData.cfg, limits, newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger())
+			assert.Equal(t, testData.expected, c.pushTimeout("user-1", testData.size))
+		})
+	}
+}
+
+func TestPusherConsumer_PushTimeout(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+	}
+
+	var pushed []string
+	pusher := pusherFunc(func(ctx context.Context, request *mimirpb.WriteRequest) error {
+		// The second series hangs until the push times out.
+		name := request.Timeseries[0].Labels[0].Value
+		if name == "series_2" {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		pushed = append(pushed, name)
+		return nil
+	})
+
+	t.Run("should fail the pushes which time out", func(t *testing.T) {
+		pushed = nil
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusher, KafkaConfig{IngestionPushTimeout: 50 * time.Millisecond}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		err := c.Consume(context.Background(), records)
+		require.ErrorIs(t, err, errPushTimeout)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, []string{"series_1"}, pushed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.pushTimeouts))
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.timeouts.WithLabelValues(timeoutStagePush)))
+	})
+
+	t.Run("should not count the failures of the pushes which haven't timed out", func(t *testing.T) {
+		metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+		c := newPusherConsumer(pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			return context.Canceled
+		}), KafkaConfig{IngestionPushTimeout: time.Minute}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+		err := c.Consume(context.Background(), records)
+		require.ErrorIs(t, err, context.Canceled)
+		require.NotErrorIs(t, err, errPushTimeout)
+		assert.Equal(t, float64(0), testutil.ToFloat64(metrics.pushTimeouts))
+	})
+}
+
+func TestPusherConsumer_MutationTimeout(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+	}
+
+	for _, timeout := range []time.Duration{time.Nanosecond, time.Minute} {
+		t.Run(fmt.Sprintf("timeout=%s", timeout), func(t *testing.T) {
+			var pushed []string
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+				return nil
+			})
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, KafkaConfig{IngestionMutationTimeout: timeout}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+			// The records whose mutation timed out are still pushed.
+			require.NoError(t, c.Consume(context.Background(), records))
+			assert.Equal(t, []string{"series_1", "series_2"}, pushed)
+
+			expected := 0
+			if timeout < time.Minute {
+				expected = len(records)
+			}
+			assert.Equal(t, float64(expected), testutil.ToFloat64(metrics.timeouts.WithLabelValues(timeoutStageMutation)))
+		})
+	}
+}
+
+func TestPusherConsumer_FirstRecordTimeout(t *testing.T) {
+	records := []record{
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}, nil),
+		makeRecord(t, "user-1", &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_2")}}, nil),
+	}
+
+	for _, delay := range []time.Duration{0, 200 * time.Millisecond} {
+		t.Run(fmt.Sprintf("delay=%s", delay), func(t *testing.T) {
+			var pushed []string
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+				return nil
+			})
+
+			metrics := newPusherConsumerMetrics(prometheus.NewPedanticRegistry())
+			c := newPusherConsumer(pusher, KafkaConfig{IngestionFirstRecordTimeout: 50 * time.Millisecond}, validation.MockDefaultOverrides(), metrics, log.NewNopLogger())
+
+			// The first record is delayed, like a huge record being slow to decode.
+			ch := make(chan record)
+			go func() {
+				defer close(ch)
+				time.Sleep(delay)
+				for _, r := range records {
+					ch <- r
+				}
+			}()
+
+			// The consume goes on once the first record is late, and the next records don't restart the watchdog.
+			require.NoError(t, c.consumeStream(context.Background(), ch))
+			time.Sleep(100 * time.Millisecond)
+			assert.Equal(t, []string{"series_1", "series_2"}, pushed)
+
+			expected := 0
+			if delay > 0 {
+				expected = 1
+			}
+			assert.Equal(t, float64(expected), testutil.ToFloat64(metrics.timeouts.WithLabelValues(timeoutStageFirstRecord)))
+		})
+	}
+}
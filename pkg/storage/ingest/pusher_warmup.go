@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/atomic"
+)
+
+// concurrencyWarmUp ramps the ingestion concurrency linearly from 1 to the configured maximum over the warm-up
+// duration, starting when the PartitionReader starts consuming, so that the storage isn't hit at full concurrency
+// right away. The warm-up applies once per start of the PartitionReader.
+//
+// The concurrencyWarmUp is shared by all the pusherConsumer instances of a PartitionReader, each of which picks the
+// concurrency when it's created. A nil *concurrencyWarmUp is a no-op.
+type concurrencyWarmUp struct {
+	duration time.Duration
+	// startedAt is the time the warm-up has begun in Unix nanoseconds, or 0 if it hasn't begun yet.
+	startedAt atomic.Int64
+	now       func() time.Time
+
+	currentConcurrency prometheus.Gauge
+}
+
+// newConcurrencyWarmUp returns a concurrencyWarmUp, or nil if the duration is 0 and the warm-up is disabled.
+func newConcurrencyWarmUp(duration time.Duration, partitionID int32, reg prometheus.Registerer) *concurrencyWarmUp {
+	if duration <= 0 {
+		return nil
+	}
+	return &concurrencyWarmUp{
+		duration: duration,
+		now:      time.Now,
+		currentConcurrency: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name:        "cortex_ingest_storage_reader_warm_up_ingestion_concurrency",
+			Help:        "The maximum ingestion concurrency allowed by the warm-up of the partition reader. It reaches the configured maximum once the warm-up has completed.",
+			ConstLabels: prometheus.Labels{"partition": strconv.Itoa(int(partitionID))},
+		}),
+	}
+}
+
+// begin starts the warm-up.
+func (w *concurrencyWarmUp) begin() {
+	if w == nil {
+		return
+	}
+	w.startedAt.Store(w.now().UnixNano())
+	w.currentConcurrency.Set(1)
+}
+
+// concurrency returns the ingestion concurrency allowed at this point of the warm-up, given the configured maximum.
+// The maximum is returned if the warm-up hasn't begun or once it's completed.
+func (w *concurrencyWarmUp) concurrency(maxConcurrency int) int {
+	if w == nil || maxConcurrency <= 1 {
+		return maxConcurrency
+	}
+
+	startedAt := w.startedAt.Load()
+	if startedAt == 0 {
+		return maxConcurrency
+	}
+
+	elapsed := w.now().Sub(time.Unix(0, startedAt))
+	concurrency := maxConcurrency
+	if elapsed < w.duration {
+		concurrency = 1 + int(float64(maxConcurrency-1)*float64(elapsed)/float64(w.duration))
+	}
+	w.currentConcurrency.Set(float64(concurrency))
+	return concurrency
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestConcurrencyWarmUp(t *testing.T) {
+	t.Run("should be a no-op if disabled", func(t *testing.T) {
+		w := newConcurrencyWarmUp(0, 1, prometheus.NewPedanticRegistry())
+		require.Nil(t, w)
+
+		w.begin()
+		assert.Equal(t, 10, w.concurrency(10))
+	})
+
+	t.Run("should ramp the concurrency up once begun", func(t *testing.T) {
+		reg := prometheus.NewPedanticRegistry()
+		now := time.Now()
+		w := newConcurrencyWarmUp(time.Minute, 1, reg)
+		w.now = func() time.Time { return now }
+
+		// The warm-up only applies once the reader has started.
+		assert.Equal(t, 10, w.concurrency(10))
+
+		w.begin()
+		assert.Equal(t, 1, w.concurrency(10))
+		assert.Equal(t, 1, w.concurrency(1))
+		assert.Equal(t, 0, w.concurrency(0))
+
+		now = now.Add(30 * time.Second)
+		assert.Equal(t, 5, w.concurrency(10))
+
+		now = now.Add(29 * time.Second)
+		assert.Equal(t, 9, w.concurrency(10))
+
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_ingest_storage_reader_warm_up_ingestion_concurrency The maximum ingestion concurrency allowed by the warm-up of the partition reader. It reaches the configured maximum once the warm-up has completed.
+			# TYPE cortex_ingest_storage_reader_warm_up_ingestion_concurrency gauge
+			cortex_ingest_storage_reader_warm_up_ingestion_concurrency{partition="1"} 9
+		`), "cortex_ingest_storage_reader_warm_up_ingestion_concurrency"))
+
+		now = now.Add(time.Second)
+		assert.Equal(t, 10, w.concurrency(10))
+		now = now.Add(time.Hour)
+		assert.Equal(t, 10, w.concurrency(10))
+	})
+
+	t.Run("should limit the concurrency of the consumer", func(t *testing.T) {
+		now := time.Now()
+		w := newConcurrencyWarmUp(time.Minute, 1, prometheus.NewPedanticRegistry())
+		w.now = func() time.Time { return now }
+		w.begin()
+
+		cfg := KafkaConfig{IngestionConcurrencyMax: 4}
+		c := newPusherConsumer(nil, cfg, validation.MockDefaultOverrides(), newPusherConsumerMetrics(prometheus.NewPedanticRegistry()), log.NewNopLogger(), withConcurrencyWarmUp(w))
+		assert.Equal(t, 1, c.ingestionConcurrency())
+
+		now = now.Add(time.Minute)
+		assert.Equal(t, 4, c.ingestionConcurrency())
+	})
+}
@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// The reasons a windowMergingPusher flushes the accumulated write requests.
+const (
+	windowFlushReasonWindow   = "window"
+	windowFlushReasonMaxBytes = "max_bytes"
+	windowFlushReasonShutdown = "shutdown"
+)
+
+// windowMergingPusher is a Pusher middleware which accumulates the write requests of each tenant across the consumes,
+// and pushes them to the upstream Pusher merged in a single request per tenant once per window, instead of once per
+// consumed batch of records, to amortize the overhead of the pushes of the high-frequency producers. The accumulated
+// write requests are flushed early once their size exceeds the maximum, and on shutdown.
+//
+// The write requests are acknowledged as soon as they're accumulated, so the errors of the merged requests can't be
+// attributed to the records anymore: the merged requests failing with a server error are kept, to be pushed again with
+// the next flush, and the accumulation fails once they exceed the maximum size, so that the consumption is retried.
+// The merged requests rejected with a client error are dropped, like the sequential pushes do, because they'd be
+// rejected again with every flush. The offsets of
+// the consumed records are held back until the requests accumulated until then have been flushed, so that the records
+// are consumed again if the process crashes before.
+//
+// The windowMergingPusher is shared by all the pusherConsumer instances of a PartitionReader, which starts and stops it.
+type windowMergingPusher struct {
+	services.Service
+
+	upstream Pusher
+	maxBytes int
+	logger   log.Logger
+
+	mx      sync.Mutex
+	pending map[windowMergeKey]*windowMergedRequest
+	order   []windowMergeKey
+	bytes   int
+	// offset is the offset of the last record consumed, to commit once the requests accumulated until then have been
+	// flushed, or -1 if there's none.
+	offset int64
+
+	// commitOffset enqueues the offset to be committed. It's set by the PartitionReader before starting.
+	commitOffset func(offset int64)
+
+	// flushMx serializes the flushes, so that the merged requests of a tenant are pushed in order.
+	flushMx sync.Mutex
+
+	accumulatedBytes prometheus.Gauge
+	flushes          *prometheus.CounterVec
+	flushFailures    prometheus.Counter
+	rejected         prometheus.Counter
+}
+
+// windowMergeKey groups the write requests which can be merged in the same request.
+type windowMergeKey struct {
+	tenantID            string
+	source              mimirpb.WriteRequest_SourceEnum
+	skipLabelValidation bool
+}
+
+type windowMergedRequest struct {
+	// ctx is the context of the first request merged, without its cancellation.
+	ctx context.Context
+	req *mimirpb.WriteRequest
+}
+
+func newWindowMergingPusher(upstream Pusher, cfg KafkaConfig, reg prometheus.Registerer, logger log.Logger) *windowMergingPusher {
+	p := &windowMergingPusher{
+		upstream: upstream,
+		maxBytes: cfg.IngestionMergeMaxBytes,
+		logger:   logger,
+		pending:  map[windowMergeKey]*windowMergedRequest{},
+		offset:   -1,
+		accumulatedBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_ingest_storage_reader_merge_window_accumulated_bytes",
+			Help: "Size of the write requests read from Kafka which have been accumulated to be pushed merged at the end of the merge window.",
+		}),
+		flushes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_merge_window_flushes_total",
+			Help: "Number of times the write requests accumulated during the merge window have been pushed, by the reason of the flush.",
+		}, []string{"reason"}),
+		flushFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_merge_window_failed_requests_total",
+			Help: "Number of merged write requests which failed to be pushed, and are kept to be pushed again with the next flush.",
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_merge_window_rejected_requests_total",
+			Help: "Number of merged write requests which have been rejected with a client error, and dropped.",
+		}),
+	}
+	for _, reason := range []string{windowFlushReasonWindow, windowFlushReasonMaxBytes, windowFlushReasonShutdown} {
+		p.flushes.WithLabelValues(reason)
+	}
+
+	p.Service = services.NewTimerService(cfg.IngestionMergeWindow, nil, p.iteration, p.stopping)
+	return p
+}
+
+func (p *windowMergingPusher) iteration(context.Context) error {
+	// The failed requests are pushed again with the next flush.
+	_ = p.flush(windowFlushReasonWindow)
+	return nil
+}
+
+func (p *windowMergingPusher) stopping(error) error {
+	// The offsets of the records whose requests fail to be pushed aren't committed, so they're consumed again once
+	// restarted.
+	_ = p.flush(windowFlushReasonShutdown)
+	return nil
+}
+
+// consumed holds back the commit of the offset of the last record consumed, until the requests accumulated until then
+// have been flushed.
+func (p *windowMergingPusher) consumed(offset int64) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.offset = offset
+}
+
+// PushToStorage implements the Pusher interface. It accumulates the request, after flushing the accumulated requests
+// if the request would exceed the maximum size. It fails if the tenant is missing, or if the flush fails, in which
+// case the request isn't accumulated.
+func (p *windowMergingPusher) PushToStorage(ctx context.Context, req *mimirpb.WriteRequest) error {
+	tenantID, err := user.ExtractOrgID(ctx)
+	if err != nil {
+		return err
+	}
+
+	size := req.Size()
+	p.mx.Lock()
+	full := p.bytes > 0 && p.bytes+size > p.maxBytes
+	p.mx.Unlock()
+	if full {
+		if err := p.flush(windowFlushReasonMaxBytes); err != nil {
+			return err
+		}
+	}
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	key := windowMergeKey{tenantID: tenantID, source: req.Source, skipLabelValidation: req.SkipLabelValidation}
+	merged, ok := p.pending[key]
+	if !ok {
+		merged = &windowMergedRequest{
+			ctx: context.WithoutCancel(ctx),
+			req: &mimirpb.WriteRequest{Source: req.Source, SkipLabelValidation: req.SkipLabelValidation},
+		}
+		p.pending[key] = merged
+		p.order = append(p.order, key)
+	}
+	merged.req.Timeseries = append(merged.req.Timeseries, req.Timeseries...)
+	merged.req.Metadata = append(merged.req.Metadata, req.Metadata...)
+
+	p.bytes += size
+	p.accumulatedBytes.Set(float64(p.bytes))
+	return nil
+}
+
+// flush pushes the accumulated requests, in the order their tenants have been first accumulated in, and commits the
+// offset of the last record consumed before if they've all been pushed or rejected. The requests failing to be pushed
+// with a server error are kept to be pushed again with the next flush, and the error of the first one is returned.
+func (p *windowMergingPusher) flush(reason string) error {
+	p.flushMx.Lock()
+	defer p.flushMx.Unlock()
+
+	p.mx.Lock()
+	pending, order, offset := p.pending, p.order, p.offset
+	p.pending, p.order, p.bytes = map[windowMergeKey]*windowMergedRequest{}, nil, 0
+	p.accumulatedBytes.Set(0)
+	p.mx.Unlock()
+
+	if len(order) > 0 {
+		p.flushes.WithLabelValues(reason).Inc()
+	}
+
+	var (
+		firstErr error
+		failed   []windowMergeKey
+	)
+	for _, key := range order {
+		merged := pending[key]
+		err := p.upstream.PushToStorage(merged.ctx, cloneWriteRequest(merged.req))
+		if err != nil && mimirpb.IsClientError(err) {
+			p.rejected.Inc()
+			level.Warn(p.logger).Log("msg", "the write requests merged during the merge window have been rejected; skipping them", "user", key.tenantID, "reason", reason, "err", err)
+			continue
+		}
+		if err != nil {
+			p.flushFailures.Inc()
+			level.Warn(p.logger).Log("msg", "failed to push the write requests merged during the merge window; pushing them again with the next flush", "user", key.tenantID, "reason", reason, "err", err)
+			failed = append(failed, key)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("pushing the write requests merged during the merge window for tenant %s: %w", key.tenantID, err)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		p.requeue(pending, failed)
+		return firstErr
+	}
+
+	if offset >= 0 && p.commitOffset != nil {
+		p.commitOffset(offset)
+	}
+	return nil
+}
+
+// requeue accumulates the failed requests again, ahead of the requests accumulated since they've been flushed.
+func (p *windowMergingPusher) requeue(pending map[windowMergeKey]*windowMergedRequest, failed []windowMergeKey) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	order := slices.Clone(failed)
+	for _, key := range failed {
+		merged := pending[key]
+		p.bytes += merged.req.Size()
+		if next, ok := p.pending[key]; ok {
+			merged.req.Timeseries = append(merged.req.Timeseries, next.req.Timeseries...)
+			merged.req.Metadata = append(merged.req.Metadata, next.req.Metadata...)
+		}
+		p.pending[key] = merged
+	}
+	for _, key := range p.order {
+		if !slices.Contains(failed, key) {
+			order = append(order, key)
+		}
+	}
+	p.order = order
+	p.accumulatedBytes.Set(float64(p.bytes))
+}
+
+// cloneWriteRequest returns a deep copy of the series of req, because the upstream Pusher may free the series of the
+// request it pushes even if the push fails, while the failed requests are kept to be pushed again.
+func cloneWriteRequest(req *mimirpb.WriteRequest) *mimirpb.WriteRequest {
+	clone := &mimirpb.WriteRequest{Source: req.Source, SkipLabelValidation: req.SkipLabelValidation, Metadata: req.Metadata}
+	clone.Timeseries = mimirpb.PreallocTimeseriesSliceFromPool()
+	for _, ts := range req.Timeseries {
+		clone.Timeseries = append(clone.Timeseries, mimirpb.DeepCopyTimeseries(mimirpb.PreallocTimeseries{}, ts, true, true))
+	}
+	return clone
+}
@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/grafana/dskit/user"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+func TestWindowMergingPusher(t *testing.T) {
+	type pushed struct {
+		tenantID string
+		series   []string
+	}
+
+	newUpstream := func() (Pusher, func() []pushed) {
+		var (
+			mx   sync.Mutex
+			reqs []pushed
+		)
+		upstream := pusherFunc(func(ctx context.Context, req *mimirpb.WriteRequest) error {
+			tenantID, err := user.ExtractOrgID(ctx)
+			require.NoError(t, err)
+
+			p := pushed{tenantID: tenantID}
+			for _, ts := range req.Timeseries {
+				p.series = append(p.series, ts.Labels[0].Value)
+			}
+			mx.Lock()
+			defer mx.Unlock()
+			reqs = append(reqs, p)
+			if tenantID == "failing" {
+				return fmt.Errorf("failed to push")
+			}
+			return nil
+		})
+		return upstream, func() []pushed {
+			mx.Lock()
+			defer mx.Unlock()
+			return reqs
+		}
+	}
+
+	push := func(t *testing.T, p Pusher, tenantID string, series string) {
+		req := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries(series)}}
+		require.NoError(t, p.PushToStorage(user.InjectOrgID(context.Background(), tenantID), req))
+	}
+
+	t.Run("should push the requests of each tenant merged at the end of the window", func(t *testing.T) {
+		upstream, pushedReqs := newUpstream()
+		reg := prometheus.NewPedanticRegistry()
+		p := newWindowMergingPusher(upstream, KafkaConfig{IngestionMergeWindow: 100 * time.Millisecond, IngestionMergeMaxBytes: 1024 * 1024}, reg, log.NewNopLogger())
+		require.NoError(t, services.StartAndAwaitRunning(context.Background(), p))
+		t.Cleanup(func() { require.NoError(t, services.StopAndAwaitTerminated(context.Background(), p)) })
+
+		push(t, p, "user-1", "series_1")
+		push(t, p, "user-2", "series_2")
+		push(t, p, "user-1", "series_3")
+		assert.Greater(t, testutil.ToFloat64(p.accumulatedBytes), float64(0))
+
+		require.Eventually(t, func() bool { return len(pushedReqs()) == 2 }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []pushed{
+			{tenantID: "user-1", series: []string{"series_1", "series_3"}},
+			{tenantID: "user-2", series: []string{"series_2"}},
+		}, pushedReqs())
+		assert.Equal(t, float64(0), testutil.ToFloat64(p.accumulatedBytes))
+		assert.Equal(t, float64(1), testutil.ToFloat64(p.flushes.WithLabelValues(windowFlushReasonWindow)))
+	})
+
+	t.Run("should push the accumulated requests once the maximum size would be exceeded", func(t *testing.T) {
+		upstream, pushedReqs := newUpstream()
+		size := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Size()
+		p := newWindowMergingPusher(upstream, KafkaConfig{IngestionMergeWindow: time.Hour, IngestionMergeMaxBytes: 2 * size}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+
+		push(t, p, "user-1", "series_1")
+		push(t, p, "user-1", "series_2")
+		assert.Empty(t, pushedReqs())
+
+		push(t, p, "user-1", "series_3")
+		assert.Equal(t, []pushed{{tenantID: "user-1", series: []string{"series_1", "series_2"}}}, pushedReqs())
+		assert.Equal(t, float64(1), testutil.ToFloat64(p.flushes.WithLabelValues(windowFlushReasonMaxBytes)))
+	})
+
+	t.Run("should push the accumulated requests on shutdown and count the failed ones", func(t *testing.T) {
+		upstream, pushedReqs := newUpstream()
+		p := newWindowMergingPusher(upstream, KafkaConfig{IngestionMergeWindow: time.Hour, IngestionMergeMaxBytes: 1024 * 1024}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+		var committed []int64
+		p.commitOffset = func(offset int64) { committed = append(committed, offset) }
+		require.NoError(t, services.StartAndAwaitRunning(context.Background(), p))
+
+		push(t, p, "failing", "series_1")
+		push(t, p, "user-1", "series_2")
+		p.consumed(10)
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), p))
+
+		assert.Equal(t, []pushed{
+			{tenantID: "failing", series: []string{"series_1"}},
+			{tenantID: "user-1", series: []string{"series_2"}},
+		}, pushedReqs())
+		assert.Equal(t, float64(1), testutil.ToFloat64(p.flushes.WithLabelValues(windowFlushReasonShutdown)))
+		assert.Equal(t, float64(1), testutil.ToFloat64(p.flushFailures))
+		// The records whose requests failed are consumed again once restarted.
+		assert.Empty(t, committed)
+	})
+
+	t.Run("should commit the offsets once the requests accumulated until then have been pushed", func(t *testing.T) {
+		var fail atomic.Bool
+		fail.Store(true)
+		var pushedSeries []string
+		upstream := pusherFunc(func(_ context.Context, req *mimirpb.WriteRequest) error {
+			for _, ts := range req.Timeseries {
+				// The labels are copied, because they're freed too.
+				pushedSeries = append(pushedSeries, strings.Clone(ts.Labels[0].Value))
+			}
+			// The upstream Pusher frees the series of the request, even if it fails.
+			mimirpb.ReuseSlice(req.Timeseries)
+			if fail.Load() {
+				return fmt.Errorf("failed to push")
+			}
+			return nil
+		})
+		size := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Size()
+		p := newWindowMergingPusher(upstream, KafkaConfig{IngestionMergeWindow: time.Hour, IngestionMergeMaxBytes: 2 * size}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+		var committed []int64
+		p.commitOffset = func(offset int64) { committed = append(committed, offset) }
+
+		push(t, p, "user-1", "series_1")
+		p.consumed(10)
+		push(t, p, "user-1", "series_2")
+		p.consumed(11)
+
+		// The flush fails, so the request isn't accumulated and the failed requests are kept.
+		ctx := user.InjectOrgID(context.Background(), "user-1")
+		err := p.PushToStorage(ctx, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}})
+		require.ErrorContains(t, err, "failed to push")
+		assert.Empty(t, committed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(p.flushFailures))
+		assert.Equal(t, float64(2*size), testutil.ToFloat64(p.accumulatedBytes))
+
+		fail.Store(false)
+		require.NoError(t, p.PushToStorage(ctx, &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_3")}}))
+		assert.Equal(t, []int64{11}, committed)
+		assert.Equal(t, []string{"series_1", "series_2", "series_1", "series_2"}, pushedSeries)
+
+		// The offset of the records accumulated since is committed with the next flush.
+		p.consumed(12)
+		require.NoError(t, p.flush(windowFlushReasonWindow))
+		assert.Equal(t, []int64{11, 12}, committed)
+		assert.Equal(t, []string{"series_1", "series_2", "series_1", "series_2", "series_3"}, pushedSeries)
+	})
+
+	t.Run("should drop the requests rejected with a client error and commit the offsets", func(t *testing.T) {
+		pushes := 0
+		upstream := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error {
+			pushes++
+			return ingesterError(mimirpb.BAD_DATA, codes.InvalidArgument, "out of order sample")
+		})
+		p := newWindowMergingPusher(upstream, KafkaConfig{IngestionMergeWindow: time.Hour, IngestionMergeMaxBytes: 1024 * 1024}, prometheus.NewPedanticRegistry(), log.NewNopLogger())
+		var committed []int64
+		p.commitOffset = func(offset int64) { committed = append(committed, offset) }
+
+		push(t, p, "user-1", "series_1")
+		p.consumed(10)
+		require.NoError(t, p.flush(windowFlushReasonWindow))
+		assert.Equal(t, []int64{10}, committed)
+		assert.Equal(t, float64(1), testutil.ToFloat64(p.rejected))
+		assert.Equal(t, float64(0), testutil.ToFloat64(p.flushFailures))
+		assert.Equal(t, float64(0), testutil.ToFloat64(p.accumulatedBytes))
+
+		// The rejected requests aren't pushed again.
+		require.NoError(t, p.flush(windowFlushReasonWindow))
+		assert.Equal(t, 1, pushes)
+	})
+}
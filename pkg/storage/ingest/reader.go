@@ -44,6 +44,7 @@ var (
 	errWaitStrongReadConsistencyTimeoutExceeded = errors.Wrap(context.DeadlineExceeded, "wait strong read consistency timeout exceeded")
 	errWaitTargetLagDeadlineExceeded            = errors.Wrap(context.DeadlineExceeded, "target lag deadline exceeded")
 	errUnknownPartitionLeader                   = fmt.Errorf("unknown partition leader")
+	errMergeWindowWithRawPusher                 = fmt.Errorf("the ingestion merge window can't be enabled with a pusher pushing the records without decoding them, because the merge window needs the decoded write requests")
 )
 
 type record struct {
@@ -51,6 +52,19 @@ type record struct {
 	ctx      context.Context
 	tenantID string
 	content  []byte
+	offset   int64
+	// timestamp is the Kafka timestamp of the record. It may be zero if unknown.
+	timestamp time.Time
+	// err is set if the record couldn't be split from the batch of records it's been written in.
+	err error
+	// idempotencyToken is the value of the IdempotencyTokenHeader of the record, if any.
+	idempotencyToken string
+	// deferred is set if the record has been left to a later consume because of the maximum number of tenants per
+	// consume, in which case the records of the other tenants are missing between it and the previous record.
+	deferred bool
+	// consumedBatchEntries is the number of entries of the batch held by the record which have already been consumed,
+	// if a previous consume has stopped while splitting it. They're skipped when the batch is split again.
+	consumedBatchEntries int
 }
 
 type recordConsumer interface {
@@ -60,6 +74,17 @@ type recordConsumer interface {
 	Consume(context.Context, []record) error
 }
 
+// lastProcessedOffsetConsumer is implemented by the recordConsumer which reports the highest offset up to which the
+// records have been processed, so that the progress of a consumption which fails can be committed too.
+type lastProcessedOffsetConsumer interface {
+	ConsumeWithLastProcessedOffset(context.Context, []record) (int64, error)
+}
+
+// canaryConsumer is implemented by the recordConsumer which can push a canary record on its own.
+type canaryConsumer interface {
+	ConsumeCanary(context.Context, []record) (RecordResult, error)
+}
+
 type consumerFactory interface {
 	consumer() recordConsumer
 }
@@ -85,6 +110,50 @@ type PartitionReader struct {
 	newConsumer consumerFactory
 	metrics     readerMetrics
 
+	// consumerMetrics is set only when the PartitionReader pushes the records to a Pusher.
+	consumerMetrics *pusherConsumerMetrics
+
+	// pusherConsumerOpts are the options of the consumers created by NewPartitionReaderForPusher.
+	pusherConsumerOpts []PusherConsumerOption
+
+	// processingTimeHistogramCfg configures the processing time histogram of the consumers created by NewPartitionReaderForPusher.
+	processingTimeHistogramCfg ProcessingTimeHistogramConfig
+
+	// poisonPolicy decides what to do with a batch of records which keeps failing to be consumed.
+	poisonPolicy PoisonPolicy
+
+	// failedRecordExporter, if not nil, exports the records which failed to be consumed through failedRecordExports.
+	failedRecordExporter FailedRecordExporter
+	failedRecordExports  *failedRecordExports
+
+	// recordRepublisher, if not nil, republishes the records the ErrorPolicy of the consumers decides to republish.
+	recordRepublisher RecordRepublisher
+
+	// lagTracker is set only when the PartitionReader pushes the records to a Pusher.
+	lagTracker *consumerLagTracker
+
+	// pushingTenant is set only when the PartitionReader pushes the records to a Pusher.
+	pushingTenant *pushingTenantTracker
+
+	// warmUp is set only when the PartitionReader pushes the records to a Pusher and the warm-up is enabled.
+	warmUp *concurrencyWarmUp
+
+	// concurrency is set only when the PartitionReader pushes the records to a Pusher. exemplarLimiter is set only
+	// when the PartitionReader pushes the records to a Pusher and the rate of the exemplars is limited.
+	concurrency     *concurrencyControl
+	exemplarLimiter *exemplarRateLimiter
+
+	// healthTracker is set only when the PartitionReader pushes the records to a Pusher and the health check is enabled.
+	healthTracker *healthTrackingPusher
+	// windowMerger is set only when the PartitionReader pushes the records to a Pusher and the merge window is enabled.
+	windowMerger *windowMergingPusher
+
+	// eventPublisher, if not nil, publishes the ingestion events of the consumed records through ingestionEvents,
+	// which is set only when the PartitionReader pushes the records to a Pusher.
+	eventPublisher  EventPublisher
+	eventBufferSize int
+	ingestionEvents *ingestionEvents
+
 	committer *partitionCommitter
 
 	// consumedOffsetWatcher is used to wait until a given offset has been consumed.
@@ -96,15 +165,104 @@ type PartitionReader struct {
 	reg    prometheus.Registerer
 }
 
-func NewPartitionReaderForPusher(kafkaCfg KafkaConfig, partitionID int32, instanceID string, pusher Pusher, logger log.Logger, reg prometheus.Registerer) (*PartitionReader, error) {
-	metrics := newPusherConsumerMetrics(reg)
+// PartitionReaderOption customizes a PartitionReader.
+type PartitionReaderOption func(*PartitionReader)
+
+// WithPusherConsumerOptions configures the options of the consumers pushing the records to the storage.
+// It's only honored by the PartitionReader created with NewPartitionReaderForPusher.
+func WithPusherConsumerOptions(opts ...PusherConsumerOption) PartitionReaderOption {
+	return func(r *PartitionReader) {
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, opts...)
+	}
+}
+
+// WithPoisonPolicy configures the PoisonPolicy consulted when a batch of records keeps failing to be consumed.
+func WithPoisonPolicy(policy PoisonPolicy) PartitionReaderOption {
+	return func(r *PartitionReader) {
+		r.poisonPolicy = policy
+	}
+}
+
+// WithProcessingTimeHistogram configures the native histogram tracking the time taken to process a batch of records.
+// It's only honored by the PartitionReader created with NewPartitionReaderForPusher.
+func WithProcessingTimeHistogram(cfg ProcessingTimeHistogramConfig) PartitionReaderOption {
+	return func(r *PartitionReader) {
+		r.processingTimeHistogramCfg = cfg
+	}
+}
+
+func NewPartitionReaderForPusher(kafkaCfg KafkaConfig, partitionID int32, instanceID string, pusher Pusher, limits TenantLimits, logger log.Logger, reg prometheus.Registerer, opts ...PartitionReaderOption) (*PartitionReader, error) {
+	if _, ok := pusher.(RawPusher); ok && kafkaCfg.IngestionMergeWindow > 0 {
+		return nil, errMergeWindowWithRawPusher
+	}
+
+	// The middlewares forward the raw pushes, so that they don't disable pushing the records without decoding them.
+	if kafkaCfg.InjectedPushLatency > 0 {
+		// The config may not have been validated, so the latency is only injected by the binaries allowing it.
+		if !pushLatencyInjectionAllowed {
+			return nil, ErrPushLatencyInjectionNotAllowed
+		}
+		pusher = withRawForwarding(newLatencyInjectingPusher(pusher, kafkaCfg.InjectedPushLatency, kafkaCfg.InjectedPushLatencyTenants), pusher)
+	}
+	if kafkaCfg.TenantCircuitBreakerEnabled {
+		pusher = withRawForwarding(newTenantCircuitBreakerPusher(pusher, kafkaCfg, reg, logger), pusher)
+	}
+	var healthTracker *healthTrackingPusher
+	if kafkaCfg.ServerErrorRatioHealthThreshold > 0 {
+		healthTracker = newHealthTrackingPusher(pusher, kafkaCfg.ServerErrorRatioHealthThreshold, kafkaCfg.ServerErrorRatioHealthWindow, reg)
+		pusher = withRawForwarding(healthTracker, pusher)
+	}
+	var windowMerger *windowMergingPusher
+	if kafkaCfg.IngestionMergeWindow > 0 {
+		windowMerger = newWindowMergingPusher(pusher, kafkaCfg, reg, logger)
+		pusher = windowMerger
+	}
+	lagTracker := newConsumerLagTracker(partitionID, reg)
+	warmUp := newConcurrencyWarmUp(kafkaCfg.IngestionConcurrencyWarmUpDuration, partitionID, reg)
+	// The reader is referenced by the factory to get the consumer options and metrics, which are known once the reader has been created.
+	var r *PartitionReader
 	factory := consumerFactoryFunc(func() recordConsumer {
-		return newPusherConsumer(pusher, kafkaCfg, metrics, logger)
+		return newPusherConsumer(pusher, kafkaCfg, limits, r.consumerMetrics, logger, r.pusherConsumerOpts...)
 	})
-	return newPartitionReader(kafkaCfg, partitionID, instanceID, factory, logger, reg)
+	r, err := newPartitionReader(kafkaCfg, partitionID, instanceID, factory, logger, reg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r.consumerMetrics = newPusherConsumerMetricsWithHistogramConfig(reg, r.processingTimeHistogramCfg)
+	r.lagTracker = lagTracker
+	r.pushingTenant = newPushingTenantTracker()
+	r.warmUp = warmUp
+	r.pusherConsumerOpts = append(r.pusherConsumerOpts, withConsumerLagTracker(lagTracker), withPushingTenantTracker(r.pushingTenant), withConcurrencyWarmUp(warmUp), withConsecutiveSkipsTracker(newConsecutiveSkipsTracker(kafkaCfg.MaxConsecutiveSkips, r.consumerMetrics, logger)), withAbandonedDecodes(newAbandonedDecodes(kafkaCfg.IngestionDecodeTimeoutMaxAbandoned, r.consumerMetrics.abandonedDecodes)), withMetricDenylists(newMetricDenylists(limits)), withTenantSeriesLimiter(newTenantSeriesLimiter(limits, kafkaCfg.MaxSeriesIdleTimeout)))
+	if tokens := newIdempotencyTokens(kafkaCfg.IdempotencyTokensMaxSize, kafkaCfg.IdempotencyTokensTTL); tokens != nil {
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, withIdempotencyTokens(tokens))
+	}
+	if r.failedRecordExports != nil {
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, withFailedRecordExports(r.failedRecordExports))
+	}
+	if r.recordRepublisher != nil {
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, withRecordRepublisher(r.recordRepublisher, partitionID))
+	}
+	if heartbeat := newConsumerHeartbeat(kafkaCfg, partitionID, pusher, r.consumerMetrics, logger); heartbeat != nil {
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, withConsumerHeartbeat(heartbeat))
+	}
+	if r.exemplarLimiter = newExemplarRateLimiter(kafkaCfg, r.consumerMetrics); r.exemplarLimiter != nil {
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, withExemplarRateLimiter(r.exemplarLimiter))
+	}
+	r.concurrency = newConcurrencyControl()
+	r.pusherConsumerOpts = append(r.pusherConsumerOpts, withConcurrencyControl(r.concurrency))
+	if r.eventPublisher != nil {
+		r.ingestionEvents = newIngestionEvents(r.eventPublisher, r.eventBufferSize, partitionID, r.logger, reg)
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, withIngestionEvents(r.ingestionEvents))
+	}
+	if profiler := newSlowConsumeProfiler(kafkaCfg, partitionID, r.consumerMetrics, logger); profiler != nil {
+		r.pusherConsumerOpts = append(r.pusherConsumerOpts, withSlowConsumeProfiler(profiler))
+	}
+	r.healthTracker = healthTracker
+	r.windowMerger = windowMerger
+	return r, nil
 }
 
-func newPartitionReader(kafkaCfg KafkaConfig, partitionID int32, instanceID string, consumer consumerFactory, logger log.Logger, reg prometheus.Registerer) (*PartitionReader, error) {
+func newPartitionReader(kafkaCfg KafkaConfig, partitionID int32, instanceID string, consumer consumerFactory, logger log.Logger, reg prometheus.Registerer, opts ...PartitionReaderOption) (*PartitionReader, error) {
 	r := &PartitionReader{
 		kafkaCfg:                              kafkaCfg,
 		partitionID:                           partitionID,
@@ -115,12 +273,87 @@ func newPartitionReader(kafkaCfg KafkaConfig, partitionID int32, instanceID stri
 		concurrentFetchersMinBytesMaxWaitTime: defaultMinBytesMaxWaitTime,
 		logger:                                log.With(logger, "partition", partitionID),
 		reg:                                   reg,
+		poisonPolicy:                          abortPoisonPolicy,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.failedRecordExporter != nil {
+		r.failedRecordExports = newFailedRecordExports(r.failedRecordExporter, partitionID, r.logger, reg)
 	}
 
 	r.Service = services.NewBasicService(r.start, r.run, r.stop)
 	return r, nil
 }
 
+// ConsumerMetricsSnapshot returns a snapshot of the metrics of the records pushed to the storage, which is cheap to read
+// and can be used by health endpoints. It returns an empty snapshot if the PartitionReader doesn't push to a Pusher.
+func (r *PartitionReader) ConsumerMetricsSnapshot() ConsumerMetricsSnapshot {
+	if r.consumerMetrics == nil {
+		return ConsumerMetricsSnapshot{}
+	}
+	return r.consumerMetrics.snapshot()
+}
+
+// SetIngestionConcurrency changes the maximum ingestion concurrency of the consumers at runtime, like
+// pusherConsumer.SetConcurrency. It returns an error if the concurrency is invalid, or if the PartitionReader doesn't
+// push to a Pusher or pushes the records sequentially.
+func (r *PartitionReader) SetIngestionConcurrency(n int) error {
+	if r.concurrency == nil {
+		return errIngestionNotTunable
+	}
+	if err := r.concurrency.setChecked(r.kafkaCfg, n); err != nil {
+		return err
+	}
+	level.Info(r.logger).Log("msg", "changed the ingestion concurrency", "concurrency", n)
+	return nil
+}
+
+// SetIngestionMaxExemplarsPerSecond changes the maximum rate of the exemplars pushed by the consumers at runtime, like
+// pusherConsumer.SetMaxExemplarsPerSecond. It returns an error if the rate is invalid, or if the PartitionReader
+// doesn't push to a Pusher or doesn't limit the rate of the exemplars.
+func (r *PartitionReader) SetIngestionMaxExemplarsPerSecond(limit float64) error {
+	if r.concurrency == nil {
+		return errIngestionNotTunable
+	}
+	if err := r.exemplarLimiter.setLimit(limit); err != nil {
+		return err
+	}
+	level.Info(r.logger).Log("msg", "changed the maximum rate of the exemplars", "limit", limit)
+	return nil
+}
+
+// PushingTenant returns the tenant of the record being pushed to the storage, or "idle" if none, for example to spot a
+// stuck tenant from a debug endpoint. When several records are pushed at once, it's the tenant of the last record whose
+// push has started. It always returns "idle" if the PartitionReader doesn't push to a Pusher.
+func (r *PartitionReader) PushingTenant() string {
+	return r.pushingTenant.get()
+}
+
+// ProbeCanary pushes a canary record holding the write request content, optionally compressed like the records read
+// from Kafka, for the canary tenant configured with -ingest-storage.kafka.canary-tenant, with the same code path as
+// the records read from Kafka. It returns the result of the canary record once it's been pushed, so that readiness
+// checks can verify that the records can be pushed to the storage end to end. The canary record isn't written to Kafka,
+// and pushing it doesn't affect the consumption of the partition.
+func (r *PartitionReader) ProbeCanary(ctx context.Context, content []byte) (RecordResult, error) {
+	consumer, ok := r.newConsumer.consumer().(canaryConsumer)
+	if !ok {
+		return RecordResult{}, errCanaryNotPushed
+	}
+
+	// The canary record has no offset, so that it's never considered as the latest processed record.
+	return consumer.ConsumeCanary(ctx, []record{{ctx: ctx, tenantID: r.kafkaCfg.CanaryTenant, content: content, offset: -1}})
+}
+
+// CheckHealth returns an error if the ratio of server errors among the most recent pushes to the storage exceeds
+// the configured threshold. It always returns nil if the health check is disabled.
+func (r *PartitionReader) CheckHealth() error {
+	if r.healthTracker == nil {
+		return nil
+	}
+	return r.healthTracker.checkHealth()
+}
+
 // Stop implements fetcher
 func (r *PartitionReader) Stop() {
 	// Given the partition reader has no concurrency it doesn't support stopping anything.
@@ -186,6 +419,20 @@ func (r *PartitionReader) start(ctx context.Context) (returnErr error) {
 		return errors.Wrap(err, "starting service manager")
 	}
 
+	if r.windowMerger != nil {
+		// The offsets of the consumed records are committed once the requests accumulated until then have been flushed.
+		r.windowMerger.commitOffset = r.committer.enqueueOffset
+		// The merge window is stopped with the dependencies, so it isn't stopped when ctx is cancelled either.
+		if err := services.StartAndAwaitRunning(context.Background(), r.windowMerger); err != nil {
+			return errors.Wrap(err, "starting merge window")
+		}
+	}
+	if r.ingestionEvents != nil {
+		if err := services.StartAndAwaitRunning(context.Background(), r.ingestionEvents); err != nil {
+			return errors.Wrap(err, "starting ingestion events publisher")
+		}
+	}
+
 	if r.kafkaCfg.StartupFetchConcurrency > 0 {
 		// When concurrent fetch is enabled we manually fetch from the partition so we don't want the Kafka
 		// client to buffer any record. However, we still want to configure partition consumption so that
@@ -216,6 +463,9 @@ func (r *PartitionReader) start(ctx context.Context) (returnErr error) {
 		r.fetcher = r
 	}
 
+	// The records are consumed from now on, so the warm-up begins.
+	r.warmUp.begin()
+
 	// Enforce the max consumer lag (if enabled).
 	if targetLag, maxLag := r.kafkaCfg.TargetConsumerLagAtStartup, r.kafkaCfg.MaxConsumerLagAtStartup; targetLag > 0 && maxLag > 0 {
 		if startOffset != kafkaOffsetEnd {
@@ -237,6 +487,19 @@ func (r *PartitionReader) stop(error) error {
 }
 
 func (r *PartitionReader) stopDependencies() error {
+	if r.windowMerger != nil {
+		// The accumulated write requests are flushed before the offsets are committed for the last time.
+		if err := services.StopAndAwaitTerminated(context.Background(), r.windowMerger); err != nil {
+			return errors.Wrap(err, "stopping merge window")
+		}
+	}
+	if r.ingestionEvents != nil {
+		// The buffered events are published once the consumption has stopped.
+		if err := services.StopAndAwaitTerminated(context.Background(), r.ingestionEvents); err != nil {
+			return errors.Wrap(err, "stopping ingestion events publisher")
+		}
+	}
+
 	if r.dependencies != nil {
 		if err := services.StopManagerAndAwaitStopped(context.Background(), r.dependencies); err != nil {
 			return errors.Wrap(err, "stopping service manager")
@@ -532,7 +795,17 @@ func (r *PartitionReader) enqueueCommit(fetches kgo.Fetches) {
 		}
 		lastOffset = partition.Records[len(partition.Records)-1].Offset
 	})
-	r.committer.enqueueOffset(lastOffset)
+	r.enqueueOffset(lastOffset)
+}
+
+// enqueueOffset enqueues the offset of the last record consumed to be committed. If the merge window is enabled, the
+// offset is only committed once the requests accumulated until then have been pushed.
+func (r *PartitionReader) enqueueOffset(offset int64) {
+	if r.windowMerger != nil {
+		r.windowMerger.consumed(offset)
+		return
+	}
+	r.committer.enqueueOffset(offset)
 }
 
 func (r *PartitionReader) consumeFetches(ctx context.Context, fetches kgo.Fetches) error {
@@ -554,16 +827,26 @@ func (r *PartitionReader) consumeFetches(ctx context.Context, fetches kgo.Fetche
 		records = append(records, record{
 			// This context carries the tracing data for this individual record;
 			// kotel populates this data when it fetches the messages.
-			ctx:      rec.Context,
-			tenantID: string(rec.Key),
-			content:  rec.Value,
+			ctx:              rec.Context,
+			tenantID:         string(rec.Key),
+			content:          rec.Value,
+			offset:           rec.Offset,
+			timestamp:        rec.Timestamp,
+			idempotencyToken: idempotencyToken(rec),
 		})
 	})
+	fetches.EachPartition(func(partition kgo.FetchTopicPartition) {
+		r.lagTracker.setHighWatermark(partition.HighWatermark)
+	})
 
+	maxAttempts := 0 // retry forever
+	if r.kafkaCfg.ConsumeMaxRetries > 0 {
+		maxAttempts = r.kafkaCfg.ConsumeMaxRetries + 1
+	}
 	boff := backoff.New(ctx, backoff.Config{
 		MinBackoff: 250 * time.Millisecond,
 		MaxBackoff: 2 * time.Second,
-		MaxRetries: 0, // retry forever
+		MaxRetries: maxAttempts,
 	})
 	defer func(consumeStart time.Time) {
 		r.metrics.consumeLatency.Observe(time.Since(consumeStart).Seconds())
@@ -571,6 +854,11 @@ func (r *PartitionReader) consumeFetches(ctx context.Context, fetches kgo.Fetche
 
 	logger := spanlogger.FromContext(ctx, r.logger)
 
+	// firstUnprocessed is the offset of the first record which hasn't been processed yet, according to the progress
+	// reported by the consumer.
+	firstUnprocessed := int64(minOffset)
+
+	var lastErr error
 	for boff.Ongoing() {
 		// We instantiate the consumer on each iteration because it is stateful, and we can't reuse it after closing.
 		consumer := r.newConsumer.consumer()
@@ -580,7 +868,17 @@ func (r *PartitionReader) consumeFetches(ctx context.Context, fetches kgo.Fetche
 		// There is an edge-case when the processing gets stuck and doesn't let the stopping process. In such a case,
 		// we expect the infrastructure (e.g. k8s) to eventually kill the process.
 		consumeCtx := context.WithoutCancel(ctx)
-		err := consumer.Consume(consumeCtx, records)
+		lastProcessed, err := r.consume(consumeCtx, consumer, records)
+		firstUnprocessed = max(firstUnprocessed, lastProcessed+1)
+
+		// The consumer may consume only some of the records of the batch, in which case the next consumer resumes
+		// from where it stopped, without backing off because this isn't a failure.
+		var unprocessed *unprocessedRecordsError
+		if errors.As(err, &unprocessed) {
+			records = unprocessed.ResumptionToken().resume(records)
+			continue
+		}
+
 		if err == nil {
 			level.Debug(logger).Log("msg", "closing consumer after successful consumption")
 			// The context might have been cancelled in the meantime, so we return here instead of breaking the loop and returning the context error
@@ -593,10 +891,65 @@ func (r *PartitionReader) consumeFetches(ctx context.Context, fetches kgo.Fetche
 			"record_max_offset", maxOffset,
 			"num_retries", boff.NumRetries(),
 		)
+		lastErr = err
 		boff.Wait()
 	}
-	// Because boff is set to retry forever, the only error here is when the context is cancelled.
-	return boff.ErrCause()
+	if ctx.Err() != nil || lastErr == nil {
+		return boff.ErrCause()
+	}
+
+	// We've run out of retries, so it's up to the poison policy to decide what to do with the records.
+	batch := PoisonBatch{
+		Partition: r.partitionID,
+		MinOffset: int64(minOffset),
+		MaxOffset: int64(maxOffset),
+		Attempts:  boff.NumRetries(),
+		Err:       lastErr,
+	}
+	decision := r.poisonPolicy.Decide(ctx, batch)
+	r.metrics.poisonDecisions.WithLabelValues(decision.String()).Inc()
+
+	switch decision {
+	case PoisonDecisionSkip:
+		level.Warn(logger).Log("msg", "skipping records which failed to be consumed after all retries", "err", lastErr, "record_min_offset", minOffset, "record_max_offset", maxOffset, "attempts", batch.Attempts)
+		return nil
+	case PoisonDecisionDeadLetter:
+		// The records which have been processed, and whose offsets have been enqueued to be committed by consume, aren't
+		// dead-lettered, so that they aren't reprocessed with the ones which failed.
+		var failed []FailedRecord
+		for _, rec := range records {
+			if rec.offset < firstUnprocessed {
+				continue
+			}
+			level.Error(logger).Log("msg", "dead-lettering record which failed to be consumed after all retries", "user", rec.tenantID, "record_offset", rec.offset, "record_bytes", len(rec.content))
+			if r.failedRecordExports != nil {
+				failed = append(failed, FailedRecord{Offset: rec.offset, TenantID: rec.tenantID, Timestamp: rec.timestamp, Content: rec.content, Err: lastErr})
+			}
+		}
+		r.failedRecordExports.export(ctx, failed)
+		level.Warn(logger).Log("msg", "skipping dead-lettered records", "err", lastErr, "record_min_offset", minOffset, "record_max_offset", maxOffset, "attempts", batch.Attempts)
+		return nil
+	default:
+		return fmt.Errorf("giving up consuming records after %d attempts: %w", batch.Attempts, lastErr)
+	}
+}
+
+// consume consumes the records with the consumer. If the consumer reports the last processed offset, the progress of
+// a consumption which fails is enqueued to be committed, so that the records which have been processed aren't consumed
+// again if the reader is restarted while retrying. The records are still retried as a whole. It returns the offset of
+// the last record processed by a consumption which fails, or -1 if it isn't known.
+func (r *PartitionReader) consume(ctx context.Context, consumer recordConsumer, records []record) (int64, error) {
+	offsetConsumer, ok := consumer.(lastProcessedOffsetConsumer)
+	if !ok {
+		return -1, consumer.Consume(ctx, records)
+	}
+
+	lastProcessed, err := offsetConsumer.ConsumeWithLastProcessedOffset(ctx, records)
+	if err != nil && lastProcessed >= 0 {
+		r.enqueueOffset(lastProcessed)
+		return lastProcessed, err
+	}
+	return -1, err
 }
 
 func (r *PartitionReader) notifyLastConsumedOffset(fetches kgo.Fetches) {
@@ -947,6 +1300,7 @@ type readerMetrics struct {
 	strongConsistencyInstrumentation *StrongReadConsistencyInstrumentation[struct{}]
 	lastConsumedOffset               prometheus.Gauge
 	consumeLatency                   prometheus.Histogram
+	poisonDecisions                  *prometheus.CounterVec
 	kprom                            *kprom.Metrics
 }
 
@@ -1002,6 +1356,10 @@ func newReaderMetrics(partitionID int32, reg prometheus.Registerer) readerMetric
 			Help:                        "How long a consumer spent processing a batch of records from Kafka.",
 			NativeHistogramBucketFactor: 1.1,
 		}),
+		poisonDecisions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_ingest_storage_reader_poison_batch_decisions_total",
+			Help: "Number of batches of records which failed to be consumed after all retries, by the decision taken on them.",
+		}, []string{"decision"}),
 		strongConsistencyInstrumentation: NewStrongReadConsistencyInstrumentation[struct{}](component, reg),
 		lastConsumedOffset:               lastConsumedOffset,
 		kprom:                            NewKafkaReaderClientMetrics(component, reg),
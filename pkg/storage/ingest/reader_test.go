@@ -27,8 +27,10 @@ import (
 	"github.com/twmb/franz-go/pkg/kmsg"
 	"go.uber.org/atomic"
 
+	"github.com/grafana/mimir/pkg/mimirpb"
 	mimirtest "github.com/grafana/mimir/pkg/util/test"
 	"github.com/grafana/mimir/pkg/util/testkafka"
+	"github.com/grafana/mimir/pkg/util/validation"
 )
 
 func TestKafkaStartOffset(t *testing.T) {
@@ -159,6 +161,204 @@ func TestPartitionReader_ConsumerError(t *testing.T) {
 	}
 }
 
+func TestPartitionReader_ShouldConsumeTheRecordsUnprocessedByTheConsumer(t *testing.T) {
+	t.Parallel()
+
+	const (
+		topicName   = "test"
+		partitionID = 1
+	)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	t.Cleanup(func() { cancel(errors.New("test done")) })
+
+	_, clusterAddr := testkafka.CreateCluster(t, partitionID+1, topicName)
+	writeClient := newKafkaProduceClient(t, clusterAddr)
+	for i := 1; i <= 5; i++ {
+		produceRecord(ctx, t, writeClient, topicName, partitionID, []byte(fmt.Sprint(i)))
+	}
+
+	// The consumer consumes at most 2 records at once, like the pusherConsumer with a max number of records per consume.
+	trackingConsumer := newTestConsumer(5)
+	consumer := consumerFunc(func(ctx context.Context, records []record) error {
+		if len(records) <= 2 {
+			return trackingConsumer.Consume(ctx, records)
+		}
+		if err := trackingConsumer.Consume(ctx, records[:2]); err != nil {
+			return err
+		}
+		return &unprocessedRecordsError{records: records[2:], reason: unprocessedMaxRecords}
+	})
+	createAndStartReader(ctx, t, clusterAddr, topicName, partitionID, consumer)
+
+	records, err := trackingConsumer.waitRecords(5, 5*time.Second, 0)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4"), []byte("5")}, records)
+}
+
+func TestPartitionReader_PoisonPolicy(t *testing.T) {
+	t.Parallel()
+
+	const (
+		topicName   = "test"
+		partitionID = 1
+		maxRetries  = 2
+	)
+
+	// The consumer always fails to consume the first record.
+	newConsumer := func(trackingConsumer testConsumer, invocations *atomic.Int64) recordConsumer {
+		return consumerFunc(func(ctx context.Context, records []record) error {
+			invocations.Inc()
+			if string(records[0].content) == "1" {
+				return errors.New("consumer error")
+			}
+			return trackingConsumer.Consume(ctx, records)
+		})
+	}
+
+	for _, decision := range []PoisonDecision{PoisonDecisionSkip, PoisonDecisionDeadLetter} {
+		t.Run(fmt.Sprintf("should continue consuming after the %s decision", decision), func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancelCause(context.Background())
+			t.Cleanup(func() { cancel(errors.New("test done")) })
+
+			_, clusterAddr := testkafka.CreateCluster(t, partitionID+1, topicName)
+			writeClient := newKafkaProduceClient(t, clusterAddr)
+			produceRecord(ctx, t, writeClient, topicName, partitionID, []byte("1"))
+
+			var (
+				invocations      = atomic.NewInt64(0)
+				trackingConsumer = newTestConsumer(1)
+				batches          = make(chan PoisonBatch, 1)
+				reg              = prometheus.NewPedanticRegistry()
+			)
+			policy := PoisonPolicyFunc(func(_ context.Context, batch PoisonBatch) PoisonDecision {
+				batches <- batch
+				return decision
+			})
+			createAndStartReader(ctx, t, clusterAddr, topicName, partitionID, newConsumer(trackingConsumer, invocations),
+				withConsumeMaxRetries(maxRetries), withPartitionReaderOptions(WithPoisonPolicy(policy)), withRegistry(reg))
+
+			batch := <-batches
+			assert.Equal(t, int32(partitionID), batch.Partition)
+			assert.Equal(t, int64(0), batch.MinOffset)
+			assert.Equal(t, int64(0), batch.MaxOffset)
+			assert.Equal(t, maxRetries+1, batch.Attempts)
+			assert.Equal(t, int64(maxRetries+1), invocations.Load())
+			assert.EqualError(t, batch.Err, "consumer error")
+
+			// The poisoned record has been skipped, so the next one is consumed.
+			produceRecord(ctx, t, writeClient, topicName, partitionID, []byte("2"))
+			records, err := trackingConsumer.waitRecords(1, 5*time.Second, 0)
+			require.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("2")}, records)
+
+			assert.NoError(t, promtest.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+				# HELP cortex_ingest_storage_reader_poison_batch_decisions_total Number of batches of records which failed to be consumed after all retries, by the decision taken on them.
+				# TYPE cortex_ingest_storage_reader_poison_batch_decisions_total counter
+				cortex_ingest_storage_reader_poison_batch_decisions_total{decision="%s"} 1
+			`, decision)), "cortex_ingest_storage_reader_poison_batch_decisions_total"))
+		})
+	}
+
+	t.Run("should export the dead-lettered records", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancelCause(context.Background())
+		t.Cleanup(func() { cancel(errors.New("test done")) })
+
+		_, clusterAddr := testkafka.CreateCluster(t, partitionID+1, topicName)
+		writeClient := newKafkaProduceClient(t, clusterAddr)
+		produceRecord(ctx, t, writeClient, topicName, partitionID, []byte("1"))
+
+		var (
+			invocations      = atomic.NewInt64(0)
+			trackingConsumer = newTestConsumer(1)
+			exported         = make(chan []FailedRecord, 1)
+			reg              = prometheus.NewPedanticRegistry()
+		)
+		policy := PoisonPolicyFunc(func(context.Context, PoisonBatch) PoisonDecision {
+			return PoisonDecisionDeadLetter
+		})
+		exporter := failedRecordExporterFunc(func(_ context.Context, records []FailedRecord) error {
+			exported <- slices.Clone(records)
+			return nil
+		})
+		createAndStartReader(ctx, t, clusterAddr, topicName, partitionID, newConsumer(trackingConsumer, invocations),
+			withConsumeMaxRetries(maxRetries), withPartitionReaderOptions(WithPoisonPolicy(policy), WithFailedRecordExporter(exporter)), withRegistry(reg))
+
+		records := <-exported
+		require.Len(t, records, 1)
+		assert.Equal(t, int32(partitionID), records[0].Partition)
+		assert.Equal(t, int64(0), records[0].Offset)
+		assert.Equal(t, []byte("1"), records[0].Content)
+		assert.EqualError(t, records[0].Err, "consumer error")
+
+		assert.NoError(t, promtest.GatherAndCompare(reg, strings.NewReader(`
+			# HELP cortex_ingest_storage_reader_failed_records_exported_total Number of records read from Kafka which failed to be consumed and have been exported for offline reprocessing.
+			# TYPE cortex_ingest_storage_reader_failed_records_exported_total counter
+			cortex_ingest_storage_reader_failed_records_exported_total 1
+		`), "cortex_ingest_storage_reader_failed_records_exported_total"))
+	})
+
+	t.Run("should only export the dead-lettered records which haven't been processed", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancelCause(context.Background())
+		t.Cleanup(func() { cancel(errors.New("test done")) })
+
+		_, clusterAddr := testkafka.CreateCluster(t, partitionID+1, topicName)
+		writeClient := newKafkaProduceClient(t, clusterAddr)
+		for _, content := range []string{"1", "2", "3"} {
+			produceRecord(ctx, t, writeClient, topicName, partitionID, []byte(content))
+		}
+
+		// The consumer keeps failing to consume the record "3", while the records before it are processed.
+		consumer := lastProcessedOffsetConsumerFunc(func(_ context.Context, records []record) (int64, error) {
+			lastProcessed := int64(-1)
+			for _, r := range records {
+				if string(r.content) == "3" {
+					return lastProcessed, errors.New("consumer error")
+				}
+				lastProcessed = r.offset
+			}
+			return lastProcessed, nil
+		})
+		exported := make(chan []FailedRecord, 1)
+		policy := PoisonPolicyFunc(func(context.Context, PoisonBatch) PoisonDecision {
+			return PoisonDecisionDeadLetter
+		})
+		exporter := failedRecordExporterFunc(func(_ context.Context, records []FailedRecord) error {
+			exported <- slices.Clone(records)
+			return nil
+		})
+		createAndStartReader(ctx, t, clusterAddr, topicName, partitionID, consumer,
+			withConsumeMaxRetries(maxRetries), withPartitionReaderOptions(WithPoisonPolicy(policy), WithFailedRecordExporter(exporter)))
+
+		records := <-exported
+		require.Len(t, records, 1)
+		assert.Equal(t, int64(2), records[0].Offset)
+		assert.Equal(t, []byte("3"), records[0].Content)
+	})
+
+	t.Run("should stop the reader with the abort decision", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancelCause(context.Background())
+		t.Cleanup(func() { cancel(errors.New("test done")) })
+
+		_, clusterAddr := testkafka.CreateCluster(t, partitionID+1, topicName)
+		writeClient := newKafkaProduceClient(t, clusterAddr)
+		produceRecord(ctx, t, writeClient, topicName, partitionID, []byte("1"))
+
+		invocations := atomic.NewInt64(0)
+		reader := createReader(t, clusterAddr, topicName, partitionID, newConsumer(newTestConsumer(1), invocations), withConsumeMaxRetries(maxRetries))
+		require.NoError(t, reader.StartAsync(ctx))
+
+		// The record is consumed while starting, so the reader fails before running.
+		require.Error(t, reader.AwaitTerminated(ctx))
+		require.ErrorContains(t, reader.FailureCase(), "giving up consuming records after 3 attempts: consumer error")
+		assert.Equal(t, int64(maxRetries+1), invocations.Load())
+	})
+}
+
 func TestPartitionReader_ConsumerStopping(t *testing.T) {
 	const (
 		topicName   = "test"
@@ -2234,6 +2434,7 @@ type readerTestCfg struct {
 	consumer    consumerFactory
 	registry    *prometheus.Registry
 	logger      log.Logger
+	readerOpts  []PartitionReaderOption
 }
 
 type readerTestCfgOpt func(cfg *readerTestCfg)
@@ -2288,6 +2489,18 @@ func withLogger(logger log.Logger) func(cfg *readerTestCfg) {
 	}
 }
 
+func withConsumeMaxRetries(retries int) readerTestCfgOpt {
+	return func(cfg *readerTestCfg) {
+		cfg.kafka.ConsumeMaxRetries = retries
+	}
+}
+
+func withPartitionReaderOptions(opts ...PartitionReaderOption) readerTestCfgOpt {
+	return func(cfg *readerTestCfg) {
+		cfg.readerOpts = append(cfg.readerOpts, opts...)
+	}
+}
+
 func withStartupConcurrency(i int) readerTestCfgOpt {
 	return func(cfg *readerTestCfg) {
 		cfg.kafka.StartupFetchConcurrency = i
@@ -2323,7 +2536,7 @@ func createReader(t *testing.T, addr string, topicName string, partitionID int32
 	// Ensure the config is valid.
 	require.NoError(t, cfg.kafka.Validate())
 
-	reader, err := newPartitionReader(cfg.kafka, cfg.partitionID, "test-group", cfg.consumer, cfg.logger, cfg.registry)
+	reader, err := newPartitionReader(cfg.kafka, cfg.partitionID, "test-group", cfg.consumer, cfg.logger, cfg.registry, cfg.readerOpts...)
 	require.NoError(t, err)
 
 	// Reduce the time the fake kafka would wait for new records. Sometimes this blocks startup.
@@ -2380,6 +2593,44 @@ func TestPartitionReader_Commit(t *testing.T) {
 		assert.Equal(t, [][]byte{recordsSentAfterShutdown}, records)
 	})
 
+	t.Run("commit the last processed offset of the consumes which fail", func(t *testing.T) {
+		t.Parallel()
+
+		const commitInterval = 100 * time.Millisecond
+		ctx, cancel := context.WithCancelCause(context.Background())
+		t.Cleanup(func() { cancel(errors.New("test done")) })
+
+		_, clusterAddr := testkafka.CreateCluster(t, partitionID+1, topicName)
+		writeClient := newKafkaProduceClient(t, clusterAddr)
+		for _, content := range []string{"1", "2", "3"} {
+			produceRecord(ctx, t, writeClient, topicName, partitionID, []byte(content))
+		}
+
+		// The consumer keeps failing to consume the record "3", while the records before it are processed.
+		consumer := lastProcessedOffsetConsumerFunc(func(_ context.Context, records []record) (int64, error) {
+			lastProcessed := int64(-1)
+			for _, r := range records {
+				if string(r.content) == "3" {
+					return lastProcessed, errors.New("consumer error")
+				}
+				lastProcessed = r.offset
+			}
+			return lastProcessed, nil
+		})
+
+		reg := prometheus.NewPedanticRegistry()
+		createAndStartReader(ctx, t, clusterAddr, topicName, partitionID, consumer, withCommitInterval(commitInterval),
+			withConsumeFromPositionAtStartup(consumeFromStart), withTargetAndMaxConsumerLagAtStartup(0, 0), withRegistry(reg))
+
+		test.Poll(t, 5*time.Second, nil, func() interface{} {
+			return promtest.GatherAndCompare(reg, strings.NewReader(`
+				# HELP cortex_ingest_storage_reader_last_committed_offset The last consumed offset successfully committed by the partition reader. Set to -1 if not offset has been committed yet.
+				# TYPE cortex_ingest_storage_reader_last_committed_offset gauge
+				cortex_ingest_storage_reader_last_committed_offset{partition="1"} 1
+			`), "cortex_ingest_storage_reader_last_committed_offset")
+		})
+	})
+
 	t.Run("commit at shutdown", func(t *testing.T) {
 		t.Parallel()
 
@@ -2495,6 +2746,38 @@ func (t testConsumer) waitRecords(numRecords int, waitTimeout, drainPeriod time.
 	}
 }
 
+func TestNewPartitionReaderForPusher_WithPusherConsumerOptions(t *testing.T) {
+	wr := &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}
+	pusher := pusherFunc(func(context.Context, *mimirpb.WriteRequest) error { return nil })
+
+	var decoded []string
+	onRecordDecoded := func(_ int, tenantID string, _ int, err error) {
+		assert.NoError(t, err)
+		decoded = append(decoded, tenantID)
+	}
+
+	r, err := NewPartitionReaderForPusher(createTestKafkaConfig("localhost:0", "test"), 1, "test", pusher, validation.MockDefaultOverrides(), log.NewNopLogger(), prometheus.NewPedanticRegistry(),
+		WithPusherConsumerOptions(WithOnRecordDecoded(onRecordDecoded)))
+	require.NoError(t, err)
+
+	// A consumer is created for each batch of records, and each of them is configured with the options.
+	require.NoError(t, r.newConsumer.consumer().Consume(context.Background(), []record{makeRecord(t, "user-1", wr, nil)}))
+	require.NoError(t, r.newConsumer.consumer().Consume(context.Background(), []record{makeRecord(t, "user-2", wr, nil)}))
+	assert.Equal(t, []string{"user-1", "user-2"}, decoded)
+}
+
+// lastProcessedOffsetConsumerFunc is a recordConsumer reporting the last processed offset.
+type lastProcessedOffsetConsumerFunc func(ctx context.Context, records []record) (int64, error)
+
+func (c lastProcessedOffsetConsumerFunc) Consume(ctx context.Context, records []record) error {
+	_, err := c(ctx, records)
+	return err
+}
+
+func (c lastProcessedOffsetConsumerFunc) ConsumeWithLastProcessedOffset(ctx context.Context, records []record) (int64, error) {
+	return c(ctx, records)
+}
+
 type consumerFunc func(ctx context.Context, records []record) error
 
 func (c consumerFunc) Consume(ctx context.Context, records []record) error {
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+)
+
+// SkipAction is the action taken by the consumer on a record which couldn't be parsed into a write request.
+type SkipAction int
+
+const (
+	// SkipActionSkip logs and skips the record, so that it's never pushed to the storage.
+	SkipActionSkip SkipAction = iota
+	// SkipActionAbort aborts the consumption of the batch with the parse error, like a server error,
+	// so that the batch is retried and eventually handed over to the PoisonPolicy.
+	SkipActionAbort
+	// SkipActionFallback pushes the fallback write request of the SkipDecision in place of the record.
+	SkipActionFallback
+)
+
+func (a SkipAction) String() string {
+	switch a {
+	case SkipActionSkip:
+		return "skip"
+	case SkipActionAbort:
+		return "abort"
+	case SkipActionFallback:
+		return "fallback"
+	default:
+		return "unknown"
+	}
+}
+
+// SkipDecision is the decision taken by a SkipPolicy on a record which couldn't be parsed.
+type SkipDecision struct {
+	Action SkipAction
+	// Fallback is the write request pushed in place of the record when Action is SkipActionFallback, for example
+	// the record decoded with a legacy format. The record is skipped if it's nil. The write request is owned by the
+	// consumer once returned, and it's processed like any other decoded write request.
+	Fallback *mimirpb.WriteRequest
+}
+
+// SkippedRecord describes a record which couldn't be parsed into a write request.
+type SkippedRecord struct {
+	// Index is the position of the record in the consumed batch.
+	Index int
+	// Offset is the offset of the record in the partition.
+	Offset int64
+	// TenantID is the tenant the record has been written with.
+	TenantID string
+	// Content is the content of the record. It must not be retained after the SkipPolicy returns.
+	Content []byte
+	// Err is the error which prevented the record from being parsed.
+	Err error
+}
+
+// SkipPolicy decides what to do with a record which couldn't be parsed into a write request, because it's corrupted
+// or it's been rejected by the checks run while decoding it. It's consulted once per such record, by the consuming
+// goroutine, so it should return quickly. The records rejected because their tenant has too many bytes in flight
+// and the records whose decoding panicked aren't parse errors, so they're never handed over to the SkipPolicy.
+type SkipPolicy interface {
+	Decide(ctx context.Context, rec SkippedRecord) SkipDecision
+}
+
+// SkipPolicyFunc is a function that implements SkipPolicy.
+type SkipPolicyFunc func(ctx context.Context, rec SkippedRecord) SkipDecision
+
+func (f SkipPolicyFunc) Decide(ctx context.Context, rec SkippedRecord) SkipDecision {
+	return f(ctx, rec)
+}
+
+// skipRecordPolicy is the default SkipPolicy. It always skips the record.
+var skipRecordPolicy = SkipPolicyFunc(func(context.Context, SkippedRecord) SkipDecision {
+	return SkipDecision{Action: SkipActionSkip}
+})
+
+// WithSkipPolicy configures the SkipPolicy consulted for each record which couldn't be parsed into a write request.
+// By default, these records are logged and skipped.
+func WithSkipPolicy(policy SkipPolicy) PusherConsumerOption {
+	return func(c *pusherConsumer) {
+		c.skipPolicy = policy
+	}
+}
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package ingest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/mimir/pkg/mimirpb"
+	"github.com/grafana/mimir/pkg/util/validation"
+)
+
+func TestPusherConsumer_WithSkipPolicy(t *testing.T) {
+	valid, err := (&mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("series_1")}}).Marshal()
+	require.NoError(t, err)
+	unparseable := []byte{0x0a, 0xff}
+
+	records := []record{
+		{ctx: context.Background(), tenantID: "user-1", content: valid, offset: 10},
+		{ctx: context.Background(), tenantID: "user-2", content: unparseable, offset: 11},
+		{ctx: context.Background(), tenantID: "user-1", content: valid, offset: 12},
+	}
+
+	tests := map[string]struct {
+		decision       SkipDecision
+		expectedPushed []string
+		expectedErr    string
+	}{
+		"should skip the record": {
+			decision:       SkipDecision{Action: SkipActionSkip},
+			expectedPushed: []string{"series_1", "series_1"},
+		},
+		"should abort the consumption": {
+			decision:       SkipDecision{Action: SkipActionAbort},
+			expectedPushed: []string{"series_1"},
+			expectedErr:    "consuming record at index 1 for tenant user-2: parsing ingest consumer write request",
+		},
+		"should push the fallback request in place of the record": {
+			decision: SkipDecision{
+				Action:   SkipActionFallback,
+				Fallback: &mimirpb.WriteRequest{Timeseries: []mimirpb.PreallocTimeseries{mockPreallocTimeseries("fallback")}},
+			},
+			expectedPushed: []string{"series_1", "fallback", "series_1"},
+		},
+		"should skip the record if there's no fallback request": {
+			decision:       SkipDecision{Action: SkipActionFallback},
+			expectedPushed: []string{"series_1", "series_1"},
+		},
+	}
+
+	for testName, testData := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var pushed []string
+			pusher := pusherFunc(func(_ context.Context, request *mimirpb.WriteRequest) error {
+				pushed = append(pushed, request.Timeseries[0].Labels[0].Value)
+				return nil
+			})
+
+			var skipped []SkippedRecord
+			policy := SkipPolicyFunc(func(_ context.Context, rec SkippedRecord) SkipDecision {
+				skipped = append(skipped, rec)
+				return testData.decision
+			})
+
+			reg := prometheus.NewPedanticRegistry()
+			c := newPusherConsumer(pusher, KafkaConfig{}, validation.MockDefaultOverrides(), newPusherConsumerMetrics(reg), log.NewNopLogger(), WithSkipPolicy(policy))
+			err := c.Consume(context.Background(), records)
+			if testData.expectedErr != "" {
+				require.ErrorContains(t, err, testData.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, testData.expectedPushed, pushed)
+
+			require.Len(t, skipped, 1)
+			assert.Equal(t, 1, skipped[0].Index)
+			assert.Equal(t, int64(11), skipped[0].Offset)
+			assert.Equal(t, "user-2", skipped[0].TenantID)
+			assert.Equal(t, unparseable, skipped[0].Content)
+			assert.Error(t, skipped[0].Err)
+			assert.Equal(t, float64(1), testutil.ToFloat64(c.metrics.skipDecisions.WithLabelValues(testData.decision.Action.String())))
+		})
+	}
+}
@@ -212,6 +212,13 @@ func (w *Writer) getKafkaWriterForPartition(partitionID int32) (*KafkaProducer,
 	return newWriter, nil
 }
 
+// writeRequestSize returns the size of the write request once marshalled, without marshalling it. The size of the
+// series decoded from a record is cached, so it's cheap to compute for the write requests consumed too, as long as
+// the series which are modified have their cache invalidated.
+func writeRequestSize(req *mimirpb.WriteRequest) int {
+	return req.Size()
+}
+
 // marshalWriteRequestToRecords marshals a mimirpb.WriteRequest to one or more Kafka records.
 // The request may be split to multiple records to get that each single Kafka record
 // data size is not bigger than maxSize.
@@ -221,7 +228,7 @@ func (w *Writer) getKafkaWriterForPartition(partitionID int32) (*KafkaProducer,
 // by each individual Timeseries and Metadata: if a single Timeseries or Metadata is bigger than
 // maxSize, than the resulting record will be bigger than the limit as well.
 func marshalWriteRequestToRecords(partitionID int32, tenantID string, req *mimirpb.WriteRequest, maxSize int) ([]*kgo.Record, error) {
-	reqSize := req.Size()
+	reqSize := writeRequestSize(req)
 
 	if reqSize <= maxSize {
 		// No need to split the request. We can take a fast path.
@@ -240,7 +247,7 @@ func marshalWriteRequestsToRecords(partitionID int32, tenantID string, reqs []*m
 	records := make([]*kgo.Record, 0, len(reqs))
 
 	for _, req := range reqs {
-		rec, err := marshalWriteRequestToRecord(partitionID, tenantID, req, req.Size())
+		rec, err := marshalWriteRequestToRecord(partitionID, tenantID, req, writeRequestSize(req))
 		if err != nil {
 			return nil, err
 		}
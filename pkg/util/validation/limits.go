@@ -18,6 +18,7 @@ import (
 
 	"github.com/grafana/dskit/flagext"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/relabel"
 	"golang.org/x/time/rate"
 	"gopkg.in/yaml.v3"
@@ -62,12 +63,25 @@ const (
 	AlertmanagerMaxGrafanaConfigSizeFlag      = "alertmanager.max-grafana-config-size-bytes"
 	AlertmanagerMaxGrafanaStateSizeFlag       = "alertmanager.max-grafana-state-size-bytes"
 
+	// The policies for the labels injected into the series consumed from the ingest storage which already have them.
+	ingestStorageInjectedLabelsConflictSkip      = "skip"
+	ingestStorageInjectedLabelsConflictOverwrite = "overwrite"
+
+	// The behaviors for the series consumed from the ingest storage which are missing required labels.
+	ingestStorageMissingRequiredLabelsDrop   = "drop"
+	ingestStorageMissingRequiredLabelsReject = "reject"
+
 	// MinCompactorPartialBlockDeletionDelay is the minimum partial blocks deletion delay that can be configured in Mimir.
 	MinCompactorPartialBlockDeletionDelay = 4 * time.Hour
 )
 
 var (
 	errInvalidIngestStorageReadConsistency         = fmt.Errorf("invalid ingest storage read consistency (supported values: %s)", strings.Join(api.ReadConsistencies, ", "))
+	errInvalidIngestStorageDeniedMetricNamesRegex  = errors.New("invalid ingest storage denied metric names regex")
+	errInvalidIngestStorageInjectedLabels          = errors.New("invalid ingest storage injected labels (must be comma-separated name=value pairs with valid label names other than __name__ and non-empty values)")
+	errInvalidIngestStorageRequiredLabels          = errors.New("invalid ingest storage required labels (must be comma-separated valid label names)")
+	errInvalidIngestStorageMissingRequiredLabels   = fmt.Errorf("invalid ingest storage behavior for the series missing required labels (supported values: %s, %s)", ingestStorageMissingRequiredLabelsDrop, ingestStorageMissingRequiredLabelsReject)
+	errInvalidIngestStorageInjectedLabelsConflict  = fmt.Errorf("invalid ingest storage injected labels conflict policy (supported values: %s, %s)", ingestStorageInjectedLabelsConflictSkip, ingestStorageInjectedLabelsConflictOverwrite)
 	errInvalidMaxEstimatedChunksPerQueryMultiplier = errors.New("invalid value for -" + MaxEstimatedChunksPerQueryMultiplierFlag + ": must be 0 or greater than or equal to 1")
 )
 
@@ -240,8 +254,22 @@ type Limits struct {
 	OTelCreatedTimestampZeroIngestionEnabled bool `yaml:"otel_created_timestamp_zero_ingestion_enabled" json:"otel_created_timestamp_zero_ingestion_enabled" category:"experimental"`
 
 	// Ingest storage.
-	IngestStorageReadConsistency       string `yaml:"ingest_storage_read_consistency" json:"ingest_storage_read_consistency" category:"experimental"`
-	IngestionPartitionsTenantShardSize int    `yaml:"ingestion_partitions_tenant_shard_size" json:"ingestion_partitions_tenant_shard_size" category:"experimental"`
+	IngestStorageReadConsistency        string                 `yaml:"ingest_storage_read_consistency" json:"ingest_storage_read_consistency" category:"experimental"`
+	IngestionPartitionsTenantShardSize  int                    `yaml:"ingestion_partitions_tenant_shard_size" json:"ingestion_partitions_tenant_shard_size" category:"experimental"`
+	IngestStorageDropExemplars          bool                   `yaml:"ingest_storage_drop_exemplars" json:"ingest_storage_drop_exemplars" category:"experimental"`
+	IngestStorageDropMetadata           bool                   `yaml:"ingest_storage_drop_metadata" json:"ingest_storage_drop_metadata" category:"experimental"`
+	IngestStorageMaxInflightBytes       int                    `yaml:"ingest_storage_max_inflight_bytes" json:"ingest_storage_max_inflight_bytes" category:"experimental"`
+	IngestStorageMaxExemplarsPerSeries  int                    `yaml:"ingest_storage_max_exemplars_per_series" json:"ingest_storage_max_exemplars_per_series" category:"experimental"`
+	IngestStorageMaxExemplarAge         model.Duration         `yaml:"ingest_storage_max_exemplar_age" json:"ingest_storage_max_exemplar_age" category:"experimental"`
+	IngestStorageMaxSeries              int                    `yaml:"ingest_storage_max_series" json:"ingest_storage_max_series" category:"experimental"`
+	IngestStoragePushTimeout            model.Duration         `yaml:"ingest_storage_push_timeout" json:"ingest_storage_push_timeout" category:"experimental"`
+	IngestStorageDownsampleInterval     model.Duration         `yaml:"ingest_storage_downsample_interval" json:"ingest_storage_downsample_interval" category:"experimental"`
+	IngestStorageDeniedMetricNames      flagext.StringSliceCSV `yaml:"ingest_storage_denied_metric_names" json:"ingest_storage_denied_metric_names" category:"experimental"`
+	IngestStorageDeniedMetricNamesRegex string                 `yaml:"ingest_storage_denied_metric_names_regex" json:"ingest_storage_denied_metric_names_regex" category:"experimental"`
+	IngestStorageInjectedLabels         flagext.StringSliceCSV `yaml:"ingest_storage_injected_labels" json:"ingest_storage_injected_labels" category:"experimental"`
+	IngestStorageInjectedLabelsConflict string                 `yaml:"ingest_storage_injected_labels_conflict" json:"ingest_storage_injected_labels_conflict" category:"experimental"`
+	IngestStorageRequiredLabels         flagext.StringSliceCSV `yaml:"ingest_storage_required_labels" json:"ingest_storage_required_labels" category:"experimental"`
+	IngestStorageMissingRequiredLabels  string                 `yaml:"ingest_storage_missing_required_labels" json:"ingest_storage_missing_required_labels" category:"experimental"`
 
 	extensions map[string]interface{}
 }
@@ -391,6 +419,20 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 	// Ingest storage.
 	f.StringVar(&l.IngestStorageReadConsistency, "ingest-storage.read-consistency", api.ReadConsistencyEventual, fmt.Sprintf("The default consistency level to enforce for queries when using the ingest storage. Supports values: %s.", strings.Join(api.ReadConsistencies, ", ")))
 	f.IntVar(&l.IngestionPartitionsTenantShardSize, "ingest-storage.ingestion-partition-tenant-shard-size", 0, "The number of partitions a tenant's data should be sharded to when using the ingest storage. Tenants are sharded across partitions using shuffle-sharding. 0 disables shuffle sharding and tenant is sharded across all partitions.")
+	f.BoolVar(&l.IngestStorageDropExemplars, "ingest-storage.drop-exemplars", false, "True to drop the exemplars of the write requests consumed from the ingest storage before ingesting them. The samples of the write requests are still ingested.")
+	f.BoolVar(&l.IngestStorageDropMetadata, "ingest-storage.drop-metadata", false, "True to drop the metadata of the write requests consumed from the ingest storage before ingesting them. The samples of the write requests are still ingested.")
+	f.IntVar(&l.IngestStorageMaxInflightBytes, "ingest-storage.max-inflight-bytes", 0, "The maximum total size, in bytes, of the tenant's records consumed from the ingest storage which are being decoded or waiting to be ingested. The records exceeding the limit are decoded once the other records of the tenant have been ingested, while the records of the other tenants are unaffected. A record is always accepted if no other record of the tenant is in flight. 0 to disable.")
+	f.IntVar(&l.IngestStorageMaxExemplarsPerSeries, "ingest-storage.max-exemplars-per-series", 0, "The maximum number of exemplars per series of the write requests consumed from the ingest storage. The oldest exemplars exceeding the limit are dropped before ingesting the write requests. 0 to disable.")
+	f.Var(&l.IngestStorageDeniedMetricNames, "ingest-storage.denied-metric-names", "Comma-separated list of metric names whose series are dropped from the write requests consumed from the ingest storage before ingesting them.")
+	f.StringVar(&l.IngestStorageDeniedMetricNamesRegex, "ingest-storage.denied-metric-names-regex", "", "Regular expression matching the metric names whose series are dropped from the write requests consumed from the ingest storage before ingesting them, in addition to -ingest-storage.denied-metric-names. The regular expression is anchored to the whole metric name. Empty to disable.")
+	f.Var(&l.IngestStorageInjectedLabels, "ingest-storage.injected-labels", "Comma-separated list of name=value labels injected into every series of the write requests consumed from the ingest storage before ingesting them, for example to tag the series with their ingestion origin.")
+	f.StringVar(&l.IngestStorageInjectedLabelsConflict, "ingest-storage.injected-labels-conflict", ingestStorageInjectedLabelsConflictSkip, fmt.Sprintf("What to do when a series of the write requests consumed from the ingest storage already has a label of -ingest-storage.injected-labels. With %[1]q, the label of the series is kept. With %[2]q, its value is replaced by the injected one. Supported values: %[1]s, %[2]s.", ingestStorageInjectedLabelsConflictSkip, ingestStorageInjectedLabelsConflictOverwrite))
+	f.Var(&l.IngestStorageRequiredLabels, "ingest-storage.required-labels", "Comma-separated list of label names every series of the write requests consumed from the ingest storage must have, after the labels of -ingest-storage.injected-labels have been injected. The series missing any of them are handled according to -ingest-storage.missing-required-labels.")
+	f.StringVar(&l.IngestStorageMissingRequiredLabels, "ingest-storage.missing-required-labels", ingestStorageMissingRequiredLabelsDrop, fmt.Sprintf("What to do with the series of the write requests consumed from the ingest storage which are missing any of the labels of -ingest-storage.required-labels. With %[1]q, those series are dropped, while the other series of the same write requests are ingested. With %[2]q, the whole write requests are skipped as a client error. Supported values: %[1]s, %[2]s.", ingestStorageMissingRequiredLabelsDrop, ingestStorageMissingRequiredLabelsReject))
+	f.IntVar(&l.IngestStorageMaxSeries, "ingest-storage.max-series", 0, "The maximum number of active series of the tenant which can be ingested from the write requests consumed from the ingest storage. Once the limit is reached, the new series of the write requests are dropped, while the samples of the active series are still ingested. A series is active until it hasn't been consumed for -ingest-storage.kafka.max-series-idle-timeout. The active series are tracked by each partition consumer, so the limit applies to the series of each partition. 0 to disable.")
+	f.Var(&l.IngestStoragePushTimeout, "ingest-storage.push-timeout", "The base timeout of the push of each of the tenant's records consumed from the ingest storage, overriding -ingest-storage.kafka.ingestion-push-timeout, for example for the tenants whose pushes are known to be slower. The timeout still scales with the size of the write requests according to -ingest-storage.kafka.ingestion-push-timeout-per-kib, up to -ingest-storage.kafka.ingestion-push-max-timeout or this value, whichever is the highest. 0 to use -ingest-storage.kafka.ingestion-push-timeout.")
+	f.Var(&l.IngestStorageDownsampleInterval, "ingest-storage.downsample-interval", "The interval the samples of the write requests consumed from the ingest storage are down-sampled to, for example for the tenants backfilling historical data. Only the first float sample and the first histogram sample of each series in each interval of each write request are ingested, while the series themselves are always ingested. 0 to disable.")
+	f.Var(&l.IngestStorageMaxExemplarAge, "ingest-storage.max-exemplar-age", "The maximum age of the exemplars of the write requests consumed from the ingest storage. Older exemplars are dropped before ingesting the write requests, while their series and samples are still ingested. 0 to disable.")
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -465,6 +507,31 @@ func (l *Limits) validate() error {
 		return errInvalidIngestStorageReadConsistency
 	}
 
+	if _, err := labels.NewFastRegexMatcher(l.IngestStorageDeniedMetricNamesRegex); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidIngestStorageDeniedMetricNamesRegex, err)
+	}
+
+	for _, lbl := range l.IngestStorageInjectedLabels {
+		name, value, _ := strings.Cut(lbl, "=")
+		if value == "" || name == labels.MetricName || !model.LabelName(name).IsValid() {
+			return fmt.Errorf("%w: %q", errInvalidIngestStorageInjectedLabels, lbl)
+		}
+	}
+
+	for _, name := range l.IngestStorageRequiredLabels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("%w: %q", errInvalidIngestStorageRequiredLabels, name)
+		}
+	}
+
+	if l.IngestStorageMissingRequiredLabels != ingestStorageMissingRequiredLabelsDrop && l.IngestStorageMissingRequiredLabels != ingestStorageMissingRequiredLabelsReject {
+		return errInvalidIngestStorageMissingRequiredLabels
+	}
+
+	if l.IngestStorageInjectedLabelsConflict != ingestStorageInjectedLabelsConflictSkip && l.IngestStorageInjectedLabelsConflict != ingestStorageInjectedLabelsConflictOverwrite {
+		return errInvalidIngestStorageInjectedLabelsConflict
+	}
+
 	return nil
 }
 
@@ -1104,6 +1171,84 @@ func (o *Overrides) IngestionPartitionsTenantShardSize(userID string) int {
 	return o.getOverridesForUser(userID).IngestionPartitionsTenantShardSize
 }
 
+// IngestStorageDropExemplars returns whether the exemplars of the write requests consumed from the ingest storage should be dropped.
+func (o *Overrides) IngestStorageDropExemplars(userID string) bool {
+	return o.getOverridesForUser(userID).IngestStorageDropExemplars
+}
+
+// IngestStorageDropMetadata returns whether the metadata of the write requests consumed from the ingest storage should be dropped.
+func (o *Overrides) IngestStorageDropMetadata(userID string) bool {
+	return o.getOverridesForUser(userID).IngestStorageDropMetadata
+}
+
+// IngestStorageMaxExemplarsPerSeries returns the maximum number of exemplars per series of the write requests consumed from the ingest storage.
+func (o *Overrides) IngestStorageMaxExemplarsPerSeries(userID string) int {
+	return o.getOverridesForUser(userID).IngestStorageMaxExemplarsPerSeries
+}
+
+// IngestStorageDeniedMetricNames returns the metric names whose series are dropped from the write requests consumed from the ingest storage.
+func (o *Overrides) IngestStorageDeniedMetricNames(userID string) []string {
+	return o.getOverridesForUser(userID).IngestStorageDeniedMetricNames
+}
+
+// IngestStorageDeniedMetricNamesRegex returns the regular expression matching the metric names whose series are dropped
+// from the write requests consumed from the ingest storage.
+func (o *Overrides) IngestStorageDeniedMetricNamesRegex(userID string) string {
+	return o.getOverridesForUser(userID).IngestStorageDeniedMetricNamesRegex
+}
+
+// IngestStorageInjectedLabels returns the name=value labels injected into every series of the write requests consumed
+// from the ingest storage.
+func (o *Overrides) IngestStorageInjectedLabels(userID string) []string {
+	return o.getOverridesForUser(userID).IngestStorageInjectedLabels
+}
+
+// IngestStorageInjectedLabelsOverwrite returns whether the injected labels overwrite the labels with the same name of
+// the series consumed from the ingest storage.
+func (o *Overrides) IngestStorageInjectedLabelsOverwrite(userID string) bool {
+	return o.getOverridesForUser(userID).IngestStorageInjectedLabelsConflict == ingestStorageInjectedLabelsConflictOverwrite
+}
+
+// IngestStorageRequiredLabels returns the label names every series of the write requests consumed from the ingest
+// storage must have.
+func (o *Overrides) IngestStorageRequiredLabels(userID string) []string {
+	return o.getOverridesForUser(userID).IngestStorageRequiredLabels
+}
+
+// IngestStorageRejectMissingRequiredLabels returns whether the write requests consumed from the ingest storage with
+// series missing required labels are rejected, instead of dropping those series only.
+func (o *Overrides) IngestStorageRejectMissingRequiredLabels(userID string) bool {
+	return o.getOverridesForUser(userID).IngestStorageMissingRequiredLabels == ingestStorageMissingRequiredLabelsReject
+}
+
+// IngestStorageMaxExemplarAge returns the maximum age of the exemplars of the write requests consumed from the ingest storage.
+func (o *Overrides) IngestStorageMaxExemplarAge(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).IngestStorageMaxExemplarAge)
+}
+
+// IngestStorageMaxSeries returns the maximum number of active series of the tenant which can be ingested from the
+// write requests consumed from the ingest storage.
+func (o *Overrides) IngestStorageMaxSeries(userID string) int {
+	return o.getOverridesForUser(userID).IngestStorageMaxSeries
+}
+
+// IngestStoragePushTimeout returns the base timeout of the push of each of the tenant's records consumed from the
+// ingest storage, or 0 if the global timeout applies.
+func (o *Overrides) IngestStoragePushTimeout(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).IngestStoragePushTimeout)
+}
+
+// IngestStorageDownsampleInterval returns the interval the samples of the tenant's write requests consumed from the
+// ingest storage are down-sampled to, or 0 if they aren't down-sampled.
+func (o *Overrides) IngestStorageDownsampleInterval(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).IngestStorageDownsampleInterval)
+}
+
+// IngestStorageMaxInflightBytes returns the maximum size of the tenant's records consumed from the ingest storage which can be in flight.
+func (o *Overrides) IngestStorageMaxInflightBytes(userID string) int {
+	return o.getOverridesForUser(userID).IngestStorageMaxInflightBytes
+}
+
 func (o *Overrides) getOverridesForUser(userID string) *Limits {
 	if o.tenantLimits != nil {
 		l := o.tenantLimits.ByUserID(userID)
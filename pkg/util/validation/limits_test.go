@@ -1076,6 +1076,50 @@ metric_relabel_configs:
 			cfg:         `ingest_storage_read_consistency: xyz`,
 			expectedErr: errInvalidIngestStorageReadConsistency.Error(),
 		},
+		"should fail on invalid ingest_storage_denied_metric_names_regex": {
+			cfg:         `ingest_storage_denied_metric_names_regex: "debug_(.*"`,
+			expectedErr: errInvalidIngestStorageDeniedMetricNamesRegex.Error(),
+		},
+		"should pass on valid ingest_storage_denied_metric_names_regex": {
+			cfg:         `ingest_storage_denied_metric_names_regex: "debug_.*"`,
+			expectedErr: "",
+		},
+		"should fail on ingest_storage_injected_labels without a value": {
+			cfg:         `ingest_storage_injected_labels: "__ingest_source__"`,
+			expectedErr: errInvalidIngestStorageInjectedLabels.Error(),
+		},
+		"should fail on ingest_storage_injected_labels with an invalid label name": {
+			cfg:         `ingest_storage_injected_labels: "ingest-source=kafka"`,
+			expectedErr: errInvalidIngestStorageInjectedLabels.Error(),
+		},
+		"should fail on ingest_storage_injected_labels with the metric name": {
+			cfg:         `ingest_storage_injected_labels: "__name__=up"`,
+			expectedErr: errInvalidIngestStorageInjectedLabels.Error(),
+		},
+		"should fail on ingest_storage_injected_labels with an empty value": {
+			cfg:         `ingest_storage_injected_labels: "cluster="`,
+			expectedErr: errInvalidIngestStorageInjectedLabels.Error(),
+		},
+		"should pass on valid ingest_storage_injected_labels": {
+			cfg:         `ingest_storage_injected_labels: "__ingest_source__=kafka,cluster=eu=west"`,
+			expectedErr: "",
+		},
+		"should fail on invalid ingest_storage_required_labels": {
+			cfg:         `ingest_storage_required_labels: "cluster,name-space"`,
+			expectedErr: errInvalidIngestStorageRequiredLabels.Error(),
+		},
+		"should pass on valid ingest_storage_required_labels": {
+			cfg:         `ingest_storage_required_labels: "cluster,namespace"`,
+			expectedErr: "",
+		},
+		"should fail on invalid ingest_storage_missing_required_labels": {
+			cfg:         `ingest_storage_missing_required_labels: xyz`,
+			expectedErr: errInvalidIngestStorageMissingRequiredLabels.Error(),
+		},
+		"should fail on invalid ingest_storage_injected_labels_conflict": {
+			cfg:         `ingest_storage_injected_labels_conflict: xyz`,
+			expectedErr: errInvalidIngestStorageInjectedLabelsConflict.Error(),
+		},
 	}
 
 	for testName, testData := range tests {